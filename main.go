@@ -2,93 +2,149 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/goodjobs/maps-api-cache/pkg/geocache"
 	"github.com/redis/go-redis/v9"
 )
 
-func setupRedis(config Config) (*redis.Client, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%s", config.RedisHost, config.RedisPort),
-		DB:   0,
-	})
+// setupRedis creates the Redis client and checks the connection. The client
+// is returned even when Redis is unreachable, since it reconnects on its own.
+func setupRedis(config geocache.Config, logger *geocache.Logger) (*redis.Client, error) {
+	rdb := geocache.NewRedisClient(&redis.Options{DB: 0}, config, logger)
 
 	if err := rdb.Ping(context.Background()).Err(); err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+		return rdb, fmt.Errorf("failed to connect to Redis: %v", err)
 	}
 	return rdb, nil
 }
 
-func isIPAllowed(remoteAddr string, cidrs []string) bool {
-	host, _, err := net.SplitHostPort(remoteAddr)
-	if err != nil {
-		host = remoteAddr // fallback if not in host:port format
-	}
-	ip := net.ParseIP(host)
-	if ip == nil {
-		return false
-	}
-	for _, cidr := range cidrs {
-		_, network, err := net.ParseCIDR(cidr)
-		if err == nil && network.Contains(ip) {
-			return true
+// waitForRedis pings Redis with exponential backoff until it answers, so the
+// server can start serving (uncached) before its dependencies are up.
+func waitForRedis(rdb *redis.Client, logger *geocache.Logger, initial, maxDelay time.Duration) {
+	delay := initial
+	for {
+		time.Sleep(delay)
+		err := rdb.Ping(context.Background()).Err()
+		if err == nil {
+			logger.Log(geocache.LogInfo, "Connected to Redis")
+			return
 		}
+		delay = min(2*delay, maxDelay)
+		logger.Log(geocache.LogWarning, "Redis still unreachable, retrying in %s: %v", delay, err)
 	}
-	return false
 }
 
-func setupServer(logger *Logger, rdb *redis.Client, config Config) *http.ServeMux {
-	mux := http.NewServeMux()
-	server := NewServer(logger, rdb, config, nil)
-
-	mux.Handle("/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf("ok\nversion: %s\n", apiConfig.Version)))
-	}))
-
-	metricsHandler := promhttp.Handler()
-	mux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if len(config.AllowedMetricsCIDRs) > 0 && !isIPAllowed(r.RemoteAddr, config.AllowedMetricsCIDRs) {
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte("Forbidden\n"))
-			return
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err := geocache.RunSimulation(os.Args[2:], os.Stdout); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				os.Exit(2)
+			}
+			fmt.Fprintf(os.Stderr, "simulate: %v\n", err)
+			os.Exit(1)
 		}
-		metricsHandler.ServeHTTP(w, r)
-	}))
-
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" {
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("Google Maps Proxy\nThis service proxies requests to Google Maps and caches responses.\nStatus: alive\n"))
-			return
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "metrics-rules" {
+		if err := geocache.RunMetricsRules(os.Args[2:], os.Stdout); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				os.Exit(2)
+			}
+			fmt.Fprintf(os.Stderr, "metrics-rules: %v\n", err)
+			os.Exit(1)
 		}
-		server.logMiddleware(http.HandlerFunc(server.query)).ServeHTTP(w, r)
-	})
+		return
+	}
 
-	return mux
-}
+	if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		if err := geocache.RunRekey(os.Args[2:], os.Stdout); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				os.Exit(2)
+			}
+			fmt.Fprintf(os.Stderr, "rekey: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-func main() {
-	config := LoadConfig()
-	logger := NewLogger(config.LogFormat == "gcp")
+	config := geocache.LoadConfig()
+	logger := geocache.NewLoggerFromConfig(config)
 
-	rdb, err := setupRedis(config)
+	rdb, err := setupRedis(config, logger)
 	if err != nil {
-		logger.log(LogCritical, err.Error())
-		os.Exit(1)
+		logger.Log(geocache.LogWarning, "%v; serving without cache until it is reachable", err)
+		go waitForRedis(rdb, logger, time.Second, 30*time.Second)
 	}
 
-	mux := setupServer(logger, rdb, config)
+	handler := geocache.New(
+		geocache.WithConfig(config),
+		geocache.WithLogger(logger),
+		geocache.WithRedis(rdb),
+	)
 
-	addr := fmt.Sprintf(":%s", config.ServerPort)
-	logger.log(LogInfo, "Starting server on %s", addr)
-	if err := http.ListenAndServe(addr, corsMiddleware(prometheusMiddleware(mux))); err != nil {
-		logger.log(LogCritical, "Server failed: %v", err)
+	server := &http.Server{Handler: handler, ConnContext: geocache.ConnContext}
+	if config.TLSCertFile != "" {
+		certs, err := geocache.NewCertReloader(config.TLSCertFile, config.TLSKeyFile, logger)
+		if err != nil {
+			logger.Log(geocache.LogCritical, "Failed to load TLS certificate: %v", err)
+			logger.Flush()
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+	}
+
+	listener, err := geocache.Listen(config)
+	if err != nil {
+		logger.Log(geocache.LogCritical, "Failed to listen: %v", err)
+		logger.Flush()
 		os.Exit(1)
 	}
+	logger.Log(geocache.LogInfo, "Starting server on %s (%s)", listener.Addr(), config.ListenNetwork)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	// Serve returns as soon as Shutdown is called; stopped is closed once
+	// the open requests have been served.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-stop
+		logger.Log(geocache.LogInfo, "Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Log(geocache.LogWarning, "Failed to finish serving open requests: %v", err)
+		}
+	}()
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Log(geocache.LogCritical, "Server failed: %v", err)
+		logger.Flush()
+		os.Exit(1)
+	}
+	<-stopped
+	shutdown(logger, config.ShutdownTimeout)
+}
+
+// shutdown writes the analytics events and log records still buffered once
+// the server has stopped accepting requests.
+func shutdown(logger *geocache.Logger, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := geocache.FlushEvents(ctx); err != nil {
+		logger.Log(geocache.LogWarning, "Failed to flush events: %v", err)
+	}
+	logger.Flush()
 }
@@ -1,98 +1,13 @@
 package main
 
 import (
-	"net/http"
-	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
-	"github.com/redis/go-redis/v9"
+	"github.com/goodjobs/maps-api-cache/pkg/geocache"
 )
 
-func TestSetupServer(t *testing.T) {
-	// Start miniredis for a mock Redis server
-	mr, err := miniredis.Run()
-	if err != nil {
-		t.Fatalf("Failed to start miniredis: %v", err)
-	}
-	defer mr.Close()
-
-	logger := NewLogger(false)
-	config := Config{
-		RedisHost:    mr.Host(),
-		RedisPort:    mr.Port(),
-		BaseURL:      "https://maps.googleapis.com",
-		CacheTimeout: 720 * time.Hour,
-	}
-
-	rdb := redis.NewClient(&redis.Options{
-		Addr: mr.Addr(),
-		DB:   0,
-	})
-	defer rdb.Close()
-
-	mux := setupServer(logger, rdb, config)
-	handler := corsMiddleware(mux) // Wrap mux with CORS middleware
-
-	tests := []struct {
-		name           string
-		path           string
-		method         string
-		expectedStatus int
-		headers        map[string]string
-	}{
-		{
-			name:           "health check",
-			path:           "/health",
-			method:         "GET",
-			expectedStatus: http.StatusOK,
-		},
-		{
-			name:           "query endpoint without API key",
-			path:           "/maps/api/geocode/json?address=test",
-			method:         "GET",
-			expectedStatus: http.StatusOK, // Server forwards request to Google Maps API without validation
-		},
-		{
-			name:           "query endpoint with API key header",
-			path:           "/maps/api/geocode/json?address=test",
-			method:         "GET",
-			expectedStatus: http.StatusOK,
-			headers: map[string]string{
-				"X-Maps-API-Key": "test-key",
-			},
-		},
-		{
-			name:           "CORS preflight request",
-			path:           "/maps/api/geocode/json",
-			method:         "OPTIONS",
-			expectedStatus: http.StatusOK,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest(tt.method, tt.path, nil)
-			for k, v := range tt.headers {
-				req.Header.Set(k, v)
-			}
-			w := httptest.NewRecorder()
-			handler.ServeHTTP(w, req) // Use handler instead of mux
-
-			if w.Code != tt.expectedStatus {
-				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
-			}
-
-			if tt.method == "OPTIONS" {
-				if w.Header().Get("Access-Control-Allow-Origin") == "" {
-					t.Error("Expected CORS headers in response")
-				}
-			}
-		})
-	}
-}
-
 func TestSetupRedis(t *testing.T) {
 	// Start miniredis
 	mr, err := miniredis.Run()
@@ -103,12 +18,12 @@ func TestSetupRedis(t *testing.T) {
 
 	tests := []struct {
 		name        string
-		config      Config
+		config      geocache.Config
 		shouldError bool
 	}{
 		{
 			name: "valid config",
-			config: Config{
+			config: geocache.Config{
 				RedisHost: mr.Host(),
 				RedisPort: mr.Port(),
 			},
@@ -116,7 +31,7 @@ func TestSetupRedis(t *testing.T) {
 		},
 		{
 			name: "invalid host",
-			config: Config{
+			config: geocache.Config{
 				RedisHost: "nonexistent-host",
 				RedisPort: "12345",
 			},
@@ -126,7 +41,7 @@ func TestSetupRedis(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			client, err := setupRedis(tt.config)
+			client, err := setupRedis(tt.config, geocache.NewLogger(false))
 			if tt.shouldError && err == nil {
 				t.Error("Expected error but got none")
 			}
@@ -139,3 +54,38 @@ func TestSetupRedis(t *testing.T) {
 		})
 	}
 }
+
+func TestWaitForRedis(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	defer mr.Close()
+	config := geocache.Config{RedisHost: mr.Host(), RedisPort: mr.Port()}
+	mr.Close()
+
+	client, err := setupRedis(config, geocache.NewLogger(false))
+	if err == nil {
+		t.Fatal("Expected an error while Redis is down")
+	}
+	if client == nil {
+		t.Fatal("Expected a client even when Redis is down")
+	}
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		waitForRedis(client, geocache.NewLogger(false), 10*time.Millisecond, 50*time.Millisecond)
+		close(done)
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("Failed to restart miniredis: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected waitForRedis to return once Redis is reachable")
+	}
+}
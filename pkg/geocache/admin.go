@@ -0,0 +1,85 @@
+package geocache
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// adminHandler serves the /admin/ API. Requests are only accepted from
+// AllowedAdminCIDRs; the API is disabled entirely when none are configured.
+// When AdminTokens are configured, requests must also carry a bearer token
+// with the scope required by the endpoint. Every admin request is audited.
+// With AdminUI, the operator page at /admin/ui is served without a token.
+// Endpoints backed by auxiliary Redis indexes are only registered when the
+// server has a Redis client.
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	if s.redis != nil {
+		mux.HandleFunc("GET /admin/reports/duplicates", requireScope(ScopeStatsRead, s.handleGetDuplicateReport))
+		mux.HandleFunc("POST /admin/reports/duplicates", requireScope(ScopeCacheWrite, s.handleStartDuplicateReport))
+		if s.usageTally != nil {
+			mux.HandleFunc("GET /admin/reports/usage", requireScope(ScopeStatsRead, s.handleUsageReport))
+		}
+		mux.HandleFunc("GET /admin/places/top", requireScope(ScopeStatsRead, s.handleTopPlaces))
+		mux.HandleFunc("GET /admin/hotkeys", requireScope(ScopeStatsRead, s.handleHotKeys))
+		mux.HandleFunc("GET /admin/places/{id}", requireScope(ScopeStatsRead, s.handleGetPlace))
+		mux.HandleFunc("DELETE /admin/places/{id}", requireScope(ScopeCachePurge, s.handlePurgePlace))
+		mux.HandleFunc("GET /admin/overrides", requireScope(ScopeStatsRead, s.handleListOverrides))
+		mux.HandleFunc("PUT /admin/overrides", requireScope(ScopeCacheWrite, s.handlePutOverride))
+		mux.HandleFunc("DELETE /admin/overrides", requireScope(ScopeCacheWrite, s.handleDeleteOverride))
+		mux.HandleFunc("GET /admin/bans", requireScope(ScopeStatsRead, s.handleListBans))
+		mux.HandleFunc("DELETE /admin/bans/{client}", requireScope(ScopeBansWrite, s.handleUnban))
+		mux.HandleFunc("POST /admin/captures", requireScope(ScopeCapture, s.handleStartCapture))
+		mux.HandleFunc("GET /admin/captures", requireScope(ScopeCapture, s.handleListCaptures))
+		mux.HandleFunc("GET /admin/captures/{id}", requireScope(ScopeCapture, s.handleDownloadCapture))
+		mux.HandleFunc("DELETE /admin/captures/{id}", requireScope(ScopeCapture, s.handleDeleteCapture))
+		mux.HandleFunc("GET /admin/sync", requireScope(ScopeCacheSync, s.handleSync))
+		mux.HandleFunc("POST /admin/integrity", requireScope(ScopeCachePurge, s.handleIntegritySweep))
+	}
+	mux.HandleFunc("POST /admin/refresh", requireScope(ScopeCacheWrite, s.handleRefresh))
+	mux.HandleFunc("GET /admin/stats", requireScope(ScopeStatsRead, s.handleStats))
+	if s.slow != nil {
+		mux.HandleFunc("GET /admin/slow", requireScope(ScopeStatsRead, s.handleSlowRequests))
+	}
+	mux.HandleFunc("GET /admin/maintenance", requireScope(ScopeStatsRead, s.handleGetMaintenance))
+	mux.HandleFunc("PUT /admin/maintenance", requireScope(ScopeConfigReload, s.handlePutMaintenance))
+	mux.HandleFunc("POST /admin/selftest", requireScope(ScopeCacheWrite, s.handleSelfTest))
+	mux.HandleFunc("GET /admin/rules", requireScope(ScopeStatsRead, s.handleListRules))
+	mux.HandleFunc("GET /admin/rules/match", requireScope(ScopeStatsRead, s.handleMatchRule))
+	mux.HandleFunc("GET /admin/quarantines", requireScope(ScopeStatsRead, s.handleListQuarantines))
+	mux.HandleFunc("POST /admin/quarantines", requireScope(ScopeCachePurge, s.handlePutQuarantine))
+	mux.HandleFunc("DELETE /admin/quarantines/{id}", requireScope(ScopeCachePurge, s.handleDeleteQuarantine))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := s.liveConfig()
+		if len(config.AllowedAdminCIDRs) == 0 || !isIPAllowed(r.RemoteAddr, config.AllowedAdminCIDRs) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden\n"))
+			return
+		}
+		if s.config.AdminUI && r.Method == http.MethodGet && r.URL.Path == adminUIPath {
+			s.handleAdminUI(w, r)
+			return
+		}
+		id, ok := authenticateAdmin(parseAdminTokens(config.AdminTokens), r)
+		if !ok {
+			s.auditLog.Record("anonymous", AuditAuthFailure, map[string]string{
+				"remote_addr": r.RemoteAddr,
+				"method":      r.Method,
+				"path":        r.URL.Path,
+			})
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or invalid bearer token"})
+			return
+		}
+		sw := newStatusResponseWriter(w)
+		mux.ServeHTTP(sw, withAdminIdentity(r, id))
+		s.auditRequest(r, id.actor, sw.statusCode)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
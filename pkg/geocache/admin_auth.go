@@ -0,0 +1,133 @@
+package geocache
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Admin token scopes. ScopeAll grants every scope.
+const (
+	ScopeStatsRead    = "stats:read"
+	ScopeCacheWrite   = "cache:write"
+	ScopeCachePurge   = "cache:purge"
+	ScopeConfigReload = "config:reload"
+	ScopeBansWrite    = "bans:write"
+	ScopeCapture      = "traffic:capture"
+	ScopeSnapshotRead = "snapshots:read"
+	ScopeCacheSync    = "cache:sync"
+	ScopeAll          = "*"
+)
+
+// adminToken is a bearer token accepted by the admin API. The secret is
+// either the token itself or, when hashed is set, its hex SHA-256 digest.
+type adminToken struct {
+	name   string
+	secret string
+	hashed bool
+	scopes map[string]bool
+}
+
+// parseAdminTokens parses Config.AdminTokens. Keys are "name:token" or
+// "name:sha256:<hex digest>", values are "|"-separated scopes. Entries
+// without a name or secret are ignored.
+func parseAdminTokens(raw map[string]string) []adminToken {
+	var tokens []adminToken
+	for key, scopeList := range raw {
+		name, secret, ok := strings.Cut(key, ":")
+		if !ok || name == "" || secret == "" {
+			continue
+		}
+		t := adminToken{name: name, secret: secret, scopes: make(map[string]bool)}
+		if digest, ok := strings.CutPrefix(secret, "sha256:"); ok {
+			t.secret = strings.ToLower(digest)
+			t.hashed = true
+		}
+		for _, scope := range strings.Split(scopeList, "|") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				t.scopes[scope] = true
+			}
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+func (t *adminToken) matches(presented string) bool {
+	candidate := presented
+	if t.hashed {
+		sum := sha256.Sum256([]byte(presented))
+		candidate = hex.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(candidate), []byte(t.secret)) == 1
+}
+
+func (t *adminToken) allows(scope string) bool {
+	return t.scopes[ScopeAll] || t.scopes[scope]
+}
+
+// adminIdentity is the authenticated caller of an admin request. token is
+// nil when the admin API runs without tokens.
+type adminIdentity struct {
+	actor string
+	token *adminToken
+}
+
+type adminIdentityKey struct{}
+
+// authenticateAdmin resolves the bearer token of r. With no tokens
+// configured every caller is accepted and identified by its address.
+func authenticateAdmin(tokens []adminToken, r *http.Request) (*adminIdentity, bool) {
+	if len(tokens) == 0 {
+		return &adminIdentity{actor: "ip:" + addrHost(r.RemoteAddr)}, true
+	}
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || presented == "" {
+		return nil, false
+	}
+	for i := range tokens {
+		if tokens[i].matches(presented) {
+			return &adminIdentity{actor: "token:" + tokens[i].name, token: &tokens[i]}, true
+		}
+	}
+	return nil, false
+}
+
+// requireScope rejects admin requests whose token lacks scope. Without
+// configured tokens all scopes are granted.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := r.Context().Value(adminIdentityKey{}).(*adminIdentity)
+		if id == nil || (id.token != nil && !id.token.allows(scope)) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "token lacks scope " + scope})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// auditRequest records an admin request and its outcome in the audit log.
+func (s *Server) auditRequest(r *http.Request, actor string, status int) {
+	s.auditLog.Record(actor, AuditAdminRequest, map[string]string{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"query":  r.URL.RawQuery,
+		"status": strconv.Itoa(status),
+	})
+}
+
+// adminActor returns the actor of an authenticated admin request.
+func adminActor(r *http.Request) string {
+	if id, ok := r.Context().Value(adminIdentityKey{}).(*adminIdentity); ok {
+		return id.actor
+	}
+	return "unknown"
+}
+
+func withAdminIdentity(r *http.Request, id *adminIdentity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, id))
+}
@@ -0,0 +1,143 @@
+package geocache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler_AccessControl(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+
+	tests := []struct {
+		name           string
+		allowedCIDRs   []string
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{
+			name:           "disabled when no CIDRs configured",
+			remoteAddr:     "192.0.2.1:1234",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "rejects address outside allowed CIDRs",
+			allowedCIDRs:   []string{"10.0.0.0/8"},
+			remoteAddr:     "192.0.2.1:1234",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "accepts address inside allowed CIDRs",
+			allowedCIDRs:   []string{"192.0.2.0/24"},
+			remoteAddr:     "192.0.2.1:1234",
+			expectedStatus: http.StatusNotFound, // no report has run yet
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.config.AllowedAdminCIDRs = tt.allowedCIDRs
+			req := httptest.NewRequest(http.MethodGet, "/admin/reports/duplicates", nil)
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			server.adminHandler().ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestAdminHandler_TokenAuth(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+
+	digest := sha256.Sum256([]byte("hashed-secret"))
+	server.config.AdminTokens = map[string]string{
+		"reader:read-secret": ScopeStatsRead,
+		"ops:ops-secret":     ScopeAll,
+		"purger:sha256:" + hex.EncodeToString(digest[:]): ScopeCachePurge + "|" + ScopeStatsRead,
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		authorization  string
+		expectedStatus int
+	}{
+		{
+			name:           "missing token",
+			method:         http.MethodGet,
+			path:           "/admin/places/top",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "unknown token",
+			method:         http.MethodGet,
+			path:           "/admin/places/top",
+			authorization:  "Bearer wrong",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "token with scope",
+			method:         http.MethodGet,
+			path:           "/admin/places/top",
+			authorization:  "Bearer read-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "token without scope",
+			method:         http.MethodDelete,
+			path:           "/admin/places/ChIJ1",
+			authorization:  "Bearer read-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "read scope cannot start a job",
+			method:         http.MethodPost,
+			path:           "/admin/reports/duplicates",
+			authorization:  "Bearer read-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "hashed token with scope",
+			method:         http.MethodDelete,
+			path:           "/admin/places/ChIJ1",
+			authorization:  "Bearer hashed-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "wildcard scope",
+			method:         http.MethodPost,
+			path:           "/admin/refresh",
+			authorization:  "Bearer ops-secret",
+			expectedStatus: http.StatusBadRequest, // no uri given
+		},
+	}
+
+	handler := server.adminHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Expected WWW-Authenticate header on 401")
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package geocache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Anomaly kinds.
+const (
+	AnomalyKeySpike      = "key_spike"
+	AnomalyReferrerSpike = "referrer_spike"
+	AnomalyNewEndpoint   = "new_endpoint"
+	AnomalyMissSurge     = "miss_rate_surge"
+)
+
+const (
+	// maxTrackedSources bounds the per-key and per-referrer baselines.
+	maxTrackedSources = 10000
+	// maxRecentAnomalies is how many anomalies /admin/stats reports.
+	maxRecentAnomalies = 100
+)
+
+// Anomaly is a usage pattern that deviated from its baseline.
+type Anomaly struct {
+	Kind     string    `json:"kind"`
+	Subject  string    `json:"subject"`
+	Observed float64   `json:"observed"`
+	Baseline float64   `json:"baseline"`
+	Time     time.Time `json:"time"`
+}
+
+// ewma is an exponentially weighted moving average of per-interval values.
+type ewma struct {
+	value       float64
+	initialized bool
+}
+
+func (e *ewma) update(v, alpha float64) {
+	if !e.initialized {
+		e.value = v
+		e.initialized = true
+		return
+	}
+	e.value = alpha*v + (1-alpha)*e.value
+}
+
+// anomalyDetector counts requests per API key, referrer and endpoint over
+// fixed intervals and compares each interval with an EWMA baseline. A value
+// is anomalous when it exceeds factor times its baseline and at least
+// minCount requests were seen. Endpoints not seen during the first
+// learningIntervals are reported once.
+type anomalyDetector struct {
+	alpha             float64
+	factor            float64
+	minCount          float64
+	learningIntervals int
+	clock             Clock
+	onAnomaly         func(Anomaly)
+
+	mu        sync.Mutex
+	intervals int
+	keys      map[string]float64
+	referrers map[string]float64
+	total     float64
+	misses    float64
+	keyBase   map[string]*ewma
+	refBase   map[string]*ewma
+	missBase  ewma
+	endpoints map[string]bool
+	recent    []Anomaly
+}
+
+func newAnomalyDetector(alpha, factor, minCount float64, learningIntervals int, clock Clock, onAnomaly func(Anomaly)) *anomalyDetector {
+	return &anomalyDetector{
+		alpha:             alpha,
+		factor:            factor,
+		minCount:          minCount,
+		learningIntervals: learningIntervals,
+		clock:             clock,
+		onAnomaly:         onAnomaly,
+		keys:              make(map[string]float64),
+		referrers:         make(map[string]float64),
+		keyBase:           make(map[string]*ewma),
+		refBase:           make(map[string]*ewma),
+		endpoints:         make(map[string]bool),
+	}
+}
+
+// observe counts one proxied request.
+func (d *anomalyDetector) observe(apiKey, referrer, endpoint string, miss bool) {
+	var anomaly *Anomaly
+
+	d.mu.Lock()
+	if apiKey != "" {
+		d.keys[apiKey]++
+	}
+	if referrer != "" {
+		d.referrers[referrer]++
+	}
+	d.total++
+	if miss {
+		d.misses++
+	}
+	if !d.endpoints[endpoint] && len(d.endpoints) < maxTrackedSources {
+		d.endpoints[endpoint] = true
+		if d.intervals >= d.learningIntervals {
+			anomaly = &Anomaly{Kind: AnomalyNewEndpoint, Subject: endpoint, Observed: 1, Time: d.clock.Now().UTC()}
+			d.remember(*anomaly)
+		}
+	}
+	d.mu.Unlock()
+
+	if anomaly != nil {
+		d.onAnomaly(*anomaly)
+	}
+}
+
+// tick closes the current interval: it compares the interval's counts with
+// the baselines, updates the baselines and resets the counts.
+func (d *anomalyDetector) tick(now time.Time) {
+	d.mu.Lock()
+	var found []Anomaly
+	found = d.compare(found, AnomalyKeySpike, d.keys, d.keyBase, now)
+	found = d.compare(found, AnomalyReferrerSpike, d.referrers, d.refBase, now)
+
+	if d.total >= d.minCount {
+		rate := d.misses / d.total
+		if d.missBase.initialized && d.missBase.value > 0 && rate > d.factor*d.missBase.value {
+			found = append(found, Anomaly{Kind: AnomalyMissSurge, Subject: "miss_rate", Observed: rate, Baseline: d.missBase.value, Time: now.UTC()})
+		}
+		d.missBase.update(rate, d.alpha)
+	}
+
+	d.keys = make(map[string]float64)
+	d.referrers = make(map[string]float64)
+	d.total, d.misses = 0, 0
+	d.intervals++
+	for _, a := range found {
+		d.remember(a)
+	}
+	d.mu.Unlock()
+
+	for _, a := range found {
+		d.onAnomaly(a)
+	}
+}
+
+func (d *anomalyDetector) compare(found []Anomaly, kind string, counts map[string]float64, baselines map[string]*ewma, now time.Time) []Anomaly {
+	for subject, base := range baselines {
+		count := counts[subject]
+		if base.initialized && count >= d.minCount && count > d.factor*base.value {
+			found = append(found, Anomaly{Kind: kind, Subject: subject, Observed: count, Baseline: base.value, Time: now.UTC()})
+		}
+		base.update(count, d.alpha)
+		if base.value < 0.01 {
+			delete(baselines, subject)
+		}
+	}
+	for subject, count := range counts {
+		if _, ok := baselines[subject]; ok || len(baselines) >= maxTrackedSources {
+			continue
+		}
+		// A source's first interval only seeds its baseline, unless the
+		// detector has already learned: then the baseline is zero traffic.
+		base := &ewma{}
+		if d.intervals >= d.learningIntervals {
+			base.initialized = true
+			if count >= d.minCount {
+				found = append(found, Anomaly{Kind: kind, Subject: subject, Observed: count, Time: now.UTC()})
+			}
+		}
+		base.update(count, d.alpha)
+		baselines[subject] = base
+	}
+	return found
+}
+
+func (d *anomalyDetector) remember(a Anomaly) {
+	d.recent = append(d.recent, a)
+	if len(d.recent) > maxRecentAnomalies {
+		d.recent = d.recent[len(d.recent)-maxRecentAnomalies:]
+	}
+}
+
+// recentAnomalies returns the latest anomalies, oldest first.
+func (d *anomalyDetector) recentAnomalies() []Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Anomaly{}, d.recent...)
+}
+
+// run closes an interval every interval, defaulting to one minute.
+func (d *anomalyDetector) run(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	for {
+		d.tick(<-d.clock.After(interval))
+	}
+}
+
+// reportAnomaly surfaces an anomaly through metrics, the log and the
+// configured webhook.
+func (s *Server) reportAnomaly(a Anomaly) {
+	anomaliesTotal.WithLabelValues(a.Kind).Inc()
+	s.logger.Log(LogWarning, "Usage anomaly: kind=%s subject=%s observed=%.2f baseline=%.2f", a.Kind, a.Subject, a.Observed, a.Baseline)
+	if s.config.AnomalyWebhookURL == "" {
+		return
+	}
+	go func() {
+		body, _ := json.Marshal(a)
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Post(s.config.AnomalyWebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			s.logger.Log(LogWarning, "Failed to deliver anomaly webhook: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			s.logger.Log(LogWarning, "Anomaly webhook returned %s", resp.Status)
+		}
+	}()
+}
+
+// requestReferrer returns the host of the Referer header, falling back to
+// Origin.
+func requestReferrer(r *http.Request) string {
+	refHeader := r.Header.Get("Referer")
+	if refHeader == "" {
+		refHeader = r.Header.Get("Origin")
+	}
+	if refHeader == "" {
+		return ""
+	}
+	u, err := url.Parse(refHeader)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
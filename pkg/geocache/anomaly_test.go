@@ -0,0 +1,140 @@
+package geocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	type interval struct {
+		keys      map[string]int
+		endpoints []string
+		misses    int
+		hits      int
+	}
+	tests := []struct {
+		name      string
+		intervals []interval
+		wantKinds []string
+	}{
+		{
+			name: "steady traffic",
+			intervals: []interval{
+				{keys: map[string]int{"AIza...1234": 20}},
+				{keys: map[string]int{"AIza...1234": 25}},
+				{keys: map[string]int{"AIza...1234": 22}},
+			},
+		},
+		{
+			name: "key spike",
+			intervals: []interval{
+				{keys: map[string]int{"AIza...1234": 20}},
+				{keys: map[string]int{"AIza...1234": 20}},
+				{keys: map[string]int{"AIza...1234": 200}},
+			},
+			wantKinds: []string{AnomalyKeySpike},
+		},
+		{
+			name: "new key after learning",
+			intervals: []interval{
+				{keys: map[string]int{"AIza...1234": 20}},
+				{keys: map[string]int{"AIza...1234": 20, "AIza...9999": 50}},
+			},
+			wantKinds: []string{AnomalyKeySpike},
+		},
+		{
+			name: "new endpoint after learning",
+			intervals: []interval{
+				{endpoints: []string{geocodePath}},
+				{endpoints: []string{geocodePath, "/maps/api/place/details/json"}},
+			},
+			wantKinds: []string{AnomalyNewEndpoint},
+		},
+		{
+			name: "miss rate surge",
+			intervals: []interval{
+				{hits: 90, misses: 10},
+				{hits: 90, misses: 10},
+				{hits: 40, misses: 60},
+			},
+			wantKinds: []string{AnomalyMissSurge},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			d := newAnomalyDetector(0.5, 3, 10, 1, systemClock{}, func(a Anomaly) { got = append(got, a.Kind) })
+
+			now := time.Now()
+			for _, iv := range tt.intervals {
+				for key, n := range iv.keys {
+					for i := 0; i < n; i++ {
+						d.observe(key, "", geocodePath, false)
+					}
+				}
+				for _, endpoint := range iv.endpoints {
+					d.observe("", "", endpoint, false)
+				}
+				for i := 0; i < iv.hits; i++ {
+					d.observe("", "", geocodePath, false)
+				}
+				for i := 0; i < iv.misses; i++ {
+					d.observe("", "", geocodePath, true)
+				}
+				now = now.Add(time.Minute)
+				d.tick(now)
+			}
+
+			if len(got) != len(tt.wantKinds) {
+				t.Fatalf("Expected anomalies %v, got %v", tt.wantKinds, got)
+			}
+			for i := range got {
+				if got[i] != tt.wantKinds[i] {
+					t.Errorf("Expected anomalies %v, got %v", tt.wantKinds, got)
+				}
+			}
+			if len(d.recentAnomalies()) != len(tt.wantKinds) {
+				t.Errorf("Expected %d recent anomalies, got %d", len(tt.wantKinds), len(d.recentAnomalies()))
+			}
+		})
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+
+	req := httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=Berlin", nil)
+	mr.Set(server.cacheKey(req), `{"status":"OK"}`)
+	handler := server.logMiddleware(server.usageMiddleware(http.HandlerFunc(server.query)))
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=Berlin", nil))
+	}
+
+	statsReq := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	statsReq.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(w, statsReq)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", w.Code)
+	}
+	var stats struct {
+		Requests  map[string]int64 `json:"requests"`
+		Anomalies []Anomaly        `json:"anomalies"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if stats.Requests["total"] != 2 || stats.Requests["hit"] != 2 {
+		t.Errorf("Expected 2 total and 2 hit requests, got %v", stats.Requests)
+	}
+	if stats.Anomalies == nil {
+		t.Errorf("Expected an empty anomalies list, got null")
+	}
+}
@@ -0,0 +1,152 @@
+package geocache
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audited actions.
+const (
+	AuditAdminRequest    = "admin.request"
+	AuditAuthFailure     = "auth.failure"
+	AuditCachePurge      = "cache.purge"
+	AuditCacheRefresh    = "cache.refresh"
+	AuditOverrideSet     = "override.set"
+	AuditOverrideClear   = "override.clear"
+	AuditClientBan       = "client.ban"
+	AuditClientUnban     = "client.unban"
+	AuditMaintenanceSet  = "maintenance.set"
+	AuditCaptureStart    = "capture.start"
+	AuditCaptureDelete   = "capture.delete"
+	AuditSnapshotRead    = "snapshot.read"
+	AuditQuarantineSet   = "quarantine.set"
+	AuditQuarantineClear = "quarantine.clear"
+	AuditConfigReload    = "config.reload"
+)
+
+// AuditEvent is one record of the audit log. Records are chained: Hash is the
+// SHA-256 of PrevHash followed by the JSON encoding of the record with an
+// empty Hash, so altering or removing a record breaks every later hash.
+type AuditEvent struct {
+	Time     time.Time         `json:"time"`
+	Actor    string            `json:"actor"`
+	Action   string            `json:"action"`
+	Params   map[string]string `json:"params,omitempty"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// auditLog appends hash-chained AuditEvents as JSON lines. Without a
+// destination, events are written through the "audit" log component instead.
+type auditLog struct {
+	logger *Logger
+
+	mu       sync.Mutex
+	w        io.Writer
+	prevHash string
+}
+
+// newAuditLog opens path for appending, resuming the hash chain from its last
+// record. An empty path selects the logger fallback.
+func newAuditLog(path string, logger *Logger) (*auditLog, error) {
+	a := &auditLog{logger: logger.Component("audit")}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return a, err
+	}
+	last, err := lastAuditHash(f)
+	if err != nil {
+		f.Close()
+		return a, fmt.Errorf("reading %s: %w", path, err)
+	}
+	a.w = f
+	a.prevHash = last
+	return a, nil
+}
+
+func lastAuditHash(r io.Reader) (string, error) {
+	var last string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return "", err
+		}
+		last = e.Hash
+	}
+	return last, scanner.Err()
+}
+
+// Record appends an event.
+func (a *auditLog) Record(actor, action string, params map[string]string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.w == nil {
+		attrs := []slog.Attr{slog.String("actor", actor), slog.String("action", action)}
+		for k, v := range params {
+			attrs = append(attrs, slog.String(k, v))
+		}
+		a.logger.LogAttrs(context.Background(), LogInfo, "audit "+action, attrs...)
+		return
+	}
+
+	e := AuditEvent{Time: time.Now().UTC(), Actor: actor, Action: action, Params: params, PrevHash: a.prevHash}
+	e.Hash = auditHash(e)
+	line, _ := json.Marshal(e)
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		a.logger.Log(LogError, "Failed to write audit event %s by %s: %v", action, actor, err)
+		return
+	}
+	a.prevHash = e.Hash
+}
+
+func auditHash(e AuditEvent) string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(append([]byte(e.PrevHash), b...))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyAuditLog checks the hash chain of an audit log and returns the
+// number of valid records read before the first broken link, if any.
+func VerifyAuditLog(r io.Reader) (int, error) {
+	var n int
+	var prev string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n, fmt.Errorf("record %d: %w", n+1, err)
+		}
+		if e.PrevHash != prev {
+			return n, fmt.Errorf("record %d: %w: previous hash mismatch", n+1, errAuditChainBroken)
+		}
+		if auditHash(e) != e.Hash {
+			return n, fmt.Errorf("record %d: %w: hash mismatch", n+1, errAuditChainBroken)
+		}
+		prev = e.Hash
+		n++
+	}
+	return n, scanner.Err()
+}
+
+var errAuditChainBroken = errors.New("audit log chain broken")
@@ -0,0 +1,78 @@
+package geocache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog_Chain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger := NewLogger(false)
+
+	a, err := newAuditLog(path, logger)
+	if err != nil {
+		t.Fatalf("newAuditLog: %v", err)
+	}
+	a.Record("token:ops", AuditCachePurge, map[string]string{"place_id": "ChIJ1", "purged": "3"})
+	a.Record("anonymous", AuditAuthFailure, map[string]string{"remote_addr": "192.0.2.1:1234"})
+
+	// Reopening resumes the chain from the last record.
+	a, err = newAuditLog(path, logger)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	a.Record("token:ops", AuditOverrideSet, map[string]string{"uri": "/maps/api/geocode/json?address=x"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	n, err := VerifyAuditLog(strings.NewReader(string(data)))
+	if err != nil || n != 3 {
+		t.Fatalf("VerifyAuditLog() = %d, %v; want 3, nil", n, err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		wantN  int
+	}{
+		{
+			name: "edited parameter",
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], "192.0.2.1", "198.51.100.7", 1)
+				return lines
+			},
+			wantN: 1,
+		},
+		{
+			name: "removed record",
+			tamper: func(lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			wantN: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			tampered := strings.Join(tt.tamper(lines), "\n")
+			n, err := VerifyAuditLog(strings.NewReader(tampered))
+			if !errors.Is(err, errAuditChainBroken) {
+				t.Errorf("Expected chain error, got %v", err)
+			}
+			if n != tt.wantN {
+				t.Errorf("Expected %d valid records, got %d", tt.wantN, n)
+			}
+		})
+	}
+}
+
+func TestAuditLog_NilSafe(t *testing.T) {
+	var a *auditLog
+	a.Record("actor", AuditCachePurge, nil)
+}
@@ -0,0 +1,214 @@
+package geocache
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Autocomplete modes, set with AUTOCOMPLETE_MODE.
+const (
+	// AutocompleteCache caches autocomplete responses like those of any other
+	// endpoint.
+	AutocompleteCache = "cache"
+	// AutocompleteBypass forwards autocomplete requests upstream without
+	// looking them up in or storing them to the cache: with a request per
+	// keystroke, their entries are seldom hit again and crowd out others.
+	AutocompleteBypass = "bypass"
+	// AutocompleteMicrocache forwards autocomplete requests upstream like
+	// AutocompleteBypass, but answers repeats of a request within
+	// AUTOCOMPLETE_MICROCACHE_SECONDS from a short-lived entry, absorbing the
+	// duplicate keystrokes of re-renders and of users typing the same prefix.
+	AutocompleteMicrocache = "microcache"
+	// AutocompleteReject answers autocomplete requests with 403.
+	AutocompleteReject = "reject"
+)
+
+// isAutocompletePath reports whether path is a Places Autocomplete endpoint,
+// such as /maps/api/place/autocomplete/json.
+func isAutocompletePath(path string) bool {
+	return strings.HasPrefix(path, "/maps/api/place/autocomplete/") ||
+		strings.HasPrefix(path, "/maps/api/place/queryautocomplete/")
+}
+
+// rateLimit returns the requests per minute allowed to the client of r, and
+// the scope its requests are counted in. With
+// AUTOCOMPLETE_RATE_LIMIT_PER_MINUTE set, autocomplete requests are counted
+// apart, so they neither use up nor are held to the limit of the other
+// endpoints.
+func (s *Server) rateLimit(r *http.Request) (limit int, scope string) {
+	if rl := ruleFromContext(r.Context()); rl != nil && rl.Action.RateLimitPerMinute > 0 {
+		return rl.Action.RateLimitPerMinute, "rule:" + rl.Name + ":"
+	}
+	if s.config.AutocompleteRateLimitPerMinute > 0 && isAutocompletePath(r.URL.Path) {
+		return s.config.AutocompleteRateLimitPerMinute, "autocomplete:"
+	}
+	return s.config.RateLimitPerMinute, ""
+}
+
+// autocompleteMiddleware applies the policy of AUTOCOMPLETE_MODE and
+// AUTOCOMPLETE_SAMPLE_PERCENT to autocomplete requests, before they are rate
+// limited, and counts their outcomes in autocomplete_requests_total. Other
+// requests pass through untouched.
+func (s *Server) autocompleteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAutocompletePath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.config.AutocompleteMode == AutocompleteReject {
+			autocompleteRequestsTotal.WithLabelValues("rejected").Inc()
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "autocomplete requests are not served"})
+			return
+		}
+		if s.config.AutocompleteSamplePercent < 100 && rand.Float64()*100 >= s.config.AutocompleteSamplePercent {
+			autocompleteRequestsTotal.WithLabelValues("shed").Inc()
+			writeTooManyRequests(w, 0, "autocomplete request shed")
+			return
+		}
+		next.ServeHTTP(w, r)
+
+		outcome := "served"
+		if csw, ok := w.(*cacheStatusResponseWriter); ok {
+			switch {
+			case csw.statusCode == http.StatusTooManyRequests:
+				outcome = "rate_limited"
+			case csw.cacheStatus == "BYPASS":
+				outcome = "bypassed"
+			case csw.cacheStatus == "MICRO-HIT":
+				outcome = "microcache_hit"
+			case csw.cacheStatus == "MICRO-MISS":
+				outcome = "microcache_miss"
+			}
+		}
+		autocompleteRequestsTotal.WithLabelValues(outcome).Inc()
+	})
+}
+
+// microcacheEntry is an autocomplete response kept in the micro-cache.
+type microcacheEntry struct {
+	Stored      time.Time `json:"stored"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+}
+
+// microcacheKey returns the micro-cache key of r. Unlike its cache key, it
+// leaves out sessiontoken, which differs between users typing the same input.
+func (s *Server) microcacheKey(r *http.Request) string {
+	u := *r.URL
+	q := u.Query()
+	q.Del("sessiontoken")
+	u.RawQuery = q.Encode()
+	return s.redisKey("microcache:" + hashCacheKey(canonicalQuery(&u, nil, s.keyParams), ""))
+}
+
+// serveMicrocached answers r from the micro-cache entry at key, and reports
+// whether there was one.
+func (s *Server) serveMicrocached(w http.ResponseWriter, r *http.Request, key string) bool {
+	data, err := s.redis.Get(r.Context(), key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			s.logger.LogContext(r.Context(), LogWarning, "Failed to read autocomplete micro-cache: %v", err)
+		}
+		return false
+	}
+	var entry microcacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return false
+	}
+	autocompleteMicrocacheHitAge.Observe(s.clock.Now().Sub(entry.Stored).Seconds())
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("X-Cache", "MICRO-HIT")
+	if s.wantsCacheDebug(r) {
+		writeCacheDecisionDebug(w, "served from the autocomplete micro-cache", 0)
+	}
+	s.writeBody(w, r, entry.Body)
+	if csw, ok := w.(*cacheStatusResponseWriter); ok {
+		csw.cacheStatus = "MICRO-HIT"
+	}
+	return true
+}
+
+// microcacheable reports whether an autocomplete response may be kept in the
+// micro-cache: only successful responses are, not errors such as
+// INVALID_REQUEST.
+func microcacheable(resp *UpstreamResponse) bool {
+	var body struct {
+		Status string `json:"status"`
+	}
+	return resp.StatusCode == http.StatusOK && json.Unmarshal(plainBody(resp.Body), &body) == nil &&
+		(body.Status == "OK" || body.Status == "ZERO_RESULTS")
+}
+
+// autocompleteBypassReason is the bypass reason of the autocomplete requests
+// in the bypass and microcache modes.
+const autocompleteBypassReason = "AUTOCOMPLETE_MODE is bypass"
+
+// serveBypass answers r from upstream without touching the cache, for the
+// reason returned by bypassReason, or from the micro-cache in the microcache
+// autocomplete mode.
+func (s *Server) serveBypass(w http.ResponseWriter, r *http.Request, reason string) {
+	var microKey string
+	if reason == autocompleteBypassReason && s.config.AutocompleteMode == AutocompleteMicrocache && s.redis != nil && s.config.AutocompleteMicrocacheTTL > 0 {
+		microKey = s.microcacheKey(r)
+		if s.serveMicrocached(w, r, microKey) {
+			return
+		}
+	}
+	if mode := s.maintenanceState().Mode; mode != MaintenanceOff {
+		writeMaintenance(w, mode, "service is in maintenance, only cached responses are served")
+		return
+	}
+	if s.limiter != nil {
+		release, ok := s.acquireUpstream(w, r, s.cacheKey(r))
+		if !ok {
+			return
+		}
+		defer release()
+	}
+	resp, err := s.upstream.Fetch(r)
+	if errors.Is(err, errReadBody) {
+		http.Error(w, "Failed to read response body", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch from Google Maps API", http.StatusInternalServerError)
+		return
+	}
+	setUpstreamHeaders(w, resp)
+
+	if quotaExceeded(resp) {
+		s.serveQuotaExceeded(w, r, resp)
+		return
+	}
+	if isRedirect(resp.StatusCode) && resp.Header.Get("Location") != "" {
+		s.serveRedirect(w, r, resp, "BYPASS")
+		return
+	}
+
+	cacheStatus, decision, ttl := "BYPASS", "not stored: "+reason, time.Duration(0)
+	if microKey != "" {
+		cacheStatus, decision = "MICRO-MISS", "not stored: the response is not cacheable"
+		if microcacheable(resp) {
+			entry, _ := json.Marshal(microcacheEntry{Stored: s.clock.Now(), ContentType: resp.Header.Get("content-type"), Body: resp.Body})
+			if err := s.redis.Set(r.Context(), microKey, entry, s.config.AutocompleteMicrocacheTTL).Err(); err != nil {
+				s.logger.LogContext(r.Context(), LogWarning, "Failed to store autocomplete micro-cache entry: %v", err)
+			}
+			decision, ttl = "stored in the autocomplete micro-cache", s.config.AutocompleteMicrocacheTTL
+		}
+	}
+	w.Header().Set("Content-Type", resp.Header.Get("content-type"))
+	w.Header().Set("Date", resp.Header.Get("date"))
+	w.Header().Set("X-Cache", cacheStatus)
+	if s.wantsCacheDebug(r) {
+		writeCacheDecisionDebug(w, decision, ttl)
+	}
+	s.writeBody(w, r, resp.Body)
+	if csw, ok := w.(*cacheStatusResponseWriter); ok {
+		csw.cacheStatus = cacheStatus
+	}
+}
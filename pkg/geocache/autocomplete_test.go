@@ -0,0 +1,158 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const autocompletePath = "/maps/api/place/autocomplete/json"
+
+func TestServer_Query_AutocompleteBypass(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AutocompleteMode = AutocompleteBypass
+	transport := &recordingTransport{body: `{"status":"OK","predictions":[]}`}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, prometheusSink{})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		server.query(w, httptest.NewRequest(http.MethodGet, autocompletePath+"?input=Main", nil))
+		if got := w.Header().Get("X-Cache"); got != "BYPASS" {
+			t.Errorf("request %d: expected X-Cache BYPASS, got %q", i, got)
+		}
+		if w.Body.String() != transport.body {
+			t.Errorf("request %d: expected upstream body, got %s", i, w.Body.String())
+		}
+	}
+	if len(transport.urls) != 2 {
+		t.Errorf("Expected 2 upstream requests, got %d", len(transport.urls))
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("Expected nothing cached, got %v", keys)
+	}
+
+	w := httptest.NewRecorder()
+	server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil))
+	if got := w.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("Expected geocode requests to be cached, got X-Cache %q", got)
+	}
+}
+
+func TestAutocompleteMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		samplePercent float64
+		path          string
+		wantStatus    int
+		wantOutcome   string
+	}{
+		{name: "served", mode: AutocompleteCache, samplePercent: 100, path: autocompletePath, wantStatus: http.StatusOK, wantOutcome: "served"},
+		{name: "rejected", mode: AutocompleteReject, samplePercent: 100, path: autocompletePath, wantStatus: http.StatusForbidden, wantOutcome: "rejected"},
+		{name: "shed", mode: AutocompleteCache, samplePercent: 0, path: "/maps/api/place/queryautocomplete/json", wantStatus: http.StatusTooManyRequests, wantOutcome: "shed"},
+		{name: "other endpoint", mode: AutocompleteReject, samplePercent: 0, path: geocodePath, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, cleanup := setupTestServer(t, nil)
+			defer cleanup()
+			server.config.AutocompleteMode = tt.mode
+			server.config.AutocompleteSamplePercent = tt.samplePercent
+			handler := server.autocompleteMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			var before float64
+			if tt.wantOutcome != "" {
+				before = testutil.ToFloat64(autocompleteRequestsTotal.WithLabelValues(tt.wantOutcome))
+			}
+			w := newCacheStatusResponseWriter(httptest.NewRecorder())
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path+"?input=Main", nil))
+
+			if w.statusCode != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.statusCode)
+			}
+			if tt.wantOutcome != "" {
+				if got := testutil.ToFloat64(autocompleteRequestsTotal.WithLabelValues(tt.wantOutcome)) - before; got != 1 {
+					t.Errorf("Expected 1 %s request counted, got %v", tt.wantOutcome, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware_Autocomplete(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.RateLimitPerMinute = 2
+	server.config.AutocompleteRateLimitPerMinute = 1
+	server.config.BanThreshold = 1
+	server.config.BanViolationWindow = 10 * time.Minute
+	server.config.BanBaseDuration = 5 * time.Minute
+	server.config.BanMaxDuration = time.Hour
+
+	handler := server.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path+"?input=Main", nil))
+		return w.Code
+	}
+
+	wantStatus := []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}
+	for i, want := range wantStatus {
+		if got := request(autocompletePath); got != want {
+			t.Fatalf("autocomplete request %d: expected status %d, got %d", i, want, got)
+		}
+	}
+	// Autocomplete requests neither use up the general limit nor get the
+	// client banned.
+	for i := 0; i < 2; i++ {
+		if got := request(geocodePath); got != http.StatusOK {
+			t.Errorf("geocode request %d: expected status 200, got %d", i, got)
+		}
+	}
+}
+
+func TestServer_Query_AutocompleteMicrocache(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AutocompleteMode = AutocompleteMicrocache
+	server.config.AutocompleteMicrocacheTTL = 10 * time.Second
+	transport := &recordingTransport{body: `{"status":"OK","predictions":[]}`}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, prometheusSink{})
+
+	query := func(rawQuery string) string {
+		w := httptest.NewRecorder()
+		server.query(w, httptest.NewRequest(http.MethodGet, autocompletePath+"?"+rawQuery, nil))
+		return w.Header().Get("X-Cache")
+	}
+	tests := []struct {
+		rawQuery string
+		want     string
+	}{
+		{"input=Mai&sessiontoken=a", "MICRO-MISS"},
+		{"input=Mai&sessiontoken=b", "MICRO-HIT"},
+		{"input=Main&sessiontoken=a", "MICRO-MISS"},
+	}
+	for _, tt := range tests {
+		if got := query(tt.rawQuery); got != tt.want {
+			t.Errorf("%s: expected X-Cache %s, got %s", tt.rawQuery, tt.want, got)
+		}
+	}
+	if len(transport.urls) != 2 {
+		t.Errorf("Expected 2 upstream requests, got %d", len(transport.urls))
+	}
+
+	mr.FastForward(10 * time.Second)
+	if got := query("input=Mai&sessiontoken=c"); got != "MICRO-MISS" {
+		t.Errorf("Expected expired entry to miss, got %s", got)
+	}
+
+	transport.body = `{"status":"INVALID_REQUEST","predictions":[]}`
+	query("input=Main+St")
+	if got := query("input=Main+St"); got != "MICRO-MISS" {
+		t.Errorf("Expected error responses not to be micro-cached, got %s", got)
+	}
+}
@@ -0,0 +1,114 @@
+package geocache
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const batchGeocodePath = "/maps/api/geocode/batch"
+
+// batchResult is the outcome of geocoding one address of a batch.
+type batchResult struct {
+	Address          string   `json:"address"`
+	Status           string   `json:"status"`
+	FormattedAddress string   `json:"formatted_address,omitempty"`
+	Lat              *float64 `json:"lat,omitempty"`
+	Lng              *float64 `json:"lng,omitempty"`
+	PlaceID          string   `json:"place_id,omitempty"`
+	LocationType     string   `json:"location_type,omitempty"`
+	CacheStatus      string   `json:"cache_status"`
+}
+
+// handleBatchGeocode geocodes the addresses of a JSON body
+// {"addresses": [...]} one by one through the cache, as if each was a
+// geocode request carrying the batch request's query parameters and API key.
+// Results are JSON, or CSV for clients that accept text/csv.
+func (s *Server) handleBatchGeocode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Addresses []string `json:"addresses"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Addresses) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `body must be {"addresses": [...]} with at least one address`})
+		return
+	}
+	if s.config.BatchMaxAddresses > 0 && len(req.Addresses) > s.config.BatchMaxAddresses {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("at most %d addresses per batch", s.config.BatchMaxAddresses)})
+		return
+	}
+
+	results := make([]batchResult, 0, len(req.Addresses))
+	for _, address := range req.Addresses {
+		results = append(results, s.geocodeOne(r, address))
+	}
+
+	if acceptsMediaType(r, "text/csv") {
+		writeBatchCSV(w, results)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// geocodeOne serves a single geocode request for address through query.
+func (s *Server) geocodeOne(r *http.Request, address string) batchResult {
+	q := r.URL.Query()
+	q.Set("address", address)
+	q.Del("output")
+	inner, err := http.NewRequestWithContext(r.Context(), http.MethodGet, geocodePath+"?"+q.Encode(), nil)
+	if err != nil {
+		return batchResult{Address: address, Status: "INVALID_REQUEST"}
+	}
+	inner.Header = r.Header.Clone()
+	inner.Header.Del("Accept")
+	inner.Header.Del("Accept-Encoding")
+	inner.RemoteAddr = r.RemoteAddr
+
+	rec := newBufferedResponseWriter()
+	s.query(rec, inner)
+
+	result := batchResult{Address: address, CacheStatus: rec.header.Get("X-Cache")}
+	var resp struct {
+		Status  string `json:"status"`
+		Results []struct {
+			FormattedAddress string `json:"formatted_address"`
+			PlaceID          string `json:"place_id"`
+			Geometry         struct {
+				Location     latLng `json:"location"`
+				LocationType string `json:"location_type"`
+			} `json:"geometry"`
+		} `json:"results"`
+	}
+	if json.Unmarshal(rec.body.Bytes(), &resp) != nil || resp.Status == "" {
+		result.Status = "HTTP_" + strconv.Itoa(rec.statusCode)
+		return result
+	}
+	result.Status = resp.Status
+	if len(resp.Results) > 0 {
+		first := resp.Results[0]
+		result.FormattedAddress = first.FormattedAddress
+		result.Lat = &first.Geometry.Location.Lat
+		result.Lng = &first.Geometry.Location.Lng
+		result.PlaceID = first.PlaceID
+		result.LocationType = first.Geometry.LocationType
+	}
+	return result
+}
+
+func writeBatchCSV(w http.ResponseWriter, results []batchResult) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"address", "lat", "lng", "place_id", "location_type", "cache_status"})
+	for _, res := range results {
+		cw.Write([]string{res.Address, formatCoordinate(res.Lat), formatCoordinate(res.Lng), res.PlaceID, res.LocationType, res.CacheStatus})
+	}
+	cw.Flush()
+}
+
+func formatCoordinate(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
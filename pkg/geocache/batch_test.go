@@ -0,0 +1,96 @@
+package geocache
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleBatchGeocode(t *testing.T) {
+	transport := &recordingTransport{
+		body: `{"status":"OK","results":[{"formatted_address":"1 Main St","place_id":"p1","geometry":{"location":{"lat":40.5,"lng":-74.25},"location_type":"ROOFTOP"}}]}`,
+	}
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.BatchMaxAddresses = 3
+	handler := server.routes()
+
+	// Warm the cache for the first address.
+	server.query(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&key=k", nil))
+
+	tests := []struct {
+		name       string
+		body       string
+		accept     string
+		wantStatus int
+		check      func(t *testing.T, body string)
+	}{
+		{
+			name:       "json results",
+			body:       `{"addresses":["Main","Elm"]}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, body string) {
+				var resp struct {
+					Results []batchResult `json:"results"`
+				}
+				if err := json.Unmarshal([]byte(body), &resp); err != nil || len(resp.Results) != 2 {
+					t.Fatalf("Unexpected response %s: %v", body, err)
+				}
+				if resp.Results[0].Address != "Main" || resp.Results[0].CacheStatus != "HIT" || resp.Results[0].PlaceID != "p1" {
+					t.Errorf("Unexpected first result %+v", resp.Results[0])
+				}
+				if resp.Results[1].Status != "OK" || *resp.Results[1].Lat != 40.5 {
+					t.Errorf("Unexpected second result %+v", resp.Results[1])
+				}
+			},
+		},
+		{
+			name:       "csv results",
+			body:       `{"addresses":["Main"]}`,
+			accept:     "text/csv",
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, body string) {
+				records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+				if err != nil {
+					t.Fatalf("Invalid CSV %q: %v", body, err)
+				}
+				want := [][]string{
+					{"address", "lat", "lng", "place_id", "location_type", "cache_status"},
+					{"Main", "40.5", "-74.25", "p1", "ROOFTOP", "HIT"},
+				}
+				if len(records) != len(want) || strings.Join(records[1], ",") != strings.Join(want[1], ",") || strings.Join(records[0], ",") != strings.Join(want[0], ",") {
+					t.Errorf("Expected %v, got %v", want, records)
+				}
+			},
+		},
+		{name: "empty batch", body: `{"addresses":[]}`, wantStatus: http.StatusBadRequest},
+		{name: "too many addresses", body: `{"addresses":["a","b","c","d"]}`, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, batchGeocodePath+"?key=k", strings.NewReader(tt.body))
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.check != nil {
+				tt.check(t, w.Body.String())
+			}
+		})
+	}
+
+	for _, u := range transport.urls {
+		if !strings.Contains(u, "key=k") {
+			t.Errorf("Expected the batch API key to be forwarded, got %s", u)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// bigQueryInserter streams rows into a BigQuery table through the
+// tabledata.insertAll REST method.
+type bigQueryInserter struct {
+	client *http.Client
+	url    string
+	token  func(ctx context.Context) (string, error)
+}
+
+// newBigQueryInserter targets a table given as "project.dataset.table",
+// authenticating as the instance's service account.
+func newBigQueryInserter(table string) (*bigQueryInserter, error) {
+	parts := strings.Split(table, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("BigQuery table %q is not project.dataset.table", table)
+	}
+	return &bigQueryInserter{
+		client: &http.Client{Timeout: 30 * time.Second},
+		url: fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll",
+			parts[0], parts[1], parts[2]),
+		token: newGCPTokenSource().Token,
+	}, nil
+}
+
+// Insert streams records, each with a random insert ID so BigQuery can
+// deduplicate retried requests.
+func (b *bigQueryInserter) Insert(ctx context.Context, records []UsageRecord) error {
+	type row struct {
+		InsertID string      `json:"insertId"`
+		JSON     UsageRecord `json:"json"`
+	}
+	rows := make([]row, len(records))
+	for i, rec := range records {
+		id := make([]byte, 16)
+		rand.Read(id)
+		rows[i] = row{InsertID: hex.EncodeToString(id), JSON: rec}
+	}
+	body, err := json.Marshal(map[string]interface{}{"rows": rows})
+	if err != nil {
+		return err
+	}
+
+	token, err := b.token(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching access token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("insertAll returned %s: %s", resp.Status, respBody)
+	}
+	var result struct {
+		InsertErrors []json.RawMessage `json:"insertErrors"`
+	}
+	if json.Unmarshal(respBody, &result) == nil && len(result.InsertErrors) > 0 {
+		return fmt.Errorf("insertAll rejected %d of %d rows: %s", len(result.InsertErrors), len(records), result.InsertErrors[0])
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package geocache
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBudgetAlpha is the weight of the latest upstream response time in
+// the latency estimate.
+const latencyBudgetAlpha = 0.2
+
+// latencyBudget returns the time the caller allows for r, from the
+// X-Latency-Budget-Ms header.
+func latencyBudget(r *http.Request) (time.Duration, bool) {
+	v := r.Header.Get("X-Latency-Budget-Ms")
+	if v == "" {
+		return 0, false
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// latencyEstimator tracks an EWMA of successful upstream response times.
+type latencyEstimator struct {
+	mu      sync.Mutex
+	average ewma
+}
+
+func (l *latencyEstimator) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.average.update(float64(d), latencyBudgetAlpha)
+}
+
+// estimate returns the expected upstream response time, or zero before any
+// upstream request completed.
+func (l *latencyEstimator) estimate() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Duration(l.average.value)
+}
@@ -0,0 +1,171 @@
+package geocache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowUpstream answers after delay unless the request context ends first.
+type slowUpstream struct {
+	delay time.Duration
+	calls int
+}
+
+func (u *slowUpstream) Fetch(r *http.Request) (*UpstreamResponse, error) {
+	u.calls++
+	select {
+	case <-time.After(u.delay):
+		return &UpstreamResponse{StatusCode: http.StatusOK, Header: make(http.Header), Body: []byte(`{"status":"OK"}`)}, nil
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+}
+
+func TestServer_Query_LatencyBudget(t *testing.T) {
+	tests := []struct {
+		name         string
+		budget       string
+		estimate     time.Duration
+		delay        time.Duration
+		wantStatus   int
+		wantUpstream int
+	}{
+		{
+			name:         "no budget",
+			delay:        10 * time.Millisecond,
+			wantStatus:   http.StatusOK,
+			wantUpstream: 1,
+		},
+		{
+			name:         "budget covers upstream",
+			budget:       "1000",
+			estimate:     10 * time.Millisecond,
+			delay:        10 * time.Millisecond,
+			wantStatus:   http.StatusOK,
+			wantUpstream: 1,
+		},
+		{
+			name:         "budget below estimate",
+			budget:       "50",
+			estimate:     200 * time.Millisecond,
+			delay:        10 * time.Millisecond,
+			wantStatus:   http.StatusGatewayTimeout,
+			wantUpstream: 0,
+		},
+		{
+			name:         "budget exhausted during upstream call",
+			budget:       "20",
+			delay:        time.Second,
+			wantStatus:   http.StatusGatewayTimeout,
+			wantUpstream: 1,
+		},
+		{
+			name:         "invalid budget is ignored",
+			budget:       "soon",
+			estimate:     time.Second,
+			delay:        10 * time.Millisecond,
+			wantStatus:   http.StatusOK,
+			wantUpstream: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, cleanup := setupTestServer(t, nil)
+			defer cleanup()
+			upstream := &slowUpstream{delay: tt.delay}
+			server.upstream = upstream
+			if tt.estimate > 0 {
+				server.upstreamLatency.observe(tt.estimate)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=Budget", nil)
+			if tt.budget != "" {
+				req.Header.Set("X-Latency-Budget-Ms", tt.budget)
+			}
+			w := httptest.NewRecorder()
+			server.query(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+			if upstream.calls != tt.wantUpstream {
+				t.Errorf("Expected %d upstream calls, got %d", tt.wantUpstream, upstream.calls)
+			}
+		})
+	}
+}
+
+func TestServer_Query_RequestDeadlineIsNotBudget(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.RequestTimeout = 20 * time.Millisecond
+	server.upstream = &slowUpstream{delay: time.Second}
+	handler := server.timeoutMiddleware(http.HandlerFunc(server.query))
+	budgetTimeouts := testutil.ToFloat64(latencyBudgetRejectionsTotal.WithLabelValues("timeout"))
+	requestTimeouts := testutil.ToFloat64(requestTimeoutsTotal.WithLabelValues("geocode"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Deadline", nil))
+	if w.Code != http.StatusGatewayTimeout || strings.Contains(w.Body.String(), "latency budget") {
+		t.Errorf("Expected the 504 of the request deadline, got %d %s", w.Code, w.Body.String())
+	}
+	if got := testutil.ToFloat64(latencyBudgetRejectionsTotal.WithLabelValues("timeout")) - budgetTimeouts; got != 0 {
+		t.Errorf("Expected no latency budget rejection without a budget, got %v", got)
+	}
+	if got := testutil.ToFloat64(requestTimeoutsTotal.WithLabelValues("geocode")) - requestTimeouts; got != 1 {
+		t.Errorf("Expected 1 request timeout, got %v", got)
+	}
+}
+
+func TestServer_Query_LatencyBudgetServesStale(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	clock := NewFrozenClock(time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC))
+	server.clock = clock
+	upstream := &slowUpstream{delay: 10 * time.Millisecond}
+	server.upstream = upstream
+
+	gcs := &fakeGCS{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(gcs)
+	defer ts.Close()
+	server.snapshots = newSnapshotStore(&gcsClient{
+		client:  ts.Client(),
+		baseURL: ts.URL,
+		bucket:  "bucket",
+		token:   func(context.Context) (string, error) { return "token", nil },
+	}, "")
+
+	ctx := context.Background()
+	cached := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Budget", nil)
+	server.query(httptest.NewRecorder(), cached)
+	if _, err := server.writeSnapshot(ctx, clock.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+	server.store.Delete(ctx, server.cacheKey(cached))
+	server.upstreamLatency.observe(time.Second)
+	calls := upstream.calls
+
+	query := func(address string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?address="+address, nil)
+		req.Header.Set("X-Latency-Budget-Ms", "50")
+		w := httptest.NewRecorder()
+		server.query(w, req)
+		return w
+	}
+	if w := query("Budget"); w.Code != http.StatusOK || w.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("Expected a stale response from the snapshot, got %d %q", w.Code, w.Header().Get("X-Cache"))
+	}
+	if w := query("Elsewhere"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 without a stale response, got %d", w.Code)
+	}
+	if upstream.calls != calls {
+		t.Errorf("Expected no upstream requests, got %d", upstream.calls-calls)
+	}
+}
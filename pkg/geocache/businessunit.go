@@ -0,0 +1,72 @@
+package geocache
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+// businessUnitPattern bounds the values accepted as business units, which
+// become metric labels.
+var businessUnitPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// businessUnitOther replaces business units missing from
+// Config.BusinessUnits.
+const businessUnitOther = "other"
+
+type businessUnitKey struct{}
+
+// businessUnitFromContext returns the business unit of the request of ctx,
+// or "" when it has none.
+func businessUnitFromContext(ctx context.Context) string {
+	unit, _ := ctx.Value(businessUnitKey{}).(string)
+	return unit
+}
+
+// businessUnit returns the business unit r is charged to, from the header
+// BUSINESS_UNIT_HEADER or the query parameter BUSINESS_UNIT_PARAM. Invalid
+// values are ignored, and values missing from BUSINESS_UNITS, when it is
+// set, are reported as other.
+func (s *Server) businessUnit(r *http.Request) string {
+	var unit string
+	if s.config.BusinessUnitHeader != "" {
+		unit = r.Header.Get(s.config.BusinessUnitHeader)
+	}
+	if unit == "" && s.config.BusinessUnitParam != "" {
+		unit = r.URL.Query().Get(s.config.BusinessUnitParam)
+	}
+	if !businessUnitPattern.MatchString(unit) {
+		return ""
+	}
+	if len(s.config.BusinessUnits) > 0 && !slices.Contains(s.config.BusinessUnits, unit) {
+		return businessUnitOther
+	}
+	return unit
+}
+
+// businessUnitMiddleware attaches the business unit of the request to its
+// context, where metrics, events and usage records pick it up, and removes
+// the query parameter carrying it, which would otherwise split cache entries
+// and be sent upstream.
+func (s *Server) businessUnitMiddleware(next http.Handler) http.Handler {
+	if s.config.BusinessUnitHeader == "" && s.config.BusinessUnitParam == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unit := s.businessUnit(r)
+		if s.config.BusinessUnitParam != "" && r.URL.Query().Has(s.config.BusinessUnitParam) {
+			r = r.Clone(r.Context())
+			q := r.URL.Query()
+			q.Del(s.config.BusinessUnitParam)
+			r.URL.RawQuery = q.Encode()
+			r.RequestURI = r.URL.RequestURI()
+		}
+		if unit != "" {
+			ctx := context.WithValue(r.Context(), businessUnitKey{}, unit)
+			r = r.WithContext(ContextWithLogAttrs(ctx, slog.String("business_unit", unit)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,63 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServer_BusinessUnit(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.BusinessUnitHeader = "X-Cost-Center"
+	server.config.BusinessUnitParam = "cost_center"
+	server.config.BusinessUnits = []string{"logistics", "sales"}
+	transport := &recordingTransport{body: `{"status":"OK","results":[]}`}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, prometheusSink{})
+	var units []string
+	handler := server.businessUnitMiddleware(server.logMiddleware(server.usageMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		units = append(units, businessUnitFromContext(r.Context()))
+		server.query(w, r)
+	}))))
+
+	tests := []struct {
+		name      string
+		target    string
+		header    string
+		wantUnit  string
+		wantLabel string
+		wantCache string
+	}{
+		{name: "header", target: geocodePath + "?address=Unit", header: "logistics", wantUnit: "logistics", wantLabel: "logistics", wantCache: "miss"},
+		{name: "param", target: geocodePath + "?address=Unit&cost_center=sales", wantUnit: "sales", wantLabel: "sales", wantCache: "hit"},
+		{name: "unlisted", target: geocodePath + "?address=Unit", header: "marketing", wantUnit: businessUnitOther, wantLabel: businessUnitOther, wantCache: "hit"},
+		{name: "invalid", target: geocodePath + "?address=Unit", header: "sales team", wantLabel: "none", wantCache: "hit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			units = nil
+			before := testutil.ToFloat64(businessUnitRequestsTotal.WithLabelValues(tt.wantLabel, "geocode", tt.wantCache))
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Cost-Center", tt.header)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if len(units) != 1 || units[0] != tt.wantUnit {
+				t.Errorf("Expected business unit %q, got %q", tt.wantUnit, units)
+			}
+			if got := testutil.ToFloat64(businessUnitRequestsTotal.WithLabelValues(tt.wantLabel, "geocode", tt.wantCache)) - before; got != 1 {
+				t.Errorf("Expected business_unit_requests_total{business_unit=%q,cache=%q} to increment by 1, got %v", tt.wantLabel, tt.wantCache, got)
+			}
+		})
+	}
+	// The parameter is neither sent upstream nor part of the cache key, so
+	// only the first request missed.
+	if len(transport.urls) != 1 || strings.Contains(transport.urls[0], "cost_center") {
+		t.Errorf("Expected one upstream request without cost_center, got %v", transport.urls)
+	}
+}
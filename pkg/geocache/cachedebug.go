@@ -0,0 +1,59 @@
+package geocache
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheDebugHeader is sent by clients asking for the X-Cache-Debug-*
+// headers explaining how their request was cached.
+const cacheDebugHeader = "X-Cache-Debug"
+
+// wantsCacheDebug reports whether r asks for the cache debug headers and
+// comes from CACHE_DEBUG_CIDRS.
+func (s *Server) wantsCacheDebug(r *http.Request) bool {
+	if len(s.config.CacheDebugCIDRs) == 0 {
+		return false
+	}
+	enabled, _ := strconv.ParseBool(r.Header.Get(cacheDebugHeader))
+	return enabled && isIPAllowed(r.RemoteAddr, s.config.CacheDebugCIDRs)
+}
+
+// writeCacheKeyDebug describes the cache key of r: the key, the canonical
+// query it is the hash of, and the parameters left out of it.
+func (s *Server) writeCacheKeyDebug(w http.ResponseWriter, r *http.Request, cacheKey string) {
+	canonical := canonicalQuery(r.URL, s.normalizer, s.keyParams)
+	kept := make(map[string]bool)
+	if _, rawQuery, ok := strings.Cut(canonical, "?"); ok {
+		for _, param := range strings.Split(rawQuery, "&") {
+			name, _, _ := strings.Cut(param, "=")
+			if name, err := url.QueryUnescape(name); err == nil {
+				kept[name] = true
+			}
+		}
+	}
+	var ignored []string
+	for name := range r.URL.Query() {
+		if !kept[name] {
+			ignored = append(ignored, name)
+		}
+	}
+	slices.Sort(ignored)
+
+	w.Header().Set("X-Cache-Debug-Key", cacheKey)
+	w.Header().Set("X-Cache-Debug-Canonical", canonical)
+	w.Header().Set("X-Cache-Debug-Ignored-Params", strings.Join(ignored, ","))
+}
+
+// writeCacheDecisionDebug explains whether the response was served from or
+// stored in the cache, and for how long the entry lives, when known.
+func writeCacheDecisionDebug(w http.ResponseWriter, reason string, ttl time.Duration) {
+	w.Header().Set("X-Cache-Debug-Reason", reason)
+	if ttl > 0 {
+		w.Header().Set("X-Cache-Debug-TTL", strconv.Itoa(int(ttl.Seconds())))
+	}
+}
@@ -0,0 +1,55 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_Query_CacheDebug(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.CacheDebugCIDRs = []string{"192.0.2.0/24"}
+	transport := &recordingTransport{body: `{"status":"OK","results":[]}`}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, prometheusSink{})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantReason string
+		wantTTL    string
+	}{
+		{name: "miss", remoteAddr: "192.0.2.1:1234", wantReason: "stored", wantTTL: "3600"},
+		{name: "hit", remoteAddr: "192.0.2.1:1234", wantReason: "served from the cache entry", wantTTL: "3600"},
+		{name: "not allowlisted", remoteAddr: "198.51.100.1:1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, directionsPath+"?origin=A&destination=B&departure_time=now&key=SECRET", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set(cacheDebugHeader, "true")
+			w := httptest.NewRecorder()
+			server.query(w, req)
+
+			if got := w.Header().Get("X-Cache-Debug-Reason"); got != tt.wantReason {
+				t.Errorf("Expected reason %q, got %q", tt.wantReason, got)
+			}
+			if got := w.Header().Get("X-Cache-Debug-TTL"); got != tt.wantTTL {
+				t.Errorf("Expected TTL %q, got %q", tt.wantTTL, got)
+			}
+			if tt.wantReason == "" {
+				return
+			}
+			if got, want := w.Header().Get("X-Cache-Debug-Canonical"), directionsPath+"?destination=B&origin=A"; got != want {
+				t.Errorf("Expected canonical query %q, got %q", want, got)
+			}
+			if got := w.Header().Get("X-Cache-Debug-Ignored-Params"); got != "departure_time,key" {
+				t.Errorf("Expected ignored params departure_time,key, got %q", got)
+			}
+			if got := w.Header().Get("X-Cache-Debug-Key"); got != server.cacheKey(req) {
+				t.Errorf("Expected key %s, got %s", server.cacheKey(req), got)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package geocache
+
+import (
+	"maps"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// keyCoordinateDecimals is the precision of the coordinates of bounds and
+// location biases in cache keys. Five decimals are about a meter, well below
+// what tells two biases apart.
+const keyCoordinateDecimals = 5
+
+// keyValueCanonicalizers rewrite the values of the parameters of an endpoint
+// that clients spell differently for the same request, so that those
+// requests share a cache entry. They report false for values that do not
+// parse, which are left alone and rejected by invalidKeyParam.
+var keyValueCanonicalizers = map[string]map[string]func(string) (string, bool){
+	geocodePath: {
+		"bounds":     canonicalBounds,
+		"components": canonicalComponents,
+	},
+	"/maps/api/place/autocomplete/json": {
+		"components":   canonicalComponents,
+		"locationbias": canonicalLocationBias,
+	},
+	"/maps/api/place/queryautocomplete/json": {
+		"locationbias": canonicalLocationBias,
+	},
+	"/maps/api/place/findplacefromtext/json": {
+		"locationbias": canonicalLocationBias,
+	},
+}
+
+// canonicalCoordinate rounds a latitude or longitude to
+// keyCoordinateDecimals, reporting false when s is not a number within
+// [-limit, limit].
+func canonicalCoordinate(s string, limit float64) (string, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(f) || math.Abs(f) > limit {
+		return "", false
+	}
+	scale := math.Pow10(keyCoordinateDecimals)
+	f = math.Round(f*scale) / scale
+	if f == 0 {
+		// Not -0.
+		f = 0
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), true
+}
+
+// canonicalLatLng canonicalizes a "lat,lng" pair, reporting false when it is
+// not a valid position.
+func canonicalLatLng(s string) (string, bool) {
+	lat, lng, ok := strings.Cut(s, ",")
+	if !ok {
+		return "", false
+	}
+	lat, latOK := canonicalCoordinate(lat, 90)
+	lng, lngOK := canonicalCoordinate(lng, 180)
+	return lat + "," + lng, latOK && lngOK
+}
+
+// canonicalBounds canonicalizes a "south,west|north,east" viewport. The
+// corners keep their order, as a viewport crossing the antimeridian has a
+// western edge east of its eastern one.
+func canonicalBounds(v string) (string, bool) {
+	sw, ne, ok := strings.Cut(v, "|")
+	if !ok {
+		return v, false
+	}
+	sw, swOK := canonicalLatLng(sw)
+	ne, neOK := canonicalLatLng(ne)
+	if !swOK || !neOK {
+		return v, false
+	}
+	return sw + "|" + ne, true
+}
+
+// canonicalLocationBias canonicalizes the coordinates of a point:,
+// circle: or rectangle: location bias. An ipbias is kept as is.
+func canonicalLocationBias(v string) (string, bool) {
+	kind, spec, _ := strings.Cut(v, ":")
+	switch kind {
+	case "ipbias":
+		return v, spec == ""
+	case "point":
+		if point, ok := canonicalLatLng(spec); ok {
+			return kind + ":" + point, true
+		}
+	case "circle":
+		radius, center, _ := strings.Cut(spec, "@")
+		r, err := strconv.ParseFloat(strings.TrimSpace(radius), 64)
+		center, ok := canonicalLatLng(center)
+		if err == nil && r >= 0 && !math.IsInf(r, 0) && ok {
+			return kind + ":" + strconv.FormatFloat(r, 'f', -1, 64) + "@" + center, true
+		}
+	case "rectangle":
+		if bounds, ok := canonicalBounds(spec); ok {
+			return kind + ":" + bounds, true
+		}
+	}
+	return v, false
+}
+
+// invalidKeyParam returns the name of the first parameter of u whose value
+// a canonicalizer of its endpoint cannot parse, or "" when there is none.
+// Such a value would otherwise key the entry as sent.
+func invalidKeyParam(u *url.URL) string {
+	canonicalizers := keyValueCanonicalizers[jsonVariant(u.Path)]
+	if len(canonicalizers) == 0 {
+		return ""
+	}
+	q := u.Query()
+	for _, name := range slices.Sorted(maps.Keys(canonicalizers)) {
+		for _, v := range q[name] {
+			if _, ok := canonicalizers[name](v); !ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// canonicalComponents sorts and deduplicates the "|"-separated filters of a
+// components parameter, whose order does not matter, lowercasing the filter
+// names and uppercasing country codes.
+func canonicalComponents(v string) (string, bool) {
+	filters := strings.Split(v, "|")
+	for i, filter := range filters {
+		name, value, ok := strings.Cut(filter, ":")
+		if !ok {
+			filters[i] = strings.TrimSpace(filter)
+			continue
+		}
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if name == "country" {
+			value = strings.ToUpper(value)
+		}
+		filters[i] = name + ":" + value
+	}
+	slices.Sort(filters)
+	return strings.Join(slices.Compact(filters), "|"), true
+}
@@ -0,0 +1,139 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCanonicalBounds(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   string
+		wantOK bool
+	}{
+		{"34.172684,-118.604794|34.236144,-118.500938", "34.17268,-118.60479|34.23614,-118.50094", true},
+		{"34.1726840,-118.6047940 | 34.23614,-118.50094", "34.17268,-118.60479|34.23614,-118.50094", true},
+		{"-0.000001,179.5|1,-179.5", "0,179.5|1,-179.5", true},
+		{"91,0|92,1", "91,0|92,1", false},
+		{"34.17,-118.60", "34.17,-118.60", false},
+		{"a,b|c,d", "a,b|c,d", false},
+	}
+	for _, tt := range tests {
+		if got, ok := canonicalBounds(tt.input); got != tt.want || ok != tt.wantOK {
+			t.Errorf("canonicalBounds(%q) = %q, %v, want %q, %v", tt.input, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestCanonicalLocationBias(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   string
+		wantOK bool
+	}{
+		{"ipbias", "ipbias", true},
+		{"point:37.7749000,-122.4194000", "point:37.7749,-122.4194", true},
+		{"circle:2000.0@47.6918452,-122.2226413", "circle:2000@47.69185,-122.22264", true},
+		{"rectangle:37.70,-122.52|37.81,-122.35", "rectangle:37.7,-122.52|37.81,-122.35", true},
+		{"circle:far@47.69,-122.22", "circle:far@47.69,-122.22", false},
+		{"rectangle:37.70,-122.52", "rectangle:37.70,-122.52", false},
+		{"point:here", "point:here", false},
+		{"nearby:37.7,-122.5", "nearby:37.7,-122.5", false},
+	}
+	for _, tt := range tests {
+		if got, ok := canonicalLocationBias(tt.input); got != tt.want || ok != tt.wantOK {
+			t.Errorf("canonicalLocationBias(%q) = %q, %v, want %q, %v", tt.input, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestCanonicalComponents(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"postal_code:94043|country:us", "country:US|postal_code:94043"},
+		{"Country:US | locality:Mountain View|country:US", "country:US|locality:Mountain View"},
+		{"country:us", "country:US"},
+	}
+	for _, tt := range tests {
+		if got, _ := canonicalComponents(tt.input); got != tt.want {
+			t.Errorf("canonicalComponents(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalQuery_SharesEntries(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{
+			name: "components order",
+			a:    geocodePath + "?address=Main&components=country:US|postal_code:94043",
+			b:    geocodePath + "?address=Main&components=postal_code:94043|country:us",
+			same: true,
+		},
+		{
+			name: "bounds precision",
+			a:    geocodePath + "?address=Main&bounds=34.172684,-118.604794|34.236144,-118.500938",
+			b:    geocodePath + "?address=Main&bounds=34.1726841,-118.6047939|34.2361440,-118.5009380",
+			same: true,
+		},
+		{
+			name: "different bounds",
+			a:    geocodePath + "?address=Main&bounds=34.17,-118.60|34.23,-118.50",
+			b:    geocodePath + "?address=Main&bounds=34.17,-118.60|34.24,-118.50",
+		},
+		{
+			name: "locationbias on findplacefromtext",
+			a:    "/maps/api/place/findplacefromtext/json?input=cafe&inputtype=textquery&locationbias=point:37.77490,-122.41940",
+			b:    "/maps/api/place/findplacefromtext/json?input=cafe&inputtype=textquery&locationbias=point:37.7749,-122.4194",
+			same: true,
+		},
+		{
+			name: "endpoint without canonicalization",
+			a:    "/maps/api/place/nearbysearch/json?location=37.77490,-122.41940",
+			b:    "/maps/api/place/nearbysearch/json?location=37.7749,-122.4194",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := url.Parse(tt.a)
+			b, _ := url.Parse(tt.b)
+			if got := canonicalQuery(a, nil, nil) == canonicalQuery(b, nil, nil); got != tt.same {
+				t.Errorf("Expected shared entry %v, got keys %q and %q", tt.same, canonicalQuery(a, nil, nil), canonicalQuery(b, nil, nil))
+			}
+		})
+	}
+}
+
+func TestServer_Query_RejectsInvalidKeyParams(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[],"status":"OK"}`}
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+
+	tests := []struct {
+		uri        string
+		wantStatus int
+	}{
+		{geocodePath + "?address=Main&bounds=34.17,-118.60|34.23,-118.50", http.StatusOK},
+		{geocodePath + "?address=Main&bounds=34.17,-118.60", http.StatusBadRequest},
+		{geocodePath + "?address=Main&bounds=91,0|92,1", http.StatusBadRequest},
+		{"/maps/api/place/findplacefromtext/json?input=cafe&inputtype=textquery&locationbias=point:here", http.StatusBadRequest},
+		{"/maps/api/place/findplacefromtext/json?input=cafe&inputtype=textquery&locationbias=ipbias", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		server.query(w, httptest.NewRequest(http.MethodGet, tt.uri, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.uri, w.Code, tt.wantStatus)
+		}
+	}
+	if len(transport.urls) != 2 {
+		t.Errorf("Expected only the valid requests to go upstream, got %d upstream requests", len(transport.urls))
+	}
+}
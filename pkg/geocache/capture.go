@@ -0,0 +1,468 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	captureDefaultDuration   = 5 * time.Minute
+	captureMaxDuration       = time.Hour
+	captureDefaultMaxEntries = 1000
+	captureMaxEntries        = 10000
+	// captureMaxBody bounds the response body recorded per entry.
+	captureMaxBody = 1 << 20
+	// captureRetention is how long a finished capture can be downloaded.
+	captureRetention = 24 * time.Hour
+	// captureSyncInterval is how often instances pick up a capture started
+	// through another instance.
+	captureSyncInterval = 5 * time.Second
+)
+
+// captureRedactedHeaders are replaced by "REDACTED" in captured requests
+// and responses.
+var captureRedactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Maps-Api-Key":      true,
+	"Proxy-Authorization": true,
+}
+
+// captureFilter selects the requests a capture records. Empty fields match
+// every request.
+type captureFilter struct {
+	// Path is a prefix of the request path.
+	Path     string `json:"path,omitempty"`
+	Referrer string `json:"referrer,omitempty"`
+	// APIKey is the obfuscated key, as shown in logs.
+	APIKey      string `json:"api_key,omitempty"`
+	CacheStatus string `json:"cache_status,omitempty"`
+}
+
+// matchesRequest checks the filter fields known before r is served.
+func (f captureFilter) matchesRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, f.Path) &&
+		(f.Referrer == "" || requestReferrer(r) == f.Referrer) &&
+		(f.APIKey == "" || obfuscateAPIKey(extractAPIKey(r)) == f.APIKey)
+}
+
+// capture is a time-boxed recording of full request/response pairs, stored
+// in Redis so it covers every instance and can be downloaded from any.
+type capture struct {
+	ID         string        `json:"id"`
+	Filter     captureFilter `json:"filter"`
+	MaxEntries int           `json:"max_entries"`
+	Actor      string        `json:"actor"`
+	StartedAt  time.Time     `json:"started_at"`
+	Until      time.Time     `json:"until"`
+	Entries    int64         `json:"entries"`
+}
+
+func (s *Server) captureKey(id string) string {
+	return s.redisKey("capture:" + id)
+}
+
+func (s *Server) captureEntriesKey(id string) string {
+	return s.redisKey("capture:" + id + ":entries")
+}
+
+func (s *Server) captureIndexKey() string {
+	return s.redisKey("captures")
+}
+
+func (s *Server) activeCaptureKey() string {
+	return s.redisKey("capture:active")
+}
+
+// harNameValue is a header or query parameter of a HAR entry.
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harEntry is an entry of a HAR 1.2 log.
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	} `json:"timings"`
+	CacheStatus string `json:"_cacheStatus,omitempty"`
+	Instance    string `json:"_instance,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     struct {
+		Size     int    `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+		Encoding string `json:"encoding,omitempty"`
+	} `json:"content"`
+	RedirectURL string `json:"redirectURL"`
+	HeadersSize int    `json:"headersSize"`
+	BodySize    int    `json:"bodySize"`
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			if captureRedactedHeaders[name] {
+				v = "REDACTED"
+			}
+			headers = append(headers, harNameValue{Name: name, Value: v})
+		}
+	}
+	return headers
+}
+
+// newHAREntry records a served request with its credentials and usage
+// channel, the parameters left out of cache keys, redacted. Bodies that are
+// not UTF-8 text, such as gzip or protobuf, are base64 encoded.
+func (s *Server) newHAREntry(r *http.Request, reqBody []byte, w *cacheStatusResponseWriter, start time.Time) harEntry {
+	elapsed := float64(time.Since(start).Microseconds()) / 1000
+	u := *r.URL
+	q := u.Query()
+	for name := range unkeyedParams {
+		if q.Has(name) {
+			q.Set(name, "REDACTED")
+		}
+	}
+	u.RawQuery = q.Encode()
+	u.Scheme = "http"
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	u.Host = r.Host
+
+	e := harEntry{
+		StartedDateTime: start.UTC().Format(time.RFC3339Nano),
+		Time:            elapsed,
+		CacheStatus:     w.cacheStatus,
+		Instance:        s.instanceID,
+	}
+	e.Timings.Wait = elapsed
+	e.Request = harRequest{
+		Method:      r.Method,
+		URL:         u.String(),
+		HTTPVersion: r.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(r.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	for name, values := range q {
+		for _, v := range values {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+	if len(reqBody) > 0 {
+		e.Request.BodySize = len(reqBody)
+		e.Request.PostData = &harPostData{MimeType: r.Header.Get("Content-Type"), Text: string(reqBody)}
+	}
+
+	body := w.body.Bytes()
+	e.Response = harResponse{
+		Status:      w.statusCode,
+		StatusText:  http.StatusText(w.statusCode),
+		HTTPVersion: r.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(w.Header()),
+		HeadersSize: -1,
+		BodySize:    w.bytes,
+	}
+	e.Response.Content.Size = w.bytes
+	e.Response.Content.MimeType = w.Header().Get("Content-Type")
+	if utf8.Valid(body) {
+		e.Response.Content.Text = string(body)
+	} else {
+		e.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+		e.Response.Content.Encoding = "base64"
+	}
+	if w.bytes > len(body) {
+		e.Comment = "response body truncated"
+	}
+	return e
+}
+
+// captureMiddleware records the requests matching the active capture. It
+// must be wrapped by logMiddleware, which provides the response writer the
+// body is copied from.
+func (s *Server) captureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := s.capture.Load()
+		csw, ok := w.(*cacheStatusResponseWriter)
+		if c == nil || !ok || s.clock.Now().After(c.Until) || !c.Filter.matchesRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		var reqBody []byte
+		if r.Body != nil && r.Method == http.MethodPost {
+			reqBody, _ = io.ReadAll(io.LimitReader(r.Body, captureMaxBody))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(reqBody), r.Body))
+		}
+		csw.body = &bytes.Buffer{}
+		csw.maxBody = captureMaxBody
+		next.ServeHTTP(w, r)
+		if c.Filter.CacheStatus != "" && !strings.EqualFold(c.Filter.CacheStatus, csw.cacheStatus) {
+			return
+		}
+		entry := s.newHAREntry(r, reqBody, csw, start)
+		go s.appendCaptureEntry(c, entry)
+	})
+}
+
+// appendCaptureEntry stores entry and ends the capture once it is full.
+func (s *Server) appendCaptureEntry(c *capture, entry harEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := s.redis.RPush(ctx, s.captureEntriesKey(c.ID), data).Result()
+	if err != nil {
+		s.logger.Log(LogWarning, "Failed to record capture entry: %v", err)
+		return
+	}
+	if n == 1 {
+		s.redis.ExpireAt(ctx, s.captureEntriesKey(c.ID), c.Until.Add(captureRetention))
+	}
+	if n >= int64(c.MaxEntries) {
+		s.redis.LTrim(ctx, s.captureEntriesKey(c.ID), 0, int64(c.MaxEntries)-1)
+		s.stopCapture(ctx, c.ID)
+	}
+}
+
+// stopCapture ends capture id on every instance.
+func (s *Server) stopCapture(ctx context.Context, id string) {
+	if active, err := s.redis.Get(ctx, s.activeCaptureKey()).Result(); err == nil && active == id {
+		s.redis.Del(ctx, s.activeCaptureKey())
+	}
+	if c := s.capture.Load(); c != nil && c.ID == id {
+		s.capture.CompareAndSwap(c, nil)
+	}
+}
+
+// syncCapture loads the capture active on the fleet. A capture started
+// locally while Redis was being read is kept.
+func (s *Server) syncCapture(ctx context.Context) error {
+	current := s.capture.Load()
+	id, err := s.redis.Get(ctx, s.activeCaptureKey()).Result()
+	if errors.Is(err, redis.Nil) {
+		s.capture.CompareAndSwap(current, nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if current != nil && current.ID == id {
+		return nil
+	}
+	data, err := s.redis.Get(ctx, s.captureKey(id)).Bytes()
+	if err != nil {
+		return err
+	}
+	var c capture
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	s.capture.CompareAndSwap(current, &c)
+	return nil
+}
+
+// runCaptureSync keeps the active capture in line with the other instances.
+func (s *Server) runCaptureSync() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), captureSyncInterval)
+		if err := s.syncCapture(ctx); err != nil {
+			s.logger.Log(LogWarning, "Failed to read active capture: %v", err)
+		}
+		cancel()
+		<-s.clock.After(captureSyncInterval)
+	}
+}
+
+// handleStartCapture starts a capture from a JSON body {"duration_seconds",
+// "max_entries", "filter"}. Only one capture can run at a time.
+func (s *Server) handleStartCapture(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DurationSeconds int           `json:"duration_seconds"`
+		MaxEntries      int           `json:"max_entries"`
+		Filter          captureFilter `json:"filter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+	duration := time.Duration(req.DurationSeconds) * time.Second
+	if duration <= 0 {
+		duration = captureDefaultDuration
+	}
+	if duration > captureMaxDuration {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "duration_seconds must not exceed " + captureMaxDuration.String()})
+		return
+	}
+	if req.MaxEntries <= 0 {
+		req.MaxEntries = captureDefaultMaxEntries
+	}
+	if req.MaxEntries > captureMaxEntries {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "max_entries must not exceed 10000"})
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	now := s.clock.Now().UTC()
+	c := capture{
+		ID:         hex.EncodeToString(id),
+		Filter:     req.Filter,
+		MaxEntries: req.MaxEntries,
+		Actor:      adminActor(r),
+		StartedAt:  now,
+		Until:      now.Add(duration),
+	}
+	data, _ := json.Marshal(c)
+
+	ctx := r.Context()
+	started, err := s.redis.SetNX(ctx, s.activeCaptureKey(), c.ID, duration).Result()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if !started {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "a capture is already running"})
+		return
+	}
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, s.captureKey(c.ID), data, duration+captureRetention)
+	pipe.SAdd(ctx, s.captureIndexKey(), c.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		s.redis.Del(ctx, s.activeCaptureKey())
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	s.capture.Store(&c)
+
+	filter, _ := json.Marshal(c.Filter)
+	s.logger.Log(LogInfo, "Started capture %s for %s", c.ID, duration)
+	s.auditLog.Record(c.Actor, AuditCaptureStart, map[string]string{"id": c.ID, "until": c.Until.Format(time.RFC3339), "filter": string(filter)})
+	writeJSON(w, http.StatusCreated, c)
+}
+
+// handleListCaptures lists the captures that can still be downloaded,
+// dropping expired ones from the index.
+func (s *Server) handleListCaptures(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ids, err := s.redis.SMembers(ctx, s.captureIndexKey()).Result()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	captures := []capture{}
+	for _, id := range ids {
+		data, err := s.redis.Get(ctx, s.captureKey(id)).Bytes()
+		if errors.Is(err, redis.Nil) {
+			s.redis.SRem(ctx, s.captureIndexKey(), id)
+			continue
+		}
+		var c capture
+		if err != nil || json.Unmarshal(data, &c) != nil {
+			continue
+		}
+		c.Entries, _ = s.redis.LLen(ctx, s.captureEntriesKey(id)).Result()
+		captures = append(captures, c)
+	}
+	writeJSON(w, http.StatusOK, captures)
+}
+
+// handleDownloadCapture returns a capture as a HAR file.
+func (s *Server) handleDownloadCapture(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	ctx := r.Context()
+	if n, err := s.redis.Exists(ctx, s.captureKey(id)).Result(); err != nil || n == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "capture not found"})
+		return
+	}
+	raw, err := s.redis.LRange(ctx, s.captureEntriesKey(id), 0, -1).Result()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	entries := make([]json.RawMessage, len(raw))
+	for i, e := range raw {
+		entries[i] = json.RawMessage(e)
+	}
+	har := map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]string{"name": "geocache", "version": apiConfig.Version},
+			"entries": entries,
+		},
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="capture-`+url.PathEscape(id)+`.har"`)
+	writeJSON(w, http.StatusOK, har)
+}
+
+// handleDeleteCapture stops a capture and deletes its entries.
+func (s *Server) handleDeleteCapture(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	ctx := r.Context()
+	s.stopCapture(ctx, id)
+	deleted, err := s.redis.Del(ctx, s.captureKey(id), s.captureEntriesKey(id)).Result()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	s.redis.SRem(ctx, s.captureIndexKey(), id)
+	if deleted == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "capture not found"})
+		return
+	}
+	s.auditLog.Record(adminActor(r), AuditCaptureDelete, map[string]string{"id": id})
+	writeJSON(w, http.StatusOK, map[string]string{"id": id, "status": "deleted"})
+}
@@ -0,0 +1,103 @@
+package geocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrafficCapture(t *testing.T) {
+	transport := &recordingTransport{body: `{"status":"OK","results":[]}`}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	handler := server.routes()
+
+	admin := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := admin(http.MethodPost, "/admin/captures", `{"duration_seconds":60,"max_entries":2,"filter":{"path":"/maps/api/geocode"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var c capture
+	json.Unmarshal(w.Body.Bytes(), &c)
+	if w := admin(http.MethodPost, "/admin/captures", `{}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected a second capture to be rejected with 409, got %d", w.Code)
+	}
+
+	for _, path := range []string{
+		directionsPath + "?origin=a&destination=b",
+		geocodePath + "?address=Main&key=secret-key&client=gme-secret-client&signature=secret-signature&channel=secret-channel",
+		geocodePath + "?address=Elm",
+		geocodePath + "?address=Oak",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Maps-API-Key", "secret-key")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if !waitFor(t, func() bool { return !mr.Exists(server.activeCaptureKey()) }) {
+		t.Fatalf("Expected the capture to stop once full")
+	}
+
+	w = admin(http.MethodGet, "/admin/captures/"+c.ID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "secret-") {
+		t.Errorf("Expected the credentials and channel to be redacted, got %s", w.Body.String())
+	}
+	var har struct {
+		Log struct {
+			Version string     `json:"version"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &har); err != nil {
+		t.Fatalf("Failed to decode HAR: %v", err)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 2 {
+		t.Fatalf("Expected a HAR 1.2 log with 2 entries, got %q with %d", har.Log.Version, len(har.Log.Entries))
+	}
+	for _, e := range har.Log.Entries {
+		if !strings.HasPrefix(e.Request.URL, "http://example.com"+geocodePath) {
+			t.Errorf("Unexpected captured URL %s", e.Request.URL)
+		}
+		if e.Response.Status != http.StatusOK || e.Response.Content.Text != transport.body || e.CacheStatus != "MISS" {
+			t.Errorf("Unexpected captured response %+v", e.Response)
+		}
+	}
+
+	w = admin(http.MethodGet, "/admin/captures", "")
+	var list []capture
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 1 || list[0].Entries != 2 {
+		t.Errorf("Expected 1 capture with 2 entries, got %+v", list)
+	}
+
+	if w := admin(http.MethodDelete, "/admin/captures/"+c.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status code 200 deleting the capture, got %d", w.Code)
+	}
+	if w := admin(http.MethodGet, "/admin/captures/"+c.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a deleted capture to be gone, got %d", w.Code)
+	}
+}
+
+func TestHARHeaders_RedactsCookies(t *testing.T) {
+	headers := harHeaders(http.Header{"Set-Cookie": {"session=secret"}, "Content-Type": {"application/json"}})
+	for _, h := range headers {
+		if h.Name == "Set-Cookie" && h.Value != "REDACTED" {
+			t.Errorf("Expected Set-Cookie to be redacted, got %q", h.Value)
+		}
+		if h.Name == "Content-Type" && h.Value != "application/json" {
+			t.Errorf("Expected Content-Type to be kept, got %q", h.Value)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// casPointerPrefix starts entries that point to a content-addressed blob
+// instead of holding the body. Cached bodies are JSON, gzip or protobuf
+// data, none of which starts with a NUL byte, or envelopes, which start with
+// entryEnvelopePrefix.
+const casPointerPrefix = "\x00cas:"
+
+// casRelease is the Lua helper managing blobs. A blob holds the body, the
+// number of entries pointing to it (refs), how many of those never expire
+// (pinned), and when the last of the others expires (expires_at, in Unix
+// milliseconds of the Redis clock). Redis cannot report expirations, so the
+// references of expired entries are never released: instead, the blob
+// expires with the last entry pointing to it, unless it is pinned. Blob keys
+// must be declared in KEYS, as Redis requires of scripts: blobOf only names
+// the blob of a value, and undeclaredBlob checks that the scripts were given
+// the blobs the entries point to. Entries are read with getEntry, so that
+// hash entries written with CACHE_HASH_ENTRIES are replaced like others.
+const casRelease = hashEntryGet + `
+local function blobOf(value)
+	if value and string.sub(value, 1, #ARGV[1]) == ARGV[1] then
+		return ARGV[2] .. string.sub(value, #ARGV[1] + 1)
+	end
+	return nil
+end
+local function undeclaredBlob(entries)
+	local declared = {}
+	for i = entries + 1, #KEYS do
+		declared[KEYS[i]] = true
+	end
+	for i = 1, entries do
+		local blob = blobOf(getEntry(KEYS[i]))
+		if blob and not declared[blob] then
+			return KEYS[i]
+		end
+	end
+	return nil
+end
+local function resolve(value)
+	local blob = blobOf(value)
+	if blob then
+		return redis.call('HGET', blob, 'body'), blob
+	end
+	return value, nil
+end
+local function isPinned(key)
+	return redis.call('PTTL', key) == -1
+end
+local function release(blob, pinned)
+	if redis.call('HINCRBY', blob, 'refs', -1) <= 0 then
+		redis.call('DEL', blob)
+		return
+	end
+	if pinned and redis.call('HINCRBY', blob, 'pinned', -1) <= 0 then
+		local expiresAt = tonumber(redis.call('HGET', blob, 'expires_at')) or 0
+		if expiresAt > 0 then
+			redis.call('PEXPIREAT', blob, expiresAt)
+		end
+	end
+end
+`
+
+// casEntrySet is the Lua helper pointing key to the blob holding value, with
+// the entry TTL ttl in milliseconds (0 for none), and returning the body the
+// entry held before. The reference to the new blob is taken before the one
+// to the previous blob is released, as they may be the same.
+const casEntrySet = `
+local function acquire(blob, value, ttl)
+	if redis.call('EXISTS', blob) == 0 then
+		redis.call('HSET', blob, 'body', value, 'refs', 0, 'pinned', 0, 'expires_at', 0)
+	end
+	redis.call('HINCRBY', blob, 'refs', 1)
+	if ttl <= 0 then
+		redis.call('HINCRBY', blob, 'pinned', 1)
+		redis.call('PERSIST', blob)
+		return
+	end
+	local time = redis.call('TIME')
+	local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+	local expiresAt = math.max(now + ttl, tonumber(redis.call('HGET', blob, 'expires_at')) or 0)
+	local current = redis.call('PTTL', blob)
+	if current > 0 then
+		expiresAt = math.max(expiresAt, now + current)
+	end
+	redis.call('HSET', blob, 'expires_at', expiresAt)
+	if (tonumber(redis.call('HGET', blob, 'pinned')) or 0) <= 0 then
+		redis.call('PEXPIREAT', blob, expiresAt)
+	end
+end
+local function setCASEntry(key, blob, value, pointer, ttl)
+	local previous = getEntry(key)
+	local pinned = previous and isPinned(key)
+	local body, oldBlob = resolve(previous)
+	acquire(blob, value, ttl)
+	if ttl > 0 then
+		redis.call('SET', key, pointer, 'PX', ttl)
+	else
+		redis.call('SET', key, pointer)
+	end
+	if oldBlob then
+		release(oldBlob, pinned)
+	end
+	return body
+end
+`
+
+// casSetScript points KEYS[1] to the blob KEYS[2] holding ARGV[3] with
+// setCASEntry. KEYS[3], when set, is the blob KEYS[1] points to. ARGV[1] and
+// ARGV[2] are the pointer and blob key prefixes, ARGV[4] the pointer and
+// ARGV[5] the entry TTL in milliseconds.
+var casSetScript = redis.NewScript(casRelease + casEntrySet + `
+local moved = undeclaredBlob(1)
+if moved then
+	return redis.error_reply('CASMOVED ' .. moved)
+end
+return setCASEntry(KEYS[1], KEYS[2], ARGV[3], ARGV[4], tonumber(ARGV[5]))
+`)
+
+// casDeleteScript deletes the first ARGV[3] KEYS, releasing the blobs they
+// point to, which follow them in KEYS, and returns how many existed.
+var casDeleteScript = redis.NewScript(casRelease + `
+local entries = tonumber(ARGV[3])
+local moved = undeclaredBlob(entries)
+if moved then
+	return redis.error_reply('CASMOVED ' .. moved)
+end
+local deleted = 0
+for i = 1, entries do
+	local key = KEYS[i]
+	local blob = blobOf(getEntry(key))
+	local pinned = isPinned(key)
+	deleted = deleted + redis.call('DEL', key)
+	if blob then
+		release(blob, pinned)
+	end
+end
+return deleted
+`)
+
+// casAttempts bounds the runs of a script whose entries were repointed to
+// other blobs between reading them and running it.
+const casAttempts = 5
+
+// withBlobs calls run with the blobs the entries keys point to, without
+// duplicates, for it to declare them to its script. run is called again
+// while its script reports an entry repointed in between.
+func (s *redisStore) withBlobs(ctx context.Context, keys []string, run func(blobs []string) error) error {
+	for attempt := 1; ; attempt++ {
+		values, err := s.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		var blobs []string
+		for _, v := range values {
+			if str, ok := v.(string); ok && strings.HasPrefix(str, casPointerPrefix) {
+				if blob := s.blobKey([]byte(str)); !slices.Contains(blobs, blob) {
+					blobs = append(blobs, blob)
+				}
+			}
+		}
+		err = run(blobs)
+		if err == nil || attempt == casAttempts || !strings.HasPrefix(err.Error(), "CASMOVED ") {
+			return err
+		}
+	}
+}
+
+// contentHash names the blob holding body.
+func contentHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// blobKey returns the key of the blob a pointer refers to.
+func (s *redisStore) blobKey(pointer []byte) string {
+	return s.blobPrefix + string(pointer[len(casPointerPrefix):])
+}
+
+// resolve replaces pointers among values by the bodies of their blobs, or by
+// nil when a blob is gone.
+func (s *redisStore) resolve(ctx context.Context, values [][]byte) error {
+	pipe := s.client.Pipeline()
+	cmds := make(map[int]*redis.StringCmd)
+	for i, v := range values {
+		if bytes.HasPrefix(v, []byte(casPointerPrefix)) {
+			cmds[i] = pipe.HGet(ctx, s.blobKey(v), "body")
+		}
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+	for i, cmd := range cmds {
+		if body, err := cmd.Bytes(); err == nil {
+			values[i] = body
+		} else {
+			values[i] = nil
+		}
+	}
+	return nil
+}
+
+// casSet stores value as a blob shared by every entry with the same body.
+func (s *redisStore) casSet(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	hash := contentHash(value)
+	var previous []byte
+	err := s.withBlobs(ctx, []string{key}, func(blobs []string) error {
+		previous = nil
+		body, err := casSetScript.Run(ctx, s.client,
+			append([]string{key, s.blobPrefix + hash}, blobs...),
+			casPointerPrefix, s.blobPrefix, value, casPointerPrefix+hash, ttl.Milliseconds(),
+		).Text()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		previous = []byte(body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// casDelete deletes keys with casDeleteScript.
+func (s *redisStore) casDelete(ctx context.Context, keys []string) (int64, error) {
+	var deleted int64
+	err := s.withBlobs(ctx, keys, func(blobs []string) error {
+		var err error
+		deleted, err = casDeleteScript.Run(ctx, s.client, append(slices.Clone(keys), blobs...),
+			casPointerPrefix, s.blobPrefix, len(keys)).Int64()
+		return err
+	})
+	return deleted, err
+}
@@ -0,0 +1,123 @@
+package geocache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisStore_ContentAddressed(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to create miniredis: %v", err)
+	}
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	mr.SetTime(time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC))
+	store := newRedisStore(rdb, "test", true)
+	ctx := context.Background()
+
+	body := []byte(`{"status":"OK","results":[]}`)
+	blob := "test:blob:" + contentHash(body)
+	if err := store.Set(ctx, "test:a", body, time.Hour); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Set(ctx, "test:b", body, 2*time.Hour); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	values, err := store.Get(ctx, "test:a", "test:b", "test:missing")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if string(values[0]) != string(body) || string(values[1]) != string(body) || values[2] != nil {
+		t.Errorf("Unexpected values %q", values)
+	}
+	if refs := mr.HGet(blob, "refs"); refs != "2" {
+		t.Errorf("Expected 2 references, got %s", refs)
+	}
+	if ttl := mr.TTL(blob); ttl != 2*time.Hour {
+		t.Errorf("Expected the blob to outlive its longest entry, got TTL %v", ttl)
+	}
+
+	// Replacing an entry returns the previous body and moves its reference.
+	previous, err := store.Swap(ctx, "test:a", []byte(`{"status":"OK"}`), time.Hour)
+	if err != nil {
+		t.Fatalf("Swap failed: %v", err)
+	}
+	if string(previous) != string(body) {
+		t.Errorf("Expected previous body %s, got %s", body, previous)
+	}
+	if refs := mr.HGet(blob, "refs"); refs != "1" {
+		t.Errorf("Expected 1 reference, got %s", refs)
+	}
+
+	// Storing the same body again does not add a reference.
+	store.Set(ctx, "test:b", body, 2*time.Hour)
+	if refs := mr.HGet(blob, "refs"); refs != "1" {
+		t.Errorf("Expected 1 reference, got %s", refs)
+	}
+
+	deleted, err := store.Delete(ctx, "test:b", "test:missing")
+	if err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 deleted entry, got %d", deleted)
+	}
+	if mr.Exists(blob) {
+		t.Errorf("Expected the blob to be deleted with its last reference")
+	}
+
+	// Pointers are still resolved with content addressing turned off.
+	values, err = newRedisStore(rdb, "test", false).Get(ctx, "test:a")
+	if err != nil || string(values[0]) != `{"status":"OK"}` {
+		t.Errorf("Expected the pointer to be resolved, got %q, %v", values, err)
+	}
+
+	// An entry without a TTL keeps the blob until it is released, after which
+	// the blob expires with the other entries pointing to it.
+	store.Set(ctx, "test:c", body, 0)
+	store.Set(ctx, "test:d", body, time.Hour)
+	if ttl := mr.TTL(blob); ttl != 0 {
+		t.Errorf("Expected the blob of an entry without TTL not to expire, got TTL %v", ttl)
+	}
+	store.Set(ctx, "test:c", []byte(`{"status":"OK"}`), 0)
+	if ttl := mr.TTL(blob); ttl != time.Hour {
+		t.Errorf("Expected the blob to expire with its last entry once released, got TTL %v", ttl)
+	}
+	mr.FastForward(time.Hour)
+	if mr.Exists(blob) {
+		t.Errorf("Expected the blob to expire with its last entry")
+	}
+}
+
+func TestRedisStore_CASDeclaresRepointedBlobs(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	store := newRedisStore(rdb, "test", true)
+	ctx := context.Background()
+
+	store.Set(ctx, "test:a", []byte(`{"status":"OK"}`), time.Hour)
+	moved := "test:blob:" + contentHash([]byte(`{"status":"ZERO_RESULTS"}`))
+	attempts := 0
+	err := store.withBlobs(ctx, []string{"test:a"}, func(blobs []string) error {
+		attempts++
+		if attempts == 1 {
+			// Another server repoints the entry after it was read.
+			store.Set(ctx, "test:a", []byte(`{"status":"ZERO_RESULTS"}`), time.Hour)
+		}
+		return casDeleteScript.Run(ctx, rdb, append([]string{"test:a"}, blobs...), casPointerPrefix, store.blobPrefix, 1).Err()
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("Expected the delete to be retried once with the new blob, got %d attempts, %v", attempts, err)
+	}
+	if mr.Exists("test:a") || mr.Exists(moved) {
+		t.Errorf("Expected the entry and its blob to be deleted")
+	}
+}
@@ -0,0 +1,197 @@
+package geocache
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const earthRadiusMeters = 6371000.0
+
+// responseFingerprint holds the fields of a response that routing depends on.
+type responseFingerprint struct {
+	FormattedAddress string
+	HasLocation      bool
+	Lat, Lng         float64
+	HasDistance      bool
+	DistanceMeters   int
+}
+
+// FieldChange describes one material difference between two responses.
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+type latLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+type distanceValue struct {
+	Value int `json:"value"`
+}
+
+// fingerprintResponse extracts the compared fields for the endpoints that
+// support change detection. It returns false for other endpoints and for
+// responses that are not successful.
+func fingerprintResponse(path string, body []byte) (responseFingerprint, bool) {
+	var fp responseFingerprint
+	switch path {
+	case geocodePath:
+		var resp struct {
+			Status  string `json:"status"`
+			Results []struct {
+				FormattedAddress string `json:"formatted_address"`
+				Geometry         struct {
+					Location latLng `json:"location"`
+				} `json:"geometry"`
+			} `json:"results"`
+		}
+		if json.Unmarshal(body, &resp) != nil || resp.Status != "OK" || len(resp.Results) == 0 {
+			return fp, false
+		}
+		fp.FormattedAddress = resp.Results[0].FormattedAddress
+		fp.HasLocation = true
+		fp.Lat = resp.Results[0].Geometry.Location.Lat
+		fp.Lng = resp.Results[0].Geometry.Location.Lng
+	case directionsPath:
+		var resp struct {
+			Status string `json:"status"`
+			Routes []struct {
+				Legs []struct {
+					Distance distanceValue `json:"distance"`
+				} `json:"legs"`
+			} `json:"routes"`
+		}
+		if json.Unmarshal(body, &resp) != nil || resp.Status != "OK" || len(resp.Routes) == 0 {
+			return fp, false
+		}
+		fp.HasDistance = true
+		for _, leg := range resp.Routes[0].Legs {
+			fp.DistanceMeters += leg.Distance.Value
+		}
+	case distanceMatrixPath:
+		var resp struct {
+			Status string `json:"status"`
+			Rows   []struct {
+				Elements []struct {
+					Distance distanceValue `json:"distance"`
+				} `json:"elements"`
+			} `json:"rows"`
+		}
+		if json.Unmarshal(body, &resp) != nil || resp.Status != "OK" {
+			return fp, false
+		}
+		fp.HasDistance = true
+		for _, row := range resp.Rows {
+			for _, el := range row.Elements {
+				fp.DistanceMeters += el.Distance.Value
+			}
+		}
+	default:
+		return fp, false
+	}
+	return fp, true
+}
+
+// diffFingerprints reports the fields that changed by more than the
+// configured thresholds.
+func diffFingerprints(old, new responseFingerprint, locationThresholdMeters, distanceThresholdPercent float64) []FieldChange {
+	var changes []FieldChange
+	if old.FormattedAddress != new.FormattedAddress {
+		changes = append(changes, FieldChange{Field: "formatted_address", Old: old.FormattedAddress, New: new.FormattedAddress})
+	}
+	if old.HasLocation && new.HasLocation {
+		if moved := haversineMeters(old.Lat, old.Lng, new.Lat, new.Lng); moved > locationThresholdMeters {
+			changes = append(changes, FieldChange{
+				Field: "location",
+				Old:   fmt.Sprintf("%f,%f", old.Lat, old.Lng),
+				New:   fmt.Sprintf("%f,%f (moved %.0fm)", new.Lat, new.Lng, moved),
+			})
+		}
+	}
+	if old.HasDistance && new.HasDistance && old.DistanceMeters != new.DistanceMeters {
+		delta := math.Abs(float64(new.DistanceMeters - old.DistanceMeters))
+		if old.DistanceMeters == 0 || delta/float64(old.DistanceMeters)*100 > distanceThresholdPercent {
+			changes = append(changes, FieldChange{
+				Field: "distance",
+				Old:   fmt.Sprintf("%dm", old.DistanceMeters),
+				New:   fmt.Sprintf("%dm", new.DistanceMeters),
+			})
+		}
+	}
+	return changes
+}
+
+func haversineMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLng := toRad(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// detectChanges compares a replaced cache entry with its replacement and
+// reports material changes through metrics, logs and InfluxDB.
+func (s *Server) detectChanges(r *http.Request, cacheKey string, previous, current []byte) {
+	oldFP, ok := fingerprintResponse(r.URL.Path, previous)
+	if !ok {
+		return
+	}
+	newFP, ok := fingerprintResponse(r.URL.Path, current)
+	if !ok {
+		return
+	}
+
+	for _, c := range diffFingerprints(oldFP, newFP, s.config.ChangeLocationThresholdMeters, s.config.ChangeDistanceThresholdPercent) {
+		s.metrics.ObserveChange(r.URL.Path, c.Field)
+		s.logger.LogContext(r.Context(), LogWarning, "Upstream response changed: path=%s cache_key=%s field=%s old=%q new=%q", r.URL.Path, cacheKey, c.Field, c.Old, c.New)
+		s.events.RecordChange(r, cacheKey, c)
+	}
+}
+
+// handleRefresh re-fetches a query from upstream and replaces its cache
+// entry. The upstream API key is taken from the uri or the admin request's
+// X-Maps-API-Key header.
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if mode := s.maintenanceState().Mode; mode != MaintenanceOff {
+		writeMaintenance(w, mode, "upstream requests are disabled in maintenance mode")
+		return
+	}
+	u, err := url.ParseRequestURI(r.URL.Query().Get("uri"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "uri must be a request URI"})
+		return
+	}
+	req := &http.Request{Method: http.MethodGet, URL: u, Header: make(http.Header)}
+	if key := r.Header.Get("X-Maps-API-Key"); key != "" {
+		req.Header.Set("X-Maps-API-Key", key)
+	}
+
+	upstreamReq := req
+	if wantsGeoJSON(req) {
+		upstreamReq = withoutOutputParam(req)
+	}
+	fetchedAt := time.Now()
+	resp, err := s.upstream.Fetch(upstreamReq)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	if quotaExceeded(resp) {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "upstream quota exceeded"})
+		return
+	}
+	cacheKey := s.cacheKey(req)
+	if body, ok := s.cacheBody(req, resp.Body); ok {
+		s.storeResponse(req, cacheKey, body, fetchedAt)
+	}
+	s.auditLog.Record(adminActor(r), AuditCacheRefresh, map[string]string{"uri": u.RequestURI(), "upstream_status": strconv.Itoa(resp.StatusCode)})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"cache_key": cacheKey, "upstream_status": resp.StatusCode})
+}
@@ -0,0 +1,141 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDiffFingerprints(t *testing.T) {
+	geocode := func(address string, lat, lng float64) string {
+		return `{"status":"OK","results":[{"formatted_address":"` + address + `","geometry":{"location":{"lat":` +
+			formatFloat(lat) + `,"lng":` + formatFloat(lng) + `}}}]}`
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		old      string
+		new      string
+		expected []string
+	}{
+		{
+			name:     "geocode unchanged",
+			path:     geocodePath,
+			old:      geocode("1 Main St", 40.0, -74.0),
+			new:      geocode("1 Main St", 40.0, -74.0),
+			expected: nil,
+		},
+		{
+			name:     "geocode moved below threshold",
+			path:     geocodePath,
+			old:      geocode("1 Main St", 40.0, -74.0),
+			new:      geocode("1 Main St", 40.0001, -74.0),
+			expected: nil,
+		},
+		{
+			name:     "geocode moved and renamed",
+			path:     geocodePath,
+			old:      geocode("1 Main St", 40.0, -74.0),
+			new:      geocode("1 Main Street", 40.01, -74.0),
+			expected: []string{"formatted_address", "location"},
+		},
+		{
+			name:     "directions distance change below threshold",
+			path:     directionsPath,
+			old:      `{"status":"OK","routes":[{"legs":[{"distance":{"value":10000}}]}]}`,
+			new:      `{"status":"OK","routes":[{"legs":[{"distance":{"value":10200}}]}]}`,
+			expected: nil,
+		},
+		{
+			name:     "directions distance change above threshold",
+			path:     directionsPath,
+			old:      `{"status":"OK","routes":[{"legs":[{"distance":{"value":10000}}]}]}`,
+			new:      `{"status":"OK","routes":[{"legs":[{"distance":{"value":6000}},{"distance":{"value":6000}}]}]}`,
+			expected: []string{"distance"},
+		},
+		{
+			name:     "distance matrix element change",
+			path:     distanceMatrixPath,
+			old:      `{"status":"OK","rows":[{"elements":[{"distance":{"value":100}}]}]}`,
+			new:      `{"status":"OK","rows":[{"elements":[{"distance":{"value":200}}]}]}`,
+			expected: []string{"distance"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldFP, ok := fingerprintResponse(tt.path, []byte(tt.old))
+			if !ok {
+				t.Fatal("Expected old response to be fingerprinted")
+			}
+			newFP, ok := fingerprintResponse(tt.path, []byte(tt.new))
+			if !ok {
+				t.Fatal("Expected new response to be fingerprinted")
+			}
+			changes := diffFingerprints(oldFP, newFP, 50, 5)
+			if len(changes) != len(tt.expected) {
+				t.Fatalf("Expected changes %v, got %+v", tt.expected, changes)
+			}
+			for i, c := range changes {
+				if c.Field != tt.expected[i] {
+					t.Errorf("Expected change %d to be %s, got %s", i, tt.expected[i], c.Field)
+				}
+			}
+		})
+	}
+}
+
+func TestFingerprintResponse_Unsupported(t *testing.T) {
+	if _, ok := fingerprintResponse("/maps/api/place/details/json", []byte(`{"status":"OK"}`)); ok {
+		t.Error("Expected unsupported endpoint not to be fingerprinted")
+	}
+	if _, ok := fingerprintResponse(geocodePath, []byte(`{"status":"ZERO_RESULTS","results":[]}`)); ok {
+		t.Error("Expected unsuccessful response not to be fingerprinted")
+	}
+}
+
+func TestRefresh_DetectsChanges(t *testing.T) {
+	transport := &recordingTransport{
+		body: `{"status":"OK","results":[{"formatted_address":"1 Main St","geometry":{"location":{"lat":41.0,"lng":-74.0}}}]}`,
+	}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.ChangeDetection = true
+	server.config.ChangeLocationThresholdMeters = 50
+	server.config.ChangeDistanceThresholdPercent = 5
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+
+	cacheKey := getCacheKey(httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=main", nil), server.config.RedisPrefix)
+	mr.Set(cacheKey, `{"status":"OK","results":[{"formatted_address":"1 Main St","geometry":{"location":{"lat":40.0,"lng":-74.0}}}]}`)
+	mr.SetTTL(cacheKey, time.Hour)
+
+	before := testutil.ToFloat64(cacheEntryChangesTotal.WithLabelValues(geocodePath, "location"))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/refresh?uri=%2Fmaps%2Fapi%2Fgeocode%2Fjson%3Faddress%3Dmain", nil)
+	req.Header.Set("X-Maps-API-Key", "admin-key")
+	w := httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	after := testutil.ToFloat64(cacheEntryChangesTotal.WithLabelValues(geocodePath, "location"))
+	if after-before != 1 {
+		t.Errorf("Expected location change to be counted once, got %v", after-before)
+	}
+	if cached, _ := mr.Get(cacheKey); cached != transport.body {
+		t.Errorf("Expected cache entry to be replaced, got %s", cached)
+	}
+	if len(transport.urls) != 1 || transport.urls[0] != "https://maps.googleapis.com/maps/api/maps/api/geocode/json?address=main&key=admin-key" {
+		t.Errorf("Unexpected upstream requests %v", transport.urls)
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,268 @@
+package geocache
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Authenticators of AUTH_CHAIN.
+const (
+	authIP        = "ip"
+	authAPIKey    = "api_key"
+	authJWT       = "jwt"
+	authAnonymous = "anonymous"
+)
+
+// clientIdentity is the caller of a proxied request, as established by the
+// first authenticator of the chain that accepted it. ID is empty for
+// anonymous callers.
+type clientIdentity struct {
+	Method string
+	ID     string
+}
+
+type clientIdentityKey struct{}
+
+// clientIdentityFromContext returns the identity attached by authMiddleware,
+// or nil when the request was not authenticated.
+func clientIdentityFromContext(ctx context.Context) *clientIdentity {
+	id, _ := ctx.Value(clientIdentityKey{}).(*clientIdentity)
+	return id
+}
+
+// authenticator accepts or passes on a request. It returns the identity of
+// the caller when it accepts it.
+type authenticator interface {
+	authenticate(r *http.Request) (*clientIdentity, bool)
+}
+
+// ipAuthenticator accepts requests from AUTH_ALLOWED_CIDRS, identified by
+// their address.
+type ipAuthenticator struct {
+	cidrs []string
+}
+
+func (a ipAuthenticator) authenticate(r *http.Request) (*clientIdentity, bool) {
+	if len(a.cidrs) == 0 || !isIPAllowed(r.RemoteAddr, a.cidrs) {
+		return nil, false
+	}
+	return &clientIdentity{Method: authIP, ID: "ip:" + addrHost(r.RemoteAddr)}, true
+}
+
+// apiKeyAuthenticator accepts requests carrying a Maps API key of
+// AUTH_API_KEYS, identified by the name of the key.
+type apiKeyAuthenticator struct {
+	keys []adminToken
+}
+
+// parseAuthAPIKeys parses Config.AuthAPIKeys, a mapping of names to keys or
+// to "sha256:<hex digest>" of keys.
+func parseAuthAPIKeys(raw map[string]string) apiKeyAuthenticator {
+	var a apiKeyAuthenticator
+	for _, name := range slices.Sorted(maps.Keys(raw)) {
+		key := adminToken{name: name, secret: raw[name]}
+		if key.secret == "" {
+			continue
+		}
+		if digest, ok := strings.CutPrefix(key.secret, "sha256:"); ok {
+			key.secret = strings.ToLower(digest)
+			key.hashed = true
+		}
+		a.keys = append(a.keys, key)
+	}
+	return a
+}
+
+func (a apiKeyAuthenticator) authenticate(r *http.Request) (*clientIdentity, bool) {
+	presented := extractAPIKey(r)
+	if presented == "" {
+		return nil, false
+	}
+	for i := range a.keys {
+		if a.keys[i].matches(presented) {
+			return &clientIdentity{Method: authAPIKey, ID: "api_key:" + a.keys[i].name}, true
+		}
+	}
+	return nil, false
+}
+
+// jwtAuthenticator accepts requests with a bearer JSON Web Token signed with
+// HS256 and AUTH_JWT_SECRET, identified by its subject. The issuer and
+// audience are checked when AUTH_JWT_ISSUER and AUTH_JWT_AUDIENCE are set.
+type jwtAuthenticator struct {
+	secret   []byte
+	issuer   string
+	audience string
+	clock    Clock
+}
+
+// jwtClaims are the registered claims checked by jwtAuthenticator.
+type jwtClaims struct {
+	Subject   string       `json:"sub"`
+	Issuer    string       `json:"iss"`
+	Audience  jwtAudiences `json:"aud"`
+	ExpiresAt *float64     `json:"exp"`
+	NotBefore *float64     `json:"nbf"`
+}
+
+// jwtAudiences is the aud claim, which is a string or an array of strings.
+type jwtAudiences []string
+
+func (a *jwtAudiences) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = jwtAudiences{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+var errInvalidJWT = errors.New("invalid token")
+
+// verify checks the signature and the claims of token and returns its
+// claims.
+func (a jwtAuthenticator) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidJWT
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(rawHeader, &header) != nil || header.Alg != "HS256" {
+		return nil, errInvalidJWT
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errInvalidJWT
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	var claims jwtClaims
+	if json.Unmarshal(rawClaims, &claims) != nil || claims.Subject == "" {
+		return nil, errInvalidJWT
+	}
+	now := float64(a.clock.Now().Unix())
+	switch {
+	case claims.ExpiresAt != nil && now >= *claims.ExpiresAt:
+		return nil, errors.New("token expired")
+	case claims.NotBefore != nil && now < *claims.NotBefore:
+		return nil, errors.New("token not valid yet")
+	case a.issuer != "" && claims.Issuer != a.issuer:
+		return nil, errors.New("unexpected token issuer")
+	case a.audience != "" && !slices.Contains(claims.Audience, a.audience):
+		return nil, errors.New("unexpected token audience")
+	}
+	return &claims, nil
+}
+
+func (a jwtAuthenticator) authenticate(r *http.Request) (*clientIdentity, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, false
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, false
+	}
+	return &clientIdentity{Method: authJWT, ID: "jwt:" + claims.Subject}, true
+}
+
+// anonymousAuthenticator accepts every request, without an identity.
+type anonymousAuthenticator struct{}
+
+func (anonymousAuthenticator) authenticate(*http.Request) (*clientIdentity, bool) {
+	return &clientIdentity{Method: authAnonymous}, true
+}
+
+// parseAuthChain builds the authenticators of AUTH_CHAIN, in order.
+// Authenticators that are unknown or lack their settings are left out.
+func parseAuthChain(config Config, clock Clock, logger *Logger) []authenticator {
+	var chain []authenticator
+	for _, name := range config.AuthChain {
+		switch name {
+		case authIP:
+			if len(config.AuthAllowedCIDRs) == 0 {
+				logger.Log(LogError, "AUTH_CHAIN: ip requires AUTH_ALLOWED_CIDRS, skipped")
+				continue
+			}
+			chain = append(chain, ipAuthenticator{cidrs: config.AuthAllowedCIDRs})
+		case authAPIKey:
+			keys := parseAuthAPIKeys(config.AuthAPIKeys)
+			if len(keys.keys) == 0 {
+				logger.Log(LogError, "AUTH_CHAIN: api_key requires AUTH_API_KEYS, skipped")
+				continue
+			}
+			chain = append(chain, keys)
+		case authJWT:
+			if config.AuthJWTSecret == "" {
+				logger.Log(LogError, "AUTH_CHAIN: jwt requires AUTH_JWT_SECRET, skipped")
+				continue
+			}
+			chain = append(chain, jwtAuthenticator{
+				secret:   []byte(config.AuthJWTSecret),
+				issuer:   config.AuthJWTIssuer,
+				audience: config.AuthJWTAudience,
+				clock:    clock,
+			})
+		case authAnonymous:
+			chain = append(chain, anonymousAuthenticator{})
+		default:
+			logger.Log(LogError, "AUTH_CHAIN: unknown authenticator %q, skipped", name)
+		}
+	}
+	return chain
+}
+
+// authMiddleware runs the authentication chain of AUTH_CHAIN on proxied
+// requests. The first authenticator that accepts a request attaches its
+// identity, which the rate limiter and the logs use in place of the API key
+// or address; requests that no authenticator accepts are answered with 401.
+// Without a chain, every request is served anonymously; a chain whose
+// authenticators all lack their settings rejects every request.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	if len(s.config.AuthChain) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, a := range s.authChain {
+			id, ok := a.authenticate(r)
+			if !ok {
+				continue
+			}
+			clientAuthTotal.WithLabelValues(id.Method).Inc()
+			ctx := context.WithValue(r.Context(), clientIdentityKey{}, id)
+			if id.ID != "" {
+				ctx = ContextWithLogAttrs(ctx, slog.String("identity", id.ID))
+				if csw, ok := w.(*cacheStatusResponseWriter); ok {
+					csw.identity = id.ID
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		clientAuthTotal.WithLabelValues("rejected").Inc()
+		w.Header().Set("WWW-Authenticate", `Bearer realm="geocache"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	})
+}
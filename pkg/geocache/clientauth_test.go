@@ -0,0 +1,130 @@
+package geocache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func signJWT(secret, claims string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthMiddleware_Chain(t *testing.T) {
+	clock := NewFrozenClock(time.Unix(1_800_000_000, 0))
+	keyDigest := sha256.Sum256([]byte("AIzaSyBATCHKEY"))
+	config := Config{
+		AuthChain:        []string{authIP, authAPIKey, authJWT},
+		AuthAllowedCIDRs: []string{"10.0.0.0/8"},
+		AuthAPIKeys:      map[string]string{"web": "AIzaSyWEBKEY", "batch": "sha256:" + hex.EncodeToString(keyDigest[:])},
+		AuthJWTSecret:    "s3cret",
+		AuthJWTAudience:  "geocache",
+	}
+	server := &Server{config: config, authChain: parseAuthChain(config, clock, NewLogger(false))}
+	var identity *clientIdentity
+	handler := server.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = clientIdentityFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		url        string
+		bearer     string
+		wantStatus int
+		wantID     string
+	}{
+		{name: "allowed address", remoteAddr: "10.1.2.3:1234", url: geocodePath + "?address=a&key=AIzaSyWEBKEY", wantStatus: http.StatusOK, wantID: "ip:10.1.2.3"},
+		{name: "allowed key", remoteAddr: "192.0.2.1:1234", url: geocodePath + "?address=a&key=AIzaSyWEBKEY", wantStatus: http.StatusOK, wantID: "api_key:web"},
+		{name: "allowed hashed key", remoteAddr: "192.0.2.1:1234", url: geocodePath + "?address=a&key=AIzaSyBATCHKEY", wantStatus: http.StatusOK, wantID: "api_key:batch"},
+		{name: "valid token", remoteAddr: "192.0.2.1:1234", url: geocodePath + "?address=a&key=AIzaSyOTHER",
+			bearer: signJWT("s3cret", `{"sub":"alice","aud":["geocache"],"exp":1800000060}`), wantStatus: http.StatusOK, wantID: "jwt:alice"},
+		{name: "expired token", remoteAddr: "192.0.2.1:1234", url: geocodePath + "?address=a",
+			bearer: signJWT("s3cret", `{"sub":"alice","aud":"geocache","exp":1799999999}`), wantStatus: http.StatusUnauthorized},
+		{name: "wrong audience", remoteAddr: "192.0.2.1:1234", url: geocodePath + "?address=a",
+			bearer: signJWT("s3cret", `{"sub":"alice","aud":"other"}`), wantStatus: http.StatusUnauthorized},
+		{name: "wrong secret", remoteAddr: "192.0.2.1:1234", url: geocodePath + "?address=a",
+			bearer: signJWT("guess", `{"sub":"alice","aud":"geocache"}`), wantStatus: http.StatusUnauthorized},
+		{name: "unknown key", remoteAddr: "192.0.2.1:1234", url: geocodePath + "?address=a&key=AIzaSyOTHER", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity = nil
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantID == "" {
+				if identity != nil {
+					t.Errorf("Expected the request not to be served, got identity %+v", identity)
+				}
+				return
+			}
+			if identity == nil || identity.ID != tt.wantID {
+				t.Errorf("Expected identity %q, got %+v", tt.wantID, identity)
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware_AnonymousFallback(t *testing.T) {
+	config := Config{AuthChain: []string{authAPIKey, authAnonymous}, AuthAPIKeys: map[string]string{"web": "AIzaSyWEBKEY"}}
+	server := &Server{config: config, authChain: parseAuthChain(config, systemClock{}, NewLogger(false))}
+	var identity *clientIdentity
+	handler := server.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = clientIdentityFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=a&key=AIzaSyOTHER", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || identity == nil || identity.Method != authAnonymous || identity.ID != "" {
+		t.Fatalf("Expected an anonymous request to be served, got status %d and identity %+v", w.Code, identity)
+	}
+	if client, _ := rateLimitClient(req, nil); client != "ip:192.0.2.1" {
+		t.Errorf("Expected anonymous requests to be rate limited by address, got %q", client)
+	}
+}
+
+func TestAuthMiddleware_MisconfiguredChainRejects(t *testing.T) {
+	config := Config{AuthChain: []string{authJWT}}
+	server := &Server{config: config, authChain: parseAuthChain(config, systemClock{}, NewLogger(false))}
+	handler := server.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected the request to be rejected")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=a", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 with jwt lacking AUTH_JWT_SECRET, got %d", w.Code)
+	}
+}
+
+func TestRateLimitClient_Identity(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=a&key=AIzaSyWEBKEY", nil)
+	server := &Server{config: Config{AuthChain: []string{authAPIKey}, AuthAPIKeys: map[string]string{"web": "AIzaSyWEBKEY"}}}
+	server.authChain = parseAuthChain(server.config, systemClock{}, NewLogger(false))
+	var client, label string
+	server.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, label = rateLimitClient(r, nil)
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if client != "api_key:web" || label != "api_key:web" {
+		t.Errorf("rateLimitClient() = %q, %q, want the identity api_key:web", client, label)
+	}
+}
@@ -0,0 +1,311 @@
+package geocache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// clientCacheInvalidateChannel is where Redis publishes the keys invalidated
+// for the clients tracking them.
+const clientCacheInvalidateChannel = "__redis__:invalidate"
+
+// clientCacheRetryInterval is how long the invalidation listener waits
+// before reconnecting after losing its connection.
+const clientCacheRetryInterval = 5 * time.Second
+
+// clientCache keeps the most recently read entries in memory. It only serves
+// them while invalidations are received, and forgets everything when they
+// stop, since writes made in the meantime would be missed.
+type clientCache struct {
+	maxKeys int
+	clock   Clock
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds the *clientCacheEntry of the entries, most recently used
+	// first.
+	lru *list.List
+	// tracking is set while invalidations are received, and generation
+	// counts the times it was set.
+	tracking   bool
+	generation uint64
+	// pending counts the reads of keys in flight, and stale holds those of
+	// their keys invalidated since, whose values must not be kept.
+	pending map[string]int
+	stale   map[string]bool
+}
+
+type clientCacheEntry struct {
+	key     string
+	entry   entryLookup
+	expires time.Time
+}
+
+func newClientCache(maxKeys int, clock Clock) *clientCache {
+	return &clientCache{
+		maxKeys: maxKeys,
+		clock:   clock,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		pending: make(map[string]int),
+		stale:   make(map[string]bool),
+	}
+}
+
+// get returns the entries of keys when all of them are cached.
+func (c *clientCache) get(keys []string) ([]entryLookup, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tracking {
+		return nil, false
+	}
+	now := c.clock.Now()
+	out := make([]entryLookup, len(keys))
+	for i, key := range keys {
+		elem, ok := c.entries[key]
+		if !ok {
+			return nil, false
+		}
+		cached := elem.Value.(*clientCacheEntry)
+		out[i] = cached.entry
+		if !cached.expires.IsZero() {
+			if out[i].ttl = cached.expires.Sub(now); out[i].ttl <= 0 {
+				c.remove(elem)
+				return nil, false
+			}
+		}
+	}
+	for _, key := range keys {
+		c.lru.MoveToFront(c.entries[key])
+	}
+	return out, true
+}
+
+// beginRead registers a read of keys from Redis, and returns the generation
+// to pass to endRead, or false when the results cannot be kept.
+func (c *clientCache) beginRead(keys []string) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tracking {
+		return 0, false
+	}
+	for _, key := range keys {
+		c.pending[key]++
+	}
+	return c.generation, true
+}
+
+// endRead ends a read begun in generation, keeping the entries read unless
+// entries is nil or they were invalidated in the meantime.
+func (c *clientCache) endRead(keys []string, entries []entryLookup, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	for i, key := range keys {
+		if entries != nil && c.tracking && c.generation == generation && !c.stale[key] {
+			cached := &clientCacheEntry{key: key, entry: entries[i]}
+			if entries[i].ttl > 0 {
+				cached.expires = now.Add(entries[i].ttl)
+			}
+			if elem, ok := c.entries[key]; ok {
+				c.remove(elem)
+			}
+			c.entries[key] = c.lru.PushFront(cached)
+		}
+		if c.pending[key]--; c.pending[key] <= 0 {
+			delete(c.pending, key)
+			delete(c.stale, key)
+		}
+	}
+	for c.lru.Len() > c.maxKeys {
+		c.remove(c.lru.Back())
+	}
+	clientCacheKeys.Set(float64(c.lru.Len()))
+}
+
+// invalidate forgets keys, including the values of their reads in flight.
+func (c *clientCache) invalidate(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := c.entries[key]; ok {
+			c.remove(elem)
+		}
+		if c.pending[key] > 0 {
+			c.stale[key] = true
+		}
+	}
+	clientCacheKeys.Set(float64(c.lru.Len()))
+}
+
+// setTracking records whether invalidations are received, forgetting every
+// entry.
+func (c *clientCache) setTracking(tracking bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.tracking = tracking
+	c.generation++
+	clientCacheKeys.Set(0)
+}
+
+// remove deletes the entry of elem. c.mu must be held.
+func (c *clientCache) remove(elem *list.Element) {
+	delete(c.entries, c.lru.Remove(elem).(*clientCacheEntry).key)
+}
+
+// trackingStore serves the most recently read entries from memory with
+// CLIENT_SIDE_CACHING, without a round trip to Redis. It is kept coherent
+// with the writes of every replica by Redis 6 client-side caching: a
+// dedicated connection enables broadcast tracking of the keys under
+// REDIS_PREFIX, redirected to itself, and receives their invalidations.
+// Lookups go to Redis whenever that connection is down, including on
+// servers that do not support tracking.
+type trackingStore struct {
+	current CacheStore
+	cache   *clientCache
+	logger  *Logger
+	client  *redis.Client
+	pubsub  *redis.PubSub
+	done    chan struct{}
+}
+
+func newTrackingStore(current CacheStore, client *redis.Client, config Config, clock Clock, logger *Logger) *trackingStore {
+	s := &trackingStore{
+		current: current,
+		cache:   newClientCache(config.ClientSideCacheMaxKeys, clock),
+		logger:  logger,
+		done:    make(chan struct{}),
+	}
+	opts := *client.Options()
+	// Invalidations are received as pub/sub messages, which RESP2 delivers
+	// on the subscribed connection only.
+	opts.Protocol = 2
+	opts.PoolSize = 1
+	opts.MinIdleConns = 0
+	opts.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		id, err := cn.ClientID(ctx).Result()
+		if err != nil {
+			return err
+		}
+		args := []interface{}{"CLIENT", "TRACKING", "ON", "REDIRECT", id, "BCAST"}
+		if config.RedisPrefix != "" {
+			args = append(args, "PREFIX", config.RedisPrefix+":")
+		}
+		return cn.Process(ctx, redis.NewCmd(ctx, args...))
+	}
+	s.client = redis.NewClient(&opts)
+	s.pubsub = s.client.Subscribe(context.Background(), clientCacheInvalidateChannel)
+	go s.listen()
+	return s
+}
+
+// listen applies the invalidations until close.
+func (s *trackingStore) listen() {
+	tracking, failed := false, false
+	for {
+		msg, err := s.pubsub.Receive(context.Background())
+		if err != nil && strings.HasPrefix(err.Error(), "redis: unsupported pubsub message payload") {
+			// The null payload announcing a flush of the database.
+			clientCacheInvalidationsTotal.Inc()
+			s.cache.setTracking(tracking)
+			continue
+		}
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if tracking || !failed {
+				s.logger.Log(LogWarning, "Client-side caching suspended, reading every entry from Redis: %v", err)
+			}
+			tracking, failed = false, true
+			s.cache.setTracking(false)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(clientCacheRetryInterval):
+			}
+			continue
+		}
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" && !tracking {
+				s.logger.Log(LogInfo, "Client-side caching enabled")
+				tracking = true
+				s.cache.setTracking(true)
+			}
+		case *redis.Message:
+			clientCacheInvalidationsTotal.Inc()
+			if msg.PayloadSlice == nil {
+				s.cache.invalidate([]string{msg.Payload})
+				continue
+			}
+			s.cache.invalidate(msg.PayloadSlice)
+		}
+	}
+}
+
+func (s *trackingStore) close() error {
+	close(s.done)
+	return errors.Join(s.pubsub.Close(), s.client.Close())
+}
+
+func (s *trackingStore) lookup(ctx context.Context, keys []string, opts lookupOptions) ([]entryLookup, error) {
+	if opts.hitsKey != "" {
+		// Every hit is counted in Redis.
+		return lookupEntries(ctx, s.current, keys, opts)
+	}
+	if entries, ok := s.cache.get(keys); ok {
+		clientCacheLookupsTotal.WithLabelValues("hit").Inc()
+		return entries, nil
+	}
+	generation, ok := s.cache.beginRead(keys)
+	if !ok {
+		clientCacheLookupsTotal.WithLabelValues("bypass").Inc()
+		return lookupEntries(ctx, s.current, keys, opts)
+	}
+	clientCacheLookupsTotal.WithLabelValues("miss").Inc()
+	entries, err := lookupEntries(ctx, s.current, keys, opts)
+	if err != nil {
+		s.cache.endRead(keys, nil, generation)
+		return nil, err
+	}
+	s.cache.endRead(keys, entries, generation)
+	return entries, nil
+}
+
+func (s *trackingStore) Get(ctx context.Context, keys ...string) ([][]byte, error) {
+	return s.current.Get(ctx, keys...)
+}
+
+// Set, Swap, setIfFresher and Delete forget the keys they write before
+// Redis reports it, so that the instance reads its own writes.
+
+func (s *trackingStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.cache.invalidate([]string{key})
+	return s.current.Set(ctx, key, value, ttl)
+}
+
+func (s *trackingStore) Swap(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	s.cache.invalidate([]string{key})
+	return s.current.Swap(ctx, key, value, ttl)
+}
+
+func (s *trackingStore) setIfFresher(ctx context.Context, key string, value []byte, ttl time.Duration, storedAt time.Time) (bool, []byte, error) {
+	s.cache.invalidate([]string{key})
+	return setIfFresher(ctx, s.current, key, value, ttl, storedAt)
+}
+
+func (s *trackingStore) Delete(ctx context.Context, keys ...string) (int64, error) {
+	s.cache.invalidate(keys)
+	return s.current.Delete(ctx, keys...)
+}
@@ -0,0 +1,137 @@
+package geocache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestTrackingStore(t *testing.T, maxKeys int, clock Clock) (*trackingStore, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	s := &trackingStore{current: newRedisStore(rdb, "test", false), cache: newClientCache(maxKeys, clock)}
+	s.cache.setTracking(true)
+	return s, mr
+}
+
+func lookupValue(t *testing.T, s *trackingStore, opts lookupOptions, keys ...string) string {
+	t.Helper()
+	entries, err := s.lookup(context.Background(), keys, opts)
+	if err != nil {
+		t.Fatalf("lookup() failed: %v", err)
+	}
+	return string(entries[0].value)
+}
+
+func TestTrackingStore_ServesFromMemoryUntilInvalidated(t *testing.T) {
+	s, mr := newTestTrackingStore(t, 10, systemClock{})
+	mr.Set("test:a", "v1")
+
+	if got := lookupValue(t, s, lookupOptions{}, "test:a", "test:b"); got != "v1" {
+		t.Fatalf("Expected v1 from Redis, got %q", got)
+	}
+	// Written by another replica; the entry is served from memory until
+	// Redis reports the invalidation.
+	mr.Set("test:a", "v2")
+	if got := lookupValue(t, s, lookupOptions{}, "test:a", "test:b"); got != "v1" {
+		t.Errorf("Expected v1 from memory, got %q", got)
+	}
+	if got := lookupValue(t, s, lookupOptions{hitsKey: "test:hits", counted: "test:a"}, "test:a"); got != "v2" {
+		t.Errorf("Expected counted hits to be read from Redis, got %q", got)
+	}
+	s.cache.invalidate([]string{"test:a"})
+	if got := lookupValue(t, s, lookupOptions{}, "test:a", "test:b"); got != "v2" {
+		t.Errorf("Expected v2 after the invalidation, got %q", got)
+	}
+
+	if err := s.Set(context.Background(), "test:a", []byte("v3"), 0); err != nil {
+		t.Fatalf("Set() failed: %v", err)
+	}
+	if got := lookupValue(t, s, lookupOptions{}, "test:a", "test:b"); got != "v3" {
+		t.Errorf("Expected the instance to read its own write, got %q", got)
+	}
+
+	s.cache.setTracking(false)
+	mr.Set("test:a", "v4")
+	if got := lookupValue(t, s, lookupOptions{}, "test:a", "test:b"); got != "v4" {
+		t.Errorf("Expected lookups to go to Redis without invalidations, got %q", got)
+	}
+}
+
+func TestClientCache_InvalidatedDuringRead(t *testing.T) {
+	c := newClientCache(10, systemClock{})
+	c.setTracking(true)
+	keys := []string{"test:a"}
+
+	generation, ok := c.beginRead(keys)
+	if !ok {
+		t.Fatal("Expected the read to be cacheable while tracking")
+	}
+	c.invalidate(keys)
+	c.endRead(keys, []entryLookup{{value: []byte("old")}}, generation)
+	if _, ok := c.get(keys); ok {
+		t.Error("Expected a value invalidated during its read not to be kept")
+	}
+
+	generation, _ = c.beginRead(keys)
+	c.setTracking(true)
+	c.endRead(keys, []entryLookup{{value: []byte("old")}}, generation)
+	if _, ok := c.get(keys); ok {
+		t.Error("Expected a value read before invalidations resumed not to be kept")
+	}
+
+	generation, _ = c.beginRead(keys)
+	c.endRead(keys, []entryLookup{{value: []byte("new")}}, generation)
+	if entries, ok := c.get(keys); !ok || string(entries[0].value) != "new" {
+		t.Errorf("Expected the value to be kept, got %v %v", entries, ok)
+	}
+}
+
+func TestClientCache_ExpiryAndEviction(t *testing.T) {
+	clock := NewFrozenClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	c := newClientCache(2, clock)
+	c.setTracking(true)
+	for _, key := range []string{"a", "b"} {
+		generation, _ := c.beginRead([]string{key})
+		c.endRead([]string{key}, []entryLookup{{value: []byte(key), ttl: time.Minute}}, generation)
+	}
+
+	clock.Advance(20 * time.Second)
+	if entries, ok := c.get([]string{"a"}); !ok || entries[0].ttl != 40*time.Second {
+		t.Errorf("Expected a with 40s left, got %v %v", entries, ok)
+	}
+	generation, _ := c.beginRead([]string{"c"})
+	c.endRead([]string{"c"}, []entryLookup{{value: []byte("c")}}, generation)
+	if _, ok := c.get([]string{"b"}); ok {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	clock.Advance(time.Minute)
+	if _, ok := c.get([]string{"a"}); ok {
+		t.Error("Expected the expired entry not to be served")
+	}
+	if _, ok := c.get([]string{"c"}); !ok {
+		t.Error("Expected the entry without expiry to be served")
+	}
+}
+
+func TestTrackingStore_FallbackWithoutTracking(t *testing.T) {
+	// miniredis does not support CLIENT TRACKING.
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	s := newTrackingStore(newRedisStore(rdb, "test", false), rdb, Config{RedisPrefix: "test", ClientSideCacheMaxKeys: 10}, systemClock{}, NewLogger(false))
+	defer s.close()
+
+	mr.Set("test:a", "v1")
+	for _, want := range []string{"v1", "v2"} {
+		mr.Set("test:a", want)
+		if got := lookupValue(t, s, lookupOptions{}, "test:a"); got != want {
+			t.Errorf("Expected %s from Redis, got %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package geocache
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the server and its background jobs: cache and ban
+// expiry, rate limit windows, filter generations, timestamps, and the
+// intervals of the periodic jobs. Durations measured for metrics and latency
+// budgets always use the system clock.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel that receives the time once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock used unless WithClock is given.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// FrozenClock is a Clock that only moves when told to, for deterministic
+// tests of code embedding the proxy. Timers returned by After fire when
+// Advance or Set moves the clock past their deadline.
+type FrozenClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []frozenTimer
+}
+
+type frozenTimer struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewFrozenClock returns a clock stopped at t.
+func NewFrozenClock(t time.Time) *FrozenClock {
+	return &FrozenClock{now: t}
+}
+
+// Now returns the time the clock is stopped at.
+func (c *FrozenClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the time once the clock has been
+// moved d past the current time.
+func (c *FrozenClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, frozenTimer{deadline: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d.
+func (c *FrozenClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to t, firing the timers due by then.
+func (c *FrozenClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(t) {
+			pending = append(pending, w)
+		} else {
+			w.ch <- t
+		}
+	}
+	c.waiters = pending
+}
+
+// Waiters returns the number of pending timers, letting tests wait until a
+// background job is idle before advancing the clock.
+func (c *FrozenClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
@@ -0,0 +1,48 @@
+package geocache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrozenClock(t *testing.T) {
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	clock := NewFrozenClock(start)
+
+	immediate := clock.After(0)
+	minute := clock.After(time.Minute)
+	hour := clock.After(time.Hour)
+	if got := <-immediate; !got.Equal(start) {
+		t.Errorf("Expected a zero duration to fire at once with %v, got %v", start, got)
+	}
+	if clock.Waiters() != 2 {
+		t.Errorf("Expected 2 pending timers, got %d", clock.Waiters())
+	}
+
+	clock.Advance(59 * time.Second)
+	select {
+	case <-minute:
+		t.Fatal("Expected the timer not to fire before its deadline")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case got := <-minute:
+		if !got.Equal(start.Add(time.Minute)) {
+			t.Errorf("Expected the timer to fire with %v, got %v", start.Add(time.Minute), got)
+		}
+	default:
+		t.Fatal("Expected the timer to fire at its deadline")
+	}
+
+	clock.Set(start.Add(2 * time.Hour))
+	select {
+	case <-hour:
+	default:
+		t.Fatal("Expected Set to fire the timers due")
+	}
+	if clock.Waiters() != 0 || !clock.Now().Equal(start.Add(2*time.Hour)) {
+		t.Errorf("Expected no pending timers at %v, got %d at %v", start.Add(2*time.Hour), clock.Waiters(), clock.Now())
+	}
+}
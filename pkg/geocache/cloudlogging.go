@@ -0,0 +1,294 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Attributes that Cloud Logging uses to correlate entries with traces.
+const (
+	traceAttrKey = "logging.googleapis.com/trace"
+	spanAttrKey  = "logging.googleapis.com/spanId"
+)
+
+const (
+	cloudLoggingBufferSize    = 10000
+	cloudLoggingBatchSize     = 200
+	cloudLoggingFlushInterval = 5 * time.Second
+)
+
+// cloudLoggingEntry is a LogEntry of the Cloud Logging API.
+type cloudLoggingEntry struct {
+	Timestamp   string                 `json:"timestamp"`
+	Severity    LogSeverity            `json:"severity"`
+	Trace       string                 `json:"trace,omitempty"`
+	SpanID      string                 `json:"spanId,omitempty"`
+	JSONPayload map[string]interface{} `json:"jsonPayload"`
+}
+
+type monitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// cloudLoggingWriter sends entries to the Cloud Logging API in batches,
+// authenticating as the instance's service account. The project and the
+// monitored resource are resolved on the first write, from Config or from
+// the environment: Cloud Run services and jobs, then GCE through the
+// metadata server, then "global".
+type cloudLoggingWriter struct {
+	client   *http.Client
+	endpoint string
+	token    func(ctx context.Context) (string, error)
+	metadata func(ctx context.Context, path string) (string, error)
+	entries  chan cloudLoggingEntry
+	flushReq chan chan struct{}
+
+	config   Config
+	resolve  sync.Once
+	project  string
+	logName  string
+	resource monitoredResource
+}
+
+func newCloudLoggingWriter(config Config) *cloudLoggingWriter {
+	tokens := newGCPTokenSource()
+	w := &cloudLoggingWriter{
+		client:   &http.Client{Timeout: 30 * time.Second},
+		endpoint: "https://logging.googleapis.com/v2/entries:write",
+		token:    tokens.Token,
+		metadata: tokens.metadata,
+		entries:  make(chan cloudLoggingEntry, cloudLoggingBufferSize),
+		flushReq: make(chan chan struct{}),
+		config:   config,
+	}
+	go w.run()
+	return w
+}
+
+// resolveTarget determines the project, log name and monitored resource.
+func (w *cloudLoggingWriter) resolveTarget(ctx context.Context) {
+	w.project = w.config.GCPProject
+	if w.project == "" {
+		w.project, _ = w.metadata(ctx, "project/project-id")
+	}
+	logName := w.config.CloudLoggingLogName
+	if logName == "" {
+		logName = "geocache"
+	}
+	w.logName = fmt.Sprintf("projects/%s/logs/%s", w.project, logName)
+
+	labels := map[string]string{"project_id": w.project}
+	region := func() string {
+		zone, _ := w.metadata(ctx, "instance/region")
+		return zone[strings.LastIndex(zone, "/")+1:]
+	}
+	switch {
+	case w.config.CloudLoggingResourceType != "":
+		w.resource.Type = w.config.CloudLoggingResourceType
+		for k, v := range w.config.CloudLoggingResourceLabels {
+			labels[k] = v
+		}
+	case os.Getenv("CLOUD_RUN_JOB") != "":
+		w.resource.Type = "cloud_run_job"
+		labels["job_name"] = os.Getenv("CLOUD_RUN_JOB")
+		labels["location"] = region()
+	case os.Getenv("K_SERVICE") != "":
+		w.resource.Type = "cloud_run_revision"
+		labels["service_name"] = os.Getenv("K_SERVICE")
+		labels["revision_name"] = os.Getenv("K_REVISION")
+		labels["configuration_name"] = os.Getenv("K_CONFIGURATION")
+		labels["location"] = region()
+	default:
+		id, err := w.metadata(ctx, "instance/id")
+		zone, _ := w.metadata(ctx, "instance/zone")
+		if err == nil && id != "" {
+			w.resource.Type = "gce_instance"
+			labels["instance_id"] = id
+			labels["zone"] = zone[strings.LastIndex(zone, "/")+1:]
+		} else {
+			w.resource.Type = "global"
+		}
+	}
+	w.resource.Labels = labels
+}
+
+// Write queues an entry, dropping it when the buffer is full.
+func (w *cloudLoggingWriter) Write(e cloudLoggingEntry) {
+	select {
+	case w.entries <- e:
+	default:
+		logEntriesDroppedTotal.Inc()
+	}
+}
+
+// Flush sends the queued entries and waits for the request to finish.
+func (w *cloudLoggingWriter) Flush() {
+	done := make(chan struct{})
+	w.flushReq <- done
+	<-done
+}
+
+func (w *cloudLoggingWriter) run() {
+	ticker := time.NewTicker(cloudLoggingFlushInterval)
+	defer ticker.Stop()
+	batch := make([]cloudLoggingEntry, 0, cloudLoggingBatchSize)
+	send := func() {
+		if len(batch) > 0 {
+			w.send(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case e := <-w.entries:
+			batch = append(batch, e)
+			if len(batch) >= cloudLoggingBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-w.flushReq:
+			for drained := false; !drained; {
+				select {
+				case e := <-w.entries:
+					batch = append(batch, e)
+				default:
+					drained = true
+				}
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+// send writes a batch. Failures cannot be logged through the logger that
+// produced the entries, so they go to stderr.
+func (w *cloudLoggingWriter) send(batch []cloudLoggingEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	w.resolve.Do(func() { w.resolveTarget(ctx) })
+
+	for i := range batch {
+		if batch[i].Trace != "" && !strings.HasPrefix(batch[i].Trace, "projects/") {
+			batch[i].Trace = "projects/" + w.project + "/traces/" + batch[i].Trace
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"logName":  w.logName,
+		"resource": w.resource,
+		"entries":  batch,
+	})
+	if err == nil {
+		err = w.post(ctx, body)
+	}
+	if err != nil {
+		logEntriesDroppedTotal.Add(float64(len(batch)))
+		fmt.Fprintf(os.Stderr, "Failed to write %d entries to Cloud Logging: %v\n", len(batch), err)
+	}
+}
+
+func (w *cloudLoggingWriter) post(ctx context.Context, body []byte) error {
+	token, err := w.token(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching access token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("entries.write returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// cloudLoggingHandler turns records into Cloud Logging entries. Attributes
+// become fields of the JSON payload, except the trace correlation ones,
+// which become the entry's trace and spanId.
+type cloudLoggingHandler struct {
+	w     *cloudLoggingWriter
+	attrs []slog.Attr
+}
+
+func newCloudLoggingHandler(w *cloudLoggingWriter) *cloudLoggingHandler {
+	return &cloudLoggingHandler{w: w}
+}
+
+func (h *cloudLoggingHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *cloudLoggingHandler) Handle(_ context.Context, r slog.Record) error {
+	e := cloudLoggingEntry{
+		Timestamp:   r.Time.UTC().Format(time.RFC3339Nano),
+		Severity:    levelSeverity(r.Level),
+		JSONPayload: map[string]interface{}{"message": r.Message},
+	}
+	add := func(a slog.Attr) bool {
+		v := a.Value.Resolve().Any()
+		switch a.Key {
+		case traceAttrKey:
+			e.Trace = fmt.Sprint(v)
+		case spanAttrKey:
+			e.SpanID = fmt.Sprint(v)
+		default:
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			e.JSONPayload[a.Key] = v
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+	h.w.Write(e)
+	return nil
+}
+
+func (h *cloudLoggingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &cloudLoggingHandler{w: h.w, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *cloudLoggingHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// requestTrace extracts the trace and span IDs of r from the
+// X-Cloud-Trace-Context header set by Google load balancers, or from a W3C
+// traceparent header. The span ID is returned as 16 hex digits.
+func requestTrace(r *http.Request) (traceID, spanID string) {
+	if h := r.Header.Get("X-Cloud-Trace-Context"); h != "" {
+		traceID, rest, _ := strings.Cut(h, "/")
+		span, _, _ := strings.Cut(rest, ";")
+		if n, err := strconv.ParseUint(span, 10, 64); err == nil {
+			spanID = fmt.Sprintf("%016x", n)
+		}
+		return traceID, spanID
+	}
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		return parts[1], parts[2]
+	}
+	return "", ""
+}
@@ -0,0 +1,113 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestRequestTrace(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		value     string
+		wantTrace string
+		wantSpan  string
+	}{
+		{name: "cloud trace context", header: "X-Cloud-Trace-Context", value: "105445aa7843bc8bf206b12000100000/1;o=1", wantTrace: "105445aa7843bc8bf206b12000100000", wantSpan: "0000000000000001"},
+		{name: "cloud trace without span", header: "X-Cloud-Trace-Context", value: "105445aa7843bc8bf206b12000100000", wantTrace: "105445aa7843bc8bf206b12000100000"},
+		{name: "traceparent", header: "traceparent", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantTrace: "4bf92f3577b34da6a3ce929d0e0e4736", wantSpan: "00f067aa0ba902b7"},
+		{name: "malformed traceparent", header: "traceparent", value: "00-abc-01"},
+		{name: "none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			traceID, spanID := requestTrace(req)
+			if traceID != tt.wantTrace || spanID != tt.wantSpan {
+				t.Errorf("requestTrace() = %q, %q, want %q, %q", traceID, spanID, tt.wantTrace, tt.wantSpan)
+			}
+		})
+	}
+}
+
+func TestCloudLoggingHandler(t *testing.T) {
+	t.Setenv("K_SERVICE", "")
+	t.Setenv("CLOUD_RUN_JOB", "")
+
+	var mu sync.Mutex
+	var requests []map[string]json.RawMessage
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		requests = append(requests, body)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	metadata := map[string]string{"instance/id": "4242", "instance/zone": "projects/1/zones/europe-west1-b"}
+	w := &cloudLoggingWriter{
+		client:   ts.Client(),
+		endpoint: ts.URL,
+		token:    func(context.Context) (string, error) { return "test-token", nil },
+		metadata: func(_ context.Context, path string) (string, error) {
+			if v, ok := metadata[path]; ok {
+				return v, nil
+			}
+			return "", errors.New("not found")
+		},
+		entries:  make(chan cloudLoggingEntry, 10),
+		flushReq: make(chan chan struct{}),
+		config:   Config{GCPProject: "my-project", CloudLoggingLogName: "geocache"},
+	}
+	go w.run()
+
+	logger := newLoggerWithHandler(LogFormatCloudLogging, newCloudLoggingHandler(w), slog.LevelInfo, nil)
+	logger.cloud = w
+	ctx := ContextWithLogAttrs(context.Background(), slog.String(traceAttrKey, "abc123"), slog.String(spanAttrKey, "00000000000000ff"))
+	logger.Component("upstream").LogContext(ctx, LogWarning, "upstream slow: %d ms", 1200)
+	logger.Log(LogDebug, "dropped by level")
+	logger.Flush()
+
+	if len(requests) != 1 {
+		t.Fatalf("Expected one write request, got %d", len(requests))
+	}
+	body := requests[0]
+	if got := string(body["logName"]); got != `"projects/my-project/logs/geocache"` {
+		t.Errorf("Unexpected logName %s", got)
+	}
+	var resource monitoredResource
+	json.Unmarshal(body["resource"], &resource)
+	if resource.Type != "gce_instance" || resource.Labels["instance_id"] != "4242" || resource.Labels["zone"] != "europe-west1-b" || resource.Labels["project_id"] != "my-project" {
+		t.Errorf("Unexpected resource %+v", resource)
+	}
+	var entries []cloudLoggingEntry
+	json.Unmarshal(body["entries"], &entries)
+	if len(entries) != 1 {
+		t.Fatalf("Expected one entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Severity != LogWarning || e.JSONPayload["message"] != "upstream slow: 1200 ms" || e.JSONPayload["component"] != "upstream" {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+	if e.Trace != "projects/my-project/traces/abc123" || e.SpanID != "00000000000000ff" {
+		t.Errorf("Expected trace correlation, got trace=%q span=%q", e.Trace, e.SpanID)
+	}
+	if _, ok := e.JSONPayload[traceAttrKey]; ok {
+		t.Error("Expected the trace attribute to be moved out of the payload")
+	}
+}
@@ -0,0 +1,220 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cloudMonitoringMetricPrefix is the type prefix of the custom metrics
+// written to Cloud Monitoring.
+const cloudMonitoringMetricPrefix = "custom.googleapis.com/geocache/"
+
+// cloudMonitoringMinInterval is the shortest interval between writes that
+// Cloud Monitoring accepts for a time series.
+const cloudMonitoringMinInterval = 10 * time.Second
+
+// cloudMonitoringTimeSeries is a TimeSeries of the Cloud Monitoring API with
+// a single point.
+type cloudMonitoringTimeSeries struct {
+	Metric struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels,omitempty"`
+	} `json:"metric"`
+	Resource   monitoredResource      `json:"resource"`
+	MetricKind string                 `json:"metricKind"`
+	ValueType  string                 `json:"valueType"`
+	Unit       string                 `json:"unit,omitempty"`
+	Points     []cloudMonitoringPoint `json:"points"`
+}
+
+type cloudMonitoringPoint struct {
+	Interval struct {
+		StartTime string `json:"startTime,omitempty"`
+		EndTime   string `json:"endTime"`
+	} `json:"interval"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// cloudMonitoringExporter writes the key metrics of the instance to Cloud
+// Monitoring as custom metrics, for deployments without a Prometheus server:
+// requests by cache status, the hit rate, upstream errors and the estimated
+// Google cost. Each instance writes its own time series, under a
+// generic_task resource whose task_id is the instance ID; Cloud Run
+// revisions are not a resource custom metrics can be written to.
+type cloudMonitoringExporter struct {
+	s        *Server
+	client   *http.Client
+	baseURL  string
+	token    func(ctx context.Context) (string, error)
+	metadata func(ctx context.Context, path string) (string, error)
+	// gatherer provides the upstream request counters.
+	gatherer prometheus.Gatherer
+
+	resolve  sync.Once
+	project  string
+	resource monitoredResource
+	// last are the request counts of the previous write, from which the hit
+	// rate over the interval is computed.
+	last requestCounts
+}
+
+func newCloudMonitoringExporter(s *Server) *cloudMonitoringExporter {
+	tokens := newGCPTokenSource()
+	return &cloudMonitoringExporter{
+		s:        s,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		baseURL:  "https://monitoring.googleapis.com",
+		token:    tokens.Token,
+		metadata: tokens.metadata,
+		gatherer: prometheus.DefaultGatherer,
+	}
+}
+
+// resolveTarget determines the project and the monitored resource.
+func (e *cloudMonitoringExporter) resolveTarget(ctx context.Context) {
+	e.project = e.s.config.GCPProject
+	if e.project == "" {
+		e.project, _ = e.metadata(ctx, "project/project-id")
+	}
+	location, _ := e.metadata(ctx, "instance/region")
+	if location == "" {
+		location, _ = e.metadata(ctx, "instance/zone")
+	}
+	location = location[strings.LastIndex(location, "/")+1:]
+	if location == "" {
+		location = "global"
+	}
+	job := os.Getenv("K_SERVICE")
+	if job == "" {
+		job = os.Getenv("CLOUD_RUN_JOB")
+	}
+	if job == "" {
+		job = "geocache"
+	}
+	e.resource = monitoredResource{Type: "generic_task", Labels: map[string]string{
+		"project_id": e.project,
+		"location":   location,
+		"namespace":  "geocache",
+		"job":        job,
+		"task_id":    e.s.instanceID,
+	}}
+}
+
+// upstreamErrors sums the upstream requests that failed or were answered
+// with a 5xx status.
+func (e *cloudMonitoringExporter) upstreamErrors() int64 {
+	families, _ := e.gatherer.Gather()
+	var total float64
+	for _, family := range families {
+		if family.GetName() != "upstream_requests_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() != "status" {
+					continue
+				}
+				if code, _ := strconv.Atoi(label.GetValue()); label.GetValue() == "error" || code >= 500 {
+					total += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return int64(total)
+}
+
+// timeSeries returns the points of the metrics at now.
+func (e *cloudMonitoringExporter) timeSeries(now time.Time) []cloudMonitoringTimeSeries {
+	start := e.s.stats.startedAt.Format(time.RFC3339Nano)
+	end := now.UTC().Format(time.RFC3339Nano)
+	var series []cloudMonitoringTimeSeries
+	add := func(name, kind, unit string, labels map[string]string, value interface{}) {
+		ts := cloudMonitoringTimeSeries{Resource: e.resource, MetricKind: kind, Unit: unit}
+		ts.Metric.Type = cloudMonitoringMetricPrefix + name
+		ts.Metric.Labels = labels
+		p := cloudMonitoringPoint{}
+		if kind == "CUMULATIVE" {
+			p.Interval.StartTime = start
+		}
+		p.Interval.EndTime = end
+		switch v := value.(type) {
+		case int64:
+			// The API takes 64-bit integers as strings.
+			ts.ValueType = "INT64"
+			p.Value = map[string]interface{}{"int64Value": strconv.FormatInt(v, 10)}
+		case float64:
+			ts.ValueType = "DOUBLE"
+			p.Value = map[string]interface{}{"doubleValue": v}
+		}
+		ts.Points = []cloudMonitoringPoint{p}
+		series = append(series, ts)
+	}
+
+	counts := e.s.stats.counts()
+	add("requests", "CUMULATIVE", "1", map[string]string{"cache_status": "hit"}, counts.Hit)
+	add("requests", "CUMULATIVE", "1", map[string]string{"cache_status": "miss"}, counts.Miss)
+	add("requests", "CUMULATIVE", "1", map[string]string{"cache_status": "override"}, counts.Override)
+	add("requests", "CUMULATIVE", "1", map[string]string{"cache_status": "other"}, counts.Total-counts.Hit-counts.Miss-counts.Override)
+	interval := requestCounts{Hit: counts.Hit - e.last.Hit, Miss: counts.Miss - e.last.Miss, Override: counts.Override - e.last.Override}
+	if interval.Hit+interval.Miss+interval.Override > 0 {
+		add("hit_rate", "GAUGE", "10^2.%", nil, interval.hitRate())
+	}
+	e.last = counts
+	add("upstream_errors", "CUMULATIVE", "1", nil, e.upstreamErrors())
+	add("estimated_cost", "CUMULATIVE", "USD", nil, float64(e.s.stats.costMicros.Load())/1e6)
+	return series
+}
+
+// write sends the current points through timeSeries.create.
+func (e *cloudMonitoringExporter) write(ctx context.Context) error {
+	e.resolve.Do(func() { e.resolveTarget(ctx) })
+	body, err := json.Marshal(map[string]interface{}{"timeSeries": e.timeSeries(e.s.clock.Now())})
+	if err != nil {
+		return err
+	}
+	token, err := e.token(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching access token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/v3/projects/%s/timeSeries", e.baseURL, e.project), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("timeSeries.create returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// runCloudMonitoring writes the metrics every CLOUD_MONITORING_INTERVAL_SECONDS.
+func (s *Server) runCloudMonitoring(e *cloudMonitoringExporter) {
+	logger := s.logger.Component("monitoring")
+	interval := max(s.config.CloudMonitoringInterval, cloudMonitoringMinInterval)
+	for {
+		<-s.clock.After(interval)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := e.write(ctx); err != nil {
+			logger.Log(LogWarning, "Failed to write metrics to Cloud Monitoring: %v", err)
+		}
+		cancel()
+	}
+}
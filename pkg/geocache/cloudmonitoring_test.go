@@ -0,0 +1,107 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCloudMonitoringExporter(t *testing.T) {
+	t.Setenv("K_SERVICE", "geocache-eu")
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: &recordingTransport{body: `{"status":"OK","results":[]}`}})
+	defer cleanup()
+	server.costs = map[string]float64{geocodePath: 0.005}
+	handler := server.routes()
+	for _, address := range []string{"Main", "Main", "Side"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, geocodePath+"?address="+address, nil))
+	}
+
+	var paths []string
+	var body struct {
+		TimeSeries []cloudMonitoringTimeSeries `json:"timeSeries"`
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		paths = append(paths, r.URL.Path)
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer ts.Close()
+
+	upstream := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "upstream_requests_total"}, []string{"target", "status"})
+	upstream.WithLabelValues("primary", "200").Add(5)
+	upstream.WithLabelValues("primary", "503").Add(2)
+	upstream.WithLabelValues("canary", "error").Add(1)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(upstream)
+	metadata := map[string]string{"project/project-id": "maps-prod", "instance/region": "projects/1/regions/europe-west1"}
+	e := &cloudMonitoringExporter{
+		s:       server,
+		client:  ts.Client(),
+		baseURL: ts.URL,
+		token:   func(context.Context) (string, error) { return "token", nil },
+		metadata: func(_ context.Context, path string) (string, error) {
+			if v, ok := metadata[path]; ok {
+				return v, nil
+			}
+			return "", errors.New("not found")
+		},
+		gatherer: registry,
+	}
+
+	if err := e.write(context.Background()); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if len(paths) != 1 || paths[0] != "/v3/projects/maps-prod/timeSeries" {
+		t.Fatalf("Expected a write to the project's time series, got %v", paths)
+	}
+	values := make(map[string]interface{})
+	for _, series := range body.TimeSeries {
+		name := series.Metric.Type[len(cloudMonitoringMetricPrefix):] + series.Metric.Labels["cache_status"]
+		values[name] = series.Points[0].Value["int64Value"]
+		if v, ok := series.Points[0].Value["doubleValue"]; ok {
+			values[name] = v
+		}
+		want := map[string]string{"project_id": "maps-prod", "location": "europe-west1", "namespace": "geocache", "job": "geocache-eu", "task_id": server.instanceID}
+		if series.Resource.Type != "generic_task" || len(series.Resource.Labels) != len(want) {
+			t.Errorf("Unexpected resource %+v", series.Resource)
+		}
+		for k, v := range want {
+			if series.Resource.Labels[k] != v {
+				t.Errorf("Expected resource label %s=%s, got %s", k, v, series.Resource.Labels[k])
+			}
+		}
+	}
+	want := map[string]interface{}{
+		"requestshit":      "1",
+		"requestsmiss":     "2",
+		"requestsoverride": "0",
+		"requestsother":    "0",
+		"hit_rate":         1.0 / 3,
+		"upstream_errors":  "3",
+		"estimated_cost":   0.01,
+	}
+	for name, v := range want {
+		if values[name] != v {
+			t.Errorf("Expected %s to be %v, got %v", name, v, values[name])
+		}
+	}
+
+	// The hit rate covers the interval since the previous write, and is not
+	// written when no request was served.
+	if err := e.write(context.Background()); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	for _, series := range body.TimeSeries {
+		if series.Metric.Type == cloudMonitoringMetricPrefix+"hit_rate" {
+			t.Errorf("Expected no hit rate without requests, got %v", series.Points[0].Value)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package geocache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// isGzip reports whether b starts with the gzip magic bytes. Cache entries
+// carry no metadata, so this is how compressed entries are recognized.
+func isGzip(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+func gunzip(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+func gzipCompress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// plainBody returns the uncompressed form of a cached or upstream body. A
+// body that fails to decompress is returned unchanged.
+func plainBody(b []byte) []byte {
+	if !isGzip(b) {
+		return b
+	}
+	plain, err := gunzip(b)
+	if err != nil {
+		return b
+	}
+	return plain
+}
+
+// acceptsGzip reports whether the client's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") || strings.TrimSpace(coding) == "*" {
+			return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// writeBody writes a cached or upstream body, passing gzip bodies through to
+// clients that accept them and decompressing them for the others. With
+// RESPONSE_WATERMARK, JSON bodies are written uncompressed with a proxy_meta
+// member.
+func (s *Server) writeBody(w http.ResponseWriter, r *http.Request, body []byte) {
+	if s.config.ResponseWatermark {
+		w.Write(s.watermark(w, r, plainBody(body)))
+		return
+	}
+	if isGzip(body) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else if plain, err := gunzip(body); err == nil {
+			body = plain
+		} else {
+			s.logger.LogContext(r.Context(), LogWarning, "Failed to decompress cached body: %v", err)
+		}
+	}
+	w.Write(body)
+}
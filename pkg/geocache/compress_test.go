@@ -0,0 +1,113 @@
+package geocache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=1.0, br", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"identity", false},
+		{"*", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsGzip(r); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// gzipTransport answers like an upstream honoring Accept-Encoding: gzip.
+type gzipTransport struct {
+	body           []byte
+	acceptEncoding string
+}
+
+func (g *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	g.acceptEncoding = req.Header.Get("Accept-Encoding")
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Encoding", "gzip")
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(bytes.NewReader(g.body))}, nil
+}
+
+func TestServer_Query_Gzip(t *testing.T) {
+	const payload = `{"status":"OK","results":[]}`
+
+	tests := []struct {
+		name         string
+		clientGzip   bool
+		wantEncoding string
+	}{
+		{name: "client accepts gzip", clientGzip: true, wantEncoding: "gzip"},
+		{name: "client requires identity", clientGzip: false, wantEncoding: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, mr, cleanup := setupTestServer(t, nil)
+			defer cleanup()
+			server.config.UpstreamGzip = true
+			transport := &gzipTransport{body: gzipBytes(t, payload)}
+			server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+
+			for _, wantCache := range []string{"MISS", "HIT"} {
+				req := httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=Gzip", nil)
+				if tt.clientGzip {
+					req.Header.Set("Accept-Encoding", "gzip")
+				}
+				w := httptest.NewRecorder()
+				server.query(w, req)
+
+				if got := w.Header().Get("X-Cache"); got != wantCache {
+					t.Fatalf("Expected X-Cache %s, got %s", wantCache, got)
+				}
+				if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+					t.Errorf("%s: expected Content-Encoding %q, got %q", wantCache, tt.wantEncoding, got)
+				}
+				body := w.Body.Bytes()
+				if tt.clientGzip {
+					body = plainBody(body)
+				}
+				if string(body) != payload {
+					t.Errorf("%s: expected body %s, got %q", wantCache, payload, body)
+				}
+			}
+
+			if transport.acceptEncoding != "gzip" {
+				t.Errorf("Expected upstream request with Accept-Encoding gzip, got %q", transport.acceptEncoding)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=Gzip", nil)
+			stored, _ := mr.Get(server.cacheKey(req))
+			if !isGzip([]byte(stored)) {
+				t.Errorf("Expected the cached entry to be stored compressed")
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Kinds of entries that any fill replaces, whatever their age.
+const (
+	// entryNegative is a response without results, such as ZERO_RESULTS.
+	entryNegative = "negative"
+	// entryPartial is a failed response, or a distance matrix with elements
+	// that could not be computed.
+	entryPartial = "partial"
+)
+
+// entryKind classifies the JSON body of a response: entryNegative,
+// entryPartial, or "" for a complete response.
+func entryKind(body []byte) string {
+	var resp struct {
+		Status string `json:"status"`
+		Rows   []struct {
+			Elements []struct {
+				Status string `json:"status"`
+			} `json:"elements"`
+		} `json:"rows"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Status == "" {
+		return ""
+	}
+	switch resp.Status {
+	case "OK":
+	case "ZERO_RESULTS", "NOT_FOUND":
+		return entryNegative
+	default:
+		return entryPartial
+	}
+	for _, row := range resp.Rows {
+		for _, el := range row.Elements {
+			if el.Status != "OK" {
+				return entryPartial
+			}
+		}
+	}
+	return ""
+}
+
+// fillEntry returns the value to store for body, the response to r fetched
+// upstream at fetchedAt, with CONDITIONAL_FILLS. Entries are always
+// enveloped, so that their age can be compared.
+func (s *Server) fillEntry(r *http.Request, body []byte, fetchedAt time.Time) []byte {
+	h := entryHeader{StoredAt: fetchedAt.UnixMilli(), Kind: entryKind(plainBody(body))}
+	if s.config.CacheStoreURI {
+		h.URI = s.entryURI(r)
+	}
+	return encodeEntryHeader(body, h)
+}
+
+// conditionalSetScript stores ARGV[3] under KEYS[1] unless the entry there
+// is fresher: its envelope holds a stored_at later than ARGV[7] and no kind.
+// It returns whether the value was stored and the body the entry held. The
+// value is stored as ARGV[8] tells: as a string, as a hash entry at ARGV[9]
+// expiring at ARGV[10], or content-addressed in the blob KEYS[2] with the
+// pointer ARGV[4]. The following KEYS are the blob KEYS[1] points to, if
+// any, which is released when the entry is replaced. ARGV[1] and ARGV[2] are
+// the pointer and blob key prefixes, ARGV[5] the TTL in milliseconds (0 for
+// none) and ARGV[6] the envelope prefix.
+var conditionalSetScript = redis.NewScript(casRelease + casEntrySet + hashEntrySet + `
+local function storedAt(value)
+	if not value or string.sub(value, 1, #ARGV[6]) ~= ARGV[6] then
+		return nil
+	end
+	local eol = string.find(value, '\n', #ARGV[6] + 1, true)
+	if not eol then
+		return nil
+	end
+	local ok, header = pcall(cjson.decode, string.sub(value, #ARGV[6] + 1, eol - 1))
+	if not ok or type(header) ~= 'table' or header.kind then
+		return nil
+	end
+	return tonumber(header.stored_at)
+end
+local moved = undeclaredBlob(1)
+if moved then
+	return redis.error_reply('CASMOVED ' .. moved)
+end
+local value = getEntry(KEYS[1])
+local pinned = value and isPinned(KEYS[1])
+local previous, oldBlob = resolve(value)
+local current = storedAt(previous)
+if current and current > tonumber(ARGV[7]) then
+	return {0, previous}
+end
+local ttl = tonumber(ARGV[5])
+if ARGV[8] == 'cas' then
+	setCASEntry(KEYS[1], KEYS[2], ARGV[3], ARGV[4], ttl)
+	return {1, previous}
+elseif ARGV[8] == 'hash' then
+	setHashEntry(KEYS[1], ARGV[3], ARGV[9], ARGV[10], ttl)
+elseif ttl > 0 then
+	redis.call('SET', KEYS[1], ARGV[3], 'PX', ttl)
+else
+	redis.call('SET', KEYS[1], ARGV[3])
+end
+if oldBlob then
+	release(oldBlob, pinned)
+end
+return {1, previous}
+`)
+
+// conditionalSetter is implemented by the stores that replace an entry only
+// with a fresher one atomically.
+type conditionalSetter interface {
+	setIfFresher(ctx context.Context, key string, value []byte, ttl time.Duration, storedAt time.Time) (stored bool, previous []byte, err error)
+}
+
+// setIfFresher stores value, a body fetched upstream at storedAt, under key
+// unless the entry there was fetched later and is neither negative nor
+// partial, so that a slow fill does not replace the response of a later one.
+// It returns whether value was stored and the value the entry held. Stores
+// other than the package's replace the entry in any case.
+func setIfFresher(ctx context.Context, store CacheStore, key string, value []byte, ttl time.Duration, storedAt time.Time) (bool, []byte, error) {
+	if c, ok := store.(conditionalSetter); ok {
+		return c.setIfFresher(ctx, key, value, ttl, storedAt)
+	}
+	previous, err := store.Swap(ctx, key, value, ttl)
+	return err == nil, previous, err
+}
+
+func (s *redisStore) setIfFresher(ctx context.Context, key string, value []byte, ttl time.Duration, storedAt time.Time) (bool, []byte, error) {
+	keys := []string{key}
+	mode, pointer := "string", ""
+	if s.contentAddressed {
+		hash := contentHash(value)
+		keys = append(keys, s.blobPrefix+hash)
+		mode, pointer = "cas", casPointerPrefix+hash
+	} else if s.hashEntries {
+		mode = "hash"
+	}
+	now := time.Now()
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = now.Add(ttl).UnixMilli()
+	}
+	var result []interface{}
+	err := s.withBlobs(ctx, []string{key}, func(blobs []string) error {
+		var err error
+		result, err = conditionalSetScript.Run(ctx, s.client, append(keys, blobs...),
+			casPointerPrefix, s.blobPrefix, value, pointer, ttl.Milliseconds(),
+			entryEnvelopePrefix, storedAt.UnixMilli(), mode, now.UnixMilli(), expiresAt,
+		).Slice()
+		return err
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	var previous []byte
+	if str, ok := result[1].(string); ok {
+		previous = []byte(str)
+	}
+	return result[0] == int64(1), previous, nil
+}
+
+func (s *migratingStore) setIfFresher(ctx context.Context, key string, value []byte, ttl time.Duration, storedAt time.Time) (bool, []byte, error) {
+	return setIfFresher(ctx, s.current, key, value, ttl, storedAt)
+}
+
+func (s *mirroringStore) setIfFresher(ctx context.Context, key string, value []byte, ttl time.Duration, storedAt time.Time) (bool, []byte, error) {
+	stored, previous, err := setIfFresher(ctx, s.current, key, value, ttl, storedAt)
+	if err == nil && stored {
+		s.enqueue(mirrorOp{op: "set", keys: []string{key}, value: value, ttl: ttl})
+	}
+	return stored, previous, err
+}
+
+// setIfFresher compares the entries kept in Redis only: oversized entries
+// replace the entry in any case.
+func (s *spilloverStore) setIfFresher(ctx context.Context, key string, value []byte, ttl time.Duration, storedAt time.Time) (bool, []byte, error) {
+	if len(value) > s.maxBytes {
+		previous, err := s.Swap(ctx, key, value, ttl)
+		return err == nil, previous, err
+	}
+	stored, previous, err := setIfFresher(ctx, s.current, key, value, ttl, storedAt)
+	if err == nil && stored && s.disk != nil {
+		if spilled := s.disk.get(key); spilled != nil {
+			previous = spilled
+			s.disk.delete(key)
+		}
+	}
+	return stored, previous, err
+}
@@ -0,0 +1,150 @@
+package geocache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestEntryKind(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"status":"OK","results":[]}`, ""},
+		{`{"status":"ZERO_RESULTS","results":[]}`, entryNegative},
+		{`{"status":"UNKNOWN_ERROR"}`, entryPartial},
+		{`{"status":"OK","rows":[{"elements":[{"status":"OK"},{"status":"NOT_FOUND"}]}]}`, entryPartial},
+		{`{"status":"OK","rows":[{"elements":[{"status":"OK"}]}]}`, ""},
+		{`<xml/>`, ""},
+	}
+	for _, tt := range tests {
+		if got := entryKind([]byte(tt.body)); got != tt.want {
+			t.Errorf("entryKind(%s) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRedisStore_SetIfFresher(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to create miniredis: %v", err)
+	}
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	ctx := context.Background()
+
+	early := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	late := early.Add(time.Second)
+	entry := func(body string, storedAt time.Time) []byte {
+		return encodeEntryHeader([]byte(body), entryHeader{StoredAt: storedAt.UnixMilli(), Kind: entryKind([]byte(body))})
+	}
+	full := `{"status":"OK","results":[{"place_id":"a"}]}`
+
+	for _, mode := range []string{"string", "hash", "cas"} {
+		t.Run(mode, func(t *testing.T) {
+			mr.FlushAll()
+			store := newRedisStore(rdb, "test", mode == "cas")
+			store.hashEntries = mode == "hash"
+
+			stored, _, err := store.setIfFresher(ctx, "test:a", entry(full, late), time.Hour, late)
+			if err != nil || !stored {
+				t.Fatalf("Expected the first fill to be stored, got %v, %v", stored, err)
+			}
+			// A fill requested earlier keeps the later entry.
+			stored, previous, err := store.setIfFresher(ctx, "test:a", entry(`{"status":"OK","results":[]}`, early), time.Hour, early)
+			if err != nil || stored {
+				t.Errorf("Expected the fresher entry to be kept, got %v, %v", stored, err)
+			}
+			if string(previous) != string(entry(full, late)) {
+				t.Errorf("Expected the entry kept as previous, got %q", previous)
+			}
+			values, _ := store.Get(ctx, "test:a")
+			if body, _ := decodeEntry(values[0]); string(body) != full {
+				t.Errorf("Expected the fresher entry, got %s", body)
+			}
+			if ttl := mr.TTL("test:a"); ttl != time.Hour {
+				t.Errorf("Expected TTL 1h, got %v", ttl)
+			}
+
+			// A negative entry is replaced by any fill.
+			store.Set(ctx, "test:a", entry(`{"status":"ZERO_RESULTS","results":[]}`, late), time.Hour)
+			if stored, _, _ := store.setIfFresher(ctx, "test:a", entry(full, early), 2*time.Hour, early); !stored {
+				t.Errorf("Expected the negative entry to be replaced")
+			}
+			if ttl := mr.TTL("test:a"); ttl != 2*time.Hour {
+				t.Errorf("Expected TTL 2h, got %v", ttl)
+			}
+
+			// So are entries without a stored_at.
+			store.Set(ctx, "test:a", []byte(full), time.Hour)
+			if stored, _, _ := store.setIfFresher(ctx, "test:a", entry(full, early), 0, early); !stored {
+				t.Errorf("Expected the bare entry to be replaced")
+			}
+			if ttl := mr.TTL("test:a"); ttl != 0 {
+				t.Errorf("Expected no TTL, got %v", ttl)
+			}
+		})
+	}
+}
+
+func TestServer_StoreResponse_ConditionalFills(t *testing.T) {
+	for _, clientSideCaching := range []bool{false, true} {
+		t.Run(fmt.Sprintf("client-side caching %v", clientSideCaching), func(t *testing.T) {
+			server, _, cleanup := setupTestServer(t, nil)
+			defer cleanup()
+			server.config.ConditionalFills = true
+			if clientSideCaching {
+				tracking := &trackingStore{current: server.store, cache: newClientCache(10, systemClock{})}
+				tracking.cache.setTracking(true)
+				server.store = tracking
+			}
+			req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil)
+			cacheKey := server.cacheKey(req)
+			kept := testutil.ToFloat64(conditionalFillsTotal.WithLabelValues("kept"))
+			body := func() string {
+				t.Helper()
+				entries, err := lookupEntries(context.Background(), server.store, []string{cacheKey}, lookupOptions{})
+				if err != nil {
+					t.Fatalf("lookupEntries() failed: %v", err)
+				}
+				body, err := decodeEntry(entries[0].value)
+				if err != nil {
+					t.Fatalf("decodeEntry() failed: %v", err)
+				}
+				return string(body)
+			}
+
+			now := time.Now()
+			if server.storeResponse(req, cacheKey, []byte(`{"status":"OK","results":[{"place_id":"new"}]}`), now) {
+				t.Fatalf("Expected the first fill to be stored")
+			}
+			body()
+			if !server.storeResponse(req, cacheKey, []byte(`{"status":"OK","results":[{"place_id":"old"}]}`), now.Add(-time.Second)) {
+				t.Errorf("Expected the slower fill to keep the fresher entry")
+			}
+			if got := testutil.ToFloat64(conditionalFillsTotal.WithLabelValues("kept")) - kept; got != 1 {
+				t.Errorf("Expected 1 kept fill, got %v", got)
+			}
+			if got := body(); got != `{"status":"OK","results":[{"place_id":"new"}]}` {
+				t.Errorf("Expected the fresher entry, got %s", got)
+			}
+
+			// A later fill replaces the entry, and its copy in memory.
+			if server.storeResponse(req, cacheKey, []byte(`{"status":"OK","results":[{"place_id":"newer"}]}`), now.Add(time.Second)) {
+				t.Errorf("Expected the later fill to be stored")
+			}
+			if got := body(); got != `{"status":"OK","results":[{"place_id":"newer"}]}` {
+				t.Errorf("Expected the later entry, got %s", got)
+			}
+		})
+	}
+}
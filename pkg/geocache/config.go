@@ -0,0 +1,584 @@
+package geocache
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Environment struct {
+	RedisHost        string
+	RedisPort        string
+	LogFormat        string
+	ServerPort       string
+	BaseURL          string
+	CacheTimeout     time.Duration
+	RedisDB          int
+	RedisPrefix      string
+	InfluxDSN        string
+	InfluxSampleRate float64
+	CanaryBaseURL    string
+	CanaryPercent    float64
+}
+
+type APIConfig struct {
+	Version string
+}
+
+var (
+	defaultEnv = Environment{
+		RedisHost:        "redis",
+		RedisPort:        "6379",
+		ServerPort:       "80",
+		BaseURL:          "https://maps.googleapis.com",
+		CacheTimeout:     720 * time.Hour,
+		RedisDB:          0,
+		RedisPrefix:      "",
+		InfluxDSN:        "",
+		InfluxSampleRate: 0.0,
+		CanaryBaseURL:    "",
+		CanaryPercent:    0.0,
+	}
+
+	apiConfig = APIConfig{
+		Version: "1.0.0",
+	}
+)
+
+type Config struct {
+	RedisHost                      string
+	RedisPort                      string
+	ServerPort                     string
+	LogFormat                      string
+	LogLevel                       string
+	LogComponentLevels             map[string]string
+	LogDedupBurst                  int
+	LogDedupWindow                 time.Duration
+	LogRequestURI                  bool
+	BaseURL                        string
+	CacheTimeout                   time.Duration
+	RedisDB                        int
+	RedisPrefix                    string
+	RedisFailoverThreshold         int
+	InfluxDSN                      string
+	InfluxSampleRate               float64
+	AllowedMetricsCIDRs            []string
+	MetricsBearerToken             string
+	MetricsBasicAuth               string
+	VerboseLogging                 bool
+	CanaryBaseURL                  string
+	CanaryPercent                  float64
+	NormalizeAddress               bool
+	NormalizeStripDiacritics       bool
+	AddressAbbreviationsFile       string
+	AllowedAdminCIDRs              []string
+	AdminTokens                    map[string]string
+	AdminUI                        bool
+	AuditLogFile                   string
+	DuplicateTracking              bool
+	DuplicateTrackingMax           int
+	PlaceIndex                     bool
+	PlaceIndexMaxPlaces            int
+	ChangeDetection                bool
+	ChangeLocationThresholdMeters  float64
+	ChangeDistanceThresholdPercent float64
+	AnomalyDetection               bool
+	AnomalyInterval                time.Duration
+	AnomalyEWMAAlpha               float64
+	AnomalyFactor                  float64
+	AnomalyMinCount                float64
+	AnomalyLearningIntervals       int
+	AnomalyWebhookURL              string
+	RateLimitPerMinute             int
+	TrustedProxyCIDRs              []string
+	BanThreshold                   int
+	BanViolationWindow             time.Duration
+	BanBaseDuration                time.Duration
+	BanMaxDuration                 time.Duration
+	BanStrikeMemory                time.Duration
+	UpstreamGzip                   bool
+	PolylineToleranceMeters        float64
+	PolylineSimplifyMode           string
+	ProtobufOutput                 bool
+	BatchMaxAddresses              int
+	BigQueryTable                  string
+	BigQueryBatchSize              int
+	BigQueryFlushInterval          time.Duration
+	UsageCosts                     map[string]string
+	GCPProject                     string
+	CloudLoggingLogName            string
+	CloudLoggingResourceType       string
+	CloudLoggingResourceLabels     map[string]string
+	ConfigDir                      string
+	TLSCertFile                    string
+	TLSKeyFile                     string
+	InstanceHeartbeat              time.Duration
+	ZeroResultsFilter              bool
+	ContentAddressedStorage        bool
+	SelfTestAddress                string
+	MaintenanceMode                string
+	ValidateResponses              bool
+	CacheChecksums                 bool
+	CacheStoreURI                  bool
+	CacheMaxUpstreamLatency        time.Duration
+	CacheSkipStreamed              bool
+	MigrationMode                  bool
+	MigrateFromRedisDB             int
+	MigrateFromRedisPrefix         string
+	SnapshotLocation               string
+	SnapshotInterval               time.Duration
+	URLSigningSecret               string
+	URLSigningClientID             string
+	UpstreamRoutesFile             string
+	ListenAddress                  string
+	ListenNetwork                  string
+	WarmupWindow                   time.Duration
+	WarmupInitialConcurrency       int
+	WarmupMaxConcurrency           int
+	UpstreamMaxConcurrency         int
+	BatchAPIKeys                   []string
+	BatchUpstreamShare             float64
+	BatchQueueTimeout              time.Duration
+	PushgatewayURL                 string
+	HTTPDurationBuckets            []float64
+	RedisLatencyBuckets            []float64
+	ProfilesFile                   string
+	UpstreamAPIKey                 string
+	UpstreamHosts                  map[string]string
+	UpstreamResolver               string
+	UpstreamUserAgent              string
+	UpstreamHeaders                map[string]string
+	UpstreamProxy                  string
+	XMLTranscode                   bool
+	JSONOutputEndpoints            []string
+	BusinessUnitHeader             string
+	BusinessUnitParam              string
+	BusinessUnits                  []string
+	CacheKeyParams                 map[string]string
+	CacheKeyCandidateFile          string
+	RulesFile                      string
+	CacheBypassPatterns            []string
+	RejectPatterns                 []string
+	PostCachePaths                 []string
+	PostCacheVolatileFields        []string
+	UpstreamRedirects              string
+	UpstreamMaxRedirects           int
+	RequestTimeout                 time.Duration
+	EndpointTimeouts               map[string]string
+	MaxConnections                 int
+	MaxInflightRequests            int
+	ShutdownTimeout                time.Duration
+	HealthFailureThreshold         int
+	HealthRecovery                 time.Duration
+	AuthChain                      []string
+	AuthAllowedCIDRs               []string
+	AuthAPIKeys                    map[string]string
+	AuthJWTSecret                  string
+	AuthJWTIssuer                  string
+	AuthJWTAudience                string
+	ResponseWatermark              bool
+	UpstreamPrewarmInterval        time.Duration
+	UpstreamHTTP3                  bool
+	WarmSource                     string
+	WarmQuery                      string
+	WarmTopN                       int
+	WarmInterval                   time.Duration
+	WarmRatePerSecond              int
+	WarmAPIKey                     string
+	IntegritySweepSample           int
+	IntegritySweepPurge            bool
+	CloudMonitoringInterval        time.Duration
+	CacheHashEntries               bool
+	CacheHitCounts                 bool
+	HotKeysMax                     int
+	SlowRequestsMax                int
+	SlowRequestThreshold           time.Duration
+	ConditionalFills               bool
+	ForwardHeaders                 []string
+	CacheKeyHeaders                []string
+	UsageReports                   bool
+	UsageReportTimeZone            string
+	UsageReportRetentionDays       int
+	StitchPlacesPages              bool
+	DistanceMatrixLimits           map[string]string
+	CacheDebugCIDRs                []string
+	AutocompleteMode               string
+	AutocompleteRateLimitPerMinute int
+	AutocompleteSamplePercent      float64
+	AutocompleteMicrocacheTTL      time.Duration
+	QuotaRetryAfter                time.Duration
+	QuotaCircuit                   bool
+	QuotaCircuitMaxWait            time.Duration
+	MirrorRedisAddr                string
+	MirrorRedisDB                  int
+	MirrorReads                    bool
+	MirrorUntil                    time.Time
+	CacheMaxEntryBytes             int
+	DiskCacheDir                   string
+	DiskCacheMaxMB                 int
+	ClientSideCaching              bool
+	ClientSideCacheMaxKeys         int
+	EdgeSyncURL                    string
+	EdgeSyncToken                  string
+	EdgeSyncInterval               time.Duration
+	EdgeSyncBounds                 string
+	EdgeSyncPrefix                 string
+	SelfTestAPIKey                 string
+	ZeroResultsFilterCapacity      int
+	ZeroResultsFilterFPRate        float64
+	ZeroResultsFilterPeriod        time.Duration
+}
+
+func LoadConfig() Config {
+	return loadConfig(getEnv)
+}
+
+// loadConfig builds the configuration from the settings returned by env.
+func loadConfig(env configLookup) Config {
+	cacheTimeoutHours, _ := strconv.ParseInt(env.orDefault("CACHE_TIMEOUT_HOURS", "720"), 10, 64)
+	redisDB, _ := strconv.Atoi(env.orDefault("REDIS_DB", "0"))
+	redisFailoverThreshold, _ := strconv.Atoi(env.orDefault("REDIS_FAILOVER_THRESHOLD", "3"))
+	influxSampleRate, _ := strconv.ParseFloat(env.orDefault("INFLUX_SAMPLE_RATE", "0.0"), 64)
+	canaryPercent, _ := strconv.ParseFloat(env.orDefault("CANARY_PERCENT", "0.0"), 64)
+	placeIndexMaxPlaces, _ := strconv.Atoi(env.orDefault("PLACE_INDEX_MAX_PLACES", "10000"))
+	duplicateTrackingMax, _ := strconv.Atoi(env.orDefault("DUPLICATE_TRACKING_MAX", "100000"))
+	changeLocationThreshold, _ := strconv.ParseFloat(env.orDefault("CHANGE_LOCATION_THRESHOLD_METERS", "50"), 64)
+	logDedupBurst, _ := strconv.Atoi(env.orDefault("LOG_DEDUP_BURST", "10"))
+	logDedupWindowSeconds, _ := strconv.Atoi(env.orDefault("LOG_DEDUP_WINDOW_SECONDS", "60"))
+	changeDistanceThreshold, _ := strconv.ParseFloat(env.orDefault("CHANGE_DISTANCE_THRESHOLD_PERCENT", "5"), 64)
+	anomalyIntervalSeconds, _ := strconv.Atoi(env.orDefault("ANOMALY_INTERVAL_SECONDS", "60"))
+	anomalyEWMAAlpha, _ := strconv.ParseFloat(env.orDefault("ANOMALY_EWMA_ALPHA", "0.1"), 64)
+	anomalyFactor, _ := strconv.ParseFloat(env.orDefault("ANOMALY_FACTOR", "5"), 64)
+	anomalyMinCount, _ := strconv.ParseFloat(env.orDefault("ANOMALY_MIN_COUNT", "100"), 64)
+	anomalyLearningIntervals, _ := strconv.Atoi(env.orDefault("ANOMALY_LEARNING_INTERVALS", "10"))
+	rateLimitPerMinute, _ := strconv.Atoi(env.orDefault("RATE_LIMIT_PER_MINUTE", "0"))
+	autocompleteRateLimitPerMinute, _ := strconv.Atoi(env.orDefault("AUTOCOMPLETE_RATE_LIMIT_PER_MINUTE", "0"))
+	autocompleteSamplePercent, _ := strconv.ParseFloat(env.orDefault("AUTOCOMPLETE_SAMPLE_PERCENT", "100"), 64)
+	autocompleteMicrocacheSeconds, _ := strconv.Atoi(env.orDefault("AUTOCOMPLETE_MICROCACHE_SECONDS", "10"))
+	quotaRetryAfterSeconds, _ := strconv.Atoi(env.orDefault("QUOTA_RETRY_AFTER_SECONDS", "60"))
+	banThreshold, _ := strconv.Atoi(env.orDefault("BAN_THRESHOLD", "3"))
+	banViolationWindowMinutes, _ := strconv.Atoi(env.orDefault("BAN_VIOLATION_WINDOW_MINUTES", "10"))
+	banBaseDurationMinutes, _ := strconv.Atoi(env.orDefault("BAN_BASE_DURATION_MINUTES", "5"))
+	banMaxDurationHours, _ := strconv.Atoi(env.orDefault("BAN_MAX_DURATION_HOURS", "24"))
+	banStrikeMemoryHours, _ := strconv.Atoi(env.orDefault("BAN_STRIKE_MEMORY_HOURS", "168"))
+	batchMaxAddresses, _ := strconv.Atoi(env.orDefault("BATCH_MAX_ADDRESSES", "100"))
+	bigQueryBatchSize, _ := strconv.Atoi(env.orDefault("BIGQUERY_BATCH_SIZE", "500"))
+	bigQueryFlushSeconds, _ := strconv.Atoi(env.orDefault("BIGQUERY_FLUSH_SECONDS", "10"))
+	zeroResultsFilterCapacity, _ := strconv.Atoi(env.orDefault("ZERO_RESULTS_FILTER_CAPACITY", "100000"))
+	zeroResultsFilterFPRate, _ := strconv.ParseFloat(env.orDefault("ZERO_RESULTS_FILTER_FP_RATE", "0.001"), 64)
+	zeroResultsFilterHours, _ := strconv.Atoi(env.orDefault("ZERO_RESULTS_FILTER_PERIOD_HOURS", "24"))
+	snapshotIntervalHours, _ := strconv.Atoi(env.orDefault("SNAPSHOT_INTERVAL_HOURS", "24"))
+	migrateFromRedisDB, _ := strconv.Atoi(env.orDefault("MIGRATE_FROM_REDIS_DB", strconv.Itoa(redisDB)))
+	mirrorRedisDB, _ := strconv.Atoi(env.orDefault("MIRROR_REDIS_DB", strconv.Itoa(redisDB)))
+	mirrorUntil, _ := time.Parse(time.RFC3339, env.get("MIRROR_UNTIL"))
+	cacheMaxEntryBytes, _ := strconv.Atoi(env.orDefault("CACHE_MAX_ENTRY_BYTES", "0"))
+	diskCacheMaxMB, _ := strconv.Atoi(env.orDefault("DISK_CACHE_MAX_MB", "1024"))
+	clientSideCacheMaxKeys, _ := strconv.Atoi(env.orDefault("CLIENT_SIDE_CACHE_MAX_KEYS", "10000"))
+	upstreamMaxRedirects, _ := strconv.Atoi(env.orDefault("UPSTREAM_MAX_REDIRECTS", "10"))
+	requestTimeoutSeconds, _ := strconv.Atoi(env.orDefault("REQUEST_TIMEOUT_SECONDS", "0"))
+	maxConnections, _ := strconv.Atoi(env.orDefault("MAX_CONNECTIONS", "0"))
+	maxInflightRequests, _ := strconv.Atoi(env.orDefault("MAX_INFLIGHT_REQUESTS", "0"))
+	cacheMaxUpstreamLatencySeconds, _ := strconv.Atoi(env.orDefault("CACHE_MAX_UPSTREAM_LATENCY_SECONDS", "0"))
+	shutdownTimeoutSeconds, _ := strconv.Atoi(env.orDefault("SHUTDOWN_TIMEOUT_SECONDS", "10"))
+	healthFailureThreshold, _ := strconv.Atoi(env.orDefault("HEALTH_FAILURE_THRESHOLD", "5"))
+	healthRecoverySeconds, _ := strconv.Atoi(env.orDefault("HEALTH_RECOVERY_SECONDS", "30"))
+	upstreamPrewarmSeconds, _ := strconv.Atoi(env.orDefault("UPSTREAM_PREWARM_SECONDS", "0"))
+	warmTopN, _ := strconv.Atoi(env.orDefault("WARM_TOP_N", "1000"))
+	warmIntervalHours, _ := strconv.Atoi(env.orDefault("WARM_INTERVAL_HOURS", "24"))
+	warmRatePerSecond, _ := strconv.Atoi(env.orDefault("WARM_RATE_PER_SECOND", "5"))
+	integritySweepSample, _ := strconv.Atoi(env.orDefault("INTEGRITY_SWEEP_SAMPLE", "0"))
+	cloudMonitoringIntervalSeconds, _ := strconv.Atoi(env.orDefault("CLOUD_MONITORING_INTERVAL_SECONDS", "0"))
+	hotKeysMax, _ := strconv.Atoi(env.orDefault("HOT_KEYS_MAX", "10000"))
+	slowRequestsMax, _ := strconv.Atoi(env.orDefault("SLOW_REQUESTS_MAX", "100"))
+	slowRequestThresholdSeconds, _ := strconv.ParseFloat(env.orDefault("SLOW_REQUEST_THRESHOLD_SECONDS", "1"), 64)
+	usageReportRetentionDays, _ := strconv.Atoi(env.orDefault("USAGE_REPORT_RETENTION_DAYS", "400"))
+	quotaCircuitMaxWaitSeconds, _ := strconv.Atoi(env.orDefault("QUOTA_CIRCUIT_MAX_WAIT_SECONDS", "0"))
+	edgeSyncIntervalMinutes, _ := strconv.Atoi(env.orDefault("EDGE_SYNC_INTERVAL_MINUTES", "60"))
+	instanceHeartbeatSeconds, _ := strconv.Atoi(env.orDefault("INSTANCE_HEARTBEAT_SECONDS", "15"))
+	warmupSeconds, _ := strconv.Atoi(env.orDefault("WARMUP_SECONDS", "0"))
+	warmupInitialConcurrency, _ := strconv.Atoi(env.orDefault("WARMUP_INITIAL_CONCURRENCY", "4"))
+	warmupMaxConcurrency, _ := strconv.Atoi(env.orDefault("WARMUP_MAX_CONCURRENCY", "64"))
+	upstreamMaxConcurrency, _ := strconv.Atoi(env.orDefault("UPSTREAM_MAX_CONCURRENCY", "0"))
+	batchUpstreamShare, _ := strconv.ParseFloat(env.orDefault("BATCH_UPSTREAM_SHARE", "0.5"), 64)
+	batchQueueSeconds, _ := strconv.Atoi(env.orDefault("BATCH_QUEUE_SECONDS", "10"))
+	polylineTolerance, _ := strconv.ParseFloat(env.orDefault("POLYLINE_TOLERANCE_METERS", "0"), 64)
+
+	return Config{
+		RedisHost:                      env.orDefault("REDIS_HOST", defaultEnv.RedisHost),
+		RedisPort:                      env.orDefault("REDIS_PORT", defaultEnv.RedisPort),
+		ServerPort:                     env.orDefault("SERVER_PORT", env.orDefault("PORT", defaultEnv.ServerPort)),
+		LogFormat:                      env.get("LOG_FORMAT"),
+		LogLevel:                       env.orDefault("LOG_LEVEL", "info"),
+		LogComponentLevels:             env.mapping("LOG_COMPONENT_LEVELS"),
+		LogDedupBurst:                  logDedupBurst,
+		LogDedupWindow:                 time.Duration(logDedupWindowSeconds) * time.Second,
+		LogRequestURI:                  env.bool("LOG_REQUEST_URI", false),
+		BaseURL:                        env.orDefault("BASE_URL", defaultEnv.BaseURL),
+		CacheTimeout:                   time.Duration(cacheTimeoutHours) * time.Hour,
+		RedisDB:                        redisDB,
+		RedisPrefix:                    env.orDefault("REDIS_PREFIX", defaultEnv.RedisPrefix),
+		RedisFailoverThreshold:         redisFailoverThreshold,
+		InfluxDSN:                      env.orDefault("INFLUX_DSN", defaultEnv.InfluxDSN),
+		InfluxSampleRate:               influxSampleRate,
+		AllowedMetricsCIDRs:            env.list("ALLOWED_METRICS_CIDRS"),
+		MetricsBearerToken:             env.get("METRICS_BEARER_TOKEN"),
+		MetricsBasicAuth:               env.get("METRICS_BASIC_AUTH"),
+		VerboseLogging:                 env.bool("VERBOSE_LOGGING", false),
+		CanaryBaseURL:                  env.orDefault("CANARY_BASE_URL", defaultEnv.CanaryBaseURL),
+		CanaryPercent:                  canaryPercent,
+		NormalizeAddress:               env.bool("NORMALIZE_ADDRESS", false),
+		NormalizeStripDiacritics:       env.bool("NORMALIZE_STRIP_DIACRITICS", true),
+		AddressAbbreviationsFile:       env.get("ADDRESS_ABBREVIATIONS_FILE"),
+		AllowedAdminCIDRs:              env.list("ALLOWED_ADMIN_CIDRS"),
+		AdminTokens:                    env.mapping("ADMIN_TOKENS"),
+		AdminUI:                        env.bool("ADMIN_UI", false),
+		AuditLogFile:                   env.get("AUDIT_LOG_FILE"),
+		DuplicateTracking:              env.bool("DUPLICATE_TRACKING", false),
+		DuplicateTrackingMax:           duplicateTrackingMax,
+		PlaceIndex:                     env.bool("PLACE_INDEX", false),
+		PlaceIndexMaxPlaces:            placeIndexMaxPlaces,
+		ChangeDetection:                env.bool("CHANGE_DETECTION", false),
+		ChangeLocationThresholdMeters:  changeLocationThreshold,
+		ChangeDistanceThresholdPercent: changeDistanceThreshold,
+		AnomalyDetection:               env.bool("ANOMALY_DETECTION", false),
+		AnomalyInterval:                time.Duration(anomalyIntervalSeconds) * time.Second,
+		AnomalyEWMAAlpha:               anomalyEWMAAlpha,
+		AnomalyFactor:                  anomalyFactor,
+		AnomalyMinCount:                anomalyMinCount,
+		AnomalyLearningIntervals:       anomalyLearningIntervals,
+		AnomalyWebhookURL:              env.get("ANOMALY_WEBHOOK_URL"),
+		RateLimitPerMinute:             rateLimitPerMinute,
+		TrustedProxyCIDRs:              env.list("TRUSTED_PROXY_CIDRS"),
+		BanThreshold:                   banThreshold,
+		BanViolationWindow:             time.Duration(banViolationWindowMinutes) * time.Minute,
+		BanBaseDuration:                time.Duration(banBaseDurationMinutes) * time.Minute,
+		BanMaxDuration:                 time.Duration(banMaxDurationHours) * time.Hour,
+		BanStrikeMemory:                time.Duration(banStrikeMemoryHours) * time.Hour,
+		UpstreamGzip:                   env.bool("UPSTREAM_GZIP", false),
+		PolylineToleranceMeters:        polylineTolerance,
+		PolylineSimplifyMode:           env.orDefault("POLYLINE_SIMPLIFY_MODE", PolylineSimplifyResponse),
+		ProtobufOutput:                 env.bool("PROTOBUF_OUTPUT", false),
+		BatchMaxAddresses:              batchMaxAddresses,
+		BigQueryTable:                  env.get("BIGQUERY_TABLE"),
+		BigQueryBatchSize:              bigQueryBatchSize,
+		BigQueryFlushInterval:          time.Duration(bigQueryFlushSeconds) * time.Second,
+		UsageCosts:                     env.mapping("USAGE_COSTS"),
+		GCPProject:                     env.get("GOOGLE_CLOUD_PROJECT"),
+		CloudLoggingLogName:            env.orDefault("CLOUD_LOGGING_LOG_NAME", "geocache"),
+		CloudLoggingResourceType:       env.get("CLOUD_LOGGING_RESOURCE_TYPE"),
+		CloudLoggingResourceLabels:     env.mapping("CLOUD_LOGGING_RESOURCE_LABELS"),
+		ConfigDir:                      os.Getenv("CONFIG_DIR"),
+		TLSCertFile:                    env.get("TLS_CERT_FILE"),
+		TLSKeyFile:                     env.get("TLS_KEY_FILE"),
+		InstanceHeartbeat:              time.Duration(instanceHeartbeatSeconds) * time.Second,
+		ZeroResultsFilter:              env.bool("ZERO_RESULTS_FILTER", false),
+		ContentAddressedStorage:        env.bool("CONTENT_ADDRESSED_STORAGE", false),
+		SelfTestAddress:                env.orDefault("SELFTEST_ADDRESS", "1600 Amphitheatre Parkway, Mountain View, CA"),
+		SelfTestAPIKey:                 env.get("SELFTEST_API_KEY"),
+		MaintenanceMode:                env.orDefault("MAINTENANCE_MODE", MaintenanceOff),
+		ValidateResponses:              env.bool("VALIDATE_RESPONSES", false),
+		CacheChecksums:                 env.bool("CACHE_CHECKSUMS", false),
+		CacheStoreURI:                  env.bool("CACHE_STORE_URI", false),
+		CacheMaxUpstreamLatency:        time.Duration(cacheMaxUpstreamLatencySeconds) * time.Second,
+		CacheSkipStreamed:              env.bool("CACHE_SKIP_STREAMED", false),
+		MigrationMode:                  env.bool("MIGRATION_MODE", false),
+		MigrateFromRedisDB:             migrateFromRedisDB,
+		MigrateFromRedisPrefix:         env.get("MIGRATE_FROM_REDIS_PREFIX"),
+		SnapshotLocation:               env.get("SNAPSHOT_LOCATION"),
+		SnapshotInterval:               time.Duration(snapshotIntervalHours) * time.Hour,
+		URLSigningSecret:               env.get("URL_SIGNING_SECRET"),
+		URLSigningClientID:             env.get("URL_SIGNING_CLIENT_ID"),
+		UpstreamRoutesFile:             env.get("UPSTREAM_ROUTES_FILE"),
+		ListenAddress:                  env.get("LISTEN_ADDRESS"),
+		ListenNetwork:                  env.orDefault("LISTEN_NETWORK", "tcp"),
+		WarmupWindow:                   time.Duration(warmupSeconds) * time.Second,
+		WarmupInitialConcurrency:       warmupInitialConcurrency,
+		WarmupMaxConcurrency:           warmupMaxConcurrency,
+		UpstreamMaxConcurrency:         upstreamMaxConcurrency,
+		BatchAPIKeys:                   env.list("BATCH_API_KEYS"),
+		BatchUpstreamShare:             batchUpstreamShare,
+		BatchQueueTimeout:              time.Duration(batchQueueSeconds) * time.Second,
+		PushgatewayURL:                 env.get("PUSHGATEWAY_URL"),
+		HTTPDurationBuckets:            env.buckets("HTTP_DURATION_BUCKETS"),
+		RedisLatencyBuckets:            env.buckets("REDIS_LATENCY_BUCKETS"),
+		ProfilesFile:                   env.get("PROFILES_FILE"),
+		UpstreamAPIKey:                 env.get("UPSTREAM_API_KEY"),
+		UpstreamHosts:                  env.mapping("UPSTREAM_HOSTS"),
+		UpstreamResolver:               env.get("UPSTREAM_RESOLVER"),
+		UpstreamUserAgent:              env.orDefault("UPSTREAM_USER_AGENT", upstreamUserAgent(env.get("UPSTREAM_CONTACT"))),
+		UpstreamHeaders:                env.mapping("UPSTREAM_HEADERS"),
+		UpstreamProxy:                  env.get("UPSTREAM_PROXY"),
+		XMLTranscode:                   env.bool("XML_TRANSCODE", false),
+		JSONOutputEndpoints:            env.list("JSON_OUTPUT_ENDPOINTS"),
+		BusinessUnitHeader:             env.get("BUSINESS_UNIT_HEADER"),
+		BusinessUnitParam:              env.get("BUSINESS_UNIT_PARAM"),
+		BusinessUnits:                  env.list("BUSINESS_UNITS"),
+		CacheKeyParams:                 env.mapping("CACHE_KEY_PARAMS"),
+		CacheKeyCandidateFile:          env.get("CACHE_KEY_CANDIDATE_FILE"),
+		RulesFile:                      env.get("RULES_FILE"),
+		CacheBypassPatterns:            env.list("CACHE_BYPASS_PATTERNS"),
+		RejectPatterns:                 env.list("REJECT_PATTERNS"),
+		PostCachePaths:                 env.list("POST_CACHE_PATHS"),
+		PostCacheVolatileFields:        env.list("POST_CACHE_VOLATILE_FIELDS"),
+		UpstreamRedirects:              env.orDefault("UPSTREAM_REDIRECTS", RedirectFollow),
+		UpstreamMaxRedirects:           upstreamMaxRedirects,
+		RequestTimeout:                 time.Duration(requestTimeoutSeconds) * time.Second,
+		EndpointTimeouts:               env.mapping("ENDPOINT_TIMEOUTS"),
+		MaxConnections:                 maxConnections,
+		MaxInflightRequests:            maxInflightRequests,
+		ShutdownTimeout:                time.Duration(shutdownTimeoutSeconds) * time.Second,
+		HealthFailureThreshold:         healthFailureThreshold,
+		HealthRecovery:                 time.Duration(healthRecoverySeconds) * time.Second,
+		AuthChain:                      env.list("AUTH_CHAIN"),
+		AuthAllowedCIDRs:               env.list("AUTH_ALLOWED_CIDRS"),
+		AuthAPIKeys:                    env.mapping("AUTH_API_KEYS"),
+		AuthJWTSecret:                  env.get("AUTH_JWT_SECRET"),
+		AuthJWTIssuer:                  env.get("AUTH_JWT_ISSUER"),
+		AuthJWTAudience:                env.get("AUTH_JWT_AUDIENCE"),
+		ResponseWatermark:              env.bool("RESPONSE_WATERMARK", false),
+		UpstreamPrewarmInterval:        time.Duration(upstreamPrewarmSeconds) * time.Second,
+		UpstreamHTTP3:                  env.bool("UPSTREAM_HTTP3", false),
+		WarmSource:                     env.get("WARM_SOURCE"),
+		WarmQuery:                      env.get("WARM_QUERY"),
+		WarmTopN:                       warmTopN,
+		WarmInterval:                   time.Duration(warmIntervalHours) * time.Hour,
+		WarmRatePerSecond:              warmRatePerSecond,
+		WarmAPIKey:                     env.get("WARM_API_KEY"),
+		IntegritySweepSample:           integritySweepSample,
+		IntegritySweepPurge:            env.bool("INTEGRITY_SWEEP_PURGE", false),
+		CloudMonitoringInterval:        time.Duration(cloudMonitoringIntervalSeconds) * time.Second,
+		CacheHashEntries:               env.bool("CACHE_HASH_ENTRIES", false),
+		CacheHitCounts:                 env.bool("CACHE_HIT_COUNTS", false),
+		HotKeysMax:                     hotKeysMax,
+		SlowRequestsMax:                slowRequestsMax,
+		SlowRequestThreshold:           time.Duration(slowRequestThresholdSeconds * float64(time.Second)),
+		ConditionalFills:               env.bool("CONDITIONAL_FILLS", false),
+		ForwardHeaders:                 parseList(env.orDefault("FORWARD_HEADERS", "X-Goog-*")),
+		CacheKeyHeaders:                parseList(env.orDefault("CACHE_KEY_HEADERS", "X-Goog-FieldMask")),
+		UsageReports:                   env.bool("USAGE_REPORTS", false),
+		UsageReportTimeZone:            env.orDefault("USAGE_REPORT_TIME_ZONE", "America/Los_Angeles"),
+		UsageReportRetentionDays:       usageReportRetentionDays,
+		StitchPlacesPages:              env.bool("STITCH_PLACES_PAGES", false),
+		DistanceMatrixLimits:           env.mapping("DISTANCE_MATRIX_LIMITS"),
+		CacheDebugCIDRs:                env.list("CACHE_DEBUG_CIDRS"),
+		AutocompleteMode:               env.orDefault("AUTOCOMPLETE_MODE", AutocompleteCache),
+		AutocompleteRateLimitPerMinute: autocompleteRateLimitPerMinute,
+		AutocompleteSamplePercent:      autocompleteSamplePercent,
+		AutocompleteMicrocacheTTL:      time.Duration(autocompleteMicrocacheSeconds) * time.Second,
+		QuotaRetryAfter:                time.Duration(quotaRetryAfterSeconds) * time.Second,
+		QuotaCircuit:                   env.bool("QUOTA_CIRCUIT", false),
+		QuotaCircuitMaxWait:            time.Duration(quotaCircuitMaxWaitSeconds) * time.Second,
+		MirrorRedisAddr:                env.get("MIRROR_REDIS_ADDR"),
+		MirrorRedisDB:                  mirrorRedisDB,
+		MirrorReads:                    env.bool("MIRROR_READS", false),
+		MirrorUntil:                    mirrorUntil,
+		CacheMaxEntryBytes:             cacheMaxEntryBytes,
+		DiskCacheDir:                   env.get("DISK_CACHE_DIR"),
+		DiskCacheMaxMB:                 diskCacheMaxMB,
+		ClientSideCaching:              env.bool("CLIENT_SIDE_CACHING", false),
+		ClientSideCacheMaxKeys:         clientSideCacheMaxKeys,
+		EdgeSyncURL:                    env.get("EDGE_SYNC_URL"),
+		EdgeSyncToken:                  env.get("EDGE_SYNC_TOKEN"),
+		EdgeSyncInterval:               time.Duration(edgeSyncIntervalMinutes) * time.Minute,
+		EdgeSyncBounds:                 env.get("EDGE_SYNC_BOUNDS"),
+		EdgeSyncPrefix:                 env.get("EDGE_SYNC_PREFIX"),
+		ZeroResultsFilterCapacity:      zeroResultsFilterCapacity,
+		ZeroResultsFilterFPRate:        zeroResultsFilterFPRate,
+		ZeroResultsFilterPeriod:        time.Duration(zeroResultsFilterHours) * time.Hour,
+	}
+}
+
+// getEnv returns the environment variable key. When CONFIG_DIR is set, a
+// file named key in that directory takes precedence, so settings can come
+// from mounted ConfigMaps and Secrets.
+func getEnv(key string) string {
+	return lookupConfig(os.Getenv("CONFIG_DIR"), key)
+}
+
+// lookupConfig reads key from a file in dir, falling back to the
+// environment.
+func lookupConfig(dir, key string) string {
+	if dir != "" {
+		if b, err := os.ReadFile(filepath.Join(dir, key)); err == nil {
+			return strings.TrimSpace(string(b))
+		}
+	}
+	return os.Getenv(key)
+}
+
+// configLookup returns the value of a setting, or "" when it is not set.
+type configLookup func(key string) string
+
+func (env configLookup) get(key string) string {
+	return env(key)
+}
+
+func (env configLookup) orDefault(key, defaultValue string) string {
+	if value := env(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func (env configLookup) bool(key string, defaultValue bool) bool {
+	if v := env(key); v != "" {
+		return v == "1" || strings.ToLower(v) == "true"
+	}
+	return defaultValue
+}
+
+// list splits a comma- or newline-separated setting into its trimmed,
+// non-empty elements.
+func (env configLookup) list(key string) []string {
+	return parseList(env(key))
+}
+
+func parseList(v string) []string {
+	list := []string{}
+	for _, item := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == '\n' }) {
+		trimmed := strings.TrimSpace(item)
+		if trimmed != "" {
+			list = append(list, trimmed)
+		}
+	}
+	return list
+}
+
+// buckets parses a comma-separated list of histogram bucket upper bounds in
+// seconds. It returns nil, selecting the default buckets, when the setting
+// is unset or the bounds are not increasing numbers.
+func (env configLookup) buckets(key string) []float64 {
+	return parseBuckets(env(key))
+}
+
+func parseBuckets(v string) []float64 {
+	var buckets []float64
+	for _, item := range parseList(v) {
+		b, err := strconv.ParseFloat(item, 64)
+		if err != nil || math.IsNaN(b) || (len(buckets) > 0 && b <= buckets[len(buckets)-1]) {
+			return nil
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// mapping parses a comma-separated list of key=value pairs. Elements without
+// "=" are ignored.
+func (env configLookup) mapping(key string) map[string]string {
+	return parseMap(env(key))
+}
+
+func parseMap(v string) map[string]string {
+	m := make(map[string]string)
+	for _, item := range parseList(v) {
+		k, v, ok := strings.Cut(item, "=")
+		if ok && strings.TrimSpace(k) != "" {
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return m
+}
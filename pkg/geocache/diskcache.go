@@ -0,0 +1,315 @@
+package geocache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache is a bounded, per-instance cache of entries in files of a local
+// directory, evicting the least recently used ones once it holds more than
+// maxBytes. Each file holds the expiry of the entry, in Unix nanoseconds
+// with 0 for none, followed by its value. The index is rebuilt from the
+// directory on startup, so entries survive restarts.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+	clock    Clock
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds the *diskEntry of the entries, most recently used first.
+	lru  *list.List
+	size int64
+}
+
+type diskEntry struct {
+	name    string
+	size    int64
+	expires time.Time
+}
+
+// diskEntryHeader is the length of the expiry preceding values in files.
+const diskEntryHeader = 8
+
+func openDiskCache(dir string, maxBytes int64, clock Clock) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &diskCache{dir: dir, maxBytes: maxBytes, clock: clock, entries: make(map[string]*list.Element), lru: list.New()}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		entry    *diskEntry
+		modified time.Time
+	}
+	var existing []found
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "tmp-") {
+			// Left over by a write interrupted by a crash.
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || !info.Mode().IsRegular() || len(file.Name()) != sha256.Size*2 {
+			continue
+		}
+		expires, err := readDiskExpiry(filepath.Join(dir, file.Name()))
+		if err != nil || (!expires.IsZero() && !clock.Now().Before(expires)) {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		existing = append(existing, found{&diskEntry{name: file.Name(), size: info.Size(), expires: expires}, info.ModTime()})
+	}
+	// The most recently written files are taken as the most recently used.
+	slices.SortFunc(existing, func(a, b found) int { return a.modified.Compare(b.modified) })
+	for _, f := range existing {
+		c.entries[f.entry.name] = c.lru.PushFront(f.entry)
+		c.size += f.entry.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func readDiskExpiry(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	var header [diskEntryHeader]byte
+	if _, err := f.Read(header[:]); err != nil {
+		return time.Time{}, err
+	}
+	return diskExpiry(header[:]), nil
+}
+
+func diskExpiry(header []byte) time.Time {
+	if nanos := int64(binary.BigEndian.Uint64(header)); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+// diskFileName names the file of key, which may hold any character.
+func diskFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the value of key, or nil when it is missing or expired.
+func (c *diskCache) get(key string) []byte {
+	name := diskFileName(key)
+	c.mu.Lock()
+	elem, ok := c.entries[name]
+	if ok {
+		if expires := elem.Value.(*diskEntry).expires; !expires.IsZero() && !c.clock.Now().Before(expires) {
+			c.remove(elem)
+			ok = false
+		} else {
+			c.lru.MoveToFront(elem)
+		}
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil || len(data) < diskEntryHeader {
+		// Evicted since it was looked up.
+		return nil
+	}
+	diskCacheHitsTotal.Inc()
+	return data[diskEntryHeader:]
+}
+
+// set stores value under key for ttl, with 0 for no expiry, evicting the
+// least recently used entries beyond maxBytes.
+func (c *diskCache) set(key string, value []byte, ttl time.Duration) error {
+	if int64(len(value)+diskEntryHeader) > c.maxBytes {
+		return errors.New("entry larger than the disk cache")
+	}
+	name := diskFileName(key)
+	entry := &diskEntry{name: name, size: int64(len(value) + diskEntryHeader)}
+	data := make([]byte, diskEntryHeader, entry.size)
+	if ttl > 0 {
+		entry.expires = c.clock.Now().Add(ttl)
+		binary.BigEndian.PutUint64(data, uint64(entry.expires.UnixNano()))
+	}
+	data = append(data, value...)
+
+	// Written aside and renamed, so that readers never see a partial file.
+	tmp, err := os.CreateTemp(c.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if elem, ok := c.entries[name]; ok {
+		c.size -= elem.Value.(*diskEntry).size
+		c.lru.Remove(elem)
+	}
+	c.entries[name] = c.lru.PushFront(entry)
+	c.size += entry.size
+	c.evict()
+	return nil
+}
+
+// delete removes key, reporting whether it was stored.
+func (c *diskCache) delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[diskFileName(key)]
+	if ok {
+		c.remove(elem)
+	}
+	return ok
+}
+
+// evict removes the least recently used entries until the cache fits in
+// maxBytes. c.mu must be held.
+func (c *diskCache) evict() {
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+		diskCacheEvictionsTotal.Inc()
+	}
+	diskCacheBytes.Set(float64(c.size))
+}
+
+// remove deletes the entry of elem and its file. c.mu must be held.
+func (c *diskCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*diskEntry)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+	os.Remove(filepath.Join(c.dir, entry.name))
+	diskCacheBytes.Set(float64(c.size))
+}
+
+// spilloverStore keeps the entries larger than Config.CacheMaxEntryBytes out
+// of Redis. With a disk cache, they are stored there instead; without one,
+// they are not cached.
+type spilloverStore struct {
+	current  CacheStore
+	disk     *diskCache
+	maxBytes int
+}
+
+func newSpilloverStore(current CacheStore, config Config, clock Clock, logger *Logger) *spilloverStore {
+	s := &spilloverStore{current: current, maxBytes: config.CacheMaxEntryBytes}
+	if config.DiskCacheDir != "" {
+		disk, err := openDiskCache(config.DiskCacheDir, int64(config.DiskCacheMaxMB)<<20, clock)
+		if err != nil {
+			logger.Log(LogError, "Disk cache disabled, entries above CACHE_MAX_ENTRY_BYTES are not cached: %v", err)
+		} else {
+			s.disk = disk
+		}
+	}
+	return s
+}
+
+func (s *spilloverStore) Get(ctx context.Context, keys ...string) ([][]byte, error) {
+	values, err := s.current.Get(ctx, keys...)
+	if err != nil || s.disk == nil {
+		return values, err
+	}
+	for i, v := range values {
+		if v == nil {
+			values[i] = s.disk.get(keys[i])
+		}
+	}
+	return values, nil
+}
+
+func (s *spilloverStore) lookup(ctx context.Context, keys []string, opts lookupOptions) ([]entryLookup, error) {
+	entries, err := lookupEntries(ctx, s.current, keys, opts)
+	if err != nil || s.disk == nil {
+		return entries, err
+	}
+	for i, e := range entries {
+		if e.value == nil {
+			entries[i].value = s.disk.get(keys[i])
+		}
+	}
+	return entries, nil
+}
+
+func (s *spilloverStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if len(value) <= s.maxBytes {
+		if s.disk != nil {
+			s.disk.delete(key)
+		}
+		return s.current.Set(ctx, key, value, ttl)
+	}
+	// A smaller previous version must not outlive the new one.
+	if _, err := s.current.Delete(ctx, key); err != nil {
+		return err
+	}
+	if s.disk == nil {
+		oversizedEntriesTotal.WithLabelValues("skipped").Inc()
+		return nil
+	}
+	if err := s.disk.set(key, value, ttl); err != nil {
+		oversizedEntriesTotal.WithLabelValues("error").Inc()
+		return err
+	}
+	oversizedEntriesTotal.WithLabelValues("spilled").Inc()
+	return nil
+}
+
+func (s *spilloverStore) Swap(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	if len(value) <= s.maxBytes {
+		previous, err := s.current.Swap(ctx, key, value, ttl)
+		if err == nil && s.disk != nil {
+			if spilled := s.disk.get(key); spilled != nil {
+				previous = spilled
+				s.disk.delete(key)
+			}
+		}
+		return previous, err
+	}
+	previous, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return previous[0], s.Set(ctx, key, value, ttl)
+}
+
+func (s *spilloverStore) Delete(ctx context.Context, keys ...string) (int64, error) {
+	n, err := s.current.Delete(ctx, keys...)
+	if err != nil || s.disk == nil {
+		return n, err
+	}
+	for _, key := range keys {
+		if s.disk.delete(key) {
+			n++
+		}
+	}
+	return n, nil
+}
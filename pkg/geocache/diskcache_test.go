@@ -0,0 +1,104 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	clock := NewFrozenClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	entry := bytes.Repeat([]byte("x"), 100-diskEntryHeader)
+	c, err := openDiskCache(dir, 300, clock)
+	if err != nil {
+		t.Fatalf("openDiskCache failed: %v", err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.set(key, entry, time.Hour); err != nil {
+			t.Fatalf("set(%s) failed: %v", key, err)
+		}
+		clock.Advance(time.Second)
+	}
+	// a is used, so b is the least recently used once d is added.
+	if c.get("a") == nil {
+		t.Fatal("Expected a to be cached")
+	}
+	if err := c.set("d", entry, 0); err != nil {
+		t.Fatalf("set(d) failed: %v", err)
+	}
+	if c.get("b") != nil {
+		t.Error("Expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if got := c.get(key); !bytes.Equal(got, entry) {
+			t.Errorf("Expected %s to be cached, got %d bytes", key, len(got))
+		}
+	}
+	if err := c.set("big", bytes.Repeat([]byte("x"), 400), time.Hour); err == nil {
+		t.Error("Expected an entry larger than the cache to be refused")
+	}
+
+	// Entries survive a restart, except the expired ones.
+	clock.Advance(2 * time.Hour)
+	reopened, err := openDiskCache(dir, 300, clock)
+	if err != nil {
+		t.Fatalf("openDiskCache failed: %v", err)
+	}
+	if reopened.get("a") != nil || reopened.get("c") != nil {
+		t.Error("Expected expired entries to be dropped")
+	}
+	if got := reopened.get("d"); !bytes.Equal(got, entry) {
+		t.Errorf("Expected d, without expiry, to survive a restart, got %d bytes", len(got))
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected 1 file left, got %d", len(files))
+	}
+}
+
+func TestSpilloverStore(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	config := Config{CacheMaxEntryBytes: 10, DiskCacheDir: t.TempDir(), DiskCacheMaxMB: 1}
+	store := newSpilloverStore(server.store, config, systemClock{}, server.logger)
+	ctx := context.Background()
+
+	store.Set(ctx, "test:small", []byte("small"), time.Hour)
+	store.Set(ctx, "test:large", []byte("a large entry"), time.Hour)
+	if !mr.Exists("test:small") || mr.Exists("test:large") {
+		t.Errorf("Expected only the small entry in Redis, got %v", mr.Keys())
+	}
+	values, err := store.Get(ctx, "test:small", "test:large", "test:missing")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if string(values[0]) != "small" || string(values[1]) != "a large entry" || values[2] != nil {
+		t.Errorf("Unexpected values %q", values)
+	}
+
+	// An entry changing size moves between Redis and the disk.
+	previous, err := store.Swap(ctx, "test:large", []byte("now small"), time.Hour)
+	if err != nil || string(previous) != "a large entry" {
+		t.Errorf("Expected Swap to return the spilled entry, got %q (%v)", previous, err)
+	}
+	if store.disk.get("test:large") != nil || !mr.Exists("test:large") {
+		t.Error("Expected the entry to move back to Redis")
+	}
+
+	store.Set(ctx, "test:small", []byte("no longer small"), time.Hour)
+	if n, err := store.Delete(ctx, "test:small", "test:large"); err != nil || n != 2 {
+		t.Errorf("Expected 2 entries deleted, got %d (%v)", n, err)
+	}
+	if values, _ := store.Get(ctx, "test:small", "test:large"); values[0] != nil || values[1] != nil {
+		t.Errorf("Expected deleted entries to be gone, got %q", values)
+	}
+
+	skipping := newSpilloverStore(server.store, Config{CacheMaxEntryBytes: 10}, systemClock{}, server.logger)
+	skipping.Set(ctx, "test:skipped", []byte("a large entry"), time.Hour)
+	if values, _ := skipping.Get(ctx, "test:skipped"); values[0] != nil {
+		t.Errorf("Expected a large entry not to be cached without a disk cache, got %q", values[0])
+	}
+}
@@ -0,0 +1,291 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultMinSimilarity = 0.5
+
+// geocodeResponse is the subset of a Geocoding API response the cache inspects.
+type geocodeResponse struct {
+	Status  string `json:"status"`
+	Results []struct {
+		PlaceID          string `json:"place_id"`
+		FormattedAddress string `json:"formatted_address"`
+	} `json:"results"`
+}
+
+// duplicateCluster groups the distinct address strings whose cached geocode
+// resolved to the same place.
+type duplicateCluster struct {
+	PlaceID          string   `json:"place_id"`
+	FormattedAddress string   `json:"formatted_address"`
+	Addresses        []string `json:"addresses"`
+	NormalizedForms  int      `json:"normalized_forms"`
+	Similarity       float64  `json:"similarity"`
+}
+
+type duplicateReport struct {
+	Status                string             `json:"status"`
+	StartedAt             time.Time          `json:"started_at"`
+	FinishedAt            *time.Time         `json:"finished_at,omitempty"`
+	Error                 string             `json:"error,omitempty"`
+	MinSimilarity         float64            `json:"min_similarity"`
+	EntriesScanned        int                `json:"entries_scanned"`
+	ExpiredRemoved        int                `json:"expired_removed"`
+	DuplicateEntries      int                `json:"duplicate_entries"`
+	MergedByNormalization int                `json:"merged_by_normalization"`
+	Clusters              []duplicateCluster `json:"clusters"`
+}
+
+// duplicateReporter holds the state of the most recent duplicate analysis.
+type duplicateReporter struct {
+	mu     sync.Mutex
+	report *duplicateReport
+}
+
+func (s *Server) geocodeTrackingKey() string {
+	return s.redisKey("geocode:queries")
+}
+
+// geocodeTrackingAgeKey ranks the tracked cache keys by when they were last
+// filled, so the oldest can be dropped once DuplicateTrackingMax is reached.
+func (s *Server) geocodeTrackingAgeKey() string {
+	return s.redisKey("geocode:queries:filled")
+}
+
+// redisKey namespaces an auxiliary key under the configured Redis prefix.
+func (s *Server) redisKey(name string) string {
+	if s.config.RedisPrefix != "" {
+		return s.config.RedisPrefix + ":" + name
+	}
+	return name
+}
+
+// trackGeocodeScript records the address ARGV[2] of the cache key ARGV[1] in
+// the tracking hash KEYS[1] and ranks the key by its fill time ARGV[3] in
+// KEYS[2]. Past ARGV[4] tracked keys, the least recently filled are dropped
+// from both.
+var trackGeocodeScript = redis.NewScript(`
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+local max = tonumber(ARGV[4])
+if max > 0 then
+	local over = redis.call('ZCARD', KEYS[2]) - max
+	if over > 0 then
+		local oldest = redis.call('ZRANGE', KEYS[2], 0, over - 1)
+		redis.call('HDEL', KEYS[1], unpack(oldest))
+		redis.call('ZREMRANGEBYRANK', KEYS[2], 0, over - 1)
+	end
+end
+`)
+
+// trackGeocodeQuery remembers the raw address behind a geocode cache entry so
+// the duplicate report can later relate addresses to places. At most
+// DuplicateTrackingMax entries are tracked; the least recently filled make
+// room for new ones.
+func (s *Server) trackGeocodeQuery(r *http.Request, cacheKey string) {
+	if s.redis == nil || !s.config.DuplicateTracking || r.URL.Path != geocodePath {
+		return
+	}
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		return
+	}
+	keys := []string{s.geocodeTrackingKey(), s.geocodeTrackingAgeKey()}
+	err := trackGeocodeScript.Run(context.Background(), s.redis, keys, cacheKey, address, s.clock.Now().UnixMilli(), s.config.DuplicateTrackingMax).Err()
+	if err != nil {
+		s.logger.Log(LogWarning, "Failed to track geocode query: %v", err)
+	}
+}
+
+func (s *Server) handleStartDuplicateReport(w http.ResponseWriter, r *http.Request) {
+	minSimilarity := defaultMinSimilarity
+	if v := r.URL.Query().Get("min_similarity"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "min_similarity must be between 0 and 1"})
+			return
+		}
+		minSimilarity = f
+	}
+
+	s.duplicates.mu.Lock()
+	if s.duplicates.report != nil && s.duplicates.report.Status == "running" {
+		s.duplicates.mu.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "a duplicate report is already running"})
+		return
+	}
+	report := &duplicateReport{Status: "running", StartedAt: s.clock.Now(), MinSimilarity: minSimilarity}
+	s.duplicates.report = report
+	s.duplicates.mu.Unlock()
+
+	go s.runDuplicateReport(minSimilarity)
+
+	writeJSON(w, http.StatusAccepted, report)
+}
+
+func (s *Server) handleGetDuplicateReport(w http.ResponseWriter, r *http.Request) {
+	s.duplicates.mu.Lock()
+	defer s.duplicates.mu.Unlock()
+	if s.duplicates.report == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no duplicate report has been run"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.duplicates.report)
+}
+
+func (s *Server) runDuplicateReport(minSimilarity float64) {
+	result, err := s.buildDuplicateReport(context.Background(), minSimilarity)
+	finished := s.clock.Now()
+
+	s.duplicates.mu.Lock()
+	defer s.duplicates.mu.Unlock()
+	result.StartedAt = s.duplicates.report.StartedAt
+	result.FinishedAt = &finished
+	result.Status = "done"
+	if err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+		s.logger.Log(LogError, "Duplicate report failed: %v", err)
+	}
+	s.duplicates.report = result
+}
+
+// buildDuplicateReport scans the tracked geocode queries, groups them by the
+// place_id of their cached response and reports groups that contain more than
+// one address. Tracking entries whose cache entry has expired are removed.
+func (s *Server) buildDuplicateReport(ctx context.Context, minSimilarity float64) (*duplicateReport, error) {
+	report := &duplicateReport{MinSimilarity: minSimilarity, Clusters: []duplicateCluster{}}
+
+	normalizer := s.normalizer
+	if normalizer == nil {
+		normalizer = newAddressNormalizer(s.config.NormalizeStripDiacritics, nil)
+	}
+
+	clusters := make(map[string]*duplicateCluster)
+	trackingKey := s.geocodeTrackingKey()
+	var cursor uint64
+	for {
+		fields, next, err := s.redis.HScan(ctx, trackingKey, cursor, "", 500).Result()
+		if err != nil {
+			return report, err
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			cacheKey, address := fields[i], fields[i+1]
+			report.EntriesScanned++
+
+			values, err := s.store.Get(ctx, cacheKey)
+			if err != nil {
+				return report, err
+			}
+			body := plainBody(s.unwrapEntry(ctx, geocodePath, cacheKey, values[0]))
+			if body == nil {
+				s.redis.HDel(ctx, trackingKey, cacheKey)
+				s.redis.ZRem(ctx, s.geocodeTrackingAgeKey(), cacheKey)
+				report.ExpiredRemoved++
+				continue
+			}
+
+			var geocode geocodeResponse
+			if json.Unmarshal(body, &geocode) != nil || geocode.Status != "OK" || len(geocode.Results) == 0 {
+				continue
+			}
+			placeID := geocode.Results[0].PlaceID
+			c, ok := clusters[placeID]
+			if !ok {
+				c = &duplicateCluster{PlaceID: placeID, FormattedAddress: geocode.Results[0].FormattedAddress}
+				clusters[placeID] = c
+			}
+			c.Addresses = append(c.Addresses, address)
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	for _, c := range clusters {
+		if len(c.Addresses) < 2 {
+			continue
+		}
+		sort.Strings(c.Addresses)
+		forms := make(map[string]bool)
+		normalized := make([]string, 0, len(c.Addresses))
+		for _, a := range c.Addresses {
+			n := normalizer.Normalize(a)
+			forms[n] = true
+			normalized = append(normalized, n)
+		}
+		c.NormalizedForms = len(forms)
+		c.Similarity = minPairwiseSimilarity(normalized)
+		if c.Similarity < minSimilarity {
+			continue
+		}
+		report.DuplicateEntries += len(c.Addresses) - 1
+		report.MergedByNormalization += len(c.Addresses) - c.NormalizedForms
+		report.Clusters = append(report.Clusters, *c)
+	}
+
+	sort.Slice(report.Clusters, func(i, j int) bool {
+		if len(report.Clusters[i].Addresses) != len(report.Clusters[j].Addresses) {
+			return len(report.Clusters[i].Addresses) > len(report.Clusters[j].Addresses)
+		}
+		return report.Clusters[i].PlaceID < report.Clusters[j].PlaceID
+	})
+	return report, nil
+}
+
+// minPairwiseSimilarity returns the lowest similarity between any two strings.
+func minPairwiseSimilarity(values []string) float64 {
+	lowest := 1.0
+	for i := 0; i < len(values); i++ {
+		for j := i + 1; j < len(values); j++ {
+			if sim := similarity(values[i], values[j]); sim < lowest {
+				lowest = sim
+			}
+		}
+	}
+	return lowest
+}
+
+// similarity is 1 minus the Levenshtein distance scaled by the longer length.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
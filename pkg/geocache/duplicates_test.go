@@ -0,0 +1,172 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBuildDuplicateReport(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+
+	trackingKey := server.geocodeTrackingKey()
+	entries := []struct {
+		cacheKey string
+		address  string
+		body     string
+	}{
+		{"test:a", "123 Main St.", `{"status":"OK","results":[{"place_id":"P1","formatted_address":"123 Main Street"}]}`},
+		{"test:b", "123 main street", `{"status":"OK","results":[{"place_id":"P1","formatted_address":"123 Main Street"}]}`},
+		{"test:c", "123 Main Stret", `{"status":"OK","results":[{"place_id":"P1","formatted_address":"123 Main Street"}]}`},
+		{"test:d", "Empire State Building", `{"status":"OK","results":[{"place_id":"P2","formatted_address":"20 W 34th St"}]}`},
+		{"test:e", "20 W 34th St", `{"status":"OK","results":[{"place_id":"P2","formatted_address":"20 W 34th St"}]}`},
+		{"test:f", "nowhere", `{"status":"ZERO_RESULTS","results":[]}`},
+	}
+	for _, e := range entries {
+		mr.Set(e.cacheKey, e.body)
+		mr.HSet(trackingKey, e.cacheKey, e.address)
+	}
+	// Tracked entry whose cache entry has expired
+	mr.HSet(trackingKey, "test:expired", "1 Gone Rd")
+
+	report, err := server.buildDuplicateReport(context.Background(), 0.5)
+	if err != nil {
+		t.Fatalf("buildDuplicateReport() error = %v", err)
+	}
+
+	if report.EntriesScanned != 7 {
+		t.Errorf("EntriesScanned = %d, want 7", report.EntriesScanned)
+	}
+	if report.ExpiredRemoved != 1 {
+		t.Errorf("ExpiredRemoved = %d, want 1", report.ExpiredRemoved)
+	}
+	if mr.HGet(trackingKey, "test:expired") != "" {
+		t.Error("Expected expired tracking entry to be removed")
+	}
+
+	// P2's addresses are too dissimilar to be considered near-duplicates
+	if len(report.Clusters) != 1 {
+		t.Fatalf("Expected 1 cluster, got %d: %+v", len(report.Clusters), report.Clusters)
+	}
+	c := report.Clusters[0]
+	if c.PlaceID != "P1" || len(c.Addresses) != 3 {
+		t.Errorf("Unexpected cluster %+v", c)
+	}
+	if c.NormalizedForms != 2 {
+		t.Errorf("NormalizedForms = %d, want 2", c.NormalizedForms)
+	}
+	if report.DuplicateEntries != 2 {
+		t.Errorf("DuplicateEntries = %d, want 2", report.DuplicateEntries)
+	}
+	if report.MergedByNormalization != 1 {
+		t.Errorf("MergedByNormalization = %d, want 1", report.MergedByNormalization)
+	}
+}
+
+func TestDuplicateReportEndpoints(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	handler := server.adminHandler()
+
+	mr.Set("test:a", `{"status":"OK","results":[{"place_id":"P1"}]}`)
+	mr.Set("test:b", `{"status":"OK","results":[{"place_id":"P1"}]}`)
+	mr.HSet(server.geocodeTrackingKey(), "test:a", "1 Main St", "test:b", "1 main street")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/reports/duplicates", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d before any report, got %d", http.StatusNotFound, w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/reports/duplicates?min_similarity=2", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid min_similarity, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/reports/duplicates", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+
+	var report duplicateReport
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		req = httptest.NewRequest(http.MethodGet, "/admin/reports/duplicates", nil)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Failed to decode report: %v", err)
+		}
+		if report.Status != "running" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if report.Status != "done" {
+		t.Fatalf("Expected report status done, got %q (%s)", report.Status, report.Error)
+	}
+	if len(report.Clusters) != 1 || report.MergedByNormalization != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+}
+
+func TestTrackGeocodeQuery_Bounded(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	clock := NewFrozenClock(time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC))
+	server.clock = clock
+	server.config.DuplicateTracking = true
+	server.config.DuplicateTrackingMax = 2
+
+	for _, address := range []string{"1 Main St", "2 Main St", "3 Main St"} {
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?address="+url.QueryEscape(address), nil)
+		server.trackGeocodeQuery(req, "test:"+address)
+		clock.Advance(time.Second)
+	}
+	// Filling the first key again makes the second the least recently filled.
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=1+Main+St", nil)
+	server.trackGeocodeQuery(req, "test:1 Main St")
+
+	tracked, err := mr.HKeys(server.geocodeTrackingKey())
+	if err != nil {
+		t.Fatalf("HKeys failed: %v", err)
+	}
+	sort.Strings(tracked)
+	if len(tracked) != 2 || tracked[0] != "test:1 Main St" || tracked[1] != "test:3 Main St" {
+		t.Errorf("Expected the two most recently filled keys to be tracked, got %q", tracked)
+	}
+	if ranked, _ := mr.ZMembers(server.geocodeTrackingAgeKey()); len(ranked) != 2 {
+		t.Errorf("Expected the fill ranking to be trimmed with the hash, got %q", ranked)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"", "", 1},
+		{"abc", "abc", 1},
+		{"abc", "abd", 1 - 1.0/3.0},
+		{"abc", "", 0},
+	}
+	for _, tt := range tests {
+		if got := similarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("similarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package geocache
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// syncPageSize is the number of keys scanned per /admin/sync page by
+	// default, and syncMaxPageSize the most a caller may ask for.
+	syncPageSize    = 500
+	syncMaxPageSize = 5000
+	// edgeSyncRetryDelay is how long an edge waits before resuming a sync
+	// interrupted by an error, such as a lost WAN link.
+	edgeSyncRetryDelay = time.Minute
+)
+
+// syncEntry is a cache entry sent from the central cache to an edge.
+type syncEntry struct {
+	// Key is the cache key without the Redis prefix, which may differ
+	// between the central cache and the edges.
+	Key string `json:"key"`
+	// TTLSeconds is the remaining lifetime of the entry, 0 for none.
+	TTLSeconds int64  `json:"ttl_seconds"`
+	Body       []byte `json:"body"`
+	// URI is the request the entry answers, when stored with
+	// CACHE_STORE_URI.
+	URI string `json:"uri,omitempty"`
+}
+
+// syncPage is a page of /admin/sync. Cursor is passed to get the next page,
+// and is 0 on the last one.
+type syncPage struct {
+	Cursor  uint64      `json:"cursor"`
+	Entries []syncEntry `json:"entries"`
+}
+
+// syncBounds is a "south,west|north,east" area. West is greater than east
+// for an area crossing the antimeridian.
+type syncBounds struct {
+	south, west, north, east float64
+}
+
+func parseSyncBounds(raw string) (syncBounds, error) {
+	sw, ne, ok := strings.Cut(raw, "|")
+	var coords []float64
+	for _, pair := range []string{sw, ne} {
+		for _, c := range strings.SplitN(pair, ",", 2) {
+			f, err := strconv.ParseFloat(strings.TrimSpace(c), 64)
+			if err != nil {
+				ok = false
+			}
+			coords = append(coords, f)
+		}
+	}
+	if !ok || len(coords) != 4 || coords[0] > coords[2] {
+		return syncBounds{}, fmt.Errorf("invalid bounds %q, want south,west|north,east", raw)
+	}
+	return syncBounds{south: coords[0], west: coords[1], north: coords[2], east: coords[3]}, nil
+}
+
+func (b syncBounds) contains(p latLng) bool {
+	if p.Lat < b.south || p.Lat > b.north {
+		return false
+	}
+	if b.west <= b.east {
+		return p.Lng >= b.west && p.Lng <= b.east
+	}
+	return p.Lng >= b.west || p.Lng <= b.east
+}
+
+// entryLocations returns the locations of the results of a response body:
+// those of geocoding and place searches, and of place details.
+func entryLocations(body []byte) []latLng {
+	type geometry struct {
+		Geometry struct {
+			Location *latLng `json:"location"`
+		} `json:"geometry"`
+	}
+	var resp struct {
+		Results []geometry `json:"results"`
+		Result  *geometry  `json:"result"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return nil
+	}
+	if resp.Result != nil {
+		resp.Results = append(resp.Results, *resp.Result)
+	}
+	var locations []latLng
+	for _, r := range resp.Results {
+		if r.Geometry.Location != nil {
+			locations = append(locations, *r.Geometry.Location)
+		}
+	}
+	return locations
+}
+
+// handleSync serves a page of cache entries to the edges. The entries can be
+// restricted to the keys starting with the hex prefix, and to the responses
+// with a result within bounds, such as the service area of an edge.
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	cursor, _ := strconv.ParseUint(q.Get("cursor"), 10, 64)
+	count := syncPageSize
+	if n, err := strconv.Atoi(q.Get("count")); err == nil && n > 0 {
+		count = min(n, syncMaxPageSize)
+	}
+	prefix := strings.ToLower(q.Get("prefix"))
+	if _, err := hex.DecodeString(prefix + strings.Repeat("0", len(prefix)%2)); err != nil || len(prefix) > 64 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "prefix must be hexadecimal"})
+		return
+	}
+	var bounds *syncBounds
+	if raw := q.Get("bounds"); raw != "" {
+		b, err := parseSyncBounds(raw)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		bounds = &b
+	}
+
+	ctx := r.Context()
+	keys, next, err := s.redis.Scan(ctx, cursor, s.redisKey(prefix)+"*", int64(count)).Result()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	page := syncPage{Cursor: next, Entries: []syncEntry{}}
+	var names, entryKeys []string
+	for _, key := range keys {
+		if name := strings.TrimPrefix(key, s.redisKey("")); isCacheEntryName(name) {
+			names = append(names, name)
+			entryKeys = append(entryKeys, key)
+		}
+	}
+	if len(entryKeys) == 0 {
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+	values, err := s.store.Get(ctx, entryKeys...)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	ttls := make([]*redis.DurationCmd, len(entryKeys))
+	pipe := s.redis.Pipeline()
+	for i, key := range entryKeys {
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	pipe.Exec(ctx)
+
+	for i, raw := range values {
+		header, body, err := decodeEntryHeader(raw)
+		if raw == nil || err != nil {
+			continue
+		}
+		if bounds != nil && !slices.ContainsFunc(entryLocations(plainBody(body)), bounds.contains) {
+			continue
+		}
+		// PTTL reports -1 for keys without an expiry and -2 for keys that
+		// expired since they were read.
+		ttl, err := ttls[i].Result()
+		if err != nil || ttl == -2 {
+			continue
+		}
+		entry := syncEntry{Key: names[i], Body: body, URI: header.URI}
+		if ttl > 0 {
+			entry.TTLSeconds = max(int64(ttl/time.Second), 1)
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// edgeSyncer pulls the entries selected by EDGE_SYNC_BOUNDS and
+// EDGE_SYNC_PREFIX from the /admin/sync endpoint of the central cache at
+// EDGE_SYNC_URL into the local cache.
+type edgeSyncer struct {
+	s      *Server
+	client *http.Client
+	logger *Logger
+	// cursor is where the current pass resumes after an error.
+	cursor uint64
+}
+
+// fetchPage requests the page of the central cache at cursor.
+func (e *edgeSyncer) fetchPage(ctx context.Context, cursor uint64) (syncPage, error) {
+	config := e.s.config
+	u, err := url.Parse(config.EdgeSyncURL)
+	if err != nil {
+		return syncPage{}, err
+	}
+	q := u.Query()
+	q.Set("cursor", strconv.FormatUint(cursor, 10))
+	if config.EdgeSyncBounds != "" {
+		q.Set("bounds", config.EdgeSyncBounds)
+	}
+	if config.EdgeSyncPrefix != "" {
+		q.Set("prefix", config.EdgeSyncPrefix)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return syncPage{}, err
+	}
+	if config.EdgeSyncToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.EdgeSyncToken)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return syncPage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return syncPage{}, fmt.Errorf("%s returned %s", u.Redacted(), resp.Status)
+	}
+	var page syncPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return syncPage{}, err
+	}
+	return page, nil
+}
+
+// syncPass copies the selected entries page by page, from e.cursor to the
+// end of the central keyspace. It returns the number of entries copied.
+func (e *edgeSyncer) syncPass(ctx context.Context) (int, error) {
+	copied := 0
+	for {
+		e.s.health.wait("edge_sync", healthRedis)
+		page, err := e.fetchPage(ctx, e.cursor)
+		if err != nil {
+			return copied, err
+		}
+		for _, entry := range page.Entries {
+			if !isCacheEntryName(entry.Key) {
+				continue
+			}
+			ttl := time.Duration(entry.TTLSeconds) * time.Second
+			if err := e.s.store.Set(ctx, e.s.redisKey(entry.Key), e.s.wrapEntryURI(entry.Body, entry.URI), ttl); err != nil {
+				return copied, err
+			}
+			copied++
+			edgeSyncEntriesTotal.Inc()
+		}
+		e.cursor = page.Cursor
+		if e.cursor == 0 {
+			return copied, nil
+		}
+	}
+}
+
+// runEdgeSync syncs from the central cache on startup and then every
+// EDGE_SYNC_INTERVAL_MINUTES. A pass interrupted by an error resumes where it
+// stopped after edgeSyncRetryDelay, so that an edge with an intermittent
+// link catches up whenever it is connected.
+func (s *Server) runEdgeSync() {
+	e := &edgeSyncer{s: s, client: &http.Client{Timeout: time.Minute}, logger: s.logger.Component("edgesync")}
+	for {
+		start := time.Now()
+		copied, err := e.syncPass(context.Background())
+		delay := s.config.EdgeSyncInterval
+		if err != nil {
+			edgeSyncRunsTotal.WithLabelValues("error").Inc()
+			e.logger.Log(LogWarning, "Edge sync interrupted after %d entries, resuming in %v: %v", copied, edgeSyncRetryDelay, err)
+			delay = edgeSyncRetryDelay
+		} else {
+			edgeSyncRunsTotal.WithLabelValues("complete").Inc()
+			edgeSyncLastComplete.Set(float64(s.clock.Now().Unix()))
+			e.logger.Log(LogInfo, "Edge sync copied %d entries in %v", copied, time.Since(start).Round(time.Second))
+		}
+		<-s.clock.After(delay)
+	}
+}
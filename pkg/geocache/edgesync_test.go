@@ -0,0 +1,132 @@
+package geocache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEdgeSync(t *testing.T) {
+	central, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	ctx := context.Background()
+	entries := map[string]string{
+		"denver":  `{"results":[{"geometry":{"location":{"lat":39.74,"lng":-104.99}}}],"status":"OK"}`,
+		"houston": `{"results":[{"geometry":{"location":{"lat":29.76,"lng":-95.37}}}],"status":"OK"}`,
+		"details": `{"result":{"geometry":{"location":{"lat":39.5,"lng":-105.2}}},"status":"OK"}`,
+	}
+	names := make(map[string]string)
+	for city, body := range entries {
+		names[city] = hashCacheKey(city, "")
+		if err := central.store.Set(ctx, central.redisKey(names[city]), []byte(body), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mr.Set(central.redisKey("maintenance"), "not an entry")
+
+	var auth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		r.URL.RawQuery += "&count=1"
+		central.handleSync(w, r)
+	}))
+	defer upstream.Close()
+
+	edge, edgeRedis, edgeCleanup := setupTestServer(t, nil)
+	defer edgeCleanup()
+	edge.config.EdgeSyncURL = upstream.URL + "/admin/sync"
+	edge.config.EdgeSyncToken = "secret"
+	edge.config.EdgeSyncBounds = "39,-106|40.5,-104"
+	e := &edgeSyncer{s: edge, client: upstream.Client(), logger: edge.logger}
+	copied, err := e.syncPass(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 2 || auth != "Bearer secret" {
+		t.Errorf("copied %d entries with %q, want 2 with the bearer token", copied, auth)
+	}
+	for city, want := range map[string]bool{"denver": true, "details": true, "houston": false} {
+		got, err := edgeRedis.Get(edge.redisKey(names[city]))
+		if want && got != entries[city] {
+			t.Errorf("%s = %q, %v, want the central entry", city, got, err)
+		} else if !want && err == nil {
+			t.Errorf("%s outside the bounds was copied", city)
+		}
+	}
+	if ttl := edgeRedis.TTL(edge.redisKey(names["denver"])); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL = %v, want the remaining TTL of the central entry", ttl)
+	}
+}
+
+func TestEdgeSyncResumesAfterError(t *testing.T) {
+	central, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	ctx := context.Background()
+	for _, s := range []string{"a", "b", "c"} {
+		central.store.Set(ctx, central.redisKey(hashCacheKey(s, "")), []byte(`{"status":"OK"}`), 0)
+	}
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 2 {
+			http.Error(w, "link down", http.StatusBadGateway)
+			return
+		}
+		r.URL.RawQuery += "&count=1"
+		central.handleSync(w, r)
+	}))
+	defer upstream.Close()
+
+	edge, edgeRedis, edgeCleanup := setupTestServer(t, nil)
+	defer edgeCleanup()
+	edge.config.EdgeSyncURL = upstream.URL
+	e := &edgeSyncer{s: edge, client: upstream.Client(), logger: edge.logger}
+	first, err := e.syncPass(ctx)
+	if err == nil || e.cursor == 0 {
+		t.Fatalf("syncPass() = %v, cursor %d, want an error mid-pass", err, e.cursor)
+	}
+	second, err := e.syncPass(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first+second != 3 || len(edgeRedis.Keys()) != 3 {
+		t.Errorf("copied %d then %d entries, %d keys, want 3 in total", first, second, len(edgeRedis.Keys()))
+	}
+	if ttl := edgeRedis.TTL(edge.redisKey(hashCacheKey("a", ""))); ttl != 0 {
+		t.Errorf("TTL = %v, want none as on the central cache", ttl)
+	}
+}
+
+func TestSyncRejectsInvalidParameters(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	for _, query := range []string{"prefix=xyz", "bounds=40,-104|39,-106", "bounds=39,-106", "bounds=a,b|c,d"} {
+		w := httptest.NewRecorder()
+		server.handleSync(w, httptest.NewRequest(http.MethodGet, "/admin/sync?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestSyncBoundsAcrossAntimeridian(t *testing.T) {
+	b, err := parseSyncBounds("-20,170|-10,-170")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		p    latLng
+		want bool
+	}{
+		{latLng{-15, 175}, true},
+		{latLng{-15, -175}, true},
+		{latLng{-15, 0}, false},
+		{latLng{0, 175}, false},
+	} {
+		if got := b.contains(tc.p); got != tc.want {
+			t.Errorf("contains(%v) = %v, want %v", tc.p, got, tc.want)
+		}
+	}
+}
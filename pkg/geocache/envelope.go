@@ -0,0 +1,135 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+)
+
+// entryEnvelopePrefix starts cache entries stored in an envelope: the prefix,
+// a JSON header line describing the body, then the body. Entries without it
+// are bare bodies written before CACHE_CHECKSUMS was enabled, and are served
+// unverified.
+const entryEnvelopePrefix = "\x00env1"
+
+// entryHeader is the metadata stored in front of an enveloped body.
+type entryHeader struct {
+	CRC32C string `json:"crc32c"`
+	// StoredAt is when the body was requested upstream, in Unix
+	// milliseconds, for entries stored with CONDITIONAL_FILLS.
+	StoredAt int64 `json:"stored_at,omitempty"`
+	// Kind is entryNegative or entryPartial for bodies that any fill
+	// replaces, for entries stored with CONDITIONAL_FILLS.
+	Kind string `json:"kind,omitempty"`
+	// URI is the request the entry answers, for entries stored with
+	// CACHE_STORE_URI, from which `geocache rekey` recomputes its key.
+	URI string `json:"uri,omitempty"`
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptEntry is returned for entries whose body no longer matches the
+// checksum of their envelope.
+var errCorruptEntry = errors.New("corrupt cache entry")
+
+func entryChecksum(body []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(body, castagnoli))
+}
+
+// encodeEntry wraps body in an envelope holding its checksum.
+func encodeEntry(body []byte) []byte {
+	return encodeEntryHeader(body, entryHeader{})
+}
+
+// encodeEntryHeader wraps body in an envelope holding header and the checksum
+// of body.
+func encodeEntryHeader(body []byte, h entryHeader) []byte {
+	h.CRC32C = entryChecksum(body)
+	header, _ := json.Marshal(h)
+	b := make([]byte, 0, len(entryEnvelopePrefix)+len(header)+1+len(body))
+	b = append(b, entryEnvelopePrefix...)
+	b = append(b, header...)
+	b = append(b, '\n')
+	return append(b, body...)
+}
+
+// decodeEntry returns the body of a stored entry, verifying its checksum
+// when it has an envelope.
+func decodeEntry(raw []byte) ([]byte, error) {
+	_, body, err := decodeEntryHeader(raw)
+	return body, err
+}
+
+// decodeEntryHeader is decodeEntry, also returning the header of the
+// envelope, or a zero header for a bare body.
+func decodeEntryHeader(raw []byte) (entryHeader, []byte, error) {
+	var header entryHeader
+	if !bytes.HasPrefix(raw, []byte(entryEnvelopePrefix)) {
+		return header, raw, nil
+	}
+	rest := raw[len(entryEnvelopePrefix):]
+	i := bytes.IndexByte(rest, '\n')
+	if i < 0 {
+		return header, nil, fmt.Errorf("%w: unterminated header", errCorruptEntry)
+	}
+	if err := json.Unmarshal(rest[:i], &header); err != nil {
+		return header, nil, fmt.Errorf("%w: invalid header: %v", errCorruptEntry, err)
+	}
+	body := rest[i+1:]
+	if sum := entryChecksum(body); sum != header.CRC32C {
+		return header, nil, fmt.Errorf("%w: checksum %s, want %s", errCorruptEntry, sum, header.CRC32C)
+	}
+	return header, body, nil
+}
+
+// wrapEntry returns the value to store for body.
+func (s *Server) wrapEntry(body []byte) []byte {
+	if !s.config.CacheChecksums {
+		return body
+	}
+	return encodeEntry(body)
+}
+
+// wrapEntryURI returns the value to store for body, the response to the
+// request of uri, which is kept in the envelope with CACHE_STORE_URI.
+func (s *Server) wrapEntryURI(body []byte, uri string) []byte {
+	if !s.config.CacheStoreURI || uri == "" {
+		return s.wrapEntry(body)
+	}
+	return encodeEntryHeader(body, entryHeader{URI: uri})
+}
+
+// entryURI returns the URI to store with the entry answering r: its request
+// URI without the credentials and usage channel, which do not identify the
+// response, and with sorted parameters. It is empty when the key of r also
+// depends on its body, key headers or page token, which the URI leaves out.
+func (s *Server) entryURI(r *http.Request) string {
+	if pageKeyFromContext(r.Context()) != "" || postBodyFromContext(r.Context()) != nil ||
+		keyHeaders(r.Header, s.config.CacheKeyHeaders) != "" {
+		return ""
+	}
+	return requestURIWithoutKey(r.URL)
+}
+
+// unwrapEntry returns the body of the value read from key, an entry of the
+// endpoint at path, or nil when there is none. A corrupt entry is deleted and
+// counted, and reads as a miss.
+func (s *Server) unwrapEntry(ctx context.Context, path, key string, raw []byte) []byte {
+	if raw == nil {
+		return nil
+	}
+	body, err := decodeEntry(raw)
+	if err == nil {
+		return body
+	}
+	corruptEntriesTotal.WithLabelValues(metricsEndpoint(path)).Inc()
+	s.logger.LogContext(ctx, LogWarning, "Deleting cache entry %s: %v", key, err)
+	if _, err := s.store.Delete(context.Background(), key); err != nil {
+		s.logger.LogContext(ctx, LogWarning, "Failed to delete corrupt cache entry %s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package geocache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDecodeEntry(t *testing.T) {
+	body := []byte(`{"results":[],"status":"ZERO_RESULTS"}`)
+	enveloped := encodeEntry(body)
+	flipped := append([]byte(nil), enveloped...)
+	flipped[len(flipped)-3] ^= 0x01
+
+	tests := []struct {
+		name        string
+		raw         []byte
+		want        string
+		wantCorrupt bool
+	}{
+		{name: "enveloped", raw: enveloped, want: string(body)},
+		{name: "legacy bare body", raw: body, want: string(body)},
+		{name: "empty body", raw: encodeEntry(nil), want: ""},
+		{name: "flipped bit", raw: flipped, wantCorrupt: true},
+		{name: "truncated body", raw: enveloped[:len(enveloped)-5], wantCorrupt: true},
+		{name: "truncated header", raw: enveloped[:len(entryEnvelopePrefix)+4], wantCorrupt: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeEntry(tt.raw)
+			if tt.wantCorrupt {
+				if !errors.Is(err, errCorruptEntry) {
+					t.Errorf("Expected a corrupt entry error, got %v", err)
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Errorf("Expected %q, got %q (%v)", tt.want, got, err)
+			}
+		})
+	}
+}
+
+func TestServer_Query_CorruptEntry(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[{"place_id":"p1"}],"status":"OK"}`}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.CacheChecksums = true
+	before := testutil.ToFloat64(corruptEntriesTotal.WithLabelValues("geocode"))
+
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil)
+	server.query(httptest.NewRecorder(), req)
+	cacheKey := server.cacheKey(req)
+	stored, _ := mr.Get(cacheKey)
+	if got, err := decodeEntry([]byte(stored)); err != nil || string(got) != transport.body {
+		t.Fatalf("Expected the body to be stored with its checksum, got %q (%v)", stored, err)
+	}
+
+	// Corrupt the body while keeping the envelope.
+	mr.Set(cacheKey, stored[:len(stored)-2]+"X}")
+	w := httptest.NewRecorder()
+	server.query(w, req)
+
+	if got := w.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("Expected a corrupt entry to be treated as a miss, got X-Cache %s", got)
+	}
+	if w.Body.String() != transport.body {
+		t.Errorf("Expected the upstream body, got %s", w.Body.String())
+	}
+	if len(transport.urls) != 2 {
+		t.Errorf("Expected 2 upstream calls, got %d", len(transport.urls))
+	}
+	if got := testutil.ToFloat64(corruptEntriesTotal.WithLabelValues("geocode")) - before; got != 1 {
+		t.Errorf("Expected 1 corrupt entry to be counted, got %v", got)
+	}
+	if stored, _ := mr.Get(cacheKey); stored == "" {
+		t.Errorf("Expected the entry to be stored again")
+	} else if _, err := decodeEntry([]byte(stored)); err != nil {
+		t.Errorf("Expected the refilled entry to verify, got %v", err)
+	}
+
+	// Bare entries written without checksums are still served.
+	mr.Set(cacheKey, transport.body)
+	w = httptest.NewRecorder()
+	server.query(w, req)
+	if got := w.Header().Get("X-Cache"); got != "HIT" || w.Body.String() != transport.body {
+		t.Errorf("Expected the legacy entry to be served, got X-Cache %s and %s", got, w.Body.String())
+	}
+}
+
+func TestServer_Query_StoreURI(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[],"status":"OK"}`}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.CacheStoreURI = true
+	server.config.CacheKeyHeaders = []string{"X-Goog-FieldMask"}
+	rekey := &rekeyer{config: server.config, normalizer: server.normalizer, keyParams: server.keyParams}
+
+	for _, conditional := range []bool{false, true} {
+		server.config.ConditionalFills = conditional
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?key=secret&client=gme-fleet&signature=c2ln&region=us&channel=web&address=Main+St", nil)
+		server.query(httptest.NewRecorder(), req)
+		cacheKey := server.cacheKey(req)
+		stored, _ := mr.Get(cacheKey)
+		header, body, err := decodeEntryHeader([]byte(stored))
+		if err != nil || string(body) != transport.body {
+			t.Fatalf("Expected the body to be stored in an envelope, got %q (%v)", stored, err)
+		}
+		if want := geocodePath + "?address=Main+St&region=us"; header.URI != want {
+			t.Errorf("conditional fills %v: stored URI %q, want %q", conditional, header.URI, want)
+		}
+		if key, _ := rekey.entryKey(header.URI); key != cacheKey {
+			t.Errorf("conditional fills %v: the stored URI has the key %s, want %s", conditional, key, cacheKey)
+		}
+		mr.Del(cacheKey)
+	}
+
+	// The URI does not tell the key of requests with key headers.
+	server.config.ConditionalFills = false
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Elm+St", nil)
+	req.Header.Set("X-Goog-FieldMask", "results.place_id")
+	server.query(httptest.NewRecorder(), req)
+	stored, _ := mr.Get(server.cacheKey(req))
+	if stored != transport.body {
+		t.Errorf("Expected a bare body without checksums or URI, got %q", stored)
+	}
+}
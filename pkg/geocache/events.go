@@ -0,0 +1,247 @@
+package geocache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// EventRecorder records per-request cache analytics events.
+type EventRecorder interface {
+	// RecordCacheEvent records how a request was served ("hit", "miss", ...).
+	RecordCacheEvent(event string, r *http.Request, cacheKey string)
+	// RecordChange records a material change detected when an entry was replaced.
+	RecordChange(r *http.Request, cacheKey string, change FieldChange)
+}
+
+// noopRecorder discards all events.
+type noopRecorder struct{}
+
+func (noopRecorder) RecordCacheEvent(string, *http.Request, string)  {}
+func (noopRecorder) RecordChange(*http.Request, string, FieldChange) {}
+
+const (
+	influxBufferSize    = 10000
+	influxBatchSize     = 500
+	influxFlushInterval = time.Second
+)
+
+// influxRecorders are the InfluxDB recorders created by the package, flushed
+// by FlushEvents.
+var (
+	influxRecordersMu sync.Mutex
+	influxRecorders   []*influxRecorder
+)
+
+// influxRecorder writes a sample of events to InfluxDB. Points are buffered
+// and written in batches in the background, so requests never wait for
+// InfluxDB. The client is created on the first write, so InfluxDB does not
+// need to be reachable, or even resolvable, at startup.
+type influxRecorder struct {
+	url        string
+	token      string
+	bucket     string
+	org        string
+	sampleRate float64
+	logger     *Logger
+
+	client   influxdb2.Client
+	writeAPI api.WriteAPIBlocking
+	points   chan *write.Point
+	done     chan struct{}
+	// mu guards closed, so that no point is sent once points is closed.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newInfluxRecorder builds an InfluxDB recorder from Config.InfluxDSN. It
+// returns a no-op recorder when InfluxDB is not configured or sampling is off.
+func newInfluxRecorder(config Config, logger *Logger) EventRecorder {
+	if config.InfluxDSN == "" || config.InfluxSampleRate <= 0 {
+		return noopRecorder{}
+	}
+	dsn, err := url.Parse(config.InfluxDSN)
+	if err != nil {
+		return noopRecorder{}
+	}
+	influxURL := dsn.Scheme + "://" + dsn.Host
+	q := dsn.Query()
+	bucket := q.Get("bucket")
+	org := q.Get("org")
+	if org == "" {
+		org = "ignored"
+	}
+	token := q.Get("token")
+	if influxURL == "" || token == "" || bucket == "" {
+		return noopRecorder{}
+	}
+
+	ir := &influxRecorder{
+		url:        influxURL,
+		token:      token,
+		bucket:     bucket,
+		org:        org,
+		sampleRate: config.InfluxSampleRate,
+		logger:     logger,
+		points:     make(chan *write.Point, influxBufferSize),
+		done:       make(chan struct{}),
+	}
+	influxRecordersMu.Lock()
+	influxRecorders = append(influxRecorders, ir)
+	influxRecordersMu.Unlock()
+	go ir.run()
+	return ir
+}
+
+// write queues a point, dropping it when the buffer is full or the recorder
+// is closed.
+func (ir *influxRecorder) write(p *write.Point) {
+	ir.mu.RLock()
+	defer ir.mu.RUnlock()
+	if ir.closed {
+		influxPointsDroppedTotal.WithLabelValues("closed").Inc()
+		return
+	}
+	select {
+	case ir.points <- p:
+	default:
+		influxPointsDroppedTotal.WithLabelValues("buffer_full").Inc()
+	}
+}
+
+// run writes batches until the points channel is closed, then writes the
+// points left, closes the client and closes done.
+func (ir *influxRecorder) run() {
+	defer close(ir.done)
+	ticker := time.NewTicker(influxFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*write.Point, 0, influxBatchSize)
+	for {
+		select {
+		case p, ok := <-ir.points:
+			if !ok {
+				ir.send(batch)
+				if ir.client != nil {
+					ir.client.Close()
+				}
+				return
+			}
+			batch = append(batch, p)
+			if len(batch) >= influxBatchSize {
+				ir.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			ir.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (ir *influxRecorder) send(batch []*write.Point) {
+	if len(batch) == 0 {
+		return
+	}
+	if ir.client == nil {
+		ir.client = influxdb2.NewClient(ir.url, ir.token)
+		ir.writeAPI = ir.client.WriteAPIBlocking(ir.org, ir.bucket)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := ir.writeAPI.WritePoint(ctx, batch...); err != nil {
+		influxPointsDroppedTotal.WithLabelValues("write_failed").Add(float64(len(batch)))
+		if ir.logger != nil {
+			ir.logger.Log(LogWarning, "InfluxDB write error, dropped %d points: %v", len(batch), err)
+		} else {
+			fmt.Println("InfluxDB write error:", err)
+		}
+	}
+}
+
+// close stops accepting points and waits until the buffered ones have been
+// written, or ctx is done.
+func (ir *influxRecorder) close(ctx context.Context) error {
+	ir.mu.Lock()
+	if !ir.closed {
+		ir.closed = true
+		close(ir.points)
+	}
+	ir.mu.Unlock()
+	select {
+	case <-ir.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("InfluxDB flush interrupted with %d points left: %w", len(ir.points), ctx.Err())
+	}
+}
+
+// FlushEvents writes the events buffered for InfluxDB and stops recording
+// them; events recorded afterwards are dropped. Call it on shutdown, after
+// the HTTP server has stopped, so that the events of the last requests are
+// not lost. It returns when every event is written or ctx is done.
+func FlushEvents(ctx context.Context) error {
+	influxRecordersMu.Lock()
+	recorders := influxRecorders
+	influxRecorders = nil
+	influxRecordersMu.Unlock()
+	var errs []error
+	for _, ir := range recorders {
+		if err := ir.close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ir *influxRecorder) RecordCacheEvent(event string, r *http.Request, cacheKey string) {
+	if rand.Float64() > ir.sampleRate {
+		return
+	}
+	apiKey := extractAPIKey(r)
+	obfuscatedKey := obfuscateAPIKey(apiKey)
+	if obfuscatedKey == "" {
+		return
+	}
+	tags := map[string]string{"event": event}
+	if unit := businessUnitFromContext(r.Context()); unit != "" {
+		tags["business_unit"] = unit
+	}
+	p := influxdb2.NewPoint(
+		"cache_event",
+		tags,
+		map[string]interface{}{
+			"api":       r.URL.Path,
+			"api_key":   obfuscatedKey,
+			"cache_key": cacheKey,
+		},
+		time.Now(),
+	)
+	ir.write(p)
+}
+
+func (ir *influxRecorder) RecordChange(r *http.Request, cacheKey string, c FieldChange) {
+	if rand.Float64() > ir.sampleRate {
+		return
+	}
+	p := influxdb2.NewPoint(
+		"cache_change",
+		map[string]string{"field": c.Field},
+		map[string]interface{}{
+			"api":       r.URL.Path,
+			"cache_key": cacheKey,
+			"old":       c.Old,
+			"new":       c.New,
+		},
+		time.Now(),
+	)
+	ir.write(p)
+}
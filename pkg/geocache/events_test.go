@@ -0,0 +1,76 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFlushEvents_WritesBufferedPoints(t *testing.T) {
+	var mu sync.Mutex
+	var lines int
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		lines += bytes.Count(bytes.TrimSpace(body), []byte("\n")) + 1
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	events := newInfluxRecorder(Config{
+		InfluxDSN:        influx.URL + "?org=o&bucket=b&token=t",
+		InfluxSampleRate: 1,
+	}, NewLogger(false))
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=a&key=abcdefghijkl", nil)
+	for i := 0; i < 3; i++ {
+		events.RecordCacheEvent("miss", req, "key")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := FlushEvents(ctx); err != nil {
+		t.Fatalf("FlushEvents() error = %v", err)
+	}
+	mu.Lock()
+	if lines != 3 {
+		t.Errorf("InfluxDB received %d points, want 3", lines)
+	}
+	mu.Unlock()
+
+	before := testutil.ToFloat64(influxPointsDroppedTotal.WithLabelValues("closed"))
+	events.RecordCacheEvent("hit", req, "key")
+	if got := testutil.ToFloat64(influxPointsDroppedTotal.WithLabelValues("closed")) - before; got != 1 {
+		t.Errorf("points dropped after FlushEvents = %v, want 1", got)
+	}
+}
+
+func TestFlushEvents_CountsFailedWrites(t *testing.T) {
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer influx.Close()
+
+	events := newInfluxRecorder(Config{
+		InfluxDSN:        influx.URL + "?org=o&bucket=b&token=t",
+		InfluxSampleRate: 1,
+	}, NewLogger(false))
+	before := testutil.ToFloat64(influxPointsDroppedTotal.WithLabelValues("write_failed"))
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=a&key=abcdefghijkl", nil)
+	events.RecordCacheEvent("miss", req, "key")
+	events.RecordCacheEvent("hit", req, "key")
+
+	if err := FlushEvents(context.Background()); err != nil {
+		t.Fatalf("FlushEvents() error = %v", err)
+	}
+	if got := testutil.ToFloat64(influxPointsDroppedTotal.WithLabelValues("write_failed")) - before; got != 2 {
+		t.Errorf("points dropped on write failure = %v, want 2", got)
+	}
+}
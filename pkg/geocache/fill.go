@@ -0,0 +1,71 @@
+package geocache
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// fill is an upstream request made to fill a missing cache entry. Its ID is
+// the request ID of the request that triggered it, and is returned to every
+// request it answers in X-Cache-Fill-Id.
+type fill struct {
+	id   string
+	done chan struct{}
+	// resp and err are the result of the upstream request, set before done
+	// is closed. Both are nil when the triggering request gave up before
+	// going upstream.
+	resp *UpstreamResponse
+	err  error
+}
+
+// fillGroup coalesces concurrent misses of the same cache entry, so that a
+// stampede of identical requests results in a single upstream request.
+type fillGroup struct {
+	mu    sync.Mutex
+	fills map[string]*fill
+}
+
+// join returns the fill in progress for cacheKey, or starts one with id when
+// there is none, in which case leader is true and the caller must call finish.
+func (g *fillGroup) join(cacheKey, id string) (f *fill, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.fills[cacheKey]; ok {
+		return f, false
+	}
+	if g.fills == nil {
+		g.fills = make(map[string]*fill)
+	}
+	f = &fill{id: id, done: make(chan struct{})}
+	g.fills[cacheKey] = f
+	return f, true
+}
+
+// finish releases the requests waiting on f.
+func (g *fillGroup) finish(cacheKey string, f *fill) {
+	g.mu.Lock()
+	delete(g.fills, cacheKey)
+	g.mu.Unlock()
+	close(f.done)
+}
+
+// errFillAbandoned is returned by wait when the fill ended without a result
+// that can be shared.
+var errFillAbandoned = errors.New("fill abandoned")
+
+// wait returns the result of f once it is done. The context errors of the
+// triggering request, such as its latency budget running out, are not
+// shared, and neither is the lack of a result; both return errFillAbandoned
+// so that the waiting request goes upstream itself.
+func (f *fill) wait(ctx context.Context) (*UpstreamResponse, error) {
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if (f.resp == nil && f.err == nil) || errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded) {
+		return nil, errFillAbandoned
+	}
+	return f.resp, f.err
+}
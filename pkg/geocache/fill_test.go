@@ -0,0 +1,139 @@
+package geocache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// gatedTransport holds upstream requests until release is closed.
+type gatedTransport struct {
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if g.calls.Add(1) == 1 {
+		close(g.started)
+	}
+	select {
+	case <-g.release:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"results":[],"status":"OK"}`)),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+	}, nil
+}
+
+func TestServer_Query_CoalescedFill(t *testing.T) {
+	transport := &gatedTransport{started: make(chan struct{}), release: make(chan struct{})}
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+
+	before := testutil.ToFloat64(coalescedRequestsTotal.WithLabelValues("geocode"))
+
+	first := httptest.NewRecorder()
+	firstReq := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil)
+	first.Header().Set("X-Request-ID", "req-1")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.query(first, firstReq)
+	}()
+	<-transport.started
+
+	waiters := make([]*httptest.ResponseRecorder, 5)
+	for i := range waiters {
+		waiters[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil))
+		}(waiters[i])
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(transport.release)
+	wg.Wait()
+
+	if got := transport.calls.Load(); got != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", got)
+	}
+	if first.Header().Get("X-Cache") != "MISS" || first.Header().Get("X-Cache-Fill-Id") != "req-1" {
+		t.Errorf("Expected the first request to fill req-1, got %q %q", first.Header().Get("X-Cache"), first.Header().Get("X-Cache-Fill-Id"))
+	}
+	coalesced := 0
+	for i, w := range waiters {
+		switch w.Header().Get("X-Cache") {
+		case "COALESCED":
+			coalesced++
+			if got := w.Header().Get("X-Cache-Fill-Id"); got != "req-1" {
+				t.Errorf("waiter %d: expected fill ID req-1, got %q", i, got)
+			}
+			if w.Code != http.StatusOK || w.Body.String() != `{"results":[],"status":"OK"}` {
+				t.Errorf("waiter %d: expected the filled response, got %d %s", i, w.Code, w.Body.String())
+			}
+		case "HIT":
+			// Arrived after the fill was cached.
+		default:
+			t.Errorf("waiter %d: expected COALESCED, got %q", i, w.Header().Get("X-Cache"))
+		}
+	}
+	if coalesced == 0 {
+		t.Error("Expected concurrent misses to be coalesced")
+	}
+	if got := testutil.ToFloat64(coalescedRequestsTotal.WithLabelValues("geocode")) - before; got != float64(coalesced) {
+		t.Errorf("Expected %d coalesced requests counted for the geocode endpoint, got %v", coalesced, got)
+	}
+}
+
+func TestServer_Query_AbandonedFill(t *testing.T) {
+	transport := &gatedTransport{started: make(chan struct{}), release: make(chan struct{})}
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.query(first, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil).WithContext(ctx))
+	}()
+	<-transport.started
+
+	second := httptest.NewRecorder()
+	secondDone := make(chan struct{})
+	go func() {
+		defer close(secondDone)
+		server.query(second, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// The client of the triggering request goes away; the waiting request
+	// fetches the response itself.
+	cancel()
+	<-done
+	close(transport.release)
+	<-secondDone
+
+	if second.Code != http.StatusOK || second.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected the waiting request to go upstream, got %d %q", second.Code, second.Header().Get("X-Cache"))
+	}
+	if second.Header().Get("X-Cache-Fill-Id") == first.Header().Get("X-Cache-Fill-Id") {
+		t.Error("Expected the waiting request to report its own fill")
+	}
+	if got := transport.calls.Load(); got != 2 {
+		t.Errorf("Expected 2 upstream requests, got %d", got)
+	}
+}
@@ -0,0 +1,90 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpTokenSource fetches OAuth access tokens for the instance's service
+// account from the GCE metadata server, which is available on GCE, GKE and
+// Cloud Run. Tokens are reused until shortly before they expire.
+type gcpTokenSource struct {
+	client  *http.Client
+	baseURL string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newGCPTokenSource() *gcpTokenSource {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	return &gcpTokenSource{
+		client:  &http.Client{Timeout: 5 * time.Second},
+		baseURL: "http://" + host + "/computeMetadata/v1/",
+	}
+}
+
+// get reads a metadata server path.
+func (ts *gcpTokenSource) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("metadata server returned %s for %s", resp.Status, path)
+	}
+	return resp, nil
+}
+
+// metadata returns a metadata value such as "project/project-id".
+func (ts *gcpTokenSource) metadata(ctx context.Context, path string) (string, error) {
+	resp, err := ts.get(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return strings.TrimSpace(string(b)), err
+}
+
+// Token returns a valid access token.
+func (ts *gcpTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Now().Before(ts.expires) {
+		return ts.token, nil
+	}
+
+	resp, err := ts.get(ctx, "instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	ts.token = tok.AccessToken
+	ts.expires = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return ts.token, nil
+}
@@ -0,0 +1,138 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// errObjectNotFound is returned by gcsClient.Download for missing objects.
+var errObjectNotFound = errors.New("object not found")
+
+// gcsClient reads and writes objects of a Cloud Storage bucket through the
+// JSON API, authenticating as the instance's service account.
+type gcsClient struct {
+	client  *http.Client
+	baseURL string
+	bucket  string
+	token   func(ctx context.Context) (string, error)
+}
+
+// parseGCSLocation splits a "gs://bucket/path" location into the bucket and
+// an object name prefix, which is empty or ends in a slash.
+func parseGCSLocation(location string) (bucket, prefix string, err error) {
+	rest, ok := strings.CutPrefix(location, "gs://")
+	if !ok {
+		return "", "", fmt.Errorf("location %q is not gs://bucket/path", location)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("location %q has no bucket", location)
+	}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	return bucket, prefix, nil
+}
+
+func newGCSClient(bucket string) *gcsClient {
+	return &gcsClient{
+		client:  &http.Client{Timeout: 60 * time.Second},
+		baseURL: "https://storage.googleapis.com",
+		bucket:  bucket,
+		token:   newGCPTokenSource().Token,
+	}
+}
+
+func (c *gcsClient) do(ctx context.Context, method, rawURL, contentType string, body []byte) (*http.Response, error) {
+	token, err := c.token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching access token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.client.Do(req)
+}
+
+// Upload stores body as the object name.
+func (c *gcsClient) Upload(ctx context.Context, name, contentType string, body []byte) error {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", c.baseURL, url.PathEscape(c.bucket),
+		url.Values{"uploadType": {"media"}, "name": {name}}.Encode())
+	resp, err := c.do(ctx, http.MethodPost, u, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("uploading %s returned %s: %s", name, resp.Status, msg)
+	}
+	return nil
+}
+
+// Download returns the content of the object name.
+func (c *gcsClient) Download(ctx context.Context, name string) ([]byte, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", c.baseURL, url.PathEscape(c.bucket), url.PathEscape(name))
+	resp, err := c.do(ctx, http.MethodGet, u, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", errObjectNotFound, name)
+	} else if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("downloading %s returned %s: %s", name, resp.Status, msg)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// List returns the names of the objects directly under prefix, that is,
+// without a further slash in their name.
+func (c *gcsClient) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	query := url.Values{"prefix": {prefix}, "delimiter": {"/"}, "fields": {"items(name),nextPageToken"}}
+	for {
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", c.baseURL, url.PathEscape(c.bucket), query.Encode())
+		resp, err := c.do(ctx, http.MethodGet, u, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			return nil, fmt.Errorf("listing %s returned %s: %s", prefix, resp.Status, msg)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			names = append(names, item.Name)
+		}
+		if page.NextPageToken == "" {
+			return names, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
@@ -0,0 +1,223 @@
+// Package geocache implements a caching proxy for the Google Maps web service
+// APIs. It can run as the standalone geocache server or be embedded in another
+// Go service through New.
+package geocache
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+// Option configures the handler returned by New.
+type Option func(*options)
+
+type options struct {
+	config     *Config
+	logger     *Logger
+	redis      *redis.Client
+	httpClient *http.Client
+	store      CacheStore
+	metrics    MetricsSink
+	events     EventRecorder
+	upstream   Upstream
+	clock      Clock
+}
+
+// WithConfig sets the configuration. Without it, New reads the configuration
+// from the environment with LoadConfig.
+func WithConfig(config Config) Option {
+	return func(o *options) {
+		o.config = &config
+	}
+}
+
+// WithLogger sets the logger. Without it, New creates one with
+// NewLoggerFromConfig.
+func WithLogger(logger *Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithRedis sets the Redis client used as the cache. Without it, New creates
+// a client for Config.RedisHost and Config.RedisPort with NewRedisClient.
+func WithRedis(rdb *redis.Client) Option {
+	return func(o *options) {
+		o.redis = rdb
+	}
+}
+
+// WithHTTPClient sets the client used for upstream requests. Without it, a
+// client resolving upstream hosts as set by UPSTREAM_HOSTS and
+// UPSTREAM_RESOLVER is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// WithCacheStore sets the store holding cached responses. Without it, the
+// Redis client is used. Features that keep auxiliary Redis indexes (place
+// index, overrides, duplicate tracking) are disabled when a store is given
+// without WithRedis.
+func WithCacheStore(store CacheStore) Option {
+	return func(o *options) {
+		o.store = store
+	}
+}
+
+// WithMetricsSink sets where operational metrics are reported. Without it,
+// metrics are exposed on /metrics through the default Prometheus registry.
+func WithMetricsSink(metrics MetricsSink) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// WithEventRecorder sets the recorder for per-request cache events. Without
+// it, events are written to InfluxDB when Config.InfluxDSN is set.
+func WithEventRecorder(events EventRecorder) Option {
+	return func(o *options) {
+		o.events = events
+	}
+}
+
+// WithUpstream sets the upstream used on cache misses. Without it, requests
+// are forwarded to Config.BaseURL with the HTTP client. WithHTTPClient has no
+// effect when an upstream is given.
+func WithUpstream(upstream Upstream) Option {
+	return func(o *options) {
+		o.upstream = upstream
+	}
+}
+
+// WithClock sets the clock read by the server and its background jobs.
+// Without it, the system clock is used. Tests can pass a FrozenClock to
+// control expiry and periodic jobs.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+func buildOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.config == nil {
+		config := LoadConfig()
+		o.config = &config
+	}
+	if o.logger == nil {
+		o.logger = NewLoggerFromConfig(*o.config)
+	}
+	if o.clock == nil {
+		o.clock = systemClock{}
+	}
+	if o.store == nil {
+		if o.redis == nil {
+			o.redis = NewRedisClient(&redis.Options{DB: o.config.RedisDB}, *o.config, o.logger)
+		}
+		store := newRedisStore(o.redis, o.config.RedisPrefix, o.config.ContentAddressedStorage)
+		store.hashEntries = o.config.CacheHashEntries
+		if o.config.CacheHashEntries && o.config.ContentAddressedStorage {
+			o.logger.Log(LogWarning, "CACHE_HASH_ENTRIES has no effect with CONTENT_ADDRESSED_STORAGE")
+		}
+		o.store = store
+		if o.config.MigrationMode {
+			o.store = newMigratingStore(o.store, o.redis, *o.config, o.logger)
+		}
+		if o.config.MirrorRedisAddr != "" {
+			o.store = newMirroringStore(o.store, o.redis, *o.config, o.clock, o.logger)
+		}
+		if o.config.ClientSideCaching {
+			o.store = newTrackingStore(o.store, o.redis, *o.config, o.clock, o.logger)
+		}
+		if o.config.CacheMaxEntryBytes > 0 {
+			o.store = newSpilloverStore(o.store, *o.config, o.clock, o.logger)
+		}
+	}
+	if o.metrics == nil {
+		o.metrics = prometheusSink{}
+	}
+	httpBuckets, redisBuckets := o.config.HTTPDurationBuckets, o.config.RedisLatencyBuckets
+	if len(httpBuckets) == 0 {
+		httpBuckets = defaultHTTPDurationBuckets
+	}
+	if len(redisBuckets) == 0 {
+		redisBuckets = defaultRedisLatencyBuckets
+	}
+	setLatencyBuckets(httpBuckets, redisBuckets)
+	if o.events == nil {
+		o.events = newInfluxRecorder(*o.config, o.logger)
+	}
+	if o.upstream == nil {
+		if o.httpClient == nil {
+			o.httpClient = newUpstreamClient(*o.config, o.logger)
+		}
+		o.upstream = newHTTPUpstream(o.httpClient, *o.config, o.clock, o.logger, o.metrics)
+	}
+	return o
+}
+
+// New returns the complete caching proxy as an http.Handler: the proxied Maps
+// API, /health, /metrics and the /admin/ API, wrapped in the CORS, Prometheus
+// and panic recovery middlewares.
+func New(opts ...Option) http.Handler {
+	server := NewServerWithOptions(opts...)
+	if server.config.ProfilesFile != "" {
+		return newProfileMux(server, server.handler(), opts)
+	}
+	return server.handler()
+}
+
+func (s *Server) handler() http.Handler {
+	return connLimitMiddleware(corsMiddleware(prometheusMiddleware(s.inflightMiddleware(s.recoveryMiddleware(s.routes())))))
+}
+
+// routes builds the mux serving every endpoint of the proxy.
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.Handle("/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("ok\nversion: %s\n", apiConfig.Version)))
+	}))
+
+	mux.Handle("/metrics", s.metricsAccess(promhttp.Handler()))
+	mux.Handle("GET /metrics/metadata", s.metricsAccess(http.HandlerFunc(handleMetricsMetadata)))
+
+	mux.Handle("/admin/", s.adminHandler())
+
+	mux.Handle("POST "+batchGeocodePath, s.timeoutMiddleware(s.businessUnitMiddleware(s.logMiddleware(s.authMiddleware(s.captureMiddleware(s.maintenanceMiddleware(s.rateLimitMiddleware(http.HandlerFunc(s.handleBatchGeocode)))))))))
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Google Maps Proxy\nThis service proxies requests to Google Maps and caches responses.\nStatus: alive\n"))
+			return
+		}
+		s.timeoutMiddleware(s.businessUnitMiddleware(s.logMiddleware(s.authMiddleware(s.outputFormatMiddleware(s.rejectPatternsMiddleware(s.rulesMiddleware(s.postCacheMiddleware(s.captureMiddleware(s.usageMiddleware(s.maintenanceMiddleware(s.autocompleteMiddleware(s.rateLimitMiddleware(http.HandlerFunc(s.query)))))))))))))).ServeHTTP(w, r)
+	})
+
+	return mux
+}
+
+func isIPAllowed(remoteAddr string, cidrs []string) bool {
+	ip := parseAddrIP(remoteAddr)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		network, err := parseAllowedCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
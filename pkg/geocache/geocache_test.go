@@ -0,0 +1,186 @@
+package geocache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestNew(t *testing.T) {
+	// Start miniredis for a mock Redis server
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	logger := NewLogger(false)
+	config := Config{
+		RedisHost:    mr.Host(),
+		RedisPort:    mr.Port(),
+		BaseURL:      "https://maps.googleapis.com",
+		CacheTimeout: 720 * time.Hour,
+	}
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+		DB:   0,
+	})
+	defer rdb.Close()
+
+	handler := New(WithConfig(config), WithLogger(logger), WithRedis(rdb))
+
+	tests := []struct {
+		name           string
+		path           string
+		method         string
+		expectedStatus int
+		headers        map[string]string
+	}{
+		{
+			name:           "health check",
+			path:           "/health",
+			method:         "GET",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "query endpoint without API key",
+			path:           "/maps/api/geocode/json?address=test",
+			method:         "GET",
+			expectedStatus: http.StatusOK, // Server forwards request to Google Maps API without validation
+		},
+		{
+			name:           "query endpoint with API key header",
+			path:           "/maps/api/geocode/json?address=test",
+			method:         "GET",
+			expectedStatus: http.StatusOK,
+			headers: map[string]string{
+				"X-Maps-API-Key": "test-key",
+			},
+		},
+		{
+			name:           "CORS preflight request",
+			path:           "/maps/api/geocode/json",
+			method:         "OPTIONS",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.method == "OPTIONS" {
+				if w.Header().Get("Access-Control-Allow-Origin") == "" {
+					t.Error("Expected CORS headers in response")
+				}
+			}
+		})
+	}
+}
+
+type memoryStore struct {
+	entries map[string][]byte
+}
+
+func (m *memoryStore) Get(_ context.Context, keys ...string) ([][]byte, error) {
+	out := make([][]byte, len(keys))
+	for i, k := range keys {
+		out[i] = m.entries[k]
+	}
+	return out, nil
+}
+
+func (m *memoryStore) Set(_ context.Context, key string, value []byte, _ time.Duration) error {
+	m.entries[key] = value
+	return nil
+}
+
+func (m *memoryStore) Swap(_ context.Context, key string, value []byte, _ time.Duration) ([]byte, error) {
+	previous := m.entries[key]
+	m.entries[key] = value
+	return previous, nil
+}
+
+func (m *memoryStore) Delete(_ context.Context, keys ...string) (int64, error) {
+	var n int64
+	for _, k := range keys {
+		if _, ok := m.entries[k]; ok {
+			delete(m.entries, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+type fakeUpstream struct {
+	calls int
+}
+
+func (f *fakeUpstream) Fetch(r *http.Request) (*UpstreamResponse, error) {
+	f.calls++
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	return &UpstreamResponse{StatusCode: http.StatusOK, Header: header, Body: []byte(`{"status":"OK"}`), Target: "fake"}, nil
+}
+
+type countingRecorder struct {
+	events []string
+}
+
+func (c *countingRecorder) RecordCacheEvent(event string, _ *http.Request, _ string) {
+	c.events = append(c.events, event)
+}
+
+func (c *countingRecorder) RecordChange(*http.Request, string, FieldChange) {}
+
+func TestNew_CustomComponents(t *testing.T) {
+	store := &memoryStore{entries: make(map[string][]byte)}
+	upstream := &fakeUpstream{}
+	recorder := &countingRecorder{}
+
+	handler := New(
+		WithConfig(Config{CacheTimeout: time.Hour, RedisPrefix: "test"}),
+		WithLogger(NewLogger(false)),
+		WithCacheStore(store),
+		WithUpstream(upstream),
+		WithEventRecorder(recorder),
+	)
+
+	for i, wantCache := range []string{"MISS", "HIT"} {
+		req := httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=Berlin", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d", i, w.Code)
+		}
+		if got := w.Header().Get("X-Cache"); got != wantCache {
+			t.Errorf("request %d: expected X-Cache %s, got %s", i, wantCache, got)
+		}
+	}
+
+	if upstream.calls != 1 {
+		t.Errorf("Expected 1 upstream call, got %d", upstream.calls)
+	}
+	if len(store.entries) != 1 {
+		t.Errorf("Expected 1 stored entry, got %d", len(store.entries))
+	}
+	if len(recorder.events) != 2 || recorder.events[0] != "miss" || recorder.events[1] != "hit" {
+		t.Errorf("Expected events [miss hit], got %v", recorder.events)
+	}
+}
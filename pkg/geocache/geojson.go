@@ -0,0 +1,194 @@
+package geocache
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const (
+	// outputGeoJSON is the value of the output parameter that requests a
+	// GeoJSON FeatureCollection instead of the Google response.
+	outputGeoJSON      = "geojson"
+	geoJSONContentType = "application/geo+json"
+)
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	BBox       []float64              `json:"bbox,omitempty"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type latLngBounds struct {
+	Northeast latLng `json:"northeast"`
+	Southwest latLng `json:"southwest"`
+}
+
+// bbox returns b in GeoJSON order: west, south, east, north.
+func (b *latLngBounds) bbox() []float64 {
+	if b == nil {
+		return nil
+	}
+	return []float64{b.Southwest.Lng, b.Southwest.Lat, b.Northeast.Lng, b.Northeast.Lat}
+}
+
+// wantsGeoJSON reports whether r asks for GeoJSON output from an endpoint
+// that supports it.
+func wantsGeoJSON(r *http.Request) bool {
+	return r.URL.Query().Get("output") == outputGeoJSON && (r.URL.Path == geocodePath || r.URL.Path == directionsPath)
+}
+
+// withoutOutputParam returns a copy of r without the output parameter, which
+// Google does not know.
+func withoutOutputParam(r *http.Request) *http.Request {
+	upstreamReq := r.Clone(r.Context())
+	q := upstreamReq.URL.Query()
+	q.Del("output")
+	upstreamReq.URL.RawQuery = q.Encode()
+	return upstreamReq
+}
+
+// toGeoJSON converts a geocoding response into Point features and a
+// directions response into LineString features of the route overviews. It
+// returns false for other endpoints and for responses that are neither OK
+// nor ZERO_RESULTS.
+func toGeoJSON(path string, body []byte) ([]byte, bool) {
+	collection := geoJSONCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	switch path {
+	case geocodePath:
+		var resp struct {
+			Status  string                       `json:"status"`
+			Results []map[string]json.RawMessage `json:"results"`
+		}
+		if json.Unmarshal(body, &resp) != nil || (resp.Status != "OK" && resp.Status != "ZERO_RESULTS") {
+			return body, false
+		}
+		for _, result := range resp.Results {
+			var geometry struct {
+				Location     latLng        `json:"location"`
+				LocationType string        `json:"location_type"`
+				Viewport     *latLngBounds `json:"viewport"`
+			}
+			if json.Unmarshal(result["geometry"], &geometry) != nil {
+				continue
+			}
+			properties := make(map[string]interface{}, len(result))
+			for k, v := range result {
+				if k != "geometry" {
+					properties[k] = v
+				}
+			}
+			if geometry.LocationType != "" {
+				properties["location_type"] = geometry.LocationType
+			}
+			collection.Features = append(collection.Features, geoJSONFeature{
+				Type:       "Feature",
+				BBox:       geometry.Viewport.bbox(),
+				Geometry:   geoJSONGeometry{Type: "Point", Coordinates: []float64{geometry.Location.Lng, geometry.Location.Lat}},
+				Properties: properties,
+			})
+		}
+	case directionsPath:
+		var resp struct {
+			Status string `json:"status"`
+			Routes []struct {
+				Summary    string        `json:"summary"`
+				Copyrights string        `json:"copyrights"`
+				Warnings   []string      `json:"warnings"`
+				Bounds     *latLngBounds `json:"bounds"`
+				Legs       []struct {
+					Distance     distanceValue `json:"distance"`
+					Duration     distanceValue `json:"duration"`
+					StartAddress string        `json:"start_address"`
+					EndAddress   string        `json:"end_address"`
+				} `json:"legs"`
+				OverviewPolyline struct {
+					Points string `json:"points"`
+				} `json:"overview_polyline"`
+			} `json:"routes"`
+		}
+		if json.Unmarshal(body, &resp) != nil || (resp.Status != "OK" && resp.Status != "ZERO_RESULTS") {
+			return body, false
+		}
+		for _, route := range resp.Routes {
+			points := decodePolyline(route.OverviewPolyline.Points)
+			coordinates := make([][]float64, len(points))
+			for i, p := range points {
+				coordinates[i] = []float64{p.Lng, p.Lat}
+			}
+			properties := map[string]interface{}{
+				"summary":    route.Summary,
+				"copyrights": route.Copyrights,
+				"warnings":   route.Warnings,
+			}
+			var distance, duration int
+			for _, leg := range route.Legs {
+				distance += leg.Distance.Value
+				duration += leg.Duration.Value
+			}
+			properties["distance_meters"] = distance
+			properties["duration_seconds"] = duration
+			if len(route.Legs) > 0 {
+				properties["start_address"] = route.Legs[0].StartAddress
+				properties["end_address"] = route.Legs[len(route.Legs)-1].EndAddress
+			}
+			collection.Features = append(collection.Features, geoJSONFeature{
+				Type:       "Feature",
+				BBox:       route.Bounds.bbox(),
+				Geometry:   geoJSONGeometry{Type: "LineString", Coordinates: coordinates},
+				Properties: properties,
+			})
+		}
+	default:
+		return body, false
+	}
+
+	out, err := json.Marshal(collection)
+	if err != nil {
+		return body, false
+	}
+	return out, true
+}
+
+// cacheBody prepares an upstream body for caching: it applies cache-mode
+// polyline simplification and, for GeoJSON requests, the conversion. It
+// returns false when the body fails validation or a GeoJSON request got a
+// response that cannot be converted; such a body is returned as is and must
+// not be cached.
+func (s *Server) cacheBody(r *http.Request, body []byte) ([]byte, bool) {
+	if s.config.ValidateResponses {
+		if err := validateResponse(r.URL.Path, plainBody(body)); err != nil {
+			var corrupt *corruptResponseError
+			if errors.As(err, &corrupt) {
+				corruptResponsesTotal.WithLabelValues(metricsEndpoint(r.URL.Path), corrupt.reason).Inc()
+			}
+			s.logger.LogContext(r.Context(), LogWarning, "Not caching invalid upstream response (%d bytes): %v", len(body), err)
+			return body, false
+		}
+	}
+	body = s.simplifyBody(r, body, PolylineSimplifyCache, true)
+	if !wantsGeoJSON(r) {
+		return body, true
+	}
+	converted, ok := toGeoJSON(r.URL.Path, plainBody(body))
+	if !ok {
+		return body, false
+	}
+	if isGzip(body) {
+		if compressed, err := gzipCompress(converted); err == nil {
+			return compressed, true
+		}
+	}
+	return converted, true
+}
@@ -0,0 +1,149 @@
+package geocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestToGeoJSON(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		body         string
+		wantOK       bool
+		wantFeatures int
+		wantGeometry string
+	}{
+		{
+			name:         "geocode result becomes point",
+			path:         geocodePath,
+			body:         `{"status":"OK","results":[{"formatted_address":"1 Main St","place_id":"abc","geometry":{"location":{"lat":40.5,"lng":-74.25},"location_type":"ROOFTOP","viewport":{"northeast":{"lat":41,"lng":-74},"southwest":{"lat":40,"lng":-75}}}}]}`,
+			wantOK:       true,
+			wantFeatures: 1,
+			wantGeometry: "Point",
+		},
+		{
+			name:         "directions route becomes line string",
+			path:         directionsPath,
+			body:         `{"status":"OK","routes":[{"summary":"A1","legs":[{"distance":{"value":100},"duration":{"value":10}},{"distance":{"value":50},"duration":{"value":5}}],"overview_polyline":{"points":"_p~iF~ps|U_ulLnnqC_mqNvxq` + "`" + `@"}}]}`,
+			wantOK:       true,
+			wantFeatures: 1,
+			wantGeometry: "LineString",
+		},
+		{
+			name:         "zero results give empty collection",
+			path:         geocodePath,
+			body:         `{"status":"ZERO_RESULTS","results":[]}`,
+			wantOK:       true,
+			wantFeatures: 0,
+		},
+		{
+			name: "error status is not converted",
+			path: geocodePath,
+			body: `{"status":"REQUEST_DENIED","error_message":"bad key"}`,
+		},
+		{
+			name: "unsupported endpoint",
+			path: distanceMatrixPath,
+			body: `{"status":"OK","rows":[]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, ok := toGeoJSON(tt.path, []byte(tt.body))
+			if ok != tt.wantOK {
+				t.Fatalf("toGeoJSON() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				if string(out) != tt.body {
+					t.Errorf("Expected body to be returned unchanged, got %s", out)
+				}
+				return
+			}
+			var fc struct {
+				Type     string `json:"type"`
+				Features []struct {
+					BBox     []float64 `json:"bbox"`
+					Geometry struct {
+						Type        string          `json:"type"`
+						Coordinates json.RawMessage `json:"coordinates"`
+					} `json:"geometry"`
+					Properties map[string]interface{} `json:"properties"`
+				} `json:"features"`
+			}
+			if err := json.Unmarshal(out, &fc); err != nil {
+				t.Fatalf("Invalid GeoJSON %s: %v", out, err)
+			}
+			if fc.Type != "FeatureCollection" || len(fc.Features) != tt.wantFeatures {
+				t.Fatalf("Expected FeatureCollection with %d features, got %s", tt.wantFeatures, out)
+			}
+			if tt.wantFeatures == 0 {
+				return
+			}
+			f := fc.Features[0]
+			if f.Geometry.Type != tt.wantGeometry {
+				t.Errorf("Expected %s geometry, got %s", tt.wantGeometry, f.Geometry.Type)
+			}
+			switch tt.wantGeometry {
+			case "Point":
+				if string(f.Geometry.Coordinates) != "[-74.25,40.5]" {
+					t.Errorf("Expected [lng,lat] coordinates, got %s", f.Geometry.Coordinates)
+				}
+				if f.Properties["formatted_address"] != "1 Main St" || f.Properties["location_type"] != "ROOFTOP" {
+					t.Errorf("Unexpected properties %v", f.Properties)
+				}
+				if len(f.BBox) != 4 || f.BBox[0] != -75 || f.BBox[3] != 41 {
+					t.Errorf("Expected bbox from viewport, got %v", f.BBox)
+				}
+			case "LineString":
+				if string(f.Geometry.Coordinates) != "[[-120.2,38.5],[-120.95,40.7],[-126.453,43.252]]" {
+					t.Errorf("Unexpected coordinates %s", f.Geometry.Coordinates)
+				}
+				if f.Properties["distance_meters"] != float64(150) || f.Properties["duration_seconds"] != float64(15) {
+					t.Errorf("Expected leg totals, got %v", f.Properties)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_Query_GeoJSON(t *testing.T) {
+	transport := &recordingTransport{
+		body: `{"status":"OK","results":[{"formatted_address":"1 Main St","geometry":{"location":{"lat":40.5,"lng":-74.25}}}]}`,
+	}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+
+	for _, cache := range []string{"MISS", "HIT"} {
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&output=geojson", nil)
+		w := httptest.NewRecorder()
+		server.query(w, req)
+
+		if got := w.Header().Get("X-Cache"); got != cache {
+			t.Errorf("Expected X-Cache %s, got %s", cache, got)
+		}
+		if got := w.Header().Get("Content-Type"); got != geoJSONContentType {
+			t.Errorf("%s: expected Content-Type %s, got %s", cache, geoJSONContentType, got)
+		}
+		if !strings.Contains(w.Body.String(), `"type":"FeatureCollection"`) {
+			t.Errorf("%s: expected a FeatureCollection, got %s", cache, w.Body.String())
+		}
+	}
+
+	if len(transport.urls) != 1 || strings.Contains(transport.urls[0], "output=") {
+		t.Errorf("Expected one upstream request without the output parameter, got %v", transport.urls)
+	}
+
+	plainReq := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil)
+	if mr.Exists(server.cacheKey(plainReq)) {
+		t.Error("Expected the GeoJSON response to be cached separately from the plain one")
+	}
+	geoReq := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&output=geojson", nil)
+	if stored, _ := mr.Get(server.cacheKey(geoReq)); !strings.Contains(stored, "FeatureCollection") {
+		t.Errorf("Expected the converted form to be cached, got %s", stored)
+	}
+}
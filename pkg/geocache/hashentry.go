@@ -0,0 +1,135 @@
+package geocache
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache entries stored as hashes, with CACHE_HASH_ENTRIES, hold the value of
+// the entry in the body field, beside metadata that can be read and updated
+// without transferring the body:
+//
+//   - stored_at: when the body was written, in Unix milliseconds
+//   - refreshed_at: when the body was last stored again unchanged
+//   - expires_at: when the entry expires, 0 if never
+const (
+	hashEntryBody        = "body"
+	hashEntryStoredAt    = "stored_at"
+	hashEntryRefreshedAt = "refreshed_at"
+	hashEntryExpiresAt   = "expires_at"
+)
+
+// hashEntryGet is the Lua helper reading an entry stored either as a string
+// or as a hash.
+const hashEntryGet = `
+local function getEntry(key)
+	local kind = redis.call('TYPE', key).ok
+	if kind == 'hash' then
+		return redis.call('HGET', key, 'body')
+	elseif kind == 'string' then
+		return redis.call('GET', key)
+	end
+	return false
+end
+`
+
+// hashGetScript returns the values of KEYS, whether stored as strings or as
+// hashes.
+var hashGetScript = redis.NewScript(hashEntryGet + `
+local values = {}
+for i, key in ipairs(KEYS) do
+	values[i] = getEntry(key)
+end
+return values
+`)
+
+// hashEntrySet is the Lua helper storing value as the body of the hash entry
+// key at now, expiring at expiresAt after ttl milliseconds (0 for never), and
+// returning the value the entry held before. When the body is unchanged only
+// the metadata is updated, so that the body is not written again to the AOF
+// or the replicas.
+const hashEntrySet = `
+local function setHashEntry(key, value, now, expiresAt, ttl)
+	local previous = getEntry(key)
+	if previous == value and redis.call('TYPE', key).ok == 'hash' then
+		redis.call('HSET', key, 'refreshed_at', now, 'expires_at', expiresAt)
+	else
+		redis.call('DEL', key)
+		redis.call('HSET', key, 'body', value, 'stored_at', now, 'refreshed_at', now, 'expires_at', expiresAt)
+	end
+	if ttl > 0 then
+		redis.call('PEXPIRE', key, ttl)
+	else
+		redis.call('PERSIST', key)
+	end
+	return previous
+end
+`
+
+// hashSetScript stores ARGV[1] as the body of the hash entry KEYS[1] with
+// setHashEntry, at ARGV[2], expiring at ARGV[3] after ARGV[4] milliseconds.
+var hashSetScript = redis.NewScript(hashEntryGet + hashEntrySet + `
+return setHashEntry(KEYS[1], ARGV[1], ARGV[2], ARGV[3], tonumber(ARGV[4]))
+`)
+
+// hashGet reads keys with hashGetScript.
+func (s *redisStore) hashGet(ctx context.Context, keys []string) ([][]byte, error) {
+	values, err := hashGetScript.Run(ctx, s.client, keys).Slice()
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, len(keys))
+	for i, v := range values {
+		if str, ok := v.(string); ok {
+			out[i] = []byte(str)
+		}
+	}
+	return out, nil
+}
+
+// hashSet stores value as a hash entry and returns the value it replaced.
+func (s *redisStore) hashSet(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	now := time.Now()
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = now.Add(ttl).UnixMilli()
+	}
+	previous, err := hashSetScript.Run(ctx, s.client, []string{key},
+		value, now.UnixMilli(), expiresAt, ttl.Milliseconds(),
+	).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []byte(previous), nil
+}
+
+// entryMetadata is the metadata of a hash entry.
+type entryMetadata struct {
+	StoredAt    time.Time
+	RefreshedAt time.Time
+	// ExpiresAt is zero for entries that never expire.
+	ExpiresAt time.Time
+}
+
+// readEntryMetadata reads the metadata of the hash entry under key without
+// its body. ok is false for missing entries and entries stored as strings.
+func readEntryMetadata(ctx context.Context, client redis.Cmdable, key string) (meta entryMetadata, ok bool) {
+	values, err := client.HMGet(ctx, key, hashEntryStoredAt, hashEntryRefreshedAt, hashEntryExpiresAt).Result()
+	if err != nil || values[0] == nil {
+		return meta, false
+	}
+	times := make([]time.Time, len(values))
+	for i, v := range values {
+		str, _ := v.(string)
+		if ms, err := strconv.ParseInt(str, 10, 64); err == nil && ms > 0 {
+			times[i] = time.UnixMilli(ms)
+		}
+	}
+	return entryMetadata{StoredAt: times[0], RefreshedAt: times[1], ExpiresAt: times[2]}, true
+}
@@ -0,0 +1,105 @@
+package geocache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisStore_HashEntries(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to create miniredis: %v", err)
+	}
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	store := newRedisStore(rdb, "test", false)
+	store.hashEntries = true
+	ctx := context.Background()
+
+	body := []byte(`{"status":"OK","results":[]}`)
+	if err := store.Set(ctx, "test:a", body, time.Hour); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if mr.HGet("test:a", hashEntryBody) != string(body) || mr.HGet("test:a", hashEntryStoredAt) == "" {
+		t.Errorf("Expected a hash entry, got a %s", mr.Type("test:a"))
+	}
+	if ttl := mr.TTL("test:a"); ttl != time.Hour {
+		t.Errorf("Expected TTL 1h, got %v", ttl)
+	}
+	meta, ok := readEntryMetadata(ctx, rdb, "test:a")
+	if !ok || meta.StoredAt.IsZero() || meta.ExpiresAt.Sub(meta.StoredAt) != time.Hour {
+		t.Errorf("Unexpected metadata %+v, %v", meta, ok)
+	}
+
+	// Storing the same body again only updates the metadata.
+	mr.HSet("test:a", hashEntryStoredAt, "1")
+	previous, err := store.Swap(ctx, "test:a", body, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("Swap failed: %v", err)
+	}
+	if string(previous) != string(body) {
+		t.Errorf("Expected previous body %s, got %s", body, previous)
+	}
+	if stored := mr.HGet("test:a", hashEntryStoredAt); stored != "1" {
+		t.Errorf("Expected stored_at to be kept, got %s", stored)
+	}
+	if refreshed := mr.HGet("test:a", hashEntryRefreshedAt); refreshed == "1" || refreshed == "" {
+		t.Errorf("Expected refreshed_at to be updated, got %s", refreshed)
+	}
+	if ttl := mr.TTL("test:a"); ttl != 2*time.Hour {
+		t.Errorf("Expected TTL 2h, got %v", ttl)
+	}
+
+	// A new body is written with its own stored_at.
+	if err := store.Set(ctx, "test:a", []byte(`{"status":"OK"}`), 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if stored := mr.HGet("test:a", hashEntryStoredAt); stored == "1" {
+		t.Errorf("Expected stored_at to be rewritten with the body")
+	}
+	if ttl := mr.TTL("test:a"); ttl != 0 {
+		t.Errorf("Expected no TTL, got %v", ttl)
+	}
+
+	// Entries stored as strings are still read, and replaced by hashes.
+	mr.Set("test:b", string(body))
+	values, err := store.Get(ctx, "test:a", "test:b", "test:missing")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if string(values[0]) != `{"status":"OK"}` || string(values[1]) != string(body) || values[2] != nil {
+		t.Errorf("Unexpected values %q", values)
+	}
+	if _, ok := readEntryMetadata(ctx, rdb, "test:b"); ok {
+		t.Errorf("Expected no metadata for a string entry")
+	}
+	previous, err = store.Swap(ctx, "test:b", body, time.Hour)
+	if err != nil || string(previous) != string(body) {
+		t.Errorf("Expected previous body %s, got %s, %v", body, previous, err)
+	}
+	if typ := mr.Type("test:b"); typ != "hash" {
+		t.Errorf("Expected the entry to be stored as a hash, got %s", typ)
+	}
+
+	// Without hash entries, hashes read as missing entries.
+	values, err = newRedisStore(rdb, "test", false).Get(ctx, "test:a")
+	if err != nil || values[0] != nil {
+		t.Errorf("Expected a missing entry, got %q, %v", values, err)
+	}
+
+	// Content addressing replaces hash entries.
+	cas := newRedisStore(rdb, "test", true)
+	previous, err = cas.Swap(ctx, "test:a", body, time.Hour)
+	if err != nil || string(previous) != `{"status":"OK"}` {
+		t.Errorf("Expected previous body {\"status\":\"OK\"}, got %s, %v", previous, err)
+	}
+	values, err = cas.Get(ctx, "test:a")
+	if err != nil || string(values[0]) != string(body) {
+		t.Errorf("Expected the content addressed entry, got %q, %v", values, err)
+	}
+}
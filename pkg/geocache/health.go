@@ -0,0 +1,197 @@
+package geocache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Dependencies whose health gates the background jobs.
+const (
+	healthRedis    = "redis"
+	healthUpstream = "upstream"
+)
+
+// healthPollInterval is how often a paused job checks whether the
+// dependencies it waits for have recovered.
+const healthPollInterval = 5 * time.Second
+
+// dependencyHealth is the health of a dependency, as seen by the requests
+// served.
+type dependencyHealth struct {
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	UnhealthySince      *time.Time `json:"unhealthy_since,omitempty"`
+	// until is when the dependency is considered healthy again if no request
+	// succeeds or fails in the meantime.
+	until time.Time
+}
+
+// pausedJob is a background job waiting for its dependencies to recover.
+type pausedJob struct {
+	Since      time.Time `json:"since"`
+	WaitingFor []string  `json:"waiting_for"`
+}
+
+// healthGate pauses the background jobs that would only add load to an
+// unhealthy Redis or upstream: the cache warmer, snapshots, the startup
+// integrity sweep, edge sync and upstream prewarming. A dependency is
+// unhealthy after HEALTH_FAILURE_THRESHOLD consecutive failed requests to
+// it, and healthy again after a request succeeds or HEALTH_RECOVERY_SECONDS
+// pass without failures. The zero value never pauses jobs.
+type healthGate struct {
+	clock     Clock
+	threshold int
+	recovery  time.Duration
+	logger    *Logger
+
+	mu     sync.Mutex
+	deps   map[string]*dependencyHealth
+	paused map[string]pausedJob
+}
+
+func (g *healthGate) enabled() bool {
+	return g.threshold > 0
+}
+
+// observe records the outcome of a request to dep.
+func (g *healthGate) observe(dep string, err error) {
+	if !g.enabled() || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.deps == nil {
+		g.deps = make(map[string]*dependencyHealth)
+	}
+	h := g.deps[dep]
+	if h == nil {
+		h = &dependencyHealth{Healthy: true}
+		g.deps[dep] = h
+	}
+	now := g.clock.Now()
+	g.expire(dep, h, now)
+	if err == nil {
+		if !h.Healthy {
+			g.logger.Log(LogInfo, "%s recovered, resuming background jobs", dep)
+			dependencyHealthy.WithLabelValues(dep).Set(1)
+		}
+		*h = dependencyHealth{Healthy: true}
+		return
+	}
+	h.ConsecutiveFailures++
+	if h.ConsecutiveFailures < g.threshold {
+		return
+	}
+	h.until = now.Add(g.recovery)
+	if h.Healthy {
+		h.Healthy = false
+		h.UnhealthySince = &now
+		dependencyHealthy.WithLabelValues(dep).Set(0)
+		g.logger.Log(LogWarning, "%s unhealthy after %d consecutive failures, pausing background jobs: %v", dep, h.ConsecutiveFailures, err)
+	}
+}
+
+// expire marks dep healthy again once its recovery delay has passed.
+func (g *healthGate) expire(dep string, h *dependencyHealth, now time.Time) {
+	if !h.Healthy && now.After(h.until) {
+		g.logger.Log(LogInfo, "No %s failures for %v, resuming background jobs", dep, g.recovery)
+		dependencyHealthy.WithLabelValues(dep).Set(1)
+		*h = dependencyHealth{Healthy: true}
+	}
+}
+
+// unhealthy returns the dependencies of deps that are unhealthy.
+func (g *healthGate) unhealthy(deps []string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var down []string
+	now := g.clock.Now()
+	for _, dep := range deps {
+		if h := g.deps[dep]; h != nil {
+			g.expire(dep, h, now)
+			if !h.Healthy {
+				down = append(down, dep)
+			}
+		}
+	}
+	return down
+}
+
+// wait blocks job while any of deps is unhealthy.
+func (g *healthGate) wait(job string, deps ...string) {
+	if !g.enabled() {
+		return
+	}
+	down := g.unhealthy(deps)
+	if len(down) == 0 {
+		return
+	}
+	since := g.clock.Now()
+	g.setPaused(job, &pausedJob{Since: since, WaitingFor: down})
+	backgroundJobPaused.WithLabelValues(job).Set(1)
+	g.logger.Log(LogInfo, "Paused %s until %v recovers", job, down)
+	for len(down) > 0 {
+		<-g.clock.After(healthPollInterval)
+		down = g.unhealthy(deps)
+		if len(down) > 0 {
+			g.setPaused(job, &pausedJob{Since: since, WaitingFor: down})
+		}
+	}
+	g.setPaused(job, nil)
+	backgroundJobPaused.WithLabelValues(job).Set(0)
+	g.logger.Log(LogInfo, "Resumed %s after %v", job, g.clock.Now().Sub(since).Round(time.Second))
+}
+
+func (g *healthGate) setPaused(job string, p *pausedJob) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if p == nil {
+		delete(g.paused, job)
+		return
+	}
+	if g.paused == nil {
+		g.paused = make(map[string]pausedJob)
+	}
+	g.paused[job] = *p
+}
+
+// healthReport is the health section of /admin/stats.
+type healthReport struct {
+	Enabled      bool                        `json:"enabled"`
+	Dependencies map[string]dependencyHealth `json:"dependencies"`
+	PausedJobs   map[string]pausedJob        `json:"paused_jobs"`
+}
+
+func (g *healthGate) report() healthReport {
+	report := healthReport{
+		Enabled:      g.enabled(),
+		Dependencies: make(map[string]dependencyHealth),
+		PausedJobs:   make(map[string]pausedJob),
+	}
+	if !g.enabled() {
+		return report
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.clock.Now()
+	for dep, h := range g.deps {
+		g.expire(dep, h, now)
+		report.Dependencies[dep] = *h
+	}
+	maps.Copy(report.PausedJobs, g.paused)
+	return report
+}
+
+// observeUpstreamHealth records the outcome of an upstream request; errors
+// and 5xx responses are failures.
+func (s *Server) observeUpstreamHealth(resp *UpstreamResponse, err error) {
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		err = fmt.Errorf("upstream returned %d", resp.StatusCode)
+	}
+	s.health.observe(healthUpstream, err)
+}
@@ -0,0 +1,74 @@
+package geocache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthGate_PausesUntilRecovery(t *testing.T) {
+	clock := NewFrozenClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	g := &healthGate{clock: clock, threshold: 2, recovery: 30 * time.Second, logger: NewLogger(false)}
+
+	g.observe(healthRedis, errors.New("connection refused"))
+	if down := g.unhealthy([]string{healthRedis}); len(down) != 0 {
+		t.Fatalf("Expected Redis to stay healthy below the threshold, got unhealthy %v", down)
+	}
+	g.observe(healthRedis, errors.New("connection refused"))
+	if down := g.unhealthy([]string{healthRedis, healthUpstream}); len(down) != 1 || down[0] != healthRedis {
+		t.Fatalf("Expected Redis to be unhealthy at the threshold, got %v", down)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		g.wait("snapshot", healthRedis)
+		close(done)
+	}()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	report := g.report()
+	if p, ok := report.PausedJobs["snapshot"]; !ok || len(p.WaitingFor) != 1 || p.WaitingFor[0] != healthRedis {
+		t.Errorf("Expected the snapshot job to be reported as waiting for Redis, got %+v", report.PausedJobs)
+	}
+	if h := report.Dependencies[healthRedis]; h.Healthy || h.ConsecutiveFailures != 2 || h.UnhealthySince == nil {
+		t.Errorf("Expected Redis to be reported unhealthy after 2 failures, got %+v", h)
+	}
+
+	g.observe(healthRedis, nil)
+	clock.Advance(healthPollInterval)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the job to resume once Redis recovered")
+	}
+	if report := g.report(); len(report.PausedJobs) != 0 || !report.Dependencies[healthRedis].Healthy {
+		t.Errorf("Expected no paused job and a healthy Redis, got %+v", report)
+	}
+}
+
+func TestHealthGate_RecoversWithoutFailures(t *testing.T) {
+	clock := NewFrozenClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	g := &healthGate{clock: clock, threshold: 1, recovery: 30 * time.Second, logger: NewLogger(false)}
+
+	g.observe(healthUpstream, errors.New("upstream returned 503"))
+	clock.Advance(29 * time.Second)
+	if down := g.unhealthy([]string{healthUpstream}); len(down) != 1 {
+		t.Fatalf("Expected the upstream to be unhealthy within the recovery delay, got %v", down)
+	}
+	clock.Advance(2 * time.Second)
+	if down := g.unhealthy([]string{healthUpstream}); len(down) != 0 {
+		t.Errorf("Expected the upstream to be healthy after the recovery delay, got unhealthy %v", down)
+	}
+}
+
+func TestHealthGate_DisabledNeverPauses(t *testing.T) {
+	var g healthGate
+	for i := 0; i < 10; i++ {
+		g.observe(healthRedis, errors.New("connection refused"))
+	}
+	g.wait("warm", healthRedis)
+	if report := g.report(); report.Enabled || len(report.Dependencies) != 0 {
+		t.Errorf("Expected a disabled gate to report nothing, got %+v", report)
+	}
+}
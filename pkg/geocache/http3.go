@@ -0,0 +1,115 @@
+package geocache
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3HandshakeIdleTimeout bounds the QUIC handshake, after which the
+// request falls back to TCP: a network dropping UDP shows as a handshake that
+// never completes.
+const http3HandshakeIdleTimeout = 2 * time.Second
+
+// http3RetryDelay is how long requests to a host go over TCP after HTTP/3
+// failed for it.
+const http3RetryDelay = 5 * time.Minute
+
+// http3Transport sends HTTPS requests over HTTP/3, and over HTTP/2 or
+// HTTP/1.1 with fallback when HTTP/3 fails, such as where UDP is blocked.
+// A host for which HTTP/3 failed is reached over TCP for http3RetryDelay.
+type http3Transport struct {
+	h3       *http3.Transport
+	fallback http.RoundTripper
+
+	mu sync.Mutex
+	// broken maps the hosts reached over TCP to when HTTP/3 is tried again.
+	broken map[string]time.Time
+}
+
+// newHTTP3Transport returns a transport dialing QUIC connections through d,
+// so that UPSTREAM_HOSTS and UPSTREAM_RESOLVER apply, with tlsConfig.
+func newHTTP3Transport(d *upstreamDialer, tlsConfig *tls.Config, fallback http.RoundTripper) *http3Transport {
+	return &http3Transport{
+		h3: &http3.Transport{
+			TLSClientConfig: tlsConfig,
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: http3HandshakeIdleTimeout},
+			Dial:            d.DialQUIC,
+		},
+		fallback: fallback,
+		broken:   make(map[string]time.Time),
+	}
+}
+
+func (t *http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" || t.isBroken(req.URL.Host) {
+		return t.fallback.RoundTrip(req)
+	}
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	t.mu.Lock()
+	t.broken[req.URL.Host] = time.Now().Add(http3RetryDelay)
+	t.mu.Unlock()
+	upstreamHTTP3FallbacksTotal.Inc()
+	return t.fallback.RoundTrip(retry)
+}
+
+func (t *http3Transport) isBroken(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.broken[host]
+	if ok && time.Now().After(until) {
+		delete(t.broken, host)
+		return false
+	}
+	return ok
+}
+
+// CloseIdleConnections closes the idle connections of both transports.
+func (t *http3Transport) CloseIdleConnections() {
+	t.h3.CloseIdleConnections()
+	if c, ok := t.fallback.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// DialQUIC opens a QUIC connection to the first reachable address of the
+// host of addr, for http3.Transport.
+func (d *upstreamDialer) DialQUIC(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range ips {
+		conn, err := quic.DialAddrEarly(ctx, net.JoinHostPort(ip, port), tlsConfig, config)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("dial %s over QUIC: %w", host, errors.Join(errs...))
+}
@@ -0,0 +1,90 @@
+package geocache
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3Transport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	upstream := httptest.NewTLSServer(handler)
+	defer upstream.Close()
+	tlsConfig := upstream.Client().Transport.(*http.Transport).TLSClientConfig
+
+	// The HTTP/3 server listens on the UDP port of the same number.
+	conn, err := net.ListenPacket("udp", upstream.Listener.Addr().String())
+	if err != nil {
+		t.Skipf("UDP port unavailable: %v", err)
+	}
+	h3 := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(upstream.TLS)}
+	go h3.Serve(conn)
+
+	get := func(transport http.RoundTripper) string {
+		t.Helper()
+		resp, err := (&http.Client{Transport: transport}).Get(upstream.URL + "/")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	dialer := newUpstreamDialer(Config{})
+	transport := newHTTP3Transport(dialer, tlsConfig, upstream.Client().Transport)
+	defer transport.h3.Close()
+	if got := get(transport); got != "HTTP/3.0" {
+		t.Errorf("Expected the request over HTTP/3, got %s", got)
+	}
+
+	// Without the HTTP/3 server, requests fall back to TCP and stop trying
+	// HTTP/3 for a while.
+	h3.Close()
+	conn.Close()
+	fallback := newHTTP3Transport(dialer, tlsConfig, upstream.Client().Transport)
+	defer fallback.h3.Close()
+	fallback.h3.QUICConfig.HandshakeIdleTimeout = 100 * time.Millisecond
+	fallbacks := testutil.ToFloat64(upstreamHTTP3FallbacksTotal)
+	if got := get(fallback); got != "HTTP/1.1" {
+		t.Errorf("Expected the request to fall back to HTTP/1.1, got %s", got)
+	}
+	start := time.Now()
+	if got := get(fallback); got != "HTTP/1.1" {
+		t.Errorf("Expected the request over HTTP/1.1, got %s", got)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected HTTP/3 to be skipped, the request took %v", elapsed)
+	}
+	if got := testutil.ToFloat64(upstreamHTTP3FallbacksTotal) - fallbacks; got != 1 {
+		t.Errorf("Expected 1 fallback, got %v", got)
+	}
+}
+
+func TestUpstreamClient_HTTP3(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   bool
+	}{
+		{name: "disabled", config: Config{}},
+		{name: "enabled", config: Config{UpstreamHTTP3: true}, want: true},
+		{name: "direct", config: Config{UpstreamHTTP3: true, UpstreamProxy: "direct"}, want: true},
+		{name: "through a proxy", config: Config{UpstreamHTTP3: true, UpstreamProxy: "socks5://bastion.internal:1080"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got := newUpstreamClient(tt.config, NewLogger(false)).Transport.(*http3Transport)
+			if got != tt.want {
+				t.Errorf("HTTP/3 transport: %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
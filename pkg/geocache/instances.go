@@ -0,0 +1,131 @@
+package geocache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// requestCounts are the request counters of one instance or of the fleet.
+type requestCounts struct {
+	Total    int64 `json:"total"`
+	Hit      int64 `json:"hit"`
+	Miss     int64 `json:"miss"`
+	Override int64 `json:"override"`
+}
+
+func (c *requestCounts) add(o requestCounts) {
+	c.Total += o.Total
+	c.Hit += o.Hit
+	c.Miss += o.Miss
+	c.Override += o.Override
+}
+
+// hitRate is the share of cacheable requests answered from the cache.
+func (c requestCounts) hitRate() float64 {
+	if served := c.Hit + c.Miss + c.Override; served > 0 {
+		return float64(c.Hit+c.Override) / float64(served)
+	}
+	return 0
+}
+
+// instanceSnapshot is what a replica publishes in the instance registry.
+type instanceSnapshot struct {
+	ID        string        `json:"id"`
+	Hostname  string        `json:"hostname"`
+	Version   string        `json:"version"`
+	StartedAt time.Time     `json:"started_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Requests  requestCounts `json:"requests"`
+}
+
+// newInstanceID identifies this process: the hostname, which is the pod name
+// on Kubernetes, and a random suffix to tell restarts apart.
+func newInstanceID() string {
+	host, _ := os.Hostname()
+	var b [4]byte
+	rand.Read(b[:])
+	return host + "-" + hex.EncodeToString(b[:])
+}
+
+func (s *Server) instanceKey(id string) string {
+	return s.redisKey("instances:" + id)
+}
+
+func (s *Server) instanceIndexKey() string {
+	return s.redisKey("instances")
+}
+
+func (s *Server) snapshot() instanceSnapshot {
+	host, _ := os.Hostname()
+	return instanceSnapshot{
+		ID:        s.instanceID,
+		Hostname:  host,
+		Version:   apiConfig.Version,
+		StartedAt: s.stats.startedAt,
+		UpdatedAt: s.clock.Now().UTC(),
+		Requests:  s.stats.counts(),
+	}
+}
+
+// publishInstance registers this instance with its current counters. The
+// entry expires after three missed heartbeats.
+func (s *Server) publishInstance(ctx context.Context, interval time.Duration) error {
+	data, err := json.Marshal(s.snapshot())
+	if err != nil {
+		return err
+	}
+	pipe := s.redis.Pipeline()
+	pipe.Set(ctx, s.instanceKey(s.instanceID), data, 3*interval)
+	pipe.SAdd(ctx, s.instanceIndexKey(), s.instanceID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// runHeartbeat publishes this instance every interval.
+func (s *Server) runHeartbeat(interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := s.publishInstance(ctx, interval); err != nil {
+			s.logger.Log(LogWarning, "Failed to publish instance heartbeat: %v", err)
+		}
+		cancel()
+		<-s.clock.After(interval)
+	}
+}
+
+// listInstances returns the registered instances, dropping expired ones from
+// the index. This instance is reported with its live counters.
+func (s *Server) listInstances(ctx context.Context) ([]instanceSnapshot, error) {
+	ids, err := s.redis.SMembers(ctx, s.instanceIndexKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	instances := []instanceSnapshot{s.snapshot()}
+	if len(ids) == 0 {
+		return instances, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.instanceKey(id)
+	}
+	values, err := s.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			s.redis.SRem(ctx, s.instanceIndexKey(), ids[i])
+			continue
+		}
+		var snap instanceSnapshot
+		if json.Unmarshal([]byte(str), &snap) == nil && snap.ID != s.instanceID {
+			instances = append(instances, snap)
+		}
+	}
+	return instances, nil
+}
@@ -0,0 +1,72 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFleetStats(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	server.stats.total.Add(4)
+	server.stats.hits.Add(3)
+	server.stats.misses.Add(1)
+
+	peer := NewServer(server.logger, server.redis, server.config, nil)
+	peer.stats.total.Add(6)
+	peer.stats.hits.Add(1)
+	peer.stats.misses.Add(5)
+	if err := peer.publishInstance(context.Background(), time.Minute); err != nil {
+		t.Fatalf("Failed to publish instance: %v", err)
+	}
+	if ttl := mr.TTL(peer.instanceKey(peer.instanceID)); ttl != 3*time.Minute {
+		t.Errorf("Expected a TTL of 3m, got %v", ttl)
+	}
+	// An instance whose heartbeat expired is still listed in the index.
+	mr.SAdd(server.instanceIndexKey(), "gone")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", w.Code)
+	}
+	var stats struct {
+		Instance string        `json:"instance"`
+		Requests requestCounts `json:"requests"`
+		Fleet    struct {
+			Instances []instanceSnapshot `json:"instances"`
+			Requests  requestCounts      `json:"requests"`
+			HitRate   float64            `json:"hit_rate"`
+		} `json:"fleet"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if stats.Instance != server.instanceID {
+		t.Errorf("Expected instance %q, got %q", server.instanceID, stats.Instance)
+	}
+	if stats.Requests.Total != 4 {
+		t.Errorf("Expected 4 local requests, got %d", stats.Requests.Total)
+	}
+	if len(stats.Fleet.Instances) != 2 {
+		t.Fatalf("Expected 2 instances, got %d", len(stats.Fleet.Instances))
+	}
+	want := requestCounts{Total: 10, Hit: 4, Miss: 6}
+	if stats.Fleet.Requests != want {
+		t.Errorf("Expected fleet requests %+v, got %+v", want, stats.Fleet.Requests)
+	}
+	if stats.Fleet.HitRate != 0.4 {
+		t.Errorf("Expected a hit rate of 0.4, got %v", stats.Fleet.HitRate)
+	}
+	if ok, _ := mr.SIsMember(server.instanceIndexKey(), "gone"); ok {
+		t.Errorf("Expected the expired instance to be removed from the index")
+	}
+}
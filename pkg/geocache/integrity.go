@@ -0,0 +1,193 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// integrityExamples bounds the keys listed per problem in a sweep report.
+const integrityExamples = 10
+
+// integrityReport summarizes an integrity sweep. Problems counts the entries
+// by what is wrong with them: corrupt_envelope, invalid_json,
+// missing_status, no_ttl or ttl_too_long.
+type integrityReport struct {
+	Sampled  int                 `json:"sampled"`
+	Valid    int                 `json:"valid"`
+	Purged   int64               `json:"purged"`
+	Problems map[string]int      `json:"problems"`
+	Examples map[string][]string `json:"examples"`
+}
+
+// maxEntryTTL is the longest TTL an entry may have been stored with: that of
+// CACHE_TIMEOUT_HOURS or of a rule; zero if entries may never expire.
+func (s *Server) maxEntryTTL() time.Duration {
+	longest := s.config.CacheTimeout
+	if longest <= 0 {
+		return 0
+	}
+	for _, rl := range s.rules {
+		longest = max(longest, time.Duration(rl.Action.TTLSeconds)*time.Second)
+	}
+	return longest
+}
+
+// entryProblem returns what is wrong with a stored entry, or "". Bodies are
+// only checked when they look like JSON: the endpoint of an entry is not
+// known from its key, and XML or image bodies are left alone.
+func entryProblem(raw []byte, ttl, maxTTL time.Duration) string {
+	body, err := decodeEntry(raw)
+	if err != nil {
+		return "corrupt_envelope"
+	}
+	if plain := bytes.TrimSpace(plainBody(body)); bytes.HasPrefix(plain, []byte("{")) {
+		var corrupt *corruptResponseError
+		if errors.As(validateResponse("/json", plain), &corrupt) {
+			return corrupt.reason
+		}
+	}
+	switch {
+	case ttl == -1 && maxTTL > 0:
+		return "no_ttl"
+	case maxTTL > 0 && ttl > maxTTL:
+		return "ttl_too_long"
+	}
+	return ""
+}
+
+// integritySweep checks up to sample cache entries, as they come from SCAN,
+// for a corrupt envelope, a body that is not a complete JSON response, and a
+// TTL that no configuration would have set, such as after Redis was restored
+// from an RDB or AOF file. With purge, the invalid entries are deleted.
+func (s *Server) integritySweep(ctx context.Context, sample int, purge bool) (integrityReport, error) {
+	report := integrityReport{Problems: make(map[string]int), Examples: make(map[string][]string)}
+	maxTTL := s.maxEntryTTL()
+	var cursor uint64
+	for report.Sampled < sample {
+		keys, next, err := s.redis.Scan(ctx, cursor, s.redisKey("")+"*", 500).Result()
+		if err != nil {
+			return report, err
+		}
+		var names, entryKeys []string
+		for _, key := range keys {
+			if name := strings.TrimPrefix(key, s.redisKey("")); isCacheEntryName(name) && len(entryKeys) < sample-report.Sampled {
+				names = append(names, name)
+				entryKeys = append(entryKeys, key)
+			}
+		}
+		if len(entryKeys) > 0 {
+			values, err := s.store.Get(ctx, entryKeys...)
+			if err != nil {
+				return report, err
+			}
+			ttls := make([]*redis.DurationCmd, len(entryKeys))
+			pipe := s.redis.Pipeline()
+			for i, key := range entryKeys {
+				ttls[i] = pipe.PTTL(ctx, key)
+			}
+			pipe.Exec(ctx)
+
+			var invalid []string
+			for i, raw := range values {
+				// PTTL reports -2 for keys that expired since they were
+				// scanned.
+				ttl, err := ttls[i].Result()
+				if raw == nil || err != nil || ttl == -2 {
+					continue
+				}
+				report.Sampled++
+				problem := entryProblem(raw, ttl, maxTTL)
+				if problem == "" {
+					report.Valid++
+					integrityEntriesTotal.WithLabelValues("valid").Inc()
+					continue
+				}
+				integrityEntriesTotal.WithLabelValues(problem).Inc()
+				report.Problems[problem]++
+				if len(report.Examples[problem]) < integrityExamples {
+					report.Examples[problem] = append(report.Examples[problem], names[i])
+				}
+				invalid = append(invalid, entryKeys[i])
+			}
+			if purge && len(invalid) > 0 {
+				purged, err := s.store.Delete(ctx, invalid...)
+				if err != nil {
+					return report, err
+				}
+				report.Purged += purged
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	return report, nil
+}
+
+// logIntegrityReport logs the outcome of a sweep, with a warning when
+// entries are invalid.
+func (s *Server) logIntegrityReport(report integrityReport) {
+	invalid := report.Sampled - report.Valid
+	if invalid == 0 {
+		s.logger.Log(LogInfo, "Cache integrity sweep: %d entries sampled, all valid", report.Sampled)
+		return
+	}
+	problems := make([]string, 0, len(report.Problems))
+	for problem, n := range report.Problems {
+		problems = append(problems, problem+"="+strconv.Itoa(n))
+	}
+	sort.Strings(problems)
+	s.logger.Log(LogWarning, "Cache integrity sweep: %d of %d entries sampled are invalid (%s), %d purged",
+		invalid, report.Sampled, strings.Join(problems, ", "), report.Purged)
+}
+
+// runIntegritySweep sweeps INTEGRITY_SWEEP_SAMPLE entries on startup.
+func (s *Server) runIntegritySweep() {
+	s.health.wait("integrity_sweep", healthRedis)
+	report, err := s.integritySweep(context.Background(), s.config.IntegritySweepSample, s.config.IntegritySweepPurge)
+	if err != nil {
+		s.logger.Log(LogError, "Cache integrity sweep failed: %v", err)
+		return
+	}
+	s.logIntegrityReport(report)
+}
+
+// handleIntegritySweep sweeps the number of entries of the sample parameter,
+// INTEGRITY_SWEEP_SAMPLE by default, and deletes the invalid ones with
+// purge=true.
+func (s *Server) handleIntegritySweep(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sample := s.config.IntegritySweepSample
+	if v := q.Get("sample"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sample must be a positive integer"})
+			return
+		}
+		sample = n
+	}
+	if sample <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sample is required when INTEGRITY_SWEEP_SAMPLE is not set"})
+		return
+	}
+
+	report, err := s.integritySweep(r.Context(), sample, q.Get("purge") == "true")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	s.logIntegrityReport(report)
+	if report.Purged > 0 {
+		s.auditLog.Record(adminActor(r), AuditCachePurge, map[string]string{"reason": "integrity sweep", "purged": strconv.FormatInt(report.Purged, 10)})
+	}
+	writeJSON(w, http.StatusOK, report)
+}
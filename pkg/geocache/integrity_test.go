@@ -0,0 +1,80 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServer_IntegritySweep(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: &recordingTransport{}})
+	defer cleanup()
+	server.config.CacheTimeout = time.Hour
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+
+	entries := map[string]struct {
+		value string
+		ttl   time.Duration
+	}{
+		"valid":            {value: `{"status":"OK","results":[]}`, ttl: time.Hour},
+		"enveloped":        {value: string(encodeEntry([]byte(`{"status":"OK","results":[]}`))), ttl: time.Hour},
+		"xml":              {value: `<GeocodeResponse><status>OK</status></GeocodeResponse>`, ttl: time.Hour},
+		"corrupt_envelope": {value: string(encodeEntry([]byte(`{"status":"OK"}`))) + "x", ttl: time.Hour},
+		"invalid_json":     {value: `{"status":"OK","resu`, ttl: time.Hour},
+		"missing_status":   {value: `{"results":[]}`, ttl: time.Hour},
+		"no_ttl":           {value: `{"status":"OK","results":[]}`},
+		"ttl_too_long":     {value: `{"status":"OK","results":[]}`, ttl: 48 * time.Hour},
+	}
+	keys := make(map[string]string)
+	for name, e := range entries {
+		key := server.cacheKey(httptest.NewRequest(http.MethodGet, geocodePath+"?address="+name, nil))
+		keys[name] = key
+		mr.Set(key, e.value)
+		if e.ttl > 0 {
+			mr.SetTTL(key, e.ttl)
+		}
+	}
+	// Auxiliary keys are not cache entries.
+	mr.Set(server.redisKey("warm:lock"), "instance")
+
+	report, err := server.integritySweep(context.Background(), 100, false)
+	if err != nil {
+		t.Fatalf("integritySweep failed: %v", err)
+	}
+	want := map[string]int{"corrupt_envelope": 1, "invalid_json": 1, "missing_status": 1, "no_ttl": 1, "ttl_too_long": 1}
+	if report.Sampled != len(entries) || report.Valid != 3 || !reflect.DeepEqual(report.Problems, want) {
+		t.Errorf("Expected %d entries sampled, 3 valid and problems %v, got %+v", len(entries), want, report)
+	}
+	if got := report.Examples["invalid_json"]; len(got) != 1 || server.redisKey(got[0]) != keys["invalid_json"] {
+		t.Errorf("Expected the invalid entry as example, got %v", got)
+	}
+	if !mr.Exists(keys["invalid_json"]) {
+		t.Error("Expected invalid entries to be kept without purge")
+	}
+
+	if report, _ := server.integritySweep(context.Background(), 2, false); report.Sampled != 2 {
+		t.Errorf("Expected the sweep to stop after 2 entries, got %d", report.Sampled)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/integrity?sample=100&purge=true", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var purged integrityReport
+	json.Unmarshal(w.Body.Bytes(), &purged)
+	if purged.Purged != 5 {
+		t.Errorf("Expected 5 entries purged, got %d", purged.Purged)
+	}
+	for name, key := range keys {
+		if exists := mr.Exists(key); exists != (purged.Problems[name] == 0) {
+			t.Errorf("Entry %s exists: %v", name, exists)
+		}
+	}
+}
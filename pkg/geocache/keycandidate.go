@@ -0,0 +1,136 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// parseKeyParams parses Config.CacheKeyParams, endpoint path to the
+// "|"-separated parameters identifying its cache entries.
+func parseKeyParams(raw map[string]string) map[string][]string {
+	if len(raw) == 0 {
+		return nil
+	}
+	params := make(map[string][]string, len(raw))
+	for path, names := range raw {
+		params[path] = strings.Split(names, "|")
+	}
+	return params
+}
+
+// keyCandidatePolicy is a cache key policy to evaluate in dry run, as read
+// from CACHE_KEY_CANDIDATE_FILE. Settings left out are those in effect.
+type keyCandidatePolicy struct {
+	NormalizeAddress  *bool   `json:"normalize_address"`
+	StripDiacritics   *bool   `json:"strip_diacritics"`
+	AbbreviationsFile *string `json:"abbreviations_file"`
+	// Params replaces the parameter whitelists of the endpoints it lists,
+	// like CACHE_KEY_PARAMS.
+	Params map[string][]string `json:"params"`
+}
+
+// keyCandidate computes the cache keys of a candidate policy next to the
+// active ones, and counts how the two would have fared.
+type keyCandidate struct {
+	normalizer *addressNormalizer
+	params     map[string][]string
+
+	requests      atomic.Int64
+	diverged      atomic.Int64
+	activeHits    atomic.Int64
+	candidateHits atomic.Int64
+}
+
+// loadKeyCandidate reads the candidate policy at path, completing it with
+// the settings of config.
+func loadKeyCandidate(path string, config Config, logger *Logger) (*keyCandidate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy keyCandidatePolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if policy.NormalizeAddress != nil {
+		config.NormalizeAddress = *policy.NormalizeAddress
+	}
+	if policy.StripDiacritics != nil {
+		config.NormalizeStripDiacritics = *policy.StripDiacritics
+	}
+	if policy.AbbreviationsFile != nil {
+		config.AddressAbbreviationsFile = *policy.AbbreviationsFile
+	}
+	params := parseKeyParams(config.CacheKeyParams)
+	for endpoint, names := range policy.Params {
+		if params == nil {
+			params = make(map[string][]string)
+		}
+		params[endpoint] = names
+	}
+	return &keyCandidate{normalizer: newKeyNormalizer(config, logger), params: params}, nil
+}
+
+// observeKeyCandidate compares the cache key of r under the candidate policy
+// with cacheKey, its active key, which hit the cache when hit is true.
+// Whether the candidate key would have hit is tracked with markers set in
+// Redis for the cache timeout, so the projection settles once the policy has
+// been evaluated for that long.
+func (s *Server) observeKeyCandidate(r *http.Request, cacheKey string, hit bool) {
+	c := s.keyCandidate
+	candidateQuery := canonicalQuery(r.URL, c.normalizer, c.params)
+	candidateKey := hashCacheKey(candidateQuery, s.config.RedisPrefix)
+	diverged := candidateKey != cacheKey
+	candidateHit := hit
+	if s.redis != nil {
+		marker := s.redisKey("keycandidate:" + strings.TrimPrefix(candidateKey, s.redisKey("")))
+		created, err := s.redis.SetNX(context.Background(), marker, 1, s.config.CacheTimeout).Result()
+		if err != nil {
+			s.logger.LogContext(r.Context(), LogWarning, "Failed to track candidate cache key: %v", err)
+		} else if diverged {
+			candidateHit = !created
+		}
+	}
+
+	c.requests.Add(1)
+	keys := "same"
+	if diverged {
+		c.diverged.Add(1)
+		keys = "diverged"
+		s.logger.LogContext(r.Context(), LogDebug, "Candidate cache key diverges: %s is keyed as %s", canonicalQuery(r.URL, s.normalizer, s.keyParams), candidateQuery)
+	}
+	if hit {
+		c.activeHits.Add(1)
+	}
+	if candidateHit {
+		c.candidateHits.Add(1)
+	}
+	cacheKeyCandidateRequestsTotal.WithLabelValues(metricsEndpoint(r.URL.Path), keys, hitLabel(hit), hitLabel(candidateHit)).Inc()
+}
+
+func hitLabel(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+// report summarizes the evaluation for /admin/stats.
+func (c *keyCandidate) report() map[string]interface{} {
+	requests := c.requests.Load()
+	report := map[string]interface{}{
+		"requests":       requests,
+		"diverged":       c.diverged.Load(),
+		"active_hits":    c.activeHits.Load(),
+		"candidate_hits": c.candidateHits.Load(),
+	}
+	if requests > 0 {
+		report["hit_rate_delta"] = float64(c.candidateHits.Load()-c.activeHits.Load()) / float64(requests)
+	}
+	return report
+}
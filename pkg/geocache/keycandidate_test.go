@@ -0,0 +1,59 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCanonicalQuery_Params(t *testing.T) {
+	params := parseKeyParams(map[string]string{directionsPath: "origin|destination|mode"})
+	u, _ := url.Parse(directionsPath + "?origin=A&destination=B&mode=walking&departure_time=now")
+	if got, want := canonicalQuery(u, nil, params), directionsPath+"?destination=B&mode=walking&origin=A"; got != want {
+		t.Errorf("canonicalQuery() = %q, want %q", got, want)
+	}
+	xml, _ := url.Parse("/maps/api/directions/xml?origin=A&destination=B&mode=walking&departure_time=now")
+	if got, want := canonicalQuery(xml, nil, params), "/maps/api/directions/xml?destination=B&mode=walking&origin=A"; got != want {
+		t.Errorf("canonicalQuery() = %q, want %q", got, want)
+	}
+}
+
+func TestServer_KeyCandidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "candidate.json")
+	os.WriteFile(path, []byte(`{"normalize_address": true, "strip_diacritics": true}`), 0o600)
+
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	candidate, err := loadKeyCandidate(path, server.config, server.logger)
+	if err != nil {
+		t.Fatalf("loadKeyCandidate failed: %v", err)
+	}
+	server.keyCandidate = candidate
+	transport := &recordingTransport{body: `{"status":"OK","results":[]}`}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, prometheusSink{})
+	before := testutil.ToFloat64(cacheKeyCandidateRequestsTotal.WithLabelValues("geocode", "diverged", "miss", "hit"))
+
+	for _, address := range []string{"1 Main St", "1  main st.", "1 Main St"} {
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?address="+url.QueryEscape(address), nil)
+		server.query(httptest.NewRecorder(), req)
+	}
+
+	// The second address is a miss under the active policy, but would hit
+	// the entry of the first under the candidate policy.
+	report := candidate.report()
+	if report["requests"] != int64(3) || report["diverged"] != int64(3) || report["active_hits"] != int64(1) || report["candidate_hits"] != int64(2) {
+		t.Errorf("Unexpected report %v", report)
+	}
+	if delta, _ := report["hit_rate_delta"].(float64); delta < 0.33 || delta > 0.34 {
+		t.Errorf("Expected a hit rate delta of 1/3, got %v", report["hit_rate_delta"])
+	}
+	if got := testutil.ToFloat64(cacheKeyCandidateRequestsTotal.WithLabelValues("geocode", "diverged", "miss", "hit")) - before; got != 1 {
+		t.Errorf("Expected one projected hit of a miss, got %v", got)
+	}
+}
@@ -0,0 +1,207 @@
+package geocache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request priorities. Interactive requests, such as those of dispatcher UIs,
+// are the default; batch requests, such as nightly ETL jobs, give way to them
+// when upstream requests are limited.
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// requestPriority classifies r as batch when it says so in X-Priority or
+// carries one of batchKeys. A batch key cannot claim interactive priority.
+func requestPriority(r *http.Request, batchKeys []string) string {
+	if strings.EqualFold(strings.TrimSpace(r.Header.Get("X-Priority")), PriorityBatch) {
+		return PriorityBatch
+	}
+	if key := extractAPIKey(r); key != "" && slices.Contains(batchKeys, key) {
+		return PriorityBatch
+	}
+	return PriorityInteractive
+}
+
+// upstreamLimiter limits the number of concurrent upstream requests. After
+// startup the limit ramps up over a warm-up window: replicas deployed
+// together start with cold local state at the same moment, and without a ramp
+// each of them forwards every miss at once. After the warm-up the limit is
+// max, or none when max is 0.
+//
+// Batch requests only start while fewer than batchShare of the limit are in
+// flight, keeping the rest for interactive requests, and wait up to batchWait
+// for that instead of being rejected at once.
+type upstreamLimiter struct {
+	clock      Clock
+	start      time.Time
+	warmup     time.Duration
+	initial    int
+	warmupMax  int
+	max        int
+	batchShare float64
+	batchWait  time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	// released is closed, and replaced, whenever a request is released.
+	released chan struct{}
+}
+
+func newUpstreamLimiter(clock Clock, config Config) *upstreamLimiter {
+	initial := max(config.WarmupInitialConcurrency, 1)
+	return &upstreamLimiter{
+		clock:      clock,
+		start:      clock.Now(),
+		warmup:     config.WarmupWindow,
+		initial:    initial,
+		warmupMax:  max(config.WarmupMaxConcurrency, initial),
+		max:        config.UpstreamMaxConcurrency,
+		batchShare: config.BatchUpstreamShare,
+		batchWait:  config.BatchQueueTimeout,
+		released:   make(chan struct{}),
+	}
+}
+
+// warmingUp reports whether the warm-up window is running at now.
+func (u *upstreamLimiter) warmingUp(now time.Time) bool {
+	return now.Sub(u.start) < u.warmup
+}
+
+// limit returns the number of concurrent upstream requests allowed at now,
+// rising linearly from initial to warmupMax during the warm-up. It returns
+// false when requests are not limited.
+func (u *upstreamLimiter) limit(now time.Time) (int, bool) {
+	if u.warmingUp(now) {
+		elapsed := max(now.Sub(u.start), 0)
+		limit := u.initial + int(float64(u.warmupMax-u.initial)*float64(elapsed)/float64(u.warmup))
+		if u.max > 0 {
+			limit = min(limit, u.max)
+		}
+		return limit, true
+	}
+	return u.max, u.max > 0
+}
+
+// tryAcquire reserves an upstream request for priority if one is free, and
+// otherwise returns the channel closed on the next release.
+func (u *upstreamLimiter) tryAcquire(priority string) (bool, <-chan struct{}) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if limit, limited := u.limit(u.clock.Now()); limited {
+		if priority == PriorityBatch {
+			// Batch requests always get at least one request.
+			limit = max(int(float64(limit)*u.batchShare), 1)
+		}
+		if u.inFlight >= limit {
+			return false, u.released
+		}
+	}
+	u.inFlight++
+	return true, nil
+}
+
+func (u *upstreamLimiter) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.inFlight--
+	close(u.released)
+	u.released = make(chan struct{})
+}
+
+// errUpstreamBusy is returned by acquire when no upstream request is free.
+var errUpstreamBusy = errors.New("no upstream request available")
+
+// acquire reserves an upstream request for priority. Interactive requests
+// fail at once when none is free; batch requests wait up to batchWait, or
+// until ctx is done. queued reports whether the request had to wait. Once
+// acquired, release must be called when the request is done.
+func (u *upstreamLimiter) acquire(ctx context.Context, priority string) (queued bool, err error) {
+	ok, released := u.tryAcquire(priority)
+	if ok {
+		return false, nil
+	}
+	if priority != PriorityBatch || u.batchWait <= 0 {
+		return false, errUpstreamBusy
+	}
+	timer := time.NewTimer(u.batchWait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-released:
+		case <-timer.C:
+			return true, errUpstreamBusy
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+		if ok, released = u.tryAcquire(priority); ok {
+			return true, nil
+		}
+	}
+}
+
+// acquireUpstream is called for cache misses when upstream requests are
+// limited. During the warm-up it answers from the latest snapshot when the
+// entry is in it. Otherwise it reserves an upstream request for the priority
+// of r, rejecting r with 503 when none is free. It returns false when r has
+// been answered; otherwise release must be called after the upstream
+// request.
+func (s *Server) acquireUpstream(w http.ResponseWriter, r *http.Request, cacheKey string) (release func(), proceed bool) {
+	warmingUp := s.limiter.warmingUp(s.clock.Now())
+	if warmingUp && s.serveStale(w, r, cacheKey) {
+		warmupRequestsTotal.WithLabelValues("stale").Inc()
+		return nil, false
+	}
+	priority := requestPriority(r, s.config.BatchAPIKeys)
+	queued, err := s.limiter.acquire(r.Context(), priority)
+	if queued {
+		outcome := "served"
+		if err != nil {
+			outcome = "rejected"
+		}
+		upstreamQueuedTotal.WithLabelValues(priority, outcome).Inc()
+	}
+	if err != nil {
+		if warmingUp {
+			warmupRequestsTotal.WithLabelValues("rejected").Inc()
+		}
+		upstreamThrottledTotal.WithLabelValues(priority).Inc()
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "too many upstream requests in progress, retry shortly"})
+		return nil, false
+	}
+	if warmingUp {
+		warmupRequestsTotal.WithLabelValues("upstream").Inc()
+	}
+	return s.limiter.release, true
+}
+
+// serveStale answers r from the latest cache snapshot, if any holds it.
+func (s *Server) serveStale(w http.ResponseWriter, r *http.Request, cacheKey string) bool {
+	if s.snapshots == nil || s.quarantineFor(r, cacheKey) != nil {
+		return false
+	}
+	body, taken, err := s.snapshots.Lookup(r.Context(), strings.TrimPrefix(cacheKey, s.redisKey("")), s.clock.Now())
+	if err != nil {
+		if !errors.Is(err, errNoSnapshot) && !errors.Is(err, errNotInSnapshot) {
+			s.logger.LogContext(r.Context(), LogWarning, "Failed to read cache snapshot: %v", err)
+		}
+		return false
+	}
+	w.Header().Set("X-Cache", "STALE")
+	w.Header().Set("X-Cache-Snapshot", taken.Format(time.RFC3339))
+	w.Header().Set("Content-Type", cachedContentType(r))
+	s.writeBody(w, r, s.simplifyBody(r, body, PolylineSimplifyResponse, false))
+	s.events.RecordCacheEvent("stale", r, cacheKey)
+	if csw, ok := w.(*cacheStatusResponseWriter); ok {
+		csw.cacheStatus = "STALE"
+	}
+	return true
+}
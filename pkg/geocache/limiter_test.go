@@ -0,0 +1,185 @@
+package geocache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamLimiter_Warmup(t *testing.T) {
+	clock := NewFrozenClock(time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC))
+	limiter := newUpstreamLimiter(clock, Config{WarmupWindow: 100 * time.Second, WarmupInitialConcurrency: 4, WarmupMaxConcurrency: 54})
+
+	tests := []struct {
+		elapsed     time.Duration
+		want        int
+		wantLimited bool
+	}{
+		{elapsed: 0, want: 4, wantLimited: true},
+		{elapsed: 50 * time.Second, want: 29, wantLimited: true},
+		{elapsed: 99 * time.Second, want: 53, wantLimited: true},
+		{elapsed: 100 * time.Second, wantLimited: false},
+	}
+	for _, tt := range tests {
+		got, limited := limiter.limit(limiter.start.Add(tt.elapsed))
+		if got != tt.want || limited != tt.wantLimited {
+			t.Errorf("limit after %v = %d, %v, want %d, %v", tt.elapsed, got, limited, tt.want, tt.wantLimited)
+		}
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		if _, err := limiter.acquire(ctx, PriorityInteractive); err != nil {
+			t.Fatalf("Expected request %d to be allowed, got %v", i, err)
+		}
+	}
+	if _, err := limiter.acquire(ctx, PriorityInteractive); !errors.Is(err, errUpstreamBusy) {
+		t.Errorf("Expected a fifth concurrent request to be refused at startup, got %v", err)
+	}
+	limiter.release()
+	if _, err := limiter.acquire(ctx, PriorityInteractive); err != nil {
+		t.Errorf("Expected a released request to be reusable, got %v", err)
+	}
+	clock.Advance(10 * time.Second)
+	if _, err := limiter.acquire(ctx, PriorityInteractive); err != nil {
+		t.Errorf("Expected the limit to rise with time, got %v", err)
+	}
+	clock.Advance(90 * time.Second)
+	if limiter.warmingUp(clock.Now()) {
+		t.Error("Expected the warm-up to be over after its window")
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := limiter.acquire(ctx, PriorityInteractive); err != nil {
+			t.Fatalf("Expected no limit after the warm-up, got %v", err)
+		}
+	}
+}
+
+func TestUpstreamLimiter_Priorities(t *testing.T) {
+	limiter := newUpstreamLimiter(systemClock{}, Config{UpstreamMaxConcurrency: 4, BatchUpstreamShare: 0.5, BatchQueueTimeout: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if queued, err := limiter.acquire(ctx, PriorityBatch); err != nil || queued {
+			t.Fatalf("Expected batch request %d to be allowed at once, got %v, %v", i, queued, err)
+		}
+	}
+	// Batch requests have used their share; the rest is kept for
+	// interactive requests.
+	if queued, err := limiter.acquire(ctx, PriorityBatch); !queued || !errors.Is(err, errUpstreamBusy) {
+		t.Errorf("Expected a third batch request to wait and be rejected, got %v, %v", queued, err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.acquire(ctx, PriorityInteractive); err != nil {
+			t.Fatalf("Expected interactive request %d to be allowed, got %v", i, err)
+		}
+	}
+	if queued, err := limiter.acquire(ctx, PriorityInteractive); queued || !errors.Is(err, errUpstreamBusy) {
+		t.Errorf("Expected interactive requests over the limit to be rejected at once, got %v, %v", queued, err)
+	}
+
+	// Batch requests start only while the requests in flight, of either
+	// priority, are under the batch share.
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			limiter.release()
+		}
+	}()
+	if queued, err := limiter.acquire(ctx, PriorityBatch); !queued || err != nil {
+		t.Errorf("Expected a queued batch request to be served once requests are released, got %v, %v", queued, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := limiter.acquire(canceled, PriorityBatch); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a canceled batch request to stop waiting, got %v", err)
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header string
+		want   string
+	}{
+		{name: "default", target: "/?key=ui", want: PriorityInteractive},
+		{name: "batch header", target: "/?key=ui", header: "Batch", want: PriorityBatch},
+		{name: "interactive header", target: "/?key=ui", header: "interactive", want: PriorityInteractive},
+		{name: "unknown header", target: "/?key=ui", header: "urgent", want: PriorityInteractive},
+		{name: "batch key", target: "/?key=etl", want: PriorityBatch},
+		{name: "batch key claiming interactive", target: "/?key=etl", header: "interactive", want: PriorityBatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Priority", tt.header)
+			}
+			if got := requestPriority(r, []string{"etl"}); got != tt.want {
+				t.Errorf("requestPriority() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_Query_Warmup(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[{"place_id":"v1"}],"status":"OK"}`}
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	clock := NewFrozenClock(time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC))
+	server.clock = clock
+
+	gcs := &fakeGCS{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(gcs)
+	defer ts.Close()
+	server.snapshots = newSnapshotStore(&gcsClient{
+		client:  ts.Client(),
+		baseURL: ts.URL,
+		bucket:  "bucket",
+		token:   func(context.Context) (string, error) { return "token", nil },
+	}, "")
+
+	ctx := context.Background()
+	cached := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil)
+	server.query(httptest.NewRecorder(), cached)
+	if _, err := server.writeSnapshot(ctx, clock.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+	// A restarted instance finds the entry gone from Redis.
+	server.store.Delete(ctx, server.cacheKey(cached))
+	upstreamCalls := len(transport.urls)
+
+	server.limiter = newUpstreamLimiter(clock, Config{WarmupWindow: time.Minute, WarmupInitialConcurrency: 1, WarmupMaxConcurrency: 10})
+	server.limiter.acquire(ctx, PriorityInteractive)
+
+	w := httptest.NewRecorder()
+	server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("Expected a stale response from the snapshot, got %d %q", w.Code, w.Header().Get("X-Cache"))
+	}
+
+	w = httptest.NewRecorder()
+	server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Elm", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After while the ramp is full, got %d", w.Code)
+	}
+	if len(transport.urls) != upstreamCalls {
+		t.Errorf("Expected no upstream requests, got %d", len(transport.urls)-upstreamCalls)
+	}
+
+	server.limiter.release()
+	w = httptest.NewRecorder()
+	server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Elm", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected the miss to go upstream once a request is free, got %d %q", w.Code, w.Header().Get("X-Cache"))
+	}
+	if _, err := server.limiter.acquire(ctx, PriorityInteractive); err != nil {
+		t.Errorf("Expected the upstream request to be released after the response, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package geocache
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// limitConnections returns l counting its open connections, of which the
+// ones beyond max, when positive, are marked to be answered with 503 by
+// connLimitMiddleware and closed. They are accepted rather than left in the
+// listen backlog, so that clients learn at once to retry elsewhere.
+func limitConnections(l net.Listener, max int) net.Listener {
+	if max <= 0 {
+		return l
+	}
+	return &countingListener{Listener: l, max: int64(max)}
+}
+
+// countingListener reports its open connections in open_connections.
+type countingListener struct {
+	net.Listener
+	max      int64
+	admitted atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	openConnections.Inc()
+	conn := &countedConn{Conn: c, listener: l}
+	if l.admitted.Add(1) > l.max {
+		l.admitted.Add(-1)
+		conn.overLimit = true
+	}
+	return conn, nil
+}
+
+type countedConn struct {
+	net.Conn
+	listener  *countingListener
+	overLimit bool
+	once      sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		openConnections.Dec()
+		if !c.overLimit {
+			c.listener.admitted.Add(-1)
+		}
+	})
+	return c.Conn.Close()
+}
+
+type connOverLimitKey struct{}
+
+// ConnContext marks the requests of the connections accepted beyond
+// MAX_CONNECTIONS, for connLimitMiddleware to reject; set it as the
+// ConnContext of the http.Server serving the listener of Listen.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = tc.NetConn()
+	}
+	if cc, ok := c.(*countedConn); ok && cc.overLimit {
+		return context.WithValue(ctx, connOverLimitKey{}, true)
+	}
+	return ctx
+}
+
+// connLimitMiddleware answers 503 to the requests of the connections
+// accepted beyond MAX_CONNECTIONS, and closes them.
+func connLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if over, _ := r.Context().Value(connOverLimitKey{}).(bool); !over {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Connection", "close")
+		if isLimitExempt(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		connectionRejectionsTotal.Inc()
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "too many connections, retry later"})
+	})
+}
+
+// isLimitExempt reports whether requests to path are served whatever the
+// load: health checks, metrics and the admin API, so that a saturated
+// instance can still be observed and operated.
+func isLimitExempt(path string) bool {
+	return path == "/health" || path == "/metrics" || strings.HasPrefix(path, "/admin/")
+}
+
+// inflightMiddleware answers 503 to the requests arriving while
+// MAX_INFLIGHT_REQUESTS are being served, before they reach Redis or the
+// upstream.
+func (s *Server) inflightMiddleware(next http.Handler) http.Handler {
+	if s.config.MaxInflightRequests <= 0 {
+		return next
+	}
+	max := int64(s.config.MaxInflightRequests)
+	var inflight atomic.Int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isLimitExempt(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The limit is per server, with the settings of its profile, while
+		// the gauge counts the requests of every server.
+		n := inflight.Add(1)
+		inflightRequests.Inc()
+		defer func() {
+			inflight.Add(-1)
+			inflightRequests.Dec()
+		}()
+		if n > max {
+			inflightRejectionsTotal.Inc()
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "server is saturated, retry later"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,119 @@
+package geocache
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInflightMiddleware(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.MaxInflightRequests = 1
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := server.inflightMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == geocodePath {
+			close(started)
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	rejected := testutil.ToFloat64(inflightRejectionsTotal)
+	inflight := testutil.ToFloat64(inflightRequests)
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, geocodePath, nil))
+		done <- w.Code
+	}()
+	<-started
+	for path, want := range map[string]int{"/maps/api/directions/json": http.StatusServiceUnavailable, "/health": http.StatusOK, "/admin/stats": http.StatusOK} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("%s while saturated: status %d, want %d", path, w.Code, want)
+		}
+	}
+	if got := testutil.ToFloat64(inflightRejectionsTotal) - rejected; got != 1 {
+		t.Errorf("counted %v rejections, want 1", got)
+	}
+	// The server of another profile has requests of its own, and the gauge
+	// counts those of both.
+	other := server.inflightMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := testutil.ToFloat64(inflightRequests) - inflight; got != 2 {
+			t.Errorf("inflight_requests grew by %v while both servers serve one request, want 2", got)
+		}
+	}))
+	other.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, geocodePath, nil))
+	if got := testutil.ToFloat64(inflightRequests) - inflight; got != 1 {
+		t.Errorf("inflight_requests grew by %v with one request left, want 1", got)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("first request: status %d, want 200", code)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/maps/api/directions/json", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("after the first request: status %d, want 200", w.Code)
+	}
+}
+
+func TestListenMaxConnections(t *testing.T) {
+	l, err := Listen(Config{ListenNetwork: "tcp4", ListenAddress: "127.0.0.1", ServerPort: "0", MaxConnections: 1})
+	if err != nil {
+		t.Skipf("tcp4 unavailable here: %v", err)
+	}
+	server := &http.Server{
+		Handler: connLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})),
+		ConnContext: ConnContext,
+	}
+	go server.Serve(l)
+	defer server.Close()
+	open := testutil.ToFloat64(openConnections)
+	rejected := testutil.ToFloat64(connectionRejectionsTotal)
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get("http://" + l.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	first, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, func() bool { return testutil.ToFloat64(openConnections)-open == 1 }) {
+		t.Fatal("open_connections did not count the first connection")
+	}
+	resp := get(geocodePath)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("second connection: status %d, want 503 with Retry-After", resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(connectionRejectionsTotal) - rejected; got != 1 {
+		t.Errorf("counted %v rejections, want 1", got)
+	}
+	if resp := get("/health"); resp.StatusCode != http.StatusOK {
+		t.Errorf("health check beyond MAX_CONNECTIONS: status %d, want 200", resp.StatusCode)
+	}
+
+	first.Close()
+	if !waitFor(t, func() bool { return testutil.ToFloat64(openConnections) == open }) {
+		t.Fatal("open_connections did not drop once the connections were closed")
+	}
+	if resp := get(geocodePath); resp.StatusCode != http.StatusOK {
+		t.Errorf("after the first connection closed: status %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,82 @@
+package geocache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// logDeduper limits how often the same message template is logged. Within a
+// window, the first burst occurrences of a template are written; the rest are
+// counted and summarized in a single record when the window ends.
+type logDeduper struct {
+	burst  int
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+func newLogDeduper(burst int, window time.Duration) *logDeduper {
+	if burst <= 0 || window <= 0 {
+		return nil
+	}
+	return &logDeduper{burst: burst, window: window, entries: make(map[string]*dedupEntry)}
+}
+
+// allow records an occurrence of key and reports whether it should be
+// logged. The first suppressed occurrence in a window schedules summarize to
+// run when the window ends with the number of suppressed occurrences.
+func (d *logDeduper) allow(key string, summarize func(suppressed int, window time.Duration)) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	e, ok := d.entries[key]
+	if !ok || now.Sub(e.start) >= d.window {
+		if ok && e.suppressed > 0 {
+			// The summary is pending; let it report this window first.
+			e.suppressed++
+			return false
+		}
+		d.entries[key] = &dedupEntry{start: now, count: 1}
+		return true
+	}
+
+	e.count++
+	if e.count <= d.burst {
+		return true
+	}
+	e.suppressed++
+	if e.suppressed == 1 {
+		time.AfterFunc(e.start.Add(d.window).Sub(now), func() {
+			d.mu.Lock()
+			suppressed := e.suppressed
+			delete(d.entries, key)
+			d.mu.Unlock()
+			summarize(suppressed, d.window)
+		})
+	}
+	return false
+}
+
+// logDeduplicated writes a WARNING-or-above record unless its template has
+// exceeded the deduper's burst in the current window.
+func (l *Logger) logDeduplicated(severity LogSeverity, format string, v []interface{}) bool {
+	if l.dedup == nil || severityLevel(severity) < severityLevel(LogWarning) {
+		return true
+	}
+	key := l.componentName + "\x00" + string(severity) + "\x00" + format
+	return l.dedup.allow(key, func(suppressed int, window time.Duration) {
+		logMessagesSuppressedTotal.WithLabelValues(string(severity)).Add(float64(suppressed))
+		msg := fmt.Sprintf("suppressed %d similar messages in %s: %s", suppressed, window, fmt.Sprintf(format, v...))
+		l.slog.Log(context.Background(), severityLevel(severity), msg)
+	})
+}
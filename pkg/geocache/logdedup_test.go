@@ -0,0 +1,88 @@
+package geocache
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer guards a bytes.Buffer written from the summary timer goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogDeduplication(t *testing.T) {
+	tests := []struct {
+		name        string
+		severity    LogSeverity
+		count       int
+		wantLines   int
+		wantSummary string
+	}{
+		{
+			name:        "warnings beyond burst are summarized",
+			severity:    LogWarning,
+			count:       5,
+			wantLines:   3,
+			wantSummary: "suppressed 3 similar messages in 50ms: Failed to cache response: redis down",
+		},
+		{
+			name:      "warnings within burst are all logged",
+			severity:  LogError,
+			count:     2,
+			wantLines: 2,
+		},
+		{
+			name:      "info is never suppressed",
+			severity:  LogInfo,
+			count:     5,
+			wantLines: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf syncBuffer
+			logger := newLogger(LogFormatJSON, &buf, slog.LevelDebug, nil)
+			logger.dedup = newLogDeduper(2, 50*time.Millisecond)
+
+			for i := 0; i < tt.count; i++ {
+				logger.Log(tt.severity, "Failed to cache response: %v", "redis down")
+			}
+			time.Sleep(150 * time.Millisecond)
+
+			out := buf.String()
+			if lines := strings.Count(out, "\n"); lines != tt.wantLines {
+				t.Errorf("Expected %d log lines, got %d: %s", tt.wantLines, lines, out)
+			}
+			if tt.wantSummary != "" && !strings.Contains(out, tt.wantSummary) {
+				t.Errorf("Expected summary %q, got: %s", tt.wantSummary, out)
+			}
+		})
+	}
+}
+
+func TestNewLogDeduper_Disabled(t *testing.T) {
+	if d := newLogDeduper(0, time.Minute); d != nil {
+		t.Errorf("Expected burst 0 to disable deduplication")
+	}
+	if d := newLogDeduper(10, 0); d != nil {
+		t.Errorf("Expected window 0 to disable deduplication")
+	}
+}
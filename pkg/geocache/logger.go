@@ -0,0 +1,313 @@
+package geocache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type LogSeverity string
+
+const (
+	LogDebug    LogSeverity = "DEBUG"
+	LogInfo     LogSeverity = "INFO"
+	LogWarning  LogSeverity = "WARNING"
+	LogError    LogSeverity = "ERROR"
+	LogCritical LogSeverity = "CRITICAL"
+)
+
+// LevelCritical is the slog level used for LogCritical.
+const LevelCritical = slog.Level(12)
+
+// Log formats accepted in Config.LogFormat.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+	LogFormatGCP  = "gcp"
+	// LogFormatCloudLogging sends records to the Cloud Logging API instead
+	// of stdout.
+	LogFormatCloudLogging = "cloudlogging"
+)
+
+// Logger writes log records through a slog.Handler. Records below the
+// logger's minimum level are dropped; component loggers created with
+// Component can have their own minimum level. Repeated warnings and errors
+// are suppressed when deduplication is configured.
+type Logger struct {
+	slog          *slog.Logger
+	format        string
+	level         slog.Level
+	components    map[string]slog.Level
+	componentName string
+	dedup         *logDeduper
+	// cloud is the Cloud Logging writer of LogFormatCloudLogging loggers.
+	cloud *cloudLoggingWriter
+}
+
+// NewLogger creates an INFO-level logger writing GCP structured JSON when
+// useGCP is set and plain text otherwise.
+func NewLogger(useGCP bool) *Logger {
+	format := LogFormatText
+	if useGCP {
+		format = LogFormatGCP
+	}
+	return newLogger(format, os.Stdout, slog.LevelInfo, nil)
+}
+
+// NewLoggerFromConfig creates a logger honoring Config.LogFormat,
+// Config.LogLevel, Config.LogComponentLevels and the Config.LogDedup*
+// settings.
+func NewLoggerFromConfig(config Config) *Logger {
+	level, _ := parseLogLevel(config.LogLevel)
+	components := make(map[string]slog.Level, len(config.LogComponentLevels))
+	for name, l := range config.LogComponentLevels {
+		if parsed, ok := parseLogLevel(l); ok {
+			components[name] = parsed
+		}
+	}
+	var l *Logger
+	if config.LogFormat == LogFormatCloudLogging {
+		cloud := newCloudLoggingWriter(config)
+		l = newLoggerWithHandler(LogFormatCloudLogging, newCloudLoggingHandler(cloud), level, components)
+		l.cloud = cloud
+	} else {
+		l = newLogger(config.LogFormat, os.Stdout, level, components)
+	}
+	l.dedup = newLogDeduper(config.LogDedupBurst, config.LogDedupWindow)
+	return l
+}
+
+// Flush waits until buffered records have been delivered. Only loggers
+// writing to the Cloud Logging API buffer records.
+func (l *Logger) Flush() {
+	if l.cloud != nil {
+		l.cloud.Flush()
+	}
+}
+
+// NewLoggerWithHandler creates a logger writing through a custom handler.
+// Level filtering is left to the handler.
+func NewLoggerWithHandler(handler slog.Handler) *Logger {
+	return &Logger{
+		slog:   slog.New(&contextHandler{handler}),
+		format: LogFormatJSON,
+		level:  slog.LevelDebug,
+	}
+}
+
+func newLogger(format string, w io.Writer, level slog.Level, components map[string]slog.Level) *Logger {
+	var handler slog.Handler
+	switch format {
+	case LogFormatGCP:
+		handler = newGCPHandler(w)
+	case LogFormatJSON:
+		handler = slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: replaceLevelName})
+	default:
+		format = LogFormatText
+		handler = &textHandler{}
+	}
+	return newLoggerWithHandler(format, handler, level, components)
+}
+
+func newLoggerWithHandler(format string, handler slog.Handler, level slog.Level, components map[string]slog.Level) *Logger {
+	return &Logger{
+		slog:       slog.New(&contextHandler{handler}),
+		format:     format,
+		level:      level,
+		components: components,
+	}
+}
+
+// Component returns a logger tagging its records with component=name. Its
+// minimum level is the one configured for the component, if any.
+func (l *Logger) Component(name string) *Logger {
+	c := *l
+	c.slog = l.slog.With("component", name)
+	c.componentName = name
+	if level, ok := l.components[name]; ok {
+		c.level = level
+	}
+	return &c
+}
+
+// structured reports whether records are written as JSON.
+func (l *Logger) structured() bool {
+	return l.format != LogFormatText
+}
+
+// Enabled reports whether records of the given severity are written.
+func (l *Logger) Enabled(severity LogSeverity) bool {
+	return severityLevel(severity) >= l.level
+}
+
+func (l *Logger) Log(severity LogSeverity, format string, v ...interface{}) {
+	l.LogContext(context.Background(), severity, format, v...)
+}
+
+// LogContext logs like Log, adding the attributes attached to ctx with
+// ContextWithLogAttrs.
+func (l *Logger) LogContext(ctx context.Context, severity LogSeverity, format string, v ...interface{}) {
+	if !l.Enabled(severity) || !l.logDeduplicated(severity, format, v) {
+		return
+	}
+	l.slog.Log(ctx, severityLevel(severity), fmt.Sprintf(format, v...))
+}
+
+// LogAttrs logs msg with structured attributes.
+func (l *Logger) LogAttrs(ctx context.Context, severity LogSeverity, msg string, attrs ...slog.Attr) {
+	if !l.Enabled(severity) {
+		return
+	}
+	l.slog.LogAttrs(ctx, severityLevel(severity), msg, attrs...)
+}
+
+type logAttrsKey struct{}
+
+// ContextWithLogAttrs returns a context whose log records carry attrs in
+// addition to any attributes already attached to ctx.
+func ContextWithLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(existing)+len(attrs))
+	merged = append(merged, existing...)
+	merged = append(merged, attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, merged)
+}
+
+// contextHandler adds the attributes stored in the record's context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+// newGCPHandler writes JSON records in the format expected by Google Cloud
+// Logging: "severity", "message" and "timestamp" fields.
+func newGCPHandler(w io.Writer) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.LevelKey:
+				return slog.String("severity", string(levelSeverity(a.Value.Any().(slog.Level))))
+			case slog.MessageKey:
+				a.Key = "message"
+			case slog.TimeKey:
+				a.Key = "timestamp"
+			}
+			return a
+		},
+	})
+}
+
+// replaceLevelName renders LevelCritical as "CRITICAL" instead of "ERROR+4".
+func replaceLevelName(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.LevelKey {
+		if level := a.Value.Any().(slog.Level); level >= LevelCritical {
+			return slog.String(slog.LevelKey, string(LogCritical))
+		}
+	}
+	return a
+}
+
+// textHandler writes plain lines through the standard log package, so they
+// get its timestamp prefix and honor log.SetOutput.
+type textHandler struct {
+	attrs []slog.Attr
+}
+
+func (h *textHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	if r.Level != slog.LevelInfo {
+		b.WriteString(string(levelSeverity(r.Level)))
+		b.WriteString(" ")
+	}
+	b.WriteString(r.Message)
+	for _, a := range h.attrs {
+		b.WriteString(" " + a.String())
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		b.WriteString(" " + a.String())
+		return true
+	})
+	return log.Output(4, b.String())
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &textHandler{attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *textHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func severityLevel(severity LogSeverity) slog.Level {
+	switch severity {
+	case LogDebug:
+		return slog.LevelDebug
+	case LogWarning:
+		return slog.LevelWarn
+	case LogError:
+		return slog.LevelError
+	case LogCritical:
+		return LevelCritical
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func levelSeverity(level slog.Level) LogSeverity {
+	switch {
+	case level >= LevelCritical:
+		return LogCritical
+	case level >= slog.LevelError:
+		return LogError
+	case level >= slog.LevelWarn:
+		return LogWarning
+	case level >= slog.LevelInfo:
+		return LogInfo
+	default:
+		return LogDebug
+	}
+}
+
+// parseLogLevel parses a LOG_LEVEL value. Unknown values select INFO.
+func parseLogLevel(s string) (slog.Level, bool) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "DEBUG":
+		return slog.LevelDebug, true
+	case "INFO", "":
+		return slog.LevelInfo, true
+	case "WARN", "WARNING":
+		return slog.LevelWarn, true
+	case "ERROR":
+		return slog.LevelError, true
+	case "CRITICAL":
+		return LevelCritical, true
+	default:
+		return slog.LevelInfo, false
+	}
+}
@@ -0,0 +1,340 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		useGCP   bool
+		severity LogSeverity
+		format   string
+		args     []interface{}
+	}{
+		{
+			name:     "Standard logging INFO",
+			useGCP:   false,
+			severity: LogInfo,
+			format:   "Test message %s",
+			args:     []interface{}{"info"},
+		},
+		{
+			name:     "Standard logging ERROR",
+			useGCP:   false,
+			severity: LogError,
+			format:   "Test error %s",
+			args:     []interface{}{"error"},
+		},
+		{
+			name:     "Standard logging WARNING",
+			useGCP:   false,
+			severity: LogWarning,
+			format:   "Test warning %s",
+			args:     []interface{}{"warning"},
+		},
+		{
+			name:     "Standard logging CRITICAL",
+			useGCP:   false,
+			severity: LogCritical,
+			format:   "Test critical %s",
+			args:     []interface{}{"critical"},
+		},
+		{
+			name:     "GCP logging INFO",
+			useGCP:   true,
+			severity: LogInfo,
+			format:   "Test info %s",
+			args:     []interface{}{"info"},
+		},
+		{
+			name:     "GCP logging WARNING",
+			useGCP:   true,
+			severity: LogWarning,
+			format:   "Test warning %s",
+			args:     []interface{}{"warning"},
+		},
+		{
+			name:     "GCP logging ERROR",
+			useGCP:   true,
+			severity: LogError,
+			format:   "Test error %s",
+			args:     []interface{}{"error"},
+		},
+		{
+			name:     "GCP logging CRITICAL",
+			useGCP:   true,
+			severity: LogCritical,
+			format:   "Test critical %s",
+			args:     []interface{}{"critical"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := NewLogger(tt.useGCP)
+			logger.Log(tt.severity, tt.format, tt.args...)
+		})
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name       string
+		useGCP     bool
+		wantFormat string
+	}{
+		{
+			name:       "Standard logger",
+			useGCP:     false,
+			wantFormat: LogFormatText,
+		},
+		{
+			name:       "GCP logger",
+			useGCP:     true,
+			wantFormat: LogFormatGCP,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := NewLogger(tt.useGCP)
+			if logger.format != tt.wantFormat {
+				t.Errorf("NewLogger() format = %v, want %v", logger.format, tt.wantFormat)
+			}
+		})
+	}
+}
+
+func TestGCPLogFormat(t *testing.T) {
+	tests := []struct {
+		severity LogSeverity
+	}{
+		{LogDebug},
+		{LogInfo},
+		{LogWarning},
+		{LogError},
+		{LogCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.severity), func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := newLogger(LogFormatGCP, &buf, slog.LevelDebug, nil)
+			logger.Log(tt.severity, "Test %s", "message")
+
+			var decoded map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("Failed to unmarshal log entry %q: %v", buf.String(), err)
+			}
+			if decoded["message"] != "Test message" {
+				t.Errorf("message = %v, want %v", decoded["message"], "Test message")
+			}
+			if decoded["severity"] != string(tt.severity) {
+				t.Errorf("severity = %v, want %v", decoded["severity"], tt.severity)
+			}
+			if _, ok := decoded["timestamp"]; !ok {
+				t.Errorf("Expected timestamp field, got %v", decoded)
+			}
+		})
+	}
+}
+
+func TestLoggerLevelFiltering(t *testing.T) {
+	tests := []struct {
+		name      string
+		level     string
+		component string
+		levels    map[string]string
+		severity  LogSeverity
+		wantLog   bool
+	}{
+		{name: "info passes at info", level: "info", severity: LogInfo, wantLog: true},
+		{name: "debug dropped at info", level: "info", severity: LogDebug, wantLog: false},
+		{name: "debug passes at debug", level: "debug", severity: LogDebug, wantLog: true},
+		{name: "warning dropped at error", level: "error", severity: LogWarning, wantLog: false},
+		{name: "critical passes at error", level: "error", severity: LogCritical, wantLog: true},
+		{name: "unknown level selects info", level: "loud", severity: LogInfo, wantLog: true},
+		{
+			name:      "component level overrides default",
+			level:     "error",
+			component: "upstream",
+			levels:    map[string]string{"upstream": "debug"},
+			severity:  LogDebug,
+			wantLog:   true,
+		},
+		{
+			name:      "other components keep default",
+			level:     "error",
+			component: "access",
+			levels:    map[string]string{"upstream": "debug"},
+			severity:  LogInfo,
+			wantLog:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := NewLoggerFromConfig(Config{LogFormat: LogFormatJSON, LogLevel: tt.level, LogComponentLevels: tt.levels})
+			logger = newLogger(LogFormatJSON, &buf, logger.level, logger.components)
+			if tt.component != "" {
+				logger = logger.Component(tt.component)
+			}
+			logger.Log(tt.severity, "hello")
+
+			if got := buf.Len() > 0; got != tt.wantLog {
+				t.Errorf("logged = %v, want %v (output %q)", got, tt.wantLog, buf.String())
+			}
+		})
+	}
+}
+
+func TestLoggerContextAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(LogFormatJSON, &buf, slog.LevelInfo, nil).Component("upstream")
+
+	ctx := ContextWithLogAttrs(context.Background(), slog.String("request_id", "abc123"))
+	ctx = ContextWithLogAttrs(ctx, slog.String("endpoint", geocodePath))
+	logger.LogContext(ctx, LogWarning, "upstream slow")
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal log entry %q: %v", buf.String(), err)
+	}
+	want := map[string]string{
+		"msg":        "upstream slow",
+		"level":      "WARN",
+		"component":  "upstream",
+		"request_id": "abc123",
+		"endpoint":   geocodePath,
+	}
+	for k, v := range want {
+		if decoded[k] != v {
+			t.Errorf("%s = %v, want %v", k, decoded[k], v)
+		}
+	}
+}
+
+func TestLoggerMiddlewareOutput(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		remoteAddr    string
+		xForwardedFor string
+		referer       string
+		requestID     string
+		logRequestURI bool
+		wantIP        string
+		wantReferrer  string
+		wantURI       interface{}
+	}{
+		{
+			name:       "remote addr",
+			method:     "GET",
+			path:       "/test",
+			remoteAddr: "192.168.1.1:1234",
+			wantIP:     "192.168.1.1:1234",
+		},
+		{
+			name:       "IPv4-mapped remote addr",
+			method:     "GET",
+			path:       "/test",
+			remoteAddr: "[::ffff:192.168.1.1]:1234",
+			wantIP:     "192.168.1.1:1234",
+		},
+		{
+			name:          "IPv6 X-Forwarded-For chain",
+			method:        "GET",
+			path:          "/test",
+			remoteAddr:    "[2001:db8::1]:1234",
+			xForwardedFor: "[2001:DB8::0:2]:5678,::ffff:10.0.0.1",
+			wantIP:        "[2001:db8::2]:5678, 10.0.0.1",
+		},
+		{
+			name:          "X-Forwarded-For and referrer",
+			method:        "POST",
+			path:          "/api/test",
+			remoteAddr:    "192.168.1.1:1234",
+			xForwardedFor: "10.0.0.1",
+			referer:       "https://example.com/page",
+			requestID:     "req-1",
+			wantIP:        "10.0.0.1",
+			wantReferrer:  "example.com",
+		},
+		{
+			name:          "request URI without key",
+			method:        "GET",
+			path:          "/maps/api/geocode/json?address=Main+St&key=secret",
+			remoteAddr:    "192.168.1.1:1234",
+			logRequestURI: true,
+			wantIP:        "192.168.1.1:1234",
+			wantURI:       "/maps/api/geocode/json?address=Main+St",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := newLogger(LogFormatGCP, &buf, slog.LevelInfo, nil)
+			config := Config{
+				BaseURL:       "https://maps.googleapis.com",
+				CacheTimeout:  time.Hour,
+				LogRequestURI: tt.logRequestURI,
+			}
+			server := NewServer(logger, nil, config, nil)
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xForwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.xForwardedFor)
+			}
+			if tt.referer != "" {
+				req.Header.Set("Referer", tt.referer)
+			}
+			if tt.requestID != "" {
+				req.Header.Set("X-Request-ID", tt.requestID)
+			}
+
+			rr := httptest.NewRecorder()
+			handler := server.logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			handler.ServeHTTP(rr, req)
+
+			var decoded map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("Failed to unmarshal log entry %q: %v", buf.String(), err)
+			}
+			if want := strings.Join([]string{tt.method, req.URL.Path}, " "); decoded["message"] != want {
+				t.Errorf("message = %v, want %v", decoded["message"], want)
+			}
+			if decoded["ip"] != tt.wantIP {
+				t.Errorf("ip = %v, want %v", decoded["ip"], tt.wantIP)
+			}
+			if decoded["referrer"] != tt.wantReferrer {
+				t.Errorf("referrer = %v, want %v", decoded["referrer"], tt.wantReferrer)
+			}
+			if decoded["endpoint"] != req.URL.Path {
+				t.Errorf("endpoint = %v, want %v", decoded["endpoint"], req.URL.Path)
+			}
+			if decoded["uri"] != tt.wantURI {
+				t.Errorf("uri = %v, want %v", decoded["uri"], tt.wantURI)
+			}
+			requestID := rr.Header().Get("X-Request-ID")
+			if tt.requestID != "" && requestID != tt.requestID {
+				t.Errorf("X-Request-ID = %v, want %v", requestID, tt.requestID)
+			}
+			if requestID == "" || decoded["request_id"] != requestID {
+				t.Errorf("request_id = %v, want X-Request-ID %q", decoded["request_id"], requestID)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package geocache
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// hotKeysTrimProbability is the chance that a counted hit also trims the hit
+// counts down to HotKeysMax entries.
+const hotKeysTrimProbability = 0.01
+
+// entryLookup is an entry read with its metadata.
+type entryLookup struct {
+	// value is nil for missing entries.
+	value []byte
+	// ttl is the remaining lifetime of the entry, 0 if it never expires or
+	// the store does not report it.
+	ttl time.Duration
+	// storedAt is when the body was written, for hash entries.
+	storedAt time.Time
+	// hits is the hit count of the counted entry, including this hit.
+	hits int64
+}
+
+// lookupOptions are the updates a lookup makes on the entries it finds.
+type lookupOptions struct {
+	// hitsKey is the sorted set counting the hits of entries, or empty for
+	// no counting.
+	hitsKey string
+	// counted is the key whose hit is counted when it is found.
+	counted string
+	// trim, when positive, trims hitsKey to the entries with the most hits.
+	trim int
+}
+
+// entryLooker is implemented by the stores reading entries with their
+// metadata and counting hits in a single round trip, keeping the hit path at
+// one round trip as per-hit updates are added.
+type entryLooker interface {
+	lookup(ctx context.Context, keys []string, opts lookupOptions) ([]entryLookup, error)
+}
+
+// lookupEntries reads keys from store with their metadata. Stores other than
+// the package's are read with Get, without metadata or hit counts.
+func lookupEntries(ctx context.Context, store CacheStore, keys []string, opts lookupOptions) ([]entryLookup, error) {
+	if l, ok := store.(entryLooker); ok {
+		return l.lookup(ctx, keys, opts)
+	}
+	values, err := store.Get(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]entryLookup, len(values))
+	for i, v := range values {
+		entries[i].value = v
+	}
+	return entries, nil
+}
+
+// lookupScript reads KEYS, whether stored as strings or as hashes, and
+// returns for each its value, its PTTL, its stored_at field and its hit
+// count. Content-addressed pointers are returned as they are, to be resolved
+// with the blob keys they name. The hits of KEYS[ARGV[2]] are counted in the
+// sorted set ARGV[1] when it is set, which is then trimmed to the ARGV[3]
+// members with the most hits when ARGV[3] is positive.
+var lookupScript = redis.NewScript(hashEntryGet + `
+local out = {}
+for i, key in ipairs(KEYS) do
+	local entry = {false, 0, false, 0}
+	local value = getEntry(key)
+	if value then
+		entry[1] = value
+		entry[2] = redis.call('PTTL', key)
+		if redis.call('TYPE', key).ok == 'hash' then
+			entry[3] = redis.call('HGET', key, 'stored_at')
+		end
+		if ARGV[1] ~= '' and key == ARGV[2] then
+			entry[4] = redis.call('ZINCRBY', ARGV[1], 1, key)
+		end
+	end
+	out[i] = entry
+end
+local trim = tonumber(ARGV[3])
+if ARGV[1] ~= '' and trim > 0 then
+	redis.call('ZREMRANGEBYRANK', ARGV[1], 0, -trim - 1)
+end
+return out
+`)
+
+func (s *redisStore) lookup(ctx context.Context, keys []string, opts lookupOptions) ([]entryLookup, error) {
+	results, err := lookupScript.Run(ctx, s.client, keys,
+		opts.hitsKey, opts.counted, opts.trim,
+	).Slice()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]entryLookup, len(keys))
+	for i, r := range results {
+		fields, _ := r.([]interface{})
+		if len(fields) != 4 {
+			continue
+		}
+		str, ok := fields[0].(string)
+		if !ok {
+			continue
+		}
+		e := &entries[i]
+		e.value = []byte(str)
+		// PTTL is -1 for entries without an expiry.
+		if ms, _ := fields[1].(int64); ms > 0 {
+			e.ttl = time.Duration(ms) * time.Millisecond
+		}
+		if str, ok := fields[2].(string); ok {
+			if ms, err := strconv.ParseInt(str, 10, 64); err == nil && ms > 0 {
+				e.storedAt = time.UnixMilli(ms)
+			}
+		}
+		if str, ok := fields[3].(string); ok {
+			hits, _ := strconv.ParseFloat(str, 64)
+			e.hits = int64(hits)
+		}
+	}
+	values := make([][]byte, len(entries))
+	for i := range entries {
+		values[i] = entries[i].value
+	}
+	if err := s.resolve(ctx, values); err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if values[i] == nil {
+			entries[i] = entryLookup{}
+		} else {
+			entries[i].value = values[i]
+		}
+	}
+	return entries, nil
+}
+
+// hitsKey is the sorted set counting the hits of cache entries, with
+// CACHE_HIT_COUNTS.
+func (s *Server) hitsKey() string {
+	return s.redisKey("hits")
+}
+
+// lookupOptions counts the hit of cacheKey when CACHE_HIT_COUNTS is set.
+func (s *Server) lookupOptions(cacheKey string) lookupOptions {
+	if !s.config.CacheHitCounts {
+		return lookupOptions{}
+	}
+	opts := lookupOptions{hitsKey: s.hitsKey(), counted: cacheKey}
+	if s.config.HotKeysMax > 0 && rand.Float64() < hotKeysTrimProbability {
+		opts.trim = s.config.HotKeysMax
+	}
+	return opts
+}
+
+type keyHits struct {
+	Key  string `json:"key"`
+	Hits int64  `json:"hits"`
+	// URI is the request the entry answers, when stored with
+	// CACHE_STORE_URI.
+	URI string `json:"uri,omitempty"`
+}
+
+// handleHotKeys lists the cache entries with the most hits, with the
+// requests they answer when known.
+func (s *Server) handleHotKeys(w http.ResponseWriter, r *http.Request) {
+	n := 10
+	if v := r.URL.Query().Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "n must be a positive integer"})
+			return
+		}
+		n = parsed
+	}
+
+	top, err := s.redis.ZRevRangeWithScores(r.Context(), s.hitsKey(), 0, int64(n-1)).Result()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	keys := make([]keyHits, 0, len(top))
+	names := make([]string, 0, len(top))
+	for _, z := range top {
+		keys = append(keys, keyHits{Key: z.Member.(string), Hits: int64(z.Score)})
+		names = append(names, z.Member.(string))
+	}
+	if len(names) > 0 {
+		values, err := s.store.Get(r.Context(), names...)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		for i, raw := range values {
+			if header, _, err := decodeEntryHeader(raw); err == nil {
+				keys[i].URI = header.URI
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
@@ -0,0 +1,109 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisStore_Lookup(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to create miniredis: %v", err)
+	}
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	ctx := context.Background()
+
+	body := []byte(`{"status":"OK","results":[]}`)
+	newRedisStore(rdb, "test", false).Set(ctx, "test:string", body, time.Hour)
+	newRedisStore(rdb, "test", true).Set(ctx, "test:pointer", body, 2*time.Hour)
+	hashes := newRedisStore(rdb, "test", false)
+	hashes.hashEntries = true
+	hashes.Set(ctx, "test:hash", body, 0)
+
+	store := newRedisStore(rdb, "test", false)
+	keys := []string{"test:string", "test:pointer", "test:hash", "test:missing"}
+	entries, err := store.lookup(ctx, keys, lookupOptions{hitsKey: "test:hits", counted: "test:hash"})
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	for i, e := range entries[:3] {
+		if string(e.value) != string(body) {
+			t.Errorf("Expected %s to be read, got %q", keys[i], e.value)
+		}
+	}
+	if entries[3].value != nil {
+		t.Errorf("Expected a missing entry, got %q", entries[3].value)
+	}
+	if entries[0].ttl != time.Hour || entries[1].ttl != 2*time.Hour || entries[2].ttl != 0 {
+		t.Errorf("Unexpected TTLs %v, %v, %v", entries[0].ttl, entries[1].ttl, entries[2].ttl)
+	}
+	if !entries[0].storedAt.IsZero() || entries[2].storedAt.IsZero() {
+		t.Errorf("Expected stored_at for the hash entry only, got %v, %v", entries[0].storedAt, entries[2].storedAt)
+	}
+	if entries[0].hits != 0 || entries[2].hits != 1 {
+		t.Errorf("Expected the hit of the counted entry only, got %d, %d", entries[0].hits, entries[2].hits)
+	}
+
+	// Missing entries are not counted, and the counts are trimmed to the
+	// entries with the most hits.
+	store.lookup(ctx, keys, lookupOptions{hitsKey: "test:hits", counted: "test:missing"})
+	store.lookup(ctx, keys, lookupOptions{hitsKey: "test:hits", counted: "test:string"})
+	entries, _ = store.lookup(ctx, keys, lookupOptions{hitsKey: "test:hits", counted: "test:hash", trim: 1})
+	if entries[2].hits != 2 {
+		t.Errorf("Expected 2 hits, got %d", entries[2].hits)
+	}
+	if members, _ := mr.ZMembers("test:hits"); len(members) != 1 || members[0] != "test:hash" {
+		t.Errorf("Expected the counts to be trimmed to test:hash, got %v", members)
+	}
+}
+
+func TestServer_Query_HitCounts(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.CacheHitCounts = true
+	server.config.CacheStoreURI = true
+	server.config.CacheDebugCIDRs = []string{"192.0.2.0/24"}
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	transport := &recordingTransport{body: `{"status":"OK","results":[]}`}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, prometheusSink{})
+	handler := server.routes()
+
+	var w *httptest.ResponseRecorder
+	var req *http.Request
+	for range 3 {
+		req = httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(cacheDebugHeader, "true")
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+	}
+	if got := w.Header().Get("X-Cache-Debug-Hits"); got != "2" {
+		t.Errorf("Expected 2 hits, got %q", got)
+	}
+	if got := w.Header().Get("X-Cache-Debug-TTL"); got != "3600" {
+		t.Errorf("Expected TTL 3600, got %q", got)
+	}
+
+	cacheKey := server.cacheKey(req)
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/hotkeys?n=5", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var keys []keyHits
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil {
+		t.Fatalf("Failed to decode hot keys %d: %s", w.Code, w.Body.String())
+	}
+	if len(keys) != 1 || keys[0].Key != cacheKey || keys[0].Hits != 2 || keys[0].URI != geocodePath+"?address=Main" {
+		t.Errorf("Unexpected hot keys %+v", keys)
+	}
+}
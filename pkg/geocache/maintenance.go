@@ -0,0 +1,135 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Maintenance modes. In cache-only mode, requests that would go upstream are
+// rejected; in unavailable mode every proxied request is. Health, metrics
+// and the admin API are always served.
+const (
+	MaintenanceOff         = "off"
+	MaintenanceCacheOnly   = "cache-only"
+	MaintenanceUnavailable = "unavailable"
+)
+
+// maintenanceSyncInterval is how often instances pick up a mode set through
+// another instance.
+const maintenanceSyncInterval = 5 * time.Second
+
+// maintenanceState is the current maintenance mode and who set it.
+type maintenanceState struct {
+	Mode   string    `json:"mode"`
+	Reason string    `json:"reason,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+func validMaintenanceMode(mode string) bool {
+	return mode == MaintenanceOff || mode == MaintenanceCacheOnly || mode == MaintenanceUnavailable
+}
+
+func (s *Server) maintenanceKey() string {
+	return s.redisKey("maintenance")
+}
+
+// maintenanceState returns the mode in effect, Config.MaintenanceMode until
+// one is set through the admin API.
+func (s *Server) maintenanceState() maintenanceState {
+	if st := s.maintenance.Load(); st != nil {
+		return *st
+	}
+	mode := s.config.MaintenanceMode
+	if !validMaintenanceMode(mode) {
+		mode = MaintenanceOff
+	}
+	return maintenanceState{Mode: mode, Since: s.stats.startedAt}
+}
+
+// syncMaintenance loads the mode shared through Redis. A mode set locally
+// while Redis was being read is kept.
+func (s *Server) syncMaintenance(ctx context.Context) error {
+	current := s.maintenance.Load()
+	data, err := s.redis.Get(ctx, s.maintenanceKey()).Bytes()
+	if errors.Is(err, redis.Nil) {
+		s.maintenance.CompareAndSwap(current, nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var st maintenanceState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	previous := s.maintenanceState()
+	if s.maintenance.CompareAndSwap(current, &st) && previous.Mode != st.Mode {
+		s.logger.Log(LogWarning, "Maintenance mode changed from %s to %s by %s: %s", previous.Mode, st.Mode, st.Actor, st.Reason)
+	}
+	return nil
+}
+
+// runMaintenanceSync keeps the mode in line with the other instances.
+func (s *Server) runMaintenanceSync() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), maintenanceSyncInterval)
+		if err := s.syncMaintenance(ctx); err != nil {
+			s.logger.Log(LogWarning, "Failed to read maintenance mode: %v", err)
+		}
+		cancel()
+		<-s.clock.After(maintenanceSyncInterval)
+	}
+}
+
+// maintenanceMiddleware rejects proxied requests in unavailable mode.
+func (s *Server) maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.maintenanceState().Mode == MaintenanceUnavailable {
+			writeMaintenance(w, MaintenanceUnavailable, "service is down for maintenance")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeMaintenance(w http.ResponseWriter, mode, msg string) {
+	maintenanceRejectionsTotal.WithLabelValues(mode).Inc()
+	w.Header().Set("X-Maintenance-Mode", mode)
+	writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": msg})
+}
+
+func (s *Server) handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.maintenanceState())
+}
+
+// handlePutMaintenance sets the maintenance mode from a JSON body
+// {"mode", "reason"}, for every instance sharing the Redis instance.
+func (s *Server) handlePutMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mode   string `json:"mode"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validMaintenanceMode(req.Mode) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `body must be {"mode": "off"|"cache-only"|"unavailable", "reason": ...}`})
+		return
+	}
+
+	st := maintenanceState{Mode: req.Mode, Reason: req.Reason, Actor: adminActor(r), Since: s.clock.Now().UTC()}
+	if s.redis != nil {
+		data, _ := json.Marshal(st)
+		if err := s.redis.Set(r.Context(), s.maintenanceKey(), data, 0).Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	s.maintenance.Store(&st)
+
+	s.logger.Log(LogWarning, "Maintenance mode set to %s by %s: %s", st.Mode, st.Actor, st.Reason)
+	s.auditLog.Record(st.Actor, AuditMaintenanceSet, map[string]string{"mode": st.Mode, "reason": st.Reason})
+	writeJSON(w, http.StatusOK, st)
+}
@@ -0,0 +1,95 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	transport := &recordingTransport{body: `{"status":"OK","results":[]}`}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	handler := server.routes()
+
+	cached := httptest.NewRequest(http.MethodGet, geocodePath+"?address=cached", nil)
+	mr.Set(server.cacheKey(cached), `{"status":"OK","results":[]}`)
+
+	setMode := func(body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/admin/maintenance", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	if code := setMode(`{"mode":"sometimes"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid mode to be rejected with 400, got %d", code)
+	}
+
+	tests := []struct {
+		mode       string
+		wantHit    int
+		wantMiss   int
+		wantHealth int
+	}{
+		{mode: MaintenanceCacheOnly, wantHit: http.StatusOK, wantMiss: http.StatusServiceUnavailable, wantHealth: http.StatusOK},
+		{mode: MaintenanceUnavailable, wantHit: http.StatusServiceUnavailable, wantMiss: http.StatusServiceUnavailable, wantHealth: http.StatusOK},
+		{mode: MaintenanceOff, wantHit: http.StatusOK, wantMiss: http.StatusOK, wantHealth: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			transport.urls = nil
+			if code := setMode(`{"mode":"` + tt.mode + `","reason":"key rotation"}`); code != http.StatusOK {
+				t.Fatalf("Expected status code 200 setting the mode, got %d", code)
+			}
+			if w := get(geocodePath + "?address=cached"); w.Code != tt.wantHit {
+				t.Errorf("Cached request: expected status code %d, got %d", tt.wantHit, w.Code)
+			}
+			w := get(geocodePath + "?address=uncached-" + tt.mode)
+			if w.Code != tt.wantMiss {
+				t.Errorf("Uncached request: expected status code %d, got %d", tt.wantMiss, w.Code)
+			}
+			if tt.wantMiss == http.StatusServiceUnavailable {
+				if len(transport.urls) != 0 {
+					t.Errorf("Expected no upstream requests, got %d", len(transport.urls))
+				}
+				if got := w.Header().Get("X-Maintenance-Mode"); got != tt.mode {
+					t.Errorf("Expected X-Maintenance-Mode %s, got %s", tt.mode, got)
+				}
+			}
+			if w := get("/health"); w.Code != tt.wantHealth {
+				t.Errorf("Health: expected status code %d, got %d", tt.wantHealth, w.Code)
+			}
+		})
+	}
+
+	// Other instances pick the mode up from Redis.
+	setMode(`{"mode":"cache-only","reason":"billing incident"}`)
+	peer := NewServer(server.logger, server.redis, server.config, nil)
+	if err := peer.syncMaintenance(context.Background()); err != nil {
+		t.Fatalf("Failed to sync maintenance mode: %v", err)
+	}
+	st := peer.maintenanceState()
+	if st.Mode != MaintenanceCacheOnly || st.Reason != "billing incident" {
+		t.Errorf("Expected the peer in cache-only mode, got %+v", st)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/maintenance", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var got maintenanceState
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Mode != MaintenanceCacheOnly {
+		t.Errorf("Expected GET to report cache-only, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,178 @@
+package geocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Key tiers of the distance matrix limits. Requests signed with a Premium
+// Plan client ID are premium; requests with an API key are standard.
+const (
+	matrixTierStandard = "standard"
+	matrixTierPremium  = "premium"
+)
+
+// maxMatrixSide is the most origins, or destinations, Google accepts in a
+// distance matrix request.
+const maxMatrixSide = 25
+
+// matrixLimit bounds the origins and destinations of an upstream distance
+// matrix request.
+type matrixLimit struct {
+	origins      int
+	destinations int
+}
+
+// defaultMatrixLimits are Google's limits of 100 elements per request for
+// API keys, and 625 for Premium Plan client IDs.
+var defaultMatrixLimits = map[string]matrixLimit{
+	matrixTierStandard: {origins: 10, destinations: 10},
+	matrixTierPremium:  {origins: maxMatrixSide, destinations: maxMatrixSide},
+}
+
+// parseMatrixLimits parses Config.DistanceMatrixLimits, key tier to
+// "<origins>x<destinations>", on top of the default limits. Unknown tiers and
+// invalid limits are logged and ignored.
+func parseMatrixLimits(raw map[string]string, logger *Logger) map[string]matrixLimit {
+	limits := make(map[string]matrixLimit, len(defaultMatrixLimits))
+	for tier, limit := range defaultMatrixLimits {
+		limits[tier] = limit
+	}
+	for tier, v := range raw {
+		if _, ok := defaultMatrixLimits[tier]; !ok {
+			logger.Log(LogWarning, "Ignoring DISTANCE_MATRIX_LIMITS of unknown tier %q", tier)
+			continue
+		}
+		o, d, _ := strings.Cut(v, "x")
+		origins, err1 := strconv.Atoi(strings.TrimSpace(o))
+		destinations, err2 := strconv.Atoi(strings.TrimSpace(d))
+		if err1 != nil || err2 != nil || origins < 1 || destinations < 1 || origins > maxMatrixSide || destinations > maxMatrixSide {
+			logger.Log(LogWarning, "Ignoring invalid DISTANCE_MATRIX_LIMITS %q for %s: want <origins>x<destinations>, each from 1 to %d", v, tier, maxMatrixSide)
+			continue
+		}
+		limits[tier] = matrixLimit{origins: origins, destinations: destinations}
+	}
+	return limits
+}
+
+// matrixTier returns the key tier of the upstream request req.
+func (s *Server) matrixTier(req *http.Request) string {
+	if s.config.URLSigningClientID != "" || req.URL.Query().Get("client") != "" {
+		return matrixTierPremium
+	}
+	return matrixTierStandard
+}
+
+// chunk splits values into slices of at most n.
+func chunk(values []string, n int) [][]string {
+	var chunks [][]string
+	for len(values) > n {
+		chunks = append(chunks, values[:n])
+		values = values[n:]
+	}
+	return append(chunks, values)
+}
+
+// matrixPart is the response to one upstream request of a split distance
+// matrix.
+type matrixPart struct {
+	resp *UpstreamResponse
+	err  error
+	body struct {
+		Status               string   `json:"status"`
+		OriginAddresses      []string `json:"origin_addresses"`
+		DestinationAddresses []string `json:"destination_addresses"`
+		Rows                 []struct {
+			Elements []json.RawMessage `json:"elements"`
+		} `json:"rows"`
+	}
+}
+
+// fetchMatrix fetches the upstream response to req. Distance matrix requests
+// with more origins or destinations than the limit of their key tier are
+// split into requests within it, sent concurrently, and their responses
+// merged into one. When a part fails, or is not OK, its response is returned
+// instead. Origins and destinations given as encoded polylines are not split.
+func (s *Server) fetchMatrix(req *http.Request) (*UpstreamResponse, error) {
+	if req.URL.Path != distanceMatrixPath {
+		return s.upstream.Fetch(req)
+	}
+	q := req.URL.Query()
+	origins := strings.Split(q.Get("origins"), "|")
+	destinations := strings.Split(q.Get("destinations"), "|")
+	tier := s.matrixTier(req)
+	limit, ok := s.matrixLimits[tier]
+	if !ok || (len(origins) <= limit.origins && len(destinations) <= limit.destinations) ||
+		strings.HasPrefix(q.Get("origins"), "enc:") || strings.HasPrefix(q.Get("destinations"), "enc:") {
+		return s.upstream.Fetch(req)
+	}
+
+	originChunks := chunk(origins, limit.origins)
+	destinationChunks := chunk(destinations, limit.destinations)
+	parts := make([][]matrixPart, len(originChunks))
+	var wg sync.WaitGroup
+	for i, o := range originChunks {
+		parts[i] = make([]matrixPart, len(destinationChunks))
+		for j, d := range destinationChunks {
+			wg.Add(1)
+			go func(part *matrixPart) {
+				defer wg.Done()
+				partReq := req.Clone(req.Context())
+				pq := partReq.URL.Query()
+				pq.Set("origins", strings.Join(o, "|"))
+				pq.Set("destinations", strings.Join(d, "|"))
+				partReq.URL.RawQuery = pq.Encode()
+				part.resp, part.err = s.upstream.Fetch(partReq)
+				if part.err == nil {
+					json.Unmarshal(plainBody(part.resp.Body), &part.body)
+				}
+			}(&parts[i][j])
+		}
+	}
+	wg.Wait()
+	matrixSplitsTotal.WithLabelValues(tier).Inc()
+	matrixSplitRequestsTotal.WithLabelValues(tier).Add(float64(len(originChunks) * len(destinationChunks)))
+
+	merged := struct {
+		DestinationAddresses []string `json:"destination_addresses"`
+		OriginAddresses      []string `json:"origin_addresses"`
+		Rows                 []struct {
+			Elements []json.RawMessage `json:"elements"`
+		} `json:"rows"`
+		Status string `json:"status"`
+	}{Status: "OK"}
+	for i, row := range parts {
+		for j, part := range row {
+			if part.err != nil || part.resp.StatusCode != http.StatusOK || part.body.Status != "OK" || len(part.body.Rows) != len(originChunks[i]) {
+				return part.resp, part.err
+			}
+			if j == 0 {
+				merged.OriginAddresses = append(merged.OriginAddresses, part.body.OriginAddresses...)
+				merged.Rows = append(merged.Rows, part.body.Rows...)
+			} else {
+				for k, r := range part.body.Rows {
+					base := len(merged.Rows) - len(part.body.Rows)
+					merged.Rows[base+k].Elements = append(merged.Rows[base+k].Elements, r.Elements...)
+				}
+			}
+			if i == 0 {
+				merged.DestinationAddresses = append(merged.DestinationAddresses, part.body.DestinationAddresses...)
+			}
+		}
+	}
+	body, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	resp := *parts[0][0].resp
+	resp.Body = body
+	for _, row := range parts {
+		for _, part := range row {
+			resp.Streamed = resp.Streamed || part.resp.Streamed
+		}
+	}
+	return &resp, nil
+}
@@ -0,0 +1,115 @@
+package geocache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseMatrixLimits(t *testing.T) {
+	limits := parseMatrixLimits(map[string]string{
+		"standard": "5x20",
+		"premium":  "30x30",
+		"gold":     "10x10",
+	}, NewLogger(false))
+	if got := limits[matrixTierStandard]; got != (matrixLimit{origins: 5, destinations: 20}) {
+		t.Errorf("Expected the standard limit 5x20, got %+v", got)
+	}
+	if got := limits[matrixTierPremium]; got != defaultMatrixLimits[matrixTierPremium] {
+		t.Errorf("Expected the invalid premium limit to be ignored, got %+v", got)
+	}
+	if _, ok := limits["gold"]; ok {
+		t.Errorf("Expected the unknown tier to be ignored")
+	}
+}
+
+// matrixTransport answers distance matrix requests with elements naming
+// their origin and destination.
+type matrixTransport struct {
+	mu   sync.Mutex
+	urls []string
+}
+
+func (m *matrixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.mu.Lock()
+	m.urls = append(m.urls, req.URL.String())
+	m.mu.Unlock()
+	q := req.URL.Query()
+	origins := strings.Split(q.Get("origins"), "|")
+	destinations := strings.Split(q.Get("destinations"), "|")
+	var rows []string
+	for _, o := range origins {
+		var elements []string
+		for _, d := range destinations {
+			elements = append(elements, fmt.Sprintf(`{"status":"OK","distance":{"text":"%s-%s"}}`, o, d))
+		}
+		rows = append(rows, `{"elements":[`+strings.Join(elements, ",")+`]}`)
+	}
+	originsJSON, _ := json.Marshal(origins)
+	destinationsJSON, _ := json.Marshal(destinations)
+	body := fmt.Sprintf(`{"destination_addresses":%s,"origin_addresses":%s,"rows":[%s],"status":"OK"}`, destinationsJSON, originsJSON, strings.Join(rows, ","))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func TestServer_Query_SplitsDistanceMatrix(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.matrixLimits = parseMatrixLimits(map[string]string{"standard": "2x2"}, server.logger)
+	transport := &matrixTransport{}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+	splits := testutil.ToFloat64(matrixSplitsTotal.WithLabelValues(matrixTierStandard))
+
+	w := httptest.NewRecorder()
+	server.query(w, httptest.NewRequest(http.MethodGet, distanceMatrixPath+"?origins=A|B|C&destinations=X|Y|Z", nil))
+	if len(transport.urls) != 4 {
+		t.Errorf("Expected 4 upstream requests, got %d", len(transport.urls))
+	}
+	if got := testutil.ToFloat64(matrixSplitsTotal.WithLabelValues(matrixTierStandard)) - splits; got != 1 {
+		t.Errorf("Expected 1 split, got %v", got)
+	}
+
+	var resp struct {
+		OriginAddresses      []string `json:"origin_addresses"`
+		DestinationAddresses []string `json:"destination_addresses"`
+		Rows                 []struct {
+			Elements []struct {
+				Distance struct {
+					Text string `json:"text"`
+				} `json:"distance"`
+			} `json:"elements"`
+		} `json:"rows"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response %s: %v", w.Body.String(), err)
+	}
+	if strings.Join(resp.OriginAddresses, "|") != "A|B|C" || strings.Join(resp.DestinationAddresses, "|") != "X|Y|Z" {
+		t.Errorf("Unexpected addresses %v, %v", resp.OriginAddresses, resp.DestinationAddresses)
+	}
+	var cells []string
+	for _, row := range resp.Rows {
+		for _, el := range row.Elements {
+			cells = append(cells, el.Distance.Text)
+		}
+	}
+	if got := strings.Join(cells, " "); got != "A-X A-Y A-Z B-X B-Y B-Z C-X C-Y C-Z" {
+		t.Errorf("Expected the merged matrix, got %s", got)
+	}
+
+	// Requests within the limit are sent as they are.
+	transport.urls = nil
+	server.query(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, distanceMatrixPath+"?origins=A|B&destinations=X", nil))
+	if len(transport.urls) != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", len(transport.urls))
+	}
+}
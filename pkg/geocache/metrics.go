@@ -0,0 +1,748 @@
+package geocache
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// responseSizeBuckets spans 256 B to 4 MiB.
+var responseSizeBuckets = prometheus.ExponentialBuckets(256, 4, 8)
+
+// Default latency buckets. Redis round trips are usually well under a
+// millisecond, while directions and distance matrix misses can take seconds.
+var (
+	defaultHTTPDurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	defaultRedisLatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+)
+
+// The latency histograms are replaced when a server is configured with other
+// buckets, so they are read through atomic pointers.
+var (
+	httpRequestDuration atomic.Pointer[prometheus.HistogramVec]
+	redisLatency        atomic.Pointer[prometheus.HistogramVec]
+	histogramsMu        sync.Mutex
+	currentHTTPBuckets  []float64
+	currentRedisBuckets []float64
+)
+
+// setLatencyBuckets registers the latency histograms with the given buckets,
+// replacing the current ones when the buckets differ.
+func setLatencyBuckets(forHTTP, forRedis []float64) {
+	histogramsMu.Lock()
+	defer histogramsMu.Unlock()
+	if !slices.Equal(forHTTP, currentHTTPBuckets) {
+		replaceHistogram(&httpRequestDuration, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_request_duration_seconds",
+				Help:    "Duration of HTTP requests",
+				Buckets: forHTTP,
+			},
+			[]string{"method", "endpoint"},
+		))
+		currentHTTPBuckets = forHTTP
+	}
+	if !slices.Equal(forRedis, currentRedisBuckets) {
+		replaceHistogram(&redisLatency, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "redis_latency_seconds",
+				Help:    "Redis round-trip latency in seconds",
+				Buckets: forRedis,
+			},
+			[]string{"endpoint"},
+		))
+		currentRedisBuckets = forRedis
+	}
+}
+
+func replaceHistogram(current *atomic.Pointer[prometheus.HistogramVec], h *prometheus.HistogramVec) {
+	if old := current.Load(); old != nil {
+		unregisterMetric(old)
+	}
+	registerMetric(h)
+	current.Store(h)
+}
+
+// registeredMetrics are the collectors registered by the package, from which
+// the metrics metadata and the suggested rules are generated.
+var (
+	registeredMetricsMu sync.Mutex
+	registeredMetrics   = make(map[prometheus.Collector]bool)
+)
+
+func registerMetric(c prometheus.Collector) {
+	prometheus.MustRegister(c)
+	registeredMetricsMu.Lock()
+	registeredMetrics[c] = true
+	registeredMetricsMu.Unlock()
+}
+
+func unregisterMetric(c prometheus.Collector) {
+	prometheus.Unregister(c)
+	registeredMetricsMu.Lock()
+	delete(registeredMetrics, c)
+	registeredMetricsMu.Unlock()
+}
+
+// mapsAPIs are the Maps web services reported as endpoints in metrics labels.
+var mapsAPIs = map[string]bool{
+	"directions":     true,
+	"distancematrix": true,
+	"elevation":      true,
+	"geocode":        true,
+	"place":          true,
+	"staticmap":      true,
+	"streetview":     true,
+	"timezone":       true,
+}
+
+// metricsEndpoint reduces a request path to one of a bounded set of endpoint
+// labels: the Maps web service ("geocode", "place", ...), "autocomplete" for
+// Places Autocomplete, "geocode_batch", "admin", "health", "metrics", or
+// "other".
+func metricsEndpoint(path string) string {
+	switch {
+	case path == batchGeocodePath:
+		return "geocode_batch"
+	case isAutocompletePath(path):
+		return "autocomplete"
+	case strings.HasPrefix(path, "/maps/api/"):
+		api, _, _ := strings.Cut(strings.TrimPrefix(path, "/maps/api/"), "/")
+		if mapsAPIs[api] {
+			return api
+		}
+	case path == "/health" || path == "/metrics":
+		return strings.TrimPrefix(path, "/")
+	case strings.HasPrefix(path, "/admin/"):
+		return "admin"
+	}
+	return "other"
+}
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total number of HTTP requests",
+		},
+		[]string{"method", "path", "status"},
+	)
+	redisUp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "redis_up",
+			Help: "Whether Redis is up (1) or down (0)",
+		},
+	)
+	upstreamRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_requests_total",
+			Help: "Total number of upstream requests made on cache misses",
+		},
+		[]string{"target", "status"},
+	)
+	businessUnitRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "business_unit_requests_total",
+			Help: "Total number of proxied requests by business unit, endpoint and cache status",
+		},
+		[]string{"business_unit", "endpoint", "cache"},
+	)
+	cacheKeyCandidateRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_key_candidate_requests_total",
+			Help: "Total number of requests keyed under the candidate cache key policy, by whether the keys diverge and the active and projected candidate cache outcomes",
+		},
+		[]string{"endpoint", "keys", "active", "candidate"},
+	)
+	autocompleteRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "autocomplete_requests_total",
+			Help: "Total number of Places Autocomplete requests by outcome",
+		},
+		[]string{"outcome"},
+	)
+	upstreamQuotaExceededTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_quota_exceeded_total",
+			Help: "Total number of requests answered with 429 because the upstream quota was exceeded, by endpoint and source (upstream or circuit)",
+		},
+		[]string{"endpoint", "source"},
+	)
+	autocompleteMicrocacheHitAge = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "autocomplete_microcache_hit_age_seconds",
+			Help:    "Age in seconds of the autocomplete micro-cache entries served",
+			Buckets: []float64{1, 2, 5, 10, 15, 20, 30},
+		},
+	)
+	upstreamDNSDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upstream_dns_duration_seconds",
+			Help:    "Duration of DNS lookups of upstream hosts in seconds",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		},
+		[]string{"outcome"},
+	)
+	upstreamRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upstream_request_duration_seconds",
+			Help:    "Duration of upstream requests in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"target"},
+	)
+	cacheEntryChangesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_entry_changes_total",
+			Help: "Material changes detected when a cached entry is replaced",
+		},
+		[]string{"endpoint", "field"},
+	)
+	logMessagesSuppressedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "log_messages_suppressed_total",
+			Help: "Repeated log messages suppressed by deduplication",
+		},
+		[]string{"severity"},
+	)
+	panicsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "panics_total",
+			Help: "Handler panics recovered by the recovery middleware",
+		},
+		[]string{"path"},
+	)
+	anomaliesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "usage_anomalies_total",
+			Help: "Usage anomalies flagged by the anomaly detector",
+		},
+		[]string{"kind"},
+	)
+	rateLimitedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limited_requests_total",
+			Help: "Requests rejected with 429 by the rate limiter",
+		},
+		[]string{"reason"},
+	)
+	corruptResponsesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_corrupt_responses_total",
+			Help: "Upstream responses not cached because they failed validation",
+		},
+		[]string{"endpoint", "reason"},
+	)
+	upstreamResponsesNotCachedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_responses_not_cached_total",
+			Help: "Upstream responses not cached because they were slow or streamed",
+		},
+		[]string{"reason"},
+	)
+	corruptEntriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_corrupt_entries_total",
+			Help: "Cache entries deleted because their body did not match the stored checksum",
+		},
+		[]string{"endpoint"},
+	)
+	migrationLookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_migration_lookups_total",
+			Help: "Cache lookups in migration mode, by the location the entry was found in",
+		},
+		[]string{"source"},
+	)
+	migrationCopiedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_migration_copied_total",
+			Help: "Cache entries copied from the old location in migration mode",
+		},
+	)
+	mirrorWritesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mirror_writes_total",
+			Help: "Total number of cache writes mirrored to MIRROR_REDIS_ADDR, by operation (set, delete or read) and outcome (ok, error or dropped)",
+		},
+		[]string{"op", "outcome"},
+	)
+	mirrorLag = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "mirror_lag_seconds",
+			Help:    "Delay in seconds between a cache write and its copy to the mirror",
+			Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 30, 60},
+		},
+	)
+	oversizedEntriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_oversized_entries_total",
+			Help: "Cache entries above CACHE_MAX_ENTRY_BYTES, by outcome (spilled to disk, skipped, or error)",
+		},
+		[]string{"outcome"},
+	)
+	diskCacheHitsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "disk_cache_hits_total",
+			Help: "Cache entries read from the disk cache",
+		},
+	)
+	diskCacheEvictionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "disk_cache_evictions_total",
+			Help: "Entries evicted from the disk cache to stay within DISK_CACHE_MAX_MB",
+		},
+	)
+	diskCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "disk_cache_bytes",
+			Help: "Size in bytes of the entries in the disk cache",
+		},
+	)
+	clientCacheLookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "client_side_cache_lookups_total",
+			Help: "Cache lookups by client-side cache outcome: hit, miss, or bypass while invalidations are not received",
+		},
+		[]string{"result"},
+	)
+	clientCacheInvalidationsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "client_side_cache_invalidations_total",
+			Help: "Invalidation messages received from Redis for the client-side cache",
+		},
+	)
+	clientCacheKeys = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "client_side_cache_keys",
+			Help: "Keys held in the client-side cache",
+		},
+	)
+	redisForcedReconnectsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "redis_forced_reconnects_total",
+			Help: "Redis connections dropped after REDIS_FAILOVER_THRESHOLD consecutive connection errors, by whether re-resolving REDIS_HOST changed its addresses",
+		},
+		[]string{"address_changed"},
+	)
+	quotaCircuitRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_quota_held_total",
+			Help: "Misses held back by an exhausted upstream quota but still answered, by outcome: waited, when sent once QUOTA_CIRCUIT closed within QUOTA_CIRCUIT_MAX_WAIT_SECONDS, or stale, when served from the latest cache snapshot",
+		},
+		[]string{"outcome"},
+	)
+	matrixSplitsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "distance_matrix_splits_total",
+			Help: "Distance matrix misses split into several upstream requests for the limits of DISTANCE_MATRIX_LIMITS, by key tier",
+		},
+		[]string{"tier"},
+	)
+	matrixSplitRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "distance_matrix_split_requests_total",
+			Help: "Upstream requests sent for split distance matrix misses, by key tier",
+		},
+		[]string{"tier"},
+	)
+	pageStitchesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "places_page_stitches_total",
+			Help: "Places searches whose pages were stitched into one entry with STITCH_PLACES_PAGES, by result: stitched or failed",
+		},
+		[]string{"result"},
+	)
+	conditionalFillsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_conditional_fills_total",
+			Help: "Fills stored with CONDITIONAL_FILLS, by result: stored, or kept when the entry was fresher",
+		},
+		[]string{"result"},
+	)
+	integrityEntriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_integrity_entries_total",
+			Help: "Cache entries checked by integrity sweeps, by result: valid or the problem found",
+		},
+		[]string{"result"},
+	)
+	quarantinedRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_quarantined_requests_total",
+			Help: "Requests for cache entries ignored because of a quarantine, by quarantine ID",
+		},
+		[]string{"quarantine"},
+	)
+	warmQueriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_warm_queries_total",
+			Help: "Queries of WARM_SOURCE requested through the cache by outcome (hit, miss, error, skipped, invalid)",
+		},
+		[]string{"outcome"},
+	)
+	warmRunsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_warm_runs_total",
+			Help: "Cache warming runs by outcome (complete, error)",
+		},
+		[]string{"outcome"},
+	)
+	upstreamProtocolDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upstream_protocol_request_duration_seconds",
+			Help:    "Duration of upstream requests until their response headers in seconds, by HTTP protocol",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"protocol"},
+	)
+	upstreamHTTP3FallbacksTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "upstream_http3_fallbacks_total",
+			Help: "Upstream requests retried over TCP after HTTP/3 failed",
+		},
+	)
+	upstreamPrewarmTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_prewarm_total",
+			Help: "Requests keeping upstream hosts warm by outcome (success, error)",
+		},
+		[]string{"outcome"},
+	)
+	upstreamTLSHandshakesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_tls_handshakes_total",
+			Help: "TLS handshakes with upstream hosts by whether they resumed a session",
+		},
+		[]string{"resumed"},
+	)
+	upstreamResponsesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_responses_total",
+			Help: "Upstream responses received by provider (target) and the host that answered",
+		},
+		[]string{"provider", "host"},
+	)
+	openConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "open_connections",
+			Help: "Client connections open, counted when MAX_CONNECTIONS is set",
+		},
+	)
+	connectionRejectionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "connection_rejections_total",
+			Help: "Requests answered with 503 on connections accepted beyond MAX_CONNECTIONS",
+		},
+	)
+	inflightRequests = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "inflight_requests",
+			Help: "Requests being served, counted when MAX_INFLIGHT_REQUESTS is set",
+		},
+	)
+	inflightRejectionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "inflight_rejections_total",
+			Help: "Requests answered with 503 because MAX_INFLIGHT_REQUESTS were being served",
+		},
+	)
+	requestTimeoutsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "request_timeouts_total",
+			Help: "Requests answered with 504 at the deadline of REQUEST_TIMEOUT_SECONDS or ENDPOINT_TIMEOUTS",
+		},
+		[]string{"endpoint"},
+	)
+	upstreamRedirectsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_redirects_total",
+			Help: "Upstream redirects by outcome (followed, limit, returned, rewritten)",
+		},
+		[]string{"outcome"},
+	)
+	pathPatternMatchesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "path_pattern_matches_total",
+			Help: "Requests matched by a pattern of CACHE_BYPASS_PATTERNS (bypass), REJECT_PATTERNS (reject), POST_CACHE_PATHS (post_cache) or JSON_OUTPUT_ENDPOINTS (json_output)",
+		},
+		[]string{"list", "pattern"},
+	)
+	ruleMatchesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rule_matches_total",
+			Help: "Proxied requests matched by each rule of RULES_FILE",
+		},
+		[]string{"rule"},
+	)
+	edgeSyncRunsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "edge_sync_runs_total",
+			Help: "Syncs from the central cache by outcome (complete, error)",
+		},
+		[]string{"outcome"},
+	)
+	edgeSyncEntriesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "edge_sync_entries_total",
+			Help: "Entries copied from the central cache",
+		},
+	)
+	edgeSyncLastComplete = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "edge_sync_last_complete_timestamp_seconds",
+			Help: "Unix time of the last complete sync from the central cache",
+		},
+	)
+	upstreamRouteFallbacksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_route_fallbacks_total",
+			Help: "Upstream requests of a route retried against its fallback base URL",
+		},
+		[]string{"route"},
+	)
+	maintenanceRejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "maintenance_rejections_total",
+			Help: "Requests rejected with 503 because of the maintenance mode",
+		},
+		[]string{"mode"},
+	)
+	warmupRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "warmup_requests_total",
+			Help: "Cache misses during the startup warm-up, by outcome",
+		},
+		[]string{"outcome"},
+	)
+	coalescedRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_coalesced_requests_total",
+			Help: "Cache misses answered with the upstream response of a concurrent miss of the same entry",
+		},
+		[]string{"endpoint"},
+	)
+	upstreamThrottledTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_throttled_total",
+			Help: "Cache misses rejected with 503 because the upstream concurrency limit was reached",
+		},
+		[]string{"priority"},
+	)
+	upstreamQueuedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_queued_total",
+			Help: "Batch cache misses that waited for an upstream request, by whether they were served or rejected",
+		},
+		[]string{"priority", "outcome"},
+	)
+	latencyBudgetRejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "latency_budget_rejections_total",
+			Help: "Cache misses answered with 504 because of the X-Latency-Budget-Ms header",
+		},
+		[]string{"reason"},
+	)
+	upstreamResponseBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upstream_response_bytes",
+			Help:    "Size of upstream response bodies as received, in bytes",
+			Buckets: responseSizeBuckets,
+		},
+		[]string{"endpoint"},
+	)
+	clientResponseBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "client_response_bytes",
+			Help:    "Size of response bodies sent to clients, in bytes",
+			Buckets: responseSizeBuckets,
+		},
+		[]string{"endpoint", "cache"},
+	)
+	bansTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "client_bans_total",
+			Help: "Temporary bans issued to clients exceeding the rate limit",
+		},
+	)
+	logEntriesDroppedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "log_entries_dropped_total",
+			Help: "Log entries that could not be sent to Cloud Logging",
+		},
+	)
+	clientAuthTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "client_auth_requests_total",
+			Help: "Proxied requests by the authenticator of AUTH_CHAIN that accepted them, or rejected",
+		},
+		[]string{"method"},
+	)
+	dependencyHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dependency_healthy",
+			Help: "Whether a dependency (redis or upstream) is considered healthy (1) or not (0) by the background job gate",
+		},
+		[]string{"dependency"},
+	)
+	backgroundJobPaused = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "background_job_paused",
+			Help: "Whether a background job is paused (1) until its dependencies recover",
+		},
+		[]string{"job"},
+	)
+	influxPointsDroppedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "influx_points_dropped_total",
+			Help: "Cache events that could not be written to InfluxDB, by reason",
+		},
+		[]string{"reason"},
+	)
+	usageRecordsDroppedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "usage_records_dropped_total",
+			Help: "Usage records that could not be exported, by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	registerMetric(httpRequestsTotal)
+	setLatencyBuckets(defaultHTTPDurationBuckets, defaultRedisLatencyBuckets)
+	registerMetric(redisUp)
+	registerMetric(upstreamRequestsTotal)
+	registerMetric(upstreamRequestDuration)
+	registerMetric(upstreamDNSDuration)
+	registerMetric(businessUnitRequestsTotal)
+	registerMetric(cacheKeyCandidateRequestsTotal)
+	registerMetric(autocompleteRequestsTotal)
+	registerMetric(autocompleteMicrocacheHitAge)
+	registerMetric(upstreamQuotaExceededTotal)
+	registerMetric(cacheEntryChangesTotal)
+	registerMetric(logMessagesSuppressedTotal)
+	registerMetric(panicsTotal)
+	registerMetric(anomaliesTotal)
+	registerMetric(rateLimitedTotal)
+	registerMetric(maintenanceRejectionsTotal)
+	registerMetric(warmupRequestsTotal)
+	registerMetric(upstreamThrottledTotal)
+	registerMetric(coalescedRequestsTotal)
+	registerMetric(upstreamQueuedTotal)
+	registerMetric(corruptResponsesTotal)
+	registerMetric(upstreamResponsesNotCachedTotal)
+	registerMetric(corruptEntriesTotal)
+	registerMetric(migrationLookupsTotal)
+	registerMetric(migrationCopiedTotal)
+	registerMetric(mirrorWritesTotal)
+	registerMetric(mirrorLag)
+	registerMetric(oversizedEntriesTotal)
+	registerMetric(diskCacheHitsTotal)
+	registerMetric(diskCacheEvictionsTotal)
+	registerMetric(diskCacheBytes)
+	registerMetric(clientCacheLookupsTotal)
+	registerMetric(clientCacheInvalidationsTotal)
+	registerMetric(clientCacheKeys)
+	registerMetric(redisForcedReconnectsTotal)
+	registerMetric(quotaCircuitRequestsTotal)
+	registerMetric(matrixSplitsTotal)
+	registerMetric(matrixSplitRequestsTotal)
+	registerMetric(pageStitchesTotal)
+	registerMetric(conditionalFillsTotal)
+	registerMetric(integrityEntriesTotal)
+	registerMetric(quarantinedRequestsTotal)
+	registerMetric(warmQueriesTotal)
+	registerMetric(warmRunsTotal)
+	registerMetric(upstreamProtocolDuration)
+	registerMetric(upstreamHTTP3FallbacksTotal)
+	registerMetric(upstreamPrewarmTotal)
+	registerMetric(upstreamTLSHandshakesTotal)
+	registerMetric(upstreamResponsesTotal)
+	registerMetric(openConnections)
+	registerMetric(connectionRejectionsTotal)
+	registerMetric(inflightRequests)
+	registerMetric(inflightRejectionsTotal)
+	registerMetric(requestTimeoutsTotal)
+	registerMetric(upstreamRedirectsTotal)
+	registerMetric(pathPatternMatchesTotal)
+	registerMetric(ruleMatchesTotal)
+	registerMetric(edgeSyncRunsTotal)
+	registerMetric(edgeSyncEntriesTotal)
+	registerMetric(edgeSyncLastComplete)
+	registerMetric(upstreamRouteFallbacksTotal)
+	registerMetric(bansTotal)
+	registerMetric(latencyBudgetRejectionsTotal)
+	registerMetric(upstreamResponseBytes)
+	registerMetric(clientResponseBytes)
+	registerMetric(usageRecordsDroppedTotal)
+	registerMetric(influxPointsDroppedTotal)
+	registerMetric(dependencyHealthy)
+	registerMetric(clientAuthTotal)
+	registerMetric(backgroundJobPaused)
+	registerMetric(logEntriesDroppedTotal)
+}
+
+// MetricsSink receives the operational metrics of the proxy.
+type MetricsSink interface {
+	// ObserveCacheOp records the latency and outcome of a cache store round
+	// trip made for a request to endpoint.
+	ObserveCacheOp(endpoint string, duration time.Duration, err error)
+	// ObserveUpstream records an upstream request; status is the HTTP status
+	// code, or "error" when the request failed.
+	ObserveUpstream(target, status string, duration time.Duration)
+	// ObserveChange records a material change detected when an entry was replaced.
+	ObserveChange(endpoint, field string)
+	// ObserveUpstreamBytes records the size of an upstream response body as
+	// received.
+	ObserveUpstreamBytes(endpoint string, n int)
+	// ObserveClientBytes records the size of a response body sent to a
+	// client; cache is how it was served ("hit", "miss", ...).
+	ObserveClientBytes(endpoint, cache string, n int)
+}
+
+// prometheusSink is the MetricsSink exposing metrics on /metrics.
+type prometheusSink struct{}
+
+func (prometheusSink) ObserveCacheOp(endpoint string, duration time.Duration, err error) {
+	redisLatency.Load().WithLabelValues(metricsEndpoint(endpoint)).Observe(duration.Seconds())
+	if err != nil {
+		redisUp.Set(0)
+	} else {
+		redisUp.Set(1)
+	}
+}
+
+func (prometheusSink) ObserveUpstream(target, status string, duration time.Duration) {
+	upstreamRequestDuration.WithLabelValues(target).Observe(duration.Seconds())
+	upstreamRequestsTotal.WithLabelValues(target, status).Inc()
+}
+
+func (prometheusSink) ObserveChange(endpoint, field string) {
+	cacheEntryChangesTotal.WithLabelValues(endpoint, field).Inc()
+}
+
+func (prometheusSink) ObserveUpstreamBytes(endpoint string, n int) {
+	upstreamResponseBytes.WithLabelValues(endpoint).Observe(float64(n))
+}
+
+func (prometheusSink) ObserveClientBytes(endpoint, cache string, n int) {
+	clientResponseBytes.WithLabelValues(endpoint, cache).Observe(float64(n))
+}
+
+func prometheusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := newStatusResponseWriter(w)
+		next.ServeHTTP(sw, r)
+		duration := time.Since(start).Seconds()
+		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", sw.statusCode)).Inc()
+		httpRequestDuration.Load().WithLabelValues(r.Method, metricsEndpoint(r.URL.Path)).Observe(duration)
+	})
+}
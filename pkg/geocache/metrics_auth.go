@@ -0,0 +1,71 @@
+package geocache
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// metricsSecret parses a METRICS_* credential, either the secret itself or
+// "sha256:<hex digest>" of it. It returns nil when raw is empty.
+func metricsSecret(name, raw string) *adminToken {
+	if raw == "" {
+		return nil
+	}
+	t := &adminToken{name: name, secret: raw}
+	if digest, ok := strings.CutPrefix(raw, "sha256:"); ok {
+		t.secret = strings.ToLower(digest)
+		t.hashed = true
+	}
+	return t
+}
+
+// metricsAuthorized reports whether r carries the credentials of
+// METRICS_BEARER_TOKEN or METRICS_BASIC_AUTH. Requests are authorized when
+// neither is set. Secrets are compared in constant time.
+func metricsAuthorized(config Config, r *http.Request) bool {
+	token := metricsSecret("bearer", config.MetricsBearerToken)
+	var basic *adminToken
+	var basicUser string
+	if config.MetricsBasicAuth != "" {
+		user, password, _ := strings.Cut(config.MetricsBasicAuth, ":")
+		basic, basicUser = metricsSecret("basic", password), user
+	}
+	if token == nil && basic == nil {
+		return true
+	}
+	if presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != nil && presented != "" {
+		return token.matches(presented)
+	}
+	if user, password, ok := r.BasicAuth(); ok && basic != nil {
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(basicUser)) == 1
+		return basic.matches(password) && userOK
+	}
+	return false
+}
+
+// metricsAccess restricts next to ALLOWED_METRICS_CIDRS and, when they are
+// set, to scrapers presenting the METRICS_BEARER_TOKEN or METRICS_BASIC_AUTH
+// credentials, for scrapers without stable source addresses.
+func (s *Server) metricsAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := s.liveConfig()
+		if cidrs := config.AllowedMetricsCIDRs; len(cidrs) > 0 && !isIPAllowed(r.RemoteAddr, cidrs) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden\n"))
+			return
+		}
+		if !metricsAuthorized(config, r) {
+			if config.MetricsBearerToken != "" {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="metrics"`)
+			}
+			if config.MetricsBasicAuth != "" {
+				w.Header().Add("WWW-Authenticate", `Basic realm="metrics"`)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Unauthorized\n"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,63 @@
+package geocache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsAccess_Credentials(t *testing.T) {
+	digest := sha256.Sum256([]byte("scrape-pass"))
+	server := &Server{config: Config{
+		AllowedMetricsCIDRs: []string{"192.0.2.0/24", "198.51.100.0/24"},
+		MetricsBearerToken:  "scrape-token",
+		MetricsBasicAuth:    "prometheus:sha256:" + hex.EncodeToString(digest[:]),
+	}}
+	handler := server.metricsAccess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		setAuth    func(r *http.Request)
+		wantStatus int
+	}{
+		{name: "bearer token", setAuth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer scrape-token") }, wantStatus: http.StatusOK},
+		{name: "basic auth", setAuth: func(r *http.Request) { r.SetBasicAuth("prometheus", "scrape-pass") }, wantStatus: http.StatusOK},
+		{name: "no credentials", setAuth: func(r *http.Request) {}, wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", setAuth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, wantStatus: http.StatusUnauthorized},
+		{name: "wrong user", setAuth: func(r *http.Request) { r.SetBasicAuth("grafana", "scrape-pass") }, wantStatus: http.StatusUnauthorized},
+		{name: "outside allowed CIDRs", remoteAddr: "203.0.113.1:1234",
+			setAuth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer scrape-token") }, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			tt.setAuth(req)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && len(w.Header().Values("WWW-Authenticate")) != 2 {
+				t.Errorf("Expected Bearer and Basic challenges, got %v", w.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestMetricsAccess_NoCredentialsConfigured(t *testing.T) {
+	server := &Server{}
+	handler := server.metricsAccess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected /metrics to be open without CIDRs or credentials, got %d", w.Code)
+	}
+}
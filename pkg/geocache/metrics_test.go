@@ -0,0 +1,126 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// recordingSink is a MetricsSink remembering response size observations.
+type recordingSink struct {
+	prometheusSink
+	upstreamBytes map[string]int
+	clientBytes   map[string]int
+}
+
+func (r *recordingSink) ObserveUpstreamBytes(endpoint string, n int) {
+	r.upstreamBytes[endpoint] += n
+}
+
+func (r *recordingSink) ObserveClientBytes(endpoint, cache string, n int) {
+	r.clientBytes[endpoint+" "+cache] += n
+}
+
+func TestResponseSizeMetrics(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+
+	sink := &recordingSink{upstreamBytes: map[string]int{}, clientBytes: map[string]int{}}
+	server.metrics = sink
+	transport := &recordingTransport{body: `{"status":"OK","results":[]}`}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, sink)
+
+	handler := server.logMiddleware(server.usageMiddleware(http.HandlerFunc(server.query)))
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Size", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	size := len(transport.body)
+	if got := sink.upstreamBytes["geocode"]; got != size {
+		t.Errorf("Expected %d upstream bytes, got %d", size, got)
+	}
+	for _, cache := range []string{"miss", "hit"} {
+		if got := sink.clientBytes["geocode "+cache]; got != size {
+			t.Errorf("Expected %d client bytes for %s, got %d", size, cache, got)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{geocodePath, "geocode"},
+		{"/maps/api/geocode/xml", "geocode"},
+		{batchGeocodePath, "geocode_batch"},
+		{directionsPath, "directions"},
+		{"/maps/api/place/details/json", "place"},
+		{"/maps/api/place/autocomplete/json", "autocomplete"},
+		{"/maps/api/unknown/json", "other"},
+		{"/admin/stats", "admin"},
+		{"/health", "health"},
+		{"/metrics", "metrics"},
+		{"/query", "other"},
+		{"/", "other"},
+	}
+	for _, tt := range tests {
+		if got := metricsEndpoint(tt.path); got != tt.want {
+			t.Errorf("metricsEndpoint(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseBuckets(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []float64
+	}{
+		{"", nil},
+		{"0.0001, 0.001,0.01", []float64{0.0001, 0.001, 0.01}},
+		{"0.1,fast", nil},
+		{"1,0.5", nil},
+		{"1,1", nil},
+	}
+	for _, tt := range tests {
+		if got := parseBuckets(tt.value); !slices.Equal(got, tt.want) {
+			t.Errorf("parseBuckets(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLatencyBuckets(t *testing.T) {
+	defer setLatencyBuckets(defaultHTTPDurationBuckets, defaultRedisLatencyBuckets)
+
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	config := server.config
+	config.RedisLatencyBuckets = []float64{0.0002, 0.002}
+	server = NewServer(server.logger, server.redis, config, &http.Client{Transport: &recordingTransport{body: `{"status":"OK","results":[]}`}})
+	server.query(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, geocodePath+"?address=Buckets", nil))
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "redis_latency_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if m.GetLabel()[0].GetValue() != "geocode" {
+				continue
+			}
+			if buckets := m.GetHistogram().GetBucket(); len(buckets) != 2 || buckets[0].GetUpperBound() != 0.0002 {
+				t.Errorf("Expected the configured buckets, got %v", buckets)
+			}
+			return
+		}
+	}
+	t.Error("Expected redis_latency_seconds to be observed for the geocode endpoint")
+}
@@ -0,0 +1,346 @@
+package geocache
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricInfo describes a metric family exposed on /metrics.
+type metricInfo struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Help   string   `json:"help"`
+	Labels []string `json:"labels"`
+}
+
+// descPattern parses prometheus.Desc.String(), the only exported view of the
+// label names of a collector that has not been observed yet.
+var descPattern = regexp.MustCompile(`^Desc\{fqName: ("(?:[^"\\]|\\.)*"), help: ("(?:[^"\\]|\\.)*"), constLabels: \{.*\}, variableLabels: \{(.*)\}\}$`)
+
+// collectorType returns the metric type of the collectors the package
+// registers.
+func collectorType(c prometheus.Collector) string {
+	switch c.(type) {
+	// A Gauge also implements Counter.
+	case prometheus.Gauge, *prometheus.GaugeVec:
+		return "gauge"
+	case prometheus.Counter, *prometheus.CounterVec:
+		return "counter"
+	case prometheus.Histogram, *prometheus.HistogramVec:
+		return "histogram"
+	}
+	return "untyped"
+}
+
+// exposedMetrics describes the metrics registered by the package, sorted by
+// name.
+func exposedMetrics() []metricInfo {
+	registeredMetricsMu.Lock()
+	collectors := make([]prometheus.Collector, 0, len(registeredMetrics))
+	for c := range registeredMetrics {
+		collectors = append(collectors, c)
+	}
+	registeredMetricsMu.Unlock()
+
+	var metrics []metricInfo
+	for _, c := range collectors {
+		descs := make(chan *prometheus.Desc, 4)
+		go func() {
+			c.Describe(descs)
+			close(descs)
+		}()
+		for desc := range descs {
+			m := descPattern.FindStringSubmatch(desc.String())
+			if m == nil {
+				continue
+			}
+			info := metricInfo{Type: collectorType(c), Labels: []string{}}
+			info.Name, _ = strconv.Unquote(m[1])
+			info.Help, _ = strconv.Unquote(m[2])
+			if m[3] != "" {
+				for _, label := range strings.Split(m[3], ",") {
+					// Constrained labels are shown as c(name).
+					info.Labels = append(info.Labels, strings.TrimSuffix(strings.TrimPrefix(label, "c("), ")"))
+				}
+			}
+			metrics = append(metrics, info)
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics
+}
+
+// handleMetricsMetadata serves the name, type, help and labels of every
+// metric, including those without samples yet, for building dashboards.
+func handleMetricsMetadata(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, exposedMetrics())
+}
+
+// ruleBuilder writes PromQL selectors for the exposed metrics, failing on a
+// metric or label the binary does not expose, so that the suggested rules
+// cannot drift from the metrics.
+type ruleBuilder struct {
+	metrics  map[string]metricInfo
+	selector string
+	err      error
+}
+
+// sel returns the selector of the series name with the matchers, which are
+// label="value" or label=~"regexp". Histogram series are named with their
+// _bucket, _count or _sum suffix.
+func (b *ruleBuilder) sel(name string, matchers ...string) string {
+	info, ok := b.metrics[name]
+	if !ok {
+		for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+			if base, found := strings.CutSuffix(name, suffix); found {
+				info, ok = b.metrics[base]
+				ok = ok && info.Type == "histogram"
+				break
+			}
+		}
+	}
+	if !ok {
+		b.fail(fmt.Errorf("metric %s is not exposed", name))
+	}
+	for _, m := range matchers {
+		label := m[:strings.IndexAny(m, "=!")]
+		if !slices.Contains(info.Labels, label) {
+			b.fail(fmt.Errorf("metric %s has no label %s", name, label))
+		}
+	}
+	if b.selector != "" {
+		matchers = append(matchers, b.selector)
+	}
+	if len(matchers) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(matchers, ",") + "}"
+}
+
+// by checks that the labels of the aggregation are exposed by name.
+func (b *ruleBuilder) by(name string, labels ...string) string {
+	info := b.metrics[name]
+	for _, label := range labels {
+		if label != "le" && !slices.Contains(info.Labels, label) {
+			b.fail(fmt.Errorf("metric %s has no label %s", name, label))
+		}
+	}
+	return "by (" + strings.Join(labels, ", ") + ")"
+}
+
+func (b *ruleBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// promRule is a recording or alerting rule of a Prometheus rule file.
+type promRule struct {
+	Record      string
+	Alert       string
+	Expr        string
+	For         time.Duration
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+type promRuleGroup struct {
+	Name  string
+	Rules []promRule
+}
+
+// rulesOptions are the thresholds of the suggested rules.
+type rulesOptions struct {
+	selector     string
+	hitRatio     float64
+	slo          float64
+	redisDownFor time.Duration
+}
+
+// suggestedRules returns the recording and alerting rules for metrics: the
+// cache hit ratio, the error budget of the availability objective, upstream
+// errors and Redis being down.
+func suggestedRules(metrics []metricInfo, o rulesOptions) ([]promRuleGroup, error) {
+	b := &ruleBuilder{metrics: make(map[string]metricInfo), selector: o.selector}
+	for _, m := range metrics {
+		b.metrics[m.Name] = m
+	}
+	// Requests answered from the cache, by the cache label of
+	// client_response_bytes; MISS is the only status that reached upstream.
+	hits := `cache=~"hit|micro-hit|negative|coalesced|override|stale|snapshot"`
+	served := `cache!="none"`
+	errorBudget := 1 - o.slo
+	errorRatio := func(window string) string {
+		return fmt.Sprintf(`sum(rate(%s[%s])) / sum(rate(%s[%s]))`,
+			b.sel("http_requests_total", `status=~"5.."`), window, b.sel("http_requests_total"), window)
+	}
+
+	recording := promRuleGroup{Name: "geocache.rules", Rules: []promRule{
+		{Record: "geocache:cache_hit_ratio:rate5m", Expr: fmt.Sprintf(`sum(rate(%s[5m])) / sum(rate(%s[5m]))`,
+			b.sel("client_response_bytes_count", hits), b.sel("client_response_bytes_count", served))},
+		{Record: "geocache:cache_hit_ratio_by_endpoint:rate5m", Expr: fmt.Sprintf(`sum %[1]s (rate(%[2]s[5m])) / sum %[1]s (rate(%[3]s[5m]))`,
+			b.by("client_response_bytes", "endpoint"), b.sel("client_response_bytes_count", hits), b.sel("client_response_bytes_count", served))},
+		{Record: "geocache:http_errors:ratio_rate5m", Expr: errorRatio("5m")},
+		{Record: "geocache:http_errors:ratio_rate30m", Expr: errorRatio("30m")},
+		{Record: "geocache:http_errors:ratio_rate1h", Expr: errorRatio("1h")},
+		{Record: "geocache:http_errors:ratio_rate6h", Expr: errorRatio("6h")},
+		{Record: "geocache:http_request_duration_seconds:p95_rate5m", Expr: fmt.Sprintf(`histogram_quantile(0.95, sum %s (rate(%s[5m])))`,
+			b.by("http_request_duration_seconds", "le", "endpoint"), b.sel("http_request_duration_seconds_bucket"))},
+		{Record: "geocache:upstream_errors:ratio_rate5m", Expr: fmt.Sprintf(`sum %[1]s (rate(%[2]s[5m])) / sum %[1]s (rate(%[3]s[5m]))`,
+			b.by("upstream_requests_total", "target"), b.sel("upstream_requests_total", `status=~"error|5.."`), b.sel("upstream_requests_total"))},
+	}}
+
+	alerts := promRuleGroup{Name: "geocache.alerts", Rules: []promRule{
+		{
+			Alert:  "GeocacheRedisDown",
+			Expr:   b.sel("redis_up") + " == 0",
+			For:    o.redisDownFor,
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "Redis is unreachable from {{ $labels.instance }}",
+				"description": "Requests are served without the cache, each one billed by Google.",
+			},
+		},
+		{
+			Alert:  "GeocacheLowHitRatio",
+			Expr:   fmt.Sprintf("geocache:cache_hit_ratio:rate5m < %g", o.hitRatio),
+			For:    30 * time.Minute,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Cache hit ratio below %g", o.hitRatio),
+				"description": "The hit ratio is {{ $value | humanizePercentage }}; check for cache key changes, evictions or unusual traffic.",
+			},
+		},
+		{
+			// Multiwindow burn rates: 2% of a 30-day budget in an hour,
+			// then 5% in six hours.
+			Alert: "GeocacheErrorBudgetFastBurn",
+			Expr: fmt.Sprintf("geocache:http_errors:ratio_rate1h > %.6g and geocache:http_errors:ratio_rate5m > %.6[1]g",
+				14.4*errorBudget),
+			For:    2 * time.Minute,
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Error budget of the %g%% availability objective burning fast", 100*o.slo),
+				"description": "{{ $value | humanizePercentage }} of requests failed over the last hour.",
+			},
+		},
+		{
+			Alert: "GeocacheErrorBudgetSlowBurn",
+			Expr: fmt.Sprintf("geocache:http_errors:ratio_rate6h > %.6g and geocache:http_errors:ratio_rate30m > %.6[1]g",
+				6*errorBudget),
+			For:    15 * time.Minute,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Error budget of the %g%% availability objective burning", 100*o.slo),
+				"description": "{{ $value | humanizePercentage }} of requests failed over the last 6 hours.",
+			},
+		},
+		{
+			Alert:  "GeocacheUpstreamErrors",
+			Expr:   "geocache:upstream_errors:ratio_rate5m > 0.05",
+			For:    10 * time.Minute,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Upstream {{ $labels.target }} failing",
+				"description": "{{ $value | humanizePercentage }} of the requests to {{ $labels.target }} failed or returned a 5xx status.",
+			},
+		},
+	}}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return []promRuleGroup{recording, alerts}, nil
+}
+
+// writeRuleFile writes groups as a Prometheus rule file.
+func writeRuleFile(out io.Writer, groups []promRuleGroup) error {
+	var sb strings.Builder
+	sb.WriteString("groups:\n")
+	for _, g := range groups {
+		fmt.Fprintf(&sb, "  - name: %s\n    rules:\n", g.Name)
+		for _, r := range g.Rules {
+			if r.Record != "" {
+				fmt.Fprintf(&sb, "      - record: %s\n", r.Record)
+			} else {
+				fmt.Fprintf(&sb, "      - alert: %s\n", r.Alert)
+			}
+			// Double-quoted YAML strings take the escapes of Go quoting.
+			fmt.Fprintf(&sb, "        expr: %s\n", strconv.Quote(r.Expr))
+			if r.For > 0 {
+				fmt.Fprintf(&sb, "        for: %s\n", promDuration(r.For))
+			}
+			for _, section := range []struct {
+				name   string
+				values map[string]string
+			}{{"labels", r.Labels}, {"annotations", r.Annotations}} {
+				if len(section.values) == 0 {
+					continue
+				}
+				fmt.Fprintf(&sb, "        %s:\n", section.name)
+				keys := make([]string, 0, len(section.values))
+				for k := range section.values {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					fmt.Fprintf(&sb, "          %s: %s\n", k, strconv.Quote(section.values[k]))
+				}
+			}
+		}
+	}
+	_, err := io.WriteString(out, sb.String())
+	return err
+}
+
+// promDuration formats d as a Prometheus duration, such as 1h30m.
+func promDuration(d time.Duration) string {
+	var sb strings.Builder
+	for _, unit := range []struct {
+		d    time.Duration
+		name string
+	}{{time.Hour, "h"}, {time.Minute, "m"}, {time.Second, "s"}} {
+		if n := d / unit.d; n > 0 {
+			fmt.Fprintf(&sb, "%d%s", n, unit.name)
+			d -= n * unit.d
+		}
+	}
+	return sb.String()
+}
+
+// RunMetricsRules implements the "metrics-rules" command: it writes
+// suggested Prometheus recording and alerting rules for the metrics of this
+// binary to out.
+func RunMetricsRules(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("metrics-rules", flag.ContinueOnError)
+	flags.SetOutput(out)
+	selector := flags.String("selector", "", `label matcher added to every selector, such as job="geocache"`)
+	hitRatio := flags.Float64("hit-ratio", 0.5, "cache hit ratio below which GeocacheLowHitRatio fires")
+	slo := flags.Float64("slo", 0.999, "availability objective whose error budget is alerted on")
+	redisDownFor := flags.Duration("redis-down-for", 2*time.Minute, "how long Redis is down before GeocacheRedisDown fires")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *slo <= 0 || *slo >= 1 {
+		return fmt.Errorf("-slo must be between 0 and 1, got %g", *slo)
+	}
+	groups, err := suggestedRules(exposedMetrics(), rulesOptions{
+		selector:     *selector,
+		hitRatio:     *hitRatio,
+		slo:          *slo,
+		redisDownFor: *redisDownFor,
+	})
+	if err != nil {
+		return err
+	}
+	return writeRuleFile(out, groups)
+}
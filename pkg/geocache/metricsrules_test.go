@@ -0,0 +1,80 @@
+package geocache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExposedMetrics(t *testing.T) {
+	metrics := make(map[string]metricInfo)
+	for _, m := range exposedMetrics() {
+		metrics[m.Name] = m
+	}
+	tests := []metricInfo{
+		{Name: "upstream_requests_total", Type: "counter", Help: "Total number of upstream requests made on cache misses", Labels: []string{"target", "status"}},
+		{Name: "redis_up", Type: "gauge", Help: "Whether Redis is up (1) or down (0)", Labels: []string{}},
+		{Name: "http_request_duration_seconds", Type: "histogram", Help: "Duration of HTTP requests", Labels: []string{"method", "endpoint"}},
+	}
+	for _, want := range tests {
+		if got := metrics[want.Name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestSuggestedRules(t *testing.T) {
+	var out bytes.Buffer
+	if err := RunMetricsRules([]string{"-selector", `job="geocache"`, "-redis-down-for", "90s"}, &out); err != nil {
+		t.Fatalf("RunMetricsRules failed: %v", err)
+	}
+	for _, want := range []string{
+		"      - record: geocache:cache_hit_ratio:rate5m\n",
+		`redis_up{job=\"geocache\"} == 0`,
+		"        for: 1m30s\n",
+		"geocache:http_errors:ratio_rate1h > 0.0144 and",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected the rules to contain %q, got:\n%s", want, out.String())
+		}
+	}
+
+	// Rules referring to a metric or label the binary does not expose fail.
+	metrics := exposedMetrics()
+	for i := range metrics {
+		if metrics[i].Name == "http_requests_total" {
+			metrics[i].Labels = []string{"method", "path"}
+		}
+	}
+	if _, err := suggestedRules(metrics, rulesOptions{slo: 0.999, redisDownFor: time.Minute}); err == nil || !strings.Contains(err.Error(), "no label status") {
+		t.Errorf("Expected a missing label to be reported, got %v", err)
+	}
+}
+
+func TestMetricsMetadataEndpoint(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: &recordingTransport{}})
+	defer cleanup()
+	server.config.AllowedMetricsCIDRs = []string{"192.0.2.0/24"}
+	handler := server.routes()
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics/metadata", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 outside ALLOWED_METRICS_CIDRS, got %d", w.Code)
+	}
+
+	req.RemoteAddr = "192.0.2.1:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var metrics []metricInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil || len(metrics) == 0 {
+		t.Fatalf("Expected the metrics metadata, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -1,9 +1,12 @@
-package main
+package geocache
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestLogMiddleware(t *testing.T) {
@@ -126,3 +129,77 @@ func TestCORSMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestRecoveryMiddleware(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+
+	tests := []struct {
+		name          string
+		handler       http.HandlerFunc
+		requestID     string
+		wantStatus    int
+		wantJSONError bool
+	}{
+		{
+			name:          "panic before writing",
+			handler:       func(w http.ResponseWriter, r *http.Request) { panic("boom") },
+			wantStatus:    http.StatusInternalServerError,
+			wantJSONError: true,
+		},
+		{
+			name:          "panic keeps incoming request id",
+			handler:       func(w http.ResponseWriter, r *http.Request) { panic("boom") },
+			requestID:     "req-42",
+			wantStatus:    http.StatusInternalServerError,
+			wantJSONError: true,
+		},
+		{
+			name: "panic after writing",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				panic("boom")
+			},
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "no panic",
+			handler:    func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+			if tt.requestID != "" {
+				req.Header.Set("X-Request-ID", tt.requestID)
+			}
+			w := httptest.NewRecorder()
+
+			before := testutil.ToFloat64(panicsTotal.WithLabelValues("other"))
+			server.recoveryMiddleware(tt.handler).ServeHTTP(w, req)
+			after := testutil.ToFloat64(panicsTotal.WithLabelValues("other"))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantStatus != http.StatusOK && after-before != 1 {
+				t.Errorf("Expected panics_total to increment by 1, got %v", after-before)
+			}
+			if !tt.wantJSONError {
+				return
+			}
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Expected JSON body, got %q: %v", w.Body.String(), err)
+			}
+			if body["request_id"] == "" || body["request_id"] != w.Header().Get("X-Request-ID") {
+				t.Errorf("Expected request_id %q to match X-Request-ID %q", body["request_id"], w.Header().Get("X-Request-ID"))
+			}
+			if tt.requestID != "" && body["request_id"] != tt.requestID {
+				t.Errorf("Expected request_id %q, got %q", tt.requestID, body["request_id"])
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package geocache
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// migratingStore moves the cache from one Redis prefix or database to another
+// without a cold start. Entries are written to the new location only; a key
+// missing there is read from the old location and copied over with its
+// remaining TTL. Deletes apply to both, so a purged entry is not read back
+// from the old location. Once the entries of the old location have expired,
+// migration mode can be turned off.
+type migratingStore struct {
+	current  CacheStore
+	previous *redisStore
+	// oldKey maps a key to its old location, or returns "" for keys that are
+	// not migrated.
+	oldKey func(string) string
+	logger *Logger
+}
+
+// newMigratingStore returns the store reading through to the location given
+// by Config.MigrateFromRedisDB and Config.MigrateFromRedisPrefix. client is
+// connected to the new location.
+func newMigratingStore(current CacheStore, client *redis.Client, config Config, logger *Logger) *migratingStore {
+	oldClient := client
+	if config.MigrateFromRedisDB != config.RedisDB {
+		opts := *client.Options()
+		opts.DB = config.MigrateFromRedisDB
+		oldClient = redis.NewClient(&opts)
+	}
+	// Content addressing is assumed so that deletes release the blobs of
+	// old entries written with it; pointers are resolved either way. Hash
+	// entries are read along with the others.
+	previous := newRedisStore(oldClient, config.MigrateFromRedisPrefix, true)
+	previous.hashEntries = true
+	return &migratingStore{
+		current:  current,
+		previous: previous,
+		oldKey:   migrationKeyMapper(config.RedisPrefix, config.MigrateFromRedisPrefix),
+		logger:   logger.Component("migration"),
+	}
+}
+
+// migrationKeyMapper maps keys under prefix to the same key under from.
+// Overrides are not migrated: they are listed through an index kept under
+// the new prefix, and must be recreated there.
+func migrationKeyMapper(prefix, from string) func(string) string {
+	return func(key string) string {
+		name := key
+		if prefix != "" {
+			if !strings.HasPrefix(key, prefix+":") {
+				return ""
+			}
+			name = key[len(prefix)+1:]
+		}
+		if strings.HasPrefix(name, "override:") {
+			return ""
+		}
+		if from != "" {
+			return from + ":" + name
+		}
+		return name
+	}
+}
+
+func (s *migratingStore) Get(ctx context.Context, keys ...string) ([][]byte, error) {
+	values, err := s.current.Get(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]entryLookup, len(values))
+	for i, v := range values {
+		entries[i].value = v
+	}
+	s.readPrevious(ctx, keys, entries)
+	for i, e := range entries {
+		values[i] = e.value
+	}
+	return values, nil
+}
+
+func (s *migratingStore) lookup(ctx context.Context, keys []string, opts lookupOptions) ([]entryLookup, error) {
+	entries, err := lookupEntries(ctx, s.current, keys, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.readPrevious(ctx, keys, entries)
+	return entries, nil
+}
+
+// readPrevious reads the entries missing from the new location from the old
+// one, and copies them over with their remaining TTL.
+func (s *migratingStore) readPrevious(ctx context.Context, keys []string, entries []entryLookup) {
+	var missing []int
+	var oldKeys []string
+	for i, e := range entries {
+		if e.value != nil {
+			migrationLookupsTotal.WithLabelValues("new").Inc()
+			continue
+		}
+		if old := s.oldKey(keys[i]); old != "" {
+			missing = append(missing, i)
+			oldKeys = append(oldKeys, old)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	// The old location is best effort: a failure reads as a miss.
+	oldEntries, err := s.previous.lookup(ctx, oldKeys, lookupOptions{})
+	if err != nil {
+		s.logger.LogContext(ctx, LogWarning, "Failed to read from the old cache location: %v", err)
+		return
+	}
+	for j, i := range missing {
+		old := oldEntries[j]
+		if old.value == nil {
+			migrationLookupsTotal.WithLabelValues("miss").Inc()
+			continue
+		}
+		migrationLookupsTotal.WithLabelValues("old").Inc()
+		entries[i] = old
+		if err := s.current.Set(ctx, keys[i], old.value, old.ttl); err != nil {
+			s.logger.LogContext(ctx, LogWarning, "Failed to copy %s to the new cache location: %v", keys[i], err)
+			continue
+		}
+		migrationCopiedTotal.Inc()
+	}
+}
+
+func (s *migratingStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.current.Set(ctx, key, value, ttl)
+}
+
+func (s *migratingStore) Swap(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	return s.current.Swap(ctx, key, value, ttl)
+}
+
+func (s *migratingStore) Delete(ctx context.Context, keys ...string) (int64, error) {
+	var oldKeys []string
+	for _, key := range keys {
+		if old := s.oldKey(key); old != "" {
+			oldKeys = append(oldKeys, old)
+		}
+	}
+	if len(oldKeys) > 0 {
+		if _, err := s.previous.Delete(ctx, oldKeys...); err != nil {
+			return 0, err
+		}
+	}
+	return s.current.Delete(ctx, keys...)
+}
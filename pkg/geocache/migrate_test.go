@@ -0,0 +1,91 @@
+package geocache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMigrationKeyMapper(t *testing.T) {
+	tests := []struct {
+		prefix, from, key, want string
+	}{
+		{prefix: "new", from: "old", key: "new:abc", want: "old:abc"},
+		{prefix: "new", from: "old", key: "new:abc:pb", want: "old:abc:pb"},
+		{prefix: "new", from: "", key: "new:abc", want: "abc"},
+		{prefix: "", from: "old", key: "abc", want: "old:abc"},
+		{prefix: "new", from: "old", key: "other:abc", want: ""},
+		{prefix: "new", from: "old", key: "new:override:abc", want: ""},
+	}
+	for _, tt := range tests {
+		if got := migrationKeyMapper(tt.prefix, tt.from)(tt.key); got != tt.want {
+			t.Errorf("migrationKeyMapper(%q, %q)(%q) = %q, want %q", tt.prefix, tt.from, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMigratingStore(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to create miniredis: %v", err)
+	}
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr(), DB: 1})
+	defer rdb.Close()
+	config := Config{RedisDB: 1, RedisPrefix: "new", MigrationMode: true, MigrateFromRedisDB: 0, MigrateFromRedisPrefix: "old"}
+	store := newMigratingStore(newRedisStore(rdb, "new", false), rdb, config, NewLogger(false))
+	ctx := context.Background()
+
+	mr.DB(0).Set("old:a", "body a")
+	mr.DB(0).SetTTL("old:a", time.Hour)
+	mr.DB(0).Set("old:b", "body b")
+	mr.DB(1).Set("new:b", "body b2")
+	oldBefore := testutil.ToFloat64(migrationLookupsTotal.WithLabelValues("old"))
+	copiedBefore := testutil.ToFloat64(migrationCopiedTotal)
+
+	values, err := store.Get(ctx, "new:a", "new:b", "new:c")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if string(values[0]) != "body a" || string(values[1]) != "body b2" || values[2] != nil {
+		t.Errorf("Unexpected values %q", values)
+	}
+	if got, _ := mr.DB(1).Get("new:a"); got != "body a" {
+		t.Errorf("Expected the old entry to be copied, got %q", got)
+	}
+	if ttl := mr.DB(1).TTL("new:a"); ttl != time.Hour {
+		t.Errorf("Expected the copy to keep the remaining TTL, got %v", ttl)
+	}
+	if got := testutil.ToFloat64(migrationLookupsTotal.WithLabelValues("old")) - oldBefore; got != 1 {
+		t.Errorf("Expected 1 lookup served from the old location, got %v", got)
+	}
+	if got := testutil.ToFloat64(migrationCopiedTotal) - copiedBefore; got != 1 {
+		t.Errorf("Expected 1 copied entry, got %v", got)
+	}
+
+	// Writes only go to the new location.
+	if err := store.Set(ctx, "new:d", []byte("body d"), time.Hour); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if mr.DB(0).Exists("old:d") {
+		t.Errorf("Expected nothing to be written to the old location")
+	}
+
+	// Deletes apply to both locations.
+	if _, err := store.Delete(ctx, "new:a", "new:b"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	for _, key := range []string{"old:a", "old:b"} {
+		if mr.DB(0).Exists(key) {
+			t.Errorf("Expected %s to be deleted", key)
+		}
+	}
+	values, _ = store.Get(ctx, "new:a", "new:b")
+	if values[0] != nil || values[1] != nil {
+		t.Errorf("Expected deleted entries to stay deleted, got %q", values)
+	}
+}
@@ -0,0 +1,160 @@
+package geocache
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// mirrorBufferSize bounds the writes waiting to be mirrored; writes beyond it
+// are dropped rather than slowing down requests.
+const mirrorBufferSize = 10000
+
+// mirrorOp is a write waiting to be applied to the mirror.
+type mirrorOp struct {
+	// op is "set", "delete", or "read" for a cache hit copied over.
+	op     string
+	keys   []string
+	value  []byte
+	ttl    time.Duration
+	queued time.Time
+}
+
+// mirroringStore copies the writes of a store to a second Redis, so that a
+// replacement cluster is warm by the time traffic is cut over to it. Writes
+// are applied to the mirror in order, in the background: a slow or failing
+// mirror never affects requests. With Config.MirrorReads, cache hits are
+// copied too, with their remaining TTL, so that long-lived entries written
+// before mirroring started are not missing. Mirroring stops at
+// Config.MirrorUntil, when set.
+type mirroringStore struct {
+	current CacheStore
+	// client is connected to the Redis of current, for the TTL of hits.
+	client *redis.Client
+	mirror *redisStore
+	reads  bool
+	until  time.Time
+	clock  Clock
+	ops    chan mirrorOp
+	logger *Logger
+}
+
+func newMirroringStore(current CacheStore, client *redis.Client, config Config, clock Clock, logger *Logger) *mirroringStore {
+	mirrorClient := redis.NewClient(&redis.Options{Addr: config.MirrorRedisAddr, DB: config.MirrorRedisDB})
+	mirror := newRedisStore(mirrorClient, config.RedisPrefix, config.ContentAddressedStorage)
+	mirror.hashEntries = config.CacheHashEntries
+	s := &mirroringStore{
+		current: current,
+		client:  client,
+		mirror:  mirror,
+		reads:   config.MirrorReads,
+		until:   config.MirrorUntil,
+		clock:   clock,
+		ops:     make(chan mirrorOp, mirrorBufferSize),
+		logger:  logger.Component("mirror"),
+	}
+	go s.run()
+	return s
+}
+
+// enqueue queues a write for the mirror, unless mirroring has ended.
+func (s *mirroringStore) enqueue(op mirrorOp) {
+	now := s.clock.Now()
+	if !s.until.IsZero() && now.After(s.until) {
+		return
+	}
+	op.queued = now
+	select {
+	case s.ops <- op:
+	default:
+		mirrorWritesTotal.WithLabelValues(op.op, "dropped").Inc()
+	}
+}
+
+func (s *mirroringStore) run() {
+	for op := range s.ops {
+		outcome := "ok"
+		if err := s.apply(context.Background(), op); err != nil {
+			outcome = "error"
+			s.logger.Log(LogWarning, "Failed to mirror %s of %s: %v", op.op, op.keys[0], err)
+		}
+		mirrorWritesTotal.WithLabelValues(op.op, outcome).Inc()
+		mirrorLag.Observe(s.clock.Now().Sub(op.queued).Seconds())
+	}
+}
+
+func (s *mirroringStore) apply(ctx context.Context, op mirrorOp) error {
+	switch op.op {
+	case "delete":
+		_, err := s.mirror.Delete(ctx, op.keys...)
+		return err
+	case "read":
+		// Entries already in the mirror are at least as recent.
+		if n, err := s.mirror.client.Exists(ctx, op.keys[0]).Result(); err != nil || n > 0 {
+			return err
+		}
+		// PTTL reports -1 for keys without an expiry and -2 for keys that
+		// expired since they were read.
+		ttl, err := s.client.PTTL(ctx, op.keys[0]).Result()
+		if err != nil || ttl == -2 {
+			return err
+		} else if ttl < 0 {
+			ttl = 0
+		}
+		op.ttl = ttl
+	}
+	return s.mirror.Set(ctx, op.keys[0], op.value, op.ttl)
+}
+
+func (s *mirroringStore) Get(ctx context.Context, keys ...string) ([][]byte, error) {
+	values, err := s.current.Get(ctx, keys...)
+	if err != nil || !s.reads {
+		return values, err
+	}
+	for i, v := range values {
+		if v != nil {
+			s.enqueue(mirrorOp{op: "read", keys: keys[i : i+1], value: v})
+		}
+	}
+	return values, nil
+}
+
+func (s *mirroringStore) lookup(ctx context.Context, keys []string, opts lookupOptions) ([]entryLookup, error) {
+	entries, err := lookupEntries(ctx, s.current, keys, opts)
+	if err != nil || !s.reads {
+		return entries, err
+	}
+	for i, e := range entries {
+		if e.value != nil {
+			s.enqueue(mirrorOp{op: "read", keys: keys[i : i+1], value: e.value})
+		}
+	}
+	return entries, nil
+}
+
+func (s *mirroringStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := s.current.Set(ctx, key, value, ttl); err != nil {
+		return err
+	}
+	s.enqueue(mirrorOp{op: "set", keys: []string{key}, value: value, ttl: ttl})
+	return nil
+}
+
+func (s *mirroringStore) Swap(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	previous, err := s.current.Swap(ctx, key, value, ttl)
+	if err != nil {
+		return nil, err
+	}
+	s.enqueue(mirrorOp{op: "set", keys: []string{key}, value: value, ttl: ttl})
+	return previous, nil
+}
+
+func (s *mirroringStore) Delete(ctx context.Context, keys ...string) (int64, error) {
+	n, err := s.current.Delete(ctx, keys...)
+	if err != nil || len(keys) == 0 {
+		return n, err
+	}
+	s.enqueue(mirrorOp{op: "delete", keys: keys})
+	return n, nil
+}
@@ -0,0 +1,75 @@
+package geocache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMirroringStore(t *testing.T) {
+	primary, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to create miniredis: %v", err)
+	}
+	defer primary.Close()
+	mirror, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to create miniredis: %v", err)
+	}
+	defer mirror.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: primary.Addr()})
+	defer rdb.Close()
+	clock := NewFrozenClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	config := Config{RedisPrefix: "test", MirrorRedisAddr: mirror.Addr(), MirrorReads: true, MirrorUntil: clock.Now().Add(time.Hour)}
+	store := newMirroringStore(newRedisStore(rdb, "test", false), rdb, config, clock, NewLogger(false))
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "test:a", []byte("body a"), time.Hour); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if !waitFor(t, func() bool { return mirror.Exists("test:a") }) {
+		t.Fatal("Expected the write to be mirrored")
+	}
+	if ttl := mirror.TTL("test:a"); ttl != time.Hour {
+		t.Errorf("Expected the mirrored entry to keep its TTL, got %v", ttl)
+	}
+
+	// Hits on entries written before mirroring started are copied with
+	// their remaining TTL.
+	primary.Set("test:b", "body b")
+	primary.SetTTL("test:b", 30*time.Minute)
+	if _, err := store.Get(ctx, "test:b", "test:c"); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !waitFor(t, func() bool { return mirror.Exists("test:b") }) {
+		t.Fatal("Expected the hit to be mirrored")
+	}
+	if got, _ := mirror.Get("test:b"); got != "body b" {
+		t.Errorf("Expected the mirrored hit to hold body b, got %q", got)
+	}
+	if ttl := mirror.TTL("test:b"); ttl != 30*time.Minute {
+		t.Errorf("Expected the mirrored hit to keep its remaining TTL, got %v", ttl)
+	}
+
+	if _, err := store.Delete(ctx, "test:a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if !waitFor(t, func() bool { return !mirror.Exists("test:a") }) {
+		t.Error("Expected the delete to be mirrored")
+	}
+
+	// Once MirrorUntil has passed, writes only go to the primary.
+	clock.Advance(2 * time.Hour)
+	store.Set(ctx, "test:d", []byte("body d"), time.Hour)
+	store.Set(ctx, "test:e", []byte("body e"), time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	if mirror.Exists("test:d") || mirror.Exists("test:e") {
+		t.Error("Expected mirroring to stop after MirrorUntil")
+	}
+	if !primary.Exists("test:d") {
+		t.Error("Expected the write to reach the primary")
+	}
+}
@@ -0,0 +1,121 @@
+package geocache
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseAddrIP parses the IP of an address as found in RemoteAddr or
+// X-Forwarded-For: a bare IP, "ip:port", "[ipv6]" or "[ipv6]:port", with an
+// optional IPv6 zone. IPv4-mapped IPv6 addresses are returned in their IPv4
+// form, so ::ffff:192.0.2.1 and 192.0.2.1 are one client. It returns nil for
+// anything else, such as a host name.
+func parseAddrIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+	host, _, _ = strings.Cut(host, "%")
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// normalizeAddr returns addr with its IP in canonical form, keeping its port.
+// Addresses that do not parse are returned trimmed but otherwise unchanged.
+func normalizeAddr(addr string) string {
+	addr = strings.TrimSpace(addr)
+	ip := parseAddrIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	return ip.String()
+}
+
+// forwardedFor returns the addresses of the X-Forwarded-For chain of r, each
+// normalized, separated by ", ".
+func forwardedFor(r *http.Request) string {
+	header := r.Header.Get("X-Forwarded-For")
+	if header == "" {
+		return ""
+	}
+	hops := strings.Split(header, ",")
+	for i, hop := range hops {
+		hops[i] = normalizeAddr(hop)
+	}
+	return strings.Join(hops, ", ")
+}
+
+// clientIP returns the address of the client of r, without port and with
+// IPv4-mapped addresses unmapped: the host of RemoteAddr, unless it is one
+// of trustedProxies. X-Forwarded-For is only believed then, as anyone can
+// send it, and its right-most hop that is not a trusted proxy is the client,
+// as the hops to its left were sent by the client itself.
+func clientIP(r *http.Request, trustedProxies []string) string {
+	addr := r.RemoteAddr
+	header := r.Header.Get("X-Forwarded-For")
+	if header == "" || len(trustedProxies) == 0 || !isIPAllowed(addr, trustedProxies) {
+		return addrHost(addr)
+	}
+	hops := strings.Split(header, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr = hops[i]
+		if !isIPAllowed(addr, trustedProxies) {
+			break
+		}
+	}
+	return addrHost(addr)
+}
+
+// addrHost returns the normalized IP of addr without its port, or its host
+// part when it is not an IP address.
+func addrHost(addr string) string {
+	if ip := parseAddrIP(addr); ip != nil {
+		return ip.String()
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSpace(addr)
+}
+
+// parseAllowedCIDR parses an entry of an allowed CIDR list. IPv4-mapped IPv6
+// ranges such as ::ffff:10.0.0.0/104 are converted to their IPv4 equivalent,
+// since addresses are unmapped before they are matched.
+func parseAllowedCIDR(cidr string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	if ip4 := network.IP.To4(); ip4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+		network = &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+	}
+	return network, nil
+}
+
+// Listen opens the listener of the server. ListenNetwork selects dual-stack
+// ("tcp") or single-family ("tcp4", "tcp6") sockets, and ListenAddress the
+// address bound; an empty address binds all interfaces of the selected
+// families. MaxConnections bounds the connections open at once.
+func Listen(config Config) (net.Listener, error) {
+	switch config.ListenNetwork {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported LISTEN_NETWORK %q, want tcp, tcp4 or tcp6", config.ListenNetwork)
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(config.ListenAddress, "["), "]")
+	l, err := net.Listen(config.ListenNetwork, net.JoinHostPort(host, config.ServerPort))
+	if err != nil {
+		return nil, err
+	}
+	return limitConnections(l, config.MaxConnections), nil
+}
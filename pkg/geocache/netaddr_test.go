@@ -0,0 +1,126 @@
+package geocache
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.0.2.0/24"}
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		xForwardedFor string
+		want          string
+	}{
+		{name: "IPv4 remote addr", remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "IPv6 remote addr", remoteAddr: "[2001:db8::1]:1234", want: "2001:db8::1"},
+		{name: "IPv4-mapped remote addr", remoteAddr: "[::ffff:192.0.2.1]:1234", want: "192.0.2.1"},
+		{name: "zoned remote addr", remoteAddr: "[fe80::1%eth0]:1234", want: "fe80::1"},
+		{name: "remote addr without port", remoteAddr: "2001:db8::1", want: "2001:db8::1"},
+		{name: "untrusted remote addr", remoteAddr: "198.51.100.9:1234", xForwardedFor: "203.0.113.5", want: "198.51.100.9"},
+		{name: "forwarded hop", remoteAddr: "192.0.2.1:1234", xForwardedFor: "198.51.100.7", want: "198.51.100.7"},
+		{name: "right-most untrusted hop", remoteAddr: "192.0.2.1:1234", xForwardedFor: " 203.0.113.5, 198.51.100.7 , 10.0.0.1", want: "198.51.100.7"},
+		{name: "only trusted hops", remoteAddr: "192.0.2.1:1234", xForwardedFor: "10.0.0.2, 10.0.0.1", want: "10.0.0.2"},
+		{name: "bracketed forwarded IPv6", remoteAddr: "192.0.2.1:1234", xForwardedFor: "[2001:DB8:0::7]", want: "2001:db8::7"},
+		{name: "bracketed forwarded IPv6 with port", remoteAddr: "192.0.2.1:1234", xForwardedFor: "[2001:db8::7]:443, 10.0.0.1", want: "2001:db8::7"},
+		{name: "forwarded IPv4 with port", remoteAddr: "192.0.2.1:1234", xForwardedFor: "198.51.100.7:443", want: "198.51.100.7"},
+		{name: "forwarded IPv4-mapped", remoteAddr: "192.0.2.1:1234", xForwardedFor: "::ffff:198.51.100.7", want: "198.51.100.7"},
+		{name: "forwarded garbage", remoteAddr: "192.0.2.1:1234", xForwardedFor: "unknown", want: "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.xForwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.xForwardedFor)
+			}
+			if got := clientIP(r, trusted); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Without trusted proxies, X-Forwarded-For is ignored.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if got := clientIP(r, nil); got != "192.0.2.1" {
+		t.Errorf("clientIP() without trusted proxies = %q, want 192.0.2.1", got)
+	}
+}
+
+func TestRateLimitClient_IPv4Mapped(t *testing.T) {
+	mapped := httptest.NewRequest(http.MethodGet, "/", nil)
+	mapped.RemoteAddr = "[::ffff:192.0.2.1]:1234"
+	plain := httptest.NewRequest(http.MethodGet, "/", nil)
+	plain.RemoteAddr = "192.0.2.1:5678"
+
+	mappedID, _ := rateLimitClient(mapped, nil)
+	plainID, _ := rateLimitClient(plain, nil)
+	if mappedID != plainID || plainID != "ip:192.0.2.1" {
+		t.Errorf("Expected one rate limit client ip:192.0.2.1, got %q and %q", mappedID, plainID)
+	}
+}
+
+func TestIsIPAllowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		cidrs      []string
+		want       bool
+	}{
+		{name: "IPv4 in range", remoteAddr: "10.1.2.3:80", cidrs: []string{"10.0.0.0/8"}, want: true},
+		{name: "IPv4 out of range", remoteAddr: "11.1.2.3:80", cidrs: []string{"10.0.0.0/8"}, want: false},
+		{name: "IPv6 in range", remoteAddr: "[2001:db8:1::5]:80", cidrs: []string{"2001:db8::/32"}, want: true},
+		{name: "IPv6 out of range", remoteAddr: "[2001:db9::5]:80", cidrs: []string{"2001:db8::/32"}, want: false},
+		{name: "IPv6 loopback", remoteAddr: "[::1]:80", cidrs: []string{"127.0.0.0/8", "::1/128"}, want: true},
+		{name: "IPv6 not matched by IPv4 range", remoteAddr: "[::1]:80", cidrs: []string{"0.0.0.0/0"}, want: false},
+		{name: "IPv4-mapped address in IPv4 range", remoteAddr: "[::ffff:10.1.2.3]:80", cidrs: []string{"10.0.0.0/8"}, want: true},
+		{name: "IPv4 address in IPv4-mapped range", remoteAddr: "10.1.2.3:80", cidrs: []string{"::ffff:10.0.0.0/104"}, want: true},
+		{name: "zoned link-local", remoteAddr: "[fe80::1%eth0]:80", cidrs: []string{"fe80::/10"}, want: true},
+		{name: "invalid CIDR skipped", remoteAddr: "[2001:db8::5]:80", cidrs: []string{"2001:db8::/129", " 2001:db8::/32 "}, want: true},
+		{name: "host name", remoteAddr: "localhost:80", cidrs: []string{"127.0.0.0/8"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIPAllowed(tt.remoteAddr, tt.cidrs); got != tt.want {
+				t.Errorf("isIPAllowed(%q, %v) = %v, want %v", tt.remoteAddr, tt.cidrs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListen(t *testing.T) {
+	if _, err := Listen(Config{ListenNetwork: "udp", ServerPort: "0"}); err == nil {
+		t.Error("Expected an unsupported network to be rejected")
+	}
+
+	tests := []struct {
+		name    string
+		network string
+		address string
+	}{
+		{name: "IPv4", network: "tcp4", address: "127.0.0.1"},
+		{name: "IPv6", network: "tcp6", address: "::1"},
+		{name: "bracketed IPv6", network: "tcp6", address: "[::1]"},
+		{name: "dual-stack", network: "tcp", address: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := Listen(Config{ListenNetwork: tt.network, ListenAddress: tt.address, ServerPort: "0"})
+			if err != nil {
+				t.Skipf("%s unavailable here: %v", tt.network, err)
+			}
+			defer l.Close()
+			if _, ok := l.Addr().(*net.TCPAddr); !ok {
+				t.Errorf("Expected a TCP listener, got %v", l.Addr())
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package geocache
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultAbbreviations expands common street suffix abbreviations. Keys are
+// case-folded and have any trailing period removed.
+var defaultAbbreviations = map[string]string{
+	"st":   "street",
+	"ave":  "avenue",
+	"av":   "avenue",
+	"blvd": "boulevard",
+	"rd":   "road",
+	"dr":   "drive",
+	"ln":   "lane",
+	"ct":   "court",
+	"cir":  "circle",
+	"hwy":  "highway",
+	"pkwy": "parkway",
+	"pl":   "place",
+	"sq":   "square",
+	"ter":  "terrace",
+	"trl":  "trail",
+	"ste":  "suite",
+	"apt":  "apartment",
+}
+
+// nameAbbreviations are the abbreviations read differently at the start of a
+// name: "St. Louis" is "saint louis", while "Main St." is "main street".
+var nameAbbreviations = map[string]string{
+	"st": "saint",
+}
+
+// addressNormalizer canonicalizes user-typed address strings so that trivially
+// different spellings of the same address share a cache entry.
+type addressNormalizer struct {
+	stripDiacritics bool
+	abbreviations   map[string]string
+}
+
+func newAddressNormalizer(stripDiacritics bool, abbreviations map[string]string) *addressNormalizer {
+	if abbreviations == nil {
+		abbreviations = defaultAbbreviations
+	}
+	return &addressNormalizer{
+		stripDiacritics: stripDiacritics,
+		abbreviations:   abbreviations,
+	}
+}
+
+// loadAbbreviations reads an abbreviation table from a file with one
+// "abbreviation=expansion" pair per line. Blank lines and lines starting with
+// '#' are ignored.
+func loadAbbreviations(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	table := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		abbr, expansion, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected abbreviation=expansion", path, line)
+		}
+		abbr = strings.TrimSuffix(cases.Fold().String(strings.TrimSpace(abbr)), ".")
+		table[abbr] = cases.Fold().String(strings.TrimSpace(expansion))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Normalize trims and collapses whitespace, case-folds, optionally strips
+// diacritics and expands abbreviations found in the table. An abbreviation of
+// nameAbbreviations starting a part of the address, rather than following a
+// street name, is expanded as the start of a name instead.
+func (n *addressNormalizer) Normalize(address string) string {
+	s := cases.Fold().String(address)
+	if n.stripDiacritics {
+		t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+		if out, _, err := transform.String(t, s); err == nil {
+			s = out
+		}
+	}
+
+	fields := strings.Fields(s)
+	for i, field := range fields {
+		core := strings.TrimRight(field, ".,;")
+		trailing := strings.TrimLeft(field[len(core):], ".")
+		if expansion, ok := n.abbreviations[core]; ok {
+			if name, ok := nameAbbreviations[core]; ok && startsName(fields, i) {
+				expansion = name
+			}
+			fields[i] = expansion + trailing
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// startsName reports whether fields[i] starts a part of an address: it is
+// the first word, follows a comma, or follows a house number.
+func startsName(fields []string, i int) bool {
+	if i == 0 || strings.HasSuffix(fields[i-1], ",") {
+		return true
+	}
+	previous := strings.TrimRight(fields[i-1], ".,;")
+	return previous != "" && strings.IndexFunc(previous, func(r rune) bool { return !unicode.IsDigit(r) }) < 0
+}
@@ -0,0 +1,146 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddressNormalizer_Normalize(t *testing.T) {
+	tests := []struct {
+		name            string
+		stripDiacritics bool
+		input           string
+		expected        string
+	}{
+		{
+			name:     "trims and collapses whitespace",
+			input:    "  123   Main\tStreet  ",
+			expected: "123 main street",
+		},
+		{
+			name:     "case folds",
+			input:    "1600 AMPHITHEATRE Parkway",
+			expected: "1600 amphitheatre parkway",
+		},
+		{
+			name:     "expands abbreviation with trailing period",
+			input:    "123 Main St.",
+			expected: "123 main street",
+		},
+		{
+			name:     "keeps punctuation after expanded abbreviation",
+			input:    "123 Main St., Springfield",
+			expected: "123 main street, springfield",
+		},
+		{
+			name:     "reads st as saint at the start of a name",
+			input:    "St. Louis, MO",
+			expected: "saint louis, mo",
+		},
+		{
+			name:     "merges st with saint",
+			input:    "Saint Louis, MO",
+			expected: "saint louis, mo",
+		},
+		{
+			name:     "reads st as saint after a comma",
+			input:    "1 Main St, St. Paul",
+			expected: "1 main street, saint paul",
+		},
+		{
+			name:     "reads st as saint after a house number",
+			input:    "20 St James Pl",
+			expected: "20 saint james place",
+		},
+		{
+			name:     "reads st as street after a street name without commas",
+			input:    "123 Main St Springfield",
+			expected: "123 main street springfield",
+		},
+		{
+			name:     "leaves unknown words alone",
+			input:    "Acme Inc. HQ",
+			expected: "acme inc. hq",
+		},
+		{
+			name:            "strips diacritics when enabled",
+			stripDiacritics: true,
+			input:           "Calle Añil, Mérida",
+			expected:        "calle anil, merida",
+		},
+		{
+			name:            "keeps diacritics when disabled",
+			stripDiacritics: false,
+			input:           "Calle Añil, Mérida",
+			expected:        "calle añil, mérida",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newAddressNormalizer(tt.stripDiacritics, nil)
+			if got := n.Normalize(tt.input); got != tt.expected {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLoadAbbreviations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abbreviations.txt")
+	content := "# German street suffixes\nStr.=Strasse\n\npl = platz\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write abbreviations file: %v", err)
+	}
+
+	table, err := loadAbbreviations(path)
+	if err != nil {
+		t.Fatalf("loadAbbreviations() error = %v", err)
+	}
+	if table["str"] != "strasse" || table["pl"] != "platz" {
+		t.Errorf("loadAbbreviations() = %v, want str and pl entries", table)
+	}
+
+	n := newAddressNormalizer(true, table)
+	if got := n.Normalize("Hauptstr. 5"); got != "hauptstr. 5" {
+		t.Errorf("Normalize() should only expand whole words, got %q", got)
+	}
+	if got := n.Normalize("Haupt Str. 5"); got != "haupt strasse 5" {
+		t.Errorf("Normalize() = %q, want %q", got, "haupt strasse 5")
+	}
+
+	badPath := filepath.Join(t.TempDir(), "bad.txt")
+	if err := os.WriteFile(badPath, []byte("no separator\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write abbreviations file: %v", err)
+	}
+	if _, err := loadAbbreviations(badPath); err == nil {
+		t.Error("Expected error for malformed abbreviations file")
+	}
+}
+
+func TestServer_CacheKey_NormalizesAddress(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+
+	a := httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=123+Main+St.", nil)
+	b := httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=123%20%20main%20street", nil)
+
+	if server.cacheKey(a) == server.cacheKey(b) {
+		t.Error("Expected distinct cache keys when normalization is disabled")
+	}
+
+	server.normalizer = newAddressNormalizer(true, nil)
+	if server.cacheKey(a) != server.cacheKey(b) {
+		t.Error("Expected equal cache keys when normalization is enabled")
+	}
+
+	// Normalization only applies to the geocoding endpoint
+	c := httptest.NewRequest(http.MethodGet, "/maps/api/place/textsearch/json?address=123+Main+St.", nil)
+	d := httptest.NewRequest(http.MethodGet, "/maps/api/place/textsearch/json?address=123+main+street", nil)
+	if server.cacheKey(c) == server.cacheKey(d) {
+		t.Error("Expected normalization to be limited to the geocoding endpoint")
+	}
+}
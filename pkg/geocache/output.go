@@ -0,0 +1,55 @@
+package geocache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// outputFormat splits path, a Maps API endpoint, into its base, such as
+// /maps/api/geocode, and its output format: "json", "xml", or "" when the
+// path has none. ok is false for other paths.
+func outputFormat(path string) (base, format string, ok bool) {
+	if !strings.HasPrefix(path, "/maps/api/") {
+		return "", "", false
+	}
+	for _, f := range []string{"json", "xml"} {
+		if base, found := strings.CutSuffix(path, "/"+f); found {
+			return base, f, true
+		}
+	}
+	return strings.TrimSuffix(path, "/"), "", true
+}
+
+// transcodesXML reports whether requests for the XML endpoint at path are
+// served from the cache of its JSON variant: with XML_TRANSCODE, or when its
+// base matches JSON_OUTPUT_ENDPOINTS.
+func (s *Server) transcodesXML(path string) bool {
+	if !isXMLPath(path) {
+		return false
+	}
+	if s.config.XMLTranscode {
+		return true
+	}
+	base, _, _ := outputFormat(path)
+	return matchPathPattern(s.jsonOutputEndpoints, "json_output", base) != nil
+}
+
+// outputFormatMiddleware rewrites the requests without an output format to
+// the endpoints of JSON_OUTPUT_ENDPOINTS, such as /maps/api/geocode, to their
+// JSON variant, so that they are cached and sent upstream as JSON requests.
+func (s *Server) outputFormatMiddleware(next http.Handler) http.Handler {
+	if len(s.jsonOutputEndpoints) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base, format, ok := outputFormat(r.URL.Path)
+		if !ok || format != "" || matchPathPattern(s.jsonOutputEndpoints, "json_output", base) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath = base+"/json", ""
+		r.RequestURI = r.URL.RequestURI()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,139 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// override is an operator-pinned response served in place of the cached or
+// upstream response for a canonical query. Overrides never expire.
+type override struct {
+	URI         string    `json:"uri"`
+	Body        string    `json:"body"`
+	ContentType string    `json:"content_type"`
+	Note        string    `json:"note,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// overrideKey maps a cache key to the Redis key holding its override.
+func (s *Server) overrideKey(cacheKey string) string {
+	return s.redisKey("override:" + strings.TrimPrefix(cacheKey, s.config.RedisPrefix+":"))
+}
+
+func (s *Server) overrideIndexKey() string {
+	return s.redisKey("overrides")
+}
+
+// overrideKeyForURI resolves a request URI to the override key for its
+// canonical query, so keys and parameter order do not matter.
+func (s *Server) overrideKeyForURI(uri string) (string, error) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "", err
+	}
+	return s.overrideKey(s.cacheKey(&http.Request{URL: u})), nil
+}
+
+func (s *Server) handlePutOverride(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Query().Get("uri")
+	key, err := s.overrideKeyForURI(uri)
+	if uri == "" || err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "uri must be a request URI such as /maps/api/geocode/json?address=..."})
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "request body must contain the response to serve"})
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	o := override{
+		URI:         uri,
+		Body:        string(body),
+		ContentType: contentType,
+		Note:        r.URL.Query().Get("note"),
+		CreatedAt:   s.clock.Now().UTC(),
+	}
+	data, _ := json.Marshal(o)
+
+	ctx := r.Context()
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, key, data, 0)
+	pipe.SAdd(ctx, s.overrideIndexKey(), key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	s.logger.Log(LogInfo, "Pinned override for %s", uri)
+	s.auditLog.Record(adminActor(r), AuditOverrideSet, map[string]string{"uri": uri, "note": o.Note})
+	writeJSON(w, http.StatusOK, o)
+}
+
+func (s *Server) handleDeleteOverride(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Query().Get("uri")
+	key, err := s.overrideKeyForURI(uri)
+	if uri == "" || err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "uri must be a request URI"})
+		return
+	}
+
+	ctx := r.Context()
+	pipe := s.redis.TxPipeline()
+	deleted := pipe.Del(ctx, key)
+	pipe.SRem(ctx, s.overrideIndexKey(), key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if deleted.Val() == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no override for uri"})
+		return
+	}
+
+	s.logger.Log(LogInfo, "Removed override for %s", uri)
+	s.auditLog.Record(adminActor(r), AuditOverrideClear, map[string]string{"uri": uri})
+	writeJSON(w, http.StatusOK, map[string]string{"uri": uri})
+}
+
+func (s *Server) handleListOverrides(w http.ResponseWriter, r *http.Request) {
+	overrides, err := s.listOverrides(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, overrides)
+}
+
+func (s *Server) listOverrides(ctx context.Context) ([]override, error) {
+	keys, err := s.redis.SMembers(ctx, s.overrideIndexKey()).Result()
+	if err != nil || len(keys) == 0 {
+		return []override{}, err
+	}
+	values, err := s.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := make([]override, 0, len(values))
+	for _, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var o override
+		if json.Unmarshal([]byte(str), &o) == nil {
+			overrides = append(overrides, o)
+		}
+	}
+	return overrides, nil
+}
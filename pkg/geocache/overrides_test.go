@@ -0,0 +1,98 @@
+package geocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverrides(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	admin := server.adminHandler()
+
+	// Cached Google response that the override must take precedence over
+	cacheKey := getCacheKey(httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=gate", nil), server.config.RedisPrefix)
+	mr.Set(cacheKey, `{"source": "google"}`)
+	mr.SetTTL(cacheKey, time.Hour)
+
+	pinned := `{"source": "override"}`
+	req := httptest.NewRequest(http.MethodPut, "/admin/overrides?note=customer+gate&uri="+
+		"%2Fmaps%2Fapi%2Fgeocode%2Fjson%3Fkey%3Dabc%26address%3Dgate", strings.NewReader(pinned))
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if ttl := mr.TTL(server.overrideKey(cacheKey)); ttl != 0 {
+		t.Errorf("Expected override to never expire, got TTL %v", ttl)
+	}
+
+	w = httptest.NewRecorder()
+	server.query(w, httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=gate&key=other", nil))
+	if w.Header().Get("X-Cache") != "OVERRIDE" {
+		t.Errorf("Expected X-Cache header to be OVERRIDE, got %s", w.Header().Get("X-Cache"))
+	}
+	if w.Body.String() != pinned {
+		t.Errorf("Expected body %s, got %s", pinned, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/overrides", nil))
+	var overrides []override
+	if err := json.Unmarshal(w.Body.Bytes(), &overrides); err != nil {
+		t.Fatalf("Failed to decode overrides: %v", err)
+	}
+	if len(overrides) != 1 || overrides[0].Note != "customer gate" {
+		t.Errorf("Unexpected overrides %+v", overrides)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/overrides?uri=%2Fmaps%2Fapi%2Fgeocode%2Fjson%3Faddress%3Dgate", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	server.query(w, httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=gate", nil))
+	if w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected X-Cache header to be HIT after removing override, got %s", w.Header().Get("X-Cache"))
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/overrides?uri=%2Fmaps%2Fapi%2Fgeocode%2Fjson%3Faddress%3Dgate", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d deleting a missing override, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestOverrides_InvalidRequests(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	admin := server.adminHandler()
+
+	tests := []struct {
+		name string
+		uri  string
+		body string
+	}{
+		{"missing uri", "", `{}`},
+		{"relative uri", "maps/api/geocode/json", `{}`},
+		{"empty body", "/maps/api/geocode/json?address=x", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/admin/overrides?uri="+tt.uri, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package geocache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// paginatedPaths are the Places endpoints whose responses carry a
+// next_page_token, for the next page of results.
+var paginatedPaths = map[string]bool{
+	"/maps/api/place/textsearch/json":   true,
+	"/maps/api/place/nearbysearch/json": true,
+}
+
+const (
+	// maxPlacesPages is the number of pages Google serves for a search.
+	maxPlacesPages = 3
+	// pageTokenDelay is how long Google takes to accept a next_page_token.
+	pageTokenDelay = 2 * time.Second
+	// aggregatePagesParam asks for every page of a search in one response.
+	aggregatePagesParam = "proxy_aggregate_pages"
+)
+
+// pageKeyKey is the context key of the cache key of a page request.
+type pageKeyKey struct{}
+
+// pageKeyFromContext returns the cache key of the page request of ctx, or ""
+// for other requests.
+func pageKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(pageKeyKey{}).(string)
+	return key
+}
+
+// pageToken returns the pagetoken of r when it requests a page of a Places
+// search.
+func pageToken(r *http.Request) string {
+	if !paginatedPaths[jsonVariant(r.URL.Path)] {
+		return ""
+	}
+	return r.URL.Query().Get("pagetoken")
+}
+
+// nextPageToken returns the next_page_token of a Places search response.
+func nextPageToken(body []byte) string {
+	var resp struct {
+		NextPageToken string `json:"next_page_token"`
+	}
+	json.Unmarshal(body, &resp)
+	return resp.NextPageToken
+}
+
+func (s *Server) pageTokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return s.redisKey("pagetoken:" + hex.EncodeToString(sum[:16]))
+}
+
+// nextPageKey returns the cache key of the page following the entry
+// cacheKey. Every response to a search carries a new token, but they all
+// lead to the same page, so pages are keyed by the search instead.
+func (s *Server) nextPageKey(cacheKey string) string {
+	return hashCacheKey("next page of "+cacheKey, s.config.RedisPrefix)
+}
+
+// resolvePageToken returns r with the cache key of the page its pagetoken
+// leads to, or false when the token was not issued in a cached response:
+// such requests are not cached, since tokens expire within minutes and a
+// key made of one would never be hit again.
+func (s *Server) resolvePageToken(r *http.Request, token string) (*http.Request, bool) {
+	if s.redis == nil {
+		return r, false
+	}
+	parent, err := s.redis.Get(r.Context(), s.pageTokenKey(token)).Result()
+	if err != nil {
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), pageKeyKey{}, s.nextPageKey(parent))), true
+}
+
+// trackPages remembers the next_page_token of body, the Places search
+// response stored under cacheKey, for as long as the entry, so that clients
+// served the entry can fetch the next page from the cache with it. With
+// STITCH_PLACES_PAGES, the following pages of a search are then fetched in
+// the background and stored with its first page in a single entry.
+func (s *Server) trackPages(r *http.Request, cacheKey string, body []byte, fetchedAt time.Time) {
+	if s.redis == nil || !paginatedPaths[r.URL.Path] {
+		return
+	}
+	token := nextPageToken(body)
+	if token == "" {
+		return
+	}
+	if err := s.redis.Set(context.Background(), s.pageTokenKey(token), cacheKey, s.cacheTTL(r)).Err(); err != nil {
+		s.logger.LogContext(r.Context(), LogWarning, "Failed to remember the page token of %s: %v", cacheKey, err)
+	}
+	if s.config.StitchPlacesPages && pageKeyFromContext(r.Context()) == "" {
+		go s.stitchPages(r, cacheKey, body, fetchedAt)
+	}
+}
+
+// errPageFailed is returned when a page of a search cannot be fetched.
+var errPageFailed = errors.New("page of the search could not be fetched")
+
+// fetchPages fetches the pages following first, the body of the first page
+// of the search req, waiting for Google to accept each next_page_token, and
+// returns a response holding the results of every page and no
+// next_page_token. A token Google does not accept yet is retried once.
+func (s *Server) fetchPages(req *http.Request, first []byte) ([]byte, error) {
+	var merged map[string]json.RawMessage
+	var results []json.RawMessage
+	if err := json.Unmarshal(first, &merged); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(merged["results"], &results); err != nil {
+		return nil, err
+	}
+	var token string
+	json.Unmarshal(merged["next_page_token"], &token)
+
+	pageReq := req.Clone(req.Context())
+	for page := 2; page <= maxPlacesPages && token != ""; page++ {
+		q := pageReq.URL.Query()
+		q.Set("pagetoken", token)
+		pageReq.URL.RawQuery = q.Encode()
+		var next struct {
+			Status        string            `json:"status"`
+			Results       []json.RawMessage `json:"results"`
+			NextPageToken string            `json:"next_page_token"`
+		}
+		for attempt := 0; attempt < 2 && next.Status != "OK"; attempt++ {
+			select {
+			case <-s.clock.After(pageTokenDelay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			resp, err := s.upstream.Fetch(pageReq)
+			if err != nil {
+				return nil, fmt.Errorf("page %d: %w", page, err)
+			}
+			next.Status = ""
+			json.Unmarshal(plainBody(resp.Body), &next)
+			if next.Status != "OK" && next.Status != "INVALID_REQUEST" {
+				break
+			}
+		}
+		if next.Status != "OK" {
+			return nil, fmt.Errorf("page %d has status %q: %w", page, next.Status, errPageFailed)
+		}
+		results = append(results, next.Results...)
+		token = next.NextPageToken
+	}
+
+	merged["results"], _ = json.Marshal(results)
+	delete(merged, "next_page_token")
+	return json.Marshal(merged)
+}
+
+// stitchPages replaces the entry cacheKey, the first page of the search r,
+// with the results of every page of the search. The entry is left as it is
+// when a page cannot be fetched.
+func (s *Server) stitchPages(r *http.Request, cacheKey string, body []byte, fetchedAt time.Time) {
+	r = r.WithContext(context.WithoutCancel(r.Context()))
+	stitched, err := s.fetchPages(r, body)
+	if err != nil {
+		s.logger.Log(LogWarning, "Not stitching the pages of %s: %v", cacheKey, err)
+		pageStitchesTotal.WithLabelValues("failed").Inc()
+		return
+	}
+	stitched, cacheable := s.cacheBody(r, stitched)
+	if !cacheable {
+		pageStitchesTotal.WithLabelValues("failed").Inc()
+		return
+	}
+	s.storeResponse(r, cacheKey, stitched, fetchedAt)
+	pageStitchesTotal.WithLabelValues("stitched").Inc()
+	s.logger.Log(LogDebug, "Stitched the pages of %s", cacheKey)
+}
+
+// wantsAggregatePages reports whether r asks for every page of a Places
+// search in one response.
+func wantsAggregatePages(r *http.Request) bool {
+	return paginatedPaths[r.URL.Path] && r.URL.Query().Get(aggregatePagesParam) == "true" && pageKeyFromContext(r.Context()) == ""
+}
+
+// withoutAggregateParam returns a copy of r without the
+// proxy_aggregate_pages parameter, which Google does not know. The parameter
+// stays in the cache key, since the aggregate differs from the first page.
+func withoutAggregateParam(r *http.Request) *http.Request {
+	upstreamReq := r.Clone(r.Context())
+	q := upstreamReq.URL.Query()
+	q.Del(aggregatePagesParam)
+	upstreamReq.URL.RawQuery = q.Encode()
+	return upstreamReq
+}
+
+// aggregatePages replaces the body of resp, the first page of the search
+// req, with the results of every page. Responses other than an OK with a
+// next_page_token are returned as they are.
+func (s *Server) aggregatePages(req *http.Request, resp *UpstreamResponse) (*UpstreamResponse, error) {
+	body := plainBody(resp.Body)
+	if nextPageToken(body) == "" {
+		return resp, nil
+	}
+	merged, err := s.fetchPages(req, body)
+	if err != nil {
+		return nil, err
+	}
+	aggregated := *resp
+	aggregated.Body = merged
+	return &aggregated, nil
+}
@@ -0,0 +1,185 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const textSearchPath = "/maps/api/place/textsearch/json"
+
+// pagesTransport answers a Places search with the page of its pagetoken.
+type pagesTransport struct {
+	mu    sync.Mutex
+	pages map[string]string
+	urls  []string
+}
+
+func (p *pagesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.urls = append(p.urls, req.URL.String())
+	body, ok := p.pages[req.URL.Query().Get("pagetoken")]
+	if !ok {
+		body = `{"status":"INVALID_REQUEST","results":[]}`
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func (p *pagesTransport) requests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.urls)
+}
+
+func TestServer_Query_PageTokens(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	transport := &pagesTransport{pages: map[string]string{
+		"":        `{"status":"OK","results":[{"place_id":"a"}],"next_page_token":"token-1"}`,
+		"token-1": `{"status":"OK","results":[{"place_id":"b"}]}`,
+	}}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+	handler := server.routes()
+	get := func(uri string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, uri, nil))
+		return w
+	}
+
+	// A token that was not issued in a cached response is passed through.
+	if w := get(textSearchPath + "?pagetoken=token-1"); w.Header().Get("X-Cache") != "BYPASS" {
+		t.Errorf("Expected an unknown token to bypass the cache, got %q", w.Header().Get("X-Cache"))
+	}
+	get(textSearchPath + "?query=pizza")
+	for _, want := range []string{"MISS", "HIT"} {
+		w := get(textSearchPath + "?pagetoken=token-1")
+		if got := w.Header().Get("X-Cache"); got != want {
+			t.Errorf("Expected the second page to be a %s, got %q", want, got)
+		}
+		if !strings.Contains(w.Body.String(), `"place_id":"b"`) {
+			t.Errorf("Expected the second page, got %s", w.Body.String())
+		}
+	}
+	if got := transport.requests(); got != 3 {
+		t.Errorf("Expected 3 upstream requests, got %d", got)
+	}
+
+	// A token rejected upstream is not stored under the page.
+	req := httptest.NewRequest(http.MethodGet, textSearchPath+"?query=pasta", nil)
+	transport.pages[""] = `{"status":"OK","results":[{"place_id":"c"}],"next_page_token":"token-2"}`
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	get(textSearchPath + "?pagetoken=token-2")
+	if w := get(textSearchPath + "?pagetoken=token-2"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected the rejected page not to be stored, got %q", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestServer_StitchPages(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	transport := &pagesTransport{pages: map[string]string{
+		"token-1": `{"status":"OK","results":[{"place_id":"b"}],"next_page_token":"token-2"}`,
+		"token-2": `{"status":"OK","results":[{"place_id":"c"}]}`,
+	}}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+	clock := NewFrozenClock(time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC))
+	server.clock = clock
+
+	req := httptest.NewRequest(http.MethodGet, textSearchPath+"?query=pizza", nil)
+	cacheKey := server.cacheKey(req)
+	first := []byte(`{"html_attributions":[],"next_page_token":"token-1","results":[{"place_id":"a"}],"status":"OK"}`)
+	done := make(chan struct{})
+	go func() {
+		server.stitchPages(req, cacheKey, first, time.Now())
+		close(done)
+	}()
+	for stitched := false; !stitched; {
+		select {
+		case <-done:
+			stitched = true
+		case <-time.After(time.Millisecond):
+			clock.Advance(pageTokenDelay)
+		}
+	}
+
+	values, _ := server.store.Get(context.Background(), cacheKey)
+	body, err := decodeEntry(values[0])
+	if err != nil {
+		t.Fatalf("Expected the stitched entry, got %v", err)
+	}
+	var resp map[string]json.RawMessage
+	json.Unmarshal(plainBody(body), &resp)
+	if got := string(resp["results"]); got != `[{"place_id":"a"},{"place_id":"b"},{"place_id":"c"}]` {
+		t.Errorf("Expected the results of every page, got %s", got)
+	}
+	if _, ok := resp["next_page_token"]; ok {
+		t.Errorf("Expected no next_page_token, got %s", resp["next_page_token"])
+	}
+}
+
+func TestServer_Query_AggregatePages(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	transport := &pagesTransport{pages: map[string]string{
+		"":        `{"status":"OK","results":[{"place_id":"a"}],"next_page_token":"token-1"}`,
+		"token-1": `{"status":"OK","results":[{"place_id":"b"}],"next_page_token":"token-2"}`,
+		"token-2": `{"status":"OK","results":[{"place_id":"c"}]}`,
+	}}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+	clock := NewFrozenClock(time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC))
+	server.clock = clock
+	handler := server.routes()
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, textSearchPath+"?query=pizza&proxy_aggregate_pages=true", nil))
+			close(done)
+		}()
+		for served := false; !served; {
+			select {
+			case <-done:
+				served = true
+			case <-time.After(time.Millisecond):
+				clock.Advance(pageTokenDelay)
+			}
+		}
+		return w
+	}
+	for _, want := range []string{"MISS", "HIT"} {
+		w := get()
+		if got := w.Header().Get("X-Cache"); got != want {
+			t.Errorf("Expected a %s, got %q", want, got)
+		}
+		var resp map[string]json.RawMessage
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if got := string(resp["results"]); got != `[{"place_id":"a"},{"place_id":"b"},{"place_id":"c"}]` {
+			t.Errorf("Expected the results of every page, got %s", w.Body.String())
+		}
+		if _, ok := resp["next_page_token"]; ok {
+			t.Errorf("Expected no next_page_token, got %s", resp["next_page_token"])
+		}
+	}
+	if len(transport.urls) != 3 || strings.Contains(transport.urls[0], "proxy_aggregate_pages") {
+		t.Errorf("Expected 3 upstream requests without proxy_aggregate_pages, got %v", transport.urls)
+	}
+
+	// A page that cannot be fetched fails the request, which is not cached.
+	delete(transport.pages, "token-2")
+	server.store.Delete(context.Background(), server.cacheKey(httptest.NewRequest(http.MethodGet, textSearchPath+"?query=pizza&proxy_aggregate_pages=true", nil)))
+	if w := get(); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %d: %s", w.Code, w.Body.String())
+	}
+}
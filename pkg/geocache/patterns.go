@@ -0,0 +1,89 @@
+package geocache
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathPattern matches request paths: a regular expression when it starts
+// with "^", otherwise a glob in the syntax of path.Match, where "*" matches
+// within a path segment.
+type pathPattern struct {
+	raw string
+	re  *regexp.Regexp
+}
+
+func (p pathPattern) matches(urlPath string) bool {
+	if p.re != nil {
+		return p.re.MatchString(urlPath)
+	}
+	ok, _ := path.Match(p.raw, urlPath)
+	return ok
+}
+
+// parsePathPatterns parses the patterns of the setting name. Invalid ones
+// are logged and ignored.
+func parsePathPatterns(name string, patterns []string, logger *Logger) []pathPattern {
+	var parsed []pathPattern
+	for _, raw := range patterns {
+		p := pathPattern{raw: raw}
+		var err error
+		if strings.HasPrefix(raw, "^") {
+			p.re, err = regexp.Compile(raw)
+		} else {
+			_, err = path.Match(raw, "/")
+		}
+		if err != nil {
+			logger.Log(LogError, "Ignoring invalid %s pattern %q: %v", name, raw, err)
+			continue
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed
+}
+
+// matchPathPattern returns the first of patterns matching urlPath, counting
+// the match in path_pattern_matches_total under list, or nil.
+func matchPathPattern(patterns []pathPattern, list, urlPath string) *pathPattern {
+	for i, p := range patterns {
+		if p.matches(urlPath) {
+			pathPatternMatchesTotal.WithLabelValues(list, p.raw).Inc()
+			return &patterns[i]
+		}
+	}
+	return nil
+}
+
+// rejectPatternsMiddleware answers 403 to the requests whose path matches
+// REJECT_PATTERNS, before anything else is done for them.
+func (s *Server) rejectPatternsMiddleware(next http.Handler) http.Handler {
+	if len(s.rejectPatterns) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := matchPathPattern(s.rejectPatterns, "reject", r.URL.Path); p != nil {
+			s.logger.LogContext(r.Context(), LogDebug, "Request rejected by pattern %s", p.raw)
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "this endpoint is not served"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bypassReason returns why r is answered from upstream without touching the
+// cache, or "" when it is not: its rule, CACHE_BYPASS_PATTERNS, or
+// AUTOCOMPLETE_MODE, in that order.
+func (s *Server) bypassReason(r *http.Request) string {
+	if rl := ruleFromContext(r.Context()); rl != nil && rl.Action.Cache == ruleCacheBypass {
+		return "rule " + rl.Name + " bypasses the cache"
+	}
+	if p := matchPathPattern(s.bypassPatterns, "bypass", r.URL.Path); p != nil {
+		return "the path matches CACHE_BYPASS_PATTERNS " + p.raw
+	}
+	if mode := s.config.AutocompleteMode; (mode == AutocompleteBypass || mode == AutocompleteMicrocache) && isAutocompletePath(r.URL.Path) {
+		return autocompleteBypassReason
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPathPatterns(t *testing.T) {
+	patterns := parsePathPatterns("TEST", []string{"/maps/api/place/autocomplete/*", `^/maps/api/(streetview|staticmap)`, "[", "^("}, NewLogger(false))
+	if len(patterns) != 2 {
+		t.Fatalf("parsed %d patterns, want the 2 valid ones", len(patterns))
+	}
+	for path, want := range map[string]bool{
+		"/maps/api/place/autocomplete/json":      true,
+		"/maps/api/place/autocomplete/json/x":    false,
+		"/maps/api/place/queryautocomplete/json": false,
+		"/maps/api/streetview/metadata":          true,
+		"/maps/api/staticmap":                    true,
+		"/v1/maps/api/staticmap":                 false,
+	} {
+		if got := matchPathPattern(patterns, "test", path) != nil; got != want {
+			t.Errorf("%s: matched %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestPathPatternLists(t *testing.T) {
+	transport := &recordingTransport{body: `{"predictions":[],"status":"OK"}`}
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AutocompleteSamplePercent = 100
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, prometheusSink{})
+	server.bypassPatterns = parsePathPatterns("CACHE_BYPASS_PATTERNS", []string{"/maps/api/place/autocomplete/*"}, server.logger)
+	server.rejectPatterns = parsePathPatterns("REJECT_PATTERNS", []string{"^/maps/api/streetview"}, server.logger)
+	handler := server.routes()
+	before := testutil.ToFloat64(pathPatternMatchesTotal.WithLabelValues("bypass", "/maps/api/place/autocomplete/*"))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, autocompletePath+"?input=Ber", nil))
+		if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "BYPASS" {
+			t.Errorf("bypassed request %d: status %d, X-Cache %q, want 200 BYPASS", i, w.Code, w.Header().Get("X-Cache"))
+		}
+	}
+	if len(transport.urls) != 2 {
+		t.Errorf("%d upstream requests, want 2", len(transport.urls))
+	}
+	if got := testutil.ToFloat64(pathPatternMatchesTotal.WithLabelValues("bypass", "/maps/api/place/autocomplete/*")) - before; got != 2 {
+		t.Errorf("counted %v bypass matches, want 2", got)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/maps/api/streetview/metadata?location=1,2", nil))
+	if w.Code != http.StatusForbidden || len(transport.urls) != 2 {
+		t.Errorf("rejected request: status %d, upstream requests %v, want 403 and none", w.Code, transport.urls[2:])
+	}
+}
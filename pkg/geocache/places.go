@@ -0,0 +1,258 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// placeTrimProbability is the chance that indexing a fill also trims the
+// popularity sorted set down to PlaceIndexMaxPlaces members.
+const placeTrimProbability = 0.01
+
+type placeRef struct {
+	PlaceID string `json:"place_id"`
+}
+
+// placeRefs covers the places a Google Maps response can reference: geocoding
+// and search results, place details, find-place candidates and directions
+// waypoints.
+type placeRefs struct {
+	Results           []placeRef `json:"results"`
+	Result            *placeRef  `json:"result"`
+	Candidates        []placeRef `json:"candidates"`
+	GeocodedWaypoints []placeRef `json:"geocoded_waypoints"`
+}
+
+// extractPlaceIDs returns the distinct place IDs referenced by a response body.
+func extractPlaceIDs(body []byte) []string {
+	var refs placeRefs
+	if err := json.Unmarshal(body, &refs); err != nil {
+		return nil
+	}
+	all := append(append(append([]placeRef{}, refs.Results...), refs.Candidates...), refs.GeocodedWaypoints...)
+	if refs.Result != nil {
+		all = append(all, *refs.Result)
+	}
+
+	seen := make(map[string]bool)
+	ids := []string{}
+	for _, ref := range all {
+		if ref.PlaceID != "" && !seen[ref.PlaceID] {
+			seen[ref.PlaceID] = true
+			ids = append(ids, ref.PlaceID)
+		}
+	}
+	return ids
+}
+
+func (s *Server) placeKeysKey(placeID string) string {
+	return s.redisKey("place:" + placeID + ":keys")
+}
+
+func (s *Server) placeHitsKey() string {
+	return s.redisKey("places:hits")
+}
+
+// referencesPlaces reports whether the responses of the endpoint at path
+// carry place IDs that extractPlaceIDs finds.
+func referencesPlaces(path string) bool {
+	switch path {
+	case geocodePath, directionsPath,
+		"/maps/api/place/details/json",
+		"/maps/api/place/findplacefromtext/json",
+		"/maps/api/place/textsearch/json",
+		"/maps/api/place/nearbysearch/json":
+		return true
+	}
+	return false
+}
+
+// indexPlaces records a freshly cached response: cacheKey joins the key set
+// of every place referenced by body, and the fill counts as a query against
+// each of them.
+func (s *Server) indexPlaces(path, cacheKey string, body []byte) {
+	if s.redis == nil || !s.config.PlaceIndex || !referencesPlaces(path) {
+		return
+	}
+	ids := extractPlaceIDs(body)
+	if len(ids) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	pipe := s.redis.Pipeline()
+	for _, id := range ids {
+		pipe.ZIncrBy(ctx, s.placeHitsKey(), 1, id)
+		pipe.SAdd(ctx, s.placeKeysKey(id), cacheKey)
+		pipe.Expire(ctx, s.placeKeysKey(id), s.config.CacheTimeout)
+	}
+	if s.config.PlaceIndexMaxPlaces > 0 && rand.Float64() < placeTrimProbability {
+		pipe.ZRemRangeByRank(ctx, s.placeHitsKey(), 0, int64(-s.config.PlaceIndexMaxPlaces-1))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		s.logger.Log(LogWarning, "Failed to update place index: %v", err)
+	}
+}
+
+// placeTallyMaxKeys bounds the cache keys whose hits are counted between two
+// flushes; hits on further keys are not counted.
+const placeTallyMaxKeys = 10000
+
+// placeTallyFlushInterval is how often counted hits are added to the place
+// popularity ranking.
+const placeTallyFlushInterval = 10 * time.Second
+
+// placeTally counts the cache hits of an instance by cache key, until they
+// are added to the place popularity ranking in Redis. The response of a key
+// is only parsed then, once per flush, rather than on every hit.
+type placeTally struct {
+	s *Server
+
+	mu   sync.Mutex
+	hits map[string]*placeHits
+}
+
+type placeHits struct {
+	body  []byte
+	count int64
+}
+
+func newPlaceTally(s *Server) *placeTally {
+	return &placeTally{s: s, hits: make(map[string]*placeHits)}
+}
+
+// observe counts a cache hit on cacheKey, served with body.
+func (t *placeTally) observe(path, cacheKey string, body []byte) {
+	if !referencesPlaces(path) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok := t.hits[cacheKey]; ok {
+		h.count++
+	} else if len(t.hits) < placeTallyMaxKeys {
+		t.hits[cacheKey] = &placeHits{body: body, count: 1}
+	}
+}
+
+// flush adds the counted hits to the place popularity ranking. Hits that
+// cannot be written are kept for the next flush.
+func (t *placeTally) flush(ctx context.Context) error {
+	t.mu.Lock()
+	hits := t.hits
+	t.hits = make(map[string]*placeHits)
+	t.mu.Unlock()
+	if len(hits) == 0 {
+		return nil
+	}
+
+	counts := make(map[string]int64)
+	for _, h := range hits {
+		for _, id := range extractPlaceIDs(plainBody(h.body)) {
+			counts[id] += h.count
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	pipe := t.s.redis.Pipeline()
+	for id, n := range counts {
+		pipe.ZIncrBy(ctx, t.s.placeHitsKey(), float64(n), id)
+	}
+	if t.s.config.PlaceIndexMaxPlaces > 0 {
+		pipe.ZRemRangeByRank(ctx, t.s.placeHitsKey(), 0, int64(-t.s.config.PlaceIndexMaxPlaces-1))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.mu.Lock()
+		for key, h := range hits {
+			if current, ok := t.hits[key]; ok {
+				current.count += h.count
+			} else {
+				t.hits[key] = h
+			}
+		}
+		t.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// runPlaceTally flushes the counted hits every placeTallyFlushInterval.
+func (s *Server) runPlaceTally() {
+	for {
+		<-s.clock.After(placeTallyFlushInterval)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := s.placeTally.flush(ctx); err != nil {
+			s.logger.Log(LogWarning, "Failed to update place index: %v", err)
+		}
+		cancel()
+	}
+}
+
+type placeCount struct {
+	PlaceID string `json:"place_id"`
+	Count   int64  `json:"count"`
+}
+
+func (s *Server) handleTopPlaces(w http.ResponseWriter, r *http.Request) {
+	n := 10
+	if v := r.URL.Query().Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "n must be a positive integer"})
+			return
+		}
+		n = parsed
+	}
+
+	top, err := s.redis.ZRevRangeWithScores(r.Context(), s.placeHitsKey(), 0, int64(n-1)).Result()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	places := make([]placeCount, 0, len(top))
+	for _, z := range top {
+		places = append(places, placeCount{PlaceID: z.Member.(string), Count: int64(z.Score)})
+	}
+	writeJSON(w, http.StatusOK, places)
+}
+
+func (s *Server) handleGetPlace(w http.ResponseWriter, r *http.Request) {
+	placeID := r.PathValue("id")
+	keys, err := s.redis.SMembers(r.Context(), s.placeKeysKey(placeID)).Result()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"place_id": placeID, "keys": keys})
+}
+
+// handlePurgePlace deletes every cache entry indexed under a place ID.
+func (s *Server) handlePurgePlace(w http.ResponseWriter, r *http.Request) {
+	placeID := r.PathValue("id")
+	ctx := r.Context()
+	keys, err := s.redis.SMembers(ctx, s.placeKeysKey(placeID)).Result()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var purged int64
+	if len(keys) > 0 {
+		purged, err = s.store.Delete(ctx, keys...)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	s.redis.Del(ctx, s.placeKeysKey(placeID))
+
+	s.logger.Log(LogInfo, "Purged %d cache entries for place %s", purged, placeID)
+	s.auditLog.Record(adminActor(r), AuditCachePurge, map[string]string{"place_id": placeID, "purged": strconv.FormatInt(purged, 10)})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"place_id": placeID, "purged": purged})
+}
@@ -0,0 +1,142 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractPlaceIDs(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{
+			name:     "geocode results",
+			body:     `{"status":"OK","results":[{"place_id":"A"},{"place_id":"B"},{"place_id":"A"}]}`,
+			expected: []string{"A", "B"},
+		},
+		{
+			name:     "place details",
+			body:     `{"status":"OK","result":{"place_id":"C"}}`,
+			expected: []string{"C"},
+		},
+		{
+			name:     "find place candidates",
+			body:     `{"status":"OK","candidates":[{"place_id":"D"}]}`,
+			expected: []string{"D"},
+		},
+		{
+			name:     "directions waypoints",
+			body:     `{"status":"OK","geocoded_waypoints":[{"place_id":"E"},{"place_id":"F"}],"routes":[]}`,
+			expected: []string{"E", "F"},
+		},
+		{
+			name:     "no places",
+			body:     `{"status":"ZERO_RESULTS","results":[]}`,
+			expected: []string{},
+		},
+		{
+			name:     "invalid JSON",
+			body:     `not json`,
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := extractPlaceIDs([]byte(tt.body))
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("extractPlaceIDs() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPlaceIndex(t *testing.T) {
+	body := `{"status":"OK","results":[{"place_id":"PLACE1"}]}`
+	mockClient := &http.Client{
+		Transport: &MockTransport{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(body)),
+				Header:     make(http.Header),
+			},
+		},
+	}
+
+	server, mr, cleanup := setupTestServer(t, mockClient)
+	defer cleanup()
+	server.config.PlaceIndex = true
+	server.placeTally = newPlaceTally(server)
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	admin := server.adminHandler()
+
+	// Miss indexes the key, then a hit counts another query for the place
+	req := httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=somewhere", nil)
+	cacheKey := server.cacheKey(req)
+	server.query(httptest.NewRecorder(), req)
+	server.query(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=somewhere", nil))
+	// The hit is only counted once the tally is flushed.
+	if score, _ := mr.ZScore(server.placeHitsKey(), "PLACE1"); score != 1 {
+		t.Errorf("Expected the fill only to be counted before the flush, got %v", score)
+	}
+	if err := server.placeTally.flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	members, err := mr.SMembers(server.placeKeysKey("PLACE1"))
+	if err != nil || len(members) != 1 || members[0] != cacheKey {
+		t.Fatalf("Expected place key set to contain %s, got %v (%v)", cacheKey, members, err)
+	}
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/places/top?n=5", nil))
+	var top []placeCount
+	if err := json.Unmarshal(w.Body.Bytes(), &top); err != nil {
+		t.Fatalf("Failed to decode top places: %v", err)
+	}
+	if len(top) != 1 || top[0].PlaceID != "PLACE1" || top[0].Count != 2 {
+		t.Errorf("Unexpected top places %+v", top)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/places/PLACE1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if mr.Exists(cacheKey) {
+		t.Error("Expected cache entry to be purged")
+	}
+	if mr.Exists(server.placeKeysKey("PLACE1")) {
+		t.Error("Expected place key set to be removed")
+	}
+}
+
+func TestPlaceTally_SkipsEndpointsWithoutPlaces(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.PlaceIndex = true
+	tally := newPlaceTally(server)
+
+	body := []byte(`{"status":"OK","results":[{"place_id":"PLACE1"}]}`)
+	tally.observe(distanceMatrixPath, "test:matrix", body)
+	tally.observe(autocompletePath, "test:autocomplete", body)
+	if len(tally.hits) != 0 {
+		t.Errorf("Expected hits on endpoints without places not to be counted, got %d keys", len(tally.hits))
+	}
+	tally.observe(geocodePath, "test:geocode", body)
+	tally.observe(geocodePath, "test:geocode", body)
+	if err := tally.flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if score, _ := mr.ZScore(server.placeHitsKey(), "PLACE1"); score != 2 {
+		t.Errorf("Expected 2 hits for the place, got %v", score)
+	}
+}
@@ -0,0 +1,190 @@
+package geocache
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Polyline simplification modes accepted in Config.PolylineSimplifyMode.
+const (
+	// PolylineSimplifyResponse caches full responses and simplifies them when
+	// they are returned.
+	PolylineSimplifyResponse = "response"
+	// PolylineSimplifyCache simplifies responses before they are cached.
+	PolylineSimplifyCache = "cache"
+)
+
+type point struct {
+	Lat, Lng float64
+}
+
+// decodePolyline decodes a Google encoded polyline.
+func decodePolyline(encoded string) []point {
+	var points []point
+	var lat, lng int
+	for i := 0; i < len(encoded); {
+		for _, coord := range []*int{&lat, &lng} {
+			var result, shift int
+			for i < len(encoded) {
+				b := int(encoded[i]) - 63
+				i++
+				result |= (b & 0x1f) << shift
+				shift += 5
+				if b < 0x20 {
+					break
+				}
+			}
+			if result&1 != 0 {
+				*coord += ^(result >> 1)
+			} else {
+				*coord += result >> 1
+			}
+		}
+		points = append(points, point{Lat: float64(lat) / 1e5, Lng: float64(lng) / 1e5})
+	}
+	return points
+}
+
+// encodePolyline encodes points as a Google encoded polyline.
+func encodePolyline(points []point) string {
+	var b strings.Builder
+	var prevLat, prevLng int
+	for _, p := range points {
+		lat := int(math.Round(p.Lat * 1e5))
+		lng := int(math.Round(p.Lng * 1e5))
+		encodePolylineValue(&b, lat-prevLat)
+		encodePolylineValue(&b, lng-prevLng)
+		prevLat, prevLng = lat, lng
+	}
+	return b.String()
+}
+
+func encodePolylineValue(b *strings.Builder, v int) {
+	v <<= 1
+	if v < 0 {
+		v = ^v
+	}
+	for v >= 0x20 {
+		b.WriteByte(byte((0x20 | (v & 0x1f)) + 63))
+		v >>= 5
+	}
+	b.WriteByte(byte(v + 63))
+}
+
+// simplifyPolyline applies Douglas-Peucker with a tolerance in meters.
+func simplifyPolyline(points []point, toleranceMeters float64) []point {
+	if len(points) < 3 {
+		return points
+	}
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+
+	type span struct{ first, last int }
+	stack := []span{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		sp := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		maxDist, index := 0.0, -1
+		for i := sp.first + 1; i < sp.last; i++ {
+			if d := segmentDistanceMeters(points[i], points[sp.first], points[sp.last]); d > maxDist {
+				maxDist, index = d, i
+			}
+		}
+		if index >= 0 && maxDist > toleranceMeters {
+			keep[index] = true
+			stack = append(stack, span{sp.first, index}, span{index, sp.last})
+		}
+	}
+
+	simplified := make([]point, 0, len(points))
+	for i, p := range points {
+		if keep[i] {
+			simplified = append(simplified, p)
+		}
+	}
+	return simplified
+}
+
+// segmentDistanceMeters is the distance from p to the segment a-b, using an
+// equirectangular projection around a, which is accurate at route scale.
+func segmentDistanceMeters(p, a, b point) float64 {
+	cosLat := math.Cos(a.Lat * math.Pi / 180)
+	project := func(q point) (float64, float64) {
+		x := (q.Lng - a.Lng) * math.Pi / 180 * cosLat * earthRadiusMeters
+		y := (q.Lat - a.Lat) * math.Pi / 180 * earthRadiusMeters
+		return x, y
+	}
+	px, py := project(p)
+	bx, by := project(b)
+
+	lengthSq := bx*bx + by*by
+	if lengthSq == 0 {
+		return math.Hypot(px, py)
+	}
+	t := math.Max(0, math.Min(1, (px*bx+py*by)/lengthSq))
+	return math.Hypot(px-t*bx, py-t*by)
+}
+
+// simplifyDirections simplifies the overview_polyline of every route in a
+// directions response. It reports false, leaving body untouched, when the
+// body is not a directions response with polylines.
+func simplifyDirections(body []byte, toleranceMeters float64) ([]byte, bool) {
+	var resp map[string]json.RawMessage
+	if json.Unmarshal(body, &resp) != nil {
+		return body, false
+	}
+	var routes []map[string]json.RawMessage
+	if json.Unmarshal(resp["routes"], &routes) != nil || len(routes) == 0 {
+		return body, false
+	}
+
+	changed := false
+	for _, route := range routes {
+		var overview map[string]json.RawMessage
+		if json.Unmarshal(route["overview_polyline"], &overview) != nil {
+			continue
+		}
+		var encoded string
+		if json.Unmarshal(overview["points"], &encoded) != nil || encoded == "" {
+			continue
+		}
+		simplified := encodePolyline(simplifyPolyline(decodePolyline(encoded), toleranceMeters))
+		if len(simplified) >= len(encoded) {
+			continue
+		}
+		overview["points"], _ = json.Marshal(simplified)
+		route["overview_polyline"], _ = json.Marshal(overview)
+		changed = true
+	}
+	if !changed {
+		return body, false
+	}
+	resp["routes"], _ = json.Marshal(routes)
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return body, false
+	}
+	return out, true
+}
+
+// simplifyBody simplifies a directions body when simplification is
+// configured for mode. A gzip body is recompressed only if wantGzip is set;
+// otherwise the simplified body is returned uncompressed.
+func (s *Server) simplifyBody(r *http.Request, body []byte, mode string, wantGzip bool) []byte {
+	if s.config.PolylineToleranceMeters <= 0 || s.config.PolylineSimplifyMode != mode || r.URL.Path != directionsPath {
+		return body
+	}
+	simplified, ok := simplifyDirections(plainBody(body), s.config.PolylineToleranceMeters)
+	if !ok {
+		return body
+	}
+	if wantGzip && isGzip(body) {
+		if compressed, err := gzipCompress(simplified); err == nil {
+			return compressed
+		}
+	}
+	return simplified
+}
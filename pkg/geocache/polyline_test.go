@@ -0,0 +1,124 @@
+package geocache
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPolylineCodec(t *testing.T) {
+	// Example from the Google encoded polyline algorithm documentation.
+	const encoded = "_p~iF~ps|U_ulLnnqC_mqNvxq`@"
+	want := []point{{38.5, -120.2}, {40.7, -120.95}, {43.252, -126.453}}
+
+	got := decodePolyline(encoded)
+	if len(got) != len(want) {
+		t.Fatalf("decodePolyline() returned %d points, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if math.Abs(got[i].Lat-want[i].Lat) > 1e-9 || math.Abs(got[i].Lng-want[i].Lng) > 1e-9 {
+			t.Errorf("point %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if re := encodePolyline(got); re != encoded {
+		t.Errorf("encodePolyline() = %q, want %q", re, encoded)
+	}
+}
+
+func TestSimplifyPolyline(t *testing.T) {
+	// A straight line north with a small wiggle and one large detour.
+	points := []point{
+		{52.0000, 13.0}, {52.0010, 13.00001}, {52.0020, 13.0}, {52.0030, 13.0100}, {52.0040, 13.0}, {52.0050, 13.0},
+	}
+
+	tests := []struct {
+		name      string
+		tolerance float64
+		want      int
+	}{
+		{name: "zero tolerance keeps detours and wiggles", tolerance: 0, want: 6},
+		{name: "small tolerance drops wiggle", tolerance: 5, want: 5},
+		{name: "large tolerance keeps endpoints only", tolerance: 5000, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := simplifyPolyline(points, tt.tolerance)
+			if len(got) != tt.want {
+				t.Errorf("simplifyPolyline() kept %d points, want %d: %v", len(got), tt.want, got)
+			}
+			if got[0] != points[0] || got[len(got)-1] != points[len(points)-1] {
+				t.Errorf("Expected endpoints to be kept")
+			}
+		})
+	}
+}
+
+func directionsBody(points []point) string {
+	return `{"status":"OK","routes":[{"summary":"A1","overview_polyline":{"points":` + string(mustJSON(encodePolyline(points))) + `}}]}`
+}
+
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+func TestServer_Query_PolylineSimplification(t *testing.T) {
+	var points []point
+	for i := 0; i < 100; i++ {
+		points = append(points, point{Lat: 52 + float64(i)*0.001, Lng: 13 + float64(i%2)*0.000001})
+	}
+	full := directionsBody(points)
+
+	tests := []struct {
+		name           string
+		mode           string
+		wantSimplified bool
+		wantStoredFull bool
+	}{
+		{name: "simplify on response", mode: PolylineSimplifyResponse, wantSimplified: true, wantStoredFull: true},
+		{name: "simplify before caching", mode: PolylineSimplifyCache, wantSimplified: true, wantStoredFull: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, mr, cleanup := setupTestServer(t, nil)
+			defer cleanup()
+			server.config.PolylineToleranceMeters = 10
+			server.config.PolylineSimplifyMode = tt.mode
+			server.upstream = newHTTPUpstream(&http.Client{Transport: &recordingTransport{body: full}}, server.config, server.clock, server.logger, prometheusSink{})
+
+			for _, cache := range []string{"MISS", "HIT"} {
+				req := httptest.NewRequest(http.MethodGet, directionsPath+"?origin=A&destination=B", nil)
+				w := httptest.NewRecorder()
+				server.query(w, req)
+
+				var resp struct {
+					Routes []struct {
+						Summary          string `json:"summary"`
+						OverviewPolyline struct {
+							Points string `json:"points"`
+						} `json:"overview_polyline"`
+					} `json:"routes"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Routes) != 1 {
+					t.Fatalf("%s: invalid response %s: %v", cache, w.Body.String(), err)
+				}
+				if resp.Routes[0].Summary != "A1" {
+					t.Errorf("%s: expected other route fields to be kept", cache)
+				}
+				if got := len(decodePolyline(resp.Routes[0].OverviewPolyline.Points)); got != 2 {
+					t.Errorf("%s: expected a 2-point polyline, got %d", cache, got)
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodGet, directionsPath+"?origin=A&destination=B", nil)
+			stored, _ := mr.Get(server.cacheKey(req))
+			if (stored == full) != tt.wantStoredFull {
+				t.Errorf("Expected stored full response = %v", tt.wantStoredFull)
+			}
+		})
+	}
+}
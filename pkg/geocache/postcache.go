@@ -0,0 +1,102 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// postCacheMaxBody bounds the request bodies read to build cache keys.
+const postCacheMaxBody = 1 << 20
+
+// postBody is the JSON body of a cached POST request.
+type postBody struct {
+	// raw is the body as sent by the client, and forwarded upstream.
+	raw []byte
+	// canonical is the body with sorted keys and without the volatile
+	// fields, which identifies the cache entry.
+	canonical string
+}
+
+type postBodyKey struct{}
+
+// postBodyFromContext returns the body of the cached POST request of ctx, or
+// nil for other requests.
+func postBodyFromContext(ctx context.Context) *postBody {
+	body, _ := ctx.Value(postBodyKey{}).(*postBody)
+	return body
+}
+
+// canonicalJSONBody re-encodes the JSON document raw with sorted keys and
+// without insignificant whitespace, removing the fields of volatile. Those
+// are dotted paths from the root, such as "meta.requestId"; paths go
+// through arrays, so "items.trace" removes trace from every item.
+func canonicalJSONBody(raw []byte, volatile []string) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	// Numbers are kept as written, not rounded through float64.
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return "", err
+	}
+	if dec.More() {
+		return "", errors.New("trailing data after the JSON document")
+	}
+	for _, path := range volatile {
+		removeJSONField(doc, strings.Split(path, "."))
+	}
+	canonical, err := json.Marshal(doc)
+	return string(canonical), err
+}
+
+func removeJSONField(v interface{}, path []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+		} else {
+			removeJSONField(v[path[0]], path[1:])
+		}
+	case []interface{}:
+		for _, item := range v {
+			removeJSONField(item, path)
+		}
+	}
+}
+
+// postCacheMiddleware makes the POST requests to the paths of
+// POST_CACHE_PATHS cacheable: their JSON body is read and attached to the
+// context in canonical form, where cacheKey adds it to the key and the
+// upstream forwards it. Other requests pass through untouched.
+func (s *Server) postCacheMiddleware(next http.Handler) http.Handler {
+	if len(s.postCachePaths) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || matchPathPattern(s.postCachePaths, "post_cache", r.URL.Path) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		raw, err := io.ReadAll(io.LimitReader(r.Body, postCacheMaxBody+1))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "failed to read the request body"})
+			return
+		}
+		if len(raw) > postCacheMaxBody {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "request body larger than 1 MB"})
+			return
+		}
+		canonical, err := canonicalJSONBody(raw, s.config.PostCacheVolatileFields)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "request body is not valid JSON: " + err.Error()})
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), postBodyKey{}, &postBody{raw: raw, canonical: canonical}))
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+		next.ServeHTTP(w, r)
+	})
+}
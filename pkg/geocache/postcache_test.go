@@ -0,0 +1,105 @@
+package geocache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanonicalJSONBody(t *testing.T) {
+	volatile := []string{"requestId", "meta.sentAt", "stops.trace"}
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{`{"b": 1, "a": [1, 2]}`, `{"a":[1,2],"b":1}`, true},
+		{`{"a": 1, "requestId": "x"}`, `{"requestId": "y", "a": 1}`, true},
+		{`{"a": 1, "meta": {"sentAt": 1, "v": 2}}`, `{"a": 1, "meta": {"sentAt": 2, "v": 2}}`, true},
+		{`{"stops": [{"id": 1, "trace": "x"}]}`, `{"stops": [{"id": 1, "trace": "y"}]}`, true},
+		{`{"a": [1, 2]}`, `{"a": [2, 1]}`, false},
+		{`{"a": 1.0000000000000001}`, `{"a": 1}`, false},
+		{`{"a": {"requestId": 1}}`, `{"a": {"requestId": 2}}`, false},
+	}
+	for _, tt := range tests {
+		a, errA := canonicalJSONBody([]byte(tt.a), volatile)
+		b, errB := canonicalJSONBody([]byte(tt.b), volatile)
+		if errA != nil || errB != nil {
+			t.Fatalf("canonicalJSONBody errors: %v, %v", errA, errB)
+		}
+		if (a == b) != tt.same {
+			t.Errorf("%s and %s: canonical forms %s and %s, want same=%v", tt.a, tt.b, a, b, tt.same)
+		}
+	}
+	for _, invalid := range []string{`{"a":`, `{} {}`, ``} {
+		if _, err := canonicalJSONBody([]byte(invalid), nil); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+// postRecordingTransport records the method, content type and body of
+// upstream requests.
+type postRecordingTransport struct {
+	methods, contentTypes, bodies []string
+	status                        int
+}
+
+func (m *postRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		b, _ := io.ReadAll(req.Body)
+		body = string(b)
+	}
+	m.methods = append(m.methods, req.Method)
+	m.contentTypes = append(m.contentTypes, req.Header.Get("Content-Type"))
+	m.bodies = append(m.bodies, body)
+	return &http.Response{
+		StatusCode: m.status,
+		Body:       io.NopCloser(strings.NewReader(`{"eta": 42}`)),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+	}, nil
+}
+
+func TestPostCache(t *testing.T) {
+	transport := &postRecordingTransport{status: http.StatusOK}
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.PostCacheVolatileFields = []string{"requestId"}
+	server.postCachePaths = parsePathPatterns("POST_CACHE_PATHS", []string{"/internal/eta/*"}, server.logger)
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, prometheusSink{})
+	handler := server.routes()
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	first := post("/internal/eta/route", `{"from": "A", "to": "B", "requestId": "1"}`)
+	second := post("/internal/eta/route", `{"requestId": "2", "to": "B", "from": "A"}`)
+	other := post("/internal/eta/route", `{"from": "A", "to": "C"}`)
+	if first.Header().Get("X-Cache") != "MISS" || second.Header().Get("X-Cache") != "HIT" || other.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("X-Cache %q, %q, %q, want MISS, HIT, MISS", first.Header().Get("X-Cache"), second.Header().Get("X-Cache"), other.Header().Get("X-Cache"))
+	}
+	if second.Body.String() != `{"eta": 42}` {
+		t.Errorf("hit body %q, want the cached response", second.Body.String())
+	}
+	if len(transport.methods) != 2 || transport.methods[0] != http.MethodPost || transport.contentTypes[0] != "application/json" ||
+		transport.bodies[0] != `{"from": "A", "to": "B", "requestId": "1"}` {
+		t.Errorf("upstream requests %v %v %v, want 2 POSTs forwarding the client body", transport.methods, transport.contentTypes, transport.bodies)
+	}
+
+	if w := post("/internal/eta/route", `{"from": `); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid JSON: status %d, want 400", w.Code)
+	}
+
+	transport.status = http.StatusInternalServerError
+	post("/internal/eta/route", `{"from": "A", "to": "D"}`)
+	if w := post("/internal/eta/route", `{"from": "A", "to": "D"}`); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("5xx response was cached: X-Cache %q", w.Header().Get("X-Cache"))
+	}
+}
@@ -0,0 +1,118 @@
+package geocache
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// prewarmTimeout bounds each request keeping an upstream host warm.
+const prewarmTimeout = 10 * time.Second
+
+// upstreamSessionCacheSize is the number of upstream hosts whose TLS
+// sessions are kept for resumption.
+const upstreamSessionCacheSize = 64
+
+// traceTLSHandshakes returns ctx reporting the TLS handshakes of the
+// requests made with it in upstream_tls_handshakes_total, by whether they
+// resumed a session.
+func traceTLSHandshakes(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				upstreamTLSHandshakesTotal.WithLabelValues(strconv.FormatBool(state.DidResume)).Inc()
+			}
+		},
+	})
+}
+
+// prewarmTarget is an upstream origin, such as https://maps.googleapis.com/,
+// with the client reaching it.
+type prewarmTarget struct {
+	client *http.Client
+	origin string
+}
+
+// prewarmTargets returns the origins misses may be sent to: those of the
+// primary and canary base URLs and of the upstream routes and their
+// fallbacks.
+func (u *httpUpstream) prewarmTargets() []prewarmTarget {
+	var targets []prewarmTarget
+	seen := make(map[prewarmTarget]bool)
+	add := func(client *http.Client, baseURL string) {
+		parsed, err := url.Parse(baseURL)
+		if err != nil || parsed.Host == "" {
+			return
+		}
+		t := prewarmTarget{client: client, origin: parsed.Scheme + "://" + parsed.Host + "/"}
+		if !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	add(u.client, u.config.BaseURL)
+	if u.config.CanaryBaseURL != "" {
+		add(u.client, u.config.CanaryBaseURL)
+	}
+	for _, route := range u.routes {
+		client := u.client
+		if routeClient, ok := u.routeClients[route.Name]; ok {
+			client = routeClient
+		}
+		add(client, route.BaseURL)
+		if route.FallbackBaseURL != "" {
+			add(client, route.FallbackBaseURL)
+		}
+	}
+	return targets
+}
+
+// prewarm sends a HEAD request to the root of every upstream origin, which
+// resolves its host and leaves an open connection in the pool of its client,
+// and a TLS session to resume once that connection is closed. The root of
+// the Maps API is not an API call, so it costs no quota.
+func (u *httpUpstream) prewarm(ctx context.Context) {
+	for _, t := range u.prewarmTargets() {
+		outcome := "success"
+		if err := prewarmOrigin(ctx, t); err != nil {
+			outcome = "error"
+			u.logger.Log(LogWarning, "Failed to prewarm %s: %v", t.origin, err)
+		}
+		upstreamPrewarmTotal.WithLabelValues(outcome).Inc()
+	}
+}
+
+func prewarmOrigin(ctx context.Context, t prewarmTarget) error {
+	ctx, cancel := context.WithTimeout(traceTLSHandshakes(ctx), prewarmTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, t.origin, nil)
+	if err != nil {
+		return err
+	}
+	// Redirects of the root lead away from the API host.
+	client := *t.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drained so that the connection goes back to the pool.
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// runUpstreamPrewarm keeps the upstream hosts of u warm, on startup and then
+// every UPSTREAM_PREWARM_SECONDS, so that the first misses after an idle
+// period skip the DNS lookup and the TLS handshake.
+func (s *Server) runUpstreamPrewarm(u *httpUpstream) {
+	for {
+		s.health.wait("upstream_prewarm", healthUpstream)
+		u.prewarm(context.Background())
+		<-s.clock.After(s.config.UpstreamPrewarmInterval)
+	}
+}
@@ -0,0 +1,61 @@
+package geocache
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHTTPUpstream_Prewarm(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		http.Redirect(w, r, "https://developers.example.com/maps", http.StatusFound)
+	}))
+	defer upstream.Close()
+	client := upstream.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(upstreamSessionCacheSize)
+
+	config := Config{BaseURL: upstream.URL + "/maps/api", CanaryBaseURL: upstream.URL + "/canary"}
+	u := newHTTPUpstream(client, config, systemClock{}, NewLogger(false), prometheusSink{})
+	if got := len(u.prewarmTargets()); got != 1 {
+		t.Fatalf("Expected the primary and canary base URLs to share a target, got %d targets", got)
+	}
+
+	succeeded := testutil.ToFloat64(upstreamPrewarmTotal.WithLabelValues("success"))
+	resumed := testutil.ToFloat64(upstreamTLSHandshakesTotal.WithLabelValues("true"))
+	u.prewarm(context.Background())
+	// The second connection resumes the session of the first.
+	transport.CloseIdleConnections()
+	u.prewarm(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 2 || requests[0] != "HEAD /" {
+		t.Errorf("Expected 2 HEAD requests to the root, without following the redirect, got %v", requests)
+	}
+	if got := testutil.ToFloat64(upstreamPrewarmTotal.WithLabelValues("success")) - succeeded; got != 2 {
+		t.Errorf("Expected 2 successful prewarms, got %v", got)
+	}
+	if got := testutil.ToFloat64(upstreamTLSHandshakesTotal.WithLabelValues("true")) - resumed; got != 1 {
+		t.Errorf("Expected 1 resumed handshake, got %v", got)
+	}
+}
+
+func TestHTTPUpstream_PrewarmError(t *testing.T) {
+	u := newHTTPUpstream(http.DefaultClient, Config{BaseURL: "http://127.0.0.1:1/maps/api"}, systemClock{}, NewLogger(false), prometheusSink{})
+	failed := testutil.ToFloat64(upstreamPrewarmTotal.WithLabelValues("error"))
+	u.prewarm(context.Background())
+	if got := testutil.ToFloat64(upstreamPrewarmTotal.WithLabelValues("error")) - failed; got != 1 {
+		t.Errorf("Expected 1 failed prewarm, got %v", got)
+	}
+}
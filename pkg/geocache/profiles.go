@@ -0,0 +1,188 @@
+package geocache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// profile is a named environment served by the same process as the default
+// one, such as staging next to production, selected by Host header or path
+// prefix. Its settings override those of the process configuration.
+type profile struct {
+	Name string `json:"name"`
+	// Hosts are matched without port. A leading "*." matches any subdomain,
+	// so *.eu.example.com matches geocache.eu.example.com.
+	Hosts []string `json:"hosts"`
+	// PathPrefix is removed from the path before the request is served, so
+	// /staging/maps/api/geocode/json is served as /maps/api/geocode/json.
+	PathPrefix        string `json:"path_prefix"`
+	RedisPrefix       string `json:"redis_prefix"`
+	CacheTimeoutHours int    `json:"cache_timeout_hours"`
+	BaseURL           string `json:"base_url"`
+	UpstreamAPIKey    string `json:"upstream_api_key"`
+	// Env holds environment variables read in place of those of the process
+	// when building the configuration of the profile, such as BASE_URL or
+	// ALLOWED_ADMIN_CIDRS. The settings above take precedence over it.
+	Env map[string]string `json:"env"`
+}
+
+// processSettings are the environment variables, or prefixes of them, that
+// configure the process rather than a profile, and cannot be set in its env.
+var processSettings = []string{"SERVER_PORT", "PORT", "LISTEN_", "REDIS_HOST", "REDIS_PORT", "REDIS_DB", "TLS_", "LOG_", "CONFIG_DIR", "PROFILES_FILE"}
+
+func isProcessSetting(key string) bool {
+	for _, setting := range processSettings {
+		if key == setting || (strings.HasSuffix(setting, "_") && strings.HasPrefix(key, setting)) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadProfiles reads a JSON array of profiles. Requests are served by the
+// first profile matching them.
+func loadProfiles(path string) ([]profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles []profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i, p := range profiles {
+		switch {
+		case p.Name == "" || names[p.Name]:
+			return nil, fmt.Errorf("%s: profile %d needs a unique name", path, i)
+		case len(p.Hosts) == 0 && p.PathPrefix == "":
+			return nil, fmt.Errorf("%s: profile %s matches no hosts or path_prefix", path, p.Name)
+		case p.PathPrefix != "" && (!strings.HasPrefix(p.PathPrefix, "/") || strings.HasSuffix(p.PathPrefix, "/")):
+			return nil, fmt.Errorf("%s: profile %s has an invalid path_prefix %q, want /name", path, p.Name, p.PathPrefix)
+		case p.BaseURL != "" && !isAbsoluteURL(p.BaseURL):
+			return nil, fmt.Errorf("%s: profile %s has an invalid base_url %q", path, p.Name, p.BaseURL)
+		case p.CacheTimeoutHours < 0:
+			return nil, fmt.Errorf("%s: profile %s has a negative cache_timeout_hours", path, p.Name)
+		}
+		for key := range p.Env {
+			if isProcessSetting(key) {
+				return nil, fmt.Errorf("%s: profile %s cannot set %s, which applies to the whole process", path, p.Name, key)
+			}
+		}
+		names[p.Name] = true
+		for j, host := range p.Hosts {
+			profiles[i].Hosts[j] = strings.ToLower(host)
+		}
+	}
+	return profiles, nil
+}
+
+// apply returns config with the settings of p. When p has an env, the
+// configuration is loaded again with env layered over the environment of
+// the process.
+func (p profile) apply(config Config) Config {
+	if len(p.Env) > 0 {
+		config = loadConfig(func(key string) string {
+			if value, ok := p.Env[key]; ok {
+				return value
+			}
+			return getEnv(key)
+		})
+	}
+	config.ProfilesFile = ""
+	if p.RedisPrefix != "" {
+		config.RedisPrefix = p.RedisPrefix
+	}
+	if p.CacheTimeoutHours > 0 {
+		config.CacheTimeout = time.Duration(p.CacheTimeoutHours) * time.Hour
+	}
+	if p.BaseURL != "" {
+		config.BaseURL = p.BaseURL
+	}
+	if p.UpstreamAPIKey != "" {
+		config.UpstreamAPIKey = p.UpstreamAPIKey
+	}
+	return config
+}
+
+func (p profile) matches(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range p.Hosts {
+		if pattern == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+			return true
+		}
+	}
+	return p.PathPrefix != "" && strings.HasPrefix(r.URL.Path, p.PathPrefix+"/")
+}
+
+// profileMux serves each request with the handler of the profile it matches,
+// or the default handler.
+type profileMux struct {
+	profiles []profile
+	handlers []http.Handler
+	fallback http.Handler
+}
+
+// newProfileMux builds a server per profile of Config.ProfilesFile, sharing
+// the components given in opts, such as the Redis client and the logger.
+// Each profile runs its own background jobs on its own Redis prefix.
+func newProfileMux(server *Server, fallback http.Handler, opts []Option) http.Handler {
+	profiles, err := loadProfiles(server.config.ProfilesFile)
+	if err != nil {
+		server.logger.Log(LogError, "Profiles disabled: %v", err)
+		return fallback
+	}
+	m := &profileMux{profiles: profiles, fallback: fallback}
+	for _, p := range profiles {
+		profileOpts := append(slices.Clip(opts), WithLogger(server.logger), WithConfig(p.apply(server.config)))
+		if server.redis != nil {
+			profileOpts = append(profileOpts, WithRedis(server.redis))
+		}
+		s := NewServerWithOptions(profileOpts...)
+		h := s.handler()
+		if p.PathPrefix != "" {
+			h = stripPathPrefix(p.PathPrefix, h)
+		}
+		m.handlers = append(m.handlers, h)
+		server.logger.Log(LogInfo, "Serving profile %s (hosts %v, path prefix %q, Redis prefix %q)", p.Name, p.Hosts, p.PathPrefix, s.config.RedisPrefix)
+	}
+	return m
+}
+
+// stripPathPrefix removes prefix from the paths of requests that have it;
+// requests matching a profile by host may not.
+func stripPathPrefix(prefix string, h http.Handler) http.Handler {
+	stripped := http.StripPrefix(prefix, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, prefix+"/") {
+			stripped.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (m *profileMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for i, p := range m.profiles {
+		if p.matches(r) {
+			r = r.WithContext(ContextWithLogAttrs(r.Context(), slog.String("profile", p.Name)))
+			m.handlers[i].ServeHTTP(w, r)
+			return
+		}
+	}
+	m.fallback.ServeHTTP(w, r)
+}
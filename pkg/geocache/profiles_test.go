@@ -0,0 +1,166 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestNew_Profiles(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	os.WriteFile(path, []byte(`[
+		{"name": "staging", "path_prefix": "/staging", "redis_prefix": "staging", "cache_timeout_hours": 1, "upstream_api_key": "STAGINGKEY"},
+		{"name": "eu", "hosts": ["EU.example.com"], "redis_prefix": "eu", "base_url": "https://eu.example.com"}
+	]`), 0o600)
+	config := Config{
+		BaseURL:      "https://maps.googleapis.com",
+		CacheTimeout: 720 * time.Hour,
+		RedisPrefix:  "prod",
+		ProfilesFile: path,
+	}
+	transport := &recordingTransport{body: `{"results":[],"status":"OK"}`}
+	handler := New(WithConfig(config), WithLogger(NewLogger(false)), WithRedis(rdb), WithHTTPClient(&http.Client{Transport: transport}))
+
+	tests := []struct {
+		name       string
+		host       string
+		target     string
+		wantURL    string
+		wantPrefix string
+		wantMaxTTL time.Duration
+	}{
+		{
+			name:       "default",
+			host:       "maps.example.com",
+			target:     geocodePath + "?address=Main&key=CLIENT",
+			wantURL:    "https://maps.googleapis.com" + geocodePath + "?address=Main&key=CLIENT",
+			wantPrefix: "prod:",
+			wantMaxTTL: 720 * time.Hour,
+		},
+		{
+			name:       "path prefix",
+			host:       "maps.example.com",
+			target:     "/staging" + geocodePath + "?address=Main&key=CLIENT",
+			wantURL:    "https://maps.googleapis.com" + geocodePath + "?address=Main&key=STAGINGKEY",
+			wantPrefix: "staging:",
+			wantMaxTTL: time.Hour,
+		},
+		{
+			name:       "host",
+			host:       "eu.example.com:8080",
+			target:     geocodePath + "?address=Main&key=CLIENT",
+			wantURL:    "https://eu.example.com" + geocodePath + "?address=Main&key=CLIENT",
+			wantPrefix: "eu:",
+			wantMaxTTL: 720 * time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr.FlushAll()
+			transport.urls = nil
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Host = tt.host
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK || len(transport.urls) != 1 || transport.urls[0] != tt.wantURL {
+				t.Fatalf("Expected one upstream request to %s, got %d %v", tt.wantURL, w.Code, transport.urls)
+			}
+			keys := mr.Keys()
+			if len(keys) != 1 || !strings.HasPrefix(keys[0], tt.wantPrefix) {
+				t.Fatalf("Expected one cache entry with prefix %s, got %v", tt.wantPrefix, keys)
+			}
+			if ttl := mr.TTL(keys[0]); ttl <= 0 || ttl > tt.wantMaxTTL {
+				t.Errorf("Expected a TTL up to %v, got %v", tt.wantMaxTTL, ttl)
+			}
+		})
+	}
+}
+
+func TestNew_ProfileEnv(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	os.WriteFile(path, []byte(`[
+		{"name": "us", "hosts": ["*.us.example.com"], "env": {"BASE_URL": "https://us.example.com", "REDIS_PREFIX": "us", "INSTANCE_HEARTBEAT_SECONDS": "0"}, "cache_timeout_hours": 1}
+	]`), 0o600)
+	config := Config{
+		BaseURL:      "https://maps.googleapis.com",
+		CacheTimeout: 720 * time.Hour,
+		RedisPrefix:  "prod",
+		ProfilesFile: path,
+	}
+	transport := &recordingTransport{body: `{"results":[],"status":"OK"}`}
+	handler := New(WithConfig(config), WithLogger(NewLogger(false)), WithRedis(rdb), WithHTTPClient(&http.Client{Transport: transport}))
+
+	tests := []struct {
+		host       string
+		wantURL    string
+		wantPrefix string
+	}{
+		{"geocache.us.example.com", "https://us.example.com" + geocodePath + "?address=Main&key=CLIENT", "us:"},
+		{"us.example.com", "https://maps.googleapis.com" + geocodePath + "?address=Main&key=CLIENT", "prod:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			mr.FlushAll()
+			transport.urls = nil
+			req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&key=CLIENT", nil)
+			req.Host = tt.host
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK || len(transport.urls) != 1 || transport.urls[0] != tt.wantURL {
+				t.Fatalf("Expected one upstream request to %s, got %d %v", tt.wantURL, w.Code, transport.urls)
+			}
+			keys := mr.Keys()
+			if len(keys) != 1 || !strings.HasPrefix(keys[0], tt.wantPrefix) {
+				t.Fatalf("Expected one cache entry with prefix %s, got %v", tt.wantPrefix, keys)
+			}
+		})
+	}
+}
+
+func TestLoadProfiles_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"no name":          `[{"hosts": ["staging.example.com"]}]`,
+		"duplicate":        `[{"name": "staging", "hosts": ["a.example.com"]}, {"name": "staging", "hosts": ["b.example.com"]}]`,
+		"no matcher":       `[{"name": "staging", "redis_prefix": "staging"}]`,
+		"relative prefix":  `[{"name": "staging", "path_prefix": "staging"}]`,
+		"trailing slash":   `[{"name": "staging", "path_prefix": "/staging/"}]`,
+		"relative URL":     `[{"name": "staging", "path_prefix": "/staging", "base_url": "eu.example.com"}]`,
+		"negative timeout": `[{"name": "staging", "path_prefix": "/staging", "cache_timeout_hours": -1}]`,
+		"process setting":  `[{"name": "staging", "path_prefix": "/staging", "env": {"REDIS_HOST": "staging-redis"}}]`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "profiles.json")
+			os.WriteFile(path, []byte(content), 0o600)
+			if _, err := loadProfiles(path); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
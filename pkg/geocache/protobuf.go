@@ -0,0 +1,138 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const protobufContentType = "application/x-protobuf"
+
+// wantsProtobuf reports whether r negotiates the binary distance matrix
+// format through its Accept header.
+func (s *Server) wantsProtobuf(r *http.Request) bool {
+	if !s.config.ProtobufOutput || r.URL.Path != distanceMatrixPath {
+		return false
+	}
+	return acceptsMediaType(r, protobufContentType)
+}
+
+// acceptsMediaType reports whether the Accept header of r lists mediaType.
+func acceptsMediaType(r *http.Request, mediaType string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// protobufKey is the key of the binary representation stored next to the
+// JSON entry at cacheKey.
+func protobufKey(cacheKey string) string {
+	return cacheKey + ":pb"
+}
+
+// distanceMatrixToProtobuf encodes a distance matrix response as the
+// DistanceMatrix message of distancematrix.proto. It returns false for
+// bodies that are not successful distance matrix responses.
+func distanceMatrixToProtobuf(body []byte) ([]byte, bool) {
+	var resp struct {
+		Status               string   `json:"status"`
+		OriginAddresses      []string `json:"origin_addresses"`
+		DestinationAddresses []string `json:"destination_addresses"`
+		Rows                 []struct {
+			Elements []struct {
+				Status            string        `json:"status"`
+				Distance          distanceValue `json:"distance"`
+				Duration          distanceValue `json:"duration"`
+				DurationInTraffic distanceValue `json:"duration_in_traffic"`
+			} `json:"elements"`
+		} `json:"rows"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Status != "OK" {
+		return nil, false
+	}
+
+	var b []byte
+	b = appendProtoString(b, 1, resp.Status)
+	for _, a := range resp.OriginAddresses {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, a)
+	}
+	for _, a := range resp.DestinationAddresses {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, a)
+	}
+	for _, row := range resp.Rows {
+		var rb []byte
+		for _, el := range row.Elements {
+			var eb []byte
+			eb = appendProtoString(eb, 1, el.Status)
+			eb = appendProtoInt(eb, 2, el.Distance.Value)
+			eb = appendProtoInt(eb, 3, el.Duration.Value)
+			eb = appendProtoInt(eb, 4, el.DurationInTraffic.Value)
+			rb = protowire.AppendTag(rb, 1, protowire.BytesType)
+			rb = protowire.AppendBytes(rb, eb)
+		}
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, rb)
+	}
+	return b, true
+}
+
+// appendProtoString appends a proto3 string field, omitting the default.
+func appendProtoString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendProtoInt appends a proto3 int64 field, omitting the default.
+func appendProtoInt(b []byte, num protowire.Number, v int) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(int64(v)))
+}
+
+// storeProtobuf stores the binary representation of a distance matrix
+// entry, or removes a stale one when the new body cannot be converted.
+func (s *Server) storeProtobuf(ctx context.Context, r *http.Request, cacheKey string, plain []byte) {
+	start := time.Now()
+	var err error
+	if pb, ok := distanceMatrixToProtobuf(plain); ok {
+		err = s.store.Set(ctx, protobufKey(cacheKey), s.wrapEntry(pb), s.cacheTTL(r))
+	} else {
+		_, err = s.store.Delete(ctx, protobufKey(cacheKey))
+	}
+	s.metrics.ObserveCacheOp(r.URL.Path, time.Since(start), err)
+	if err != nil {
+		s.logger.LogContext(r.Context(), LogWarning, "Failed to cache protobuf response: %v", err)
+	}
+}
+
+// writeProtobuf writes the stored binary representation, or converts body
+// when there is none, as for entries cached before PROTOBUF_OUTPUT was
+// enabled. It returns false, writing nothing, when body cannot be converted.
+func writeProtobuf(w http.ResponseWriter, stored, body []byte) bool {
+	pb, ok := stored, stored != nil
+	if !ok {
+		pb, ok = distanceMatrixToProtobuf(plainBody(body))
+	}
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", protobufContentType)
+	w.Header().Add("Vary", "Accept")
+	w.Write(pb)
+	return true
+}
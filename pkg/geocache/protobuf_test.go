@@ -0,0 +1,128 @@
+package geocache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const distanceMatrixBody = `{"status":"OK","origin_addresses":["A"],"destination_addresses":["B","C"],"rows":[{"elements":[{"status":"OK","distance":{"value":1200},"duration":{"value":300}},{"status":"ZERO_RESULTS"}]}]}`
+
+// protoFields decodes the top-level fields of a message, keeping the raw
+// bytes of length-delimited fields and the value of varints.
+func protoFields(t *testing.T, b []byte) map[protowire.Number][]interface{} {
+	t.Helper()
+	fields := make(map[protowire.Number][]interface{})
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("Invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatalf("Invalid bytes: %v", protowire.ParseError(n))
+			}
+			fields[num] = append(fields[num], v)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				t.Fatalf("Invalid varint: %v", protowire.ParseError(n))
+			}
+			fields[num] = append(fields[num], v)
+			b = b[n:]
+		default:
+			t.Fatalf("Unexpected wire type %v", typ)
+		}
+	}
+	return fields
+}
+
+func TestDistanceMatrixToProtobuf(t *testing.T) {
+	pb, ok := distanceMatrixToProtobuf([]byte(distanceMatrixBody))
+	if !ok {
+		t.Fatal("Expected conversion to succeed")
+	}
+	msg := protoFields(t, pb)
+	if string(msg[1][0].([]byte)) != "OK" {
+		t.Errorf("Expected status OK, got %v", msg[1])
+	}
+	if len(msg[2]) != 1 || len(msg[3]) != 2 || string(msg[3][1].([]byte)) != "C" {
+		t.Errorf("Unexpected addresses: origins %v, destinations %v", msg[2], msg[3])
+	}
+	if len(msg[4]) != 1 {
+		t.Fatalf("Expected one row, got %d", len(msg[4]))
+	}
+	elements := protoFields(t, msg[4][0].([]byte))[1]
+	if len(elements) != 2 {
+		t.Fatalf("Expected two elements, got %d", len(elements))
+	}
+	first := protoFields(t, elements[0].([]byte))
+	if first[2][0].(uint64) != 1200 || first[3][0].(uint64) != 300 {
+		t.Errorf("Unexpected first element %v", first)
+	}
+	if second := protoFields(t, elements[1].([]byte)); string(second[1][0].([]byte)) != "ZERO_RESULTS" || second[2] != nil {
+		t.Errorf("Unexpected second element %v", second)
+	}
+
+	if _, ok := distanceMatrixToProtobuf([]byte(`{"status":"REQUEST_DENIED"}`)); ok {
+		t.Error("Expected error responses not to be converted")
+	}
+}
+
+func TestServer_Query_Protobuf(t *testing.T) {
+	transport := &recordingTransport{body: distanceMatrixBody}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.ProtobufOutput = true
+
+	want, _ := distanceMatrixToProtobuf([]byte(distanceMatrixBody))
+	path := distanceMatrixPath + "?origins=A&destinations=B|C"
+
+	tests := []struct {
+		name      string
+		accept    string
+		wantCache string
+		wantType  string
+	}{
+		{name: "miss", accept: "application/x-protobuf", wantCache: "MISS", wantType: protobufContentType},
+		{name: "hit", accept: "application/json;q=0.5, application/x-protobuf", wantCache: "HIT", wantType: protobufContentType},
+		{name: "json client", accept: "application/json", wantCache: "HIT", wantType: "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			server.query(w, req)
+
+			if got := w.Header().Get("X-Cache"); got != tt.wantCache {
+				t.Errorf("Expected X-Cache %s, got %s", tt.wantCache, got)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Expected Content-Type %s, got %s", tt.wantType, got)
+			}
+			if tt.wantType == protobufContentType && !bytes.Equal(w.Body.Bytes(), want) {
+				t.Errorf("Unexpected protobuf body %x", w.Body.Bytes())
+			}
+			if tt.wantType == "application/json" && w.Body.String() != distanceMatrixBody {
+				t.Errorf("Expected the JSON body, got %s", w.Body.String())
+			}
+		})
+	}
+
+	stored, err := mr.Get(protobufKey(server.cacheKey(httptest.NewRequest(http.MethodGet, path, nil))))
+	if err != nil || stored != string(want) {
+		t.Errorf("Expected the binary form to be cached at fill time, got %x (%v)", stored, err)
+	}
+	if len(transport.urls) != 1 {
+		t.Errorf("Expected one upstream request, got %d", len(transport.urls))
+	}
+}
@@ -0,0 +1,48 @@
+package geocache
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// jobMetrics collects the metrics of a command that exits once it is done,
+// such as simulate. Prometheus cannot scrape such commands, so their metrics
+// are pushed to a Pushgateway when they finish.
+type jobMetrics struct {
+	job      string
+	started  time.Time
+	registry *prometheus.Registry
+}
+
+func newJobMetrics(job string) *jobMetrics {
+	return &jobMetrics{job: job, started: time.Now(), registry: prometheus.NewRegistry()}
+}
+
+// gaugeVec registers a gauge vector for the job.
+func (m *jobMetrics) gaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	m.registry.MustRegister(g)
+	return g
+}
+
+// push replaces the metrics of the job on the Pushgateway at url, adding its
+// duration and the time it succeeded.
+func (m *jobMetrics) push(url string) error {
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "job_duration_seconds",
+		Help: "Duration of the last run of the job",
+	})
+	duration.Set(time.Since(m.started).Seconds())
+	lastSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "job_last_success_timestamp_seconds",
+		Help: "Time the job last succeeded, in seconds since the epoch",
+	})
+	lastSuccess.SetToCurrentTime()
+	return push.New(url, m.job).
+		Gatherer(m.registry).
+		Collector(duration).
+		Collector(lastSuccess).
+		Push()
+}
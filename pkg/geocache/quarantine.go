@@ -0,0 +1,186 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// quarantineSyncInterval is how often instances pick up the quarantines set
+// or lifted through another instance.
+const quarantineSyncInterval = 5 * time.Second
+
+// quarantine makes the cache entries matching Pattern be ignored, without
+// deleting them, while a suspected poisoning is investigated: their requests
+// are answered from upstream, and the responses are not stored so that the
+// entries are kept as they are.
+type quarantine struct {
+	ID string `json:"id"`
+	// Pattern is a regular expression matched against the canonical query
+	// of requests, as shown in X-Cache-Debug-Canonical, and their cache key.
+	Pattern   string    `json:"pattern"`
+	Reason    string    `json:"reason,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	re *regexp.Regexp
+}
+
+// quarantineList is the set of quarantines in effect on an instance.
+type quarantineList struct {
+	mu   sync.RWMutex
+	list []quarantine
+	// version counts the changes, so that a sync does not undo a change
+	// made while Redis was being read.
+	version int
+}
+
+func (l *quarantineList) all() []quarantine {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.list
+}
+
+func (l *quarantineList) currentVersion() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.version
+}
+
+// set replaces the quarantines, unless they changed since version was read;
+// a negative version replaces them in any case.
+func (l *quarantineList) set(list []quarantine, version int) {
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if version < 0 || version == l.version {
+		l.list = list
+		l.version++
+	}
+}
+
+func (s *Server) quarantineKey() string {
+	return s.redisKey("quarantines")
+}
+
+// quarantineFor returns the quarantine of the cache entry of r under
+// cacheKey, or nil.
+func (s *Server) quarantineFor(r *http.Request, cacheKey string) *quarantine {
+	list := s.quarantines.all()
+	if len(list) == 0 {
+		return nil
+	}
+	canonical := canonicalQuery(r.URL, s.normalizer, s.keyParams)
+	for i := range list {
+		if list[i].re.MatchString(canonical) || list[i].re.MatchString(cacheKey) {
+			quarantinedRequestsTotal.WithLabelValues(list[i].ID).Inc()
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+// syncQuarantines loads the quarantines shared through Redis.
+func (s *Server) syncQuarantines(ctx context.Context) error {
+	version := s.quarantines.currentVersion()
+	values, err := s.redis.HGetAll(ctx, s.quarantineKey()).Result()
+	if err != nil {
+		return err
+	}
+	list := make([]quarantine, 0, len(values))
+	for _, v := range values {
+		var q quarantine
+		if json.Unmarshal([]byte(v), &q) != nil {
+			continue
+		}
+		if q.re, err = regexp.Compile(q.Pattern); err == nil {
+			list = append(list, q)
+		}
+	}
+	s.quarantines.set(list, version)
+	return nil
+}
+
+// runQuarantineSync keeps the quarantines in line with the other instances.
+func (s *Server) runQuarantineSync() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), quarantineSyncInterval)
+		if err := s.syncQuarantines(ctx); err != nil {
+			s.logger.Log(LogWarning, "Failed to read cache quarantines: %v", err)
+		}
+		cancel()
+		<-s.clock.After(quarantineSyncInterval)
+	}
+}
+
+func (s *Server) handleListQuarantines(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, append([]quarantine{}, s.quarantines.all()...))
+}
+
+// handlePutQuarantine quarantines the entries matching the pattern of a JSON
+// body {"pattern", "reason"}, on every instance sharing the Redis instance.
+func (s *Server) handlePutQuarantine(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pattern string `json:"pattern"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Pattern == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `body must be {"pattern": "<regular expression>", "reason": ...}`})
+		return
+	}
+	re, err := regexp.Compile(req.Pattern)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid pattern: " + err.Error()})
+		return
+	}
+
+	q := quarantine{ID: newRequestID(), Pattern: req.Pattern, Reason: req.Reason, Actor: adminActor(r), CreatedAt: s.clock.Now().UTC(), re: re}
+	if s.redis != nil {
+		data, _ := json.Marshal(q)
+		if err := s.redis.HSet(r.Context(), s.quarantineKey(), q.ID, data).Err(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	s.quarantines.set(append(append([]quarantine{}, s.quarantines.all()...), q), -1)
+
+	s.logger.Log(LogWarning, "Cache entries matching %s quarantined by %s: %s", q.Pattern, q.Actor, q.Reason)
+	s.auditLog.Record(q.Actor, AuditQuarantineSet, map[string]string{"id": q.ID, "pattern": q.Pattern, "reason": q.Reason})
+	writeJSON(w, http.StatusCreated, q)
+}
+
+// handleDeleteQuarantine lifts a quarantine; the entries it covered are
+// served again.
+func (s *Server) handleDeleteQuarantine(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var kept []quarantine
+	found := false
+	for _, q := range s.quarantines.all() {
+		if q.ID == id {
+			found = true
+		} else {
+			kept = append(kept, q)
+		}
+	}
+	if s.redis != nil {
+		deleted, err := s.redis.HDel(r.Context(), s.quarantineKey(), id).Result()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		found = found || deleted > 0
+	}
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no quarantine " + id})
+		return
+	}
+	s.quarantines.set(kept, -1)
+
+	s.logger.Log(LogInfo, "Quarantine %s lifted by %s", id, adminActor(r))
+	s.auditLog.Record(adminActor(r), AuditQuarantineClear, map[string]string{"id": id})
+	writeJSON(w, http.StatusOK, map[string]string{"id": id})
+}
@@ -0,0 +1,80 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	transport := &recordingTransport{body: `{"status":"OK","results":[{"place_id":"fresh"}]}`}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	handler := server.routes()
+
+	poisoned := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main+St", nil)
+	poisonedKey := server.cacheKey(poisoned)
+	mr.Set(poisonedKey, `{"status":"OK","results":[{"place_id":"poisoned"}]}`)
+	other := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Side+St", nil)
+	mr.Set(server.cacheKey(other), `{"status":"OK","results":[{"place_id":"other"}]}`)
+
+	admin := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	get := func(uri string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, uri, nil))
+		return w
+	}
+
+	if w := admin(http.MethodPost, "/admin/quarantines", `{"pattern":"("}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid pattern to be rejected with 400, got %d", w.Code)
+	}
+	w := admin(http.MethodPost, "/admin/quarantines", `{"pattern":"^`+poisonedKey+`$","reason":"suspected poisoning"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201 quarantining, got %d: %s", w.Code, w.Body.String())
+	}
+	var q quarantine
+	json.Unmarshal(w.Body.Bytes(), &q)
+
+	w = get(geocodePath + "?address=Main+St")
+	if w.Header().Get("X-Cache") != "MISS" || !strings.Contains(w.Body.String(), "fresh") {
+		t.Errorf("Expected the quarantined entry to be answered from upstream, got %s %s", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if got, _ := mr.Get(poisonedKey); !strings.Contains(got, "poisoned") {
+		t.Errorf("Expected the quarantined entry to be kept, got %s", got)
+	}
+	if w := get(geocodePath + "?address=Side+St"); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected other entries to be served from the cache, got %s", w.Header().Get("X-Cache"))
+	}
+
+	// Other instances pick the quarantine up from Redis.
+	peer := &Server{redis: server.redis, config: server.config, keyParams: server.keyParams}
+	if err := peer.syncQuarantines(context.Background()); err != nil {
+		t.Fatalf("syncQuarantines failed: %v", err)
+	}
+	if peer.quarantineFor(poisoned, poisonedKey) == nil {
+		t.Error("Expected the quarantine to be synced")
+	}
+
+	if w := admin(http.MethodGet, "/admin/quarantines", ""); !strings.Contains(w.Body.String(), "suspected poisoning") {
+		t.Errorf("Expected the quarantine to be listed, got %s", w.Body.String())
+	}
+	if w := admin(http.MethodDelete, "/admin/quarantines/"+q.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 lifting the quarantine, got %d", w.Code)
+	}
+	if w := admin(http.MethodDelete, "/admin/quarantines/"+q.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 lifting it again, got %d", w.Code)
+	}
+	if w := get(geocodePath + "?address=Main+St"); w.Header().Get("X-Cache") != "HIT" || !strings.Contains(w.Body.String(), "poisoned") {
+		t.Errorf("Expected the entry to be served again once the quarantine is lifted, got %s %s", w.Header().Get("X-Cache"), w.Body.String())
+	}
+}
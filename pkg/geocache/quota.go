@@ -0,0 +1,147 @@
+package geocache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quotaExceeded reports whether resp tells that the upstream quota of its
+// API key is exhausted: a 429, or an OVER_QUERY_LIMIT status, which Google
+// returns with a 200.
+func quotaExceeded(resp *UpstreamResponse) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	return json.Unmarshal(plainBody(resp.Body), &body) == nil && body.Status == "OVER_QUERY_LIMIT"
+}
+
+// quotaRetryAfter returns how long to wait before retrying after resp: its
+// Retry-After in seconds when it has one, otherwise fallback.
+func quotaRetryAfter(resp *UpstreamResponse, fallback time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return fallback
+}
+
+// serveQuotaExceeded answers r, whose upstream quota is exhausted, from the
+// latest cache snapshot when it holds the entry. Otherwise it answers with a
+// 429 carrying the upstream error body, so that clients back off instead of
+// mistaking the 200 of an OVER_QUERY_LIMIT for a response. It is never
+// cached.
+func (s *Server) serveQuotaExceeded(w http.ResponseWriter, r *http.Request, resp *UpstreamResponse) {
+	source := "upstream"
+	if resp.Header.Get("X-Quota-Circuit") == "open" {
+		source = "circuit"
+	}
+	if s.serveStale(w, r, s.cacheKey(r)) {
+		quotaCircuitRequestsTotal.WithLabelValues("stale").Inc()
+		return
+	}
+	upstreamQuotaExceededTotal.WithLabelValues(metricsEndpoint(r.URL.Path), source).Inc()
+	s.logger.LogContext(r.Context(), LogWarning, "Upstream quota exceeded (%s)", source)
+
+	retryAfter := quotaRetryAfter(resp, s.config.QuotaRetryAfter)
+	w.Header().Set("Content-Type", resp.Header.Get("content-type"))
+	w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(retryAfter)))
+	setRateLimitHeaders(w, 0, 0, retryAfter)
+	w.Header().Set("X-Cache", "MISS")
+	w.WriteHeader(http.StatusTooManyRequests)
+	s.writeBody(w, r, resp.Body)
+	if csw, ok := w.(*cacheStatusResponseWriter); ok {
+		csw.cacheStatus = "MISS"
+	}
+}
+
+// quotaCircuit holds back the upstream requests of API keys whose quota is
+// exhausted, answering them as the upstream would until the retry delay has
+// passed, rather than spending requests that would fail. Circuits are kept
+// per upstream target, since routes may reach providers with quotas of
+// their own.
+type quotaCircuit struct {
+	clock Clock
+
+	mu   sync.Mutex
+	open map[string]time.Time
+}
+
+func newQuotaCircuit(clock Clock) *quotaCircuit {
+	return &quotaCircuit{clock: clock, open: make(map[string]time.Time)}
+}
+
+// quotaCircuitKey identifies the credentials of the upstream request URI
+// uri: its API key, or its client ID for signed requests. Keys are hashed so
+// they are not kept in memory in clear.
+func quotaCircuitKey(uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	credential := q.Get("key")
+	if client := q.Get("client"); client != "" {
+		credential = "client:" + client
+	}
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:8])
+}
+
+// circuitKey returns the key of the circuit of the credentials of uri on
+// target.
+func circuitKey(target, uri string) string {
+	return target + ":" + quotaCircuitKey(uri)
+}
+
+// trip opens the circuit of key for d. Circuits that have closed since are
+// dropped, so that keys tripped once and never seen again are not kept.
+func (c *quotaCircuit) trip(key string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	for k, until := range c.open {
+		if !until.After(now) {
+			delete(c.open, k)
+		}
+	}
+	c.open[key] = now.Add(d)
+}
+
+// remaining returns how long the circuit of key stays open, or 0 when it is
+// closed.
+func (c *quotaCircuit) remaining(key string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.open[key]
+	if !ok {
+		return 0
+	}
+	if d := until.Sub(c.clock.Now()); d > 0 {
+		return d
+	}
+	delete(c.open, key)
+	return 0
+}
+
+// circuitResponse is the response to the requests held back while the
+// circuit of their key is open for d.
+func circuitResponse(d time.Duration, target string) *UpstreamResponse {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json; charset=UTF-8")
+	header.Set("Retry-After", strconv.Itoa(retrySeconds(d)))
+	header.Set("X-Quota-Circuit", "open")
+	return &UpstreamResponse{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     header,
+		Body:       []byte(`{"status":"OVER_QUERY_LIMIT","error_message":"The upstream quota of this API key is exhausted."}`),
+		Target:     target,
+	}
+}
@@ -0,0 +1,170 @@
+package geocache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServer_Query_QuotaExceeded(t *testing.T) {
+	tests := []struct {
+		name          string
+		circuit       bool
+		wantUpstream  int
+		wantCircuited float64
+	}{
+		{name: "without circuit", wantUpstream: 3},
+		{name: "with circuit", circuit: true, wantUpstream: 2, wantCircuited: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, mr, cleanup := setupTestServer(t, nil)
+			defer cleanup()
+			server.config.QuotaRetryAfter = time.Minute
+			server.config.QuotaCircuit = tt.circuit
+			clock := NewFrozenClock(time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC))
+			server.clock = clock
+			transport := &recordingTransport{body: `{"status":"OVER_QUERY_LIMIT","error_message":"You have exceeded your rate-limit for this API.","results":[]}`}
+			server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, prometheusSink{})
+			before := testutil.ToFloat64(upstreamQuotaExceededTotal.WithLabelValues("geocode", "circuit"))
+
+			for _, key := range []string{"KEY1", "KEY1", "KEY2"} {
+				w := httptest.NewRecorder()
+				server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&key="+key, nil))
+				if w.Code != http.StatusTooManyRequests {
+					t.Errorf("%s: expected status 429, got %d", key, w.Code)
+				}
+				if got := w.Header().Get("Retry-After"); got != "60" {
+					t.Errorf("%s: expected Retry-After of a minute, got %q", key, got)
+				}
+			}
+			if len(transport.urls) != tt.wantUpstream {
+				t.Errorf("Expected %d upstream requests, got %d", tt.wantUpstream, len(transport.urls))
+			}
+			// The circuit closes once the retry delay has passed on the clock.
+			clock.Advance(time.Minute)
+			server.query(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&key=KEY1", nil))
+			if len(transport.urls) != tt.wantUpstream+1 {
+				t.Errorf("Expected the request to go upstream after a minute, got %d upstream requests", len(transport.urls))
+			}
+			if got := testutil.ToFloat64(upstreamQuotaExceededTotal.WithLabelValues("geocode", "circuit")) - before; got != tt.wantCircuited {
+				t.Errorf("Expected %v requests held back by the circuit, got %v", tt.wantCircuited, got)
+			}
+			if keys := mr.Keys(); len(keys) != 0 {
+				t.Errorf("Expected the error not to be cached, got %v", keys)
+			}
+		})
+	}
+}
+
+func TestServer_Query_QuotaCircuitWait(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.QuotaCircuit = true
+	server.config.QuotaRetryAfter = 20 * time.Second
+	server.config.QuotaCircuitMaxWait = time.Minute
+	// Only the upstream reads the clock, so that its timer is the only one.
+	clock := NewFrozenClock(time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC))
+	transport := &recordingTransport{body: `{"status":"OVER_QUERY_LIMIT","results":[]}`}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, clock, server.logger, prometheusSink{})
+	waited := testutil.ToFloat64(quotaCircuitRequestsTotal.WithLabelValues("waited"))
+
+	server.query(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&key=KEY1", nil))
+	transport.body = `{"status":"OK","results":[]}`
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Elm&key=KEY1", nil))
+	}()
+	if !waitFor(t, func() bool { return clock.Waiters() == 1 }) {
+		t.Fatal("Expected the miss to wait for the circuit to close")
+	}
+	clock.Advance(20 * time.Second)
+	<-done
+	if w.Code != http.StatusOK || len(transport.urls) != 2 {
+		t.Errorf("Expected the miss to go upstream once the circuit closed, got %d after %d upstream requests", w.Code, len(transport.urls))
+	}
+	if got := testutil.ToFloat64(quotaCircuitRequestsTotal.WithLabelValues("waited")) - waited; got != 1 {
+		t.Errorf("Expected 1 request to wait for the circuit, got %v", got)
+	}
+}
+
+func TestServer_Query_QuotaExceededStale(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[{"place_id":"v1"}],"status":"OK"}`}
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.QuotaCircuit = true
+	server.config.QuotaRetryAfter = time.Minute
+	clock := NewFrozenClock(time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC))
+	server.clock = clock
+	gcs := &fakeGCS{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(gcs)
+	defer ts.Close()
+	server.snapshots = newSnapshotStore(&gcsClient{
+		client:  ts.Client(),
+		baseURL: ts.URL,
+		bucket:  "bucket",
+		token:   func(context.Context) (string, error) { return "token", nil },
+	}, "")
+
+	ctx := context.Background()
+	cached := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil)
+	server.query(httptest.NewRecorder(), cached)
+	if _, err := server.writeSnapshot(ctx, clock.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+	server.store.Delete(ctx, server.cacheKey(cached))
+	transport.body = `{"status":"OVER_QUERY_LIMIT","results":[]}`
+
+	w := httptest.NewRecorder()
+	server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("Expected a stale response from the snapshot, got %d %q", w.Code, w.Header().Get("X-Cache"))
+	}
+	w = httptest.NewRecorder()
+	server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Elm", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for an entry missing from the snapshot, got %d", w.Code)
+	}
+}
+
+func TestQuotaRetryAfter(t *testing.T) {
+	header := make(http.Header)
+	resp := &UpstreamResponse{StatusCode: http.StatusTooManyRequests, Header: header}
+	if got := quotaRetryAfter(resp, time.Minute); got != time.Minute {
+		t.Errorf("Expected fallback of 1m, got %v", got)
+	}
+	header.Set("Retry-After", "30")
+	if got := quotaRetryAfter(resp, time.Minute); got != 30*time.Second {
+		t.Errorf("Expected upstream Retry-After of 30s, got %v", got)
+	}
+	if !quotaExceeded(resp) {
+		t.Error("Expected a 429 to be a quota error")
+	}
+	if quotaExceeded(&UpstreamResponse{StatusCode: http.StatusOK, Body: []byte(`{"status":"ZERO_RESULTS"}`)}) {
+		t.Error("Expected ZERO_RESULTS not to be a quota error")
+	}
+}
+
+func TestQuotaCircuit_PrunesClosedCircuits(t *testing.T) {
+	clock := NewFrozenClock(time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC))
+	c := newQuotaCircuit(clock)
+	for i := 0; i < 100; i++ {
+		c.trip(circuitKey("google", "/maps/api/geocode/json?key=KEY"+strconv.Itoa(i)), time.Minute)
+	}
+	clock.Advance(2 * time.Minute)
+	key := circuitKey("google", "/maps/api/geocode/json?key=OTHER")
+	c.trip(key, time.Minute)
+	if len(c.open) != 1 {
+		t.Errorf("Expected only the open circuit to be kept, got %d circuits", len(c.open))
+	}
+	if d := c.remaining(key); d != time.Minute {
+		t.Errorf("Expected the circuit to stay open for 1m, got %v", d)
+	}
+}
@@ -0,0 +1,258 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ban is a temporary block of a client that kept exceeding the rate limit.
+type ban struct {
+	Client  string    `json:"client"`
+	Label   string    `json:"label"`
+	Strikes int64     `json:"strikes"`
+	Until   time.Time `json:"until"`
+}
+
+// rateLimitClient identifies the client of r for rate limiting: the
+// identity established by the authentication chain, otherwise its address,
+// as forwarded by trustedProxies. An API key the chain did not recognize is
+// not an identity: a client could send a new one with every request to get
+// a fresh bucket and never be banned. label is a displayable form of id.
+func rateLimitClient(r *http.Request, trustedProxies []string) (id, label string) {
+	if identity := clientIdentityFromContext(r.Context()); identity != nil && identity.ID != "" {
+		return identity.ID, identity.ID
+	}
+	ip := clientIP(r, trustedProxies)
+	return "ip:" + ip, ip
+}
+
+func (s *Server) rateLimitKey(client string, window int64) string {
+	return s.redisKey("ratelimit:" + client + ":" + strconv.FormatInt(window, 10))
+}
+
+func (s *Server) violationsKey(client string) string {
+	return s.redisKey("ratelimit:violations:" + client)
+}
+
+func (s *Server) strikesKey(client string) string {
+	return s.redisKey("ban:strikes:" + client)
+}
+
+func (s *Server) banKey(client string) string {
+	return s.redisKey("ban:" + client)
+}
+
+func (s *Server) banIndexKey() string {
+	return s.redisKey("bans")
+}
+
+// banDuration doubles the base duration with every strike, up to max.
+func banDuration(base, max time.Duration, strikes int64) time.Duration {
+	if strikes < 1 {
+		strikes = 1
+	}
+	d := float64(base) * math.Pow(2, float64(strikes-1))
+	if d > float64(max) || math.IsInf(d, 1) {
+		return max
+	}
+	return time.Duration(d)
+}
+
+// rateLimitMiddleware answers 429 to banned clients and to clients above
+// RateLimitPerMinute, or AutocompleteRateLimitPerMinute for autocomplete
+// requests, before the cache or upstream is touched. Clients that exceed the
+// limit in BanThreshold windows within BanViolationWindow are banned for a
+// duration that doubles with each ban. Rate limiting fails open when Redis is
+// unavailable. Responses carry the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers of the client's limit, so that clients can pace
+// themselves.
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, scope := s.rateLimit(r)
+		if s.redis == nil || limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		client, label := rateLimitClient(r, s.config.TrustedProxyCIDRs)
+
+		if data, err := s.redis.Get(ctx, s.banKey(client)).Bytes(); err == nil {
+			var b ban
+			if json.Unmarshal(data, &b) == nil {
+				rateLimitedTotal.WithLabelValues("ban").Inc()
+				setRateLimitHeaders(w, limit, 0, b.Until.Sub(s.clock.Now()))
+				writeTooManyRequests(w, b.Until.Sub(s.clock.Now()), "client is temporarily banned")
+				return
+			}
+		}
+
+		now := s.clock.Now()
+		window := now.Unix() / 60
+		key := s.rateLimitKey(scope+client, window)
+		pipe := s.redis.Pipeline()
+		count := pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, 2*time.Minute)
+		if _, err := pipe.Exec(ctx); err != nil {
+			s.logger.LogContext(ctx, LogWarning, "Rate limiter unavailable: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		retryAfter := time.Unix((window+1)*60, 0).Sub(now)
+		setRateLimitHeaders(w, limit, int64(limit)-count.Val(), retryAfter)
+		if count.Val() <= int64(limit) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if scope != "" {
+			// Exceeding the autocomplete or rule limits does not count
+			// towards bans.
+			reason, _, _ := strings.Cut(scope, ":")
+			rateLimitedTotal.WithLabelValues(reason).Inc()
+			writeTooManyRequests(w, retryAfter, reason+" rate limit exceeded")
+			return
+		}
+		rateLimitedTotal.WithLabelValues("limit").Inc()
+		// Count one violation per window: the first request over the limit.
+		if count.Val() == int64(limit)+1 && s.config.BanThreshold > 0 {
+			s.recordViolation(ctx, client, label)
+		}
+		writeTooManyRequests(w, retryAfter, "rate limit exceeded")
+	})
+}
+
+// recordViolation counts a rate limit violation and bans the client when it
+// reaches BanThreshold.
+func (s *Server) recordViolation(ctx context.Context, client, label string) {
+	violations, err := s.redis.Incr(ctx, s.violationsKey(client)).Result()
+	if err != nil {
+		return
+	}
+	if violations == 1 {
+		s.redis.Expire(ctx, s.violationsKey(client), s.config.BanViolationWindow)
+	}
+	if violations < int64(s.config.BanThreshold) {
+		return
+	}
+
+	strikes, err := s.redis.Incr(ctx, s.strikesKey(client)).Result()
+	if err != nil {
+		return
+	}
+	s.redis.Expire(ctx, s.strikesKey(client), s.config.BanStrikeMemory)
+	duration := banDuration(s.config.BanBaseDuration, s.config.BanMaxDuration, strikes)
+	b := ban{Client: client, Label: label, Strikes: strikes, Until: s.clock.Now().Add(duration).UTC()}
+	data, _ := json.Marshal(b)
+
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, s.banKey(client), data, duration)
+	pipe.SAdd(ctx, s.banIndexKey(), client)
+	pipe.Del(ctx, s.violationsKey(client))
+	if _, err := pipe.Exec(ctx); err != nil {
+		s.logger.Log(LogWarning, "Failed to ban client %s: %v", label, err)
+		return
+	}
+	bansTotal.Inc()
+	s.logger.Log(LogWarning, "Banned client %s for %s after %d rate limit violations (strike %d)", label, duration, violations, strikes)
+	s.auditLog.Record("system", AuditClientBan, map[string]string{
+		"client":   client,
+		"label":    label,
+		"strikes":  strconv.FormatInt(strikes, 10),
+		"duration": duration.String(),
+	})
+}
+
+// retrySeconds rounds d up to whole seconds, at least one.
+func retrySeconds(d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers of the IETF draft: the
+// requests allowed in the current window, how many remain, and the seconds
+// until the window resets. A limit of 0 leaves RateLimit-Limit out, for
+// quotas whose size is not known.
+func setRateLimitHeaders(w http.ResponseWriter, limit int, remaining int64, reset time.Duration) {
+	if limit > 0 {
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+	}
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(max(remaining, 0), 10))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(retrySeconds(reset)))
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(retryAfter)))
+	writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": msg})
+}
+
+// listBans returns the active bans, dropping expired ones from the index.
+func (s *Server) listBans(ctx context.Context) ([]ban, error) {
+	clients, err := s.redis.SMembers(ctx, s.banIndexKey()).Result()
+	if err != nil || len(clients) == 0 {
+		return []ban{}, err
+	}
+	keys := make([]string, len(clients))
+	for i, c := range clients {
+		keys[i] = s.banKey(c)
+	}
+	values, err := s.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	bans := make([]ban, 0, len(values))
+	for i, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			s.redis.SRem(ctx, s.banIndexKey(), clients[i])
+			continue
+		}
+		var b ban
+		if json.Unmarshal([]byte(str), &b) == nil {
+			bans = append(bans, b)
+		}
+	}
+	return bans, nil
+}
+
+func (s *Server) handleListBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := s.listBans(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, bans)
+}
+
+// handleUnban lifts a ban and forgets the client's strikes and violations.
+func (s *Server) handleUnban(w http.ResponseWriter, r *http.Request) {
+	client := r.PathValue("client")
+	ctx := r.Context()
+	pipe := s.redis.TxPipeline()
+	deleted := pipe.Del(ctx, s.banKey(client))
+	pipe.Del(ctx, s.strikesKey(client), s.violationsKey(client))
+	pipe.SRem(ctx, s.banIndexKey(), client)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if deleted.Val() == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "client is not banned"})
+		return
+	}
+
+	s.logger.Log(LogInfo, "Unbanned client %s", client)
+	s.auditLog.Record(adminActor(r), AuditClientUnban, map[string]string{"client": client})
+	writeJSON(w, http.StatusOK, map[string]string{"client": client})
+}
@@ -0,0 +1,141 @@
+package geocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBanDuration(t *testing.T) {
+	tests := []struct {
+		strikes int64
+		want    time.Duration
+	}{
+		{strikes: 0, want: 5 * time.Minute},
+		{strikes: 1, want: 5 * time.Minute},
+		{strikes: 2, want: 10 * time.Minute},
+		{strikes: 4, want: 40 * time.Minute},
+		{strikes: 10, want: time.Hour},
+		{strikes: 5000, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := banDuration(5*time.Minute, time.Hour, tt.strikes); got != tt.want {
+			t.Errorf("banDuration(strikes=%d) = %v, want %v", tt.strikes, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitMiddleware_Ban(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.RateLimitPerMinute = 2
+	server.config.BanThreshold = 1
+	server.config.BanViolationWindow = 10 * time.Minute
+	server.config.BanBaseDuration = 5 * time.Minute
+	server.config.BanMaxDuration = time.Hour
+	server.config.BanStrikeMemory = 24 * time.Hour
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+
+	served := 0
+	handler := server.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+	// A new made-up API key on every request does not get a new bucket.
+	request := func(i int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=x&key=AIzaSyTESTKEY123"+strconv.Itoa(i), nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	wantStatus := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}
+	for i, want := range wantStatus {
+		w := request(i)
+		if w.Code != want {
+			t.Fatalf("request %d: expected status %d, got %d", i, want, w.Code)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d: expected Retry-After header", i)
+		}
+	}
+	if served != 2 {
+		t.Errorf("Expected 2 requests to reach the handler, got %d", served)
+	}
+
+	client, _ := rateLimitClient(httptest.NewRequest(http.MethodGet, "/", nil), nil)
+	if ttl := mr.TTL(server.banKey(client)); ttl != 5*time.Minute {
+		t.Errorf("Expected first ban to last 5m, got %v", ttl)
+	}
+
+	admin := server.adminHandler()
+	listReq := httptest.NewRequest(http.MethodGet, "/admin/bans", nil)
+	listReq.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, listReq)
+	var bans []ban
+	if err := json.Unmarshal(w.Body.Bytes(), &bans); err != nil || len(bans) != 1 {
+		t.Fatalf("Expected 1 ban, got %s (%v)", w.Body.String(), err)
+	}
+	if bans[0].Label != "192.0.2.1" || bans[0].Strikes != 1 {
+		t.Errorf("Unexpected ban %+v", bans[0])
+	}
+
+	unbanReq := httptest.NewRequest(http.MethodDelete, "/admin/bans/"+client, nil)
+	unbanReq.RemoteAddr = "192.0.2.1:1234"
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, unbanReq)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected unban to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if mr.Exists(server.banKey(client)) || mr.Exists(server.strikesKey(client)) {
+		t.Errorf("Expected ban and strikes to be removed")
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, unbanReq)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected unbanning twice to return 404, got %d", w.Code)
+	}
+}
+
+func TestRateLimitMiddleware_Headers(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.RateLimitPerMinute = 2
+	server.clock = NewFrozenClock(time.Date(2026, 5, 1, 12, 0, 45, 0, time.UTC))
+
+	handler := server.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, want := range []string{"1", "0", "0"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json?address=x", nil))
+		if got := w.Header().Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("request %d: expected RateLimit-Limit 2, got %q", i, got)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != want {
+			t.Errorf("request %d: expected RateLimit-Remaining %s, got %q", i, want, got)
+		}
+		if got := w.Header().Get("RateLimit-Reset"); got != "15" {
+			t.Errorf("request %d: expected RateLimit-Reset 15, got %q", i, got)
+		}
+	}
+}
+
+func TestRateLimitMiddleware_Disabled(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+
+	served := 0
+	handler := server.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+	for i := 0; i < 5; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/maps/api/geocode/json", nil))
+	}
+	if served != 5 {
+		t.Errorf("Expected all requests to pass with rate limiting disabled, got %d", served)
+	}
+}
@@ -0,0 +1,68 @@
+package geocache
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// headerTrackingWriter records whether the response has been started, in
+// which case a recovered panic can no longer be turned into a 500.
+type headerTrackingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *headerTrackingWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerTrackingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// recoveryMiddleware turns a handler panic into a 500 JSON response carrying
+// the request ID, and logs a CRITICAL record with the stack trace.
+func (s *Server) recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &headerTrackingWriter{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			panicsTotal.WithLabelValues(metricsEndpoint(r.URL.Path)).Inc()
+
+			requestID := w.Header().Get("X-Request-ID")
+			if requestID == "" {
+				requestID = r.Header.Get("X-Request-ID")
+			}
+			if requestID == "" {
+				requestID = newRequestID()
+			}
+
+			s.logger.LogAttrs(r.Context(), LogCritical, fmt.Sprintf("panic serving %s %s: %v", r.Method, r.URL.Path, rec),
+				slog.String("request_id", requestID),
+				slog.String("endpoint", r.URL.Path),
+				slog.String("panic", fmt.Sprint(rec)),
+				slog.String("stack", string(debug.Stack())),
+			)
+
+			if tw.wroteHeader {
+				return
+			}
+			w.Header().Set("X-Request-ID", requestID)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{
+				"error":      "internal server error",
+				"request_id": requestID,
+			})
+		}()
+		next.ServeHTTP(tw, r)
+	})
+}
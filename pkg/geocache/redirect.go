@@ -0,0 +1,74 @@
+package geocache
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Upstream redirect policies.
+const (
+	// RedirectFollow follows up to UPSTREAM_MAX_REDIRECTS redirects.
+	RedirectFollow = "follow"
+	// RedirectNone returns redirects to the client as they are.
+	RedirectNone = "none"
+	// RedirectRewrite returns redirects to the client with the Location of
+	// those staying on the upstream rewritten to go through the proxy.
+	RedirectRewrite = "rewrite"
+)
+
+// isRedirect reports whether status is a redirect carrying a Location.
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// withRedirectPolicy returns a copy of client applying UPSTREAM_REDIRECTS.
+// Once UPSTREAM_MAX_REDIRECTS redirects have been followed, the last one is
+// returned instead of failing the request.
+func withRedirectPolicy(client *http.Client, config Config) *http.Client {
+	c := *client
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if config.UpstreamRedirects != RedirectFollow {
+			return http.ErrUseLastResponse
+		}
+		if len(via) > config.UpstreamMaxRedirects {
+			upstreamRedirectsTotal.WithLabelValues("limit").Inc()
+			return http.ErrUseLastResponse
+		}
+		upstreamRedirectsTotal.WithLabelValues("followed").Inc()
+		return nil
+	}
+	return &c
+}
+
+// proxiedLocation rewrites location, the target of a redirect of the
+// upstream request to requested, to go through the proxy when it stays on
+// the same upstream: its scheme and host are removed. Other locations are
+// returned unchanged.
+func proxiedLocation(location string, requested *url.URL) string {
+	u, err := requested.Parse(location)
+	if err != nil || u.Scheme != requested.Scheme || u.Host != requested.Host {
+		return location
+	}
+	return u.RequestURI()
+}
+
+// serveRedirect answers r with resp, a redirect from upstream that was not
+// followed. Redirects are never cached.
+func (s *Server) serveRedirect(w http.ResponseWriter, r *http.Request, resp *UpstreamResponse, cacheStatus string) {
+	if s.wantsCacheDebug(r) {
+		writeCacheDecisionDebug(w, "not stored: the upstream answered with a redirect", time.Duration(0))
+	}
+	w.Header().Set("Content-Type", resp.Header.Get("content-type"))
+	w.Header().Set("Location", resp.Header.Get("Location"))
+	w.Header().Set("X-Cache", cacheStatus)
+	w.WriteHeader(resp.StatusCode)
+	s.writeBody(w, r, resp.Body)
+	if csw, ok := w.(*cacheStatusResponseWriter); ok {
+		csw.cacheStatus = cacheStatus
+	}
+}
@@ -0,0 +1,98 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// redirectingUpstream redirects /maps/api/geocode/json according to the
+// address parameter: to an error page, to a valid response, or in a loop.
+func redirectingUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc(geocodePath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("address") {
+		case "error":
+			http.Redirect(w, r, "/error", http.StatusFound)
+		case "moved":
+			http.Redirect(w, r, "/v2"+geocodePath+"?"+r.URL.RawQuery, http.StatusMovedPermanently)
+		case "elsewhere":
+			http.Redirect(w, r, "https://elsewhere.example.com/x", http.StatusFound)
+		default:
+			http.Redirect(w, r, r.URL.RequestURI(), http.StatusFound)
+		}
+	})
+	mux.HandleFunc("/v2"+geocodePath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[],"status":"OK"}`))
+	})
+	mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	})
+	upstream := httptest.NewServer(mux)
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestUpstreamRedirects(t *testing.T) {
+	upstream := redirectingUpstream(t)
+	tests := []struct {
+		name, policy, address string
+		wantStatus            int
+		wantLocation          string
+		wantCached            bool
+	}{
+		{name: "followed to a response", policy: RedirectFollow, address: "moved", wantStatus: http.StatusOK, wantCached: true},
+		{name: "followed to an error page", policy: RedirectFollow, address: "error"},
+		{name: "followed past the limit", policy: RedirectFollow, address: "loop", wantStatus: http.StatusFound, wantLocation: geocodePath + "?address=loop"},
+		{name: "not followed", policy: RedirectNone, address: "moved", wantStatus: http.StatusMovedPermanently, wantLocation: "/v2" + geocodePath + "?address=moved"},
+		{name: "rewritten", policy: RedirectRewrite, address: "error", wantStatus: http.StatusFound, wantLocation: "/error"},
+		{name: "rewritten elsewhere", policy: RedirectRewrite, address: "elsewhere", wantStatus: http.StatusFound, wantLocation: "https://elsewhere.example.com/x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, cleanup := setupTestServer(t, nil)
+			defer cleanup()
+			server.config.BaseURL = upstream.URL
+			server.config.UpstreamRedirects = tt.policy
+			server.config.UpstreamMaxRedirects = 2
+			server.upstream = newHTTPUpstream(upstream.Client(), server.config, server.clock, server.logger, prometheusSink{})
+			limited := testutil.ToFloat64(upstreamRedirectsTotal.WithLabelValues("limit"))
+
+			get := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address="+tt.address, nil))
+				return w
+			}
+			w := get()
+			if (tt.wantStatus != 0 && w.Code != tt.wantStatus) || w.Header().Get("Location") != tt.wantLocation {
+				t.Errorf("status %d, Location %q, want %d, %q", w.Code, w.Header().Get("Location"), tt.wantStatus, tt.wantLocation)
+			}
+			if hit := get().Header().Get("X-Cache") == "HIT"; hit != tt.wantCached {
+				t.Errorf("second request hit: %v, want %v", hit, tt.wantCached)
+			}
+			if got := testutil.ToFloat64(upstreamRedirectsTotal.WithLabelValues("limit")) - limited; (got > 0) != (tt.address == "loop") {
+				t.Errorf("counted %v redirect limits", got)
+			}
+		})
+	}
+}
+
+func TestProxiedLocation(t *testing.T) {
+	requested, _ := url.Parse("https://maps.googleapis.com/maps/api/geocode/json?address=a")
+	for location, want := range map[string]string{
+		"https://maps.googleapis.com/maps/api/geocode/json?address=b": "/maps/api/geocode/json?address=b",
+		"/maps/api/place/json":        "/maps/api/place/json",
+		"other?x=1":                   "/maps/api/geocode/other?x=1",
+		"http://maps.googleapis.com/": "http://maps.googleapis.com/",
+		"https://example.com/a":       "https://example.com/a",
+	} {
+		if got := proxiedLocation(location, requested); got != want {
+			t.Errorf("proxiedLocation(%q) = %q, want %q", location, got, want)
+		}
+	}
+}
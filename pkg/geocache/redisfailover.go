@@ -0,0 +1,252 @@
+package geocache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Bounds of the delay between two forced reconnects while Redis keeps
+// failing.
+const (
+	redisFailoverMinBackoff = time.Second
+	redisFailoverMaxBackoff = 30 * time.Second
+)
+
+// NewRedisClient returns a client for REDIS_HOST and REDIS_PORT with opts,
+// whose Addr and Dialer are replaced. Unless REDIS_FAILOVER_THRESHOLD is 0,
+// the client drops its connections once that many commands in a row fail on
+// a connection error, or a write is refused by a replica, and opens new ones
+// to the addresses REDIS_HOST then resolves to. This follows a Kubernetes
+// Service or a DNS name moved by a Sentinel failover, which would otherwise
+// keep the pool on the old server until a restart.
+func NewRedisClient(opts *redis.Options, config Config, logger *Logger) *redis.Client {
+	opts.Addr = net.JoinHostPort(config.RedisHost, config.RedisPort)
+	if config.RedisFailoverThreshold <= 0 {
+		return redis.NewClient(opts)
+	}
+	failover := newRedisFailover(config, systemClock{}, logger)
+	opts.Dialer = failover.dial
+	client := redis.NewClient(opts)
+	client.AddHook(failover)
+	return client
+}
+
+// redisFailover resolves the Redis hostname on every dial, keeps track of
+// the connections it opened, and closes them all when commands keep failing
+// on connection errors, so that the pool dials again.
+type redisFailover struct {
+	host      string
+	port      string
+	threshold int
+	clock     Clock
+	logger    *Logger
+	dialer    net.Dialer
+	lookup    func(ctx context.Context, host string) ([]string, error)
+
+	mu    sync.Mutex
+	addrs []string
+	conns map[*failoverConn]struct{}
+	// failures counts the consecutive connection errors. last is when a
+	// reconnect was last forced, and the next one is not forced before
+	// next, which backs off while they do not help.
+	failures     int
+	backoff      time.Duration
+	last, next   time.Time
+	reconnecting bool
+}
+
+func newRedisFailover(config Config, clock Clock, logger *Logger) *redisFailover {
+	return &redisFailover{
+		host:      config.RedisHost,
+		port:      config.RedisPort,
+		threshold: config.RedisFailoverThreshold,
+		clock:     clock,
+		logger:    logger,
+		dialer:    net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second},
+		lookup:    net.DefaultResolver.LookupHost,
+		conns:     make(map[*failoverConn]struct{}),
+		backoff:   redisFailoverMinBackoff,
+	}
+}
+
+// dial connects to the first reachable address of the host.
+func (f *redisFailover) dial(ctx context.Context, network, _ string) (net.Conn, error) {
+	addrs, err := f.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := f.dialer.DialContext(ctx, network, net.JoinHostPort(addr, f.port))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tracked := &failoverConn{Conn: conn, failover: f}
+		f.mu.Lock()
+		f.conns[tracked] = struct{}{}
+		f.mu.Unlock()
+		return tracked, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// resolve looks the host up, and logs when its addresses changed since the
+// previous lookup.
+func (f *redisFailover) resolve(ctx context.Context) ([]string, error) {
+	addrs, err := f.lookup(ctx, f.host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for Redis host %s", f.host)
+	}
+	f.mu.Lock()
+	previous := f.addrs
+	f.addrs = addrs
+	f.mu.Unlock()
+	if previous != nil && !sameAddrs(previous, addrs) {
+		f.logger.Log(LogWarning, "Redis host %s moved from %s to %s", f.host, strings.Join(previous, ","), strings.Join(addrs, ","))
+	}
+	return addrs, nil
+}
+
+// observe records the outcome of a command, and forces a reconnect after
+// threshold consecutive connection errors, or at once when a write was
+// refused by a replica, which the connection will keep getting. Forced
+// reconnects back off until Redis has answered for redisFailoverMaxBackoff.
+func (f *redisFailover) observe(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.clock.Now()
+	readOnly := isRedisReadOnlyError(err)
+	if !readOnly && !isRedisConnError(err) {
+		if err == nil || errors.Is(err, redis.Nil) {
+			f.failures = 0
+			if now.Sub(f.last) >= redisFailoverMaxBackoff {
+				f.backoff = redisFailoverMinBackoff
+			}
+		}
+		return
+	}
+	f.failures++
+	if (f.failures < f.threshold && !readOnly) || f.reconnecting || now.Before(f.next) {
+		return
+	}
+	f.failures = 0
+	f.reconnecting = true
+	f.last, f.next = now, now.Add(f.backoff)
+	f.backoff = min(2*f.backoff, redisFailoverMaxBackoff)
+	go f.reconnect(err)
+}
+
+// reconnect re-resolves the host and closes every connection, in use or
+// idle, so that the pool discards them and dials the new addresses.
+func (f *redisFailover) reconnect(cause error) {
+	f.mu.Lock()
+	previous := f.addrs
+	f.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), f.dialer.Timeout)
+	addrs, err := f.resolve(ctx)
+	cancel()
+	if err != nil {
+		f.logger.Log(LogWarning, "Failed to re-resolve Redis host %s: %v", f.host, err)
+	}
+
+	f.mu.Lock()
+	conns := make([]*failoverConn, 0, len(f.conns))
+	for conn := range f.conns {
+		conns = append(conns, conn)
+	}
+	f.reconnecting = false
+	f.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	changed := err == nil && previous != nil && !sameAddrs(previous, addrs)
+	redisForcedReconnectsTotal.WithLabelValues(strconv.FormatBool(changed)).Inc()
+	f.logger.Log(LogWarning, "Dropped %d Redis connections to reconnect: %v", len(conns), cause)
+}
+
+// DialHook, ProcessHook and ProcessPipelineHook implement redis.Hook.
+
+func (f *redisFailover) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (f *redisFailover) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		f.observe(err)
+		return err
+	}
+}
+
+func (f *redisFailover) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		f.observe(err)
+		return err
+	}
+}
+
+// isRedisConnError reports whether err means the connection, rather than
+// the command, failed: a network error or a connection closed by the
+// server.
+func isRedisConnError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isRedisReadOnlyError reports whether err is a write refused by a replica,
+// as happens on the connections to a master demoted by a failover.
+func isRedisReadOnlyError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "READONLY ")
+}
+
+func sameAddrs(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// failoverConn is a connection opened by redisFailover, forgotten once
+// closed.
+type failoverConn struct {
+	net.Conn
+	failover *redisFailover
+}
+
+func (c *failoverConn) Close() error {
+	c.failover.mu.Lock()
+	delete(c.failover.conns, c)
+	c.failover.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// SyscallConn exposes the socket, which the pool checks before reusing an
+// idle connection, so that the connections closed by reconnect are dropped
+// rather than handed out.
+func (c *failoverConn) SyscallConn() (syscall.RawConn, error) {
+	conn, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return conn.SyscallConn()
+}
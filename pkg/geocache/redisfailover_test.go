@@ -0,0 +1,173 @@
+package geocache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+var errReadOnly = errors.New("READONLY You can't write against a read only replica.")
+
+func (f *redisFailover) connCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.conns)
+}
+
+func TestRedisFailoverFollowsAddressChange(t *testing.T) {
+	old := miniredis.RunT(t)
+	old.Set("key", "old")
+	moved := miniredis.NewMiniRedis()
+	if err := moved.StartAddr("127.0.0.2:" + old.Port()); err != nil {
+		t.Skipf("Cannot listen on 127.0.0.2: %v", err)
+	}
+	defer moved.Close()
+	moved.Set("key", "new")
+
+	config := Config{RedisHost: "redis.test", RedisPort: old.Port(), RedisFailoverThreshold: 2}
+	failover := newRedisFailover(config, NewFrozenClock(time.Now()), NewLogger(false))
+	var mu sync.Mutex
+	addr := "127.0.0.1"
+	failover.lookup = func(context.Context, string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return []string{addr}, nil
+	}
+	client := redis.NewClient(&redis.Options{Addr: "redis.test:" + old.Port(), Dialer: failover.dial})
+	client.AddHook(failover)
+	defer client.Close()
+	ctx := context.Background()
+
+	if got, err := client.Get(ctx, "key").Result(); err != nil || got != "old" {
+		t.Fatalf("Get = %q, %v, want old", got, err)
+	}
+
+	// The old server is still up, so the pooled connection keeps being used
+	// until it refuses a write.
+	mu.Lock()
+	addr = "127.0.0.2"
+	mu.Unlock()
+	if got, _ := client.Get(ctx, "key").Result(); got != "old" {
+		t.Fatalf("Get = %q before the reconnect, want old", got)
+	}
+	before := testutil.ToFloat64(redisForcedReconnectsTotal.WithLabelValues("true"))
+	failover.observe(errReadOnly)
+	if !waitFor(t, func() bool { return failover.connCount() == 0 }) {
+		t.Fatal("Connections not dropped after a write refused by a replica")
+	}
+	if got, err := client.Get(ctx, "key").Result(); err != nil || got != "new" {
+		t.Fatalf("Get = %q, %v after the reconnect, want new", got, err)
+	}
+	if got := testutil.ToFloat64(redisForcedReconnectsTotal.WithLabelValues("true")) - before; got != 1 {
+		t.Errorf("redis_forced_reconnects_total{address_changed=\"true\"} increased by %v, want 1", got)
+	}
+}
+
+func TestRedisFailoverBackoff(t *testing.T) {
+	mr := miniredis.RunT(t)
+	clock := NewFrozenClock(time.Now())
+	config := Config{RedisHost: mr.Host(), RedisPort: mr.Port(), RedisFailoverThreshold: 2}
+	failover := newRedisFailover(config, clock, NewLogger(false))
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), Dialer: failover.dial})
+	client.AddHook(failover)
+	defer client.Close()
+	ctx := context.Background()
+
+	reconnects := func() float64 {
+		return testutil.ToFloat64(redisForcedReconnectsTotal.WithLabelValues("false"))
+	}
+	fail := func(n int) {
+		t.Helper()
+		if err := client.Ping(ctx).Err(); err != nil {
+			t.Fatalf("Ping: %v", err)
+		}
+		for range n {
+			failover.observe(io.EOF)
+		}
+	}
+	start := reconnects()
+
+	// A success between failures resets the count.
+	failover.observe(io.EOF)
+	failover.observe(redis.Nil)
+	failover.observe(io.EOF)
+	failover.observe(context.Canceled)
+	time.Sleep(50 * time.Millisecond)
+	if reconnects() != start {
+		t.Fatal("Reconnect forced below the threshold")
+	}
+
+	fail(2)
+	if !waitFor(t, func() bool { return reconnects()-start == 1 && failover.connCount() == 0 }) {
+		t.Fatal("Reconnect not forced at the threshold")
+	}
+
+	// Within the backoff, failures do not force another reconnect.
+	fail(4)
+	time.Sleep(50 * time.Millisecond)
+	if got := reconnects() - start; got != 1 || failover.connCount() != 1 {
+		t.Fatalf("%v reconnects and %d connections within the backoff, want 1 and 1", got, failover.connCount())
+	}
+
+	clock.Advance(redisFailoverMinBackoff)
+	fail(2)
+	if !waitFor(t, func() bool { return reconnects()-start == 2 }) {
+		t.Fatal("Reconnect not forced after the backoff")
+	}
+
+	// The backoff doubled.
+	clock.Advance(redisFailoverMinBackoff)
+	fail(2)
+	time.Sleep(50 * time.Millisecond)
+	if got := reconnects() - start; got != 2 {
+		t.Fatalf("%v reconnects before the doubled backoff elapsed, want 2", got)
+	}
+	clock.Advance(redisFailoverMinBackoff)
+	fail(2)
+	if !waitFor(t, func() bool { return reconnects()-start == 3 }) {
+		t.Fatal("Reconnect not forced after the doubled backoff")
+	}
+
+	// Answering for long enough resets the backoff.
+	clock.Advance(redisFailoverMaxBackoff)
+	fail(0)
+	clock.Advance(redisFailoverMinBackoff)
+	fail(2)
+	if !waitFor(t, func() bool { return reconnects()-start == 4 }) {
+		t.Fatal("Reconnect not forced after the backoff was reset")
+	}
+	clock.Advance(redisFailoverMinBackoff)
+	fail(2)
+	if !waitFor(t, func() bool { return reconnects()-start == 5 }) {
+		t.Fatal("Backoff not reset by a healthy Redis")
+	}
+}
+
+func TestIsRedisConnError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{redis.Nil, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("ERR wrong number of arguments"), false},
+		{errReadOnly, false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{io.EOF, true},
+	}
+	for _, tt := range tests {
+		if got := isRedisConnError(tt.err); got != tt.want {
+			t.Errorf("isRedisConnError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package geocache
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rekeyBatchSize bounds the entries read per SCAN page when rekeying.
+const rekeyBatchSize = 500
+
+// rekeyReport counts the entries of a rekey run by outcome.
+type rekeyReport struct {
+	scanned int
+	// moved entries were copied to their new key, and existing ones were
+	// not, as it already held an entry.
+	moved     int
+	existing  int
+	unchanged int
+	// noURI entries were stored without the request they answer, and
+	// corrupt ones fail their checksum; both are left in place.
+	noURI   int
+	corrupt int
+	deleted int64
+}
+
+func (r rekeyReport) String() string {
+	return fmt.Sprintf("%d entries scanned: %d rekeyed, %d already under their new key, %d unchanged, %d without a stored URI, %d corrupt, %d old keys deleted",
+		r.scanned, r.moved, r.existing, r.unchanged, r.noURI, r.corrupt, r.deleted)
+}
+
+// rekeyer recomputes the keys of the cache entries under the key settings of
+// its configuration.
+type rekeyer struct {
+	rdb        *redis.Client
+	store      CacheStore
+	config     Config
+	normalizer *addressNormalizer
+	keyParams  map[string][]string
+	// deleteOld deletes the entries once under their new key, and dryRun
+	// only counts them.
+	deleteOld bool
+	dryRun    bool
+	// rate bounds the entries read per second, unless 0.
+	rate int
+}
+
+// entryKey returns the key of the entry answering uri.
+func (k *rekeyer) entryKey(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	return hashCacheKey(canonicalQuery(u, k.normalizer, k.keyParams), k.config.RedisPrefix), nil
+}
+
+// run scans every entry, calling progress after each page.
+func (k *rekeyer) run(ctx context.Context, progress func(rekeyReport)) (rekeyReport, error) {
+	var report rekeyReport
+	prefix := k.config.RedisPrefix
+	if prefix != "" {
+		prefix += ":"
+	}
+	count := rekeyBatchSize
+	if k.rate > 0 {
+		count = min(count, k.rate)
+	}
+	start := time.Now()
+	var cursor uint64
+	for {
+		keys, next, err := k.rdb.Scan(ctx, cursor, prefix+"*", int64(count)).Result()
+		if err != nil {
+			return report, err
+		}
+		var entryKeys []string
+		for _, key := range keys {
+			if isCacheEntryName(strings.TrimPrefix(key, prefix)) {
+				entryKeys = append(entryKeys, key)
+			}
+		}
+		if err := k.rekeyPage(ctx, entryKeys, &report); err != nil {
+			return report, err
+		}
+		progress(report)
+		cursor = next
+		if cursor == 0 {
+			return report, nil
+		}
+		if k.rate > 0 {
+			due := start.Add(time.Duration(report.scanned) * time.Second / time.Duration(k.rate))
+			select {
+			case <-ctx.Done():
+				return report, ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		}
+	}
+}
+
+// rekeyPage copies the entries of keys whose key changed to their new key,
+// unless an entry is already there, with their remaining TTL.
+func (k *rekeyer) rekeyPage(ctx context.Context, keys []string, report *rekeyReport) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	entries, err := lookupEntries(ctx, k.store, keys, lookupOptions{})
+	if err != nil {
+		return err
+	}
+	var oldKeys, newKeys []string
+	var moving []entryLookup
+	for i, entry := range entries {
+		if entry.value == nil {
+			// Expired since it was scanned.
+			continue
+		}
+		report.scanned++
+		header, _, err := decodeEntryHeader(entry.value)
+		switch {
+		case err != nil:
+			report.corrupt++
+			continue
+		case header.URI == "":
+			report.noURI++
+			continue
+		}
+		newKey, err := k.entryKey(header.URI)
+		if err != nil {
+			report.noURI++
+			continue
+		}
+		if newKey == keys[i] {
+			report.unchanged++
+			continue
+		}
+		oldKeys = append(oldKeys, keys[i])
+		newKeys = append(newKeys, newKey)
+		moving = append(moving, entry)
+	}
+	if len(newKeys) == 0 {
+		return nil
+	}
+	existing, err := lookupEntries(ctx, k.store, newKeys, lookupOptions{})
+	if err != nil {
+		return err
+	}
+	for i, entry := range moving {
+		if existing[i].value != nil {
+			report.existing++
+			continue
+		}
+		report.moved++
+		if k.dryRun {
+			continue
+		}
+		if err := k.store.Set(ctx, newKeys[i], entry.value, entry.ttl); err != nil {
+			return err
+		}
+	}
+	if k.deleteOld && !k.dryRun {
+		deleted, err := k.store.Delete(ctx, oldKeys...)
+		if err != nil {
+			return err
+		}
+		report.deleted += deleted
+	}
+	return nil
+}
+
+// RunRekey implements the "rekey" command: it recomputes the key of every
+// cache entry from the request URI stored in its envelope, under the key
+// settings of the current configuration (NORMALIZE_ADDRESS, CACHE_KEY_PARAMS
+// and the like), and copies the entries whose key changed, writing its
+// progress to out. Run it with the configuration about to be deployed, so
+// that the cache stays warm across the change.
+func RunRekey(args []string, out io.Writer) error {
+	config := LoadConfig()
+	flags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	flags.SetOutput(out)
+	deleteOld := flags.Bool("delete-old", false, "delete the entries from their old key once copied")
+	dryRun := flags.Bool("dry-run", false, "only count the entries whose key changed")
+	rate := flags.Int("rate", 1000, "entries read per second, 0 for no limit")
+	interval := flags.Duration("progress", 10*time.Second, "interval between progress lines")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	logger := NewLogger(false)
+	rdb := NewRedisClient(&redis.Options{DB: config.RedisDB}, config, logger)
+	defer rdb.Close()
+	store := newRedisStore(rdb, config.RedisPrefix, config.ContentAddressedStorage)
+	store.hashEntries = config.CacheHashEntries
+	k := &rekeyer{
+		rdb:        rdb,
+		store:      store,
+		config:     config,
+		normalizer: newKeyNormalizer(config, logger),
+		keyParams:  parseKeyParams(config.CacheKeyParams),
+		deleteOld:  *deleteOld,
+		dryRun:     *dryRun,
+		rate:       *rate,
+	}
+
+	last := time.Now()
+	report, err := k.run(context.Background(), func(report rekeyReport) {
+		if time.Since(last) >= *interval {
+			fmt.Fprintf(out, "Progress: %s\n", report)
+			last = time.Now()
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(out, "Stopped: %s\n", report)
+		return err
+	}
+	if *dryRun {
+		fmt.Fprintf(out, "Dry run, nothing written: %s\n", report)
+		return nil
+	}
+	fmt.Fprintf(out, "Done: %s\n", report)
+	return nil
+}
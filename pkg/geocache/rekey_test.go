@@ -0,0 +1,109 @@
+package geocache
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRekey(t *testing.T) {
+	const (
+		movedURI     = "/maps/api/geocode/json?address=1600+Amphitheatre+Pkwy"
+		existingURI  = "/maps/api/geocode/json?address=10+Downing+St"
+		unchangedURI = "/maps/api/place/details/json?place_id=abc"
+	)
+	oldKey := func(uri string) string {
+		u, _ := url.Parse(uri)
+		return hashCacheKey(canonicalQuery(u, nil, nil), "prod")
+	}
+	tests := []struct {
+		name       string
+		deleteOld  bool
+		dryRun     bool
+		want       rekeyReport
+		wantOld    bool
+		wantNewKey bool
+	}{
+		{
+			name:       "copy",
+			want:       rekeyReport{scanned: 6, moved: 1, existing: 1, unchanged: 2, noURI: 1, corrupt: 1},
+			wantOld:    true,
+			wantNewKey: true,
+		},
+		{
+			name:       "delete old",
+			deleteOld:  true,
+			want:       rekeyReport{scanned: 6, moved: 1, existing: 1, unchanged: 2, noURI: 1, corrupt: 1, deleted: 2},
+			wantNewKey: true,
+		},
+		{
+			name:      "dry run",
+			deleteOld: true,
+			dryRun:    true,
+			want:      rekeyReport{scanned: 6, moved: 1, existing: 1, unchanged: 2, noURI: 1, corrupt: 1},
+			wantOld:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			defer rdb.Close()
+			config := Config{RedisPrefix: "prod", NormalizeAddress: true}
+			k := &rekeyer{
+				rdb:        rdb,
+				store:      newRedisStore(rdb, config.RedisPrefix, false),
+				config:     config,
+				normalizer: newKeyNormalizer(config, NewLogger(false)),
+				deleteOld:  tt.deleteOld,
+				dryRun:     tt.dryRun,
+			}
+			newKey, _ := k.entryKey(movedURI)
+			existingKey, _ := k.entryKey(existingURI)
+			if newKey == oldKey(movedURI) || existingKey == oldKey(existingURI) {
+				t.Fatal("Normalization does not change the keys of the test")
+			}
+
+			moved := encodeEntryHeader([]byte(`{"status":"OK"}`), entryHeader{URI: movedURI})
+			mr.Set(oldKey(movedURI), string(moved))
+			mr.SetTTL(oldKey(movedURI), time.Hour)
+			mr.Set(oldKey(existingURI), string(encodeEntryHeader([]byte(`{"status":"OK","old":true}`), entryHeader{URI: existingURI})))
+			mr.Set(existingKey, string(encodeEntryHeader([]byte(`{"status":"OK"}`), entryHeader{URI: existingURI})))
+			mr.Set(oldKey(unchangedURI), string(encodeEntryHeader([]byte(`{"status":"OK"}`), entryHeader{URI: unchangedURI})))
+			mr.Set(hashCacheKey("bare", "prod"), `{"status":"OK"}`)
+			corrupt := encodeEntryHeader([]byte(`{"status":"OK"}`), entryHeader{URI: movedURI})
+			mr.Set(hashCacheKey("corrupt", "prod"), string(corrupt[:len(corrupt)-2]))
+			mr.Set("prod:hits", "not an entry")
+
+			got, err := k.run(context.Background(), func(rekeyReport) {})
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("report = %+v, want %+v", got, tt.want)
+			}
+			if got := mr.Exists(oldKey(movedURI)); got != tt.wantOld {
+				t.Errorf("old key exists = %v, want %v", got, tt.wantOld)
+			}
+			if got := mr.Exists(newKey); got != tt.wantNewKey {
+				t.Fatalf("new key exists = %v, want %v", got, tt.wantNewKey)
+			}
+			if !tt.wantNewKey {
+				return
+			}
+			if value, _ := mr.Get(newKey); value != string(moved) {
+				t.Errorf("new key holds %q, want %q", value, moved)
+			}
+			if ttl := mr.TTL(newKey); ttl <= 0 || ttl > time.Hour {
+				t.Errorf("new key TTL = %v, want the remaining hour", ttl)
+			}
+			if value, _ := mr.Get(existingKey); value != string(encodeEntryHeader([]byte(`{"status":"OK"}`), entryHeader{URI: existingURI})) {
+				t.Errorf("existing entry replaced by %q", value)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package geocache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadableKeys are the settings applied without a restart when their
+// files in CONFIG_DIR change.
+var reloadableKeys = []string{"ADMIN_TOKENS", "ALLOWED_ADMIN_CIDRS", "ALLOWED_METRICS_CIDRS", "METRICS_BEARER_TOKEN", "METRICS_BASIC_AUTH"}
+
+// reloadDebounce groups the burst of events of one update, such as the
+// symlink swap Kubernetes performs on projected volumes.
+const reloadDebounce = 200 * time.Millisecond
+
+// watchDirs calls onChange once the files in dirs stop changing. Directories
+// are watched rather than files because mounted ConfigMaps and Secrets are
+// updated by replacing symlinks.
+func watchDirs(dirs []string, logger *Logger, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		var mu sync.Mutex
+		var timer *time.Timer
+		run := func() {
+			mu.Lock()
+			defer mu.Unlock()
+			onChange()
+		}
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if timer == nil {
+					timer = time.AfterFunc(reloadDebounce, run)
+				} else {
+					timer.Reset(reloadDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Log(LogWarning, "File watch error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// liveConfig returns the configuration including the latest reloaded
+// settings.
+func (s *Server) liveConfig() Config {
+	if c := s.live.Load(); c != nil {
+		return *c
+	}
+	return s.config
+}
+
+// watchConfig hot-applies the reloadable settings when CONFIG_DIR changes,
+// and audits each reload with the fingerprints of the changed values.
+func (s *Server) watchConfig() {
+	logger := s.logger.Component("config")
+	dir := s.config.ConfigDir
+	values := configValues(dir)
+	err := watchDirs([]string{dir}, logger, func() {
+		updated := configValues(dir)
+		live := s.liveConfig()
+		var keys []string
+		params := map[string]string{"dir": dir}
+		for _, key := range reloadableKeys {
+			if updated[key] == values[key] {
+				continue
+			}
+			logger.Log(LogInfo, "Reloaded %s from %s: %s -> %s", key, dir, redact(values[key]), redact(updated[key]))
+			keys = append(keys, key)
+			params[key] = redact(values[key]) + " -> " + redact(updated[key])
+			switch key {
+			case "ADMIN_TOKENS":
+				live.AdminTokens = parseMap(updated[key])
+			case "ALLOWED_ADMIN_CIDRS":
+				live.AllowedAdminCIDRs = parseList(updated[key])
+			case "ALLOWED_METRICS_CIDRS":
+				live.AllowedMetricsCIDRs = parseList(updated[key])
+			case "METRICS_BEARER_TOKEN":
+				live.MetricsBearerToken = updated[key]
+			case "METRICS_BASIC_AUTH":
+				live.MetricsBasicAuth = updated[key]
+			}
+		}
+		values = updated
+		if len(keys) > 0 {
+			s.live.Store(&live)
+			params["keys"] = strings.Join(keys, ",")
+			s.auditLog.Record("system", AuditConfigReload, params)
+		}
+	})
+	if err != nil {
+		logger.Log(LogError, "Config reloading disabled, cannot watch %s: %v", dir, err)
+	}
+}
+
+func configValues(dir string) map[string]string {
+	values := make(map[string]string, len(reloadableKeys))
+	for _, key := range reloadableKeys {
+		values[key] = lookupConfig(dir, key)
+	}
+	return values
+}
+
+// redact identifies a secret value in logs without revealing it.
+func redact(v string) string {
+	if v == "" {
+		return "(unset)"
+	}
+	sum := sha256.Sum256([]byte(v))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
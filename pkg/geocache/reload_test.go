@@ -0,0 +1,166 @@
+package geocache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestLookupConfig(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "ALLOWED_ADMIN_CIDRS"), []byte("10.0.0.0/8\n192.0.2.0/24\n"), 0o600)
+	t.Setenv("ALLOWED_ADMIN_CIDRS", "127.0.0.1/32")
+	t.Setenv("ALLOWED_METRICS_CIDRS", "127.0.0.1/32")
+
+	if got := parseList(lookupConfig(dir, "ALLOWED_ADMIN_CIDRS")); len(got) != 2 || got[1] != "192.0.2.0/24" {
+		t.Errorf("Expected the file to take precedence as a newline-separated list, got %v", got)
+	}
+	if got := lookupConfig(dir, "ALLOWED_METRICS_CIDRS"); got != "127.0.0.1/32" {
+		t.Errorf("Expected the environment as fallback, got %q", got)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir := t.TempDir()
+	tokensFile := filepath.Join(dir, "ADMIN_TOKENS")
+	os.WriteFile(tokensFile, []byte("ops:old-secret=*"), 0o600)
+
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.ConfigDir = dir
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	server.config.AdminTokens = map[string]string{"ops:old-secret": "*"}
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := newAuditLog(auditFile, NewLogger(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.auditLog = auditLog
+	server.watchConfig()
+	handler := server.adminHandler()
+
+	statusWith := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if got := statusWith("old-secret"); got != http.StatusOK {
+		t.Fatalf("Expected the initial token to work, got %d", got)
+	}
+
+	// Replace the file the way Kubernetes does: write a new file and rename.
+	tmp := filepath.Join(dir, ".tmp")
+	os.WriteFile(tmp, []byte("ops:new-secret=*"), 0o600)
+	if err := os.Rename(tmp, tokensFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitFor(t, func() bool { return statusWith("new-secret") == http.StatusOK }) {
+		t.Fatal("Expected the new token to be applied without a restart")
+	}
+	if got := statusWith("old-secret"); got != http.StatusUnauthorized {
+		t.Errorf("Expected the old token to be revoked, got %d", got)
+	}
+	if got := server.liveConfig().AllowedAdminCIDRs; len(got) != 1 {
+		t.Errorf("Expected settings without files to keep their values, got %v", got)
+	}
+
+	data, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("Expected the audit log to hold fingerprints only, got %s", data)
+	}
+	var event AuditEvent
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e AuditEvent
+		if json.Unmarshal([]byte(line), &e) == nil && e.Action == AuditConfigReload {
+			event = e
+		}
+	}
+	want := redact("ops:old-secret=*") + " -> " + redact("ops:new-secret=*")
+	if event.Actor != "system" || event.Action != AuditConfigReload || event.Params["keys"] != "ADMIN_TOKENS" || event.Params["ADMIN_TOKENS"] != want {
+		t.Errorf("Unexpected reload audit event %+v, want ADMIN_TOKENS %s", event, want)
+	}
+}
+
+func writeTestCert(t *testing.T, certFile, keyFile, cn string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	// Write the key first: the reloader keeps the old pair until both match.
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, "first")
+
+	reloader, err := NewCertReloader(certFile, keyFile, NewLogger(false))
+	if err != nil {
+		t.Fatalf("NewCertReloader() error = %v", err)
+	}
+	commonName := func() string {
+		cert, _ := reloader.GetCertificate(nil)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.Subject.CommonName
+	}
+	if got := commonName(); got != "first" {
+		t.Fatalf("Expected the initial certificate, got %s", got)
+	}
+
+	writeTestCert(t, certFile, keyFile, "second")
+	if !waitFor(t, func() bool { return commonName() == "second" }) {
+		t.Error("Expected the renewed certificate to be served")
+	}
+
+	if _, err := NewCertReloader(filepath.Join(dir, "missing.crt"), keyFile, NewLogger(false)); err == nil {
+		t.Error("Expected an error for a missing certificate")
+	}
+}
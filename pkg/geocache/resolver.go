@@ -0,0 +1,198 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// upstreamDialer connects to upstream hosts, resolving their names with the
+// static mapping of UPSTREAM_HOSTS when they are in it, and otherwise with
+// the resolver of UPSTREAM_RESOLVER or the system one. Resolution times are
+// recorded in upstream_dns_duration_seconds, so that a slow or failing
+// cluster DNS can be told apart from a slow upstream.
+type upstreamDialer struct {
+	hosts    map[string][]string
+	resolver *net.Resolver
+	dialer   net.Dialer
+}
+
+func newUpstreamDialer(config Config) *upstreamDialer {
+	d := &upstreamDialer{
+		hosts:    make(map[string][]string),
+		resolver: net.DefaultResolver,
+		dialer:   net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+	for host, ips := range config.UpstreamHosts {
+		d.hosts[strings.ToLower(host)] = strings.Split(ips, "|")
+	}
+	switch server := config.UpstreamResolver; {
+	case strings.HasPrefix(server, "https://"):
+		d.resolver = &net.Resolver{PreferGo: true, Dial: dialDoH(server)}
+	case server != "":
+		d.resolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.dialer.DialContext(ctx, network, server)
+		}}
+	}
+	return d
+}
+
+// newUpstreamClient returns the HTTP client used for upstream requests when
+// none is given with WithHTTPClient. Requests go through the proxy of
+// UPSTREAM_PROXY, or those of the standard proxy environment variables. TLS
+// sessions are kept, so that new connections resume them. With
+// UPSTREAM_HTTP3, requests go over HTTP/3 unless a proxy is set.
+func newUpstreamClient(config Config, logger *Logger) *http.Client {
+	dialer := newUpstreamDialer(config)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(upstreamSessionCacheSize)}
+	if config.UpstreamProxy != "" {
+		proxy, err := parseProxyURL(config.UpstreamProxy)
+		if err != nil {
+			// Going direct could bypass a mandatory egress, so every upstream
+			// request fails instead.
+			logger.Log(LogError, "Upstream requests disabled, invalid UPSTREAM_PROXY: %v", err)
+			transport.Proxy = func(*http.Request) (*url.URL, error) { return nil, err }
+		} else {
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+	}
+	if config.UpstreamHTTP3 {
+		if config.UpstreamProxy != "" && config.UpstreamProxy != "direct" {
+			// QUIC cannot go through the proxy.
+			logger.Log(LogWarning, "UPSTREAM_HTTP3 ignored with UPSTREAM_PROXY set")
+		} else {
+			return &http.Client{Transport: newHTTP3Transport(dialer, transport.TLSClientConfig, transport)}
+		}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// parseProxyURL parses a proxy address: a socks5://, http:// or https:// URL,
+// with the credentials in its user info, or "direct" for no proxy, returned
+// as nil.
+func parseProxyURL(raw string) (*url.URL, error) {
+	if raw == "direct" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q in %s", u.Scheme, u.Redacted())
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %s has no address", u.Redacted())
+	}
+	return u, nil
+}
+
+// lookup returns the addresses of host.
+func (d *upstreamDialer) lookup(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if ips, ok := d.hosts[strings.ToLower(host)]; ok {
+		return ips, nil
+	}
+	start := time.Now()
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	upstreamDNSDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+	return addrs, err
+}
+
+// DialContext connects to the first reachable address of the host of addr.
+func (d *upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range ips {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("dial %s: %w", host, errors.Join(errs...))
+}
+
+// dialDoH returns a resolver dial function sending queries to the DNS over
+// HTTPS (RFC 8484) server at url.
+func dialDoH(url string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return &dohConn{ctx: ctx, url: url, client: client}, nil
+	}
+}
+
+// dohConn carries the DNS messages of the resolver over HTTPS. As it is not a
+// net.PacketConn, the resolver writes each query with the two-byte length
+// prefix of DNS over TCP, and reads the answer the same way.
+type dohConn struct {
+	ctx      context.Context
+	url      string
+	client   *http.Client
+	response bytes.Reader
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return 0, errors.New("doh: incomplete DNS query")
+	}
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, bytes.NewReader(b[2:]))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("doh: %s returned %s", c.url, resp.Status)
+	}
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return 0, err
+	}
+	c.response.Reset(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error)         { return c.response.Read(b) }
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
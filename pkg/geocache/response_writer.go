@@ -0,0 +1,61 @@
+package geocache
+
+import (
+	"bytes"
+	"net/http"
+)
+
+type statusResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int
+	// body, when set, receives a copy of up to maxBody bytes of the
+	// response.
+	body    *bytes.Buffer
+	maxBody int
+}
+
+func newStatusResponseWriter(w http.ResponseWriter) *statusResponseWriter {
+	return &statusResponseWriter{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK, // Default to 200 if WriteHeader is never called
+	}
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	w.statusCode = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if w.body != nil {
+		w.body.Write(b[:min(n, max(w.maxBody-w.body.Len(), 0))])
+	}
+	w.bytes += n
+	return n, err
+}
+
+// bufferedResponseWriter captures a response in memory, for handlers that
+// are invoked internally.
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: make(http.Header), statusCode: http.StatusOK}
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	w.statusCode = code
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
@@ -0,0 +1,106 @@
+package geocache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// upstreamRoute sends the cache misses of some clients to their own
+// upstream, such as a data-residency endpoint or another Google project.
+type upstreamRoute struct {
+	Name string `json:"name"`
+	// APIKeys and Referrers select the requests taking the route: client API
+	// keys, and referrer hosts as reported by requestReferrer.
+	APIKeys   []string `json:"api_keys"`
+	Referrers []string `json:"referrers"`
+	BaseURL   string   `json:"base_url"`
+	// UpstreamAPIKey replaces the client's API key, to bill another project.
+	UpstreamAPIKey string `json:"upstream_api_key"`
+	// FallbackBaseURL is tried once when BaseURL fails or answers with a
+	// server error.
+	FallbackBaseURL string `json:"fallback_base_url"`
+	// Proxy replaces UPSTREAM_PROXY for the route, "direct" for none.
+	Proxy string `json:"proxy"`
+}
+
+// loadUpstreamRoutes reads a JSON array of routes. The first route matching
+// a request is taken.
+func loadUpstreamRoutes(path string) ([]upstreamRoute, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes []upstreamRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i, route := range routes {
+		switch {
+		case route.Name == "" || route.Name == upstreamPrimary || route.Name == upstreamCanary || names[route.Name]:
+			return nil, fmt.Errorf("%s: route %d needs a unique name other than %s and %s", path, i, upstreamPrimary, upstreamCanary)
+		case len(route.APIKeys) == 0 && len(route.Referrers) == 0:
+			return nil, fmt.Errorf("%s: route %s matches no api_keys or referrers", path, route.Name)
+		case !isAbsoluteURL(route.BaseURL):
+			return nil, fmt.Errorf("%s: route %s has an invalid base_url %q", path, route.Name, route.BaseURL)
+		case route.FallbackBaseURL != "" && !isAbsoluteURL(route.FallbackBaseURL):
+			return nil, fmt.Errorf("%s: route %s has an invalid fallback_base_url %q", path, route.Name, route.FallbackBaseURL)
+		}
+		if _, err := parseProxyURL(route.Proxy); route.Proxy != "" && err != nil {
+			return nil, fmt.Errorf("%s: route %s has an invalid proxy: %w", path, route.Name, err)
+		}
+		names[route.Name] = true
+	}
+	return routes, nil
+}
+
+func isAbsoluteURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// matchRoute returns the route taken by r, or nil.
+func matchRoute(routes []upstreamRoute, r *http.Request) *upstreamRoute {
+	if len(routes) == 0 {
+		return nil
+	}
+	key, referrer := extractAPIKey(r), requestReferrer(r)
+	for i, route := range routes {
+		for _, k := range route.APIKeys {
+			if key != "" && k == key {
+				return &routes[i]
+			}
+		}
+		for _, ref := range route.Referrers {
+			if referrer != "" && ref == referrer {
+				return &routes[i]
+			}
+		}
+	}
+	return nil
+}
+
+// findRoute returns the route named name, or nil.
+func findRoute(routes []upstreamRoute, name string) *upstreamRoute {
+	for i := range routes {
+		if routes[i].Name == name {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// withAPIKey returns uri with its key parameter set to key.
+func withAPIKey(uri, key string) (string, error) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("key", key)
+	u.RawQuery = q.Encode()
+	return u.RequestURI(), nil
+}
@@ -0,0 +1,236 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Cache policies of rules.
+const (
+	// ruleCacheBypass answers from upstream without reading or writing the
+	// cache.
+	ruleCacheBypass = "bypass"
+	// ruleCacheNoStore serves cache hits but does not store misses.
+	ruleCacheNoStore = "no_store"
+)
+
+// rule applies an action to the proxied requests it matches. Rules gather
+// the per-request policies that would otherwise be special cases of the
+// endpoints: caching, TTL, rate limit, upstream route, rewriting and denial.
+type rule struct {
+	Name   string     `json:"name"`
+	Match  ruleMatch  `json:"match"`
+	Action ruleAction `json:"action"`
+}
+
+// ruleMatch selects requests. Every criterion set must match; values within
+// one criterion are alternatives.
+type ruleMatch struct {
+	// Paths are request paths. A trailing "*" matches any path starting
+	// with the rest, so /maps/api/place/* matches every Places endpoint.
+	Paths []string `json:"paths"`
+	// Params and Headers map names to the value they must have, or "*" for
+	// any value as long as they are present.
+	Params  map[string]string `json:"params"`
+	Headers map[string]string `json:"headers"`
+	// APIKeys are client API keys, as extracted by extractAPIKey.
+	APIKeys []string `json:"api_keys"`
+	// BusinessUnits are the business units the request is charged to.
+	BusinessUnits []string `json:"business_units"`
+}
+
+// ruleAction is what a rule does to the requests it matches. Unset fields
+// leave the default behavior.
+type ruleAction struct {
+	// Cache is ruleCacheBypass, ruleCacheNoStore or "" for the default.
+	Cache      string `json:"cache"`
+	TTLSeconds int    `json:"ttl_seconds"`
+	// RateLimitPerMinute limits each client separately from
+	// RATE_LIMIT_PER_MINUTE, without counting towards bans.
+	RateLimitPerMinute int `json:"rate_limit_per_minute"`
+	// Route is the name of the upstream route of UPSTREAM_ROUTES_FILE taking
+	// the cache misses.
+	Route string `json:"route"`
+	// SetParams and RemoveParams rewrite the query before it is looked up
+	// and sent upstream, such as forcing a language.
+	SetParams    map[string]string `json:"set_params"`
+	RemoveParams []string          `json:"remove_params"`
+	// Deny answers with this 4xx status instead of serving the request.
+	Deny int `json:"deny"`
+}
+
+func (m ruleMatch) empty() bool {
+	return len(m.Paths) == 0 && len(m.Params) == 0 && len(m.Headers) == 0 && len(m.APIKeys) == 0 && len(m.BusinessUnits) == 0
+}
+
+// loadRules reads a JSON array of rules. Requests take the action of the
+// first rule matching them. routes are the names of the upstream routes
+// actions may refer to.
+func loadRules(path string, routes []string) ([]rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i, rl := range rules {
+		a := rl.Action
+		switch {
+		case rl.Name == "" || names[rl.Name]:
+			return nil, fmt.Errorf("%s: rule %d needs a unique name", path, i)
+		case rl.Match.empty():
+			return nil, fmt.Errorf("%s: rule %s matches nothing, use paths [\"/*\"] to match every request", path, rl.Name)
+		case a.Cache != "" && a.Cache != ruleCacheBypass && a.Cache != ruleCacheNoStore:
+			return nil, fmt.Errorf("%s: rule %s has an invalid cache %q, want %s or %s", path, rl.Name, a.Cache, ruleCacheBypass, ruleCacheNoStore)
+		case a.TTLSeconds < 0 || a.RateLimitPerMinute < 0:
+			return nil, fmt.Errorf("%s: rule %s has a negative ttl_seconds or rate_limit_per_minute", path, rl.Name)
+		case a.Route != "" && !slices.Contains(routes, a.Route):
+			return nil, fmt.Errorf("%s: rule %s refers to an unknown route %q", path, rl.Name, a.Route)
+		case a.Deny != 0 && (a.Deny < 400 || a.Deny > 499):
+			return nil, fmt.Errorf("%s: rule %s has an invalid deny status %d, want 4xx", path, rl.Name, a.Deny)
+		case a.Deny != 0 && (a.Cache != "" || a.TTLSeconds != 0 || a.RateLimitPerMinute != 0 || a.Route != "" || len(a.SetParams) > 0 || len(a.RemoveParams) > 0):
+			return nil, fmt.Errorf("%s: rule %s denies requests and cannot take other actions", path, rl.Name)
+		}
+		for _, p := range rl.Match.Paths {
+			if !strings.HasPrefix(p, "/") {
+				return nil, fmt.Errorf("%s: rule %s has an invalid path %q", path, rl.Name, p)
+			}
+		}
+		names[rl.Name] = true
+	}
+	return rules, nil
+}
+
+// matches reports whether r is selected by m.
+func (m ruleMatch) matches(r *http.Request) bool {
+	if len(m.Paths) > 0 && !slices.ContainsFunc(m.Paths, func(p string) bool {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			return strings.HasPrefix(r.URL.Path, prefix)
+		}
+		return r.URL.Path == p
+	}) {
+		return false
+	}
+	q := r.URL.Query()
+	for name, want := range m.Params {
+		if !q.Has(name) || (want != "*" && q.Get(name) != want) {
+			return false
+		}
+	}
+	for name, want := range m.Headers {
+		if v := r.Header.Get(name); v == "" || (want != "*" && v != want) {
+			return false
+		}
+	}
+	if len(m.APIKeys) > 0 && !slices.Contains(m.APIKeys, extractAPIKey(r)) {
+		return false
+	}
+	if len(m.BusinessUnits) > 0 && !slices.Contains(m.BusinessUnits, businessUnitFromContext(r.Context())) {
+		return false
+	}
+	return true
+}
+
+// matchRule returns the first rule matching r, or nil.
+func matchRule(rules []rule, r *http.Request) *rule {
+	for i := range rules {
+		if rules[i].Match.matches(r) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+type ruleKey struct{}
+
+// ruleFromContext returns the rule matched by the request of ctx, or nil.
+func ruleFromContext(ctx context.Context) *rule {
+	rl, _ := ctx.Value(ruleKey{}).(*rule)
+	return rl
+}
+
+// rulesMiddleware matches requests against RULES_FILE. Denied requests are
+// answered here, and the query of the others rewritten; the matched rule is
+// attached to the context for the later stages to apply the rest of its
+// action.
+func (s *Server) rulesMiddleware(next http.Handler) http.Handler {
+	if len(s.rules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl := matchRule(s.rules, r)
+		if rl == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ruleMatchesTotal.WithLabelValues(rl.Name).Inc()
+		if rl.Action.Deny != 0 {
+			s.logger.LogContext(r.Context(), LogDebug, "Request denied by rule %s", rl.Name)
+			writeJSON(w, rl.Action.Deny, map[string]string{"error": "request denied by policy"})
+			return
+		}
+		r = r.Clone(ContextWithLogAttrs(context.WithValue(r.Context(), ruleKey{}, rl), slog.String("rule", rl.Name)))
+		if len(rl.Action.SetParams) > 0 || len(rl.Action.RemoveParams) > 0 {
+			q := r.URL.Query()
+			for _, name := range rl.Action.RemoveParams {
+				q.Del(name)
+			}
+			for name, value := range rl.Action.SetParams {
+				q.Set(name, value)
+			}
+			r.URL.RawQuery = q.Encode()
+			r.RequestURI = r.URL.RequestURI()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cacheTTL returns the TTL of the cache entry of r: that of its rule, when it
+// sets one, otherwise CACHE_TIMEOUT_HOURS.
+func (s *Server) cacheTTL(r *http.Request) time.Duration {
+	if rl := ruleFromContext(r.Context()); rl != nil && rl.Action.TTLSeconds > 0 {
+		return time.Duration(rl.Action.TTLSeconds) * time.Second
+	}
+	return s.config.CacheTimeout
+}
+
+// handleListRules lists the rules in the order they are evaluated.
+func (s *Server) handleListRules(w http.ResponseWriter, r *http.Request) {
+	rules := s.rules
+	if rules == nil {
+		rules = []rule{}
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// handleMatchRule reports which rule a request would take, from the request
+// URI in the uri parameter and the headers of the admin request, without
+// serving it.
+func (s *Server) handleMatchRule(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Query().Get("uri")
+	if !strings.HasPrefix(uri, "/") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "uri must be a request URI, such as /maps/api/geocode/json?address=..."})
+		return
+	}
+	probe, err := http.NewRequestWithContext(r.Context(), http.MethodGet, uri, nil)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	probe.Header = r.Header.Clone()
+	probe.Header.Del("Authorization")
+	if unit := s.businessUnit(probe); unit != "" {
+		probe = probe.WithContext(context.WithValue(probe.Context(), businessUnitKey{}, unit))
+	}
+	writeJSON(w, http.StatusOK, map[string]*rule{"rule": matchRule(s.rules, probe)})
+}
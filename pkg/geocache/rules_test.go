@@ -0,0 +1,179 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRules(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRules_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"no name":        `[{"match": {"paths": ["/*"]}}]`,
+		"duplicate":      `[{"name": "a", "match": {"paths": ["/*"]}}, {"name": "a", "match": {"paths": ["/*"]}}]`,
+		"no match":       `[{"name": "a", "action": {"deny": 403}}]`,
+		"relative path":  `[{"name": "a", "match": {"paths": ["maps/api/*"]}}]`,
+		"bad cache":      `[{"name": "a", "match": {"paths": ["/*"]}, "action": {"cache": "never"}}]`,
+		"negative TTL":   `[{"name": "a", "match": {"paths": ["/*"]}, "action": {"ttl_seconds": -1}}]`,
+		"unknown route":  `[{"name": "a", "match": {"paths": ["/*"]}, "action": {"route": "mars"}}]`,
+		"deny 500":       `[{"name": "a", "match": {"paths": ["/*"]}, "action": {"deny": 500}}]`,
+		"deny and cache": `[{"name": "a", "match": {"paths": ["/*"]}, "action": {"deny": 403, "cache": "bypass"}}]`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadRules(writeRules(t, content), []string{"eu"}); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	rules, err := loadRules(writeRules(t, `[
+		{"name": "partner", "match": {"api_keys": ["partner-key"], "business_units": ["fleet"]}},
+		{"name": "french", "match": {"paths": ["/maps/api/place/*"], "params": {"language": "fr"}}},
+		{"name": "mobile", "match": {"paths": [`+"\""+geocodePath+"\""+`], "headers": {"X-App": "*"}}}
+	]`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		uri, header, unit string
+		want              string
+	}{
+		{uri: "/maps/api/place/details/json?language=fr", want: "french"},
+		{uri: "/maps/api/place/details/json?language=de", want: ""},
+		{uri: geocodePath + "?language=fr", want: ""},
+		{uri: geocodePath, header: "ios", want: "mobile"},
+		{uri: geocodePath + "?key=partner-key", unit: "fleet", want: "partner"},
+		{uri: geocodePath + "?key=partner-key", unit: "sales", want: ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.uri, nil)
+		if tt.header != "" {
+			r.Header.Set("X-App", tt.header)
+		}
+		if tt.unit != "" {
+			r = r.WithContext(context.WithValue(r.Context(), businessUnitKey{}, tt.unit))
+		}
+		got := ""
+		if rl := matchRule(rules, r); rl != nil {
+			got = rl.Name
+		}
+		if got != tt.want {
+			t.Errorf("%s (%q, %q): matched %q, want %q", tt.uri, tt.header, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestRulesActions(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[],"status":"OK"}`}
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.RateLimitPerMinute = 100
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport, Timeout: time.Second}, server.config, server.clock, server.logger, prometheusSink{})
+	rules, err := loadRules(writeRules(t, `[
+		{"name": "blocked", "match": {"params": {"address": "blocked"}}, "action": {"deny": 403}},
+		{"name": "live", "match": {"params": {"address": "live"}}, "action": {"cache": "bypass"}},
+		{"name": "once", "match": {"params": {"address": "once"}}, "action": {"cache": "no_store"}},
+		{"name": "short", "match": {"params": {"address": "short"}}, "action": {"ttl_seconds": 60, "rate_limit_per_minute": 1}},
+		{"name": "english", "match": {"params": {"address": "english"}}, "action": {"set_params": {"language": "en"}, "remove_params": ["region"]}}
+	]`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.rules = rules
+	handler := server.routes()
+	get := func(address string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address="+address+"&region=fr", nil))
+		return w
+	}
+
+	if w := get("blocked"); w.Code != http.StatusForbidden || len(transport.urls) != 0 {
+		t.Errorf("denied request: status %d, %d upstream requests, want 403 and none", w.Code, len(transport.urls))
+	}
+	for _, address := range []string{"live", "once"} {
+		get(address)
+		if w := get(address); w.Header().Get("X-Cache") == "HIT" {
+			t.Errorf("%s: second request was a hit, want a miss", address)
+		}
+	}
+
+	if w := get("short"); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("short: X-Cache %q, want MISS", w.Header().Get("X-Cache"))
+	}
+	var ttl time.Duration
+	for _, key := range mr.Keys() {
+		if d := mr.TTL(key); d > 0 && d <= time.Minute {
+			ttl = d
+		}
+	}
+	if ttl != time.Minute {
+		t.Errorf("entry TTL %v, want the rule's 1m", ttl)
+	}
+	if w := get("short"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("second short request: status %d, want 429 from the rule's limit", w.Code)
+	}
+
+	get("english")
+	if last := transport.urls[len(transport.urls)-1]; !strings.Contains(last, "language=en") || strings.Contains(last, "region=") {
+		t.Errorf("upstream request %s, want language=en and no region", last)
+	}
+}
+
+func TestRuleRoute(t *testing.T) {
+	routesFile := filepath.Join(t.TempDir(), "routes.json")
+	os.WriteFile(routesFile, []byte(`[{"name": "eu", "api_keys": ["client-eu"], "base_url": "https://eu.example.com"}]`), 0o600)
+	transport := &recordingTransport{body: `{"results":[],"status":"OK"}`}
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.BaseURL = "https://maps.googleapis.com"
+	server.config.UpstreamRoutesFile = routesFile
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+	rules, err := loadRules(writeRules(t, `[{"name": "residency", "match": {"params": {"region": "de"}}, "action": {"route": "eu"}}]`), []string{"eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.rules = rules
+
+	server.routes().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, geocodePath+"?address=Berlin&region=de", nil))
+	if len(transport.urls) != 1 || !strings.HasPrefix(transport.urls[0], "https://eu.example.com/") {
+		t.Errorf("upstream requests %v, want one to the eu route", transport.urls)
+	}
+}
+
+func TestHandleMatchRule(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.rules = []rule{{Name: "places", Match: ruleMatch{Paths: []string{"/maps/api/place/*"}}, Action: ruleAction{Cache: ruleCacheBypass}}}
+	for uri, want := range map[string]string{"/maps/api/place/details/json": "places", geocodePath: ""} {
+		w := httptest.NewRecorder()
+		server.handleMatchRule(w, httptest.NewRequest(http.MethodGet, "/admin/rules/match?uri="+uri, nil))
+		var resp struct {
+			Rule *rule `json:"rule"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		got := ""
+		if resp.Rule != nil {
+			got = resp.Rule.Name
+		}
+		if w.Code != http.StatusOK || got != want {
+			t.Errorf("%s: status %d, rule %q, want %q", uri, w.Code, got, want)
+		}
+	}
+}
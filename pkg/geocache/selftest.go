@@ -0,0 +1,161 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// selfTestStage is the outcome of one stage of the self test: "pass",
+// "fail", or "skip" when the stage does not apply to the server's setup.
+type selfTestStage struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	Detail     string  `json:"detail,omitempty"`
+}
+
+// handleSelfTest runs a canned geocode request through the serving pipeline
+// and reports each stage: a cache store round trip, a miss answered by
+// upstream, a hit of the entry it filled, and the upstream request showing
+// in the metrics. The Google API key comes from X-Maps-API-Key or
+// SelfTestAPIKey. It responds 503 when a stage fails.
+func (s *Server) handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var stages []selfTestStage
+	run := func(name string, stage func() (status, detail string)) {
+		start := time.Now()
+		status, detail := stage()
+		stages = append(stages, selfTestStage{
+			Name:       name,
+			Status:     status,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Detail:     detail,
+		})
+	}
+
+	run("cache", func() (string, string) {
+		key := s.redisKey("selftest:" + s.instanceID)
+		probe := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+		if err := s.store.Set(ctx, key, probe, time.Minute); err != nil {
+			return "fail", "set: " + err.Error()
+		}
+		values, err := s.store.Get(ctx, key)
+		if err != nil {
+			return "fail", "get: " + err.Error()
+		}
+		s.store.Delete(ctx, key)
+		if !bytes.Equal(values[0], probe) {
+			return "fail", "read back a different value"
+		}
+		return "pass", ""
+	})
+
+	req := s.selfTestRequest(ctx, r.Header.Get("X-Maps-API-Key"))
+	cacheKey := s.cacheKey(req)
+	upstreamBefore, metricsOK := upstreamRequestCount()
+	var missBody []byte
+	run("upstream", func() (string, string) {
+		// A failing store is reported by the cache stage.
+		s.store.Delete(ctx, cacheKey)
+		rec := s.selfTestQuery(req)
+		missBody = rec.body.Bytes()
+		return checkSelfTestResponse(rec, "MISS")
+	})
+	run("cache_hit", func() (string, string) {
+		rec := s.selfTestQuery(req)
+		if status, detail := checkSelfTestResponse(rec, "HIT"); status != "pass" {
+			return status, detail
+		}
+		if !bytes.Equal(rec.body.Bytes(), missBody) {
+			return "fail", "cached body differs from the upstream response"
+		}
+		return "pass", ""
+	})
+	run("metrics", func() (string, string) {
+		if _, ok := s.metrics.(prometheusSink); !ok || !metricsOK {
+			return "skip", "metrics are not exported to Prometheus"
+		}
+		after, _ := upstreamRequestCount()
+		if after <= upstreamBefore {
+			return "fail", "upstream_requests_total did not increase"
+		}
+		return "pass", ""
+	})
+
+	status, code := "pass", http.StatusOK
+	for _, stage := range stages {
+		if stage.Status == "fail" {
+			status, code = "fail", http.StatusServiceUnavailable
+		}
+	}
+	s.logger.LogContext(ctx, LogInfo, "Self test finished: %s", status)
+	writeJSON(w, code, map[string]interface{}{"status": status, "stages": stages})
+}
+
+// selfTestRequest builds the canned geocode request.
+func (s *Server) selfTestRequest(ctx context.Context, apiKey string) *http.Request {
+	if apiKey == "" {
+		apiKey = s.config.SelfTestAPIKey
+	}
+	u := &url.URL{Path: geocodePath, RawQuery: url.Values{"address": {s.config.SelfTestAddress}}.Encode()}
+	req := (&http.Request{Method: http.MethodGet, URL: u, RequestURI: u.RequestURI(), Header: make(http.Header)}).WithContext(ctx)
+	req.Header.Set("User-Agent", "geocache-selftest")
+	if apiKey != "" {
+		req.Header.Set("X-Maps-API-Key", apiKey)
+	}
+	return req
+}
+
+// selfTestQuery serves req as a client request, so it is counted and
+// exported like one.
+func (s *Server) selfTestQuery(req *http.Request) *bufferedResponseWriter {
+	rec := newBufferedResponseWriter()
+	s.usageMiddleware(http.HandlerFunc(s.query)).ServeHTTP(newCacheStatusResponseWriter(rec), req)
+	return rec
+}
+
+func checkSelfTestResponse(rec *bufferedResponseWriter, wantCache string) (string, string) {
+	if rec.statusCode != http.StatusOK {
+		return "fail", fmt.Sprintf("HTTP %d: %s", rec.statusCode, bytes.TrimSpace(rec.body.Bytes()))
+	}
+	if got := rec.header.Get("X-Cache"); got != wantCache {
+		return "fail", fmt.Sprintf("X-Cache is %q, want %q", got, wantCache)
+	}
+	var resp struct {
+		Status       string `json:"status"`
+		ErrorMessage string `json:"error_message"`
+	}
+	if err := json.Unmarshal(plainBody(rec.body.Bytes()), &resp); err != nil {
+		return "fail", "invalid JSON response: " + err.Error()
+	}
+	if resp.Status != "OK" {
+		return "fail", fmt.Sprintf("status %s %s", resp.Status, resp.ErrorMessage)
+	}
+	return "pass", ""
+}
+
+// upstreamRequestCount sums upstream_requests_total over all labels.
+func upstreamRequestCount() (float64, bool) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return 0, false
+	}
+	for _, family := range families {
+		if family.GetName() != "upstream_requests_total" {
+			continue
+		}
+		var total float64
+		for _, m := range family.GetMetric() {
+			total += m.GetCounter().GetValue()
+		}
+		return total, true
+	}
+	return 0, true
+}
@@ -0,0 +1,78 @@
+package geocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleSelfTest(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantCode     int
+		wantStatus   map[string]string
+		wantUpstream int
+	}{
+		{
+			name:     "all stages pass",
+			body:     `{"status":"OK","results":[{"place_id":"p1"}]}`,
+			wantCode: http.StatusOK,
+			wantStatus: map[string]string{
+				"cache": "pass", "upstream": "pass", "cache_hit": "pass", "metrics": "pass",
+			},
+			wantUpstream: 1,
+		},
+		{
+			name:     "upstream rejects the key",
+			body:     `{"status":"REQUEST_DENIED","error_message":"The provided API key is invalid."}`,
+			wantCode: http.StatusServiceUnavailable,
+			wantStatus: map[string]string{
+				"cache": "pass", "upstream": "fail", "cache_hit": "fail", "metrics": "pass",
+			},
+			wantUpstream: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &recordingTransport{body: tt.body}
+			server, _, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+			defer cleanup()
+			server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+			server.config.SelfTestAddress = "1 Test St"
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/selftest", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("X-Maps-API-Key", "test-key")
+			w := httptest.NewRecorder()
+			server.adminHandler().ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status code %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			var result struct {
+				Stages []selfTestStage `json:"stages"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatalf("Failed to decode result: %v", err)
+			}
+			for _, stage := range result.Stages {
+				if stage.Status != tt.wantStatus[stage.Name] {
+					t.Errorf("Stage %s: expected %s, got %s (%s)", stage.Name, tt.wantStatus[stage.Name], stage.Status, stage.Detail)
+				}
+			}
+			if len(result.Stages) != len(tt.wantStatus) {
+				t.Errorf("Expected %d stages, got %d", len(tt.wantStatus), len(result.Stages))
+			}
+			if len(transport.urls) != tt.wantUpstream {
+				t.Fatalf("Expected %d upstream requests, got %d", tt.wantUpstream, len(transport.urls))
+			}
+			if !strings.Contains(transport.urls[0], "address=1+Test+St") || !strings.Contains(transport.urls[0], "key=test-key") {
+				t.Errorf("Unexpected upstream URL %s", transport.urls[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,861 @@
+package geocache
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	geocodePath        = "/maps/api/geocode/json"
+	directionsPath     = "/maps/api/directions/json"
+	distanceMatrixPath = "/maps/api/distancematrix/json"
+)
+
+type Server struct {
+	logger   *Logger
+	config   Config
+	store    CacheStore
+	metrics  MetricsSink
+	events   EventRecorder
+	upstream Upstream
+	clock    Clock
+	// redis backs the auxiliary indexes (place index, overrides, duplicate
+	// tracking). It is nil when a custom CacheStore is used without Redis.
+	redis      *redis.Client
+	normalizer *addressNormalizer
+	duplicates duplicateReporter
+	auditLog   *auditLog
+	stats      requestStats
+	// upstreamLatency estimates upstream response times for latency budgets.
+	upstreamLatency latencyEstimator
+	anomalies       *anomalyDetector
+	// usage exports per-request usage records; nil when disabled.
+	usage *usageExporter
+	// live holds the configuration with settings reloaded from CONFIG_DIR;
+	// nil until the first reload.
+	live atomic.Pointer[Config]
+	// instanceID identifies this replica in the instance registry.
+	instanceID string
+	// zeroResults remembers queries that returned ZERO_RESULTS; nil when
+	// disabled.
+	zeroResults *zeroResultsFilter
+	// snapshots holds the dated snapshots served for X-Cache-As-Of; nil
+	// when SNAPSHOT_LOCATION is not set.
+	snapshots *snapshotStore
+	// limiter limits concurrent upstream requests; nil when they are not
+	// limited.
+	limiter *upstreamLimiter
+	// fills coalesces concurrent misses of the same entry.
+	fills fillGroup
+	// maintenance is the maintenance mode set through the admin API; nil
+	// until one is set.
+	maintenance atomic.Pointer[maintenanceState]
+	// quarantines are the cache quarantines set through the admin API.
+	quarantines quarantineList
+	// capture is the traffic capture running on the fleet, or nil.
+	capture atomic.Pointer[capture]
+	// usageTally counts requests for the usage report; nil when
+	// USAGE_REPORTS is off or there is no Redis.
+	usageTally *usageTally
+	// placeTally counts cache hits for the place popularity ranking; nil
+	// when PLACE_INDEX is off or there is no Redis.
+	placeTally *placeTally
+	// keyParams replaces the parameter whitelists of the cache keys of some
+	// endpoints, from CACHE_KEY_PARAMS.
+	keyParams map[string][]string
+	// keyCandidate is the cache key policy evaluated in dry run; nil when
+	// none is set.
+	keyCandidate *keyCandidate
+	// rules are the request rules of RULES_FILE, in evaluation order.
+	rules []rule
+	// bypassPatterns and rejectPatterns are the paths of
+	// CACHE_BYPASS_PATTERNS and REJECT_PATTERNS.
+	bypassPatterns []pathPattern
+	rejectPatterns []pathPattern
+	// postCachePaths are the paths of POST_CACHE_PATHS, whose POST requests
+	// are cached by body.
+	postCachePaths []pathPattern
+	// jsonOutputEndpoints are the endpoints of JSON_OUTPUT_ENDPOINTS, whose
+	// requests are served from the cache of their JSON variant.
+	jsonOutputEndpoints []pathPattern
+	// endpointTimeouts are the deadlines of ENDPOINT_TIMEOUTS by path.
+	endpointTimeouts map[string]time.Duration
+	// costs are the Google prices by endpoint path, of USAGE_COSTS, from
+	// which the cost of the misses is estimated.
+	costs map[string]float64
+	// matrixLimits are the distance matrix split limits by key tier, of
+	// DISTANCE_MATRIX_LIMITS.
+	matrixLimits map[string]matrixLimit
+	// slow keeps the recent slow requests; nil when SLOW_REQUESTS_MAX is 0.
+	slow *slowRequests
+	// health pauses background jobs while Redis or the upstream is
+	// unhealthy.
+	health healthGate
+	// authChain authenticates proxied requests, in the order of AUTH_CHAIN.
+	authChain []authenticator
+}
+
+type cacheStatusResponseWriter struct {
+	statusResponseWriter
+	cacheStatus string
+	// fillID identifies the upstream request that answered a miss.
+	fillID string
+	// identity is the caller established by the authentication chain.
+	identity string
+	// upstreamTime is the time spent waiting for the upstream on a miss.
+	upstreamTime time.Duration
+}
+
+func newCacheStatusResponseWriter(w http.ResponseWriter) *cacheStatusResponseWriter {
+	return &cacheStatusResponseWriter{
+		statusResponseWriter: *newStatusResponseWriter(w),
+	}
+}
+
+// NewServer creates a Server from concrete dependencies. It is kept for
+// compatibility; NewServerWithOptions allows swapping individual components.
+func NewServer(logger *Logger, redis *redis.Client, config Config, httpClient *http.Client) *Server {
+	return NewServerWithOptions(
+		WithLogger(logger),
+		WithRedis(redis),
+		WithConfig(config),
+		WithHTTPClient(httpClient),
+	)
+}
+
+// NewServerWithOptions creates a Server. Components that are not provided
+// through options default to their Redis, Prometheus, InfluxDB and HTTP
+// implementations.
+func NewServerWithOptions(opts ...Option) *Server {
+	o := buildOptions(opts)
+	config := *o.config
+
+	auditLog, err := newAuditLog(config.AuditLogFile, o.logger)
+	if err != nil {
+		o.logger.Log(LogError, "Failed to open audit log, writing audit events to the log instead: %v", err)
+	}
+
+	server := &Server{
+		logger:              o.logger,
+		config:              config,
+		store:               o.store,
+		metrics:             o.metrics,
+		events:              o.events,
+		upstream:            o.upstream,
+		redis:               o.redis,
+		normalizer:          newKeyNormalizer(config, o.logger),
+		keyParams:           parseKeyParams(config.CacheKeyParams),
+		bypassPatterns:      parsePathPatterns("CACHE_BYPASS_PATTERNS", config.CacheBypassPatterns, o.logger),
+		rejectPatterns:      parsePathPatterns("REJECT_PATTERNS", config.RejectPatterns, o.logger),
+		postCachePaths:      parsePathPatterns("POST_CACHE_PATHS", config.PostCachePaths, o.logger),
+		jsonOutputEndpoints: parsePathPatterns("JSON_OUTPUT_ENDPOINTS", config.JSONOutputEndpoints, o.logger),
+		costs:               usageCosts(config, o.logger),
+		matrixLimits:        parseMatrixLimits(config.DistanceMatrixLimits, o.logger),
+		endpointTimeouts:    parseEndpointTimeouts(config.EndpointTimeouts),
+		authChain:           parseAuthChain(config, o.clock, o.logger),
+		auditLog:            auditLog,
+		instanceID:          newInstanceID(),
+		clock:               o.clock,
+	}
+	server.stats.startedAt = o.clock.Now().UTC()
+	if config.SlowRequestsMax > 0 {
+		server.slow = newSlowRequests(config.SlowRequestsMax)
+	}
+	server.health = healthGate{
+		clock:     o.clock,
+		threshold: config.HealthFailureThreshold,
+		recovery:  config.HealthRecovery,
+		logger:    o.logger.Component("health"),
+	}
+	if config.CacheKeyCandidateFile != "" {
+		candidate, err := loadKeyCandidate(config.CacheKeyCandidateFile, config, o.logger)
+		if err != nil {
+			o.logger.Log(LogError, "Cache key dry run disabled: %v", err)
+		}
+		server.keyCandidate = candidate
+	}
+	if config.RulesFile != "" {
+		var routes []string
+		if u, ok := o.upstream.(*httpUpstream); ok {
+			for _, route := range u.routes {
+				routes = append(routes, route.Name)
+			}
+		}
+		rules, err := loadRules(config.RulesFile, routes)
+		if err != nil {
+			o.logger.Log(LogError, "Rules disabled: %v", err)
+		}
+		server.rules = rules
+	}
+	if config.WarmupWindow > 0 || config.UpstreamMaxConcurrency > 0 {
+		server.limiter = newUpstreamLimiter(o.clock, config)
+	}
+	if config.AnomalyDetection {
+		server.anomalies = newAnomalyDetector(config.AnomalyEWMAAlpha, config.AnomalyFactor, config.AnomalyMinCount, config.AnomalyLearningIntervals, o.clock, server.reportAnomaly)
+		go server.anomalies.run(config.AnomalyInterval)
+	}
+	if config.ZeroResultsFilter {
+		if server.redis != nil {
+			server.zeroResults = newZeroResultsFilter(server.redis, server.redisKey("zero_results:"),
+				config.ZeroResultsFilterCapacity, config.ZeroResultsFilterFPRate, config.ZeroResultsFilterPeriod, o.clock)
+		} else {
+			o.logger.Log(LogWarning, "Zero results filter disabled, it requires Redis")
+		}
+	}
+	if server.redis != nil {
+		go server.runMaintenanceSync()
+		go server.runQuarantineSync()
+		go server.runCaptureSync()
+	}
+	if config.SnapshotLocation != "" {
+		if bucket, path, err := parseGCSLocation(config.SnapshotLocation); err != nil {
+			o.logger.Log(LogError, "Snapshots disabled: %v", err)
+		} else {
+			server.snapshots = newSnapshotStore(newGCSClient(bucket), path)
+			if server.redis != nil && config.SnapshotInterval > 0 {
+				go server.runSnapshots(config.SnapshotInterval)
+			}
+		}
+	}
+	if server.redis != nil && config.IntegritySweepSample > 0 {
+		go server.runIntegritySweep()
+	}
+	if server.redis != nil && config.UsageReports {
+		server.usageTally = newUsageTally(server)
+		go server.runUsageTally()
+	}
+	if server.redis != nil && config.PlaceIndex {
+		server.placeTally = newPlaceTally(server)
+		go server.runPlaceTally()
+	}
+	if server.redis != nil && config.InstanceHeartbeat > 0 {
+		go server.runHeartbeat(config.InstanceHeartbeat)
+	}
+	if u, ok := server.upstream.(*httpUpstream); ok && config.UpstreamPrewarmInterval > 0 {
+		go server.runUpstreamPrewarm(u)
+	}
+	if config.WarmSource != "" {
+		if source, err := newWarmSource(config); err != nil {
+			o.logger.Log(LogError, "Cache warming disabled: %v", err)
+		} else {
+			go server.runWarmer(source)
+		}
+	}
+	if config.CloudMonitoringInterval > 0 {
+		go server.runCloudMonitoring(newCloudMonitoringExporter(server))
+	}
+	if config.EdgeSyncURL != "" && config.EdgeSyncInterval > 0 {
+		go server.runEdgeSync()
+	}
+	if config.ConfigDir != "" {
+		server.watchConfig()
+	}
+	if config.BigQueryTable != "" {
+		inserter, err := newBigQueryInserter(config.BigQueryTable)
+		if err != nil {
+			o.logger.Log(LogError, "Usage export disabled: %v", err)
+		} else {
+			server.usage = newUsageExporter(config, o.logger, o.clock, inserter.Insert)
+			go server.usage.run()
+		}
+	}
+	return server
+}
+
+func extractAPIKey(r *http.Request) string {
+	key := r.Header.Get("X-Maps-API-Key")
+	if key != "" {
+		return key
+	}
+	q := r.URL.Query()
+	if k := q.Get("key"); k != "" {
+		return k
+	}
+	return ""
+}
+
+func obfuscateAPIKey(key string) string {
+	if len(key) <= 8 {
+		return key
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
+
+// newKeyNormalizer returns the address normalizer of the cache keys, or nil
+// when addresses are not normalized.
+func newKeyNormalizer(config Config, logger *Logger) *addressNormalizer {
+	if !config.NormalizeAddress {
+		return nil
+	}
+	var abbreviations map[string]string
+	if config.AddressAbbreviationsFile != "" {
+		table, err := loadAbbreviations(config.AddressAbbreviationsFile)
+		if err != nil {
+			logger.Log(LogWarning, "Failed to load address abbreviations, using defaults: %v", err)
+		}
+		abbreviations = table
+	}
+	return newAddressNormalizer(config.NormalizeStripDiacritics, abbreviations)
+}
+
+func getCacheKey(r *http.Request, prefix string) string {
+	return hashCacheKey(canonicalQuery(r.URL, nil, nil), prefix)
+}
+
+// cacheKey computes the cache key for r using the server's prefix and key
+// normalization settings.
+func (s *Server) cacheKey(r *http.Request) string {
+	if key := pageKeyFromContext(r.Context()); key != "" {
+		return key
+	}
+	norm := canonicalQuery(r.URL, s.normalizer, s.keyParams)
+	if body := postBodyFromContext(r.Context()); body != nil {
+		norm = "POST " + norm + "\n" + body.canonical
+	}
+	if headers := keyHeaders(r.Header, s.config.CacheKeyHeaders); headers != "" {
+		norm += "\n" + headers
+	}
+	return hashCacheKey(norm, s.config.RedisPrefix)
+}
+
+// canonicalQuery reduces a request URL to the path and sorted, whitelisted
+// parameters that identify a cache entry, with the values of parameters such
+// as bounds and components canonicalized. params replaces the built-in
+// whitelist of the endpoints it lists.
+func canonicalQuery(reqURL *url.URL, normalizer *addressNormalizer, params map[string][]string) string {
+	u := *reqURL
+	q := u.Query()
+
+	if normalizer != nil && jsonVariant(u.Path) == geocodePath {
+		if addresses, ok := q["address"]; ok {
+			for i, a := range addresses {
+				addresses[i] = normalizer.Normalize(a)
+			}
+		}
+	}
+
+	for name, canonicalize := range keyValueCanonicalizers[jsonVariant(u.Path)] {
+		for i, v := range q[name] {
+			q[name][i], _ = canonicalize(v)
+		}
+	}
+
+	var whitelist map[string]bool
+
+	// The XML variant of an endpoint is identified by the same parameters.
+	switch jsonVariant(u.Path) {
+	case directionsPath:
+		whitelist = map[string]bool{
+			"origin":      true,
+			"destination": true,
+			"output":      true,
+		}
+	case distanceMatrixPath:
+		whitelist = map[string]bool{
+			"origins":      true,
+			"destinations": true,
+		}
+	default:
+		whitelist = map[string]bool{}
+		for k := range q {
+			if !unkeyedParams[k] {
+				whitelist[k] = true
+			}
+		}
+	}
+	if names, ok := params[jsonVariant(u.Path)]; ok {
+		whitelist = make(map[string]bool, len(names))
+		for _, name := range names {
+			whitelist[name] = true
+		}
+	}
+
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		if whitelist[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	norm := u.Path
+	if len(keys) > 0 {
+		params := make([]string, 0, len(keys))
+		for _, k := range keys {
+			vals := q[k]
+			sort.Strings(vals)
+			for _, v := range vals {
+				params = append(params, url.QueryEscape(k)+"="+url.QueryEscape(v))
+			}
+		}
+		norm += "?" + strings.Join(params, "&")
+	}
+	return norm
+}
+
+func hashCacheKey(norm, prefix string) string {
+	h := sha256.New()
+	h.Write([]byte(norm))
+	key := hex.EncodeToString(h.Sum(nil))
+	if prefix != "" {
+		return prefix + ":" + key
+	}
+	return key
+}
+
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	if s.transcodesXML(r.URL.Path) {
+		s.serveTranscodedXML(w, r)
+		return
+	}
+	if reason := s.bypassReason(r); reason != "" {
+		s.serveBypass(w, r, reason)
+		return
+	}
+	if token := pageToken(r); token != "" {
+		var ok bool
+		if r, ok = s.resolvePageToken(r, token); !ok {
+			s.serveBypass(w, r, "the page token was not issued in a cached response")
+			return
+		}
+	}
+	if name := invalidKeyParam(r.URL); name != "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid " + name + " parameter"})
+		return
+	}
+	start := time.Now()
+	cacheKey := s.cacheKey(r)
+	debug := s.wantsCacheDebug(r)
+	if debug {
+		s.writeCacheKeyDebug(w, r, cacheKey)
+	}
+	if asOf := r.Header.Get("X-Cache-As-Of"); asOf != "" {
+		s.serveSnapshot(w, r, cacheKey, asOf)
+		return
+	}
+
+	lookupStart := time.Now()
+	keys := []string{s.overrideKey(cacheKey), cacheKey}
+	wantsProtobuf := s.wantsProtobuf(r)
+	if wantsProtobuf {
+		keys = append(keys, protobufKey(cacheKey))
+	}
+	entries, err := lookupEntries(context.Background(), s.store, keys, s.lookupOptions(cacheKey))
+	s.metrics.ObserveCacheOp(r.URL.Path, time.Since(lookupStart), err)
+	s.health.observe(healthRedis, err)
+	values := make([][]byte, len(keys))
+	for i, e := range entries {
+		values[i] = e.value
+	}
+	if err == nil && values[0] != nil {
+		var o override
+		if json.Unmarshal(values[0], &o) == nil {
+			w.Header().Set("Content-Type", o.ContentType)
+			w.Header().Set("X-Cache", "OVERRIDE")
+			if debug {
+				writeCacheDecisionDebug(w, "served the operator override of the entry", 0)
+			}
+			w.Write([]byte(o.Body))
+			s.events.RecordCacheEvent("override", r, cacheKey)
+			if csw, ok := w.(*cacheStatusResponseWriter); ok {
+				csw.cacheStatus = "OVERRIDE"
+			}
+			return
+		}
+	}
+	var cachedResponse, cachedProtobuf []byte
+	quarantined := s.quarantineFor(r, cacheKey)
+	if err == nil && quarantined == nil {
+		cachedResponse = s.unwrapEntry(r.Context(), r.URL.Path, cacheKey, values[1])
+		if wantsProtobuf {
+			cachedProtobuf = s.unwrapEntry(r.Context(), r.URL.Path, protobufKey(cacheKey), values[2])
+		}
+	}
+	if s.keyCandidate != nil {
+		s.observeKeyCandidate(r, cacheKey, cachedResponse != nil)
+	}
+	if cachedResponse != nil {
+		w.Header().Set("X-Cache", "HIT")
+		if debug {
+			entry := entries[1]
+			if !entry.storedAt.IsZero() {
+				w.Header().Set("X-Cache-Debug-Age", strconv.Itoa(int(s.clock.Now().Sub(entry.storedAt).Seconds())))
+			}
+			if entry.hits > 0 {
+				w.Header().Set("X-Cache-Debug-Hits", strconv.FormatInt(entry.hits, 10))
+			}
+			writeCacheDecisionDebug(w, "served from the cache entry", entry.ttl)
+		}
+		if !wantsProtobuf || !writeProtobuf(w, cachedProtobuf, cachedResponse) {
+			w.Header().Set("Content-Type", cachedContentType(r))
+			s.writeBody(w, r, s.simplifyBody(r, cachedResponse, PolylineSimplifyResponse, false))
+		}
+		s.events.RecordCacheEvent("hit", r, cacheKey)
+		if s.placeTally != nil {
+			s.placeTally.observe(r.URL.Path, cacheKey, cachedResponse)
+		}
+		if csw, ok := w.(*cacheStatusResponseWriter); ok {
+			csw.cacheStatus = "HIT"
+		}
+		return
+	}
+	if s.knownZeroResults(r, cacheKey) {
+		if debug {
+			writeCacheDecisionDebug(w, "the query is known to return ZERO_RESULTS", 0)
+		}
+		s.serveZeroResults(w, r)
+		s.events.RecordCacheEvent("negative", r, cacheKey)
+		return
+	}
+
+	if mode := s.maintenanceState().Mode; mode != MaintenanceOff {
+		writeMaintenance(w, mode, "service is in maintenance, only cached responses are served")
+		return
+	}
+	upstreamReq := r
+	if wantsGeoJSON(r) {
+		upstreamReq = withoutOutputParam(r)
+	}
+	aggregate := wantsAggregatePages(r)
+	if aggregate {
+		upstreamReq = withoutAggregateParam(upstreamReq)
+	}
+	// budgetCtx carries the deadline of the latency budget of r, if any.
+	var budgetCtx context.Context
+	if budget, ok := latencyBudget(r); ok {
+		remaining := budget - time.Since(start)
+		if remaining <= 0 || remaining < s.upstreamLatency.estimate() {
+			if s.serveStale(w, r, cacheKey) {
+				return
+			}
+			latencyBudgetRejectionsTotal.WithLabelValues("insufficient").Inc()
+			writeJSON(w, http.StatusGatewayTimeout, map[string]string{"error": "latency budget too small for an upstream request"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), remaining)
+		defer cancel()
+		upstreamReq = upstreamReq.WithContext(ctx)
+		budgetCtx = ctx
+	}
+
+	// Concurrent misses of the entry wait for the upstream request of the
+	// first one, and are answered with its response.
+	fillID := w.Header().Get("X-Request-ID")
+	if fillID == "" {
+		fillID = newRequestID()
+	}
+	fill, leader := s.fills.join(cacheKey, fillID)
+	if leader {
+		defer s.fills.finish(cacheKey, fill)
+	}
+	var resp *UpstreamResponse
+	var fetchedAt time.Time
+	var upstreamTook time.Duration
+	coalesced := false
+	if !leader {
+		s.logger.LogContext(r.Context(), LogDebug, "Waiting for fill %s", fill.id)
+		resp, err = fill.wait(upstreamReq.Context())
+		coalesced = !errors.Is(err, errFillAbandoned)
+	}
+	if coalesced {
+		fillID = fill.id
+	} else {
+		if s.limiter != nil {
+			release, ok := s.acquireUpstream(w, r, cacheKey)
+			if !ok {
+				return
+			}
+			defer release()
+		}
+		fetchStart := time.Now()
+		fetchedAt = fetchStart
+		resp, err = s.fetchMatrix(upstreamReq)
+		upstreamTook = time.Since(fetchStart)
+		s.observeUpstreamHealth(resp, err)
+		if err == nil {
+			s.upstreamLatency.observe(upstreamTook)
+			if aggregate && !quotaExceeded(resp) {
+				resp, err = s.aggregatePages(upstreamReq, resp)
+			}
+		}
+		if leader {
+			fill.resp, fill.err = resp, err
+		}
+	}
+	w.Header().Set("X-Cache-Fill-Id", fillID)
+	if csw, ok := w.(*cacheStatusResponseWriter); ok {
+		csw.fillID = fillID
+		csw.upstreamTime = upstreamTook
+	}
+	if errors.Is(err, context.DeadlineExceeded) && budgetCtx != nil && budgetCtx.Err() != nil && r.Context().Err() == nil {
+		latencyBudgetRejectionsTotal.WithLabelValues("timeout").Inc()
+		writeJSON(w, http.StatusGatewayTimeout, map[string]string{"error": "latency budget exhausted waiting for upstream"})
+		return
+	} else if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		// The deadline of the endpoint passed: timeoutMiddleware answers.
+		return
+	} else if errors.Is(err, errReadBody) {
+		http.Error(w, "Failed to read response body", http.StatusInternalServerError)
+		return
+	} else if errors.Is(err, errPageFailed) {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to fetch every page of the search: " + err.Error()})
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch from Google Maps API", http.StatusInternalServerError)
+		return
+	}
+	setUpstreamHeaders(w, resp)
+
+	if quotaExceeded(resp) {
+		if debug {
+			writeCacheDecisionDebug(w, "not stored: the upstream quota is exceeded", 0)
+		}
+		s.serveQuotaExceeded(w, r, resp)
+		return
+	}
+
+	if isRedirect(resp.StatusCode) && resp.Header.Get("Location") != "" {
+		cacheStatus := "MISS"
+		if coalesced {
+			cacheStatus = "COALESCED"
+		}
+		s.serveRedirect(w, r, resp, cacheStatus)
+		return
+	}
+
+	body, cacheable := s.cacheBody(r, resp.Body)
+	decision, ttl := "", time.Duration(0)
+	if coalesced {
+		// The request that triggered the fill has cached the response.
+		decision = "answered by the upstream request of fill " + fillID + ", which stored the response"
+	} else if quarantined != nil {
+		// The entry is kept as it is for the investigation.
+		decision = "not stored: the entry is quarantined by " + quarantined.ID
+	} else if s.zeroResults != nil && zeroResultsBodies[r.URL.Path] != nil && isZeroResults(plainBody(resp.Body)) {
+		// Remembered in the filter instead of taking up a cache entry.
+		if err := s.zeroResults.Add(r.Context(), cacheKey); err != nil {
+			s.logger.LogContext(r.Context(), LogWarning, "Failed to add to the zero results filter: %v", err)
+		}
+		decision = "not stored: ZERO_RESULTS is remembered by the zero results filter"
+	} else if rl := ruleFromContext(r.Context()); cacheable && rl != nil && rl.Action.Cache == ruleCacheNoStore {
+		decision = "not stored: rule " + rl.Name + " does not store responses"
+	} else if resp.Redirected && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		decision = "not stored: the upstream redirected to a response without a 2xx status"
+	} else if postBodyFromContext(r.Context()) != nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		decision = "not stored: POST responses are stored only with a 2xx status"
+	} else if pageKeyFromContext(r.Context()) != "" && entryKind(plainBody(resp.Body)) != "" {
+		decision = "not stored: the page token was not accepted upstream"
+	} else if cacheable && s.config.CacheMaxUpstreamLatency > 0 && upstreamTook > s.config.CacheMaxUpstreamLatency {
+		upstreamResponsesNotCachedTotal.WithLabelValues("slow").Inc()
+		decision = "not stored: the upstream took " + upstreamTook.Round(time.Millisecond).String() + ", more than CACHE_MAX_UPSTREAM_LATENCY_SECONDS"
+	} else if cacheable && s.config.CacheSkipStreamed && resp.Streamed {
+		upstreamResponsesNotCachedTotal.WithLabelValues("streamed").Inc()
+		decision = "not stored: the upstream sent the body without a Content-Length"
+	} else if cacheable {
+		decision, ttl = "stored", s.cacheTTL(r)
+		if s.storeResponse(r, cacheKey, body, fetchedAt) {
+			decision, ttl = "not stored: a fresher response was stored by another fill", 0
+		} else {
+			s.trackPages(r, cacheKey, plainBody(resp.Body), fetchedAt)
+		}
+	} else {
+		decision = "not stored: the upstream response failed validation or conversion"
+	}
+	if debug {
+		writeCacheDecisionDebug(w, decision, ttl)
+	}
+
+	if wantsGeoJSON(r) && cacheable {
+		w.Header().Set("Content-Type", geoJSONContentType)
+	} else {
+		w.Header().Set("Content-Type", resp.Header.Get("content-type"))
+	}
+	w.Header().Set("Date", resp.Header.Get("date"))
+	w.Header().Set("Expires", resp.Header.Get("expires"))
+	w.Header().Set("Alt-Svc", resp.Header.Get("alt-svc"))
+	cacheStatus := "MISS"
+	if coalesced {
+		cacheStatus = "COALESCED"
+		coalescedRequestsTotal.WithLabelValues(metricsEndpoint(r.URL.Path)).Inc()
+	}
+	w.Header().Set("X-Cache", cacheStatus)
+	if !wantsProtobuf || !writeProtobuf(w, nil, body) {
+		s.writeBody(w, r, s.simplifyBody(r, body, PolylineSimplifyResponse, false))
+	}
+	s.events.RecordCacheEvent(strings.ToLower(cacheStatus), r, cacheKey)
+	if csw, ok := w.(*cacheStatusResponseWriter); ok {
+		csw.cacheStatus = cacheStatus
+	}
+}
+
+// storeResponse caches body, which may be gzip compressed and was requested
+// upstream at fetchedAt, under cacheKey and updates the auxiliary indexes.
+// With change detection enabled, the entry being replaced (if any) is
+// compared against the new one. With conditional fills, a fresher entry is
+// kept in place of body, which kept reports.
+func (s *Server) storeResponse(r *http.Request, cacheKey string, body []byte, fetchedAt time.Time) (kept bool) {
+	ctx := context.Background()
+	storeStart := time.Now()
+	var previous []byte
+	var err error
+	ttl := s.cacheTTL(r)
+	if s.config.ConditionalFills {
+		var stored bool
+		stored, previous, err = setIfFresher(ctx, s.store, cacheKey, s.fillEntry(r, body, fetchedAt), ttl, fetchedAt)
+		kept = err == nil && !stored
+		if !s.config.ChangeDetection {
+			previous = nil
+		}
+	} else if s.config.ChangeDetection {
+		previous, err = s.store.Swap(ctx, cacheKey, s.wrapEntryURI(body, s.entryURI(r)), ttl)
+	} else {
+		err = s.store.Set(ctx, cacheKey, s.wrapEntryURI(body, s.entryURI(r)), ttl)
+	}
+	s.metrics.ObserveCacheOp(r.URL.Path, time.Since(storeStart), err)
+	s.health.observe(healthRedis, err)
+
+	if err != nil {
+		s.logger.LogContext(r.Context(), LogWarning, "Failed to cache response: %v", err)
+		return false
+	}
+	if kept {
+		conditionalFillsTotal.WithLabelValues("kept").Inc()
+		s.logger.LogContext(r.Context(), LogDebug, "Kept the fresher entry %s in place of the fill", cacheKey)
+		return true
+	} else if s.config.ConditionalFills {
+		conditionalFillsTotal.WithLabelValues("stored").Inc()
+	}
+	s.trackGeocodeQuery(r, cacheKey)
+	if s.config.ProtobufOutput && r.URL.Path == distanceMatrixPath {
+		s.storeProtobuf(ctx, r, cacheKey, plainBody(body))
+	}
+	if s.config.PlaceIndex || previous != nil {
+		plain := plainBody(body)
+		s.indexPlaces(r.URL.Path, cacheKey, plain)
+		// A corrupt previous entry is not compared; it is already replaced.
+		if previous, err := decodeEntry(previous); err == nil && previous != nil {
+			s.detectChanges(r, cacheKey, plainBody(previous), plain)
+		}
+	}
+	return false
+}
+
+// logMiddleware writes an access log line per request. It attaches a request
+// ID (taken from X-Request-ID or generated) and the endpoint to the request
+// context so that every record logged while serving it carries them.
+func (s *Server) logMiddleware(next http.Handler) http.Handler {
+	access := s.logger.Component("access")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			ip := forwardedFor(r)
+			if ip == "" {
+				ip = normalizeAddr(r.RemoteAddr)
+			}
+
+			requestID := r.Header.Get("X-Request-ID")
+			if requestID == "" {
+				requestID = newRequestID()
+			}
+			w.Header().Set("X-Request-ID", requestID)
+			ctx := ContextWithLogAttrs(r.Context(), slog.String("request_id", requestID), slog.String("endpoint", r.URL.Path))
+			if traceID, spanID := requestTrace(r); traceID != "" && access.structured() {
+				if s.config.GCPProject != "" {
+					traceID = "projects/" + s.config.GCPProject + "/traces/" + traceID
+				}
+				ctx = ContextWithLogAttrs(ctx, slog.String(traceAttrKey, traceID), slog.String(spanAttrKey, spanID))
+			}
+			r = r.WithContext(ctx)
+
+			csw := newCacheStatusResponseWriter(w)
+			start := time.Now()
+			next.ServeHTTP(csw, r)
+			s.observeSlow(r, csw, time.Since(start))
+
+			referrer := requestReferrer(r)
+
+			if access.structured() {
+				attrs := []slog.Attr{
+					slog.String("ip", ip),
+					slog.Int("status_code", csw.statusCode),
+					slog.String("cache_status", csw.cacheStatus),
+					slog.String("referrer", referrer),
+				}
+				if csw.fillID != "" {
+					attrs = append(attrs, slog.String("fill_id", csw.fillID))
+				}
+				if csw.identity != "" {
+					attrs = append(attrs, slog.String("identity", csw.identity))
+				}
+				if s.config.LogRequestURI {
+					attrs = append(attrs, slog.String("uri", requestURIWithoutKey(r.URL)))
+				}
+				access.LogAttrs(ctx, LogInfo, fmt.Sprintf("%s %s", r.Method, r.URL.Path), attrs...)
+			} else {
+				fill := ""
+				if csw.fillID != "" {
+					fill = " - fill:" + csw.fillID
+				}
+				if csw.identity != "" {
+					fill += " - identity:" + csw.identity
+				}
+				access.Log(LogInfo, "%s [%s] %s - %d - cache:%s%s - referrer:%s", ip, r.Method, r.URL.Path, csw.statusCode, csw.cacheStatus, fill, referrer)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unkeyedParams are the credentials, the API key or the client ID and URL
+// signature, and the usage reporting channel. They do not identify the
+// response, so they are left out of cache keys and of logged and stored URIs.
+var unkeyedParams = map[string]bool{"key": true, "client": true, "signature": true, "channel": true}
+
+// requestURIWithoutKey returns the request URI of u without its credentials
+// and usage channel.
+func requestURIWithoutKey(u *url.URL) string {
+	stripped := *u
+	q := stripped.Query()
+	for name := range unkeyedParams {
+		q.Del(name)
+	}
+	stripped.RawQuery = q.Encode()
+	return stripped.RequestURI()
+}
+
+// newRequestID returns a random 16 hex digit request identifier.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Maps-API-Key")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,13 +1,18 @@
-package main
+package geocache
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
@@ -51,7 +56,7 @@ func setupTestServer(t *testing.T, mockClient *http.Client) (*Server, *miniredis
 		DB:   config.RedisDB,
 	})
 
-	logger := &Logger{useGCP: false}
+	logger := NewLogger(false)
 
 	server := NewServer(logger, rdb, config, mockClient)
 
@@ -414,7 +419,7 @@ func TestServer_Query_RedisCacheError(t *testing.T) {
 		DB:   config.RedisDB,
 	})
 
-	logger := &Logger{useGCP: false}
+	logger := NewLogger(false)
 
 	server := NewServer(logger, rdb, config, mockClient)
 
@@ -519,7 +524,7 @@ func (m *mockTransport) RoundTrip(*http.Request) (*http.Response, error) {
 
 func TestQueryResponseBodyReadError(t *testing.T) {
 	// Setup mock logger
-	logger := &Logger{useGCP: false}
+	logger := NewLogger(false)
 
 	// Setup mock Redis client
 	rdb := redis.NewClient(&redis.Options{})
@@ -614,7 +619,7 @@ func TestLog_CacheHitAndMiss(t *testing.T) {
 		Header:     make(http.Header),
 	}
 	mockResp.Header.Set("content-type", "application/json")
-	server.httpClient = &http.Client{Transport: &MockTransport{Response: mockResp}}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: &MockTransport{Response: mockResp}}, server.config, server.clock, server.logger, prometheusSink{})
 
 	// Wrap with logMiddleware
 	handler := server.logMiddleware(http.HandlerFunc(server.query))
@@ -636,3 +641,326 @@ func TestLog_CacheHitAndMiss(t *testing.T) {
 		t.Errorf("Expected log to contain cache:HIT, got: %s", buf.String())
 	}
 }
+
+// recordingTransport captures the URLs requested through it, and the
+// headers of the last request
+type recordingTransport struct {
+	urls   []string
+	header http.Header
+	body   string
+}
+
+func (m *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.urls = append(m.urls, req.URL.String())
+	m.header = req.Header
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(m.body)),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func TestServer_Query_CanaryRouting(t *testing.T) {
+	tests := []struct {
+		name          string
+		canaryBaseURL string
+		canaryPercent float64
+		wantBaseURL   string
+		wantTarget    string
+		wantHost      string
+	}{
+		{
+			name:        "no canary configured",
+			wantBaseURL: "https://maps.googleapis.com/maps/api",
+			wantTarget:  upstreamPrimary,
+			wantHost:    "maps.googleapis.com",
+		},
+		{
+			name:          "canary at zero percent",
+			canaryBaseURL: "https://canary.example.com",
+			canaryPercent: 0,
+			wantBaseURL:   "https://maps.googleapis.com/maps/api",
+			wantTarget:    upstreamPrimary,
+			wantHost:      "maps.googleapis.com",
+		},
+		{
+			name:          "canary at full percent",
+			canaryBaseURL: "https://canary.example.com",
+			canaryPercent: 100,
+			wantBaseURL:   "https://canary.example.com",
+			wantTarget:    upstreamCanary,
+			wantHost:      "canary.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &recordingTransport{body: `{"mock": "response"}`}
+			server, _, cleanup := setupTestServer(t, nil)
+			defer cleanup()
+			server.config.CanaryBaseURL = tt.canaryBaseURL
+			server.config.CanaryPercent = tt.canaryPercent
+			server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+
+			before := testutil.ToFloat64(upstreamRequestsTotal.WithLabelValues(tt.wantTarget, "200"))
+			responses := testutil.ToFloat64(upstreamResponsesTotal.WithLabelValues(tt.wantTarget, tt.wantHost))
+
+			req := httptest.NewRequest(http.MethodGet, "/query?location=Canary", nil)
+			w := httptest.NewRecorder()
+			server.query(w, req)
+
+			if len(transport.urls) != 1 {
+				t.Fatalf("Expected 1 upstream request, got %d", len(transport.urls))
+			}
+			if !strings.HasPrefix(transport.urls[0], tt.wantBaseURL+"/query") {
+				t.Errorf("Expected upstream URL to start with %s, got %s", tt.wantBaseURL, transport.urls[0])
+			}
+
+			after := testutil.ToFloat64(upstreamRequestsTotal.WithLabelValues(tt.wantTarget, "200"))
+			if after-before != 1 {
+				t.Errorf("Expected upstreamRequestsTotal{target=%q} to increment by 1, got %v", tt.wantTarget, after-before)
+			}
+			if got := testutil.ToFloat64(upstreamResponsesTotal.WithLabelValues(tt.wantTarget, tt.wantHost)) - responses; got != 1 {
+				t.Errorf("Expected upstreamResponsesTotal{provider=%q, host=%q} to increment by 1, got %v", tt.wantTarget, tt.wantHost, got)
+			}
+			if got := w.Header().Get("X-Upstream-Provider"); got != tt.wantTarget {
+				t.Errorf("Expected X-Upstream-Provider %q, got %q", tt.wantTarget, got)
+			}
+			if got := w.Header().Get("X-Upstream-Host"); got != tt.wantHost {
+				t.Errorf("Expected X-Upstream-Host %q, got %q", tt.wantHost, got)
+			}
+		})
+	}
+}
+
+func TestServer_Query_UpstreamHeaders(t *testing.T) {
+	transport := &recordingTransport{body: `{"mock": "response"}`}
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.UpstreamUserAgent = upstreamUserAgent("https://example.com/geocache")
+	server.config.UpstreamHeaders = map[string]string{"X-Egress-Source": "geocache"}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+
+	req := httptest.NewRequest(http.MethodGet, "/query?location=Branding", nil)
+	req.Header.Set("User-Agent", "client/1.0")
+	w := httptest.NewRecorder()
+	server.query(w, req)
+
+	if len(transport.urls) != 1 {
+		t.Fatalf("Expected 1 upstream request, got %d", len(transport.urls))
+	}
+	if got, want := transport.header.Get("User-Agent"), "geocache/"+apiConfig.Version+" (+https://example.com/geocache)"; got != want {
+		t.Errorf("Expected User-Agent %q, got %q", want, got)
+	}
+	if got := transport.header.Get("X-Egress-Source"); got != "geocache" {
+		t.Errorf("Expected X-Egress-Source geocache, got %q", got)
+	}
+}
+
+func TestServer_Query_PlatformHeaders(t *testing.T) {
+	transport := &recordingTransport{body: `{"status":"OK","results":[]}`}
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.ForwardHeaders = []string{"X-Goog-*"}
+	server.config.CacheKeyHeaders = []string{"X-Goog-FieldMask"}
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+
+	query := func(channel, fieldMask string) string {
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&channel="+channel, nil)
+		req.Header.Set("X-Goog-Maps-Channel-Id", channel)
+		req.Header.Set("X-Goog-FieldMask", fieldMask)
+		req.Header.Set("X-Internal-Token", "secret")
+		w := httptest.NewRecorder()
+		server.query(w, req)
+		return w.Header().Get("X-Cache")
+	}
+
+	if got := query("fleet", "results"); got != "MISS" {
+		t.Fatalf("Expected a miss, got %s", got)
+	}
+	if !strings.Contains(transport.urls[0], "channel=fleet") {
+		t.Errorf("Expected the channel to be forwarded, got %s", transport.urls[0])
+	}
+	if got := transport.header.Get("X-Goog-Maps-Channel-Id"); got != "fleet" {
+		t.Errorf("Expected X-Goog-Maps-Channel-Id fleet, got %q", got)
+	}
+	if got := transport.header.Get("X-Internal-Token"); got != "" {
+		t.Errorf("Expected X-Internal-Token not to be forwarded, got %q", got)
+	}
+	// The channel does not identify the response, the field mask does.
+	if got := query("dispatch", "results"); got != "HIT" {
+		t.Errorf("Expected a hit for another channel, got %s", got)
+	}
+	if got := query("fleet", "results.place_id"); got != "MISS" {
+		t.Errorf("Expected a miss for another field mask, got %s", got)
+	}
+}
+
+func TestSignRequestURI(t *testing.T) {
+	key, _ := base64.URLEncoding.DecodeString("vNIXE0xscrmjlyV-12Nj_BvUPaw=")
+	tests := []struct {
+		name     string
+		uri      string
+		clientID string
+		want     string
+	}{
+		{
+			name:     "client ID",
+			uri:      "/maps/api/geocode/json?address=New+York",
+			clientID: "clientID",
+			want:     "/maps/api/geocode/json?address=New+York&client=clientID&signature=chaRF2hTJKOScPr-RQCEhZbSzIE=",
+		},
+		{
+			name:     "client ID replaces key and signature",
+			uri:      "/maps/api/geocode/json?address=New+York&key=abc&signature=forged",
+			clientID: "clientID",
+			want:     "/maps/api/geocode/json?address=New+York&client=clientID&signature=chaRF2hTJKOScPr-RQCEhZbSzIE=",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := signRequestURI(tt.uri, tt.clientID, key)
+			if err != nil || got != tt.want {
+				t.Errorf("signRequestURI() = %q (%v), want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_Query_SignedRequests(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[],"status":"OK"}`}
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.BaseURL = "https://maps.googleapis.com"
+	server.config.URLSigningSecret = "vNIXE0xscrmjlyV-12Nj_BvUPaw="
+	server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+
+	first := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&signature=one", nil)
+	first.Header.Set("X-Maps-API-Key", "abc")
+	server.query(httptest.NewRecorder(), first)
+	w := httptest.NewRecorder()
+	server.query(w, httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&signature=two", nil))
+
+	if got := w.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("Expected client signatures to be ignored in cache keys, got X-Cache %s", got)
+	}
+	if len(transport.urls) != 1 {
+		t.Fatalf("Expected 1 upstream request, got %d", len(transport.urls))
+	}
+	u, _ := url.Parse(transport.urls[0])
+	q := u.Query()
+	if q.Get("key") != "abc" || q.Get("signature") == "" || q.Get("signature") == "one" {
+		t.Errorf("Expected the upstream request to carry the key and the proxy's signature, got %s", transport.urls[0])
+	}
+	key, _ := base64.URLEncoding.DecodeString(server.config.URLSigningSecret)
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(u.Path + "?" + strings.Split(u.RawQuery, "&signature=")[0]))
+	if want := base64.URLEncoding.EncodeToString(mac.Sum(nil)); q.Get("signature") != want {
+		t.Errorf("Expected signature %s, got %s", want, q.Get("signature"))
+	}
+}
+
+// routedTransport answers 503 for requests to failingHost.
+type routedTransport struct {
+	recordingTransport
+	failingHost string
+}
+
+func (m *routedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == m.failingHost {
+		m.urls = append(m.urls, req.URL.String())
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader("")), Header: make(http.Header)}, nil
+	}
+	return m.recordingTransport.RoundTrip(req)
+}
+
+func TestServer_Query_UpstreamRoutes(t *testing.T) {
+	routesFile := filepath.Join(t.TempDir(), "routes.json")
+	os.WriteFile(routesFile, []byte(`[
+		{"name": "eu", "api_keys": ["client-eu"], "base_url": "https://eu.example.com", "upstream_api_key": "project-eu"},
+		{"name": "partner", "referrers": ["partner.example.com"], "base_url": "https://down.example.com", "fallback_base_url": "https://backup.example.com"}
+	]`), 0o600)
+
+	tests := []struct {
+		name       string
+		apiKey     string
+		referrer   string
+		wantURLs   []string
+		wantTarget string
+	}{
+		{
+			name:       "API key route with project key",
+			apiKey:     "client-eu",
+			wantURLs:   []string{"https://eu.example.com" + geocodePath + "?address=Route&key=project-eu"},
+			wantTarget: "eu",
+		},
+		{
+			name:     "referrer route falling back",
+			referrer: "https://partner.example.com/map",
+			wantURLs: []string{
+				"https://down.example.com" + geocodePath + "?address=Route",
+				"https://backup.example.com" + geocodePath + "?address=Route",
+			},
+			wantTarget: "partner-fallback",
+		},
+		{
+			name:       "no route",
+			apiKey:     "client-us",
+			wantURLs:   []string{"https://maps.googleapis.com" + geocodePath + "?address=Route&key=client-us"},
+			wantTarget: upstreamPrimary,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &routedTransport{recordingTransport: recordingTransport{body: `{"results":[],"status":"OK"}`}, failingHost: "down.example.com"}
+			server, _, cleanup := setupTestServer(t, nil)
+			defer cleanup()
+			server.config.BaseURL = "https://maps.googleapis.com"
+			server.config.UpstreamRoutesFile = routesFile
+			server.upstream = newHTTPUpstream(&http.Client{Transport: transport}, server.config, server.clock, server.logger, prometheusSink{})
+			before := testutil.ToFloat64(upstreamRequestsTotal.WithLabelValues(tt.wantTarget, "200"))
+
+			req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Route", nil)
+			if tt.apiKey != "" {
+				req.Header.Set("X-Maps-API-Key", tt.apiKey)
+			}
+			if tt.referrer != "" {
+				req.Header.Set("Referer", tt.referrer)
+			}
+			w := httptest.NewRecorder()
+			server.query(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status 200, got %d", w.Code)
+			}
+			if strings.Join(transport.urls, "\n") != strings.Join(tt.wantURLs, "\n") {
+				t.Errorf("Expected upstream requests\n%s\ngot\n%s", strings.Join(tt.wantURLs, "\n"), strings.Join(transport.urls, "\n"))
+			}
+			if got := testutil.ToFloat64(upstreamRequestsTotal.WithLabelValues(tt.wantTarget, "200")) - before; got != 1 {
+				t.Errorf("Expected 1 request reported for target %s, got %v", tt.wantTarget, got)
+			}
+		})
+	}
+}
+
+func TestLoadUpstreamRoutes_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"no name":      `[{"api_keys": ["k"], "base_url": "https://eu.example.com"}]`,
+		"reserved":     `[{"name": "primary", "api_keys": ["k"], "base_url": "https://eu.example.com"}]`,
+		"no matcher":   `[{"name": "eu", "base_url": "https://eu.example.com"}]`,
+		"relative URL": `[{"name": "eu", "api_keys": ["k"], "base_url": "eu.example.com"}]`,
+		"duplicate":    `[{"name": "eu", "api_keys": ["k"], "base_url": "https://eu.example.com"}, {"name": "eu", "api_keys": ["j"], "base_url": "https://eu.example.com"}]`,
+		"bad proxy":    `[{"name": "eu", "api_keys": ["k"], "base_url": "https://eu.example.com", "proxy": "ftp://bastion"}]`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routes.json")
+			os.WriteFile(path, []byte(content), 0o600)
+			if _, err := loadUpstreamRoutes(path); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
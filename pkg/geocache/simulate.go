@@ -0,0 +1,278 @@
+package geocache
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// simulatedRequest is one proxied request read from a log.
+type simulatedRequest struct {
+	time time.Time
+	url  *url.URL
+}
+
+// simulationPolicy is a candidate cache configuration.
+type simulationPolicy struct {
+	name       string
+	ttl        time.Duration
+	normalizer *addressNormalizer
+	params     map[string][]string
+}
+
+// simulationResult is the projected outcome of replaying a log against a
+// policy.
+type simulationResult struct {
+	policy       string
+	requests     int
+	hits         int
+	entries      int
+	cost         float64
+	uncachedCost float64
+}
+
+func (r simulationResult) hitRate() float64 {
+	if r.requests == 0 {
+		return 0
+	}
+	return float64(r.hits) / float64(r.requests)
+}
+
+// parseLogLine extracts the request of one log line. It understands the
+// structured access log written with LOG_REQUEST_URI=true, HTTP load
+// balancer entries exported from Cloud Logging (httpRequest.requestUrl), and
+// plain lines holding an optional RFC 3339 timestamp followed by the request
+// URI. Lines without a proxied Maps API request are skipped.
+func parseLogLine(line string) (simulatedRequest, bool) {
+	var req simulatedRequest
+	var rawURI string
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Time        time.Time `json:"time"`
+			Timestamp   time.Time `json:"timestamp"`
+			URI         string    `json:"uri"`
+			HTTPRequest struct {
+				RequestURL string `json:"requestUrl"`
+			} `json:"httpRequest"`
+			JSONPayload struct {
+				URI string `json:"uri"`
+			} `json:"jsonPayload"`
+		}
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			return req, false
+		}
+		req.time = entry.Time
+		if req.time.IsZero() {
+			req.time = entry.Timestamp
+		}
+		for _, uri := range []string{entry.URI, entry.JSONPayload.URI, entry.HTTPRequest.RequestURL} {
+			if uri != "" {
+				rawURI = uri
+				break
+			}
+		}
+	} else {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return req, false
+		}
+		rawURI = fields[len(fields)-1]
+		if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+			req.time = t
+		}
+	}
+
+	u, err := url.Parse(rawURI)
+	if err != nil || !strings.HasPrefix(u.Path, "/maps/api/") || u.Path == batchGeocodePath {
+		return req, false
+	}
+	req.url = u
+	return req, true
+}
+
+// readRequestLog reads the requests of a log, returning them with the number
+// of lines skipped.
+func readRequestLog(r io.Reader) ([]simulatedRequest, int, error) {
+	var requests []simulatedRequest
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if req, ok := parseLogLine(scanner.Text()); ok {
+			requests = append(requests, req)
+		} else if strings.TrimSpace(scanner.Text()) != "" {
+			skipped++
+		}
+	}
+	return requests, skipped, scanner.Err()
+}
+
+// simulate replays requests in order against each policy, starting from an
+// empty cache. A request is a hit when its cache key was filled less than the
+// policy's TTL before; requests without a timestamp never see entries expire.
+// Misses are charged at Google's price, as in the usage export.
+func simulate(requests []simulatedRequest, policies []simulationPolicy, costs map[string]float64) []simulationResult {
+	results := make([]simulationResult, len(policies))
+	for i, p := range policies {
+		res := simulationResult{policy: p.name}
+		expires := make(map[string]time.Time)
+		for _, req := range requests {
+			cost := requestCost(costs, req.url)
+			res.requests++
+			res.uncachedCost += cost
+
+			key := canonicalQuery(req.url, p.normalizer, p.params)
+			expiry, cached := expires[key]
+			if cached && (p.ttl == 0 || req.time.Before(expiry)) {
+				res.hits++
+				continue
+			}
+			if !cached {
+				res.entries++
+			}
+			res.cost += cost
+			expires[key] = req.time.Add(p.ttl)
+		}
+		results[i] = res
+	}
+	return results
+}
+
+// simulationPolicies builds the cross product of TTLs and address
+// normalization modes ("off", "on" or "diacritics").
+func simulationPolicies(ttls, normalize string, abbreviations map[string]string) ([]simulationPolicy, error) {
+	var policies []simulationPolicy
+	for _, rawTTL := range parseList(ttls) {
+		ttl, err := time.ParseDuration(rawTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL %q: %w", rawTTL, err)
+		}
+		for _, mode := range parseList(normalize) {
+			var normalizer *addressNormalizer
+			switch mode {
+			case "off":
+			case "on":
+				normalizer = newAddressNormalizer(false, abbreviations)
+			case "diacritics":
+				normalizer = newAddressNormalizer(true, abbreviations)
+			default:
+				return nil, fmt.Errorf("invalid normalization mode %q, want off, on or diacritics", mode)
+			}
+			policies = append(policies, simulationPolicy{
+				name:       fmt.Sprintf("ttl=%s normalize=%s", rawTTL, mode),
+				ttl:        ttl,
+				normalizer: normalizer,
+			})
+		}
+	}
+	return policies, nil
+}
+
+// RunSimulation implements the "simulate" command: it replays the request
+// logs named in args (standard input when there are none) against candidate
+// TTL and address normalization policies and writes the projected hit rates
+// and Google costs to out. The current configuration provides the defaults.
+func RunSimulation(args []string, out io.Writer) error {
+	config := LoadConfig()
+	normalize := "off"
+	if config.NormalizeAddress {
+		normalize = "on"
+		if config.NormalizeStripDiacritics {
+			normalize = "diacritics"
+		}
+	}
+
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	ttls := flags.String("ttl", config.CacheTimeout.String(), "comma-separated cache TTLs to compare, 0 for no expiry")
+	modes := flags.String("normalize", normalize, "comma-separated address normalization modes to compare: off, on, diacritics")
+	abbreviationsFile := flags.String("abbreviations", config.AddressAbbreviationsFile, "address abbreviations file used for normalization")
+	pushgateway := flags.String("pushgateway", config.PushgatewayURL, "Pushgateway URL to push the results to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var abbreviations map[string]string
+	if *abbreviationsFile != "" {
+		table, err := loadAbbreviations(*abbreviationsFile)
+		if err != nil {
+			return err
+		}
+		abbreviations = table
+	}
+	policies, err := simulationPolicies(*ttls, *modes, abbreviations)
+	if err != nil {
+		return err
+	}
+	for i := range policies {
+		policies[i].params = parseKeyParams(config.CacheKeyParams)
+	}
+
+	var requests []simulatedRequest
+	skipped := 0
+	read := func(r io.Reader) error {
+		reqs, n, err := readRequestLog(r)
+		requests = append(requests, reqs...)
+		skipped += n
+		return err
+	}
+	if flags.NArg() == 0 {
+		if err := read(os.Stdin); err != nil {
+			return err
+		}
+	}
+	for _, path := range flags.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = read(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	results := simulate(requests, policies, usageCosts(config, NewLogger(false)))
+	if *pushgateway != "" {
+		if err := pushSimulationResults(*pushgateway, len(requests), skipped, results); err != nil {
+			return fmt.Errorf("pushing metrics: %w", err)
+		}
+	}
+	fmt.Fprintf(out, "Replayed %d requests (%d lines skipped)\n\n", len(requests), skipped)
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "POLICY\tHITS\tHIT RATE\tENTRIES\tCOST (USD)\tSAVED (USD)")
+	for _, res := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f%%\t%d\t%.2f\t%.2f\n",
+			res.policy, res.hits, 100*res.hitRate(), res.entries, res.cost, res.uncachedCost-res.cost)
+	}
+	return tw.Flush()
+}
+
+// pushSimulationResults pushes the results of a simulation to a Pushgateway
+// as the job geocache_simulate, so scheduled simulations appear in
+// dashboards.
+func pushSimulationResults(url string, replayed, skipped int, results []simulationResult) error {
+	m := newJobMetrics("geocache_simulate")
+	m.gaugeVec("simulation_requests", "Requests replayed by the simulation").WithLabelValues().Set(float64(replayed))
+	m.gaugeVec("simulation_skipped_lines", "Log lines without a Maps API request").WithLabelValues().Set(float64(skipped))
+	hitRate := m.gaugeVec("simulation_hit_rate", "Projected cache hit rate of a policy", "policy")
+	entries := m.gaugeVec("simulation_entries", "Projected number of cache entries of a policy", "policy")
+	cost := m.gaugeVec("simulation_cost_usd", "Projected Google cost of a policy, in USD", "policy")
+	saved := m.gaugeVec("simulation_saved_usd", "Projected savings of a policy over sending every request to Google, in USD", "policy")
+	for _, res := range results {
+		hitRate.WithLabelValues(res.policy).Set(res.hitRate())
+		entries.WithLabelValues(res.policy).Set(float64(res.entries))
+		cost.WithLabelValues(res.policy).Set(res.cost)
+		saved.WithLabelValues(res.policy).Set(res.uncachedCost - res.cost)
+	}
+	return m.push(url)
+}
@@ -0,0 +1,164 @@
+package geocache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantOK   bool
+		wantURI  string
+		wantTime string
+	}{
+		{
+			name:     "structured access log",
+			line:     `{"time":"2025-01-02T03:04:05Z","msg":"GET /maps/api/geocode/json","uri":"/maps/api/geocode/json?address=Main+St"}`,
+			wantOK:   true,
+			wantURI:  "/maps/api/geocode/json?address=Main+St",
+			wantTime: "2025-01-02T03:04:05Z",
+		},
+		{
+			name:     "load balancer entry",
+			line:     `{"timestamp":"2025-01-02T03:04:05Z","httpRequest":{"requestUrl":"https://maps.example.com/maps/api/directions/json?origin=a&destination=b"}}`,
+			wantOK:   true,
+			wantURI:  "/maps/api/directions/json?origin=a&destination=b",
+			wantTime: "2025-01-02T03:04:05Z",
+		},
+		{
+			name:     "plain line",
+			line:     "2025-01-02T03:04:05Z /maps/api/geocode/json?address=Elm",
+			wantOK:   true,
+			wantURI:  "/maps/api/geocode/json?address=Elm",
+			wantTime: "2025-01-02T03:04:05Z",
+		},
+		{
+			name:    "plain URI without time",
+			line:    "/maps/api/geocode/json?address=Elm",
+			wantOK:  true,
+			wantURI: "/maps/api/geocode/json?address=Elm",
+		},
+		{
+			name: "access log without URI",
+			line: `{"time":"2025-01-02T03:04:05Z","msg":"GET /maps/api/geocode/json"}`,
+		},
+		{
+			name: "other endpoint",
+			line: "/health",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, ok := parseLogLine(tt.line)
+			if ok != tt.wantOK {
+				t.Fatalf("Expected ok %v, got %v", tt.wantOK, ok)
+			}
+			if !ok {
+				return
+			}
+			if got := req.url.RequestURI(); got != tt.wantURI {
+				t.Errorf("Expected URI %s, got %s", tt.wantURI, got)
+			}
+			if tt.wantTime != "" && req.time.Format(time.RFC3339) != tt.wantTime {
+				t.Errorf("Expected time %s, got %s", tt.wantTime, req.time.Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	log := strings.Join([]string{
+		"2025-01-01T00:00:00Z /maps/api/geocode/json?address=1+Main+St&key=a",
+		"2025-01-01T01:00:00Z /maps/api/geocode/json?address=1+main+street&key=b",
+		"2025-01-01T03:00:00Z /maps/api/geocode/json?address=1+Main+St&key=a",
+		"2025-01-01T03:00:00Z /maps/api/distancematrix/json?origins=a|b&destinations=c",
+		"2025-01-01T04:00:00Z /maps/api/distancematrix/json?origins=a|b&destinations=c",
+		"not a request",
+	}, "\n")
+	requests, skipped, err := readRequestLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	if len(requests) != 5 || skipped != 1 {
+		t.Fatalf("Expected 5 requests and 1 skipped line, got %d and %d", len(requests), skipped)
+	}
+
+	policies, err := simulationPolicies("2h,0", "off,on", nil)
+	if err != nil {
+		t.Fatalf("Failed to build policies: %v", err)
+	}
+	results := simulate(requests, policies, defaultUsageCosts)
+
+	want := []struct {
+		policy  string
+		hits    int
+		entries int
+		cost    float64
+	}{
+		{"ttl=2h normalize=off", 1, 3, 0.025},
+		{"ttl=2h normalize=on", 2, 2, 0.02},
+		{"ttl=0 normalize=off", 2, 3, 0.02},
+		{"ttl=0 normalize=on", 3, 2, 0.015},
+	}
+	for i, w := range want {
+		res := results[i]
+		if res.policy != w.policy || res.hits != w.hits || res.entries != w.entries {
+			t.Errorf("Expected %s with %d hits and %d entries, got %s with %d and %d",
+				w.policy, w.hits, w.entries, res.policy, res.hits, res.entries)
+		}
+		if diff := res.cost - w.cost; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("%s: expected cost %.3f, got %.3f", w.policy, w.cost, res.cost)
+		}
+		if diff := res.uncachedCost - 0.035; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("%s: expected uncached cost 0.035, got %.3f", w.policy, res.uncachedCost)
+		}
+	}
+
+	if _, err := simulationPolicies("2h", "sometimes", nil); err == nil {
+		t.Errorf("Expected an invalid normalization mode to be rejected")
+	}
+}
+
+func TestRunSimulation_Pushgateway(t *testing.T) {
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(data)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	logFile := filepath.Join(t.TempDir(), "access.log")
+	log := "2025-01-01T00:00:00Z /maps/api/geocode/json?address=Main\n2025-01-01T01:00:00Z /maps/api/geocode/json?address=Main\n"
+	if err := os.WriteFile(logFile, []byte(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := RunSimulation([]string{"-ttl", "24h", "-normalize", "off", "-pushgateway", gateway.URL, logFile}, &out); err != nil {
+		t.Fatalf("RunSimulation failed: %v", err)
+	}
+	if method != http.MethodPut || path != "/metrics/job/geocache_simulate" {
+		t.Errorf("Expected a PUT to /metrics/job/geocache_simulate, got %s %s", method, path)
+	}
+	for _, metric := range []string{"simulation_requests", "simulation_hit_rate", "job_last_success_timestamp_seconds"} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("Expected %s to be pushed", metric)
+		}
+	}
+
+	gateway.Close()
+	if err := RunSimulation([]string{"-pushgateway", gateway.URL, logFile}, &out); err == nil {
+		t.Error("Expected an unreachable Pushgateway to fail the command")
+	}
+}
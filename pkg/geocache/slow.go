@@ -0,0 +1,99 @@
+package geocache
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// slowRequest is a proxied request that took SLOW_REQUEST_THRESHOLD_SECONDS
+// or more.
+type slowRequest struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Status      int       `json:"status"`
+	CacheStatus string    `json:"cache_status,omitempty"`
+	DurationMS  float64   `json:"duration_ms"`
+	// UpstreamMS is the time spent waiting for the upstream, for misses.
+	UpstreamMS float64 `json:"upstream_ms,omitempty"`
+	// Key is the obfuscated API key of the request.
+	Key       string `json:"key,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// slowRequests keeps the last SLOW_REQUESTS_MAX slow requests in a ring.
+type slowRequests struct {
+	mu       sync.Mutex
+	requests []slowRequest
+	// next is where the next request is written once the ring is full.
+	next int
+	size int
+}
+
+func newSlowRequests(size int) *slowRequests {
+	return &slowRequests{requests: make([]slowRequest, 0, size), size: size}
+}
+
+// record keeps req in place of the oldest slow request once full.
+func (s *slowRequests) record(req slowRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) < s.size {
+		s.requests = append(s.requests, req)
+		return
+	}
+	s.requests[s.next] = req
+	s.next = (s.next + 1) % s.size
+}
+
+// slowest returns up to n of the kept requests, slowest first.
+func (s *slowRequests) slowest(n int) []slowRequest {
+	s.mu.Lock()
+	out := slices.Clone(s.requests)
+	s.mu.Unlock()
+	slices.SortFunc(out, func(a, b slowRequest) int {
+		return cmp.Compare(b.DurationMS, a.DurationMS)
+	})
+	return out[:min(n, len(out))]
+}
+
+// observeSlow records r, served through csw in took, when it is slow.
+func (s *Server) observeSlow(r *http.Request, csw *cacheStatusResponseWriter, took time.Duration) {
+	if s.slow == nil || took < s.config.SlowRequestThreshold {
+		return
+	}
+	s.slow.record(slowRequest{
+		Time:        s.clock.Now().UTC(),
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Status:      csw.statusCode,
+		CacheStatus: csw.cacheStatus,
+		DurationMS:  durationMS(took),
+		UpstreamMS:  durationMS(csw.upstreamTime),
+		Key:         obfuscateAPIKey(extractAPIKey(r)),
+		RequestID:   csw.Header().Get("X-Request-ID"),
+	})
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// handleSlowRequests lists the slowest of the recent slow requests, n of
+// them (10 by default).
+func (s *Server) handleSlowRequests(w http.ResponseWriter, r *http.Request) {
+	n := 10
+	if v := r.URL.Query().Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "n must be a positive integer"})
+			return
+		}
+		n = parsed
+	}
+	writeJSON(w, http.StatusOK, s.slow.slowest(n))
+}
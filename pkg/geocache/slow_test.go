@@ -0,0 +1,76 @@
+package geocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlowRequests_Ring(t *testing.T) {
+	ring := newSlowRequests(3)
+	for _, ms := range []float64{5, 40, 10, 30, 20} {
+		ring.record(slowRequest{DurationMS: ms})
+	}
+	// 5 and 40 were replaced by the last two requests.
+	got := ring.slowest(10)
+	want := []float64{30, 20, 10}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d requests, got %+v", len(want), got)
+	}
+	for i, ms := range want {
+		if got[i].DurationMS != ms {
+			t.Errorf("Expected request %d to take %vms, got %vms", i, ms, got[i].DurationMS)
+		}
+	}
+	if got := ring.slowest(1); len(got) != 1 || got[0].DurationMS != 30 {
+		t.Errorf("Expected the slowest request only, got %+v", got)
+	}
+}
+
+func TestServer_SlowRequests(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: &slowTransport{delay: 50 * time.Millisecond}})
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	server.config.SlowRequestThreshold = 30 * time.Millisecond
+	server.slow = newSlowRequests(10)
+	handler := server.routes()
+
+	// The miss waits for the upstream, and the hit is not slow.
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main&key=AIzaSyExampleKey1234", nil)
+		req.Header.Set("X-Request-ID", "req-1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/slow?n=5", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var slow []slowRequest
+	if err := json.Unmarshal(w.Body.Bytes(), &slow); err != nil {
+		t.Fatalf("Failed to decode slow requests %d: %s", w.Code, w.Body.String())
+	}
+	if len(slow) != 1 {
+		t.Fatalf("Expected the miss only, got %+v", slow)
+	}
+	got := slow[0]
+	if got.Path != geocodePath || got.Status != http.StatusOK || got.CacheStatus != "MISS" || got.RequestID != "req-1" {
+		t.Errorf("Unexpected slow request %+v", got)
+	}
+	if got.Key != "AIza...1234" {
+		t.Errorf("Expected the obfuscated API key, got %q", got.Key)
+	}
+	if got.UpstreamMS < 50 || got.DurationMS < got.UpstreamMS {
+		t.Errorf("Expected at least 50ms upstream within the request duration, got %vms of %vms", got.UpstreamMS, got.DurationMS)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/slow?n=0", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for n=0, got %d", w.Code)
+	}
+}
@@ -0,0 +1,404 @@
+package geocache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotTimeFormat names snapshots so that they sort chronologically.
+const snapshotTimeFormat = "20060102T150405Z"
+
+// snapshotListTTL is how long the list of snapshots is reused before the
+// bucket is listed again.
+const snapshotListTTL = time.Minute
+
+const hexDigits = "0123456789abcdef"
+
+// snapshotShardCacheSize bounds the number of manifest shards kept in memory.
+const snapshotShardCacheSize = 64
+
+var (
+	errNoSnapshot      = errors.New("no snapshot")
+	errNotInSnapshot   = errors.New("entry not in snapshot")
+	errSnapshotRunning = errors.New("snapshot already running")
+)
+
+// snapshotManifest describes a complete snapshot. It is written last, so a
+// snapshot without one is ignored.
+type snapshotManifest struct {
+	Time      time.Time `json:"time"`
+	Entries   int       `json:"entries"`
+	NewBodies int       `json:"new_bodies"`
+	Shards    []string  `json:"shards"`
+}
+
+// snapshotStore keeps dated snapshots of the cache in Cloud Storage. Bodies
+// are stored once under bodies/<sha256>, shared by every snapshot holding
+// them. A snapshot is a manifest, snapshots/<time>.json, and the shards it
+// lists, snapshots/<time>/<xx>.json, each mapping the cache keys starting
+// with xx to the hashes of their bodies.
+type snapshotStore struct {
+	gcs  *gcsClient
+	path string
+
+	mu        sync.Mutex
+	listed    time.Time
+	times     []string
+	manifests map[string]snapshotManifest
+	shards    map[string]map[string]string
+}
+
+func newSnapshotStore(gcs *gcsClient, path string) *snapshotStore {
+	return &snapshotStore{
+		gcs:       gcs,
+		path:      path,
+		manifests: make(map[string]snapshotManifest),
+		shards:    make(map[string]map[string]string),
+	}
+}
+
+func (s *snapshotStore) manifestName(ts string) string {
+	return s.path + "snapshots/" + ts + ".json"
+}
+
+func (s *snapshotStore) shardName(ts, shard string) string {
+	return s.path + "snapshots/" + ts + "/" + shard + ".json"
+}
+
+func (s *snapshotStore) bodyName(hash string) string {
+	return s.path + "bodies/" + hash
+}
+
+// list returns the names of the complete snapshots in chronological order.
+func (s *snapshotStore) list(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	if time.Since(s.listed) < snapshotListTTL {
+		defer s.mu.Unlock()
+		return s.times, nil
+	}
+	s.mu.Unlock()
+
+	names, err := s.gcs.List(ctx, s.path+"snapshots/")
+	if err != nil {
+		return nil, err
+	}
+	var times []string
+	for _, name := range names {
+		ts := strings.TrimSuffix(strings.TrimPrefix(name, s.path+"snapshots/"), ".json")
+		if _, err := time.Parse(snapshotTimeFormat, ts); err == nil {
+			times = append(times, ts)
+		}
+	}
+	sort.Strings(times)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.times, s.listed = times, time.Now()
+	return times, nil
+}
+
+// latest returns the name of the last snapshot taken at or before t.
+func (s *snapshotStore) latest(ctx context.Context, t time.Time) (string, error) {
+	times, err := s.list(ctx)
+	if err != nil {
+		return "", err
+	}
+	limit := t.UTC().Format(snapshotTimeFormat)
+	i := sort.Search(len(times), func(i int) bool { return times[i] > limit })
+	if i == 0 {
+		return "", errNoSnapshot
+	}
+	return times[i-1], nil
+}
+
+func (s *snapshotStore) manifest(ctx context.Context, ts string) (snapshotManifest, error) {
+	s.mu.Lock()
+	m, ok := s.manifests[ts]
+	s.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+	data, err := s.gcs.Download(ctx, s.manifestName(ts))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("invalid snapshot manifest %s: %w", ts, err)
+	}
+	s.mu.Lock()
+	s.manifests[ts] = m
+	s.mu.Unlock()
+	return m, nil
+}
+
+// readShard downloads a shard of snapshot ts, empty when the snapshot has
+// no entries in it.
+func (s *snapshotStore) readShard(ctx context.Context, ts string, m snapshotManifest, shard string) (map[string]string, error) {
+	entries := make(map[string]string)
+	if i := sort.SearchStrings(m.Shards, shard); i == len(m.Shards) || m.Shards[i] != shard {
+		return entries, nil
+	}
+	data, err := s.gcs.Download(ctx, s.shardName(ts, shard))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid snapshot shard %s/%s: %w", ts, shard, err)
+	}
+	return entries, nil
+}
+
+// Lookup returns the body stored for the cache key name in the last snapshot
+// taken at or before asOf, and the time of that snapshot.
+func (s *snapshotStore) Lookup(ctx context.Context, name string, asOf time.Time) ([]byte, time.Time, error) {
+	ts, err := s.latest(ctx, asOf)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	taken, _ := time.Parse(snapshotTimeFormat, ts)
+	m, err := s.manifest(ctx, ts)
+	if err != nil {
+		return nil, taken, err
+	}
+
+	shard := name[:2]
+	s.mu.Lock()
+	entries, ok := s.shards[ts+"/"+shard]
+	s.mu.Unlock()
+	if !ok {
+		if entries, err = s.readShard(ctx, ts, m, shard); err != nil {
+			return nil, taken, err
+		}
+		s.mu.Lock()
+		if len(s.shards) >= snapshotShardCacheSize {
+			for key := range s.shards {
+				delete(s.shards, key)
+				break
+			}
+		}
+		s.shards[ts+"/"+shard] = entries
+		s.mu.Unlock()
+	}
+
+	hash, ok := entries[name]
+	if !ok {
+		return nil, taken, errNotInSnapshot
+	}
+	body, err := s.gcs.Download(ctx, s.bodyName(hash))
+	return body, taken, err
+}
+
+// isCacheEntryName reports whether name, a key without the Redis prefix, is
+// that of a cached response rather than an auxiliary key.
+func isCacheEntryName(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// writeSnapshot uploads the current cache as the snapshot taken at now. The
+// keyspace is scanned in 16 passes, one per leading hex digit, so that only
+// the matching shards of the previous snapshot, which tell the bodies already
+// uploaded, are held in memory at a time.
+func (s *Server) writeSnapshot(ctx context.Context, now time.Time) (snapshotManifest, error) {
+	snap := s.snapshots
+	manifest := snapshotManifest{Time: now.UTC().Truncate(time.Second)}
+	ts := manifest.Time.Format(snapshotTimeFormat)
+	previous, err := snap.latest(ctx, manifest.Time)
+	if err != nil && !errors.Is(err, errNoSnapshot) {
+		return manifest, err
+	}
+	var previousManifest snapshotManifest
+	if previous != "" {
+		if previousManifest, err = snap.manifest(ctx, previous); err != nil {
+			return manifest, err
+		}
+	}
+
+	for _, first := range hexDigits {
+		// Bodies shared by keys of different passes may be uploaded again,
+		// which rewrites the same object.
+		uploaded := make(map[string]bool)
+		shards := make(map[string]map[string]string)
+		for _, second := range hexDigits {
+			shard := string(first) + string(second)
+			shards[shard] = make(map[string]string)
+			if previous == "" {
+				continue
+			}
+			entries, err := snap.readShard(ctx, previous, previousManifest, shard)
+			if err != nil {
+				return manifest, err
+			}
+			for _, hash := range entries {
+				uploaded[hash] = true
+			}
+		}
+
+		var cursor uint64
+		for {
+			keys, next, err := s.redis.Scan(ctx, cursor, s.redisKey(string(first))+"*", 500).Result()
+			if err != nil {
+				return manifest, err
+			}
+			var names, entryKeys []string
+			for _, key := range keys {
+				name := strings.TrimPrefix(key, s.redisKey(""))
+				if isCacheEntryName(name) {
+					names = append(names, name)
+					entryKeys = append(entryKeys, key)
+				}
+			}
+			if len(entryKeys) > 0 {
+				values, err := s.store.Get(ctx, entryKeys...)
+				if err != nil {
+					return manifest, err
+				}
+				for i, raw := range values {
+					body, err := decodeEntry(raw)
+					if raw == nil || err != nil {
+						continue
+					}
+					sum := sha256.Sum256(body)
+					hash := hex.EncodeToString(sum[:])
+					if !uploaded[hash] {
+						if err := snap.gcs.Upload(ctx, snap.bodyName(hash), "application/octet-stream", body); err != nil {
+							return manifest, err
+						}
+						uploaded[hash] = true
+						manifest.NewBodies++
+					}
+					shards[names[i][:2]][names[i]] = hash
+					manifest.Entries++
+				}
+			}
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+
+		for shard, entries := range shards {
+			if len(entries) == 0 {
+				continue
+			}
+			data, _ := json.Marshal(entries)
+			if err := snap.gcs.Upload(ctx, snap.shardName(ts, shard), "application/json", data); err != nil {
+				return manifest, err
+			}
+			manifest.Shards = append(manifest.Shards, shard)
+		}
+	}
+
+	sort.Strings(manifest.Shards)
+	data, _ := json.Marshal(manifest)
+	if err := snap.gcs.Upload(ctx, snap.manifestName(ts), "application/json", data); err != nil {
+		return manifest, err
+	}
+	snap.mu.Lock()
+	snap.listed = time.Time{}
+	snap.mu.Unlock()
+	return manifest, nil
+}
+
+// snapshotOnce writes a snapshot unless another instance took one less than
+// an interval ago.
+func (s *Server) snapshotOnce(ctx context.Context, interval time.Duration) (snapshotManifest, error) {
+	acquired, err := s.redis.SetNX(ctx, s.redisKey("snapshot:lock"), s.instanceID, interval*9/10).Result()
+	if err != nil {
+		return snapshotManifest{}, err
+	} else if !acquired {
+		return snapshotManifest{}, errSnapshotRunning
+	}
+	return s.writeSnapshot(ctx, s.clock.Now())
+}
+
+// runSnapshots takes a snapshot every interval, on one of the instances
+// sharing the Redis instance.
+func (s *Server) runSnapshots(interval time.Duration) {
+	logger := s.logger.Component("snapshot")
+	for {
+		<-s.clock.After(interval)
+		s.health.wait("snapshot", healthRedis)
+		start := time.Now()
+		m, err := s.snapshotOnce(context.Background(), interval)
+		if errors.Is(err, errSnapshotRunning) {
+			continue
+		} else if err != nil {
+			logger.Log(LogError, "Failed to write cache snapshot: %v", err)
+			continue
+		}
+		logger.Log(LogInfo, "Wrote cache snapshot %s in %v: %d entries, %d new bodies",
+			m.Time.Format(snapshotTimeFormat), time.Since(start).Round(time.Second), m.Entries, m.NewBodies)
+	}
+}
+
+// snapshotReader authenticates a request for a snapshot read like an admin
+// request, requiring the snapshots:read scope.
+func (s *Server) snapshotReader(r *http.Request) (string, bool) {
+	config := s.liveConfig()
+	if len(config.AllowedAdminCIDRs) == 0 || !isIPAllowed(r.RemoteAddr, config.AllowedAdminCIDRs) {
+		return "", false
+	}
+	id, ok := authenticateAdmin(parseAdminTokens(config.AdminTokens), r)
+	if !ok || (id.token != nil && !id.token.allows(ScopeSnapshotRead)) {
+		return "", false
+	}
+	return id.actor, true
+}
+
+// serveSnapshot answers a request carrying X-Cache-As-Of from the last
+// snapshot taken at or before that time. It never goes upstream: entries
+// missing from the snapshot are answered with 404.
+func (s *Server) serveSnapshot(w http.ResponseWriter, r *http.Request, cacheKey, rawAsOf string) {
+	if csw, ok := w.(*cacheStatusResponseWriter); ok {
+		csw.cacheStatus = "SNAPSHOT"
+	}
+	actor, ok := s.snapshotReader(r)
+	if !ok {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "X-Cache-As-Of requires a token with scope " + ScopeSnapshotRead})
+		return
+	}
+	if s.snapshots == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "snapshots are not configured"})
+		return
+	}
+	asOf, err := time.Parse(time.RFC3339, rawAsOf)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "X-Cache-As-Of must be an RFC 3339 time"})
+		return
+	}
+	s.auditLog.Record(actor, AuditSnapshotRead, map[string]string{"uri": requestURIWithoutKey(r.URL), "as_of": rawAsOf})
+
+	body, taken, err := s.snapshots.Lookup(r.Context(), strings.TrimPrefix(cacheKey, s.redisKey("")), asOf)
+	if !taken.IsZero() {
+		w.Header().Set("X-Cache-Snapshot", taken.Format(time.RFC3339))
+	}
+	switch {
+	case errors.Is(err, errNoSnapshot):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no snapshot was taken before " + rawAsOf})
+		return
+	case errors.Is(err, errNotInSnapshot):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "the response was not cached at the time of the snapshot"})
+		return
+	case err != nil:
+		s.logger.LogContext(r.Context(), LogError, "Failed to read cache snapshot: %v", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to read the snapshot"})
+		return
+	}
+
+	w.Header().Set("X-Cache", "SNAPSHOT")
+	w.Header().Set("Content-Type", cachedContentType(r))
+	s.writeBody(w, r, s.simplifyBody(r, body, PolylineSimplifyResponse, false))
+}
@@ -0,0 +1,141 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCS serves the subset of the Cloud Storage JSON API used by gcsClient
+// from memory.
+type fakeGCS struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads int
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/bucket/o":
+		body, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Query().Get("name")] = body
+		f.uploads++
+	case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/bucket/o":
+		prefix := r.URL.Query().Get("prefix")
+		type item struct {
+			Name string `json:"name"`
+		}
+		var items []item
+		for name := range f.objects {
+			if rest, ok := strings.CutPrefix(name, prefix); ok && !strings.Contains(rest, "/") {
+				items = append(items, item{name})
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+		body, ok := f.objects[strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[{"place_id":"v1"}],"status":"OK"}`}
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	server.config.AdminTokens = map[string]string{"audit:secret": ScopeSnapshotRead, "ops:other": ScopeStatsRead}
+
+	gcs := &fakeGCS{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(gcs)
+	defer ts.Close()
+	server.snapshots = newSnapshotStore(&gcsClient{
+		client:  ts.Client(),
+		baseURL: ts.URL,
+		bucket:  "bucket",
+		token:   func(context.Context) (string, error) { return "token", nil },
+	}, "geocache/")
+
+	ctx := context.Background()
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil)
+	monday := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	v1 := transport.body
+	server.query(httptest.NewRecorder(), req)
+	m, err := server.writeSnapshot(ctx, monday)
+	if err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+	if m.Entries != 1 || m.NewBodies != 1 {
+		t.Errorf("Expected 1 entry and 1 new body, got %+v", m)
+	}
+
+	// The entry changes before the next snapshot, then stays the same.
+	transport.body = `{"results":[{"place_id":"v2"}],"status":"OK"}`
+	server.store.Delete(ctx, server.cacheKey(req))
+	server.query(httptest.NewRecorder(), req)
+	if m, err = server.writeSnapshot(ctx, monday.Add(24*time.Hour)); err != nil || m.NewBodies != 1 {
+		t.Errorf("Expected the changed body to be uploaded, got %+v (%v)", m, err)
+	}
+	if m, err = server.writeSnapshot(ctx, monday.Add(48*time.Hour)); err != nil || m.Entries != 1 || m.NewBodies != 0 {
+		t.Errorf("Expected no new bodies for an unchanged cache, got %+v (%v)", m, err)
+	}
+	upstreamCalls := len(transport.urls)
+
+	tests := []struct {
+		name         string
+		address      string
+		asOf         string
+		token        string
+		wantStatus   int
+		wantBody     string
+		wantSnapshot string
+	}{
+		{name: "first snapshot", address: "Main", asOf: "2026-10-12T17:00:00Z", token: "secret", wantStatus: http.StatusOK, wantBody: v1, wantSnapshot: "2026-10-12T00:00:00Z"},
+		{name: "second snapshot", address: "Main", asOf: "2026-10-13T17:00:00+02:00", token: "secret", wantStatus: http.StatusOK, wantBody: transport.body, wantSnapshot: "2026-10-13T00:00:00Z"},
+		{name: "before the first snapshot", address: "Main", asOf: "2026-10-11T00:00:00Z", token: "secret", wantStatus: http.StatusNotFound},
+		{name: "not cached", address: "Elm", asOf: "2026-10-12T17:00:00Z", token: "secret", wantStatus: http.StatusNotFound, wantSnapshot: "2026-10-12T00:00:00Z"},
+		{name: "invalid time", address: "Main", asOf: "last tuesday", token: "secret", wantStatus: http.StatusBadRequest},
+		{name: "without token", address: "Main", asOf: "2026-10-12T17:00:00Z", wantStatus: http.StatusForbidden},
+		{name: "token without scope", address: "Main", asOf: "2026-10-12T17:00:00Z", token: "other", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, geocodePath+"?address="+tt.address, nil)
+			r.Header.Set("X-Cache-As-Of", tt.asOf)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			server.query(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("Expected body %s, got %s", tt.wantBody, w.Body.String())
+			}
+			if got := w.Header().Get("X-Cache-Snapshot"); got != tt.wantSnapshot {
+				t.Errorf("Expected X-Cache-Snapshot %q, got %q", tt.wantSnapshot, got)
+			}
+		})
+	}
+	if len(transport.urls) != upstreamCalls {
+		t.Errorf("Expected snapshot reads never to go upstream")
+	}
+}
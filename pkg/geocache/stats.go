@@ -0,0 +1,237 @@
+package geocache
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds of the breakdowns of /admin/stats.
+const (
+	statsTopEndpoints   = 10
+	statsRecentErrors   = 20
+	statsRedisPingLimit = 2 * time.Second
+)
+
+// recentError is a proxied request answered with a 5xx status.
+type recentError struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// endpointCounts are the request counters of an endpoint.
+type endpointCounts struct {
+	Endpoint string `json:"endpoint"`
+	requestCounts
+}
+
+// requestStats counts proxied requests by how they were served.
+type requestStats struct {
+	startedAt time.Time
+	total     atomic.Int64
+	hits      atomic.Int64
+	misses    atomic.Int64
+	overrides atomic.Int64
+	// costMicros is the estimated Google cost of the misses, in millionths
+	// of a USD.
+	costMicros atomic.Int64
+
+	mu        sync.Mutex
+	endpoints map[string]*requestCounts
+	// errors holds the last statsRecentErrors server errors, oldest first.
+	errors []recentError
+}
+
+// observe counts a request to endpoint, and remembers it when it failed.
+func (s *requestStats) observe(endpoint, cacheStatus string, failed *recentError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.endpoints == nil {
+		s.endpoints = make(map[string]*requestCounts)
+	}
+	c := s.endpoints[endpoint]
+	if c == nil {
+		c = &requestCounts{}
+		s.endpoints[endpoint] = c
+	}
+	c.Total++
+	switch cacheStatus {
+	case "HIT", "NEGATIVE", "COALESCED":
+		c.Hit++
+	case "MISS":
+		c.Miss++
+	case "OVERRIDE":
+		c.Override++
+	}
+	if failed != nil {
+		if len(s.errors) == statsRecentErrors {
+			s.errors = slices.Delete(s.errors, 0, 1)
+		}
+		s.errors = append(s.errors, *failed)
+	}
+}
+
+// topEndpoints returns the n endpoints with the most requests.
+func (s *requestStats) topEndpoints(n int) []endpointCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	top := make([]endpointCounts, 0, len(s.endpoints))
+	for endpoint, c := range s.endpoints {
+		top = append(top, endpointCounts{Endpoint: endpoint, requestCounts: *c})
+	}
+	slices.SortFunc(top, func(a, b endpointCounts) int {
+		return cmp.Or(cmp.Compare(b.Total, a.Total), strings.Compare(a.Endpoint, b.Endpoint))
+	})
+	return top[:min(n, len(top))]
+}
+
+// recentErrors returns the last server errors, most recent first.
+func (s *requestStats) recentErrors() []recentError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recent := make([]recentError, len(s.errors))
+	for i, e := range s.errors {
+		recent[len(recent)-1-i] = e
+	}
+	return recent
+}
+
+func (s *requestStats) counts() requestCounts {
+	return requestCounts{
+		Total:    s.total.Load(),
+		Hit:      s.hits.Load(),
+		Miss:     s.misses.Load(),
+		Override: s.overrides.Load(),
+	}
+}
+
+// cacheLabel returns the metric label of a cache status.
+func cacheLabel(cacheStatus string) string {
+	if cacheStatus == "" {
+		return "none"
+	}
+	return strings.ToLower(cacheStatus)
+}
+
+// usageMiddleware counts proxied requests, records their response sizes and
+// feeds them to the anomaly detector once they have been served.
+func (s *Server) usageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		cacheStatus := ""
+		var failed *recentError
+		if csw, ok := w.(*cacheStatusResponseWriter); ok {
+			cacheStatus = csw.cacheStatus
+			s.metrics.ObserveClientBytes(metricsEndpoint(r.URL.Path), cacheLabel(cacheStatus), csw.bytes)
+			if csw.statusCode >= http.StatusInternalServerError {
+				failed = &recentError{
+					Time:      s.clock.Now().UTC(),
+					Method:    r.Method,
+					Path:      r.URL.Path,
+					Status:    csw.statusCode,
+					RequestID: w.Header().Get("X-Request-ID"),
+				}
+			}
+		}
+		if s.config.BusinessUnitHeader != "" || s.config.BusinessUnitParam != "" {
+			unit := businessUnitFromContext(r.Context())
+			if unit == "" {
+				unit = "none"
+			}
+			businessUnitRequestsTotal.WithLabelValues(unit, metricsEndpoint(r.URL.Path), cacheLabel(cacheStatus)).Inc()
+		}
+		s.stats.total.Add(1)
+		switch cacheStatus {
+		case "HIT", "NEGATIVE", "COALESCED":
+			s.stats.hits.Add(1)
+		case "MISS":
+			s.stats.misses.Add(1)
+			s.stats.costMicros.Add(int64(requestCost(s.costs, r.URL) * 1e6))
+		case "OVERRIDE":
+			s.stats.overrides.Add(1)
+		}
+		s.stats.observe(metricsEndpoint(r.URL.Path), cacheStatus, failed)
+
+		if s.usage != nil {
+			s.usage.Record(r, cacheStatus)
+		}
+		if s.usageTally != nil {
+			s.usageTally.observe(r, cacheStatus)
+		}
+		if s.anomalies != nil {
+			s.anomalies.observe(obfuscateAPIKey(extractAPIKey(r)), requestReferrer(r), r.URL.Path, cacheStatus == "MISS")
+		}
+	})
+}
+
+// redisStatus is the outcome of a ping of Redis.
+type redisStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func (s *Server) pingRedis(ctx context.Context) redisStatus {
+	if s.redis == nil {
+		return redisStatus{Status: "disabled"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, statsRedisPingLimit)
+	defer cancel()
+	start := time.Now()
+	if err := s.redis.Ping(ctx).Err(); err != nil {
+		return redisStatus{Status: "error", Error: err.Error()}
+	}
+	return redisStatus{Status: "ok", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+}
+
+// handleStats reports request counters since startup, by endpoint, the last
+// server errors, the status of Redis and recent usage anomalies.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	anomalies := []Anomaly{}
+	if s.anomalies != nil {
+		anomalies = s.anomalies.recentAnomalies()
+	}
+	counts := s.stats.counts()
+	stats := map[string]interface{}{
+		"instance":          s.instanceID,
+		"started_at":        s.stats.startedAt,
+		"requests":          counts,
+		"hit_rate":          counts.hitRate(),
+		"endpoints":         s.stats.topEndpoints(statsTopEndpoints),
+		"recent_errors":     s.stats.recentErrors(),
+		"redis":             s.pingRedis(r.Context()),
+		"anomaly_detection": s.anomalies != nil,
+		"anomalies":         anomalies,
+		"health":            s.health.report(),
+	}
+	if s.keyCandidate != nil {
+		stats["cache_key_candidate"] = s.keyCandidate.report()
+	}
+
+	if s.redis != nil {
+		instances, err := s.listInstances(r.Context())
+		if err != nil {
+			s.logger.LogContext(r.Context(), LogWarning, "Failed to read instance registry: %v", err)
+		} else {
+			var fleet requestCounts
+			for _, inst := range instances {
+				fleet.add(inst.Requests)
+			}
+			stats["fleet"] = map[string]interface{}{
+				"instances": instances,
+				"requests":  fleet,
+				"hit_rate":  fleet.hitRate(),
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
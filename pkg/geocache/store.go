@@ -0,0 +1,99 @@
+package geocache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CacheStore persists cached responses.
+type CacheStore interface {
+	// Get returns the values stored under keys, with nil for missing keys.
+	Get(ctx context.Context, keys ...string) ([][]byte, error)
+	// Set stores value under key for ttl. A zero ttl never expires.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Swap stores value under key for ttl and returns the value it replaced,
+	// or nil if there was none.
+	Swap(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error)
+	// Delete removes keys and returns how many existed.
+	Delete(ctx context.Context, keys ...string) (int64, error)
+}
+
+// redisStore is the CacheStore backed by a Redis client. With content
+// addressing, entries point to blobs keyed by the hash of their body, so
+// identical bodies are stored once. Pointers are resolved either way, so
+// content addressing can be turned off without invalidating the cache.
+// With hash entries, entries are stored as hashes holding their metadata
+// beside the body, and entries stored either way are read; content
+// addressing takes precedence when both are enabled.
+type redisStore struct {
+	client           *redis.Client
+	contentAddressed bool
+	hashEntries      bool
+	blobPrefix       string
+}
+
+func newRedisStore(client *redis.Client, prefix string, contentAddressed bool) *redisStore {
+	blobPrefix := "blob:"
+	if prefix != "" {
+		blobPrefix = prefix + ":blob:"
+	}
+	return &redisStore{client: client, contentAddressed: contentAddressed, blobPrefix: blobPrefix}
+}
+
+func (s *redisStore) Get(ctx context.Context, keys ...string) ([][]byte, error) {
+	if s.hashEntries {
+		out, err := s.hashGet(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		return out, s.resolve(ctx, out)
+	}
+	// MGET reads hash entries as missing.
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, len(values))
+	for i, v := range values {
+		if str, ok := v.(string); ok {
+			out[i] = []byte(str)
+		}
+	}
+	return out, s.resolve(ctx, out)
+}
+
+func (s *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if s.contentAddressed {
+		_, err := s.casSet(ctx, key, value, ttl)
+		return err
+	} else if s.hashEntries {
+		_, err := s.hashSet(ctx, key, value, ttl)
+		return err
+	}
+	return s.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *redisStore) Swap(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	if s.contentAddressed {
+		return s.casSet(ctx, key, value, ttl)
+	} else if s.hashEntries {
+		return s.hashSet(ctx, key, value, ttl)
+	}
+	previous, err := s.client.SetArgs(ctx, key, value, redis.SetArgs{TTL: ttl, Get: true}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []byte(previous), nil
+}
+
+func (s *redisStore) Delete(ctx context.Context, keys ...string) (int64, error) {
+	if s.contentAddressed {
+		return s.casDelete(ctx, keys)
+	}
+	return s.client.Del(ctx, keys...).Result()
+}
@@ -0,0 +1,136 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// parseEndpointTimeouts parses Config.EndpointTimeouts, endpoint path to
+// seconds, where 0 disables the deadline of the endpoint. Invalid values are
+// ignored.
+func parseEndpointTimeouts(raw map[string]string) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration, len(raw))
+	for path, v := range raw {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil || seconds < 0 {
+			continue
+		}
+		timeouts[path] = time.Duration(seconds * float64(time.Second))
+	}
+	return timeouts
+}
+
+// requestTimeout returns the deadline of the requests to path: that of its
+// endpoint, or of its JSON variant, in ENDPOINT_TIMEOUTS, otherwise
+// REQUEST_TIMEOUT_SECONDS. 0 means none.
+func (s *Server) requestTimeout(path string) time.Duration {
+	if d, ok := s.endpointTimeouts[jsonVariant(path)]; ok {
+		return d
+	}
+	return s.config.RequestTimeout
+}
+
+// timeoutWriter buffers the response of a handler run under a deadline, so
+// that it can be discarded for the timeout response once the deadline has
+// passed.
+type timeoutWriter struct {
+	header http.Header
+
+	mu          sync.Mutex
+	buf         bytes.Buffer
+	code        int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.code, tw.wroteHeader = code, true
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.code, tw.wroteHeader = http.StatusOK, true
+	}
+	return tw.buf.Write(b)
+}
+
+// timeoutMiddleware answers 504 with a JSON error to the requests still
+// running at the deadline of their endpoint, like http.TimeoutHandler. The
+// deadline is also set on the request context, so that upstream requests
+// and waits for concurrent misses are abandoned. Responses are buffered
+// until the handler returns.
+func (s *Server) timeoutMiddleware(next http.Handler) http.Handler {
+	if s.config.RequestTimeout <= 0 && len(s.endpointTimeouts) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.requestTimeout(r.URL.Path)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, r)
+			close(done)
+		}()
+		select {
+		case p := <-panicked:
+			// Re-raised here for recoveryMiddleware.
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			for k, v := range tw.header {
+				w.Header()[k] = v
+			}
+			if !tw.wroteHeader {
+				tw.code = http.StatusOK
+			}
+			w.WriteHeader(tw.code)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// The client went away; nobody reads the response.
+				return
+			}
+			requestTimeoutsTotal.WithLabelValues(metricsEndpoint(r.URL.Path)).Inc()
+			s.logger.LogContext(r.Context(), LogWarning, "Request to %s exceeded its deadline of %v", r.URL.Path, timeout)
+			writeJSON(w, http.StatusGatewayTimeout, map[string]string{"error": fmt.Sprintf("request deadline of %v exceeded", timeout)})
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package geocache
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowTransport answers after delay, or fails when the request is cancelled
+// first.
+type slowTransport struct {
+	delay time.Duration
+}
+
+func (m *slowTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case <-time.After(m.delay):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"results":[],"status":"OK"}`)),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+	}, nil
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.RequestTimeout = 50 * time.Millisecond
+	server.endpointTimeouts = parseEndpointTimeouts(map[string]string{directionsPath: "0", "/maps/api/timezone/json": "0.5", "/maps/api/place/details/json": "x"})
+	server.upstream = newHTTPUpstream(&http.Client{Transport: &slowTransport{delay: 200 * time.Millisecond}}, server.config, server.clock, server.logger, prometheusSink{})
+	handler := server.routes()
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{geocodePath + "?address=slow", http.StatusGatewayTimeout},
+		{"/maps/api/place/details/json?place_id=slow", http.StatusGatewayTimeout},
+		{directionsPath + "?origin=a&destination=b", http.StatusOK},
+		{"/maps/api/timezone/json?location=1,2&timestamp=0", http.StatusOK},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		elapsed := time.Since(start)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.path, w.Code, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusGatewayTimeout {
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || !strings.Contains(body["error"], "deadline") {
+				t.Errorf("%s: body %q, want a JSON deadline error", tt.path, w.Body.String())
+			}
+			if elapsed > 150*time.Millisecond {
+				t.Errorf("%s: answered after %v, want about the 50ms deadline", tt.path, elapsed)
+			}
+		}
+	}
+}
+
+func TestTimeoutMiddlewareBuffersResponse(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.RequestTimeout = time.Second
+	handler := server.timeoutMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("request context has no deadline")
+		}
+		w.Header().Set("X-Cache", "HIT")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, geocodePath, nil))
+	if w.Code != http.StatusTeapot || w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "short and stout" {
+		t.Errorf("got %d %v %q, want the handler's response", w.Code, w.Header(), w.Body.String())
+	}
+
+	panicking := server.timeoutMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	defer func() {
+		if rec := recover(); rec != "boom" {
+			t.Errorf("recovered %v, want the handler's panic", rec)
+		}
+	}()
+	panicking.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, geocodePath, nil))
+}
@@ -0,0 +1,71 @@
+package geocache
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"sync"
+)
+
+// CertReloader serves a TLS certificate loaded from disk and reloads it when
+// the certificate or key file changes, so renewed certificates are picked
+// up without a restart.
+type CertReloader struct {
+	certFile, keyFile string
+	logger            *Logger
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertReloader loads the key pair and starts watching its files.
+func NewCertReloader(certFile, keyFile string, logger *Logger) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile, logger: logger.Component("tls")}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if err := watchDirs(fileDirs(certFile, keyFile), c.logger, c.reload); err != nil {
+		c.logger.Log(LogWarning, "Certificate reloading disabled: %v", err)
+	}
+	return c, nil
+}
+
+func (c *CertReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// reload keeps the current certificate when the new files do not form a
+// valid pair, as while only one of them has been replaced.
+func (c *CertReloader) reload() {
+	if err := c.load(); err != nil {
+		c.logger.Log(LogWarning, "Keeping current certificate, failed to reload %s: %v", c.certFile, err)
+		return
+	}
+	c.logger.Log(LogInfo, "Reloaded certificate %s", c.certFile)
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// fileDirs returns the distinct directories of files.
+func fileDirs(files ...string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, f := range files {
+		if dir := filepath.Dir(f); !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,24 @@
+package geocache
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// adminUIPath serves the operator page with ADMIN_UI.
+const adminUIPath = "/admin/ui"
+
+// adminUIPage is a single page showing /admin/stats and running admin
+// actions. It holds no data of its own: the operator enters an admin token,
+// which the page sends to the admin API, so it is served without one.
+//
+//go:embed ui/index.html
+var adminUIPage []byte
+
+func (s *Server) handleAdminUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(adminUIPage)
+}
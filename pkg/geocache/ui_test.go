@@ -0,0 +1,87 @@
+package geocache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler_UI(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	server.config.AdminTokens = map[string]string{"ops:ops-secret": ScopeAll}
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		remoteAddr string
+		wantStatus int
+	}{
+		{name: "served without a token", enabled: true, remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusOK},
+		{name: "outside allowed CIDRs", enabled: true, remoteAddr: "198.51.100.1:1234", wantStatus: http.StatusForbidden},
+		{name: "disabled", enabled: false, remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.config.AdminUI = tt.enabled
+			req := httptest.NewRequest(http.MethodGet, adminUIPath, nil)
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			server.adminHandler().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantStatus == http.StatusOK && (!strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "/admin/stats")) {
+				t.Errorf("Expected the embedded page, got %s %q", w.Header().Get("Content-Type"), w.Body.String())
+			}
+		})
+	}
+}
+
+func TestStats_EndpointsAndRecentErrors(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+
+	handler := server.usageMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.(*cacheStatusResponseWriter).cacheStatus = "HIT"
+	}))
+	for _, path := range []string{geocodePath + "?address=a", geocodePath + "?address=b", directionsPath + "?fail=1"} {
+		w := newCacheStatusResponseWriter(httptest.NewRecorder())
+		w.Header().Set("X-Request-ID", "req-"+path[len(path)-1:])
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(w, req)
+
+	var stats struct {
+		HitRate      float64          `json:"hit_rate"`
+		Endpoints    []endpointCounts `json:"endpoints"`
+		RecentErrors []recentError    `json:"recent_errors"`
+		Redis        redisStatus      `json:"redis"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if len(stats.Endpoints) != 2 || stats.Endpoints[0].Endpoint != "geocode" || stats.Endpoints[0].Total != 2 || stats.Endpoints[0].Hit != 2 {
+		t.Errorf("Expected geocode first with 2 hits, got %+v", stats.Endpoints)
+	}
+	if len(stats.RecentErrors) != 1 || stats.RecentErrors[0].Status != http.StatusBadGateway || stats.RecentErrors[0].Path != directionsPath || stats.RecentErrors[0].RequestID != "req-1" {
+		t.Errorf("Expected the directions failure, got %+v", stats.RecentErrors)
+	}
+	if stats.Redis.Status != "ok" {
+		t.Errorf("Expected Redis to be reported ok, got %+v", stats.Redis)
+	}
+}
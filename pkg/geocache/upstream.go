@@ -0,0 +1,337 @@
+package geocache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	upstreamPrimary = "primary"
+	upstreamCanary  = "canary"
+)
+
+var errReadBody = errors.New("failed to read upstream response body")
+
+// Upstream fetches responses for cache misses.
+type Upstream interface {
+	Fetch(r *http.Request) (*UpstreamResponse, error)
+}
+
+// UpstreamResponse is a fully read upstream response.
+type UpstreamResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Target identifies which upstream served the response, e.g. "primary"
+	// or "canary".
+	Target string
+	// Host is the host that answered, after any redirects followed; empty
+	// when the response was not received from upstream.
+	Host string
+	// Redirected is set when the response was reached by following
+	// redirects.
+	Redirected bool
+	// Streamed is set when the upstream sent the body without announcing
+	// its length, so a truncated body cannot be told from a complete one.
+	Streamed bool
+}
+
+// matchHeader reports whether the header name is one of patterns, which are
+// header names or prefixes ending with "*", compared case-insensitively.
+func matchHeader(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if prefix, ok := strings.CutSuffix(p, "*"); (ok && strings.HasPrefix(name, prefix)) || p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// keyHeaders returns the headers of header matching patterns, which identify
+// the response along with the query, as sorted "name: value" lines.
+func keyHeaders(header http.Header, patterns []string) string {
+	var lines []string
+	for name, values := range header {
+		if matchHeader(name, patterns) {
+			lines = append(lines, strings.ToLower(name)+": "+strings.Join(values, ","))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// setUpstreamHeaders tells the client which upstream answered, in
+// X-Upstream-Provider and, when known, X-Upstream-Host.
+func setUpstreamHeaders(w http.ResponseWriter, resp *UpstreamResponse) {
+	if resp.Target != "" {
+		w.Header().Set("X-Upstream-Provider", resp.Target)
+	}
+	if resp.Host != "" {
+		w.Header().Set("X-Upstream-Host", resp.Host)
+	}
+}
+
+// httpUpstream forwards requests to the Google Maps API over HTTP.
+type httpUpstream struct {
+	client  *http.Client
+	config  Config
+	logger  *Logger
+	metrics MetricsSink
+	// signingKey is the decoded URLSigningSecret; nil when requests are not
+	// signed.
+	signingKey []byte
+	routes     []upstreamRoute
+	// routeClients are the clients of the routes with their own proxy.
+	routeClients map[string]*http.Client
+	// quota is nil unless QUOTA_CIRCUIT is set.
+	quota *quotaCircuit
+	clock Clock
+}
+
+func newHTTPUpstream(client *http.Client, config Config, clock Clock, logger *Logger, metrics MetricsSink) *httpUpstream {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u := &httpUpstream{client: withRedirectPolicy(client, config), config: config, logger: logger.Component("upstream"), metrics: metrics, clock: clock}
+	if config.URLSigningSecret != "" {
+		key, err := base64.URLEncoding.DecodeString(config.URLSigningSecret)
+		if err != nil {
+			u.logger.Log(LogError, "URL signing disabled, URL_SIGNING_SECRET is not URL-safe base64: %v", err)
+		} else {
+			u.signingKey = key
+		}
+	}
+	if config.QuotaCircuit {
+		u.quota = newQuotaCircuit(clock)
+	}
+	if config.UpstreamRoutesFile != "" {
+		routes, err := loadUpstreamRoutes(config.UpstreamRoutesFile)
+		if err != nil {
+			u.logger.Log(LogError, "Upstream routing disabled: %v", err)
+		}
+		u.routes = routes
+		for _, route := range routes {
+			if route.Proxy != "" {
+				routeConfig := config
+				routeConfig.UpstreamProxy = route.Proxy
+				if u.routeClients == nil {
+					u.routeClients = make(map[string]*http.Client)
+				}
+				u.routeClients[route.Name] = withRedirectPolicy(newUpstreamClient(routeConfig, logger), config)
+			}
+		}
+	}
+	return u
+}
+
+// signRequestURI signs uri for the Maps web services with key, the decoded
+// signing secret: the signature parameter is the URL-safe base64 HMAC-SHA1
+// of the path and query. A signature sent by the client is replaced. With a
+// client ID, the request is authenticated by the client parameter instead
+// of an API key.
+func signRequestURI(uri, clientID string, key []byte) (string, error) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Del("signature")
+	if clientID != "" {
+		q.Del("key")
+		q.Set("client", clientID)
+	}
+	unsigned := u.Path + "?" + q.Encode()
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(unsigned))
+	return unsigned + "&signature=" + base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// target picks the base URL for a cache miss. When a canary base URL is
+// configured, CanaryPercent of misses are sent there instead of BaseURL.
+func (u *httpUpstream) target() (string, string) {
+	if u.config.CanaryBaseURL != "" && u.config.CanaryPercent > 0 && rand.Float64()*100 < u.config.CanaryPercent {
+		return u.config.CanaryBaseURL, upstreamCanary
+	}
+	return u.config.BaseURL, upstreamPrimary
+}
+
+// upstreamUserAgent returns the default User-Agent of upstream requests,
+// naming contact, such as a URL or an email address, when it is set.
+func upstreamUserAgent(contact string) string {
+	if contact == "" {
+		return "geocache/" + apiConfig.Version
+	}
+	return fmt.Sprintf("geocache/%s (+%s)", apiConfig.Version, contact)
+}
+
+// Fetch forwards r to the upstream API, adding the API key from the
+// X-Maps-API-Key header when the query does not carry one. Requests matching
+// an upstream route go to the route's base URL, and to its fallback when
+// that fails. With QUOTA_CIRCUIT set, requests with an API key whose quota
+// was exceeded are answered with an OVER_QUERY_LIMIT until its retry delay
+// has passed, or wait for it when it is within QUOTA_CIRCUIT_MAX_WAIT.
+func (u *httpUpstream) Fetch(r *http.Request) (*UpstreamResponse, error) {
+	googleMapsAPIKey := r.Header.Get("X-Maps-API-Key")
+	ruri := r.URL.RequestURI()
+
+	if googleMapsAPIKey != "" && !strings.Contains(ruri, "key=") {
+		ruri += "&key=" + googleMapsAPIKey
+	}
+
+	if u.config.UpstreamAPIKey != "" {
+		keyed, err := withAPIKey(ruri, u.config.UpstreamAPIKey)
+		if err != nil {
+			return nil, err
+		}
+		ruri = keyed
+	}
+
+	baseURL, target := u.target()
+	client := u.client
+	route := matchRoute(u.routes, r)
+	if rl := ruleFromContext(r.Context()); rl != nil && rl.Action.Route != "" {
+		route = findRoute(u.routes, rl.Action.Route)
+	}
+	if route != nil {
+		baseURL, target = route.BaseURL, route.Name
+		if routeClient, ok := u.routeClients[route.Name]; ok {
+			client = routeClient
+		}
+		if route.UpstreamAPIKey != "" {
+			keyed, err := withAPIKey(ruri, route.UpstreamAPIKey)
+			if err != nil {
+				return nil, err
+			}
+			ruri = keyed
+		}
+	}
+	if u.signingKey != nil {
+		signed, err := signRequestURI(ruri, u.config.URLSigningClientID, u.signingKey)
+		if err != nil {
+			return nil, err
+		}
+		ruri = signed
+	}
+
+	if u.config.VerboseLogging {
+		headers := make(map[string]string)
+		for k, v := range r.Header {
+			headers[k] = strings.Join(v, ",")
+		}
+		u.logger.LogContext(r.Context(), LogInfo, "Proxying request to backend: target=%s uri=%s headers=%v", target, baseURL+ruri, headers)
+	}
+
+	var quotaKey string
+	if u.quota != nil {
+		quotaKey = circuitKey(target, ruri)
+		if d := u.quota.remaining(quotaKey); d > 0 {
+			if d > u.config.QuotaCircuitMaxWait {
+				return circuitResponse(d, target), nil
+			}
+			select {
+			case <-u.clock.After(d):
+				quotaCircuitRequestsTotal.WithLabelValues("waited").Inc()
+			case <-r.Context().Done():
+				return nil, r.Context().Err()
+			}
+		}
+	}
+
+	resp, err := u.fetch(r, client, baseURL+ruri, target)
+	if route != nil && route.FallbackBaseURL != "" && r.Context().Err() == nil && (err != nil || resp.StatusCode >= 500) {
+		upstreamRouteFallbacksTotal.WithLabelValues(route.Name).Inc()
+		u.logger.LogContext(r.Context(), LogWarning, "Upstream route %s failed, falling back to %s", route.Name, route.FallbackBaseURL)
+		resp, err = u.fetch(r, client, route.FallbackBaseURL+ruri, route.Name+"-fallback")
+	}
+	if u.quota != nil && err == nil && quotaExceeded(resp) {
+		u.quota.trip(quotaKey, quotaRetryAfter(resp, u.config.QuotaRetryAfter))
+	}
+	return resp, err
+}
+
+// fetch sends one upstream request with client, reported under target.
+func (u *httpUpstream) fetch(r *http.Request, client *http.Client, rawURL, target string) (*UpstreamResponse, error) {
+	upstreamStart := time.Now()
+	method, reqBody := http.MethodGet, io.Reader(nil)
+	post := postBodyFromContext(r.Context())
+	if post != nil {
+		method, reqBody = http.MethodPost, bytes.NewReader(post.raw)
+	}
+	req, err := http.NewRequestWithContext(traceTLSHandshakes(r.Context()), method, rawURL, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if post != nil {
+		req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+	}
+	if u.config.UpstreamUserAgent != "" {
+		req.Header.Set("User-Agent", u.config.UpstreamUserAgent)
+	}
+	for name, values := range r.Header {
+		if matchHeader(name, u.config.ForwardHeaders) || matchHeader(name, u.config.CacheKeyHeaders) {
+			req.Header[name] = values
+		}
+	}
+	for k, v := range u.config.UpstreamHeaders {
+		req.Header.Set(k, v)
+	}
+	if u.config.UpstreamGzip {
+		// Setting the header ourselves keeps the transport from transparently
+		// decompressing, so the body is cached compressed.
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		u.metrics.ObserveUpstream(target, "error", time.Since(upstreamStart))
+		u.logger.LogContext(r.Context(), LogError, "Failed to fetch from Google Maps API (%s): %v", target, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	u.metrics.ObserveUpstream(target, fmt.Sprintf("%d", resp.StatusCode), time.Since(upstreamStart))
+	upstreamProtocolDuration.WithLabelValues(resp.Proto).Observe(time.Since(upstreamStart).Seconds())
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		u.logger.LogContext(r.Context(), LogError, "Failed to read response body: %v", err)
+		return nil, fmt.Errorf("%w: %v", errReadBody, err)
+	}
+
+	u.metrics.ObserveUpstreamBytes(metricsEndpoint(r.URL.Path), len(body))
+
+	// The URL of the last request of the redirects followed, if any.
+	final := req.URL
+	if resp.Request != nil {
+		final = resp.Request.URL
+	}
+	if isRedirect(resp.StatusCode) && resp.Header.Get("Location") != "" {
+		outcome := "returned"
+		if u.config.UpstreamRedirects == RedirectRewrite {
+			resp.Header.Set("Location", proxiedLocation(resp.Header.Get("Location"), final))
+			outcome = "rewritten"
+		}
+		upstreamRedirectsTotal.WithLabelValues(outcome).Inc()
+	}
+	upstreamResponsesTotal.WithLabelValues(target, final.Host).Inc()
+	return &UpstreamResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		Target:     target,
+		Host:       final.Host,
+		Redirected: final.String() != req.URL.String(),
+		Streamed:   resp.ContentLength < 0 && !resp.Uncompressed,
+	}, nil
+}
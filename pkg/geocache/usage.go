@@ -0,0 +1,160 @@
+package geocache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultUsageCosts are Google's list prices in USD per billed request, or
+// per element for the distance matrix.
+var defaultUsageCosts = map[string]float64{
+	geocodePath:        0.005,
+	directionsPath:     0.005,
+	distanceMatrixPath: 0.005,
+}
+
+// usageBufferSize bounds the records waiting to be exported.
+const usageBufferSize = 10000
+
+// UsageRecord is one proxied request, as exported for billing.
+type UsageRecord struct {
+	Time          time.Time `json:"time"`
+	Endpoint      string    `json:"endpoint"`
+	APIKey        string    `json:"api_key"`
+	Referrer      string    `json:"referrer"`
+	CacheStatus   string    `json:"cache_status"`
+	EstimatedCost float64   `json:"estimated_cost"`
+	BusinessUnit  string    `json:"business_unit,omitempty"`
+}
+
+// usageExporter batches usage records and hands them to insert, when a
+// batch is full or every interval. Records are dropped rather than blocking
+// requests when the buffer is full.
+type usageExporter struct {
+	records   chan UsageRecord
+	batchSize int
+	interval  time.Duration
+	insert    func(ctx context.Context, records []UsageRecord) error
+	costs     map[string]float64
+	logger    *Logger
+	clock     Clock
+}
+
+// usageCosts parses Config.UsageCosts, endpoint path to USD, on top of the
+// default list prices.
+func usageCosts(config Config, logger *Logger) map[string]float64 {
+	costs := make(map[string]float64, len(defaultUsageCosts))
+	for path, cost := range defaultUsageCosts {
+		costs[path] = cost
+	}
+	for path, raw := range config.UsageCosts {
+		cost, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			logger.Log(LogWarning, "Ignoring invalid usage cost %q for %s", raw, path)
+			continue
+		}
+		costs[path] = cost
+	}
+	return costs
+}
+
+// requestCost returns what Google bills for the upstream request of u;
+// distance matrix requests are billed per element.
+func requestCost(costs map[string]float64, u *url.URL) float64 {
+	cost := costs[u.Path]
+	if u.Path == distanceMatrixPath {
+		q := u.Query()
+		origins := len(strings.Split(q.Get("origins"), "|"))
+		destinations := len(strings.Split(q.Get("destinations"), "|"))
+		cost *= float64(origins * destinations)
+	}
+	return cost
+}
+
+func newUsageExporter(config Config, logger *Logger, clock Clock, insert func(context.Context, []UsageRecord) error) *usageExporter {
+	costs := usageCosts(config, logger)
+	batchSize := config.BigQueryBatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	return &usageExporter{
+		records:   make(chan UsageRecord, usageBufferSize),
+		batchSize: batchSize,
+		interval:  config.BigQueryFlushInterval,
+		insert:    insert,
+		costs:     costs,
+		logger:    logger.Component("usage"),
+		clock:     clock,
+	}
+}
+
+// estimateCost returns the upstream cost of a request. Only misses are
+// billed.
+func (e *usageExporter) estimateCost(r *http.Request, cacheStatus string) float64 {
+	if cacheStatus != "MISS" {
+		return 0
+	}
+	return requestCost(e.costs, r.URL)
+}
+
+// Record queues the usage of a served request.
+func (e *usageExporter) Record(r *http.Request, cacheStatus string) {
+	rec := UsageRecord{
+		Time:          e.clock.Now().UTC(),
+		Endpoint:      r.URL.Path,
+		APIKey:        obfuscateAPIKey(extractAPIKey(r)),
+		Referrer:      requestReferrer(r),
+		CacheStatus:   cacheStatus,
+		EstimatedCost: e.estimateCost(r, cacheStatus),
+		BusinessUnit:  businessUnitFromContext(r.Context()),
+	}
+	select {
+	case e.records <- rec:
+	default:
+		usageRecordsDroppedTotal.WithLabelValues("buffer_full").Inc()
+	}
+}
+
+// run exports batches until the records channel is closed.
+func (e *usageExporter) run() {
+	interval := e.interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	tick := e.clock.After(interval)
+	batch := make([]UsageRecord, 0, e.batchSize)
+	for {
+		select {
+		case rec, ok := <-e.records:
+			if !ok {
+				e.flush(batch)
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= e.batchSize {
+				e.flush(batch)
+				batch = batch[:0]
+			}
+		case <-tick:
+			e.flush(batch)
+			batch = batch[:0]
+			tick = e.clock.After(interval)
+		}
+	}
+}
+
+func (e *usageExporter) flush(batch []UsageRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := e.insert(ctx, batch); err != nil {
+		usageRecordsDroppedTotal.WithLabelValues("export_failed").Add(float64(len(batch)))
+		e.logger.Log(LogWarning, "Failed to export %d usage records: %v", len(batch), err)
+	}
+}
@@ -0,0 +1,146 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUsageExporter_EstimateCost(t *testing.T) {
+	e := newUsageExporter(Config{UsageCosts: map[string]string{geocodePath: "0.004", directionsPath: "bogus"}}, NewLogger(false), systemClock{}, nil)
+
+	tests := []struct {
+		name        string
+		url         string
+		cacheStatus string
+		want        float64
+	}{
+		{name: "hit is free", url: geocodePath + "?address=a", cacheStatus: "HIT", want: 0},
+		{name: "override is free", url: geocodePath + "?address=a", cacheStatus: "OVERRIDE", want: 0},
+		{name: "configured cost", url: geocodePath + "?address=a", cacheStatus: "MISS", want: 0.004},
+		{name: "invalid cost keeps default", url: directionsPath + "?origin=a&destination=b", cacheStatus: "MISS", want: 0.005},
+		{name: "distance matrix per element", url: distanceMatrixPath + "?origins=a|b&destinations=c|d|e", cacheStatus: "MISS", want: 0.03},
+		{name: "unknown endpoint", url: "/maps/api/elevation/json?locations=1,2", cacheStatus: "MISS", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := e.estimateCost(httptest.NewRequest(http.MethodGet, tt.url, nil), tt.cacheStatus)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("estimateCost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsageExporter_Batches(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]UsageRecord
+	insert := func(ctx context.Context, records []UsageRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, append([]UsageRecord{}, records...))
+		return nil
+	}
+	e := newUsageExporter(Config{BigQueryBatchSize: 2, BigQueryFlushInterval: time.Hour}, NewLogger(false), systemClock{}, insert)
+	done := make(chan struct{})
+	go func() {
+		e.run()
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=a&key=abcdefghijkl", nil)
+		req.Header.Set("Referer", "https://app.example.com/page")
+		e.Record(req, "MISS")
+	}
+	close(e.records)
+	<-done
+
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("Expected batches of 2 and 1 records, got %v", batches)
+	}
+	rec := batches[0][0]
+	if rec.Endpoint != geocodePath || rec.APIKey != "abcd...ijkl" || rec.Referrer != "app.example.com" || rec.CacheStatus != "MISS" || rec.EstimatedCost != 0.005 {
+		t.Errorf("Unexpected record %+v", rec)
+	}
+}
+
+func TestUsageExporter_FlushInterval(t *testing.T) {
+	flushed := make(chan []UsageRecord, 1)
+	insert := func(ctx context.Context, records []UsageRecord) error {
+		flushed <- append([]UsageRecord{}, records...)
+		return nil
+	}
+	clock := NewFrozenClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	e := newUsageExporter(Config{BigQueryBatchSize: 10, BigQueryFlushInterval: time.Minute}, NewLogger(false), clock, insert)
+	go e.run()
+	defer close(e.records)
+
+	e.Record(httptest.NewRequest(http.MethodGet, geocodePath+"?address=a", nil), "HIT")
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(30 * time.Second)
+	select {
+	case batch := <-flushed:
+		t.Fatalf("Expected no flush before the interval, got %v", batch)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(30 * time.Second)
+	select {
+	case batch := <-flushed:
+		if len(batch) != 1 || !batch[0].Time.Equal(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)) {
+			t.Errorf("Expected the record stamped with the clock's time, got %v", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a flush once the interval elapsed")
+	}
+}
+
+func TestBigQueryInserter(t *testing.T) {
+	var got struct {
+		Rows []struct {
+			InsertID string      `json:"insertId"`
+			JSON     UsageRecord `json:"json"`
+		} `json:"rows"`
+	}
+	response := `{}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(response))
+	}))
+	defer ts.Close()
+
+	b := &bigQueryInserter{
+		client: ts.Client(),
+		url:    ts.URL,
+		token:  func(context.Context) (string, error) { return "test-token", nil },
+	}
+	records := []UsageRecord{{Endpoint: geocodePath, CacheStatus: "HIT"}, {Endpoint: directionsPath, CacheStatus: "MISS"}}
+	if err := b.Insert(context.Background(), records); err != nil {
+		t.Fatalf("Insert() error = %v", err)
+	}
+	if len(got.Rows) != 2 || got.Rows[1].JSON.Endpoint != directionsPath || got.Rows[0].InsertID == "" || got.Rows[0].InsertID == got.Rows[1].InsertID {
+		t.Errorf("Unexpected rows %+v", got.Rows)
+	}
+
+	response = `{"insertErrors":[{"index":0,"errors":[{"reason":"invalid"}]}]}`
+	if err := b.Insert(context.Background(), records); err == nil {
+		t.Error("Expected insert errors to be reported")
+	}
+
+	if _, err := newBigQueryInserter("dataset.table"); err == nil {
+		t.Error("Expected an incomplete table name to be rejected")
+	}
+}
@@ -0,0 +1,342 @@
+package geocache
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// usageReportFlushInterval is how often instances add their usage counts to
+// the fleet-wide counts in Redis.
+const usageReportFlushInterval = 30 * time.Second
+
+// usageReportMaxDays bounds the period of a usage report.
+const usageReportMaxDays = 400
+
+// googleAPINames are the names of the APIs in Google's console, by endpoint
+// path prefix.
+var googleAPINames = []struct {
+	prefix string
+	name   string
+}{
+	{"/maps/api/geocode/", "Geocoding API"},
+	{"/maps/api/directions/", "Directions API"},
+	{"/maps/api/distancematrix/", "Distance Matrix API"},
+	{"/maps/api/place/", "Places API"},
+	{"/maps/api/timezone/", "Time Zone API"},
+	{"/maps/api/elevation/", "Elevation API"},
+	{"/maps/api/staticmap", "Maps Static API"},
+	{"/maps/api/streetview", "Street View Static API"},
+}
+
+// googleAPIName returns the console name of the API serving path, or path
+// itself for other endpoints.
+func googleAPIName(path string) string {
+	for _, api := range googleAPINames {
+		if strings.HasPrefix(path, api.prefix) {
+			return api.name
+		}
+	}
+	return path
+}
+
+// usageKey identifies a row of the usage report within a day.
+type usageKey struct {
+	api      string
+	channel  string
+	referrer string
+}
+
+// field returns the field of the key in the Redis hash of a day, for the
+// counter name. Tabs cannot occur in channels, hosts or API names.
+func (k usageKey) field(counter string) string {
+	return k.api + "\t" + k.channel + "\t" + k.referrer + "\t" + counter
+}
+
+// usageCounts are the counters of a usage report row. Costs are in
+// millionths of a USD.
+type usageCounts struct {
+	requests      int64
+	billable      int64
+	avoided       int64
+	costMicros    int64
+	savingsMicros int64
+}
+
+func (c *usageCounts) add(o usageCounts) {
+	c.requests += o.requests
+	c.billable += o.billable
+	c.avoided += o.avoided
+	c.costMicros += o.costMicros
+	c.savingsMicros += o.savingsMicros
+}
+
+// usageTally counts the requests of an instance by day, API, channel and
+// referrer, until they are added to the fleet-wide counts in Redis, one hash
+// per day. Days follow Google's billing time zone, so that the report can be
+// reconciled with Google's.
+type usageTally struct {
+	s        *Server
+	location *time.Location
+
+	mu     sync.Mutex
+	counts map[string]map[usageKey]usageCounts
+}
+
+func newUsageTally(s *Server) *usageTally {
+	location, err := time.LoadLocation(s.config.UsageReportTimeZone)
+	if err != nil {
+		s.logger.Log(LogWarning, "Usage report days are in UTC: %v", err)
+		location = time.UTC
+	}
+	return &usageTally{s: s, location: location, counts: make(map[string]map[usageKey]usageCounts)}
+}
+
+// requestChannel returns the Premium Plan usage reporting channel of r.
+func requestChannel(r *http.Request) string {
+	if channel := r.URL.Query().Get("channel"); channel != "" {
+		return channel
+	}
+	return r.Header.Get("X-Goog-Maps-Channel-Id")
+}
+
+// observe counts a served request. Misses are billed by Google; hits,
+// including negative and coalesced responses, are billable requests avoided.
+func (t *usageTally) observe(r *http.Request, cacheStatus string) {
+	key := usageKey{
+		api:      googleAPIName(r.URL.Path),
+		channel:  strings.ReplaceAll(requestChannel(r), "\t", " "),
+		referrer: requestReferrer(r),
+	}
+	c := usageCounts{requests: 1}
+	switch cacheStatus {
+	case "MISS":
+		c.billable = 1
+		c.costMicros = int64(requestCost(t.s.costs, r.URL) * 1e6)
+	case "HIT", "NEGATIVE", "COALESCED":
+		c.avoided = 1
+		c.savingsMicros = int64(requestCost(t.s.costs, r.URL) * 1e6)
+	}
+	day := t.s.clock.Now().In(t.location).Format(time.DateOnly)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rows := t.counts[day]
+	if rows == nil {
+		rows = make(map[usageKey]usageCounts)
+		t.counts[day] = rows
+	}
+	total := rows[key]
+	total.add(c)
+	rows[key] = total
+}
+
+func (s *Server) usageDayKey(day string) string {
+	return s.redisKey("usage:" + day)
+}
+
+// flush adds the counts to Redis. Counts that cannot be written are kept for
+// the next flush.
+func (t *usageTally) flush(ctx context.Context) error {
+	t.mu.Lock()
+	counts := t.counts
+	t.counts = make(map[string]map[usageKey]usageCounts)
+	t.mu.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	retention := time.Duration(t.s.config.UsageReportRetentionDays) * 24 * time.Hour
+	pipe := t.s.redis.Pipeline()
+	for day, rows := range counts {
+		key := t.s.usageDayKey(day)
+		for k, c := range rows {
+			pipe.HIncrBy(ctx, key, k.field("requests"), c.requests)
+			pipe.HIncrBy(ctx, key, k.field("billable"), c.billable)
+			pipe.HIncrBy(ctx, key, k.field("avoided"), c.avoided)
+			pipe.HIncrBy(ctx, key, k.field("cost_micros"), c.costMicros)
+			pipe.HIncrBy(ctx, key, k.field("savings_micros"), c.savingsMicros)
+		}
+		pipe.Expire(ctx, key, retention)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.mu.Lock()
+		for day, rows := range counts {
+			for k, c := range rows {
+				if t.counts[day] == nil {
+					t.counts[day] = make(map[usageKey]usageCounts)
+				}
+				total := t.counts[day][k]
+				total.add(c)
+				t.counts[day][k] = total
+			}
+		}
+		t.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// runUsageTally flushes the usage counts every usageReportFlushInterval.
+func (s *Server) runUsageTally() {
+	for {
+		<-s.clock.After(usageReportFlushInterval)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := s.usageTally.flush(ctx); err != nil {
+			s.logger.Log(LogWarning, "Failed to write usage report counts: %v", err)
+		}
+		cancel()
+	}
+}
+
+// usageReportRow is a row of the usage report.
+type usageReportRow struct {
+	period string
+	key    usageKey
+	counts usageCounts
+}
+
+// usageReport reads the counts of the days from through to, both included,
+// summed by period: "day" or "month".
+func (s *Server) usageReport(ctx context.Context, from, to time.Time, period string) ([]usageReportRow, error) {
+	var days []string
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		days = append(days, d.Format(time.DateOnly))
+	}
+	pipe := s.redis.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(days))
+	for i, day := range days {
+		cmds[i] = pipe.HGetAll(ctx, s.usageDayKey(day))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	type rowKey struct {
+		period string
+		key    usageKey
+	}
+	totals := make(map[rowKey]*usageCounts)
+	for i, day := range days {
+		fields, _ := cmds[i].Result()
+		p := day
+		if period == "month" {
+			p = day[:len("2006-01")]
+		}
+		for field, raw := range fields {
+			parts := strings.Split(field, "\t")
+			if len(parts) != 4 {
+				continue
+			}
+			v, _ := strconv.ParseInt(raw, 10, 64)
+			k := rowKey{period: p, key: usageKey{api: parts[0], channel: parts[1], referrer: parts[2]}}
+			c := totals[k]
+			if c == nil {
+				c = &usageCounts{}
+				totals[k] = c
+			}
+			switch parts[3] {
+			case "requests":
+				c.requests += v
+			case "billable":
+				c.billable += v
+			case "avoided":
+				c.avoided += v
+			case "cost_micros":
+				c.costMicros += v
+			case "savings_micros":
+				c.savingsMicros += v
+			}
+		}
+	}
+
+	rows := make([]usageReportRow, 0, len(totals))
+	for k, c := range totals {
+		rows = append(rows, usageReportRow{period: k.period, key: k.key, counts: *c})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.period != b.period {
+			return a.period < b.period
+		}
+		if a.key.api != b.key.api {
+			return a.key.api < b.key.api
+		}
+		if a.key.channel != b.key.channel {
+			return a.key.channel < b.key.channel
+		}
+		return a.key.referrer < b.key.referrer
+	})
+	return rows, nil
+}
+
+// usageReportHeader are the columns of the usage report. Date, API and
+// Channel match Google's channel usage reports.
+var usageReportHeader = []string{
+	"Date", "API", "Channel", "Referrer", "Requests",
+	"Billable Requests", "Billable Requests Avoided",
+	"Estimated Cost (USD)", "Estimated Savings (USD)",
+}
+
+// handleUsageReport serves the usage of the fleet as a CSV file, with a row
+// per day or month, API, channel and referrer. from and to default to the
+// current month.
+func (s *Server) handleUsageReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := s.clock.Now().In(s.usageTally.location)
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(p.name); v != "" {
+			parsed, err := time.Parse(time.DateOnly, v)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": p.name + " must be a date such as 2026-01-31"})
+				return
+			}
+			*p.t = parsed
+		}
+	}
+	if to.Before(from) || to.Sub(from) >= usageReportMaxDays*24*time.Hour {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("to must be after from, within %d days", usageReportMaxDays)})
+		return
+	}
+	period := q.Get("period")
+	if period == "" {
+		period = "day"
+	} else if period != "day" && period != "month" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "period must be day or month"})
+		return
+	}
+
+	rows, err := s.usageReport(r.Context(), from, to, period)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s-%s.csv"`, from.Format(time.DateOnly), to.Format(time.DateOnly)))
+	out := csv.NewWriter(w)
+	out.Write(usageReportHeader)
+	usd := func(micros int64) string { return strconv.FormatFloat(float64(micros)/1e6, 'f', 2, 64) }
+	for _, row := range rows {
+		out.Write([]string{
+			row.period, row.key.api, row.key.channel, row.key.referrer,
+			strconv.FormatInt(row.counts.requests, 10),
+			strconv.FormatInt(row.counts.billable, 10),
+			strconv.FormatInt(row.counts.avoided, 10),
+			usd(row.counts.costMicros), usd(row.counts.savingsMicros),
+		})
+	}
+	out.Flush()
+}
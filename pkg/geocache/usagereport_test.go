@@ -0,0 +1,75 @@
+package geocache
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServer_UsageReport(t *testing.T) {
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: &recordingTransport{body: `{"status":"OK","results":[]}`}})
+	defer cleanup()
+	server.config.AllowedAdminCIDRs = []string{"192.0.2.0/24"}
+	server.config.UsageReportTimeZone = "America/Los_Angeles"
+	server.config.UsageReportRetentionDays = 400
+	server.costs = map[string]float64{geocodePath: 0.005}
+	// 16:30 on September 30 in Mountain View.
+	clock := NewFrozenClock(time.Date(2026, 9, 30, 23, 30, 0, 0, time.UTC))
+	server.clock = clock
+	server.usageTally = newUsageTally(server)
+	handler := server.routes()
+
+	query := func(uri, referrer string) {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req.Header.Set("Referer", referrer)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	query(geocodePath+"?address=Main&channel=fleet", "https://app.example.com/map")
+	query(geocodePath+"?address=Main&channel=fleet", "https://app.example.com/map")
+	query(geocodePath+"?address=Main&channel=fleet", "https://app.example.com/map")
+	query(geocodePath+"?address=Side", "")
+	if err := server.usageTally.flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	clock.Set(time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC))
+	query(geocodePath+"?address=Main&channel=fleet", "https://app.example.com/map")
+	if err := server.usageTally.flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	report := func(query string) [][]string {
+		req := httptest.NewRequest(http.MethodGet, "/admin/reports/usage?"+query, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("Invalid CSV: %v", err)
+		}
+		return records
+	}
+
+	want := [][]string{
+		usageReportHeader,
+		{"2026-09-30", "Geocoding API", "", "", "1", "1", "0", "0.01", "0.00"},
+		{"2026-09-30", "Geocoding API", "fleet", "app.example.com", "3", "1", "2", "0.01", "0.01"},
+		{"2026-10-01", "Geocoding API", "fleet", "app.example.com", "1", "0", "1", "0.00", "0.01"},
+	}
+	if got := report("from=2026-09-30&to=2026-10-01"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected report %q, got %q", want, got)
+	}
+	want = [][]string{
+		usageReportHeader,
+		{"2026-10", "Geocoding API", "fleet", "app.example.com", "1", "0", "1", "0.00", "0.01"},
+	}
+	if got := report("period=month"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the current month, got %q", got)
+	}
+}
@@ -0,0 +1,52 @@
+package geocache
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// responseSchemas lists, per endpoint, the top-level arrays an OK response
+// must contain.
+var responseSchemas = map[string][]string{
+	geocodePath:        {"results"},
+	directionsPath:     {"routes", "geocoded_waypoints"},
+	distanceMatrixPath: {"rows", "origin_addresses", "destination_addresses"},
+}
+
+// corruptResponseError describes why an upstream body failed validation.
+type corruptResponseError struct {
+	reason string
+	detail string
+}
+
+func (e *corruptResponseError) Error() string {
+	return e.reason + ": " + e.detail
+}
+
+// validateResponse checks the body of a JSON endpoint: it must be a complete
+// JSON object with a string status and, when the status is OK, the arrays of
+// the endpoint's schema. Bodies of other endpoints are not checked.
+func validateResponse(path string, body []byte) error {
+	if !strings.HasSuffix(path, "/json") {
+		return nil
+	}
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return &corruptResponseError{"invalid_json", err.Error()}
+	}
+	var status string
+	if err := json.Unmarshal(resp["status"], &status); err != nil || status == "" {
+		return &corruptResponseError{"missing_status", "no status field"}
+	}
+	if status != "OK" {
+		return nil
+	}
+	for _, field := range responseSchemas[path] {
+		var array []json.RawMessage
+		if err := json.Unmarshal(resp[field], &array); err != nil || array == nil {
+			return &corruptResponseError{"missing_field", fmt.Sprintf("%s is not an array", field)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package geocache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestValidateResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantReason string
+	}{
+		{
+			name: "geocode OK",
+			path: geocodePath,
+			body: `{"results":[{"place_id":"p1"}],"status":"OK"}`,
+		},
+		{
+			name: "zero results without arrays",
+			path: directionsPath,
+			body: `{"status":"ZERO_RESULTS"}`,
+		},
+		{
+			name: "error status",
+			path: geocodePath,
+			body: `{"error_message":"The provided API key is invalid.","results":[],"status":"REQUEST_DENIED"}`,
+		},
+		{
+			name:       "truncated body",
+			path:       geocodePath,
+			body:       `{"results":[{"place_id":"p1"}],"sta`,
+			wantReason: "invalid_json",
+		},
+		{
+			name:       "missing status",
+			path:       geocodePath,
+			body:       `{"results":[]}`,
+			wantReason: "missing_status",
+		},
+		{
+			name:       "OK without the expected array",
+			path:       distanceMatrixPath,
+			body:       `{"origin_addresses":[],"destination_addresses":[],"status":"OK"}`,
+			wantReason: "missing_field",
+		},
+		{
+			name:       "array of the wrong type",
+			path:       directionsPath,
+			body:       `{"geocoded_waypoints":[],"routes":{},"status":"OK"}`,
+			wantReason: "missing_field",
+		},
+		{
+			name: "non-JSON endpoint",
+			path: "/maps/api/staticmap",
+			body: "\x89PNG",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateResponse(tt.path, []byte(tt.body))
+			var corrupt *corruptResponseError
+			switch {
+			case tt.wantReason == "" && err != nil:
+				t.Errorf("Expected a valid response, got %v", err)
+			case tt.wantReason != "" && (!errors.As(err, &corrupt) || corrupt.reason != tt.wantReason):
+				t.Errorf("Expected reason %s, got %v", tt.wantReason, err)
+			}
+		})
+	}
+}
+
+func TestServer_Query_InvalidResponseNotCached(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[{"formatted_address":"1 Ma`}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.ValidateResponses = true
+	before := testutil.ToFloat64(corruptResponsesTotal.WithLabelValues("geocode", "invalid_json"))
+
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Main", nil)
+	w := httptest.NewRecorder()
+	server.query(w, req)
+
+	if w.Body.String() != transport.body {
+		t.Errorf("Expected the upstream body to be passed through, got %s", w.Body.String())
+	}
+	if mr.Exists(server.cacheKey(req)) {
+		t.Errorf("Expected the truncated response not to be cached")
+	}
+	if got := testutil.ToFloat64(corruptResponsesTotal.WithLabelValues("geocode", "invalid_json")) - before; got != 1 {
+		t.Errorf("Expected 1 corrupt response to be counted, got %v", got)
+	}
+}
+
+func TestServer_Query_SlowResponseNotCached(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.CacheMaxUpstreamLatency = 20 * time.Millisecond
+	server.upstream = newHTTPUpstream(&http.Client{Transport: &slowTransport{delay: 50 * time.Millisecond}}, server.config, server.clock, server.logger, prometheusSink{})
+	before := testutil.ToFloat64(upstreamResponsesNotCachedTotal.WithLabelValues("slow"))
+
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Slow", nil)
+	w := httptest.NewRecorder()
+	server.query(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != `{"results":[],"status":"OK"}` {
+		t.Errorf("Expected the slow response to be passed through, got %d %s", w.Code, w.Body.String())
+	}
+	if mr.Exists(server.cacheKey(req)) {
+		t.Errorf("Expected the slow response not to be cached")
+	}
+	if got := testutil.ToFloat64(upstreamResponsesNotCachedTotal.WithLabelValues("slow")) - before; got != 1 {
+		t.Errorf("Expected 1 slow response to be counted, got %v", got)
+	}
+}
+
+func TestServer_Query_StreamedResponseNotCached(t *testing.T) {
+	const payload = `{"results":[],"status":"OK"}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("address") == "Streamed" {
+			io.WriteString(w, payload[:10])
+			w.(http.Flusher).Flush()
+			io.WriteString(w, payload[10:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		io.WriteString(w, payload)
+	}))
+	defer upstream.Close()
+
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.BaseURL = upstream.URL
+	server.config.CacheSkipStreamed = true
+	server.upstream = newHTTPUpstream(upstream.Client(), server.config, server.clock, server.logger, prometheusSink{})
+
+	for address, wantCached := range map[string]bool{"Streamed": false, "Sized": true} {
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?address="+address, nil)
+		w := httptest.NewRecorder()
+		server.query(w, req)
+
+		if w.Body.String() != payload {
+			t.Errorf("%s: expected the upstream body to be passed through, got %s", address, w.Body.String())
+		}
+		if got := mr.Exists(server.cacheKey(req)); got != wantCached {
+			t.Errorf("%s: expected cached %v, got %v", address, wantCached, got)
+		}
+	}
+}
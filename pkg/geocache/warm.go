@@ -0,0 +1,259 @@
+package geocache
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errWarmRunning is returned by warmOnce when another instance warmed the
+// cache less than an interval ago.
+var errWarmRunning = errors.New("cache warming ran on another instance")
+
+// warmSource lists the request URIs to keep in the cache, such as
+// /maps/api/geocode/json?address=..., most demanded first.
+type warmSource interface {
+	Queries(ctx context.Context, limit int) ([]string, error)
+}
+
+// newWarmSource returns the source of WARM_SOURCE: a CSV object in Cloud
+// Storage, as gs://bucket/object, or the result of WARM_QUERY in BigQuery,
+// as bigquery:project, the project running the query.
+func newWarmSource(config Config) (warmSource, error) {
+	switch {
+	case strings.HasPrefix(config.WarmSource, "gs://"):
+		bucket, name, _ := strings.Cut(strings.TrimPrefix(config.WarmSource, "gs://"), "/")
+		if bucket == "" || name == "" {
+			return nil, fmt.Errorf("WARM_SOURCE %q is not gs://bucket/object", config.WarmSource)
+		}
+		return &csvWarmSource{gcs: newGCSClient(bucket), name: name}, nil
+	case strings.HasPrefix(config.WarmSource, "bigquery:"):
+		project := strings.TrimPrefix(config.WarmSource, "bigquery:")
+		if project == "" || config.WarmQuery == "" {
+			return nil, errors.New("WARM_SOURCE bigquery:project needs a project and WARM_QUERY")
+		}
+		return &bigQueryWarmSource{
+			client:  &http.Client{Timeout: 2 * time.Minute},
+			baseURL: "https://bigquery.googleapis.com",
+			project: project,
+			query:   config.WarmQuery,
+			token:   newGCPTokenSource().Token,
+		}, nil
+	}
+	return nil, fmt.Errorf("WARM_SOURCE %q is neither gs://bucket/object nor bigquery:project", config.WarmSource)
+}
+
+// csvWarmSource reads request URIs from the first column of a CSV object.
+// Rows whose first field is not a request URI, such as a header, are
+// skipped.
+type csvWarmSource struct {
+	gcs  *gcsClient
+	name string
+}
+
+func (c *csvWarmSource) Queries(ctx context.Context, limit int) ([]string, error) {
+	data, err := c.gcs.Download(ctx, c.name)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	var uris []string
+	for len(uris) < limit {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.name, err)
+		}
+		if uri := strings.TrimSpace(record[0]); strings.HasPrefix(uri, "/") {
+			uris = append(uris, uri)
+		}
+	}
+	return uris, nil
+}
+
+// bigQueryWarmSource runs a standard SQL query returning request URIs in its
+// first column, through the jobs.query REST method, authenticating as the
+// instance's service account.
+type bigQueryWarmSource struct {
+	client  *http.Client
+	baseURL string
+	project string
+	query   string
+	token   func(ctx context.Context) (string, error)
+}
+
+// bigQueryQueryResponse is the part of the jobs.query and
+// jobs.getQueryResults responses read by bigQueryWarmSource.
+type bigQueryQueryResponse struct {
+	JobComplete  bool `json:"jobComplete"`
+	JobReference struct {
+		JobID    string `json:"jobId"`
+		Location string `json:"location"`
+	} `json:"jobReference"`
+	Rows []struct {
+		F []struct {
+			V json.RawMessage `json:"v"`
+		} `json:"f"`
+	} `json:"rows"`
+	PageToken string `json:"pageToken"`
+}
+
+func (b *bigQueryWarmSource) Queries(ctx context.Context, limit int) ([]string, error) {
+	body, _ := json.Marshal(map[string]interface{}{"query": b.query, "useLegacySql": false, "maxResults": limit, "timeoutMs": 60000})
+	var resp bigQueryQueryResponse
+	if err := b.call(ctx, http.MethodPost, fmt.Sprintf("%s/bigquery/v2/projects/%s/queries", b.baseURL, url.PathEscape(b.project)), body, &resp); err != nil {
+		return nil, err
+	}
+	var uris []string
+	for {
+		if resp.JobComplete {
+			for _, row := range resp.Rows {
+				var uri string
+				if len(row.F) > 0 && json.Unmarshal(row.F[0].V, &uri) == nil && strings.HasPrefix(uri, "/") && len(uris) < limit {
+					uris = append(uris, uri)
+				}
+			}
+			if len(uris) >= limit || resp.PageToken == "" {
+				return uris, nil
+			}
+		}
+		// Waits for the query to complete, or reads its next page.
+		params := url.Values{"location": {resp.JobReference.Location}, "maxResults": {strconv.Itoa(limit - len(uris))}, "timeoutMs": {"60000"}}
+		if resp.JobComplete {
+			params.Set("pageToken", resp.PageToken)
+		}
+		u := fmt.Sprintf("%s/bigquery/v2/projects/%s/queries/%s?%s", b.baseURL, url.PathEscape(b.project), url.PathEscape(resp.JobReference.JobID), params.Encode())
+		resp = bigQueryQueryResponse{}
+		if err := b.call(ctx, http.MethodGet, u, nil, &resp); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (b *bigQueryWarmSource) call(ctx context.Context, method, rawURL string, body []byte, result interface{}) error {
+	token, err := b.token(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching access token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("BigQuery query returned %s: %s", resp.Status, msg)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// warmQuery serves uri like a client request, so that its response is
+// cached, and returns the outcome: hit, miss, error, invalid, or skipped for
+// the requests a rule denies or that bypass the cache.
+func (s *Server) warmQuery(ctx context.Context, uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "invalid"
+	}
+	req := (&http.Request{Method: http.MethodGet, URL: u, RequestURI: u.RequestURI(), Header: make(http.Header)}).WithContext(ctx)
+	req.Header.Set("User-Agent", "geocache-warmer")
+	if s.config.WarmAPIKey != "" {
+		req.Header.Set("X-Maps-API-Key", s.config.WarmAPIKey)
+	}
+	outcome := "skipped"
+	rec := newBufferedResponseWriter()
+	s.outputFormatMiddleware(s.rulesMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.bypassReason(r) != "" {
+			return
+		}
+		s.query(w, r)
+		switch {
+		case rec.statusCode != http.StatusOK:
+			outcome = "error"
+		case rec.header.Get("X-Cache") == "HIT":
+			outcome = "hit"
+		default:
+			outcome = "miss"
+		}
+	}))).ServeHTTP(rec, req)
+	return outcome
+}
+
+// warmOnce requests the WARM_TOP_N queries of source through the cache, at
+// most WARM_RATE_PER_SECOND, and returns the number of queries by outcome.
+// Instances sharing Redis take turns: warming is skipped when another
+// instance warmed the cache less than WARM_INTERVAL_HOURS ago.
+func (s *Server) warmOnce(ctx context.Context, source warmSource) (map[string]int, error) {
+	if s.redis != nil && s.config.WarmInterval > 0 {
+		acquired, err := s.redis.SetNX(ctx, s.redisKey("warm:lock"), s.instanceID, s.config.WarmInterval*9/10).Result()
+		if err != nil {
+			return nil, err
+		} else if !acquired {
+			return nil, errWarmRunning
+		}
+	}
+	uris, err := source.Queries(ctx, s.config.WarmTopN)
+	if err != nil {
+		return nil, err
+	}
+	var pace <-chan time.Time
+	if s.config.WarmRatePerSecond > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(s.config.WarmRatePerSecond))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+	counts := make(map[string]int)
+	for _, uri := range uris {
+		if pace != nil {
+			<-pace
+		}
+		s.health.wait("warm", healthRedis, healthUpstream)
+		outcome := s.warmQuery(ctx, uri)
+		warmQueriesTotal.WithLabelValues(outcome).Inc()
+		counts[outcome]++
+	}
+	return counts, nil
+}
+
+// runWarmer warms the cache from source on startup and then every
+// WARM_INTERVAL_HOURS, on one of the instances sharing Redis.
+func (s *Server) runWarmer(source warmSource) {
+	logger := s.logger.Component("warm")
+	for {
+		start := time.Now()
+		counts, err := s.warmOnce(context.Background(), source)
+		switch {
+		case errors.Is(err, errWarmRunning):
+		case err != nil:
+			warmRunsTotal.WithLabelValues("error").Inc()
+			logger.Log(LogError, "Cache warming failed: %v", err)
+		default:
+			warmRunsTotal.WithLabelValues("complete").Inc()
+			logger.Log(LogInfo, "Warmed the cache in %v: %d hits, %d misses, %d errors, %d skipped, %d invalid",
+				time.Since(start).Round(time.Second), counts["hit"], counts["miss"], counts["error"], counts["skipped"], counts["invalid"])
+		}
+		if s.config.WarmInterval <= 0 {
+			return
+		}
+		<-s.clock.After(s.config.WarmInterval)
+	}
+}
@@ -0,0 +1,133 @@
+package geocache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSVWarmSource(t *testing.T) {
+	gcs := &fakeGCS{objects: map[string][]byte{
+		"warm/top.csv": []byte("uri,requests\n" + geocodePath + "?address=Main,120\n\"" + geocodePath + "?address=A%2C+B\",80\n" + directionsPath + "?origin=a&destination=b,10\n"),
+	}}
+	ts := httptest.NewServer(gcs)
+	defer ts.Close()
+	source := &csvWarmSource{
+		gcs:  &gcsClient{client: ts.Client(), baseURL: ts.URL, bucket: "bucket", token: func(context.Context) (string, error) { return "token", nil }},
+		name: "warm/top.csv",
+	}
+
+	got, err := source.Queries(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("Queries failed: %v", err)
+	}
+	if want := []string{geocodePath + "?address=Main", geocodePath + "?address=A%2C+B"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestBigQueryWarmSource(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.URL.Query().Get("pageToken"))
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost:
+			var body struct {
+				Query        string `json:"query"`
+				UseLegacySQL bool   `json:"useLegacySql"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Query != "SELECT uri FROM demand" || body.UseLegacySQL {
+				http.Error(w, "unexpected query", http.StatusBadRequest)
+				return
+			}
+			// The query is still running.
+			w.Write([]byte(`{"jobComplete":false,"jobReference":{"jobId":"job1","location":"EU"}}`))
+		case r.URL.Query().Get("pageToken") == "":
+			w.Write([]byte(`{"jobComplete":true,"jobReference":{"jobId":"job1","location":"EU"},"rows":[{"f":[{"v":"/maps/api/geocode/json?address=Main"}]},{"f":[{"v":null}]}],"pageToken":"p2"}`))
+		default:
+			w.Write([]byte(`{"jobComplete":true,"jobReference":{"jobId":"job1","location":"EU"},"rows":[{"f":[{"v":"/maps/api/geocode/json?address=Side"}]},{"f":[{"v":"/maps/api/geocode/json?address=Third"}]}]}`))
+		}
+	}))
+	defer ts.Close()
+	source := &bigQueryWarmSource{
+		client:  ts.Client(),
+		baseURL: ts.URL,
+		project: "analytics",
+		query:   "SELECT uri FROM demand",
+		token:   func(context.Context) (string, error) { return "token", nil },
+	}
+
+	got, err := source.Queries(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("Queries failed: %v", err)
+	}
+	if want := []string{geocodePath + "?address=Main", geocodePath + "?address=Side"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	want := []string{
+		"POST /bigquery/v2/projects/analytics/queries ",
+		"GET /bigquery/v2/projects/analytics/queries/job1 ",
+		"GET /bigquery/v2/projects/analytics/queries/job1 p2",
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("Expected requests %v, got %v", want, requests)
+	}
+}
+
+type staticWarmSource []string
+
+func (s staticWarmSource) Queries(ctx context.Context, limit int) ([]string, error) {
+	return s[:min(limit, len(s))], nil
+}
+
+func TestServer_WarmOnce(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[],"status":"OK"}`}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.WarmTopN = 3
+	server.config.WarmInterval = 24 * time.Hour
+	server.config.WarmAPIKey = "warm-key"
+	server.config.CacheBypassPatterns = []string{"/maps/api/place/autocomplete/json"}
+	server.bypassPatterns = parsePathPatterns("CACHE_BYPASS_PATTERNS", server.config.CacheBypassPatterns, server.logger)
+	source := staticWarmSource{
+		geocodePath + "?address=Main",
+		"/maps/api/place/autocomplete/json?input=Mai",
+		"not a request URI",
+		geocodePath + "?address=Ignored",
+	}
+
+	counts, err := server.warmOnce(context.Background(), source)
+	if err != nil {
+		t.Fatalf("warmOnce failed: %v", err)
+	}
+	if want := map[string]int{"miss": 1, "skipped": 1, "invalid": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("Expected outcomes %v, got %v", want, counts)
+	}
+	if len(transport.urls) != 1 || !strings.Contains(transport.urls[0], "key=warm-key") {
+		t.Fatalf("Expected one upstream request with WARM_API_KEY, got %v", transport.urls)
+	}
+
+	// Another instance waits for the next interval.
+	if _, err := server.warmOnce(context.Background(), source); !errors.Is(err, errWarmRunning) {
+		t.Errorf("Expected errWarmRunning, got %v", err)
+	}
+	mr.Del(server.redisKey("warm:lock"))
+	counts, err = server.warmOnce(context.Background(), source)
+	if err != nil {
+		t.Fatalf("warmOnce failed: %v", err)
+	}
+	if counts["hit"] != 1 || len(transport.urls) != 1 {
+		t.Errorf("Expected the warmed query to hit the cache, got %v and %d upstream requests", counts, len(transport.urls))
+	}
+}
@@ -0,0 +1,66 @@
+package geocache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// proxyMeta is the member added to JSON responses with RESPONSE_WATERMARK,
+// so that a response pasted in a bug report leads to its proxy request.
+type proxyMeta struct {
+	RequestID    string `json:"request_id,omitempty"`
+	CacheStatus  string `json:"cache_status,omitempty"`
+	IdentityHash string `json:"identity_hash"`
+	Time         string `json:"time"`
+}
+
+// identityHash returns a short hash of the client of r: its authenticated
+// identity, otherwise its API key or address.
+func identityHash(r *http.Request, trustedProxies []string) string {
+	client, _ := rateLimitClient(r, trustedProxies)
+	if identity := clientIdentityFromContext(r.Context()); identity == nil || identity.ID == "" {
+		if key := extractAPIKey(r); key != "" {
+			sum := sha256.Sum256([]byte(key))
+			client = "key:" + hex.EncodeToString(sum[:8])
+		}
+	}
+	sum := sha256.Sum256([]byte(client))
+	return hex.EncodeToString(sum[:8])
+}
+
+// watermark adds a proxy_meta member describing the request to plain, a
+// JSON object response. Other bodies are returned unchanged. The member is
+// appended as text, so the rest of the body is served byte for byte.
+func (s *Server) watermark(w http.ResponseWriter, r *http.Request, plain []byte) []byte {
+	if !strings.Contains(w.Header().Get("Content-Type"), "json") {
+		return plain
+	}
+	trimmed := bytes.TrimSpace(plain)
+	if len(trimmed) < 2 || trimmed[0] != '{' || trimmed[len(trimmed)-1] != '}' {
+		return plain
+	}
+	meta, err := json.Marshal(proxyMeta{
+		RequestID:    w.Header().Get("X-Request-ID"),
+		CacheStatus:  w.Header().Get("X-Cache"),
+		IdentityHash: identityHash(r, s.config.TrustedProxyCIDRs),
+		Time:         s.clock.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return plain
+	}
+	inner := bytes.TrimSpace(trimmed[1 : len(trimmed)-1])
+	out := make([]byte, 0, len(trimmed)+len(meta)+16)
+	out = append(out, '{')
+	out = append(out, inner...)
+	if len(inner) > 0 {
+		out = append(out, ',')
+	}
+	out = append(out, `"proxy_meta":`...)
+	out = append(out, meta...)
+	return append(out, '}')
+}
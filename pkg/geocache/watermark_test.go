@@ -0,0 +1,75 @@
+package geocache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_Watermark(t *testing.T) {
+	server := &Server{clock: NewFrozenClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))}
+	req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=a", nil)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{name: "object", contentType: "application/json; charset=UTF-8", body: `{"status":"OK"}`,
+			want: `{"status":"OK","proxy_meta":{"request_id":"req-1","cache_status":"HIT","identity_hash":"%s","time":"2026-10-16T12:00:00Z"}}`},
+		{name: "empty object", contentType: "application/json", body: " {} \n",
+			want: `{"proxy_meta":{"request_id":"req-1","cache_status":"HIT","identity_hash":"%s","time":"2026-10-16T12:00:00Z"}}`},
+		{name: "array", contentType: "application/json", body: `[1,2]`, want: `[1,2]`},
+		{name: "xml", contentType: "application/xml", body: `<GeocodeResponse/>`, want: `<GeocodeResponse/>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Type", tt.contentType)
+			w.Header().Set("X-Request-ID", "req-1")
+			w.Header().Set("X-Cache", "HIT")
+			want := tt.want
+			if tt.want != tt.body {
+				want = fmt.Sprintf(tt.want, identityHash(req, nil))
+			}
+			if got := string(server.watermark(w, req, []byte(tt.body))); got != want {
+				t.Errorf("watermark() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_Query_Watermark(t *testing.T) {
+	const payload = `{"status":"OK","results":[]}`
+	server, _, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	server.config.UpstreamGzip = true
+	server.config.ResponseWatermark = true
+	server.upstream = newHTTPUpstream(&http.Client{Transport: &gzipTransport{body: gzipBytes(t, payload)}}, server.config, server.clock, server.logger, prometheusSink{})
+
+	for _, wantCache := range []string{"MISS", "HIT"} {
+		req := httptest.NewRequest(http.MethodGet, geocodePath+"?address=Watermark", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		server.query(w, req)
+
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: expected watermarked bodies to be uncompressed, got Content-Encoding %q", wantCache, got)
+		}
+		var body struct {
+			Status    string    `json:"status"`
+			ProxyMeta proxyMeta `json:"proxy_meta"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: expected a JSON body, got %q: %v", wantCache, w.Body.String(), err)
+		}
+		if body.Status != "OK" || body.ProxyMeta.CacheStatus != wantCache || body.ProxyMeta.IdentityHash != identityHash(req, nil) {
+			t.Errorf("%s: unexpected watermarked body %s", wantCache, w.Body.String())
+		}
+	}
+}
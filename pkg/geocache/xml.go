@@ -0,0 +1,199 @@
+package geocache
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const xmlContentType = "application/xml; charset=UTF-8"
+
+// isXMLPath reports whether path is the XML variant of a Maps API endpoint,
+// such as /maps/api/geocode/xml.
+func isXMLPath(path string) bool {
+	return strings.HasPrefix(path, "/maps/api/") && strings.HasSuffix(path, "/xml")
+}
+
+// jsonVariant returns the JSON variant of an XML endpoint path, and other
+// paths unchanged.
+func jsonVariant(path string) string {
+	if isXMLPath(path) {
+		return strings.TrimSuffix(path, "/xml") + "/json"
+	}
+	return path
+}
+
+// cachedContentType returns the content type of a cached response to r.
+func cachedContentType(r *http.Request) string {
+	switch {
+	case wantsGeoJSON(r):
+		return geoJSONContentType
+	case isXMLPath(r.URL.Path):
+		return xmlContentType
+	default:
+		return "application/json"
+	}
+}
+
+// xmlRootElements are the root elements of the XML responses whose name is
+// not derived from their endpoint by xmlRootElement.
+var xmlRootElements = map[string]string{
+	"distancematrix": "DistanceMatrixResponse",
+	"timezone":       "TimeZoneResponse",
+	"place":          "PlaceSearchResponse",
+}
+
+// xmlRootElement returns the root element of the XML response of the
+// endpoint at path, such as GeocodeResponse for /maps/api/geocode/xml.
+func xmlRootElement(path string) string {
+	api, _, _ := strings.Cut(strings.TrimPrefix(path, "/maps/api/"), "/")
+	if root, ok := xmlRootElements[api]; ok {
+		return root
+	}
+	if api == "" {
+		return "Response"
+	}
+	return strings.ToUpper(api[:1]) + api[1:] + "Response"
+}
+
+// xmlElementNames are the names of the elements of JSON arrays whose name is
+// not their singular as returned by xmlElementName.
+var xmlElementNames = map[string]string{
+	"waypoint_order":    "waypoint_index",
+	"html_attributions": "html_attribution",
+}
+
+// xmlElementName returns the name of the elements of the JSON array name:
+// the XML responses repeat a singular element instead of wrapping arrays, so
+// results is returned as a sequence of result elements.
+func xmlElementName(name string) string {
+	if element, ok := xmlElementNames[name]; ok {
+		return element
+	}
+	switch {
+	case strings.HasSuffix(name, "sses"), strings.HasSuffix(name, "xes"):
+		return strings.TrimSuffix(name, "es")
+	case strings.HasSuffix(name, "ies"):
+		return strings.TrimSuffix(name, "ies") + "y"
+	case strings.HasSuffix(name, "s"):
+		return strings.TrimSuffix(name, "s")
+	}
+	return name
+}
+
+// jsonToXML transcodes a JSON response of the endpoint at path to the XML
+// format of the Maps API, keeping the order of the fields.
+func jsonToXML(path string, body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", " ")
+	if err := writeXMLValue(enc, dec, xmlRootElement(path)); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// writeXMLValue writes the next JSON value of dec as the element name.
+func writeXMLValue(enc *xml.Encoder, dec *json.Decoder, name string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('['):
+		for dec.More() {
+			if err := writeXMLValue(enc, dec, xmlElementName(name)); err != nil {
+				return err
+			}
+		}
+		_, err := dec.Token()
+		return err
+	case json.Delim('{'):
+		start := xml.StartElement{Name: xml.Name{Local: name}}
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			field, ok := key.(string)
+			if !ok {
+				return errors.New("invalid JSON object key")
+			}
+			if err := writeXMLValue(enc, dec, field); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		return enc.EncodeToken(start.End())
+	case nil:
+		return nil
+	default:
+		var text string
+		switch v := tok.(type) {
+		case string:
+			text = v
+		case json.Number:
+			text = v.String()
+		case bool:
+			text = "false"
+			if v {
+				text = "true"
+			}
+		}
+		return enc.EncodeElement(text, xml.StartElement{Name: xml.Name{Local: name}})
+	}
+}
+
+// serveTranscodedXML serves a request for an XML endpoint from the cache of
+// its JSON variant, transcoding the response, so that JSON and XML clients
+// share one cache entry.
+func (s *Server) serveTranscodedXML(w http.ResponseWriter, r *http.Request) {
+	jsonReq := r.Clone(r.Context())
+	jsonReq.URL.Path = jsonVariant(r.URL.Path)
+	jsonReq.URL.RawPath = ""
+	// The response is transcoded, so it must not be compressed.
+	jsonReq.Header.Del("Accept-Encoding")
+	bw := newBufferedResponseWriter()
+	for k, v := range w.Header() {
+		bw.header[k] = v
+	}
+	s.query(bw, jsonReq)
+
+	for k, v := range bw.header {
+		w.Header()[k] = v
+	}
+	if csw, ok := w.(*cacheStatusResponseWriter); ok {
+		csw.cacheStatus = bw.header.Get("X-Cache")
+		csw.fillID = bw.header.Get("X-Cache-Fill-Id")
+	}
+	body := bw.body.Bytes()
+	if contentType := bw.header.Get("Content-Type"); bw.statusCode == http.StatusOK && (contentType == "" || strings.HasPrefix(contentType, "application/json")) {
+		transcoded, err := jsonToXML(r.URL.Path, body)
+		if err != nil {
+			s.logger.LogContext(r.Context(), LogWarning, "Failed to transcode response to XML: %v", err)
+			http.Error(w, "Failed to transcode response to XML", http.StatusBadGateway)
+			return
+		}
+		body = transcoded
+		w.Header().Set("Content-Type", xmlContentType)
+		w.Header().Set("X-Cache-Transcoded", "json")
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(bw.statusCode)
+	w.Write(body)
+}
@@ -0,0 +1,143 @@
+package geocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONToXML(t *testing.T) {
+	body := `{"results":[{"address_components":[{"long_name":"Main & 1st","types":["route"]}],"geometry":{"location":{"lat":52.5,"lng":13.4}},"partial_match":true}],"status":"OK"}`
+	got, err := jsonToXML("/maps/api/geocode/xml", []byte(body))
+	if err != nil {
+		t.Fatalf("jsonToXML failed: %v", err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<GeocodeResponse>
+ <result>
+  <address_component>
+   <long_name>Main &amp; 1st</long_name>
+   <type>route</type>
+  </address_component>
+  <geometry>
+   <location>
+    <lat>52.5</lat>
+    <lng>13.4</lng>
+   </location>
+  </geometry>
+  <partial_match>true</partial_match>
+ </result>
+ <status>OK</status>
+</GeocodeResponse>
+`
+	if string(got) != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestXMLElementName(t *testing.T) {
+	for name, want := range map[string]string{
+		"results":               "result",
+		"destination_addresses": "destination_address",
+		"postcode_localities":   "postcode_locality",
+		"waypoint_order":        "waypoint_index",
+		"location":              "location",
+	} {
+		if got := xmlElementName(name); got != want {
+			t.Errorf("xmlElementName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestServer_Query_XML(t *testing.T) {
+	tests := []struct {
+		name            string
+		transcode       bool
+		wantUpstream    []string
+		wantContentType string
+	}{
+		{
+			name:            "passthrough",
+			wantUpstream:    []string{"/geocode/xml", "/geocode/json"},
+			wantContentType: xmlContentType,
+		},
+		{
+			name:            "transcoded",
+			transcode:       true,
+			wantUpstream:    []string{"/geocode/json"},
+			wantContentType: xmlContentType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &recordingTransport{body: `{"results":[],"status":"ZERO_RESULTS"}`}
+			server, _, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+			defer cleanup()
+			server.config.XMLTranscode = tt.transcode
+
+			var xmlCache []string
+			for _, path := range []string{"/maps/api/geocode/xml", "/maps/api/geocode/json", "/maps/api/geocode/xml"} {
+				w := httptest.NewRecorder()
+				server.query(w, httptest.NewRequest(http.MethodGet, path+"?address=Main", nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("Expected status 200 for %s, got %d", path, w.Code)
+				}
+				if strings.HasSuffix(path, "/xml") {
+					xmlCache = append(xmlCache, w.Header().Get("X-Cache"))
+					if tt.transcode && !strings.Contains(w.Body.String(), "<status>ZERO_RESULTS</status>") {
+						t.Errorf("Expected a transcoded XML response, got %s", w.Body.String())
+					}
+				}
+			}
+			if len(transport.urls) != len(tt.wantUpstream) {
+				t.Fatalf("Expected upstream requests for %v, got %v", tt.wantUpstream, transport.urls)
+			}
+			for i, u := range transport.urls {
+				if !strings.Contains(u, tt.wantUpstream[i]+"?") {
+					t.Errorf("Expected upstream request %d for %s, got %s", i, tt.wantUpstream[i], u)
+				}
+			}
+			if xmlCache[1] != "HIT" {
+				t.Errorf("Expected the second XML request to hit the cache, got %s", xmlCache[1])
+			}
+		})
+	}
+}
+
+func TestServer_JSONOutputEndpoints(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[],"status":"ZERO_RESULTS"}`}
+	server, _, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.config.JSONOutputEndpoints = []string{"/maps/api/geocode"}
+	server.jsonOutputEndpoints = parsePathPatterns("JSON_OUTPUT_ENDPOINTS", server.config.JSONOutputEndpoints, server.logger)
+	mux := server.routes()
+
+	tests := []struct {
+		path, wantCache, wantContentType string
+	}{
+		{path: "/maps/api/geocode", wantCache: "MISS"},
+		{path: "/maps/api/geocode/", wantCache: "HIT", wantContentType: "application/json"},
+		{path: "/maps/api/geocode/xml", wantCache: "HIT", wantContentType: xmlContentType},
+		{path: "/maps/api/directions/xml", wantCache: "MISS"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path+"?address=Main", nil))
+		if got := w.Header().Get("X-Cache"); got != tt.wantCache {
+			t.Errorf("%s: expected X-Cache %s, got %s", tt.path, tt.wantCache, got)
+		}
+		if got := w.Header().Get("Content-Type"); tt.wantContentType != "" && !strings.HasPrefix(got, tt.wantContentType) {
+			t.Errorf("%s: expected Content-Type %s, got %s", tt.path, tt.wantContentType, got)
+		}
+	}
+	want := []string{"/geocode/json?", "/directions/xml?"}
+	if len(transport.urls) != len(want) {
+		t.Fatalf("Expected upstream requests for %v, got %v", want, transport.urls)
+	}
+	for i, u := range transport.urls {
+		if !strings.Contains(u, want[i]) {
+			t.Errorf("Expected upstream request %d for %s, got %s", i, want[i], u)
+		}
+	}
+}
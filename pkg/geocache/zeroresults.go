@@ -0,0 +1,163 @@
+package geocache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// zeroResultsBodies are the responses served for queries the filter knows to
+// return nothing, per endpoint with a top-level ZERO_RESULTS status.
+var zeroResultsBodies = map[string][]byte{
+	geocodePath:    []byte(`{"results":[],"status":"ZERO_RESULTS"}`),
+	directionsPath: []byte(`{"geocoded_waypoints":[],"routes":[],"status":"ZERO_RESULTS"}`),
+}
+
+// zeroResultsFilter is a Bloom filter of the cache keys of queries that
+// recently returned ZERO_RESULTS, kept in Redis bitmaps so all instances
+// share it. Keys are added to the generation of the current period and looked
+// up in it and the previous one, so an entry is remembered for one to two
+// periods. Each generation is sized for half the false-positive budget, which
+// keeps the rate of the pair within it.
+type zeroResultsFilter struct {
+	client *redis.Client
+	prefix string
+	period time.Duration
+	bits   uint64
+	hashes int
+	clock  Clock
+}
+
+func newZeroResultsFilter(client *redis.Client, prefix string, capacity int, fpRate float64, period time.Duration, clock Clock) *zeroResultsFilter {
+	if capacity <= 0 {
+		capacity = 100000
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.001
+	}
+	if period <= 0 {
+		period = 24 * time.Hour
+	}
+	bits, hashes := bloomSize(capacity, fpRate/2)
+	return &zeroResultsFilter{client: client, prefix: prefix, period: period, bits: bits, hashes: hashes, clock: clock}
+}
+
+// bloomSize returns the number of bits and hash functions of a Bloom filter
+// holding n elements at false-positive rate p.
+func bloomSize(n int, p float64) (uint64, int) {
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return uint64(m), k
+}
+
+// offsets returns the bit positions of key, derived by double hashing.
+func (f *zeroResultsFilter) offsets(key string) []int64 {
+	sum := sha256.Sum256([]byte(key))
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+	offsets := make([]int64, f.hashes)
+	for i := range offsets {
+		offsets[i] = int64((h1 + uint64(i)*h2) % f.bits)
+	}
+	return offsets
+}
+
+func (f *zeroResultsFilter) generationKey(gen int64) string {
+	return f.prefix + strconv.FormatInt(gen, 10)
+}
+
+func (f *zeroResultsFilter) generation(now time.Time) int64 {
+	return now.Unix() / int64(f.period/time.Second)
+}
+
+// Add records that key returned ZERO_RESULTS.
+func (f *zeroResultsFilter) Add(ctx context.Context, key string) error {
+	genKey := f.generationKey(f.generation(f.clock.Now()))
+	pipe := f.client.Pipeline()
+	for _, offset := range f.offsets(key) {
+		pipe.SetBit(ctx, genKey, offset, 1)
+	}
+	pipe.Expire(ctx, genKey, 2*f.period)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Contains reports whether key probably returned ZERO_RESULTS recently.
+func (f *zeroResultsFilter) Contains(ctx context.Context, key string) (bool, error) {
+	gen := f.generation(f.clock.Now())
+	offsets := f.offsets(key)
+	pipe := f.client.Pipeline()
+	cmds := make([][]*redis.IntCmd, 2)
+	for i := range cmds {
+		genKey := f.generationKey(gen - int64(i))
+		for _, offset := range offsets {
+			cmds[i] = append(cmds[i], pipe.GetBit(ctx, genKey, offset))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	for _, gen := range cmds {
+		found := true
+		for _, cmd := range gen {
+			if cmd.Val() == 0 {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isZeroResults reports whether body is a response with a ZERO_RESULTS
+// status.
+func isZeroResults(body []byte) bool {
+	var resp struct {
+		Status string `json:"status"`
+	}
+	return json.Unmarshal(body, &resp) == nil && resp.Status == "ZERO_RESULTS"
+}
+
+// knownZeroResults reports whether r is a query the filter remembers as
+// returning nothing.
+func (s *Server) knownZeroResults(r *http.Request, cacheKey string) bool {
+	if s.zeroResults == nil || zeroResultsBodies[r.URL.Path] == nil {
+		return false
+	}
+	found, err := s.zeroResults.Contains(r.Context(), cacheKey)
+	if err != nil {
+		s.logger.LogContext(r.Context(), LogWarning, "Failed to check the zero results filter: %v", err)
+		return false
+	}
+	return found
+}
+
+// serveZeroResults answers r without an upstream request.
+func (s *Server) serveZeroResults(w http.ResponseWriter, r *http.Request) {
+	body := zeroResultsBodies[r.URL.Path]
+	contentType := "application/json"
+	if wantsGeoJSON(r) {
+		if converted, ok := toGeoJSON(r.URL.Path, body); ok {
+			body, contentType = converted, geoJSONContentType
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Cache", "NEGATIVE")
+	w.Write(body)
+	if csw, ok := w.(*cacheStatusResponseWriter); ok {
+		csw.cacheStatus = "NEGATIVE"
+	}
+}
@@ -0,0 +1,93 @@
+package geocache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBloomSize(t *testing.T) {
+	bits, hashes := bloomSize(1000, 0.01)
+	if bits != 9586 || hashes != 7 {
+		t.Errorf("Expected 9586 bits and 7 hashes, got %d and %d", bits, hashes)
+	}
+}
+
+func TestZeroResultsFilter(t *testing.T) {
+	server, mr, cleanup := setupTestServer(t, nil)
+	defer cleanup()
+	clock := NewFrozenClock(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	f := newZeroResultsFilter(server.redis, "test:zero_results:", 1000, 0.01, time.Hour, clock)
+	ctx := context.Background()
+
+	for i := 0; i < 1000; i++ {
+		if err := f.Add(ctx, fmt.Sprintf("missing-%d", i)); err != nil {
+			t.Fatalf("Failed to add to the filter: %v", err)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if found, _ := f.Contains(ctx, fmt.Sprintf("missing-%d", i)); !found {
+			t.Fatalf("Expected missing-%d to be in the filter", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if found, _ := f.Contains(ctx, fmt.Sprintf("other-%d", i)); found {
+			falsePositives++
+		}
+	}
+	if falsePositives > 100 {
+		t.Errorf("Expected at most 1%% false positives, got %d in 10000", falsePositives)
+	}
+
+	// Entries are kept through the next generation, and forgotten once
+	// their generation is two periods old.
+	clock.Advance(time.Hour)
+	if found, _ := f.Contains(ctx, "missing-1"); !found {
+		t.Errorf("Expected entries of the previous generation to be kept")
+	}
+	clock.Advance(time.Hour)
+	mr.FastForward(2 * time.Hour)
+	if found, _ := f.Contains(ctx, "missing-1"); found {
+		t.Errorf("Expected expired entries to be forgotten")
+	}
+}
+
+func TestServer_Query_ZeroResultsFilter(t *testing.T) {
+	transport := &recordingTransport{body: `{"results":[],"status":"ZERO_RESULTS"}`}
+	server, mr, cleanup := setupTestServer(t, &http.Client{Transport: transport})
+	defer cleanup()
+	server.zeroResults = newZeroResultsFilter(server.redis, server.redisKey("zero_results:"), 1000, 0.001, time.Hour, systemClock{})
+
+	path := geocodePath + "?address=asdfgh&key=k"
+	wantCache := []string{"MISS", "NEGATIVE", "NEGATIVE"}
+	for i, want := range wantCache {
+		w := httptest.NewRecorder()
+		server.query(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Header().Get("X-Cache"); got != want {
+			t.Errorf("Request %d: expected X-Cache %s, got %s", i, want, got)
+		}
+		if w.Body.String() != `{"results":[],"status":"ZERO_RESULTS"}` {
+			t.Errorf("Request %d: unexpected body %s", i, w.Body.String())
+		}
+	}
+	if len(transport.urls) != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", len(transport.urls))
+	}
+	if mr.Exists(server.cacheKey(httptest.NewRequest(http.MethodGet, path, nil))) {
+		t.Errorf("Expected the ZERO_RESULTS response not to be cached")
+	}
+
+	// Endpoints without a top-level ZERO_RESULTS status are not filtered.
+	transport.body = `{"status":"OK","rows":[{"elements":[{"status":"ZERO_RESULTS"}]}]}`
+	matrix := distanceMatrixPath + "?origins=a&destinations=b"
+	for i := 0; i < 2; i++ {
+		server.query(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, matrix, nil))
+	}
+	if len(transport.urls) != 2 {
+		t.Errorf("Expected the distance matrix response to be cached, got %d upstream requests", len(transport.urls))
+	}
+}
@@ -1,22 +0,0 @@
-package main
-
-import (
-	"net/http"
-)
-
-type statusResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-func newStatusResponseWriter(w http.ResponseWriter) *statusResponseWriter {
-	return &statusResponseWriter{
-		ResponseWriter: w,
-		statusCode:     http.StatusOK, // Default to 200 if WriteHeader is never called
-	}
-}
-
-func (w *statusResponseWriter) WriteHeader(code int) {
-	w.statusCode = code
-	w.ResponseWriter.WriteHeader(code)
-}